@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"golang.org/x/term"
+
+	"shellrunner/pkg/client"
+)
+
+// detachKey is the key, Ctrl-], that detaches from a job attached to with
+// the attach command.
+const detachKey = 0x1d
+
+// attachJob attaches the local terminal to a running background job, until
+// the user detaches with the detach key or the job exits. Input is
+// forwarded to the job until stdin ends. It returns 0 after detaching, or
+// else the job's exit code.
+func attachJob(ctx context.Context, c *client.Client, id string) int {
+	stream, err := c.AttachJob(ctx, id)
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+	defer stream.Close()
+
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			log.Fatalf("failed to put terminal into raw mode: %v", err)
+		}
+		defer term.Restore(fd, state)
+
+		// Terminal jobs follow the local window size, as sessions do.
+		resized := make(chan os.Signal, 1)
+		notifyResize(resized)
+		go func() {
+			for range resized {
+				if cols, rows, err := term.GetSize(fd); err == nil {
+					c.Resize(ctx, id, uint16(rows), uint16(cols))
+				}
+			}
+		}()
+	}
+	fmt.Fprintf(os.Stderr, "Attached to job %s; press Ctrl-] to detach.\r\n", id)
+
+	detached := make(chan struct{})
+	go func() {
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if i := bytes.IndexByte(buf[:n], detachKey); i >= 0 {
+				stream.Write(buf[:i])
+				close(detached)
+				stream.Close()
+				return
+			}
+			if n > 0 {
+				if _, err := stream.Write(buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				// Keep watching the job's output once stdin ends.
+				return
+			}
+		}
+	}()
+	// The server closes the stream once the job exits.
+	io.Copy(os.Stdout, stream)
+
+	select {
+	case <-detached:
+		fmt.Fprintf(os.Stderr, "\r\nDetached from job %s, which is still running.\r\n", id)
+		return 0
+	default:
+	}
+	status, err := c.Wait(ctx, id)
+	if err != nil {
+		return 1
+	}
+	return exitCode(status)
+}
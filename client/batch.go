@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"shellrunner/pkg/client"
+)
+
+// batchCommand is a command read from a batch file.
+type batchCommand struct {
+	line    int
+	command string
+}
+
+// batchResult is the outcome of a command run by the batch command.
+type batchResult struct {
+	Line            int     `json:"line"`
+	Command         string  `json:"command"`
+	JobID           string  `json:"job_id,omitempty"`
+	Status          string  `json:"status,omitempty"`
+	ExitCode        *int    `json:"exit_code,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// readBatch reads the commands in file, or stdin if file is "-", one per
+// line. Blank lines and lines starting with # are skipped.
+func readBatch(file string) ([]batchCommand, error) {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var commands []batchCommand
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		command := strings.TrimSpace(scanner.Text())
+		if command == "" || strings.HasPrefix(command, "#") {
+			continue
+		}
+		commands = append(commands, batchCommand{line, command})
+	}
+	return commands, scanner.Err()
+}
+
+// batch runs commands as background jobs, at most parallel at a time, and
+// waits for them all. The results are in the order of the commands. Unless
+// keep is set, each job is released once it has finished.
+func batch(ctx context.Context, c *client.Client, commands []batchCommand, parallel int, keep bool) []batchResult {
+	results := make([]batchResult, len(commands))
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, command := range commands {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			result := &results[i]
+			result.Line, result.Command = command.line, command.command
+			var opts client.BackgroundOptions
+			opts.Command, opts.Argv = activeProfile.shellCommand(command.command)
+			id, err := c.Background(ctx, opts)
+			if err != nil {
+				result.Error = errorMessage(err)
+				return
+			}
+			result.JobID = id
+			status, err := c.Wait(ctx, id)
+			if err != nil {
+				result.Error = errorMessage(err)
+				return
+			}
+			result.Status, result.ExitCode, result.DurationSeconds = status.Status, status.ExitCode, status.DurationSeconds
+			if !keep {
+				c.Release(ctx, id)
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,974 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"shellrunner/pkg/client"
+)
+
+// command is a client subcommand.
+type command struct {
+	name    string
+	args    string // the positional arguments, for the usage line
+	summary string
+	// minArgs and maxArgs bound the number of positional arguments. A
+	// negative maxArgs means there is no upper bound.
+	minArgs, maxArgs int
+	// setup defines the command's flags on fs and returns the function that
+	// runs it with the positional arguments once they have been parsed. The
+	// function's result is printed as JSON.
+	setup func(fs *flag.FlagSet) func(ctx context.Context, c *client.Client, args []string) (interface{}, error)
+}
+
+// commands are the client's subcommands, in the order the help lists them.
+var commands = []command{
+	{
+		name: "run", args: "<command> | -argv <arg>...", minArgs: 1, maxArgs: -1,
+		summary: "Executes a command synchronously.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			keep := fs.Bool("keep", false, "keep the job on the server after it finishes")
+			pty := fs.Bool("pty", false, "run the command under a pseudo-terminal")
+			raw := fs.Bool("raw", false, "print the command's stdout and stderr as they are, and exit with its exit code")
+			quiet := fs.Bool("quiet", false, "print nothing, and exit with the command's exit code")
+			parseJSON := fs.Bool("parse-json", false, "also show the command's stdout parsed as JSON, as parsed")
+			encoding := fs.String("encoding", "", "encode the output as `text`, base64, or base64 if it is binary with auto")
+			cacheTTL := fs.Duration("cache-ttl", 0, "reuse the result of the same command if it succeeded within `duration`, and keep this one for as long")
+			argv := argvFlag(fs)
+			options := jobFlags(fs)
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				if *raw && *quiet {
+					return nil, usageError("-raw and -quiet cannot be used together")
+				}
+				if *cacheTTL < 0 {
+					return nil, usageError("-cache-ttl must not be negative")
+				}
+				opts := client.RunOptions{Keep: *keep, ParseJSON: *parseJSON, Encoding: *encoding, CacheTTL: cacheTTL.Seconds()}
+				if err := options(&opts); err != nil {
+					return nil, err
+				}
+				command, err := commandLine(ctx, c, args, *argv)
+				if err != nil {
+					return nil, err
+				}
+				opts.Command, opts.Argv = activeProfile.shellCommand(command)
+				opts.Pty = *pty
+				if *raw {
+					// Binary output would be mangled as text.
+					opts.Encoding = client.EncodingAuto
+				}
+				reply, err := c.Run(ctx, opts)
+				if err == nil && (*raw || *quiet) {
+					// Behave like the command itself, for use in scripts.
+					if *raw {
+						stdout, stderr, err := reply.Decode()
+						if err != nil {
+							return nil, err
+						}
+						os.Stdout.Write(stdout)
+						os.Stderr.Write(stderr)
+					}
+					if reply.Status == "failed_to_start" {
+						fmt.Fprintln(os.Stderr, reply.StartError)
+						os.Exit(127)
+					}
+					os.Exit(reply.ExitCode)
+				}
+				return reply, err
+			}
+		},
+	},
+	{
+		name: "background", args: "<command> | -argv <arg>...", minArgs: 1, maxArgs: -1,
+		summary: "Starts a background job, or a group of jobs on the given SSH hosts.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			pty := fs.Bool("pty", false, "run the command under a pseudo-terminal")
+			hosts := fs.String("hosts", "", "comma-separated SSH `hosts` to start the command on")
+			argv := argvFlag(fs)
+			options := jobFlags(fs)
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				var opts client.BackgroundOptions
+				if err := options(&opts); err != nil {
+					return nil, err
+				}
+				command, err := commandLine(ctx, c, args, *argv)
+				if err != nil {
+					return nil, err
+				}
+				opts.Command, opts.Argv = activeProfile.shellCommand(command)
+				opts.Pty = *pty
+				if *hosts != "" {
+					opts.Hosts = strings.Split(*hosts, ",")
+				}
+				id, err := c.Background(ctx, opts)
+				if len(opts.Hosts) > 0 {
+					return map[string]string{"group_id": id}, err
+				}
+				return map[string]string{"job_id": id}, err
+			}
+		},
+	},
+	{
+		name: "validate", args: "<command|->", minArgs: 1, maxArgs: 1,
+		summary: "Checks the syntax of a command, or of a script read from stdin, with the server's shell without running it.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				command := args[0]
+				if command == "-" {
+					script, err := io.ReadAll(os.Stdin)
+					if err != nil {
+						return nil, err
+					}
+					command = string(script)
+				}
+				result, err := c.Validate(ctx, command)
+				if err != nil {
+					return nil, err
+				}
+				printResult(result)
+				if !result.Valid {
+					os.Exit(1)
+				}
+				os.Exit(0)
+				return nil, nil
+			}
+		},
+	},
+	{
+		name: "batch", minArgs: 0, maxArgs: 0,
+		summary: "Runs each line of a file as a background job, waits for them all, and summarizes their exit codes.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			file := fs.String("file", "-", "the `file` of commands, one per line, or - for stdin")
+			parallel := fs.Int("parallel", 4, "how many of the commands to run at once")
+			keep := fs.Bool("keep", false, "keep the jobs on the server, to read their output later")
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				if *parallel < 1 {
+					return nil, usageError("-parallel must be at least 1")
+				}
+				commands, err := readBatch(*file)
+				if err != nil {
+					return nil, err
+				}
+				results := batch(ctx, c, commands, *parallel, *keep)
+				printResult(results)
+				for _, result := range results {
+					if result.Error != "" || result.ExitCode == nil || *result.ExitCode != 0 {
+						os.Exit(1)
+					}
+				}
+				os.Exit(0)
+				return nil, nil
+			}
+		},
+	},
+	{
+		name: "rerun", args: "<job_id>", minArgs: 1, maxArgs: 1,
+		summary: "Starts a new background job with the same command and options as a previous job, even a released one.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				id, err := c.Rerun(ctx, args[0])
+				return map[string]string{"job_id": id}, err
+			}
+		},
+	},
+	{
+		name: "status", args: "<job_id>", minArgs: 1, maxArgs: 1,
+		summary: "Checks a job's status.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				return c.Status(ctx, args[0])
+			}
+		},
+	},
+	{
+		name: "output", args: "<job_id>", minArgs: 1, maxArgs: 1,
+		summary: "Retrieves a job's output.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			release := fs.Bool("release", false, "release the job once its output has been read")
+			encoding := fs.String("encoding", "", "encode the output as `text`, base64, or base64 if it is binary with auto")
+			filter := filterFlags(fs)
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				return c.OutputWith(ctx, client.OutputOptions{ID: args[0], Release: *release, Filter: filter(), Encoding: *encoding})
+			}
+		},
+	},
+	{
+		name: "since", args: "<job_id>", minArgs: 1, maxArgs: 1,
+		summary: "Retrieves new output from a job since the last read.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				return c.Since(ctx, args[0])
+			}
+		},
+	},
+	{
+		name: "diff", args: "<job_id> <job_id>", minArgs: 2, maxArgs: 2,
+		summary: "Compares the output of two jobs.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			stderr := fs.Bool("stderr", false, "compare the jobs' stderr as well as their stdout")
+			lines := fs.Int("context", client.DefaultDiffContext, "show `n` unchanged lines around each change")
+			raw := fs.Bool("raw", false, "print the diffs as they are, and exit with status 1 if they are not empty, like diff")
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				reply, err := c.Diff(ctx, client.DiffOptions{A: args[0], B: args[1], Stderr: *stderr, Context: lines})
+				if err == nil && *raw {
+					os.Stdout.WriteString(reply.Stdout)
+					os.Stdout.WriteString(reply.Stderr)
+					if !reply.Identical {
+						os.Exit(1)
+					}
+					os.Exit(0)
+				}
+				return reply, err
+			}
+		},
+	},
+	{
+		name: "grep", args: "<pattern>", minArgs: 1, maxArgs: 1,
+		summary: "Searches the output of the server's jobs for lines matching a regular expression.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			jobs := fs.String("jobs", "", "comma-separated IDs of the `jobs` to search, instead of all of them")
+			stream := fs.String("stream", "", "search only `stdout` or stderr")
+			lines := fs.Int("context", 0, "show `n` lines before and after each match")
+			limit := fs.Int("limit", 0, "return at most `n` matches; 1000 by default")
+			raw := fs.Bool("raw", false, "print job:stream:line:text for each match, and exit with status 1 if there are none, like grep")
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				opts := client.SearchOptions{Pattern: args[0], Stream: *stream, Context: *lines, Limit: *limit}
+				if *jobs != "" {
+					opts.IDs = strings.Split(*jobs, ",")
+				}
+				reply, err := c.Search(ctx, opts)
+				if err != nil {
+					return nil, err
+				}
+				if reply.Truncated {
+					fmt.Fprintf(os.Stderr, "Only the first %d matches are shown.\n", len(reply.Matches))
+				}
+				if !*raw {
+					return reply.Matches, nil
+				}
+				for _, match := range reply.Matches {
+					for i, line := range match.Before {
+						fmt.Printf("%s:%s-%d-%s\n", match.JobID, match.Stream, match.Line-len(match.Before)+i, line)
+					}
+					fmt.Printf("%s:%s:%d:%s\n", match.JobID, match.Stream, match.Line, match.Text)
+					for i, line := range match.After {
+						fmt.Printf("%s:%s-%d-%s\n", match.JobID, match.Stream, match.Line+1+i, line)
+					}
+				}
+				if len(reply.Matches) == 0 {
+					os.Exit(1)
+				}
+				os.Exit(0)
+				return nil, nil
+			}
+		},
+	},
+	{
+		name: "wait", args: "<job_id>", minArgs: 1, maxArgs: 1,
+		summary: "Waits for a job to finish, prints its status, and exits with its exit code.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			timeout := fs.Duration("timeout", 0, "give up after this long, exiting with status 124; 0 waits forever")
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				if *timeout > 0 {
+					var cancel context.CancelFunc
+					ctx, cancel = context.WithTimeout(ctx, *timeout)
+					defer cancel()
+				}
+				status, err := c.Wait(ctx, args[0])
+				if errors.Is(err, context.DeadlineExceeded) {
+					fmt.Fprintf(os.Stderr, "job %s still %s after %v\n", args[0], status.Status, *timeout)
+					os.Exit(124)
+				}
+				if err != nil {
+					return nil, err
+				}
+				printResult(status)
+				os.Exit(exitCode(status))
+				return nil, nil
+			}
+		},
+	},
+	{
+		name: "watch", args: "<job_id>", minArgs: 1, maxArgs: 1,
+		summary: "Shows a job's status and latest output, refreshed until it finishes.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			interval := fs.Duration("interval", time.Second, "how often to refresh")
+			lines := fs.Int("lines", 20, "how many of the last `lines` of output to show")
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				if *interval <= 0 || *lines < 0 {
+					return nil, usageError("-interval must be positive and -lines not negative")
+				}
+				status, err := watch(ctx, c, args[0], *interval, *lines)
+				if err != nil {
+					return nil, err
+				}
+				os.Exit(exitCode(status))
+				return nil, nil
+			}
+		},
+	},
+	{
+		name: "top", minArgs: 0, maxArgs: 0,
+		summary: "Shows the server's statistics and its running jobs, with their CPU and memory use, refreshed until interrupted.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			interval := fs.Duration("interval", 2*time.Second, "how often to refresh")
+			count := fs.Int("n", 0, "refresh only `n` times, such as 1 for a single snapshot")
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				if *interval <= 0 || *count < 0 {
+					return nil, usageError("-interval must be positive and -n not negative")
+				}
+				if err := top(ctx, c, *interval, *count); err != nil {
+					return nil, err
+				}
+				os.Exit(0)
+				return nil, nil
+			}
+		},
+	},
+	{
+		name: "kill", args: "[<job_id>]", minArgs: 0, maxArgs: 1,
+		summary: "Sends a signal to a running job, or to the jobs matching the filters once confirmed.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			signal := fs.String("signal", "KILL", "the `signal` to send, such as TERM or INT")
+			grace := fs.Duration("grace", 0, "send SIGKILL to the jobs still running `duration` after the signal")
+			targets := targetFlags(fs, "kill")
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				if *grace < 0 || (*grace > 0 && isKill(*signal)) {
+					return nil, usageError("-grace must be positive, and only applies to signals other than KILL")
+				}
+				ids, filtered, err := targets.resolve(ctx, c, args, "kill", "running", "paused")
+				if err != nil {
+					return nil, err
+				}
+				if !filtered {
+					if err := c.Kill(ctx, ids[0], *signal); err != nil {
+						return map[string]bool{"killed": false}, err
+					}
+					result := map[string]bool{"killed": true}
+					if *grace > 0 {
+						escalated, err := escalate(ctx, c, ids, *grace)
+						if err != nil {
+							return nil, err
+						}
+						result["escalated"] = len(escalated) > 0
+					}
+					return result, nil
+				}
+				result := controlJobs(ids, func(id string) error { return c.Kill(ctx, id, *signal) })
+				result.Escalated, err = escalate(ctx, c, result.Jobs, *grace)
+				return result, err
+			}
+		},
+	},
+	{
+		name: "pause", args: "[<job_id>]", minArgs: 0, maxArgs: 1,
+		summary: "Stops a running job, or the jobs matching the filters once confirmed, until they are resumed.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			targets := targetFlags(fs, "pause")
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				ids, filtered, err := targets.resolve(ctx, c, args, "pause", "running")
+				if err != nil {
+					return nil, err
+				}
+				if !filtered {
+					err := c.Pause(ctx, ids[0])
+					return map[string]bool{"paused": err == nil}, err
+				}
+				return controlJobs(ids, func(id string) error { return c.Pause(ctx, id) }), nil
+			}
+		},
+	},
+	{
+		name: "resume", args: "[<job_id>]", minArgs: 0, maxArgs: 1,
+		summary: "Continues a paused job, or the paused jobs matching the filters once confirmed.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			targets := targetFlags(fs, "resume")
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				ids, filtered, err := targets.resolve(ctx, c, args, "resume", "paused")
+				if err != nil {
+					return nil, err
+				}
+				if !filtered {
+					err := c.Resume(ctx, ids[0])
+					return map[string]bool{"resumed": err == nil}, err
+				}
+				return controlJobs(ids, func(id string) error { return c.Resume(ctx, id) }), nil
+			}
+		},
+	},
+	{
+		name: "stdin", args: "<job_id>", minArgs: 1, maxArgs: 1,
+		summary: "Forwards stdin, as it is read, to a running job started with -stdin-open, and closes the job's stdin at its end.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			keepOpen := fs.Bool("keep-open", false, "leave the job's stdin open at the end of stdin, for more input later")
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				buf := make([]byte, 32<<10)
+				var written int64
+				for {
+					n, err := os.Stdin.Read(buf)
+					if n > 0 {
+						if err := c.WriteStdin(ctx, args[0], buf[:n]); err != nil {
+							return nil, err
+						}
+						written += int64(n)
+					}
+					if err == io.EOF {
+						break
+					} else if err != nil {
+						return nil, err
+					}
+				}
+				if !*keepOpen {
+					if err := c.CloseStdin(ctx, args[0]); err != nil {
+						return nil, err
+					}
+				}
+				return map[string]int64{"written": written}, nil
+			}
+		},
+	},
+	{
+		name: "annotate", args: "<job_id> <key=value>", minArgs: 2, maxArgs: 2,
+		summary: "Adds a note to a job, or removes it with an empty value, and shows the job's annotations.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				key, value, ok := strings.Cut(args[1], "=")
+				if !ok {
+					return nil, usageError(fmt.Sprintf("invalid annotation %q: must be key=value", args[1]))
+				}
+				return c.Annotate(ctx, args[0], key, value)
+			}
+		},
+	},
+	{
+		name: "extend-timeout", args: "<job_id> <duration>", minArgs: 2, maxArgs: 2,
+		summary: "Gives a running job more time before its timeout kills it.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				extra, err := time.ParseDuration(args[1])
+				if err != nil || extra <= 0 {
+					return nil, usageError(fmt.Sprintf("invalid duration %q", args[1]))
+				}
+				deadline, err := c.ExtendTimeout(ctx, args[0], extra)
+				if err != nil {
+					return nil, err
+				}
+				return map[string]time.Time{"deadline": deadline}, nil
+			}
+		},
+	},
+	{
+		name: "kill-all", minArgs: 0, maxArgs: 0,
+		summary: "Sends a signal to every running job that matches the filters, or to all of them.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			signal := fs.String("signal", "KILL", "the `signal` to send, such as TERM or INT")
+			labels := make(keyValues)
+			fs.Var(labels, "label", "only signal jobs with the `label` key=value; may be repeated")
+			command := fs.String("command", "", "only signal jobs whose command matches `regexp`")
+			olderThan := fs.Duration("older-than", 0, "only signal jobs that started at least `duration` ago")
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				if *olderThan < 0 {
+					return nil, usageError("-older-than must not be negative")
+				}
+				opts := client.KillAllOptions{Command: *command, OlderThanSeconds: olderThan.Seconds(), Signal: *signal}
+				if len(labels) > 0 {
+					opts.Labels = labels
+				}
+				return c.KillAll(ctx, opts)
+			}
+		},
+	},
+	{
+		name: "release", args: "<job_id>", minArgs: 1, maxArgs: 1,
+		summary: "Releases a job.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				err := c.Release(ctx, args[0])
+				return map[string]bool{"released": err == nil}, err
+			}
+		},
+	},
+	{
+		name: "release-all", minArgs: 0, maxArgs: 0,
+		summary: "Releases all finished jobs.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				count, err := c.ReleaseAll(ctx)
+				return map[string]int{"released_count": count}, err
+			}
+		},
+	},
+	{
+		name: "list", minArgs: 0, maxArgs: 0,
+		summary: "Lists all jobs, or a page of them.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			limit := fs.Int("limit", 0, "list at most `n` jobs, with the total and the cursor of the next page")
+			after := fs.String("after", "", "list only the jobs after `job_id`, the cursor of the previous page")
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				if *limit < 0 {
+					return nil, usageError("-limit must not be negative")
+				}
+				if *limit == 0 && *after == "" {
+					return c.List(ctx)
+				}
+				return c.ListPage(ctx, client.ListOptions{Limit: *limit, AfterID: *after})
+			}
+		},
+	},
+	{
+		name: "group", args: "<group_id>", minArgs: 1, maxArgs: 1,
+		summary: "Lists the jobs of a group and their statuses.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				return c.Group(ctx, args[0])
+			}
+		},
+	},
+	{
+		name: "statistics", minArgs: 0, maxArgs: 0,
+		summary: "Shows server statistics.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				return c.Statistics(ctx)
+			}
+		},
+	},
+	{
+		name: "alerts", minArgs: 0, maxArgs: 0,
+		summary: "Shows the alerts raised about overrunning jobs, missed checks and slower or failing series of jobs, and the checks.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				return c.Alerts(ctx)
+			}
+		},
+	},
+	{
+		name: "trends", args: "[series]", minArgs: 0, maxArgs: 1,
+		summary: "Shows how the runs of each series of jobs have gone, or of one series.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				var series string
+				if len(args) == 1 {
+					series = args[0]
+				}
+				return c.Trends(ctx, series)
+			}
+		},
+	},
+	{
+		name: "top", minArgs: 0, maxArgs: 0,
+		summary: "Shows the running jobs using the most CPU, or memory with --by rss.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			by := fs.String("by", "cpu", "order the jobs by `cpu` or rss")
+			limit := fs.Int("limit", 10, "show at most `n` jobs; 0 shows all of them")
+			interval := fs.Duration("interval", time.Second, "how long to sample CPU use over")
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				return c.TopJobs(ctx, client.TopJobsOptions{By: *by, Limit: *limit, IntervalSeconds: interval.Seconds()})
+			}
+		},
+	},
+	{
+		name: "connections", minArgs: 0, maxArgs: 0,
+		summary: "Lists the server's open client connections.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				return c.Connections(ctx)
+			}
+		},
+	},
+	{
+		name: "info", minArgs: 0, maxArgs: 0,
+		summary: "Describes the server process.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				return c.Info(ctx)
+			}
+		},
+	},
+	{
+		name: "quota", minArgs: 0, maxArgs: 0,
+		summary: "Shows this client's quota and what its jobs take up of it.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				return c.Quota(ctx)
+			}
+		},
+	},
+	{
+		name: "admin-jobs", args: "[tenant]", minArgs: 0, maxArgs: 1,
+		summary: "Lists the jobs of every tenant, or of one, for admins.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				var tenant string
+				if len(args) == 1 {
+					tenant = args[0]
+				}
+				return c.AdminJobs(ctx, tenant)
+			}
+		},
+	},
+	{
+		name: "admin-kill", args: "<job_id>... | -tenant <tenant>", minArgs: 0, maxArgs: -1,
+		summary: "Sends a signal to jobs of any tenant, or to all of a tenant's, for admins.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			signal := fs.String("signal", "KILL", "the `signal` to send, such as TERM or INT")
+			tenant := fs.String("tenant", "", "signal every running job of `tenant`, such as token:ci, cert:deploy or uid:1000")
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				if (len(args) == 0) == (*tenant == "") {
+					return nil, usageError("give either job IDs or -tenant")
+				}
+				return c.AdminKill(ctx, client.AdminKillOptions{IDs: args, Tenant: *tenant, Signal: *signal})
+			}
+		},
+	},
+	{
+		name: "admin-release", args: "<job_id>... | -tenant <tenant>", minArgs: 0, maxArgs: -1,
+		summary: "Releases jobs of any tenant, or all of a tenant's, for admins.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			tenant := fs.String("tenant", "", "release every job of `tenant`, such as token:ci, cert:deploy or uid:1000")
+			force := fs.Bool("force", false, "kill the jobs that are still running and release them too")
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				if (len(args) == 0) == (*tenant == "") {
+					return nil, usageError("give either job IDs or -tenant")
+				}
+				return c.AdminRelease(ctx, client.AdminReleaseOptions{IDs: args, Tenant: *tenant, Force: *force})
+			}
+		},
+	},
+	{
+		name: "admin-quota", args: "<tenant>", minArgs: 1, maxArgs: 1,
+		summary: "Sets or removes a tenant's quota until the server restarts, for admins.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			maxRunning := fs.Int("max-running", 0, "the most jobs the tenant may have running, or 0 for no limit")
+			maxJobsPerHour := fs.Int("max-jobs-per-hour", 0, "the most jobs the tenant may submit an hour, or 0 for no limit")
+			maxBuffered := fs.Int64("max-buffered-bytes", 0, "the most bytes of output the tenant's jobs may hold in memory, or 0 for no limit")
+			remove := fs.Bool("remove", false, "remove the tenant's quota instead")
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				if *remove {
+					return c.AdminSetQuota(ctx, args[0], nil)
+				}
+				return c.AdminSetQuota(ctx, args[0], &client.Quota{MaxRunning: *maxRunning, MaxJobsPerHour: *maxJobsPerHour, MaxBufferedBytes: *maxBuffered})
+			}
+		},
+	},
+	{
+		name: "admin-tenants", minArgs: 0, maxArgs: 0,
+		summary: "Shows the statistics, quota and usage of each tenant, for admins.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				return c.AdminTenants(ctx)
+			}
+		},
+	},
+	{
+		name: "admin-backup", args: "<path>", minArgs: 1, maxArgs: 1,
+		summary: "Saves the server's jobs and quotas to a file on its host, for admins.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				return c.AdminBackup(ctx, args[0])
+			}
+		},
+	},
+	{
+		name: "admin-restore", args: "<path>", minArgs: 1, maxArgs: 1,
+		summary: "Restores the jobs and quotas of a backup on the server's host, for admins.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				return c.AdminRestore(ctx, args[0])
+			}
+		},
+	},
+	{
+		name: "maintain", minArgs: 0, maxArgs: 0,
+		summary: "Prunes and compacts what the server remembers besides its jobs, for admins.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				return c.Maintain(ctx)
+			}
+		},
+	},
+	{
+		name: "ping", minArgs: 0, maxArgs: 0,
+		summary: "Measures the round trip of calls to the server.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			count := fs.Int("count", 4, "how many pings to send")
+			interval := fs.Duration("interval", time.Second, "how long to wait between pings")
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				if *count < 1 {
+					return nil, usageError("-count must be at least 1")
+				}
+				return ping(ctx, c, *count, *interval)
+			}
+		},
+	},
+	{
+		name: "export", minArgs: 0, maxArgs: 0,
+		summary: "Writes all the server's jobs and their output to a JSON archive.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			file := fs.String("file", "-", "the `file` to write the archive to, or - for stdout")
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				archive, err := c.Export(ctx)
+				if err != nil {
+					return nil, err
+				}
+				data, err := json.MarshalIndent(archive, "", "  ")
+				if err != nil {
+					return nil, err
+				}
+				data = append(data, '\n')
+				if *file == "-" {
+					_, err = os.Stdout.Write(data)
+				} else {
+					err = os.WriteFile(*file, data, 0o600)
+				}
+				if err != nil {
+					return nil, err
+				}
+				os.Exit(0)
+				return nil, nil
+			}
+		},
+	},
+	{
+		name: "import", minArgs: 0, maxArgs: 0,
+		summary: "Adds the jobs of an archive written by export, and shows the new IDs they were given.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			file := fs.String("file", "-", "the `file` to read the archive from, or - for stdin")
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				var data []byte
+				var err error
+				if *file == "-" {
+					data, err = io.ReadAll(os.Stdin)
+				} else {
+					data, err = os.ReadFile(*file)
+				}
+				if err != nil {
+					return nil, err
+				}
+				var archive client.Archive
+				if err := json.Unmarshal(data, &archive); err != nil {
+					return nil, fmt.Errorf("invalid archive: %w", err)
+				}
+				return c.Import(ctx, archive)
+			}
+		},
+	},
+	{
+		name: "set-secret", args: "<name>", minArgs: 1, maxArgs: 1,
+		summary: "Stores a secret for jobs to use, reading its value from stdin so that it stays out of shell history.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				value, err := io.ReadAll(os.Stdin)
+				if err != nil {
+					return nil, err
+				}
+				// A value typed or piped in ends with a newline that is not
+				// part of it.
+				err = c.SetSecret(ctx, args[0], strings.TrimSuffix(string(value), "\n"))
+				return map[string]bool{"set": err == nil}, err
+			}
+		},
+	},
+	{
+		name: "delete-secret", args: "<name>", minArgs: 1, maxArgs: 1,
+		summary: "Removes a secret.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				err := c.DeleteSecret(ctx, args[0])
+				return map[string]bool{"deleted": err == nil}, err
+			}
+		},
+	},
+	{
+		name: "secrets", minArgs: 0, maxArgs: 0,
+		summary: "Lists the names of the stored secrets.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				return c.ListSecrets(ctx)
+			}
+		},
+	},
+	{
+		name: "put", args: "<local_file|-> <remote_path>", minArgs: 2, maxArgs: 2,
+		summary: "Uploads a file, such as a script or an input for a job, to an absolute path on the server.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			mode := fs.String("mode", "", "the octal permissions of the remote file; those of the local file by default")
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				perm := os.FileMode(0o644)
+				var r io.Reader = os.Stdin
+				if args[0] != "-" {
+					f, err := os.Open(args[0])
+					if err != nil {
+						return nil, err
+					}
+					defer f.Close()
+					info, err := f.Stat()
+					if err != nil {
+						return nil, err
+					}
+					perm, r = info.Mode().Perm(), f
+				}
+				if *mode != "" {
+					m, err := strconv.ParseUint(*mode, 8, 32)
+					if err != nil || m > 0o777 {
+						return nil, usageError(fmt.Sprintf("invalid mode %q", *mode))
+					}
+					perm = os.FileMode(m)
+				}
+				size, err := c.PutFile(ctx, args[1], r, perm)
+				if err != nil {
+					return nil, err
+				}
+				return map[string]int64{"size": size}, nil
+			}
+		},
+	},
+	{
+		name: "get", args: "<remote_path> <local_file|->", minArgs: 2, maxArgs: 2,
+		summary: "Downloads a file, such as an artifact a job wrote, from the server.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				if args[1] == "-" {
+					if _, err := c.GetFile(ctx, args[0], os.Stdout); err != nil {
+						return nil, err
+					}
+					os.Exit(0)
+				}
+				f, err := os.Create(args[1])
+				if err != nil {
+					return nil, err
+				}
+				defer f.Close()
+				mode, err := c.GetFile(ctx, args[0], f)
+				if err != nil {
+					return nil, err
+				}
+				if err := f.Chmod(mode); err != nil {
+					return nil, err
+				}
+				if err := f.Close(); err != nil {
+					return nil, err
+				}
+				info, err := os.Stat(args[1])
+				if err != nil {
+					return nil, err
+				}
+				return map[string]int64{"size": info.Size()}, nil
+			}
+		},
+	},
+	{
+		name: "artifacts", args: "<job_id>", minArgs: 1, maxArgs: 1,
+		summary: "Lists the artifacts a job has left, for get to download.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				return c.Artifacts(ctx, args[0])
+			}
+		},
+	},
+	{
+		name: "resize", args: "<job_id> <rows> <cols>", minArgs: 3, maxArgs: 3,
+		summary: "Resizes a terminal job.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				rows, err := strconv.ParseUint(args[1], 10, 16)
+				if err != nil {
+					return nil, usageError(fmt.Sprintf("invalid rows %q", args[1]))
+				}
+				cols, err := strconv.ParseUint(args[2], 10, 16)
+				if err != nil {
+					return nil, usageError(fmt.Sprintf("invalid cols %q", args[2]))
+				}
+				err = c.Resize(ctx, args[0], uint16(rows), uint16(cols))
+				return map[string]bool{"resized": err == nil}, err
+			}
+		},
+	},
+	{
+		name: "shell", minArgs: 0, maxArgs: 0,
+		summary: "Opens a prompt that runs each line entered on the server.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				if err := shell(ctx, c); err != nil {
+					return nil, err
+				}
+				os.Exit(0)
+				return nil, nil
+			}
+		},
+	},
+	{
+		name: "attach", args: "<job_id>", minArgs: 1, maxArgs: 1,
+		summary: "Attaches the local terminal to a running background job, until Ctrl-] detaches it or the job exits.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				// attach streams the job's output and does not print a
+				// JSON result.
+				os.Exit(attachJob(ctx, c, args[0]))
+				return nil, nil
+			}
+		},
+	},
+	{
+		name: "exec", args: "[command]", minArgs: 0, maxArgs: 1,
+		summary: "Opens an interactive session running command, or a shell, attached to the local terminal.",
+		setup: func(fs *flag.FlagSet) func(context.Context, *client.Client, []string) (interface{}, error) {
+			return func(ctx context.Context, c *client.Client, args []string) (interface{}, error) {
+				// exec attaches the local terminal and does not print a JSON
+				// result.
+				command := ""
+				if len(args) > 0 {
+					command = args[0]
+				}
+				os.Exit(execSession(ctx, c, command))
+				return nil, nil
+			}
+		},
+	},
+}
+
+// lookupCommand returns the command called name, or nil if there is none.
+func lookupCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// usageError is an error in how a command was invoked, as opposed to one
+// returned by the server.
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// parseArgs parses the flags in args, which may come before, after or
+// between the positional arguments, and returns the positional arguments. As
+// usual, everything after "--" is positional.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for len(args) > 0 {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		if len(rest) == 0 {
+			break
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+	return positional, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+
+	"shellrunner/pkg/client"
+)
+
+// config is the client's configuration file, which defines named profiles
+// for the servers it talks to:
+//
+//	default: laptop
+//	profiles:
+//	  laptop:
+//	    socket: /run/user/1000/shellrunner.sock
+//	    shell: zsh
+//	  build:
+//	    address: build.example.com:7443
+//	    tls:
+//	      ca: /etc/shellrunner/ca.pem
+//	    token: s3cret
+type config struct {
+	// Default names the profile used when none is selected.
+	Default  string             `yaml:"default"`
+	Profiles map[string]profile `yaml:"profiles"`
+}
+
+// profile describes how to reach a server and run commands on it.
+type profile struct {
+	Socket string `yaml:"socket"` // Unix socket, or named pipe on Windows
+	// Instance names a server on this host by its -instance, reaching its
+	// default socket.
+	Instance string `yaml:"instance"`
+	// Shell, if set, runs commands as "<shell> -c <command>" instead of
+	// with the server's own shell.
+	Shell string `yaml:"shell"`
+
+	// Address is the host:port of a server's tls listener, reached instead
+	// of a socket, with TLS setting how its certificate is verified.
+	Address string     `yaml:"address"`
+	TLS     *tlsConfig `yaml:"tls"`
+	// Token is presented to servers whose listener requires one.
+	// SHELLRUNNER_TOKEN overrides it.
+	Token string `yaml:"token"`
+	// Agent names the client to the server, which records it with the
+	// jobs it submits. SHELLRUNNER_AGENT overrides it.
+	Agent string `yaml:"agent"`
+}
+
+// endpoint returns the address the client dials to reach the server of p:
+// its socket, the socket of its instance, or its TCP address prefixed with
+// "tls:".
+func (p profile) endpoint() string {
+	if p.Address != "" {
+		return "tls:" + p.Address
+	}
+	if p.Instance != "" {
+		return client.InstanceSocketPath(p.Instance)
+	}
+	return p.Socket
+}
+
+// dialer configures d to authenticate with the token and TLS settings of p,
+// and to identify as its agent.
+func (p profile) dialer(d *client.Dialer) error {
+	d.Token = p.Token
+	if token := os.Getenv("SHELLRUNNER_TOKEN"); token != "" {
+		d.Token = token
+	}
+	d.Agent = p.Agent
+	if agent := os.Getenv("SHELLRUNNER_AGENT"); agent != "" {
+		d.Agent = agent
+	}
+	if p.TLS == nil {
+		return nil
+	}
+	tlsConfig, err := p.TLS.load()
+	if err != nil {
+		return err
+	}
+	d.TLSConfig = tlsConfig
+	return nil
+}
+
+// tlsConfig holds the certificates for a TLS connection.
+type tlsConfig struct {
+	CA         string `yaml:"ca"`
+	Cert       string `yaml:"cert"`
+	Key        string `yaml:"key"`
+	ServerName string `yaml:"server_name"`
+}
+
+// load returns the TLS configuration c describes. Without a CA, the
+// server's certificate is verified against the system's roots.
+func (c *tlsConfig) load() (*tls.Config, error) {
+	config := &tls.Config{ServerName: c.ServerName, MinVersion: tls.VersionTLS12}
+	if c.CA != "" {
+		pem, err := os.ReadFile(c.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", c.CA)
+		}
+	}
+	if c.Cert != "" || c.Key != "" {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// configPath returns the path of the configuration file: SHELLRUNNER_CONFIG,
+// or shellrunner/config.yaml in the user's configuration directory, such as
+// ~/.config on Linux.
+func configPath() (string, error) {
+	if path := os.Getenv("SHELLRUNNER_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "shellrunner", "config.yaml"), nil
+}
+
+// loadConfig reads the configuration file at path. A missing file is an
+// empty configuration.
+func loadConfig(path string) (*config, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cfg config
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// connection returns the socket to connect to and the profile to use it
+// with. The socket is the -socket flag, or else the socket of the -instance
+// flag, or else the endpoint of the profile selected with -profile or
+// SHELLRUNNER_PROFILE, or else SHELLRUNNER_SOCKET_PATH, or else the socket
+// of SHELLRUNNER_INSTANCE, or else the endpoint of the default profile.
+func connection(socketFlag, instanceFlag, profileFlag string) (string, profile, error) {
+	path, err := configPath()
+	if err != nil {
+		return "", profile{}, err
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return "", profile{}, err
+	}
+
+	name := profileFlag
+	if name == "" {
+		name = os.Getenv("SHELLRUNNER_PROFILE")
+	}
+	selected := name != ""
+	if name == "" {
+		name = cfg.Default
+	}
+	var p profile
+	if name != "" {
+		var ok bool
+		if p, ok = cfg.Profiles[name]; !ok {
+			return "", profile{}, fmt.Errorf("no profile %q in %s", name, path)
+		}
+		set := 0
+		for _, endpoint := range []string{p.Socket, p.Instance, p.Address} {
+			if endpoint != "" {
+				set++
+			}
+		}
+		if set > 1 {
+			return "", profile{}, fmt.Errorf("profile %q: only one of socket, instance and address can be set", name)
+		}
+	}
+
+	socket := socketFlag
+	if socket == "" && instanceFlag != "" {
+		socket = client.InstanceSocketPath(instanceFlag)
+	}
+	if socket == "" && selected {
+		socket = p.endpoint()
+	}
+	if socket == "" {
+		socket = os.Getenv("SHELLRUNNER_SOCKET_PATH")
+	}
+	if instance := os.Getenv("SHELLRUNNER_INSTANCE"); socket == "" && instance != "" {
+		socket = client.InstanceSocketPath(instance)
+	}
+	if socket == "" {
+		socket = p.endpoint()
+	}
+	return socket, p, nil
+}
+
+// shellCommand returns the command and argv to run command with the
+// profile's shell, if it has one.
+func (p profile) shellCommand(command string) (string, []string) {
+	if p.Shell == "" {
+		return command, nil
+	}
+	return "", []string{p.Shell, "-c", command}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+
+	"golang.org/x/term"
+
+	"shellrunner/pkg/client"
+)
+
+// execSession starts an interactive session on the server running command, or
+// the server's shell when command is empty, and connects the local terminal to
+// it until it exits. It returns the session's exit code.
+func execSession(ctx context.Context, c *client.Client, command string) int {
+	fd := int(os.Stdin.Fd())
+	var execArgs client.ExecOptions
+	if command != "" {
+		execArgs.Command, execArgs.Argv = activeProfile.shellCommand(command)
+	} else if activeProfile.Shell != "" {
+		execArgs.Argv = []string{activeProfile.Shell}
+	}
+	if cols, rows, err := term.GetSize(fd); err == nil {
+		execArgs.Rows, execArgs.Cols = uint16(rows), uint16(cols)
+	}
+
+	id, err := c.Exec(ctx, execArgs)
+	if err != nil {
+		log.Fatalf("rpc error calling exec: %v", err)
+	}
+
+	// The session's terminal is carried over a second, raw connection.
+	stream, err := c.Attach(ctx, id)
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+	defer stream.Close()
+
+	if term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			log.Fatalf("failed to put terminal into raw mode: %v", err)
+		}
+		defer term.Restore(fd, state)
+	}
+
+	// Propagate local window size changes to the remote terminal.
+	resized := make(chan os.Signal, 1)
+	notifyResize(resized)
+	go func() {
+		for range resized {
+			if cols, rows, err := term.GetSize(fd); err == nil {
+				c.Resize(ctx, id, uint16(rows), uint16(cols))
+			}
+		}
+	}()
+
+	go io.Copy(stream, os.Stdin)
+	// The server closes the stream once the session's job exits.
+	io.Copy(os.Stdout, stream)
+
+	status, err := c.Status(ctx, id)
+	if err != nil {
+		return 1
+	}
+	c.Release(ctx, id)
+	return exitCode(status)
+}
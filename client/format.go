@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+)
+
+// formats are the output formats of -format.
+var formats = []string{"table", "wide", "json", "jsonl", "yaml"}
+
+// outputFormat is the format results are printed in.
+var outputFormat string
+
+// defaultFormat returns the output format to use when -format is not given:
+// a table for people at a terminal, and JSON for programs.
+func defaultFormat() string {
+	if term.IsTerminal(int(os.Stdout.Fd())) {
+		return "table"
+	}
+	return "json"
+}
+
+// printResult prints a command's result in the output format.
+func printResult(result interface{}) {
+	if outputFormat == "json" || outputFormat == "" {
+		prettyJSON, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			log.Fatal("json marshal error:", err)
+		}
+		fmt.Printf("%s\n", prettyJSON)
+		return
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		log.Fatal("json marshal error:", err)
+	}
+	if outputFormat == "jsonl" {
+		writeJSONLines(os.Stdout, data)
+		return
+	}
+
+	// The other formats work from the JSON encoding, parsed as YAML, so that
+	// they show the same keys as JSON in the same order.
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		log.Fatal("yaml error:", err)
+	}
+	node := doc.Content[0]
+	if outputFormat == "yaml" {
+		resetStyle(node)
+		encoder := yaml.NewEncoder(os.Stdout)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(node); err != nil {
+			log.Fatal("yaml error:", err)
+		}
+		return
+	}
+	writeTable(os.Stdout, node, outputFormat == "wide")
+}
+
+// writeJSONLines writes each element of a JSON array on a line of its own,
+// or any other JSON value on a single line.
+func writeJSONLines(w io.Writer, data []byte) {
+	var elements []json.RawMessage
+	if err := json.Unmarshal(data, &elements); err != nil {
+		elements = []json.RawMessage{data}
+	}
+	for _, element := range elements {
+		fmt.Fprintf(w, "%s\n", element)
+	}
+}
+
+// resetStyle gives node and its children the default YAML style, instead of
+// the JSON style they were parsed with.
+func resetStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		resetStyle(child)
+	}
+}
+
+// maxCellWidth is the width cells are truncated to in the table format, but
+// not the wide one.
+const maxCellWidth = 60
+
+// writeTable writes node as a table: a list of objects with a column for
+// each key, any other list with a single column, and an object with a row
+// for each key. Null is an empty list.
+func writeTable(w io.Writer, node *yaml.Node, wide bool) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	defer tw.Flush()
+	row := func(cells ...string) {
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	cell := func(node *yaml.Node) string {
+		return tableCell(node, wide)
+	}
+
+	switch node.Kind {
+	case yaml.SequenceNode, yaml.ScalarNode:
+		if node.Kind == yaml.ScalarNode && node.Tag != "!!null" {
+			row(cell(node))
+			return
+		}
+		if len(node.Content) == 0 {
+			fmt.Fprintln(tw, "No results.")
+			return
+		}
+		var columns []string
+		index := make(map[string]int)
+		for _, element := range node.Content {
+			if element.Kind != yaml.MappingNode {
+				columns = nil
+				break
+			}
+			for i := 0; i < len(element.Content); i += 2 {
+				key := element.Content[i].Value
+				if _, ok := index[key]; !ok {
+					index[key] = len(columns)
+					columns = append(columns, key)
+				}
+			}
+		}
+		if columns == nil {
+			row("VALUE")
+			for _, element := range node.Content {
+				row(cell(element))
+			}
+			return
+		}
+		header := make([]string, len(columns))
+		for i, column := range columns {
+			header[i] = strings.ToUpper(column)
+		}
+		row(header...)
+		for _, element := range node.Content {
+			cells := make([]string, len(columns))
+			for i := 0; i < len(element.Content); i += 2 {
+				cells[index[element.Content[i].Value]] = cell(element.Content[i+1])
+			}
+			row(cells...)
+		}
+	case yaml.MappingNode:
+		row("KEY", "VALUE")
+		for i := 0; i < len(node.Content); i += 2 {
+			row(node.Content[i].Value, cell(node.Content[i+1]))
+		}
+	}
+}
+
+// tableCell renders node as a table cell on a single line: scalars as they
+// are, and lists and objects as compact JSON.
+func tableCell(node *yaml.Node, wide bool) string {
+	var text string
+	switch {
+	case node.Kind == yaml.ScalarNode && node.Tag == "!!null":
+	case node.Kind == yaml.ScalarNode:
+		text = node.Value
+	default:
+		var value interface{}
+		if err := node.Decode(&value); err == nil {
+			data, _ := json.Marshal(value)
+			text = string(data)
+		}
+	}
+	text = strings.NewReplacer("\n", `\n`, "\t", `\t`, "\r", `\r`).Replace(text)
+	if runes := []rune(text); !wide && len(runes) > maxCellWidth {
+		text = string(runes[:maxCellWidth-3]) + "..."
+	}
+	return text
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+
+	"shellrunner/pkg/client"
+)
+
+// gracePollInterval is how often kill -grace checks whether the jobs it
+// signalled have exited.
+const gracePollInterval = 100 * time.Millisecond
+
+// jobTargets selects the jobs kill, pause and resume act on: the one named
+// by their argument or, without one, the jobs matching their filters, which
+// they confirm first.
+type jobTargets struct {
+	labels    keyValues
+	command   *string
+	olderThan *time.Duration
+	yes       *bool
+}
+
+// targetFlags defines the filters of a job control command on fs.
+func targetFlags(fs *flag.FlagSet, verb string) *jobTargets {
+	t := &jobTargets{labels: make(keyValues)}
+	fs.Var(t.labels, "label", "without a job ID, "+verb+" the jobs with the `label` key=value; may be repeated")
+	t.command = fs.String("command", "", "without a job ID, "+verb+" the jobs whose command matches `regexp`")
+	t.olderThan = fs.Duration("older-than", 0, "without a job ID, "+verb+" the jobs that started at least `duration` ago")
+	t.yes = fs.Bool("yes", false, "do not ask before acting on the jobs the filters match")
+	return t
+}
+
+// filtered reports whether any filters were given.
+func (t *jobTargets) filtered() bool {
+	return len(t.labels) > 0 || *t.command != "" || *t.olderThan != 0
+}
+
+// resolve returns the IDs of the jobs to act on, and whether they were
+// matched by filters: the job named by args, or the jobs in one of states
+// that the filters match, once the user has confirmed them.
+func (t *jobTargets) resolve(ctx context.Context, c *client.Client, args []string, verb string, states ...string) ([]string, bool, error) {
+	if len(args) == 1 {
+		if t.filtered() {
+			return nil, false, usageError("give either a job ID or filters, not both")
+		}
+		return args, false, nil
+	}
+	if !t.filtered() {
+		return nil, false, usageError("give a job ID, or filters to select jobs with")
+	}
+	if *t.olderThan < 0 {
+		return nil, false, usageError("-older-than must not be negative")
+	}
+	var command *regexp.Regexp
+	if *t.command != "" {
+		var err error
+		if command, err = regexp.Compile(*t.command); err != nil {
+			return nil, false, usageError(fmt.Sprintf("invalid -command: %v", err))
+		}
+	}
+
+	list, err := c.List(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	var ids []string
+	var matched []client.JobStatus
+	for _, entry := range list {
+		if !slices.Contains(states, entry.Status) {
+			continue
+		}
+		status, err := c.Status(ctx, entry.ID)
+		if notFound(err) {
+			// Released since it was listed.
+			continue
+		} else if err != nil {
+			return nil, false, err
+		}
+		if t.matches(status, command) {
+			ids = append(ids, entry.ID)
+			matched = append(matched, status)
+		}
+	}
+	if len(ids) == 0 || *t.yes {
+		return ids, true, nil
+	}
+	if err := confirm(verb, ids, matched); err != nil {
+		return nil, true, err
+	}
+	return ids, true, nil
+}
+
+// matches reports whether the filters, with command compiled, match the
+// job whose status is status, as KillAll's would.
+func (t *jobTargets) matches(status client.JobStatus, command *regexp.Regexp) bool {
+	if command != nil && !command.MatchString(commandOf(status)) {
+		return false
+	}
+	for key, value := range t.labels {
+		if status.Labels[key] != value {
+			return false
+		}
+	}
+	return time.Since(status.StartTime) >= *t.olderThan
+}
+
+// commandOf returns the command line of a job, joining its argv if it has
+// no command.
+func commandOf(status client.JobStatus) string {
+	if status.Command != "" {
+		return status.Command
+	}
+	return strings.Join(status.Argv, " ")
+}
+
+// confirm lists the jobs the filters matched and asks the user whether to
+// verb them, returning an error unless they agree. Without a terminal to
+// ask on, -yes is needed instead.
+func confirm(verb string, ids []string, matched []client.JobStatus) error {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return usageError(fmt.Sprintf("the filters match %d jobs; pass -yes to %s them without a terminal to confirm on", len(ids), verb))
+	}
+	fmt.Fprintf(os.Stderr, "The filters match %d jobs:\n", len(ids))
+	for i, id := range ids {
+		fmt.Fprintf(os.Stderr, "  %s\t%s\t%s\n", id, matched[i].Status, commandOf(matched[i]))
+	}
+	fmt.Fprintf(os.Stderr, "%s them? [y/N] ", strings.ToUpper(verb[:1])+verb[1:])
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return errors.New("cancelled")
+}
+
+// controlResult is what a job control command did to the jobs its filters
+// matched.
+type controlResult struct {
+	Jobs []string `json:"jobs"` // the jobs acted on, in order
+	// Escalated are the jobs kill -grace sent SIGKILL to once the grace
+	// period had passed.
+	Escalated []string          `json:"escalated,omitempty"`
+	Failed    map[string]string `json:"failed,omitempty"` // why acting on a job failed, keyed by its ID
+}
+
+// controlJobs calls act on each of ids, recording the outcome in result.
+func controlJobs(ids []string, act func(id string) error) controlResult {
+	result := controlResult{Jobs: []string{}}
+	for _, id := range ids {
+		if err := act(id); err != nil {
+			if result.Failed == nil {
+				result.Failed = make(map[string]string)
+			}
+			result.Failed[id] = err.Error()
+			continue
+		}
+		result.Jobs = append(result.Jobs, id)
+	}
+	return result
+}
+
+// notFound reports whether err is the server saying that a job does not
+// exist, such as one released since it was listed.
+func notFound(err error) bool {
+	var rpcErr *client.Error
+	return errors.As(err, &rpcErr) && rpcErr.Code == client.CodeJobNotFound
+}
+
+// isKill reports whether signal names SIGKILL, which cannot be escalated.
+func isKill(signal string) bool {
+	name := strings.TrimPrefix(strings.ToUpper(signal), "SIG")
+	return name == "KILL" || name == "9" || name == ""
+}
+
+// escalate waits up to grace for the jobs ids to exit after being
+// signalled, then sends SIGKILL to those still running, and returns them.
+// Without a grace period, it does nothing.
+func escalate(ctx context.Context, c *client.Client, ids []string, grace time.Duration) ([]string, error) {
+	if grace <= 0 {
+		return nil, nil
+	}
+	running := slices.Clone(ids)
+	deadline := time.Now().Add(grace)
+	for len(running) > 0 {
+		remaining := running[:0]
+		for _, id := range running {
+			status, err := c.Status(ctx, id)
+			if notFound(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if !status.Finished() {
+				remaining = append(remaining, id)
+			}
+		}
+		running = remaining
+		if len(running) == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(gracePollInterval)
+	}
+	var killed []string
+	for _, id := range running {
+		// A job that exits meanwhile cannot be killed, which is as good.
+		if err := c.Kill(ctx, id, "KILL"); err == nil {
+			killed = append(killed, id)
+		}
+	}
+	return killed, nil
+}
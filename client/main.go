@@ -2,140 +2,150 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
-	"net"
-	"net/rpc/jsonrpc"
 	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"shellrunner/pkg/client"
 )
 
-// RunArgs matches the server's argument struct for the Run method.
-type RunArgs struct {
-	Command string
-	Keep    bool
-}
-
-// OutputArgs matches the server's argument struct for the Output method.
-type OutputArgs struct {
-	ID      string
-	Release bool
-}
+// activeProfile is the profile the client is running commands with.
+var activeProfile profile
 
 func main() {
 	// Define flags
-	socketPath := flag.String("socket", os.Getenv("SHELLRUNNER_SOCKET_PATH"), "Path to the Unix socket. Defaults to SHELLRUNNER_SOCKET_PATH env var.")
+	socketPath := flag.String("socket", "", "Path to the Unix socket (or named pipe on Windows), or tls:host:port for a server's TLS listener. Overrides the profile and SHELLRUNNER_SOCKET_PATH.")
+	instance := flag.String("instance", "", "Name of a server on this host started with -instance, to connect to its socket. Overrides the profile and SHELLRUNNER_INSTANCE.")
+	agent := flag.String("agent", "", "Name to give the server for the jobs this client submits, such as nightly-backup. Overrides the profile and SHELLRUNNER_AGENT.")
+	retries := flag.Int("retries", 3, "How many times to retry a call on a new connection if the connection drops. Calls that may have reached the server are only retried if they are idempotent, such as status and list.")
+	retryDelay := flag.Duration("retry-delay", 100*time.Millisecond, "Delay before the first retry of a call, doubling after each one.")
+	format := flag.String("format", "", "Output format: "+strings.Join(formats, ", ")+". Defaults to table when stdout is a terminal, and json otherwise.")
+	profileName := flag.String("profile", "", "Server profile from the config file to use. Overrides SHELLRUNNER_PROFILE and the config file's default.")
+	flag.Usage = usage
 	flag.Parse()
 
-	args := flag.Args()
+	outputFormat = *format
+	if outputFormat == "" {
+		outputFormat = defaultFormat()
+	}
+	if !slices.Contains(formats, outputFormat) {
+		fmt.Fprintf(os.Stderr, "Unknown format: %s\n", outputFormat)
+		os.Exit(2)
+	}
 
-	// Basic command-line argument validation.
+	args := flag.Args()
 	if len(args) < 1 {
-		fmt.Println("Usage: go run client/main.go [-socket /path/to/socket] <method> [args...]")
-		fmt.Println("Methods: run, background, status, output, release, list, release-all, statistics, since")
+		usage()
+		os.Exit(2)
+	}
+	if args[0] == "help" {
+		if len(args) > 1 {
+			if cmd := lookupCommand(args[1]); cmd != nil {
+				fs := newFlagSet(cmd)
+				cmd.setup(fs)
+				fs.Usage()
+				return
+			}
+		}
+		usage()
 		return
 	}
 
-	if *socketPath == "" {
-		log.Fatal("Error: -socket flag or SHELLRUNNER_SOCKET_PATH environment variable must be set.")
+	cmd := lookupCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", args[0])
+		usage()
+		os.Exit(2)
 	}
-
-	// Connect to the server's unix socket.
-	client, err := net.Dial("unix", *socketPath)
+	fs := newFlagSet(cmd)
+	run := cmd.setup(fs)
+	positional, err := parseArgs(fs, args[1:])
 	if err != nil {
-		log.Fatal("dialing:", err)
+		// The flag set has already reported the error.
+		os.Exit(2)
+	}
+	if len(positional) < cmd.minArgs || (cmd.maxArgs >= 0 && len(positional) > cmd.maxArgs) {
+		fmt.Fprintf(os.Stderr, "%s: wrong number of arguments\n", cmd.name)
+		fs.Usage()
+		os.Exit(2)
 	}
-	defer client.Close()
 
-	// Create a new JSON-RPC client.
-	c := jsonrpc.NewClient(client)
+	socket, p, err := connection(*socketPath, *instance, *profileName)
+	if err != nil {
+		log.Fatal("Error: ", err)
+	}
+	if socket == "" {
+		log.Fatal("Error: -socket or -instance flag, a profile or the SHELLRUNNER_SOCKET_PATH or SHELLRUNNER_INSTANCE environment variable must be set.")
+	}
+	activeProfile = p
 
-	method := args[0]
-	var result interface{}
-	var callErr error
+	// Connect to the server's socket.
+	ctx := context.Background()
+	dialer := client.Dialer{Retries: *retries, RetryDelay: *retryDelay}
+	if *retries <= 0 {
+		dialer.Retries = -1
+	}
+	if err := p.dialer(&dialer); err != nil {
+		log.Fatal("Error: ", err)
+	}
+	if *agent != "" {
+		dialer.Agent = *agent
+	}
+	c, err := dialer.Dial(ctx, socket)
+	if err != nil {
+		log.Fatal("dialing:", err)
+	}
+	defer c.Close()
 
-	// Dispatch the RPC call based on the command-line arguments.
-	switch method {
-	case "run":
-		if len(args) < 2 {
-			log.Fatal("Usage: ... run <command> [--keep]")
-		}
-		runArgs := RunArgs{Command: args[1]}
-		if len(args) > 2 && args[2] == "--keep" {
-			runArgs.Keep = true
-		}
-		var reply map[string]interface{}
-		callErr = c.Call("ShellRunner.Run", runArgs, &reply)
-		result = reply
-	case "background":
-		if len(args) < 2 {
-			log.Fatal("Usage: ... background <command>")
-		}
-		var reply string
-		callErr = c.Call("ShellRunner.Background", args[1], &reply)
-		result = map[string]string{"job_id": reply}
-	case "status":
-		if len(args) < 2 {
-			log.Fatal("Usage: ... status <job_id>")
-		}
-		var reply map[string]interface{}
-		callErr = c.Call("ShellRunner.Status", args[1], &reply)
-		result = reply
-	case "output":
-		if len(args) < 2 {
-			log.Fatal("Usage: ... output <job_id> [--release]")
-		}
-		outputArgs := OutputArgs{ID: args[1]}
-		if len(args) > 2 && args[2] == "--release" {
-			outputArgs.Release = true
-		}
-		var reply map[string]interface{}
-		callErr = c.Call("ShellRunner.Output", outputArgs, &reply)
-		result = reply
-	case "release":
-		if len(args) < 2 {
-			log.Fatal("Usage: ... release <job_id>")
-		}
-		var reply bool
-		callErr = c.Call("ShellRunner.Release", args[1], &reply)
-		result = map[string]bool{"released": reply}
-	case "list":
-		var reply []struct {
-			ID     string
-			Status string
+	result, callErr := run(ctx, c, positional)
+	if callErr != nil {
+		var invalid usageError
+		if errors.As(callErr, &invalid) {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", cmd.name, invalid)
+			fs.Usage()
+			os.Exit(2)
 		}
-		callErr = c.Call("ShellRunner.List", struct{}{}, &reply)
-		result = reply
-	case "release-all":
-		var reply int
-		callErr = c.Call("ShellRunner.ReleaseAll", struct{}{}, &reply)
-		result = map[string]int{"released_count": reply}
-	case "statistics":
-		var reply map[string]interface{}
-		callErr = c.Call("ShellRunner.Statistics", struct{}{}, &reply)
-		result = reply
-	case "since":
-		if len(args) < 2 {
-			log.Fatal("Usage: ... since <job_id>")
+		var rpcErr *client.Error
+		if errors.As(callErr, &rpcErr) {
+			log.Fatalf("rpc error calling %s: %s: %s", cmd.name, rpcErr.Code, rpcErr.Message)
 		}
-		var reply map[string]interface{}
-		callErr = c.Call("ShellRunner.Since", args[1], &reply)
-		result = reply
-	default:
-		log.Fatalf("Unknown method: %s", method)
+		log.Fatalf("rpc error calling %s: %v", cmd.name, callErr)
 	}
 
+	printResult(result)
+}
 
-	if callErr != nil {
-		log.Fatalf("rpc error calling %s: %v", method, callErr)
+// usage prints the client's help, listing its commands.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage: go run ./client [-socket /path/to/socket] <command> [flags] [args...]")
+	fmt.Fprintln(out, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-12s %s\n", cmd.name, cmd.summary)
 	}
+	fmt.Fprintln(out, "\nRun 'go run ./client help <command>' for a command's flags.")
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+}
 
-	// Pretty-print the JSON response.
-	prettyJSON, err := json.MarshalIndent(result, "", "  ")
-	if err != nil {
-		log.Fatal("json marshal error:", err)
+// newFlagSet returns the flag set of cmd, whose usage describes cmd.
+func newFlagSet(cmd *command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: go run ./client [-socket /path/to/socket] %s [flags] %s\n\n%s\n", cmd.name, cmd.args, cmd.summary)
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintln(out, "\nFlags:")
+			fs.PrintDefaults()
+		}
 	}
-
-	fmt.Printf("%s\n", prettyJSON)
+	return fs
 }
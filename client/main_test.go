@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+
+	"shellrunner/pkg/client"
+)
+
+func TestParseArgs(t *testing.T) {
+	for _, tc := range []struct {
+		args       []string
+		positional []string
+		verbose    bool
+	}{
+		{nil, nil, false},
+		{[]string{"echo hi"}, []string{"echo hi"}, false},
+		{[]string{"-v", "echo hi"}, []string{"echo hi"}, true},
+		{[]string{"echo hi", "-v"}, []string{"echo hi"}, true},
+		{[]string{"a", "-v", "b"}, []string{"a", "b"}, true},
+		{[]string{"a", "--", "-v", "b"}, []string{"a", "-v", "b"}, false},
+	} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		verbose := fs.Bool("v", false, "")
+		positional, err := parseArgs(fs, tc.args)
+		if err != nil {
+			t.Fatalf("%q: expected no error, got %v", tc.args, err)
+		}
+		if !slices.Equal(positional, tc.positional) || *verbose != tc.verbose {
+			t.Errorf("%q: expected %q and -v %v, got %q and -v %v", tc.args, tc.positional, tc.verbose, positional, *verbose)
+		}
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	if _, err := parseArgs(fs, []string{"a", "-unknown"}); err == nil {
+		t.Error("expected an error for an unknown flag")
+	}
+}
+
+func TestJobFlags(t *testing.T) {
+	stdin := filepath.Join(t.TempDir(), "input")
+	if err := os.WriteFile(stdin, []byte("some input"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want client.JobOptions
+	}{
+		{nil, client.JobOptions{}},
+		{
+			[]string{"-env", "A=1", "-env", "B=x=y", "-label", "team=ops", "-secret", "TOKEN=deploy"},
+			client.JobOptions{Env: map[string]string{"A": "1", "B": "x=y"}, Labels: map[string]string{"team": "ops"}, Secrets: map[string]string{"TOKEN": "deploy"}},
+		},
+		{
+			[]string{"-timeout", "1m30s", "-idle-timeout", "500ms", "-idle-action", "flag"},
+			client.JobOptions{Timeout: 90, IdleTimeoutSeconds: 0.5, IdleAction: "flag"},
+		},
+		{
+			[]string{"-keep-workspace", "-artifact", "*.log", "-artifact", "out/*"},
+			client.JobOptions{Workspace: true, KeepWorkspace: true, Artifacts: []string{"*.log", "out/*"}},
+		},
+		{
+			[]string{"-success-codes", "0,3", "-forbid", "ERROR", "-min-runtime", "2s"},
+			client.JobOptions{Success: &client.SuccessOptions{ExitCodes: []int{0, 3}, Forbid: []string{"ERROR"}, MinRuntime: 2}},
+		},
+		{
+			[]string{"-check", "nightly", "-check-every", "24h"},
+			client.JobOptions{Expect: &client.ExpectOptions{Check: "nightly", Every: 86400}},
+		},
+		{
+			[]string{"-notify", "slack", "-notify", "pager:failure"},
+			client.JobOptions{Notify: []client.Notification{{Notifier: "slack"}, {Notifier: "pager", On: "failure"}}},
+		},
+		{
+			[]string{"-include", "^ok", "-strip-ansi"},
+			client.JobOptions{Filter: &client.OutputFilter{Include: []string{"^ok"}, StripANSI: true}},
+		},
+		{
+			[]string{"-stdin", stdin, "-stdin-open"},
+			client.JobOptions{Stdin: "some input", StdinOpen: true},
+		},
+	} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fill := jobFlags(fs)
+		if err := fs.Parse(append(tc.args, "-traceparent", "")); err != nil {
+			t.Fatalf("%q: expected no error, got %v", tc.args, err)
+		}
+		var opts client.JobOptions
+		if err := fill(&opts); err != nil {
+			t.Fatalf("%q: expected no error, got %v", tc.args, err)
+		}
+		if !reflect.DeepEqual(opts, tc.want) {
+			t.Errorf("%q: expected %+v, got %+v", tc.args, tc.want, opts)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-timeout", "-1s"},
+		{"-success-codes", "0,one"},
+	} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fill := jobFlags(fs)
+		if err := fs.Parse(args); err != nil {
+			t.Fatalf("%q: expected no error, got %v", args, err)
+		}
+		var usage usageError
+		if err := fill(&client.JobOptions{}); !errors.As(err, &usage) {
+			t.Errorf("%q: expected a usage error, got %v", args, err)
+		}
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	jobFlags(fs)
+	if err := fs.Parse([]string{"-env", "NOVALUE"}); err == nil {
+		t.Error("expected an error for -env without a value")
+	}
+}
+
+func TestWriteTable(t *testing.T) {
+	for _, tc := range []struct {
+		json string
+		wide bool
+		want string
+	}{
+		{`null`, false, "No results.\n"},
+		{`[]`, false, "No results.\n"},
+		{`"done"`, false, "done\n"},
+		{`["a", "b"]`, false, "VALUE\na\nb\n"},
+		{`{"id": "1", "tags": ["x", "y"]}`, false, "KEY   VALUE\nid    1\ntags  [\"x\",\"y\"]\n"},
+		{
+			`[{"id": "1", "status": "running"}, {"id": "2", "exit_code": 1}]`, false,
+			"ID  STATUS   EXIT_CODE\n1   running  \n2            1\n",
+		},
+		{`{"out": "line 1\nline 2"}`, false, "KEY  VALUE\nout  line 1\\nline 2\n"},
+		{`["` + strings.Repeat("x", 70) + `"]`, false, "VALUE\n" + strings.Repeat("x", 57) + "...\n"},
+		{`["` + strings.Repeat("x", 70) + `"]`, true, "VALUE\n" + strings.Repeat("x", 70) + "\n"},
+	} {
+		var doc yaml.Node
+		if err := yaml.Unmarshal([]byte(tc.json), &doc); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		writeTable(&out, doc.Content[0], tc.wide)
+		if out.String() != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.json, tc.want, out.String())
+		}
+	}
+}
+
+func TestWriteJSONLines(t *testing.T) {
+	for _, tc := range []struct {
+		json string
+		want string
+	}{
+		{`[{"id":"1"},{"id":"2"}]`, "{\"id\":\"1\"}\n{\"id\":\"2\"}\n"},
+		{`[]`, ""},
+		{`{"id":"1"}`, "{\"id\":\"1\"}\n"},
+		{`"done"`, "\"done\"\n"},
+	} {
+		var out bytes.Buffer
+		writeJSONLines(&out, []byte(tc.json))
+		if out.String() != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.json, tc.want, out.String())
+		}
+	}
+}
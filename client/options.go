@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"shellrunner/pkg/client"
+)
+
+// keyValues is a flag that may be repeated, each time with a key=value pair.
+type keyValues map[string]string
+
+func (kv keyValues) String() string {
+	pairs := make([]string, 0, len(kv))
+	for key, value := range kv {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (kv keyValues) Set(pair string) error {
+	key, value, ok := strings.Cut(pair, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("must be key=value")
+	}
+	kv[key] = value
+	return nil
+}
+
+// values is a flag that may be repeated, each time with another value.
+type values []string
+
+func (v *values) String() string {
+	return strings.Join(*v, ",")
+}
+
+func (v *values) Set(value string) error {
+	*v = append(*v, value)
+	return nil
+}
+
+// filterFlags defines the flags for an output filter on fs, and returns a
+// function that builds the filter from them, or returns nil if none is set.
+func filterFlags(fs *flag.FlagSet) func() *client.OutputFilter {
+	var include, exclude values
+	fs.Var(&include, "include", "keep only the output lines matching `regexp`; may be repeated")
+	fs.Var(&exclude, "exclude", "drop the output lines matching `regexp`; may be repeated")
+	extract := fs.String("extract", "", "replace each output line with the groups `regexp` captures in it, dropping lines it does not match")
+	stripANSI := fs.Bool("strip-ansi", false, "remove ANSI escape sequences, such as colors, from the output")
+	return func() *client.OutputFilter {
+		if len(include) == 0 && len(exclude) == 0 && *extract == "" && !*stripANSI {
+			return nil
+		}
+		return &client.OutputFilter{StripANSI: *stripANSI, Include: include, Exclude: exclude, Extract: *extract}
+	}
+}
+
+// argvFlag defines the -argv flag of run and background on fs.
+func argvFlag(fs *flag.FlagSet) *bool {
+	return fs.Bool("argv", false, "take the command as separate arguments, quoted for the shell, instead of one command string")
+}
+
+// commandLine returns the command string given to run or background as
+// args: the only one, or with -argv, all of them quoted for the shell that
+// runs them, the server's or the profile's, so that none of them is split
+// or interpreted by it.
+func commandLine(ctx context.Context, c *client.Client, args []string, argv bool) (string, error) {
+	if !argv {
+		if len(args) != 1 {
+			return "", usageError("the command must be a single argument; use -argv to give it as several")
+		}
+		return args[0], nil
+	}
+	if activeProfile.Shell != "" {
+		// A profile's shell runs commands with -c, like a POSIX shell.
+		return client.Quote(args), nil
+	}
+	return c.Quote(ctx, args)
+}
+
+// jobFlags defines the flags for the options shared by run and background
+// on fs, and returns a function that fills in the options from them.
+func jobFlags(fs *flag.FlagSet) func(opts *client.JobOptions) error {
+	env := make(keyValues)
+	labels := make(keyValues)
+	secrets := make(keyValues)
+	fs.Var(env, "env", "set an environment `variable` as name=value; may be repeated")
+	envFile := fs.String("env-file", "", "add the variables of the dotenv `file` on the server to the environment, before -env")
+	fs.Var(labels, "label", "attach a `label` to the job as key=value; may be repeated")
+	fs.Var(secrets, "secret", "set an environment `variable` to a secret as name=secret; may be repeated")
+	dir := fs.String("dir", "", "run the command in `directory` on the server")
+	umask := fs.String("umask", "", "run the command with the octal file mode creation `mask`, such as 022")
+	locale := fs.String("locale", "", "set LANG and LC_ALL to `locale`, such as C.UTF-8, for the command")
+	tz := fs.String("tz", "", "set TZ to `timezone`, such as UTC, for the command")
+	cpuSet := fs.String("cpu-set", "", "run the command only on the `CPUs`, such as 0-3 or 0,2,8-11")
+	stdin := fs.String("stdin", "", "feed the command the contents of `file`, or - for stdin")
+	stdinOpen := fs.Bool("stdin-open", false, "keep the command's stdin open, after -stdin, for the stdin command to write to")
+	timeout := fs.Duration("timeout", 0, "kill the job if it runs for longer than `duration`")
+	idleTimeout := fs.Duration("idle-timeout", 0, "kill the job if it writes no output for `duration`")
+	idleAction := fs.String("idle-action", "", "what to do once -idle-timeout passes: kill, the default, or flag the job as stalled")
+	workspace := fs.Bool("workspace", false, "run the command in a temporary directory of its own, removed on release")
+	keepWorkspace := fs.Bool("keep-workspace", false, "like -workspace, but leave the directory in place on release")
+	var artifacts values
+	fs.Var(&artifacts, "artifact", "keep copies of the files matching `glob` once the job exits; may be repeated")
+	logFile := fs.String("log-file", "", "also append the job's output to `file` on the server")
+	logOnly := fs.Bool("log-only", false, "write the job's output only to its -log-file")
+	captureMode := fs.String("capture-mode", "", "how the job's output is kept: full, the default, or ring, keeping only the last -ring-bytes of each stream")
+	ringBytes := fs.Int("ring-bytes", 0, "how many `bytes` of each stream -capture-mode ring keeps; defaults to 1 MiB")
+	logSink := fs.String("log-sink", "", "forward each line of the job's output to `sink`: file:<path>, syslog, syslog://host:port, tcp://host:port, udp://host:port or a webhook URL")
+	filter := filterFlags(fs)
+	progress := fs.Bool("progress", false, "report lines such as '##progress 42 \"uploading\"' as the job's progress instead of output")
+	successCodes := fs.String("success-codes", "", "comma-separated exit `codes` that mean success, instead of 0")
+	var require, forbid values
+	fs.Var(&require, "require", "fail the job unless its output matches `regexp`; may be repeated")
+	fs.Var(&forbid, "forbid", "fail the job if its output matches `regexp`; may be repeated")
+	var notify values
+	fs.Var(&notify, "notify", "tell the server's notifier `name[:when]` once the job finishes, when it fails, succeeds or always; may be repeated")
+	minRuntime := fs.Duration("min-runtime", 0, "fail the job if it runs for less than `duration`")
+	expectMax := fs.Duration("expect-max-duration", 0, "raise an alert if the job runs for longer than `duration`, without stopping it")
+	check := fs.String("check", "", "check in to the dead-man switch `name` by succeeding, raising an alert if no job of it succeeds for -check-every")
+	checkEvery := fs.Duration("check-every", 0, "how often a job of -check is expected to succeed, as a `duration`")
+	maxFailureRate := fs.Float64("max-failure-rate", 0, "raise an alert once more than this `share`, from 0 to 1, of the last -failure-window runs of the job's series failed")
+	failureWindow := fs.Int("failure-window", 0, "how many of the last `runs` of the job's series -max-failure-rate applies to, by default the server's")
+	traceParent := fs.String("traceparent", os.Getenv("TRACEPARENT"), "W3C `traceparent` of the span the job's span joins; defaults to $TRACEPARENT")
+	return func(opts *client.JobOptions) error {
+		if *timeout < 0 || *idleTimeout < 0 {
+			return usageError("-timeout and -idle-timeout must not be negative")
+		}
+		if *successCodes != "" || len(require) > 0 || len(forbid) > 0 || *minRuntime != 0 {
+			opts.Success = &client.SuccessOptions{Require: require, Forbid: forbid, MinRuntime: minRuntime.Seconds()}
+			for _, code := range strings.Split(*successCodes, ",") {
+				if code == "" {
+					continue
+				}
+				n, err := strconv.Atoi(code)
+				if err != nil {
+					return usageError(fmt.Sprintf("invalid exit code %q", code))
+				}
+				opts.Success.ExitCodes = append(opts.Success.ExitCodes, n)
+			}
+		}
+		if *expectMax != 0 || *check != "" || *checkEvery != 0 || *maxFailureRate != 0 || *failureWindow != 0 {
+			opts.Expect = &client.ExpectOptions{MaxDuration: expectMax.Seconds(), Check: *check, Every: checkEvery.Seconds(), MaxFailureRate: *maxFailureRate, FailureWindow: *failureWindow}
+		}
+		if len(env) > 0 {
+			opts.Env = env
+		}
+		if len(labels) > 0 {
+			opts.Labels = labels
+		}
+		if len(secrets) > 0 {
+			opts.Secrets = secrets
+		}
+		opts.EnvFile = *envFile
+		opts.Dir = *dir
+		opts.Umask = *umask
+		opts.Locale = *locale
+		opts.TZ = *tz
+		opts.CPUSet = *cpuSet
+		opts.Workspace = *workspace || *keepWorkspace
+		opts.KeepWorkspace = *keepWorkspace
+		opts.Artifacts = artifacts
+		opts.LogFile = *logFile
+		opts.LogOnly = *logOnly
+		opts.LogSink = *logSink
+		opts.CaptureMode = *captureMode
+		opts.RingBytes = *ringBytes
+		for _, n := range notify {
+			name, on, _ := strings.Cut(n, ":")
+			opts.Notify = append(opts.Notify, client.Notification{Notifier: name, On: on})
+		}
+		opts.TraceParent = *traceParent
+		opts.Filter = filter()
+		opts.Progress = *progress
+		opts.Timeout = timeout.Seconds()
+		opts.IdleTimeoutSeconds = idleTimeout.Seconds()
+		opts.IdleAction = *idleAction
+		opts.StdinOpen = *stdinOpen
+		switch *stdin {
+		case "":
+		case "-":
+			input, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				return err
+			}
+			opts.Stdin = string(input)
+		default:
+			input, err := os.ReadFile(*stdin)
+			if err != nil {
+				return err
+			}
+			opts.Stdin = string(input)
+		}
+		return nil
+	}
+}
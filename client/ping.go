@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"shellrunner/pkg/client"
+)
+
+// pingReport summarizes the round trips measured by the ping command.
+type pingReport struct {
+	Count           int         `json:"count"`
+	MinMilliseconds float64     `json:"min_ms"`
+	AvgMilliseconds float64     `json:"avg_ms"`
+	MaxMilliseconds float64     `json:"max_ms"`
+	Pings           []pingReply `json:"pings"`
+}
+
+// pingReply is the outcome of one ping.
+type pingReply struct {
+	Counter               uint64    `json:"counter"`
+	ServerTime            time.Time `json:"server_time"`
+	RoundTripMilliseconds float64   `json:"round_trip_ms"`
+}
+
+// ping pings the server count times, waiting interval between pings, and
+// reports the round trips.
+func ping(ctx context.Context, c *client.Client, count int, interval time.Duration) (pingReport, error) {
+	var report pingReport
+	var total time.Duration
+	for i := range count {
+		if i > 0 {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return report, ctx.Err()
+			}
+		}
+		pong, roundTrip, err := c.Ping(ctx)
+		if err != nil {
+			return report, err
+		}
+		ms := float64(roundTrip) / float64(time.Millisecond)
+		if report.Count == 0 || ms < report.MinMilliseconds {
+			report.MinMilliseconds = ms
+		}
+		report.MaxMilliseconds = max(report.MaxMilliseconds, ms)
+		total += roundTrip
+		report.Count++
+		report.Pings = append(report.Pings, pingReply{pong.Counter, pong.ServerTime, ms})
+	}
+	report.AvgMilliseconds = float64(total) / float64(report.Count) / float64(time.Millisecond)
+	return report, nil
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+)
+
+// notifyResize does nothing on Windows, which has no window size signal.
+func notifyResize(c chan<- os.Signal) {}
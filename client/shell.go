@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+
+	"golang.org/x/term"
+
+	"shellrunner/pkg/client"
+)
+
+// shellHelp describes the commands of the interactive shell.
+const shellHelp = `Each line is run on the server, with its output shown as it is produced.
+End a line with & to run it in the background instead.
+
+  %jobs                   list the server's jobs
+  %status <job_id>        show a job's status
+  %output <job_id>        show a job's output
+  %kill <job_id> [signal] send a signal, KILL by default, to a job
+  %release <job_id>       release a job
+  %help                   show this help
+  %exit                   leave the shell, as do exit and Ctrl-D
+
+Ctrl-C interrupts the command running in the foreground. Tab completes
+commands and job IDs.
+`
+
+// shellSession is an interactive shell on one connection to the server.
+type shellSession struct {
+	ctx context.Context
+	c   *client.Client
+	// commands are the commands of the jobs started in the background
+	// during the session, by job ID.
+	commands map[string]string
+}
+
+// shell reads lines from stdin and runs them on the server until the input
+// ends. When stdin is a terminal, it prompts for each line with history and
+// tab completion.
+func shell(ctx context.Context, c *client.Client) error {
+	s := &shellSession{ctx: ctx, c: c, commands: make(map[string]string)}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if !s.runLine(scanner.Text()) {
+				return nil
+			}
+		}
+		return scanner.Err()
+	}
+
+	fmt.Println("Connected to shellrunner. Type %help for help.")
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "shellrunner> ")
+	t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		return s.complete(line, pos)
+	}
+	for {
+		// The terminal is only raw while a line is being edited, so that
+		// commands' output and Ctrl-C behave as usual while they run.
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return err
+		}
+		if width, height, err := term.GetSize(fd); err == nil && width > 0 {
+			t.SetSize(width, height)
+		}
+		line, err := t.ReadLine()
+		term.Restore(fd, state)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !s.runLine(line) {
+			return nil
+		}
+	}
+}
+
+// runLine runs one line of input, returning false if it ends the session.
+func (s *shellSession) runLine(line string) bool {
+	line = strings.TrimSpace(line)
+	switch {
+	case line == "":
+	case line == "exit" || line == "%exit":
+		return false
+	case strings.HasPrefix(line, "%"):
+		s.meta(strings.Fields(line))
+	case strings.HasSuffix(line, "&") && !strings.HasSuffix(line, "&&"):
+		command := strings.TrimSpace(strings.TrimSuffix(line, "&"))
+		var opts client.BackgroundOptions
+		opts.Command, opts.Argv = activeProfile.shellCommand(command)
+		id, err := s.c.Background(s.ctx, opts)
+		if err != nil {
+			shellError(err)
+			break
+		}
+		s.commands[id] = command
+		fmt.Printf("[%s] %s\n", id, command)
+	default:
+		s.foreground(line)
+	}
+	return true
+}
+
+// foreground runs command and copies its output until it exits. An interrupt
+// is passed on to the command rather than ending the session.
+func (s *shellSession) foreground(command string) {
+	var opts client.BackgroundOptions
+	opts.Command, opts.Argv = activeProfile.shellCommand(command)
+	id, err := s.c.Background(s.ctx, opts)
+	if err != nil {
+		shellError(err)
+		return
+	}
+	defer s.c.Release(s.ctx, id)
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	done := make(chan struct{})
+	defer func() {
+		signal.Stop(interrupts)
+		close(done)
+	}()
+	go func() {
+		for {
+			select {
+			case <-interrupts:
+				s.c.Kill(s.ctx, id, "INT")
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	output, err := s.c.Follow(s.ctx, id, os.Stdout, os.Stderr)
+	if err != nil {
+		shellError(err)
+		return
+	}
+	if output.ExitCode != nil && *output.ExitCode != 0 {
+		fmt.Fprintf(os.Stderr, "[exit %d]\n", *output.ExitCode)
+	}
+}
+
+// meta runs a %command.
+func (s *shellSession) meta(fields []string) {
+	name, args := fields[0], fields[1:]
+	needID := func() bool {
+		if len(args) == 0 {
+			fmt.Fprintf(os.Stderr, "usage: %s <job_id>\n", name)
+			return false
+		}
+		return true
+	}
+	switch name {
+	case "%help":
+		os.Stdout.WriteString(shellHelp)
+	case "%jobs":
+		list, err := s.c.List(s.ctx)
+		if err != nil {
+			shellError(err)
+			return
+		}
+		for _, job := range list {
+			fmt.Printf("%-6s %-10s %s\n", job.ID, job.Status, s.commands[job.ID])
+		}
+	case "%status":
+		if needID() {
+			status, err := s.c.Status(s.ctx, args[0])
+			if err != nil {
+				shellError(err)
+				return
+			}
+			printResult(status)
+		}
+	case "%output":
+		if needID() {
+			output, err := s.c.Output(s.ctx, args[0], false)
+			if err != nil {
+				shellError(err)
+				return
+			}
+			os.Stdout.WriteString(output.Stdout)
+			os.Stderr.WriteString(output.Stderr)
+		}
+	case "%kill":
+		if needID() {
+			signal := ""
+			if len(args) > 1 {
+				signal = args[1]
+			}
+			if err := s.c.Kill(s.ctx, args[0], signal); err != nil {
+				shellError(err)
+			}
+		}
+	case "%release":
+		if needID() {
+			if err := s.c.Release(s.ctx, args[0]); err != nil {
+				shellError(err)
+				return
+			}
+			delete(s.commands, args[0])
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %s; type %%help for help\n", name)
+	}
+}
+
+// metaCommands are the %commands, for completion.
+var metaCommands = []string{"%exit", "%help", "%jobs", "%kill", "%output", "%release", "%status"}
+
+// complete completes the word before pos in line: the name of a %command, or
+// a job ID as its argument.
+func (s *shellSession) complete(line string, pos int) (string, int, bool) {
+	before := line[:pos]
+	start := strings.LastIndex(before, " ") + 1
+	word := before[start:]
+
+	var candidates []string
+	switch {
+	case start == 0 && strings.HasPrefix(word, "%"):
+		candidates = metaCommands
+	case strings.HasPrefix(line, "%") && start > 0:
+		list, err := s.c.List(s.ctx)
+		if err != nil {
+			return "", 0, false
+		}
+		for _, job := range list {
+			candidates = append(candidates, job.ID)
+		}
+		sort.Strings(candidates)
+	default:
+		return "", 0, false
+	}
+
+	var matches []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, word) {
+			matches = append(matches, candidate)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+	// Complete as far as the matches agree, and past the word if there is
+	// only one.
+	completion := matches[0]
+	for _, match := range matches[1:] {
+		for !strings.HasPrefix(match, completion) {
+			completion = completion[:len(completion)-1]
+		}
+	}
+	if len(matches) == 1 {
+		completion += " "
+	}
+	newLine := before[:start] + completion + line[pos:]
+	return newLine, start + len(completion), true
+}
+
+// shellError reports an error from the server without ending the session.
+func shellError(err error) {
+	fmt.Fprintf(os.Stderr, "error: %s\n", errorMessage(err))
+}
+
+// errorMessage describes err, with its code if it came from the server.
+func errorMessage(err error) string {
+	var rpcErr *client.Error
+	if errors.As(err, &rpcErr) {
+		return fmt.Sprintf("%s: %s", rpcErr.Code, rpcErr.Message)
+	}
+	return err.Error()
+}
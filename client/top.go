@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/term"
+
+	"shellrunner/pkg/client"
+)
+
+// topSample is what top last saw of a job, to work out its CPU use since.
+type topSample struct {
+	cpuSeconds float64
+	at         time.Time
+}
+
+// topRow is a job as top shows it.
+type topRow struct {
+	status client.JobStatus
+	id     string
+	cpu    float64 // percent of a CPU since the last refresh, or -1 if unknown
+}
+
+// top redraws a view of the server's statistics and its running and paused
+// jobs every interval, count times, or until ctx is done if count is zero.
+func top(ctx context.Context, c *client.Client, interval time.Duration, count int) error {
+	clear := term.IsTerminal(int(os.Stdout.Fd()))
+	samples := make(map[string]topSample)
+	for i := 0; count == 0 || i < count; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		stats, err := c.Statistics(ctx)
+		if err != nil {
+			return err
+		}
+		list, err := c.List(ctx)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		var rows []topRow
+		seen := make(map[string]topSample)
+		for _, entry := range list {
+			if entry.Status != "running" && entry.Status != "paused" {
+				continue
+			}
+			status, err := c.Status(ctx, entry.ID)
+			if notFound(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			row := topRow{status: status, id: entry.ID, cpu: -1}
+			if status.Cgroup != "" {
+				if last, ok := samples[entry.ID]; ok && now.After(last.at) {
+					row.cpu = 100 * (status.CPUSeconds - last.cpuSeconds) / now.Sub(last.at).Seconds()
+				}
+				seen[entry.ID] = topSample{cpuSeconds: status.CPUSeconds, at: now}
+			}
+			rows = append(rows, row)
+		}
+		samples = seen
+		sort.SliceStable(rows, func(i, j int) bool {
+			if rows[i].cpu != rows[j].cpu {
+				return rows[i].cpu > rows[j].cpu
+			}
+			return jobOrder(rows[i].id, rows[j].id)
+		})
+
+		var view strings.Builder
+		if clear {
+			// Move the cursor home and clear the screen.
+			view.WriteString("\033[H\033[2J")
+		} else if i > 0 {
+			view.WriteString("\n")
+		}
+		writeTop(&view, now, stats, rows)
+		os.Stdout.WriteString(view.String())
+	}
+	return nil
+}
+
+// writeTop writes the view of top: a header of the server's statistics and
+// a line for each of rows.
+func writeTop(view *strings.Builder, now time.Time, stats client.Stats, rows []topRow) {
+	paused := 0
+	for _, row := range rows {
+		if row.status.Status == "paused" {
+			paused++
+		}
+	}
+	buffered := formatSize(stats.BufferedBytes)
+	if stats.MaxBufferedBytes > 0 {
+		buffered += " of " + formatSize(stats.MaxBufferedBytes)
+	}
+	fmt.Fprintf(view, "shellrunner top - %s\n", now.Format(time.TimeOnly))
+	fmt.Fprintf(view, "Jobs: %d running, %d paused; %d finished, %d succeeded, %d failed\n", len(rows)-paused, paused, stats.TotalCount, stats.SuccessCount, stats.FailureCount)
+	fmt.Fprintf(view, "Duration: %.1fs average, %.1fs max; output held: %s\n\n", stats.AverageDurationSeconds, stats.MaxDurationSeconds, buffered)
+
+	tw := tabwriter.NewWriter(view, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATUS\tELAPSED\tCPU%\tMEM\tCOMMAND")
+	for _, row := range rows {
+		cpu, mem := "-", "-"
+		if row.cpu >= 0 {
+			cpu = fmt.Sprintf("%.1f", row.cpu)
+		}
+		if row.status.Cgroup != "" {
+			mem = formatSize(int64(row.status.MemoryBytes))
+		}
+		elapsed := time.Duration(row.status.DurationSeconds * float64(time.Second)).Round(time.Second)
+		command := strings.ReplaceAll(commandOf(row.status), "\n", `\n`)
+		if runes := []rune(command); len(runes) > maxCellWidth {
+			command = string(runes[:maxCellWidth-3]) + "..."
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", row.id, row.status.Status, elapsed, cpu, mem, command)
+	}
+	tw.Flush()
+}
+
+// jobOrder reports whether the job ID a comes before b, as the server
+// orders them: shorter IDs first, then alphabetically, so that numbered IDs
+// sort numerically.
+func jobOrder(a, b string) bool {
+	return len(a) < len(b) || len(a) == len(b) && a < b
+}
+
+// formatSize returns a number of bytes in the largest binary unit it has
+// at least one of, such as "1.5 MiB".
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	size, exp := float64(n)/unit, 0
+	for size >= unit && exp < 4 {
+		size /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", size, "KMGTP"[exp])
+}
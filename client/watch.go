@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+
+	"shellrunner/pkg/client"
+)
+
+// watch redraws a view of a job's status and the last lines of its output
+// every interval until the job finishes, and returns its final status.
+func watch(ctx context.Context, c *client.Client, id string, interval time.Duration, lines int) (client.JobStatus, error) {
+	clear := term.IsTerminal(int(os.Stdout.Fd()))
+	for {
+		status, err := c.Status(ctx, id)
+		if err != nil {
+			return status, err
+		}
+		output, err := c.Output(ctx, id, false)
+		if err != nil {
+			return status, err
+		}
+
+		var view strings.Builder
+		if clear {
+			// Move the cursor home and clear the screen.
+			view.WriteString("\033[H\033[2J")
+		}
+		fmt.Fprintf(&view, "Job %s: %s\n", id, status.Command)
+		fmt.Fprintf(&view, "Status: %s, %.1fs", status.Status, status.DurationSeconds)
+		if status.ExitCode != nil {
+			fmt.Fprintf(&view, ", exit code %d", *status.ExitCode)
+		}
+		view.WriteString("\n\n")
+		view.WriteString(lastLines(output.Stdout, lines))
+		if output.Stderr != "" {
+			view.WriteString("--- stderr ---\n")
+			view.WriteString(lastLines(output.Stderr, lines))
+		}
+		os.Stdout.WriteString(view.String())
+
+		if status.Finished() {
+			return status, nil
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return status, ctx.Err()
+		}
+	}
+}
+
+// lastLines returns the last n lines of s, ending in a newline unless empty.
+func lastLines(s string, n int) string {
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" || n == 0 {
+		return ""
+	}
+	all := strings.Split(s, "\n")
+	if len(all) > n {
+		all = all[len(all)-n:]
+	}
+	return strings.Join(all, "\n") + "\n"
+}
+
+// exitCode returns the exit code for the client to exit with once a job has
+// finished: the job's own, 127 if its command failed to start, as a shell
+// would for a missing command, or 1 if it has none, such as when it was
+// killed before it could start.
+func exitCode(status client.JobStatus) int {
+	if status.Status == "failed_to_start" {
+		return 127
+	}
+	if status.ExitCode == nil {
+		return 1
+	}
+	return *status.ExitCode
+}
@@ -2,4 +2,12 @@ module shellrunner
 
 go 1.24.5
 
-require github.com/google/uuid v1.6.0 // indirect
+require (
+	github.com/Microsoft/go-winio v0.6.2
+	github.com/creack/pty v1.1.24
+	go.starlark.net v0.0.0-20260210143700-b62fd896b91b
+	golang.org/x/term v0.34.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.35.0 // indirect
@@ -1,405 +1,754 @@
-// Package main implements a JSON-RPC server that executes shell commands.
+// Command shellrunner is a JSON-RPC server that executes shell commands. The
+// job manager and the RPC service it is built from live in pkg/runner and
+// pkg/server.
 package main
 
 import (
-	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net"
-	"net/rpc"
-	"net/rpc/jsonrpc"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
-)
-
-// BackgroundJob represents a command running in the background.
-type BackgroundJob struct {
-	Command      string
-	Cmd          *exec.Cmd
-	Stdout       bytes.Buffer
-	Stderr       bytes.Buffer
-	StartTime    time.Time
-	EndTime      time.Time
-	Status       string // "running", "exited", "errored"
-	ExitCode     int
-	StdoutOffset int
-	StderrOffset int
-}
 
-// ExecutionStatistics holds statistics about command executions.
-type ExecutionStatistics struct {
-	TotalCount       int64
-	TotalDuration    time.Duration
-	MaxDuration      time.Duration
-	TotalStdoutBytes int64
-	TotalStderrBytes int64
-}
-
-var (
-	// jobs stores all background jobs, keyed by their unique ID.
-	jobs = make(map[string]*BackgroundJob)
-	// jobCounter is used to generate sequential job IDs.
-	jobCounter uint64
-	// mutex protects access to the jobs map and the jobCounter.
-	mutex = &sync.Mutex{}
-	// logger is used for optional logging.
-	logger *log.Logger
-	// stats holds the execution statistics.
-	stats      = &ExecutionStatistics{}
-	statsMutex = &sync.Mutex{}
+	"shellrunner/pkg/runner"
+	"shellrunner/pkg/server"
 )
 
-func updateStats(duration time.Duration, stdoutBytes, stderrBytes int) {
-	statsMutex.Lock()
-	defer statsMutex.Unlock()
+func main() {
+	// Setup command-line flags.
+	logging := flag.Bool("logging", false, "Enable logging to stdout.")
+	socketPathFlag := flag.String("socket", "", "Path to the Unix socket (or named pipe on Windows). Overrides SHELLRUNNER_SOCKET_PATH.")
+	cgroupRootFlag := flag.String("cgroup-root", "", "Linux cgroup v2 directory to create a cgroup per job under. Overrides SHELLRUNNER_CGROUP_ROOT.")
+	sandboxFlag := flag.Bool("sandbox", false, "Run every job in a bubblewrap sandbox.")
+	sandboxNoNetworkFlag := flag.Bool("sandbox-no-network", false, "Deny network access to sandboxed jobs.")
+	logDirsFlag := flag.String("log-dirs", "", "Comma-separated directories jobs may write log files in. Overrides SHELLRUNNER_LOG_DIRS.")
+	logSinkHostsFlag := flag.String("log-sink-hosts", "", "Comma-separated host:port addresses jobs may forward their output to with log sinks over the network. Overrides SHELLRUNNER_LOG_SINK_HOSTS.")
+	journalFlag := flag.Bool("journal", false, "Also write every job's output to the systemd journal, with JOB_ID, COMMAND and EXIT_CODE fields.")
+	fileDirsFlag := flag.String("file-dirs", "", "Comma-separated directories clients may read and write files in with PutFile and GetFile, besides jobs' workspaces and artifacts. Overrides SHELLRUNNER_FILE_DIRS.")
+	envFileDirsFlag := flag.String("env-file-dirs", "", "Comma-separated directories jobs may read environment files from. Overrides SHELLRUNNER_ENV_FILE_DIRS.")
+	sandboxBindAllowFlag := flag.String("sandbox-bind-allow", "", "Comma-separated directories sandboxed jobs may mount read-write. Overrides SHELLRUNNER_SANDBOX_BIND_ALLOW.")
+	containerRuntimeFlag := flag.String("container-runtime", "", "CLI that runs container jobs: docker or podman. Overrides SHELLRUNNER_CONTAINER_RUNTIME.")
+	sshHostsFlag := flag.String("ssh-hosts", "", "JSON file defining the remote hosts jobs may run on over SSH. Overrides SHELLRUNNER_SSH_HOSTS.")
+	notifiersFlag := flag.String("notifiers", "", "JSON file defining the Slack and email notifiers jobs and rules may notify. Overrides SHELLRUNNER_NOTIFIERS.")
+	shellFlag := flag.String("shell", "", "Interpreter for command strings: bash, sh, cmd, powershell or pwsh. Overrides SHELLRUNNER_SHELL.")
+	timeoutsFlag := flag.String("timeouts", "", "Comma-separated method=duration deadlines, such as Run=10m,*=5s. Overrides SHELLRUNNER_TIMEOUTS.")
+	slowCallsFlag := flag.String("slow-calls", "", "Comma-separated method=duration thresholds after which calls are logged as slow. Defaults to Run=1m,TopJobs=15s,*=1s. Overrides SHELLRUNNER_SLOW_CALLS.")
+	rateLimitFlag := flag.String("rate-limit", "", "Comma-separated scope=rate limits on job submissions per second, with scope global, connection or user, such as global=100,user=10:20. Overrides SHELLRUNNER_RATE_LIMIT.")
+	payloadLimitsFlag := flag.String("payload-limits", "", "Comma-separated name=value caps on what clients submit, with name request, command, env or stdin in bytes, or env-vars, such as command=65536,stdin=1048576; 0 lifts one. Overrides SHELLRUNNER_PAYLOAD_LIMITS.")
+	quotasFlag := flag.String("quotas", "", "JSON file of the quotas on running jobs, jobs per hour and buffered output of each client identity. Overrides SHELLRUNNER_QUOTAS.")
+	adminsFlag := flag.String("admins", "", "Comma-separated clients allowed to call the Admin methods besides root, as token:<name>, cert:<name> or uid:<user>. Overrides SHELLRUNNER_ADMINS.")
+	aclFlag := flag.String("acl", "", "JSON file of the roles that may call each method and the roles of each client identity. Overrides SHELLRUNNER_ACL.")
+	auditLogFlag := flag.String("audit-log", "", "File to append a line of JSON to for each call, with who made it and whether it failed. Overrides SHELLRUNNER_AUDIT_LOG.")
+	maxConnectionsFlag := flag.Int("max-connections", 0, "Maximum number of open client connections; 0 means no limit. Overrides SHELLRUNNER_MAX_CONNECTIONS.")
+	idleTimeoutFlag := flag.String("idle-timeout", "", "Close connections with no call in progress for this long, such as 10m. Overrides SHELLRUNNER_IDLE_TIMEOUT.")
+	historyRetentionFlag := flag.String("history-retention", "", "How long released jobs are remembered for Rerun, and series of jobs for Trends after their last run, such as 720h; by default until -history-size is reached. Overrides SHELLRUNNER_HISTORY_RETENTION.")
+	maintenanceIntervalFlag := flag.String("maintenance-interval", "", "How often to forget what -history-retention no longer keeps and expired cached results, and compact the rest. Defaults to 1h. Overrides SHELLRUNNER_MAINTENANCE_INTERVAL.")
+	historySizeFlag := flag.String("history-size", "", "Number of released jobs remembered so that they can be rerun; 0 remembers none. Defaults to 1000. Overrides SHELLRUNNER_HISTORY_SIZE.")
+	noSubreaperFlag := flag.Bool("no-subreaper", false, "Do not adopt and reap the processes jobs leave behind (Linux only).")
+	maxFailureRateFlag := flag.String("max-failure-rate", "", "Share, from 0 to 1, of the last -failure-window runs of a series of jobs that may fail before an alert is raised; 0 raises none. Overrides SHELLRUNNER_MAX_FAILURE_RATE.")
+	failureWindowFlag := flag.String("failure-window", "", "How many of the last runs of a series of jobs -max-failure-rate applies to, up to 50. Defaults to 10. Overrides SHELLRUNNER_FAILURE_WINDOW.")
+	compressThresholdFlag := flag.String("compress-threshold", "", "Size in bytes from which finished jobs' stdout and stderr are kept compressed in memory; 0 disables compression. Defaults to 65536. Overrides SHELLRUNNER_COMPRESS_THRESHOLD.")
+	maxBufferedFlag := flag.String("max-buffered", "", "Total bytes of job output to hold in memory before refusing new jobs; 0 means no limit. Overrides SHELLRUNNER_MAX_BUFFERED.")
+	workersFlag := flag.String("workers", "", "Number of jobs to run at once; jobs submitted beyond it wait for a free worker. 0 means no limit. Overrides SHELLRUNNER_WORKERS.")
+	shellWorkersFlag := flag.String("shell-workers", "", "Number of long-lived shells to run plain command strings in instead of starting a shell for each; 0, the default, starts one for each. Overrides SHELLRUNNER_SHELL_WORKERS.")
+	workerWaitFlag := flag.String("worker-wait", "", "How long a job waits for a free worker before it is refused, such as 30s. Defaults to 10s. Overrides SHELLRUNNER_WORKER_WAIT.")
+	maxLoadFlag := flag.String("max-load", "", "Load average over the last minute, per CPU, above which new jobs wait or are refused; 0, the default, means no limit. Overrides SHELLRUNNER_MAX_LOAD.")
+	minAvailableMemoryFlag := flag.String("min-available-memory", "", "Bytes of memory that must be available for new jobs to start rather than wait or be refused; 0, the default, means no limit. Overrides SHELLRUNNER_MIN_AVAILABLE_MEMORY.")
+	hostWaitFlag := flag.String("host-wait", "", "How long a job waits for the host to be below -max-load and above -min-available-memory before it is refused, such as 30s; 0, the default, refuses it at once. Overrides SHELLRUNNER_HOST_WAIT.")
+	rulesDirFlag := flag.String("rules-dir", "", "Directory of YAML files and Starlark scripts of rules that deny, rewrite, tag or filter jobs, read again on SIGHUP. Overrides SHELLRUNNER_RULES_DIR.")
+	preExecHookFlag := flag.String("pre-exec-hook", "", "Executable run with each job's spec as JSON on stdin before the job starts, which can deny the job or change its spec. Overrides SHELLRUNNER_PRE_EXEC_HOOK.")
+	postExecHookFlag := flag.String("post-exec-hook", "", "Executable run with a summary of each finished job as JSON on stdin. Overrides SHELLRUNNER_POST_EXEC_HOOK.")
+	otlpEndpointFlag := flag.String("otlp-endpoint", "", "Base URL of an OpenTelemetry collector, such as http://localhost:4318, to export trace spans to with OTLP over HTTP. Overrides OTEL_EXPORTER_OTLP_ENDPOINT.")
+	metricsAddrFlag := flag.String("metrics-addr", "", "TCP address, such as localhost:9090, to serve Prometheus metrics on at /metrics; none by default. Overrides SHELLRUNNER_METRICS_ADDR.")
+	listenFlag := flag.String("listen", "", "Semicolon-separated listeners to serve besides -socket, such as tls:0.0.0.0:7443,cert=server.pem,key=server.key,token-file=token;http:localhost:9090. A unix listener replaces the default socket. Overrides SHELLRUNNER_LISTEN.")
+	instanceFlag := flag.String("instance", "", "Name of this server among others on the host. It picks the default socket, holds relative -secrets-file, -id-counter-file and -log-dirs paths in the instance's own directory, and labels logs and metrics. Overrides SHELLRUNNER_INSTANCE.")
+	idsFlag := flag.String("ids", "", "How job IDs are made up: sequential (1, 2, 3), prefix:<prefix> (such as prefix:job- for job-1) or uuid (UUIDv7). Defaults to sequential. Overrides SHELLRUNNER_IDS.")
+	idCounterFileFlag := flag.String("id-counter-file", "", "File to keep the counter of sequential and prefixed job IDs in, so that they are not reused after a restart. Overrides SHELLRUNNER_ID_COUNTER_FILE.")
+	secretsFileFlag := flag.String("secrets-file", "", "File to keep secrets in, encrypted with the base64 AES key in SHELLRUNNER_SECRETS_KEY; by default secrets are only kept in memory. Overrides SHELLRUNNER_SECRETS_FILE.")
+	flag.Parse()
 
-	stats.TotalCount++
-	stats.TotalDuration += duration
-	if duration > stats.MaxDuration {
-		stats.MaxDuration = duration
+	// Name the instance, whose files are kept apart from other instances'.
+	instance := *instanceFlag
+	if instance == "" {
+		instance = os.Getenv("SHELLRUNNER_INSTANCE")
 	}
-	stats.TotalStdoutBytes += int64(stdoutBytes)
-	stats.TotalStderrBytes += int64(stderrBytes)
-}
-
-// ShellRunner is the receiver for the RPC methods.
-type ShellRunner struct{}
-
-// RunArgs defines the arguments for the Run method.
-type RunArgs struct {
-	Command string
-	Keep    bool
-}
-
-// Run executes a command synchronously and returns its output and exit code.
-func (s *ShellRunner) Run(args RunArgs, reply *map[string]interface{}) error {
-	logger.Printf("Run called with command: %q, Keep: %t", args.Command, args.Keep)
-	command := exec.Command("bash", "-c", args.Command)
-	var stdout, stderr bytes.Buffer
-	command.Stdout = &stdout
-	command.Stderr = &stderr
-
-	startTime := time.Now()
-	err := command.Run()
-	endTime := time.Now()
-
-	updateStats(endTime.Sub(startTime), stdout.Len(), stderr.Len())
-
-	(*reply)["stdout"] = stdout.String()
-	(*reply)["stderr"] = stderr.String()
-
-	exitCode := 0
-	if err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			exitCode = exitError.ExitCode()
-		} else {
-			exitCode = -1
+	instancePath := func(path string) string { return path }
+	if instance != "" {
+		dir, err := server.InstanceDir(instance)
+		if err != nil {
+			log.Fatalf("Invalid instance: %v", err)
+		}
+		instancePath = func(path string) string {
+			if path == "" || filepath.IsAbs(path) {
+				return path
+			}
+			path = filepath.Join(dir, path)
+			if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+				log.Fatalf("Error creating the instance directory: %v", err)
+			}
+			return path
 		}
 	}
-	(*reply)["exit_code"] = exitCode
 
-	if args.Keep {
-		mutex.Lock()
-		defer mutex.Unlock()
-		jobCounter++
-		id := fmt.Sprintf("%d", jobCounter)
-		job := &BackgroundJob{
-			Command:   args.Command,
-			Cmd:       command,
-			Stdout:    stdout,
-			Stderr:    stderr,
-			StartTime: startTime,
-			EndTime:   endTime,
-			Status:    "exited",
-			ExitCode:  exitCode,
+	// Setup logging.
+	if *logging || os.Getenv("SHELLRUNNER_LOGGING") == "true" {
+		prefix := "[shellrunner] "
+		if instance != "" {
+			prefix = "[shellrunner:" + instance + "] "
 		}
-		jobs[id] = job
-		(*reply)["job_id"] = id
-		logger.Printf("Kept job %s for command: %q", id, args.Command)
+		runner.Logger = log.New(os.Stdout, prefix, log.LstdFlags)
 	}
 
-	logger.Printf("Run finished for command: %q", args.Command)
-	return nil
-}
+	// Select the interpreter for command strings.
+	shellName := *shellFlag
+	if shellName == "" {
+		shellName = os.Getenv("SHELLRUNNER_SHELL")
+	}
+	if shellName != "" {
+		if err := runner.SetShell(shellName); err != nil {
+			log.Fatalf("Error selecting shell: %v", err)
+		}
+	}
 
-// Background executes a command asynchronously, returning a unique job ID.
-func (s *ShellRunner) Background(cmd string, reply *string) error {
-	logger.Printf("Background called with command: %q", cmd)
-	mutex.Lock()
-	defer mutex.Unlock()
+	// Collect the job manager's settings, starting with the container
+	// runtime.
+	config := runner.DefaultConfig()
+	runtime := *containerRuntimeFlag
+	if runtime == "" {
+		runtime = os.Getenv("SHELLRUNNER_CONTAINER_RUNTIME")
+	}
+	if runtime != "" {
+		config.ContainerRuntime = runtime
+	}
 
-	jobCounter++
-	id := fmt.Sprintf("%d", jobCounter)
-	command := exec.Command("bash", "-c", cmd)
+	// Remember released jobs for Rerun.
+	historySize := *historySizeFlag
+	if historySize == "" {
+		historySize = os.Getenv("SHELLRUNNER_HISTORY_SIZE")
+	}
+	if historySize != "" {
+		n, err := strconv.Atoi(historySize)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid history size: %q", historySize)
+		}
+		config.HistorySize = n
+	}
+	historyRetention := *historyRetentionFlag
+	if historyRetention == "" {
+		historyRetention = os.Getenv("SHELLRUNNER_HISTORY_RETENTION")
+	}
+	if historyRetention != "" {
+		d, err := time.ParseDuration(historyRetention)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid history retention: %q", historyRetention)
+		}
+		config.HistoryRetention = d
+	}
 
-	job := &BackgroundJob{
-		Command:   cmd,
-		Cmd:       command,
-		StartTime: time.Now(),
-		Status:    "running",
+	// Alert when a series of jobs fails too often.
+	maxFailureRate := *maxFailureRateFlag
+	if maxFailureRate == "" {
+		maxFailureRate = os.Getenv("SHELLRUNNER_MAX_FAILURE_RATE")
+	}
+	if maxFailureRate != "" {
+		rate, err := strconv.ParseFloat(maxFailureRate, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			log.Fatalf("Invalid maximum failure rate: %q", maxFailureRate)
+		}
+		config.MaxFailureRate = rate
+	}
+	failureWindow := *failureWindowFlag
+	if failureWindow == "" {
+		failureWindow = os.Getenv("SHELLRUNNER_FAILURE_WINDOW")
+	}
+	if failureWindow != "" {
+		n, err := strconv.Atoi(failureWindow)
+		if err != nil || n < 1 || n > 50 {
+			log.Fatalf("Invalid failure window: %q", failureWindow)
+		}
+		config.FailureWindow = n
 	}
-	command.Stdout = &job.Stdout
-	command.Stderr = &job.Stderr
 
-	jobs[id] = job
+	// Compress the retained output of finished jobs.
+	compressThreshold := *compressThresholdFlag
+	if compressThreshold == "" {
+		compressThreshold = os.Getenv("SHELLRUNNER_COMPRESS_THRESHOLD")
+	}
+	if compressThreshold != "" {
+		n, err := strconv.Atoi(compressThreshold)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid compress threshold: %q", compressThreshold)
+		}
+		config.CompressThreshold = n
+	}
 
-	// Run the command in a goroutine to make it non-blocking.
-	go func(job *BackgroundJob) {
-		logger.Printf("Starting background job %s: %s", id, cmd)
-		err := job.Cmd.Run()
-		job.EndTime = time.Now()
-		updateStats(job.EndTime.Sub(job.StartTime), job.Stdout.Len(), job.Stderr.Len())
+	// Refuse new jobs once too much output is held in memory.
+	maxBuffered := *maxBufferedFlag
+	if maxBuffered == "" {
+		maxBuffered = os.Getenv("SHELLRUNNER_MAX_BUFFERED")
+	}
+	if maxBuffered != "" {
+		n, err := strconv.ParseInt(maxBuffered, 10, 64)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid maximum buffered output: %q", maxBuffered)
+		}
+		config.MaxBufferedBytes = n
+	}
 
-		mutex.Lock()
-		defer mutex.Unlock()
+	// Run at most so many jobs at once.
+	workers := *workersFlag
+	if workers == "" {
+		workers = os.Getenv("SHELLRUNNER_WORKERS")
+	}
+	if workers != "" {
+		n, err := strconv.Atoi(workers)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid number of workers: %q", workers)
+		}
+		config.Workers = n
+	}
+	workerWait := *workerWaitFlag
+	if workerWait == "" {
+		workerWait = os.Getenv("SHELLRUNNER_WORKER_WAIT")
+	}
+	if workerWait != "" {
+		d, err := time.ParseDuration(workerWait)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid worker wait: %q", workerWait)
+		}
+		config.WorkerWait = d
+	}
 
+	// Hold back new jobs while the host is overloaded.
+	maxLoad := *maxLoadFlag
+	if maxLoad == "" {
+		maxLoad = os.Getenv("SHELLRUNNER_MAX_LOAD")
+	}
+	if maxLoad != "" {
+		load, err := strconv.ParseFloat(maxLoad, 64)
+		if err != nil || load < 0 {
+			log.Fatalf("Invalid maximum load: %q", maxLoad)
+		}
+		config.MaxLoad = load
+	}
+	minAvailableMemory := *minAvailableMemoryFlag
+	if minAvailableMemory == "" {
+		minAvailableMemory = os.Getenv("SHELLRUNNER_MIN_AVAILABLE_MEMORY")
+	}
+	if minAvailableMemory != "" {
+		n, err := strconv.ParseUint(minAvailableMemory, 10, 64)
 		if err != nil {
-			if exitError, ok := err.(*exec.ExitError); ok {
-				job.ExitCode = exitError.ExitCode()
-				job.Status = "exited"
-			} else {
-				job.Status = "errored"
-				job.ExitCode = -1
-			}
-		} else {
-			job.Status = "exited"
-			job.ExitCode = 0
+			log.Fatalf("Invalid minimum available memory: %q", minAvailableMemory)
 		}
-		logger.Printf("Background job %s finished with status %s and exit code %d", id, job.Status, job.ExitCode)
-	}(job)
-
-	*reply = id
-	return nil
-}
-
-// Status returns the current status and execution time of a background job.
-func (s *ShellRunner) Status(id string, reply *map[string]interface{}) error {
-	logger.Printf("Status called for job ID: %s", id)
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	job, ok := jobs[id]
-	if !ok {
-		return fmt.Errorf("job with id %s not found", id)
+		config.MinAvailableMemory = n
 	}
-
-	(*reply)["command"] = job.Command
-	(*reply)["status"] = job.Status
-	(*reply)["start_time"] = job.StartTime.Format(time.RFC3339)
-
-	var duration float64
-	if job.Status == "running" {
-		duration = time.Since(job.StartTime).Seconds()
-	} else {
-		duration = job.EndTime.Sub(job.StartTime).Seconds()
+	hostWait := *hostWaitFlag
+	if hostWait == "" {
+		hostWait = os.Getenv("SHELLRUNNER_HOST_WAIT")
 	}
-	(*reply)["duration_seconds"] = duration
-
-	return nil
-}
-
-// OutputArgs defines the arguments for the Output method.
-type OutputArgs struct {
-	ID      string
-	Release bool
-}
-
-// Output returns the stdout and stderr of a background job.
-func (s *ShellRunner) Output(args OutputArgs, reply *map[string]interface{}) error {
-	logger.Printf("Output called for job ID: %s, Release: %t", args.ID, args.Release)
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	job, ok := jobs[args.ID]
-	if !ok {
-		return fmt.Errorf("job with id %s not found", args.ID)
+	if hostWait != "" {
+		d, err := time.ParseDuration(hostWait)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid host wait: %q", hostWait)
+		}
+		config.HostWait = d
 	}
-
-	(*reply)["stdout"] = job.Stdout.String()
-	(*reply)["stderr"] = job.Stderr.String()
-
-	if args.Release {
-		logger.Printf("Releasing job %s", args.ID)
-		delete(jobs, args.ID)
+	if config.MaxLoad > 0 || config.MinAvailableMemory > 0 {
+		if _, err := runner.ReadHostStats(); err != nil {
+			log.Fatalf("Cannot hold back jobs on the host's load: %v", err)
+		}
 	}
 
-	return nil
-}
+	// Run plain command strings in long-lived shells.
+	shellWorkers := *shellWorkersFlag
+	if shellWorkers == "" {
+		shellWorkers = os.Getenv("SHELLRUNNER_SHELL_WORKERS")
+	}
+	if shellWorkers != "" {
+		n, err := strconv.Atoi(shellWorkers)
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid number of shell workers: %q", shellWorkers)
+		}
+		config.ShellWorkers = n
+	}
 
-// Release removes a job's data from memory.
-func (s *ShellRunner) Release(id string, reply *bool) error {
-	logger.Printf("Release called for job ID: %s", id)
-	mutex.Lock()
-	defer mutex.Unlock()
+	// Load the remote hosts.
+	sshHostsPath := *sshHostsFlag
+	if sshHostsPath == "" {
+		sshHostsPath = os.Getenv("SHELLRUNNER_SSH_HOSTS")
+	}
+	if sshHostsPath != "" {
+		if err := config.LoadSSHHosts(sshHostsPath); err != nil {
+			log.Fatalf("Error loading SSH hosts: %v", err)
+		}
+	}
 
-	if _, ok := jobs[id]; !ok {
-		return fmt.Errorf("job with id %s not found", id)
+	// Load the notifiers.
+	notifiersPath := *notifiersFlag
+	if notifiersPath == "" {
+		notifiersPath = os.Getenv("SHELLRUNNER_NOTIFIERS")
+	}
+	if notifiersPath != "" {
+		if err := runner.LoadNotifiers(notifiersPath); err != nil {
+			log.Fatalf("Error loading notifiers: %v", err)
+		}
 	}
 
-	delete(jobs, id)
-	*reply = true
-	logger.Printf("Released job %s", id)
-	return nil
-}
+	// Place jobs into cgroups if requested.
+	cgroupRootPath := *cgroupRootFlag
+	if cgroupRootPath == "" {
+		cgroupRootPath = os.Getenv("SHELLRUNNER_CGROUP_ROOT")
+	}
+	if cgroupRootPath != "" {
+		if err := runner.SetCgroupRoot(cgroupRootPath); err != nil {
+			log.Fatalf("Error setting up cgroup root: %v", err)
+		}
+	}
 
-// ReleaseAll removes all finished jobs from memory.
-func (s *ShellRunner) ReleaseAll(args struct{}, reply *int) error {
-	logger.Println("ReleaseAll called")
-	mutex.Lock()
-	defer mutex.Unlock()
+	// Configure the sandbox.
+	config.Sandbox.Always = *sandboxFlag || os.Getenv("SHELLRUNNER_SANDBOX") == "true"
+	config.Sandbox.NoNetwork = *sandboxNoNetworkFlag || os.Getenv("SHELLRUNNER_SANDBOX_NO_NETWORK") == "true"
+	bindAllow := *sandboxBindAllowFlag
+	if bindAllow == "" {
+		bindAllow = os.Getenv("SHELLRUNNER_SANDBOX_BIND_ALLOW")
+	}
+	if err := config.SetSandboxBindAllow(bindAllow); err != nil {
+		log.Fatalf("Error setting sandbox bind allowlist: %v", err)
+	}
 
-	releasedCount := 0
-	for id, job := range jobs {
-		if job.Status == "exited" || job.Status == "errored" {
-			delete(jobs, id)
-			releasedCount++
+	// Adopt the processes jobs leave behind, so they are reaped when they exit.
+	if !*noSubreaperFlag && os.Getenv("SHELLRUNNER_NO_SUBREAPER") != "true" {
+		if err := runner.EnableSubreaper(); err != nil {
+			runner.Logger.Printf("Not reaping stray processes: %v", err)
 		}
 	}
-	*reply = releasedCount
-	logger.Printf("Released %d finished jobs", releasedCount)
-	return nil
-}
 
-// JobListEntry represents a single entry in the list of jobs.
-type JobListEntry struct {
-	ID     string
-	Status string
-}
+	// Allow log files in the given directories.
+	logDirs := *logDirsFlag
+	if logDirs == "" {
+		logDirs = os.Getenv("SHELLRUNNER_LOG_DIRS")
+	}
+	if instance != "" && logDirs != "" {
+		dirs := strings.Split(logDirs, ",")
+		for i, dir := range dirs {
+			if dir = strings.TrimSpace(dir); dir != "" && !filepath.IsAbs(dir) {
+				dirs[i] = instancePath(dir)
+				if err := os.MkdirAll(dirs[i], 0o700); err != nil {
+					log.Fatalf("Error creating log directory: %v", err)
+				}
+			}
+		}
+		logDirs = strings.Join(dirs, ",")
+	}
+	if err := config.SetLogDirs(logDirs); err != nil {
+		log.Fatalf("Error setting log directories: %v", err)
+	}
+	logSinkHosts := *logSinkHostsFlag
+	if logSinkHosts == "" {
+		logSinkHosts = os.Getenv("SHELLRUNNER_LOG_SINK_HOSTS")
+	}
+	if err := config.SetLogSinkHosts(logSinkHosts); err != nil {
+		log.Fatalf("Error setting log sink hosts: %v", err)
+	}
+	if err := runner.SetJournal(*journalFlag || os.Getenv("SHELLRUNNER_JOURNAL") == "true"); err != nil {
+		log.Fatalf("Error writing to the journal: %v", err)
+	}
 
-// List returns a list of all jobs and their statuses.
-func (s *ShellRunner) List(args struct{}, reply *[]JobListEntry) error {
-	logger.Printf("List called")
-	mutex.Lock()
-	defer mutex.Unlock()
+	envFileDirs := *envFileDirsFlag
+	if envFileDirs == "" {
+		envFileDirs = os.Getenv("SHELLRUNNER_ENV_FILE_DIRS")
+	}
+	if err := config.SetEnvFileDirs(envFileDirs); err != nil {
+		log.Fatalf("Error setting env file directories: %v", err)
+	}
 
-	list := make([]JobListEntry, 0, len(jobs))
-	for id, job := range jobs {
-		list = append(list, JobListEntry{ID: id, Status: job.Status})
+	fileDirs := *fileDirsFlag
+	if fileDirs == "" {
+		fileDirs = os.Getenv("SHELLRUNNER_FILE_DIRS")
+	}
+	if err := config.SetFileDirs(fileDirs); err != nil {
+		log.Fatalf("Error setting file directories: %v", err)
 	}
 
-	*reply = list
-	return nil
-}
+	runner.Logger.Println("Server starting...")
 
-// Statistics returns statistics about command executions.
-func (s *ShellRunner) Statistics(args struct{}, reply *map[string]interface{}) error {
-	logger.Println("Statistics called")
-	statsMutex.Lock()
-	defer statsMutex.Unlock()
+	manager := runner.NewManager(config)
 
-	var avgDuration float64
-	if stats.TotalCount > 0 {
-		avgDuration = stats.TotalDuration.Seconds() / float64(stats.TotalCount)
+	// Pick how job IDs are made up, and where their counter is kept.
+	ids := *idsFlag
+	if ids == "" {
+		ids = os.Getenv("SHELLRUNNER_IDS")
+	}
+	idCounterFile := *idCounterFileFlag
+	if idCounterFile == "" {
+		idCounterFile = os.Getenv("SHELLRUNNER_ID_COUNTER_FILE")
+	}
+	if err := manager.UseIDs(ids, instancePath(idCounterFile)); err != nil {
+		log.Fatalf("Invalid job IDs: %v", err)
 	}
 
-	(*reply)["total_count"] = stats.TotalCount
-	(*reply)["average_duration_seconds"] = avgDuration
-	(*reply)["max_duration_seconds"] = stats.MaxDuration.Seconds()
-	(*reply)["total_stdout_bytes"] = stats.TotalStdoutBytes
-	(*reply)["total_stderr_bytes"] = stats.TotalStderrBytes
-
-	return nil
-}
+	// Load the secrets from their file, if they have one.
+	secretsFile := *secretsFileFlag
+	if secretsFile == "" {
+		secretsFile = os.Getenv("SHELLRUNNER_SECRETS_FILE")
+	}
+	secretsFile = instancePath(secretsFile)
+	if secretsFile != "" {
+		key, err := base64.StdEncoding.DecodeString(os.Getenv("SHELLRUNNER_SECRETS_KEY"))
+		if err != nil || len(key) == 0 {
+			log.Fatalf("A secrets file needs a base64 AES key in SHELLRUNNER_SECRETS_KEY")
+		}
+		if err := manager.Secrets().UseFile(secretsFile, key); err != nil {
+			log.Fatalf("Error loading secrets: %v", err)
+		}
+	}
 
-// Since returns the output of a job since the last time it was called.
-func (s *ShellRunner) Since(id string, reply *map[string]interface{}) error {
-	logger.Printf("Since called for job ID: %s", id)
-	mutex.Lock()
-	defer mutex.Unlock()
+	// Apply the operator's rules to each job, reading them again on SIGHUP.
+	rulesDir := *rulesDirFlag
+	if rulesDir == "" {
+		rulesDir = os.Getenv("SHELLRUNNER_RULES_DIR")
+	}
+	if rulesDir != "" {
+		rules, err := runner.LoadRules(rulesDir)
+		if err != nil {
+			log.Fatalf("Error loading rules: %v", err)
+		}
+		manager.BeforeStart(rules.Apply)
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				if err := rules.Reload(); err != nil {
+					log.Printf("Error reloading rules, keeping the %d in use: %v", rules.Len(), err)
+				}
+			}
+		}()
+	}
 
-	job, ok := jobs[id]
-	if !ok {
-		return fmt.Errorf("job with id %s not found", id)
+	// Run the hook scripts before and after each job.
+	preExecHook := *preExecHookFlag
+	if preExecHook == "" {
+		preExecHook = os.Getenv("SHELLRUNNER_PRE_EXEC_HOOK")
+	}
+	if preExecHook != "" {
+		manager.BeforeStart(runner.PreExecScript(preExecHook))
+	}
+	postExecHook := *postExecHookFlag
+	if postExecHook == "" {
+		postExecHook = os.Getenv("SHELLRUNNER_POST_EXEC_HOOK")
+	}
+	if postExecHook != "" {
+		manager.OnFinish(runner.PostExecScript(postExecHook))
 	}
 
-	// Read new output from the buffers
-	stdout := job.Stdout.Bytes()
-	stderr := job.Stderr.Bytes()
+	srv := server.New(manager)
+	srv.Instance = instance
 
-	newStdout := string(stdout[job.StdoutOffset:])
-	newStderr := string(stderr[job.StderrOffset:])
+	// Configure call deadlines and slow-call thresholds.
+	timeouts := *timeoutsFlag
+	if timeouts == "" {
+		timeouts = os.Getenv("SHELLRUNNER_TIMEOUTS")
+	}
+	if timeouts != "" {
+		durations, err := server.ParseDurations(timeouts)
+		if err != nil {
+			log.Fatalf("Error parsing timeouts: %v", err)
+		}
+		srv.Timeouts = durations
+	}
+	slowCalls := *slowCallsFlag
+	if slowCalls == "" {
+		slowCalls = os.Getenv("SHELLRUNNER_SLOW_CALLS")
+	}
+	if slowCalls != "" {
+		durations, err := server.ParseDurations(slowCalls)
+		if err != nil {
+			log.Fatalf("Error parsing slow-call thresholds: %v", err)
+		}
+		srv.SlowCalls = durations
+	}
 
-	// Update offsets
-	job.StdoutOffset = len(stdout)
-	job.StderrOffset = len(stderr)
+	// Limit how fast jobs may be submitted.
+	rateLimit := *rateLimitFlag
+	if rateLimit == "" {
+		rateLimit = os.Getenv("SHELLRUNNER_RATE_LIMIT")
+	}
+	if rateLimit != "" {
+		limits, err := server.ParseRateLimits(rateLimit)
+		if err != nil {
+			log.Fatalf("Error parsing rate limits: %v", err)
+		}
+		srv.RateLimits = limits
+	}
 
-	(*reply)["stdout"] = newStdout
-	(*reply)["stderr"] = newStderr
+	// Cap the size of what clients submit.
+	payloadLimits := *payloadLimitsFlag
+	if payloadLimits == "" {
+		payloadLimits = os.Getenv("SHELLRUNNER_PAYLOAD_LIMITS")
+	}
+	if payloadLimits != "" {
+		limits, err := server.ParsePayloadLimits(payloadLimits)
+		if err != nil {
+			log.Fatalf("Error parsing payload limits: %v", err)
+		}
+		srv.PayloadLimits = limits
+	}
 
-	// If the job is finished, include its status and exit code.
-	if job.Status == "exited" || job.Status == "errored" {
-		(*reply)["status"] = job.Status
-		(*reply)["exit_code"] = job.ExitCode
+	// Limit what the jobs of each client may take up.
+	quotasPath := *quotasFlag
+	if quotasPath == "" {
+		quotasPath = os.Getenv("SHELLRUNNER_QUOTAS")
+	}
+	if quotasPath != "" {
+		quotas, err := server.LoadQuotas(quotasPath)
+		if err != nil {
+			log.Fatalf("Error loading quotas: %v", err)
+		}
+		srv.Quotas = quotas
+	}
+	admins := *adminsFlag
+	if admins == "" {
+		admins = os.Getenv("SHELLRUNNER_ADMINS")
+	}
+	if admins != "" {
+		list, err := server.ParseAdmins(admins)
+		if err != nil {
+			log.Fatalf("Error parsing admins: %v", err)
+		}
+		srv.Admins = list
+	}
+	aclPath := *aclFlag
+	if aclPath == "" {
+		aclPath = os.Getenv("SHELLRUNNER_ACL")
+	}
+	if aclPath != "" {
+		acl, err := server.LoadACL(aclPath)
+		if err != nil {
+			log.Fatalf("Error loading ACL: %v", err)
+		}
+		srv.ACL = acl
+	}
+	auditLogPath := *auditLogFlag
+	if auditLogPath == "" {
+		auditLogPath = os.Getenv("SHELLRUNNER_AUDIT_LOG")
+	}
+	if auditLogPath != "" {
+		auditLog, err := os.OpenFile(auditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			log.Fatalf("Error opening audit log: %v", err)
+		}
+		defer auditLog.Close()
+		srv.AuditLog = auditLog
 	}
 
-	return nil
-}
+	// Manage client connections.
+	maxConnections := *maxConnectionsFlag
+	if maxConnections == 0 {
+		if env := os.Getenv("SHELLRUNNER_MAX_CONNECTIONS"); env != "" {
+			n, err := strconv.Atoi(env)
+			if err != nil || n < 0 {
+				log.Fatalf("Invalid SHELLRUNNER_MAX_CONNECTIONS: %q", env)
+			}
+			maxConnections = n
+		}
+	}
+	srv.MaxConnections = maxConnections
+	idleTimeout := *idleTimeoutFlag
+	if idleTimeout == "" {
+		idleTimeout = os.Getenv("SHELLRUNNER_IDLE_TIMEOUT")
+	}
+	if idleTimeout != "" {
+		d, err := time.ParseDuration(idleTimeout)
+		if err != nil || d < 0 {
+			log.Fatalf("Invalid idle timeout: %q", idleTimeout)
+		}
+		srv.IdleTimeout = d
+	}
 
-func main() {
-	// Setup command-line flags.
-	logging := flag.Bool("logging", false, "Enable logging to stdout.")
-	socketPathFlag := flag.String("socket", "", "Path to the Unix socket. Overrides SHELLRUNNER_SOCKET_PATH.")
-	flag.Parse()
+	// Maintain what the server remembers besides its jobs.
+	maintenanceInterval := *maintenanceIntervalFlag
+	if maintenanceInterval == "" {
+		maintenanceInterval = os.Getenv("SHELLRUNNER_MAINTENANCE_INTERVAL")
+	}
+	interval := server.DefaultMaintenanceInterval
+	if maintenanceInterval != "" {
+		d, err := time.ParseDuration(maintenanceInterval)
+		if err != nil || d <= 0 {
+			log.Fatalf("Invalid maintenance interval: %q", maintenanceInterval)
+		}
+		interval = d
+	}
+	go srv.MaintainEvery(interval)
 
-	// Setup logging.
-	if *logging || os.Getenv("SHELLRUNNER_LOGGING") == "true" {
-		logger = log.New(os.Stdout, "[shellrunner] ", log.LstdFlags)
-	} else {
-		// Discard logs if not enabled.
-		logger = log.New(io.Discard, "", 0)
+	// Export trace spans.
+	otlpEndpoint := *otlpEndpointFlag
+	if otlpEndpoint == "" {
+		otlpEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if otlpEndpoint != "" {
+		srv.Tracer = server.NewTracer(otlpEndpoint)
+		if service := os.Getenv("OTEL_SERVICE_NAME"); service != "" {
+			srv.Tracer.Service = service
+		}
+		runner.TraceJobs = true
 	}
 
-	logger.Println("Server starting...")
+	// Gather the listeners: those given with -listen, the metrics address,
+	// and the socket.
+	var configs []server.ListenerConfig
+	listen := *listenFlag
+	if listen == "" {
+		listen = os.Getenv("SHELLRUNNER_LISTEN")
+	}
+	for _, spec := range strings.Split(listen, ";") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		cfg, err := server.ParseListener(spec)
+		if err != nil {
+			log.Fatalf("Invalid listener: %v", err)
+		}
+		configs = append(configs, cfg)
+	}
 
-	shellRunner := new(ShellRunner)
-	rpc.Register(shellRunner)
+	metricsAddr := *metricsAddrFlag
+	if metricsAddr == "" {
+		metricsAddr = os.Getenv("SHELLRUNNER_METRICS_ADDR")
+	}
+	if metricsAddr != "" {
+		configs = append(configs, server.ListenerConfig{Network: "http", Address: metricsAddr})
+	}
 
 	// Determine socket path
 	socketPath := *socketPathFlag
 	if socketPath == "" {
 		socketPath = os.Getenv("SHELLRUNNER_SOCKET_PATH")
 	}
-
-	var listener net.Listener
-	var err error
-
-	if socketPath != "" {
-		// Use the user-specified path.
-		listener, err = net.Listen("unix", socketPath)
-		if err != nil {
-			log.Fatalf("Error listening on specified socket: %v", err)
+	unixIndex := slices.IndexFunc(configs, func(cfg server.ListenerConfig) bool { return cfg.Network == "unix" })
+	if socketPath == "" && unixIndex < 0 && instance != "" {
+		// An instance has a socket of its own for clients to find by name.
+		socketPath = server.InstanceSocketPath(instance)
+		if err := server.MakeSocketDir(socketPath); err != nil {
+			log.Fatalf("Error creating socket directory: %v", err)
 		}
-	} else {
-		// Create a temporary directory for the socket.
-		tempDir, err := os.MkdirTemp("", "shellrunner-")
+	}
+	// A server started by an upgrade inherits the listeners of the one it
+	// replaces, which passes it the socket path it made up, if any.
+	inherited, err := server.Inherited()
+	if err != nil {
+		log.Fatalf("Error inheriting from the upgraded server: %v", err)
+	}
+	var upgradeEnv []string
+	if socketPath == "" && unixIndex < 0 {
+		// Fall back to a per-process default location.
+		var err error
+		socketPath, err = server.DefaultSocketPath()
 		if err != nil {
 			log.Fatalf("Failed to create temp dir for socket: %v", err)
 		}
-		socketPath = tempDir + "/shellrunner.sock"
-		listener, err = net.Listen("unix", socketPath)
+		defer func() {
+			if !srv.HandedOver() {
+				server.RemoveDefaultSocket(socketPath)
+			}
+		}()
+		upgradeEnv = []string{"SHELLRUNNER_SOCKET_PATH=" + socketPath}
+	}
+	if socketPath != "" {
+		configs = append([]server.ListenerConfig{{Network: "unix", Address: socketPath}}, configs...)
+	} else {
+		socketPath = configs[unixIndex].Address
+	}
+
+	if inherited != nil && len(inherited.Listeners) != len(configs) {
+		log.Fatalf("Inherited %d listeners from the upgraded server, but have %d", len(inherited.Listeners), len(configs))
+	}
+	listeners := make([]net.Listener, len(configs))
+	for i, cfg := range configs {
+		var listener net.Listener
+		var err error
+		if inherited != nil {
+			listener, err = cfg.ListenFile(inherited.Listeners[i])
+			inherited.Listeners[i].Close()
+		} else {
+			listener, err = cfg.Listen()
+		}
 		if err != nil {
-			log.Fatalf("Error listening on temporary socket: %v", err)
+			log.Fatalf("Error listening on %s %s: %v", cfg.Network, cfg.Address, err)
 		}
+		defer listener.Close()
+		listeners[i] = listener
 	}
-	defer listener.Close()
 
-	// The first and only thing to stdout should be the socket path.
-	fmt.Println(socketPath)
+	if inherited != nil {
+		if err := srv.TakeOver(inherited); err != nil {
+			log.Fatalf("Error taking over from the upgraded server: %v", err)
+		}
+	} else {
+		// The first and only thing to stdout should be the socket path.
+		fmt.Println(socketPath)
+	}
 
-	logger.Println("Server listening on", socketPath)
+	for i, listener := range listeners {
+		runner.Logger.Printf("Server listening on %s %s", configs[i].Network, listener.Addr())
+	}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			logger.Printf("Error accepting connection: %v", err)
-			continue
+	// Shut down cleanly on SIGINT or SIGTERM: stop accepting connections,
+	// cancel the calls in progress, and remove the socket.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		runner.Logger.Printf("Received %v, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			runner.Logger.Printf("Calls still in progress at shutdown: %v", err)
+		}
+	}()
+
+	// Hand over to a new process running the server's executable, such as
+	// a newer version of it, on SIGUSR2, and exit once the jobs in progress
+	// have finished.
+	var upgrading sync.WaitGroup
+	upgrades := make(chan os.Signal, 1)
+	if len(server.UpgradeSignals) > 0 {
+		signal.Notify(upgrades, server.UpgradeSignals...)
+	}
+	go func() {
+		for sig := range upgrades {
+			runner.Logger.Printf("Received %v, upgrading", sig)
+			upgrading.Add(1)
+			err := srv.Upgrade(listeners, upgradeEnv)
+			upgrading.Done()
+			if err == nil {
+				return
+			}
+			runner.Logger.Printf("Error upgrading: %v", err)
 		}
-		logger.Printf("Accepted new connection from %s", conn.RemoteAddr().String())
-		// Handle each connection in a new goroutine.
-		go jsonrpc.ServeConn(conn)
+	}()
+
+	// Serve every listener until the server shuts down.
+	var wg sync.WaitGroup
+	for i, listener := range listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.ServeListener(listener, configs[i]); !errors.Is(err, net.ErrClosed) {
+				runner.Logger.Printf("Error serving %s %s: %v", configs[i].Network, configs[i].Address, err)
+			}
+		}()
 	}
+	wg.Wait()
+	upgrading.Wait()
 }
@@ -1,8 +1,14 @@
+//go:build !windows
+
 package main
 
 import (
 	"bufio"
 	"encoding/json"
+	"io"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -17,14 +23,23 @@ var (
 	socketPath string
 )
 
+// clientBinary is the client the integration tests run, built once by
+// TestMain rather than with go run for each call, which would take longer
+// than the jobs the tests time.
+const clientBinary = "./shellrunner_client_test"
+
 // TestMain sets up and tears down the integration test environment.
 func TestMain(m *testing.M) {
-	// Build the server binary for testing.
+	// Build the server and client binaries for testing.
 	buildCmd := exec.Command("go", "build", "-o", "shellrunner_test")
 	if err := buildCmd.Run(); err != nil {
 		panic("failed to build server binary: " + err.Error())
 	}
-	defer os.Remove("shellrunner_test")
+	buildCmd = exec.Command("go", "build", "-o", clientBinary, "./client")
+	if err := buildCmd.Run(); err != nil {
+		os.Remove("shellrunner_test")
+		panic("failed to build client binary: " + err.Error())
+	}
 
 	// Start the server in a separate process group.
 	serverCmd = exec.Command("./shellrunner_test")
@@ -57,18 +72,25 @@ func TestMain(m *testing.M) {
 	}
 	serverCmd.Wait() // Clean up zombie processes.
 
-	// Clean up the socket file and its temporary directory.
+	// Clean up the socket file and its temporary directory, and the
+	// binaries, as os.Exit runs no deferred calls.
 	os.RemoveAll(filepath.Dir(socketPath))
+	os.Remove("shellrunner_test")
+	os.Remove(clientBinary)
 
 	os.Exit(code)
 }
 
+// clientCommand returns the command running the client CLI with args
+// against the test server.
+func clientCommand(args ...string) *exec.Cmd {
+	return exec.Command(clientBinary, append([]string{"-socket", socketPath}, args...)...)
+}
+
 // runClient is a helper function to execute the client CLI and parse its JSON output.
 func runClient(t *testing.T, args ...string) map[string]interface{} {
 	t.Helper()
-	cmdArgs := append([]string{"run", "client/main.go", "-socket", socketPath}, args...)
-	cmd := exec.Command("go", cmdArgs...)
-	out, err := cmd.Output()
+	out, err := clientCommand(args...).Output()
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			t.Fatalf("client command failed with args %v: %s\n%s", args, err, string(exitErr.Stderr))
@@ -89,6 +111,23 @@ func runClient(t *testing.T, args ...string) map[string]interface{} {
 	return reply
 }
 
+// waitStatus polls the status of job id until it is status, failing the
+// test if it is not within 10 seconds, and returns the last status reply.
+func waitStatus(t *testing.T, id, status string) map[string]interface{} {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		reply := runClient(t, "status", id)
+		if reply["status"] == status {
+			return reply
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected job %s to be %s, got %v", id, status, reply["status"])
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
 // TestIntegrationRun tests the synchronous "run" command.
 func TestIntegrationRun(t *testing.T) {
 	t.Run("without keep", func(t *testing.T) {
@@ -128,7 +167,7 @@ func TestIntegrationRun(t *testing.T) {
 // TestIntegrationBackgroundWorkflow tests the full asynchronous workflow.
 func TestIntegrationBackgroundWorkflow(t *testing.T) {
 	// 1. Start a background job.
-	command := `sleep 0.3; echo "workflow done"`
+	command := `sleep 1; echo "workflow done"`
 	bgReply := runClient(t, "background", command)
 	jobID, ok := bgReply["job_id"].(string)
 	if !ok || jobID == "" {
@@ -150,16 +189,10 @@ func TestIntegrationBackgroundWorkflow(t *testing.T) {
 		t.Error("expected status reply to have 'duration_seconds'")
 	}
 
-	// 3. Wait for it to finish.
-	time.Sleep(400 * time.Millisecond)
-
-	// 4. Check status after completion.
-	finalStatusReply := runClient(t, "status", jobID)
-	if finalStatusReply["status"] != "exited" {
-		t.Errorf("expected status to be 'exited', got %q", finalStatusReply["status"])
-	}
-	if duration, ok := finalStatusReply["duration_seconds"].(float64); !ok || duration < 0.3 {
-		t.Errorf("expected duration to be at least 0.3, got %v", duration)
+	// 3. Wait for it to finish, and check its status after completion.
+	finalStatusReply := waitStatus(t, jobID, "exited")
+	if duration, ok := finalStatusReply["duration_seconds"].(float64); !ok || duration < 1 {
+		t.Errorf("expected duration to be at least 1, got %v", duration)
 	}
 
 	// 5. Check the output and release the job.
@@ -170,8 +203,7 @@ func TestIntegrationBackgroundWorkflow(t *testing.T) {
 
 	// 6. Verify the job was released by checking its status again.
 	// The client should fail because the job doesn't exist.
-	cmdArgs := append([]string{"run", "client/main.go", "-socket", socketPath}, "status", jobID)
-	cmd := exec.Command("go", cmdArgs...)
+	cmd := clientCommand("status", jobID)
 	_, err := cmd.Output()
 	if err == nil {
 		t.Fatalf("expected client command to fail for released job, but it succeeded")
@@ -200,8 +232,7 @@ func TestIntegrationRelease(t *testing.T) {
 	}
 
 	// 3. Verify the job was released.
-	cmdArgs := append([]string{"run", "client/main.go", "-socket", socketPath}, "status", jobID)
-	cmd := exec.Command("go", cmdArgs...)
+	cmd := clientCommand("status", jobID)
 	_, err := cmd.Output()
 	if err == nil {
 		t.Fatalf("expected client command to fail for released job, but it succeeded")
@@ -214,11 +245,10 @@ func TestIntegrationList(t *testing.T) {
 	jobID1, _ := bgReply1["job_id"].(string)
 	bgReply2 := runClient(t, "background", `echo "done"`)
 	jobID2, _ := bgReply2["job_id"].(string)
-	time.Sleep(100 * time.Millisecond) // Allow second job to finish
+	waitStatus(t, jobID2, "exited")
 
 	// 2. List the jobs
-	cmdArgs := append([]string{"run", "client/main.go", "-socket", socketPath}, "list")
-	cmd := exec.Command("go", cmdArgs...)
+	cmd := clientCommand("list")
 	out, err := cmd.Output()
 	if err != nil {
 		t.Fatalf("client command failed: %v", err)
@@ -262,12 +292,13 @@ func TestIntegrationList(t *testing.T) {
 
 func TestIntegrationReleaseAll(t *testing.T) {
 	// 1. Start a mix of jobs
-	runClient(t, "background", `echo "finished"`)
+	bgReply1 := runClient(t, "background", `echo "finished"`)
+	jobID1, _ := bgReply1["job_id"].(string)
 	bgReply2 := runClient(t, "background", `sleep 2`)
 	jobID2, _ := bgReply2["job_id"].(string)
 
 	// 2. Wait for the first job to finish
-	time.Sleep(100 * time.Millisecond)
+	waitStatus(t, jobID1, "exited")
 
 	// 3. Release all finished jobs
 	releaseReply := runClient(t, "release-all")
@@ -276,8 +307,7 @@ func TestIntegrationReleaseAll(t *testing.T) {
 	}
 
 	// 4. Verify that the running job still exists and the finished one is gone
-	cmdArgs := append([]string{"run", "client/main.go", "-socket", socketPath}, "list")
-	cmd := exec.Command("go", cmdArgs...)
+	cmd := clientCommand("list")
 	out, err := cmd.Output()
 	if err != nil {
 		t.Fatalf("client command failed: %v", err)
@@ -303,7 +333,7 @@ func TestIntegrationReleaseAll(t *testing.T) {
 
 func resetClient(t *testing.T) {
 	t.Helper()
-	cmd := exec.Command("go", "run", "client/main.go", "reset")
+	cmd := clientCommand("reset")
 	if err := cmd.Run(); err != nil {
 		t.Fatalf("failed to reset server state: %v", err)
 	}
@@ -329,11 +359,16 @@ func TestIntegrationStatistics(t *testing.T) {
 
 func TestIntegrationSince(t *testing.T) {
 	// 1. Start a background job that produces output over time
-	bgReply := runClient(t, "background", "echo 'part 1'; sleep 0.3; echo 'part 2'")
+	bgReply := runClient(t, "background", "echo 'part 1'; sleep 1; echo 'part 2'")
 	jobID, _ := bgReply["job_id"].(string)
 
 	// 2. Wait for the first part of the output
-	time.Sleep(100 * time.Millisecond)
+	for deadline := time.Now().Add(10 * time.Second); runClient(t, "status", jobID)["stdout_bytes"] == 0.0; {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the job to write its first part")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
 
 	// 3. Call 'since' for the first time
 	sinceReply1 := runClient(t, "since", jobID)
@@ -345,7 +380,7 @@ func TestIntegrationSince(t *testing.T) {
 	}
 
 	// 4. Wait for the second part of the output
-	time.Sleep(300 * time.Millisecond)
+	waitStatus(t, jobID, "exited")
 
 	// 5. Call 'since' for the second time, now it should be finished
 	sinceReply2 := runClient(t, "since", jobID)
@@ -359,3 +394,125 @@ func TestIntegrationSince(t *testing.T) {
 	// 6. Clean up
 	runClient(t, "release", jobID)
 }
+
+// TestIntegrationUpgrade tests handing a server over to a new process on
+// SIGUSR2.
+func TestIntegrationUpgrade(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "upgrade.sock")
+	old := exec.Command("./shellrunner_test", "-socket", sock)
+	old.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// The new server inherits the old one's stdout, so Wait must not wait
+	// for it to be closed.
+	stdout, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	old.Stdout = w
+	err = old.Start()
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The new server is started by the old one, in its process group.
+	defer syscall.Kill(-old.Process.Pid, syscall.SIGKILL)
+	go io.Copy(io.Discard, stdout)
+	exited := make(chan error, 1)
+	go func() { exited <- old.Wait() }()
+
+	dial := func() *rpc.Client {
+		t.Helper()
+		for i := 0; ; i++ {
+			conn, err := net.Dial("unix", sock)
+			if err == nil {
+				return jsonrpc.NewClient(conn)
+			}
+			if i == 50 {
+				t.Fatalf("failed to connect: %v", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	background := func(c *rpc.Client, command string) (string, error) {
+		var id string
+		err := c.Call("ShellRunner.Background", map[string]interface{}{"Command": command}, &id)
+		return id, err
+	}
+	output := func(c *rpc.Client, id string) string {
+		t.Helper()
+		var out struct {
+			Stdout string `json:"stdout"`
+		}
+		if err := c.Call("ShellRunner.Output", map[string]interface{}{"ID": id}, &out); err != nil {
+			t.Fatalf("output of job %s: %v", id, err)
+		}
+		return out.Stdout
+	}
+
+	c := dial()
+	defer c.Close()
+	finished, err := background(c, "echo finished")
+	if err != nil {
+		t.Fatal(err)
+	}
+	running, err := background(c, "sleep 1; echo running")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if err := old.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	// The old server keeps serving this connection, but no longer adds
+	// jobs, and once the new server is ready, new connections reach it.
+	for i := 0; ; i++ {
+		_, err := background(c, "echo refused")
+		if err != nil && strings.Contains(err.Error(), "UNAVAILABLE") {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("expected the old server to refuse new jobs, got %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	var next *rpc.Client
+	var added string
+	for i := 0; next == nil; i++ {
+		candidate := dial()
+		if added, err = background(candidate, "echo added"); err == nil {
+			next = candidate
+		} else if !strings.Contains(err.Error(), "UNAVAILABLE") || i == 50 {
+			t.Fatalf("expected to reach the new server, got %v", err)
+		} else {
+			candidate.Close()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	defer next.Close()
+	if got := output(c, running); got != "" {
+		t.Errorf("expected the running job to go on in the old server, got %q", got)
+	}
+	// The new server forwards the calls for it to the old one meanwhile.
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := next.Call("ShellRunner.Status", running, &status); err != nil || status.Status != "running" {
+		t.Errorf("expected the new server to report the job still running on the old one, got %q, %v", status.Status, err)
+	}
+	if added == finished || added == running {
+		t.Errorf("expected a new ID for the new server's job, got %s", added)
+	}
+	if got := output(next, finished); got != "finished\n" {
+		t.Errorf("expected the finished job handed over, got %q", got)
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the old server to exit once its job finished")
+	}
+	if got := output(next, running); got != "running\n" {
+		t.Errorf("expected the running job handed over once it finished, got %q", got)
+	}
+}
@@ -0,0 +1,791 @@
+// Package client is a Go client for the ShellRunner JSON-RPC server.
+//
+// A Client wraps a connection to the server with typed methods, so programs
+// can run and watch jobs without redeclaring the server's argument and reply
+// types:
+//
+//	c, err := client.Dial(ctx, socketPath)
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//	result, err := c.Run(ctx, client.RunOptions{Command: "uname -a"})
+//
+// Every method takes a context. Cancelling it makes the method return
+// ctx.Err() straight away; the server still finishes the call.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"shellrunner/pkg/runner"
+	"shellrunner/pkg/server"
+)
+
+// PollInterval is how often Wait and Follow ask the server about a job.
+var PollInterval = 100 * time.Millisecond
+
+// A Dialer connects to a server, retrying while it is not accepting
+// connections yet, such as when it is still starting.
+type Dialer struct {
+	// Attempts is the number of connection attempts before giving up. It
+	// defaults to 5.
+	Attempts int
+	// Backoff is the delay before the first retry, doubling after each
+	// one. It defaults to 100ms.
+	Backoff time.Duration
+	// Retries is the number of times a call is retried on a new connection
+	// after the connection drops. It defaults to 3, and a negative value
+	// disables retries. Calls that may have reached the server are only
+	// retried if they are idempotent, such as Status and List.
+	Retries int
+	// RetryDelay is the delay before the first retry of a call, doubling
+	// after each one. It defaults to 100ms.
+	RetryDelay time.Duration
+	// Token is presented to a server whose listener requires one.
+	Token string
+	// TLSConfig configures the connections to a "tls:host:port" address.
+	// By default the server's certificate is verified against the
+	// system's roots.
+	TLSConfig *tls.Config
+	// Agent, if set, names the client to the server on each connection,
+	// as Identify does, so that its jobs are recorded as its own.
+	Agent string
+}
+
+// Dial connects to the server listening on socketPath, a Unix socket or a
+// named pipe on Windows, or "tls:host:port" for a server's TLS listener,
+// with the default Dialer.
+func Dial(ctx context.Context, socketPath string) (*Client, error) {
+	return Dialer{}.Dial(ctx, socketPath)
+}
+
+// InstanceSocketPath returns the socket that a server started with
+// -instance name listens on unless it is given one.
+func InstanceSocketPath(name string) string {
+	return server.InstanceSocketPath(name)
+}
+
+// Quote joins argv into a command line for a POSIX shell, such as bash or
+// sh, that runs argv as it is, quoting the arguments the shell would
+// otherwise split or interpret. Client.Quote quotes for the server's shell.
+func Quote(argv []string) string {
+	return runner.Quote(argv)
+}
+
+// Dial connects to the server listening on socketPath.
+func (d Dialer) Dial(ctx context.Context, socketPath string) (*Client, error) {
+	c := &Client{socketPath: socketPath, dialer: d}
+	if _, err := c.connection(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// A Client is a connection to a server, which it reopens if it drops. It is
+// safe for concurrent use.
+type Client struct {
+	socketPath string
+	dialer     Dialer
+
+	// mu guards the connection, which is nil while the client is
+	// disconnected.
+	mu     sync.Mutex
+	rpc    *rpc.Client
+	closed bool
+}
+
+// dial opens a new connection to the client's server.
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	attempts := c.dialer.Attempts
+	if attempts <= 0 {
+		attempts = 5
+	}
+	backoff := c.dialer.Backoff
+	if backoff <= 0 {
+		backoff = 100 * time.Millisecond
+	}
+	for attempt := 1; ; attempt++ {
+		conn, err := c.dialOnce(ctx)
+		if err == nil {
+			return conn, nil
+		}
+		if attempt >= attempts {
+			return nil, fmt.Errorf("dialing %s: %w", c.socketPath, err)
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// dialOnce makes a single attempt at connecting to the client's server,
+// presenting the dialer's token if it has one.
+func (c *Client) dialOnce(ctx context.Context) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if addr, ok := strings.CutPrefix(c.socketPath, "tls:"); ok {
+		d := tls.Dialer{Config: c.dialer.TLSConfig}
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dial(ctx, c.socketPath)
+	}
+	if err != nil || c.dialer.Token == "" {
+		return conn, err
+	}
+	if _, err := fmt.Fprintf(conn, "AUTH %s\n", c.dialer.Token); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// connection returns the client's connection, opening a new one if it is
+// disconnected.
+func (c *Client) connection(ctx context.Context) (*rpc.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, rpc.ErrShutdown
+	}
+	if c.rpc == nil {
+		conn, err := c.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		rpcClient := jsonrpc.NewClient(conn)
+		if c.dialer.Agent != "" {
+			call := rpcClient.Go("ShellRunner.Identify", IdentifyOptions{Agent: c.dialer.Agent}, new(Identity), make(chan *rpc.Call, 1))
+			select {
+			case <-call.Done:
+				err = call.Error
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			if err != nil {
+				rpcClient.Close()
+				return nil, fmt.Errorf("identifying as %q: %w", c.dialer.Agent, err)
+			}
+		}
+		c.rpc = rpcClient
+	}
+	return c.rpc, nil
+}
+
+// disconnect drops the connection rpc, which has failed, so that the next
+// call opens a new one.
+func (c *Client) disconnect(rpc *rpc.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rpc == rpc {
+		rpc.Close()
+		c.rpc = nil
+	}
+}
+
+// Close closes the connection to the server.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.rpc == nil {
+		return nil
+	}
+	return c.rpc.Close()
+}
+
+// idempotent are the methods that are safe to call again if the connection
+// drops before their reply arrives.
+var idempotent = map[string]bool{
+	"Status": true, "Group": true, "List": true, "Statistics": true, "Alerts": true, "Trends": true, "TopJobs": true, "Connections": true,
+	"Info": true, "Ping": true, "Identify": true, "Quota": true, "Validate": true, "Quote": true, "Diff": true, "Search": true, "Export": true, "AdminJobs": true, "AdminSetQuota": true, "AdminTenants": true, "AdminBackup": true, "Maintain": true, "Annotate": true, "SetSecret": true, "ListSecrets": true,
+	// Chunks are written at an offset, so writing one again changes nothing.
+	"PutFile": true, "GetFile": true, "Artifacts": true,
+}
+
+// disconnected reports whether err means the connection failed.
+func disconnected(err error) bool {
+	var opErr *net.OpError
+	return errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &opErr)
+}
+
+// Call calls the ShellRunner method with the given name, such as "Status",
+// and stores its reply in reply. It is the escape hatch for methods without
+// a typed wrapper. Errors returned by the server are *Error values, whose
+// code server.Code reports.
+func (c *Client) Call(ctx context.Context, method string, args, reply interface{}) error {
+	return c.call(ctx, method, args, reply, idempotent[method])
+}
+
+// call calls method, retrying it on a new connection if the connection
+// drops: always if the call was not sent, and otherwise only if retry is
+// set.
+func (c *Client) call(ctx context.Context, method string, args, reply interface{}, retry bool) error {
+	retries := c.dialer.Retries
+	if retries == 0 {
+		retries = 3
+	}
+	delay := c.dialer.RetryDelay
+	if delay <= 0 {
+		delay = 100 * time.Millisecond
+	}
+	for attempt := 0; ; attempt++ {
+		conn, err := c.connection(ctx)
+		if err != nil {
+			return err
+		}
+		call := conn.Go("ShellRunner."+method, args, reply, make(chan *rpc.Call, 1))
+		select {
+		case <-call.Done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if message, ok := call.Error.(rpc.ServerError); ok {
+			err := server.ParseError(string(message))
+			// A server that has handed over to an upgraded one refuses
+			// calls that add jobs without running them, so they are
+			// safe to send again, to the new server.
+			if err.Code != server.CodeUnavailable || attempt >= retries {
+				return err
+			}
+			c.disconnect(conn)
+		} else if !disconnected(call.Error) {
+			return call.Error
+		} else {
+			c.disconnect(conn)
+			// A call on a connection that had already shut down was
+			// never sent, so it is safe to send again.
+			if attempt >= retries || !(retry || errors.Is(call.Error, rpc.ErrShutdown)) {
+				return call.Error
+			}
+		}
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Run runs a command to completion and returns its output and exit code.
+func (c *Client) Run(ctx context.Context, opts RunOptions) (RunResult, error) {
+	var result RunResult
+	err := c.Call(ctx, "Run", opts, &result)
+	return result, err
+}
+
+// Background starts a command and returns its job ID, or its group ID when
+// opts.Hosts is set.
+func (c *Client) Background(ctx context.Context, opts BackgroundOptions) (string, error) {
+	var id string
+	err := c.Call(ctx, "Background", opts, &id)
+	return id, err
+}
+
+// Rerun starts a new job with the same command and options as the job with
+// the given ID, which may have been released, and returns the new job's ID.
+func (c *Client) Rerun(ctx context.Context, id string) (string, error) {
+	var newID string
+	err := c.Call(ctx, "Rerun", id, &newID)
+	return newID, err
+}
+
+// Diff returns unified diffs of the output of two jobs.
+func (c *Client) Diff(ctx context.Context, opts DiffOptions) (DiffResult, error) {
+	var result DiffResult
+	err := c.Call(ctx, "Diff", opts, &result)
+	return result, err
+}
+
+// Search returns the lines of job output that match a regular expression.
+func (c *Client) Search(ctx context.Context, opts SearchOptions) (SearchResult, error) {
+	var result SearchResult
+	err := c.Call(ctx, "Search", opts, &result)
+	return result, err
+}
+
+// Export returns the records of all the server's jobs with their output.
+func (c *Client) Export(ctx context.Context) (Archive, error) {
+	var archive Archive
+	err := c.Call(ctx, "Export", struct{}{}, &archive)
+	return archive, err
+}
+
+// Import adds the jobs of an archive written by Export, and returns the IDs
+// they were given.
+func (c *Client) Import(ctx context.Context, archive Archive) (ImportResult, error) {
+	var result ImportResult
+	err := c.Call(ctx, "Import", archive, &result)
+	return result, err
+}
+
+// SetSecret stores a named secret for jobs to use, replacing any secret of
+// the same name.
+func (c *Client) SetSecret(ctx context.Context, name, value string) error {
+	return c.Call(ctx, "SetSecret", server.SecretArgs{Name: name, Value: value}, new(bool))
+}
+
+// DeleteSecret removes a secret.
+func (c *Client) DeleteSecret(ctx context.Context, name string) error {
+	return c.Call(ctx, "DeleteSecret", name, new(bool))
+}
+
+// ListSecrets returns the names of the stored secrets.
+func (c *Client) ListSecrets(ctx context.Context) ([]SecretInfo, error) {
+	var list []SecretInfo
+	err := c.Call(ctx, "ListSecrets", struct{}{}, &list)
+	return list, err
+}
+
+// PutFile uploads the contents of r to path on the server, in chunks,
+// creating or truncating the file with mode's permissions, and returns the
+// number of bytes written.
+func (c *Client) PutFile(ctx context.Context, path string, r io.Reader, mode os.FileMode) (int64, error) {
+	buf := make([]byte, server.MaxFileChunk)
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return offset, err
+		}
+		// The first chunk is always written, to create the file even if
+		// it is empty.
+		if n > 0 || offset == 0 {
+			args := server.PutFileArgs{Path: path, Data: buf[:n], Offset: offset, Mode: uint32(mode.Perm())}
+			if err := c.Call(ctx, "PutFile", args, new(int64)); err != nil {
+				return offset, err
+			}
+			offset += int64(n)
+		}
+		if n < len(buf) {
+			return offset, nil
+		}
+	}
+}
+
+// GetFile downloads the file at path on the server to w, in chunks, and
+// returns its permissions.
+func (c *Client) GetFile(ctx context.Context, path string, w io.Writer) (os.FileMode, error) {
+	var offset int64
+	for {
+		var chunk FileChunk
+		if err := c.Call(ctx, "GetFile", server.GetFileArgs{Path: path, Offset: offset}, &chunk); err != nil {
+			return 0, err
+		}
+		if _, err := w.Write(chunk.Data); err != nil {
+			return 0, err
+		}
+		offset += int64(len(chunk.Data))
+		if chunk.EOF {
+			return os.FileMode(chunk.Mode), nil
+		}
+	}
+}
+
+// Artifacts lists the files a job has left in its workspace.
+func (c *Client) Artifacts(ctx context.Context, id string) ([]Artifact, error) {
+	var artifacts []Artifact
+	err := c.Call(ctx, "Artifacts", id, &artifacts)
+	return artifacts, err
+}
+
+// Status returns the status of a job.
+func (c *Client) Status(ctx context.Context, id string) (JobStatus, error) {
+	var status JobStatus
+	err := c.Call(ctx, "Status", id, &status)
+	return status, err
+}
+
+// Group returns the status of a group of jobs.
+func (c *Client) Group(ctx context.Context, id string) (GroupStatus, error) {
+	var status GroupStatus
+	err := c.Call(ctx, "Group", id, &status)
+	return status, err
+}
+
+// Output returns a job's full output, releasing the job afterwards if
+// release is set.
+func (c *Client) Output(ctx context.Context, id string, release bool) (JobOutput, error) {
+	var output JobOutput
+	// Reading the output again is harmless unless it releases the job.
+	err := c.call(ctx, "Output", server.OutputArgs{ID: id, Release: release}, &output, !release)
+	return output, err
+}
+
+// OutputWith is like Output, with the filter and encoding of opts applied
+// to the output on the server.
+func (c *Client) OutputWith(ctx context.Context, opts OutputOptions) (JobOutput, error) {
+	var output JobOutput
+	err := c.call(ctx, "Output", opts, &output, !opts.Release)
+	return output, err
+}
+
+// Since returns a job's output since the previous call to Since.
+func (c *Client) Since(ctx context.Context, id string) (JobOutput, error) {
+	var output JobOutput
+	err := c.Call(ctx, "Since", id, &output)
+	return output, err
+}
+
+// Release removes a job from the server.
+func (c *Client) Release(ctx context.Context, id string) error {
+	var released bool
+	return c.Call(ctx, "Release", id, &released)
+}
+
+// ReleaseAll removes every finished job and returns how many there were.
+func (c *Client) ReleaseAll(ctx context.Context) (int, error) {
+	var count int
+	err := c.Call(ctx, "ReleaseAll", struct{}{}, &count)
+	return count, err
+}
+
+// Kill sends a signal, such as "TERM", to a job. An empty signal is KILL.
+func (c *Client) Kill(ctx context.Context, id, signal string) error {
+	var killed bool
+	return c.Call(ctx, "Kill", server.KillArgs{ID: id, Signal: signal}, &killed)
+}
+
+// Pause stops a running job until Resume is called.
+func (c *Client) Pause(ctx context.Context, id string) error {
+	var paused bool
+	return c.Call(ctx, "Pause", id, &paused)
+}
+
+// Resume continues a job stopped by Pause.
+func (c *Client) Resume(ctx context.Context, id string) error {
+	var resumed bool
+	return c.Call(ctx, "Resume", id, &resumed)
+}
+
+// WriteStdin writes data to the stdin of a running job started with
+// StdinOpen, in chunks of at most MaxFileChunk bytes.
+func (c *Client) WriteStdin(ctx context.Context, id string, data []byte) error {
+	for len(data) > 0 {
+		chunk := data[:min(len(data), server.MaxFileChunk)]
+		if err := c.Call(ctx, "WriteStdin", server.WriteStdinArgs{ID: id, Data: chunk}, new(int)); err != nil {
+			return err
+		}
+		data = data[len(chunk):]
+	}
+	return nil
+}
+
+// CloseStdin closes the stdin of a running job started with StdinOpen, so
+// that it reads the end of its input.
+func (c *Client) CloseStdin(ctx context.Context, id string) error {
+	var closed bool
+	return c.Call(ctx, "CloseStdin", id, &closed)
+}
+
+// ExtendTimeout gives a running job extra time before its timeout kills it,
+// and returns its new deadline.
+func (c *Client) ExtendTimeout(ctx context.Context, id string, extra time.Duration) (time.Time, error) {
+	var deadline time.Time
+	err := c.Call(ctx, "ExtendTimeout", server.ExtendTimeoutArgs{ID: id, ExtraSeconds: extra.Seconds()}, &deadline)
+	return deadline, err
+}
+
+// Annotate sets the annotation key of the job with the given ID to value,
+// or removes it if value is empty, and returns the job's annotations.
+func (c *Client) Annotate(ctx context.Context, id, key, value string) (map[string]string, error) {
+	var annotations map[string]string
+	err := c.Call(ctx, "Annotate", server.AnnotateArgs{ID: id, Key: key, Value: value}, &annotations)
+	return annotations, err
+}
+
+// KillAll sends a signal, as Kill does, to every running job opts selects.
+func (c *Client) KillAll(ctx context.Context, opts KillAllOptions) (KillAllResult, error) {
+	var result KillAllResult
+	err := c.Call(ctx, "KillAll", opts, &result)
+	return result, err
+}
+
+// listPageSize is the number of jobs List fetches at a time.
+const listPageSize = 1000
+
+// List returns every job the server knows about, in order of ID. It fetches
+// them a page at a time, so jobs started or released meanwhile may be missed
+// or included.
+func (c *Client) List(ctx context.Context) ([]JobListEntry, error) {
+	var list []JobListEntry
+	opts := ListOptions{Limit: listPageSize}
+	for {
+		page, err := c.ListPage(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, page.Jobs...)
+		if page.NextAfterID == "" {
+			return list, nil
+		}
+		opts.AfterID = page.NextAfterID
+	}
+}
+
+// ListPage returns one page of the server's jobs, in order of ID, and their
+// total number.
+func (c *Client) ListPage(ctx context.Context, opts ListOptions) (JobList, error) {
+	var page JobList
+	err := c.Call(ctx, "List", opts, &page)
+	return page, err
+}
+
+// Statistics returns the server's execution statistics.
+func (c *Client) Statistics(ctx context.Context) (Stats, error) {
+	var stats Stats
+	err := c.Call(ctx, "Statistics", struct{}{}, &stats)
+	return stats, err
+}
+
+// Alerts returns the alerts the server has raised about jobs that ran for
+// longer than expected and missed checks, and the state of the checks.
+func (c *Client) Alerts(ctx context.Context) (AlertsResult, error) {
+	var alerts AlertsResult
+	err := c.Call(ctx, "Alerts", struct{}{}, &alerts)
+	return alerts, err
+}
+
+// Trends returns how the runs of each series of jobs on the server have
+// gone, or of just the given one if series is set.
+func (c *Client) Trends(ctx context.Context, series string) (TrendsResult, error) {
+	var trends TrendsResult
+	err := c.Call(ctx, "Trends", TrendsOptions{Series: series}, &trends)
+	return trends, err
+}
+
+// TopJobs samples what the server's running jobs use and returns them
+// ordered by CPU or by resident memory, as opts says.
+func (c *Client) TopJobs(ctx context.Context, opts TopJobsOptions) (TopJobsResult, error) {
+	var top TopJobsResult
+	err := c.Call(ctx, "TopJobs", opts, &top)
+	return top, err
+}
+
+// AdminJobs lists the jobs of every tenant on the server, or of just the
+// given one if tenant is set. Only admins may call it.
+func (c *Client) AdminJobs(ctx context.Context, tenant string) (AdminJobList, error) {
+	var jobs AdminJobList
+	err := c.Call(ctx, "AdminJobs", AdminJobsOptions{Tenant: tenant}, &jobs)
+	return jobs, err
+}
+
+// AdminKill sends a signal to jobs of any tenant. Only admins may call it.
+func (c *Client) AdminKill(ctx context.Context, opts AdminKillOptions) (KillAllResult, error) {
+	var result KillAllResult
+	err := c.Call(ctx, "AdminKill", opts, &result)
+	return result, err
+}
+
+// AdminRelease releases jobs of any tenant. Only admins may call it.
+func (c *Client) AdminRelease(ctx context.Context, opts AdminReleaseOptions) (AdminReleaseResult, error) {
+	var result AdminReleaseResult
+	err := c.Call(ctx, "AdminRelease", opts, &result)
+	return result, err
+}
+
+// AdminSetQuota sets the quota of a tenant until the server restarts, or
+// removes it if quota is nil, and returns the quotas now in force. Only
+// admins may call it.
+func (c *Client) AdminSetQuota(ctx context.Context, tenant string, quota *Quota) (Quotas, error) {
+	var quotas Quotas
+	err := c.Call(ctx, "AdminSetQuota", AdminSetQuotaOptions{Tenant: tenant, Quota: quota}, &quotas)
+	return quotas, err
+}
+
+// AdminTenants returns the statistics, quota and usage of each tenant. Only
+// admins may call it.
+func (c *Client) AdminTenants(ctx context.Context) (TenantList, error) {
+	var tenants TenantList
+	err := c.Call(ctx, "AdminTenants", struct{}{}, &tenants)
+	return tenants, err
+}
+
+// AdminBackup saves the server's jobs and quotas to a file at path, an
+// absolute path on the server's host. Only admins may call it.
+func (c *Client) AdminBackup(ctx context.Context, path string) (AdminBackupResult, error) {
+	var result AdminBackupResult
+	err := c.Call(ctx, "AdminBackup", server.AdminBackupArgs{Path: path}, &result)
+	return result, err
+}
+
+// AdminRestore restores a backup AdminBackup saved at path on the server's
+// host, importing its jobs and replacing the quotas in force. Only admins
+// may call it.
+func (c *Client) AdminRestore(ctx context.Context, path string) (AdminRestoreResult, error) {
+	var result AdminRestoreResult
+	err := c.Call(ctx, "AdminRestore", server.AdminRestoreArgs{Path: path}, &result)
+	return result, err
+}
+
+// Maintain has the server forget the released jobs and series of trends
+// older than its history retention and its expired cached results at once.
+// Only admins may call it.
+func (c *Client) Maintain(ctx context.Context) (MaintainResult, error) {
+	var result MaintainResult
+	err := c.Call(ctx, "Maintain", struct{}{}, &result)
+	return result, err
+}
+
+// Connections lists the server's open connections, including this one.
+func (c *Client) Connections(ctx context.Context) ([]ConnectionInfo, error) {
+	var conns []ConnectionInfo
+	err := c.Call(ctx, "Connections", struct{}{}, &conns)
+	return conns, err
+}
+
+// Info describes the server process.
+func (c *Client) Info(ctx context.Context) (ServerInfo, error) {
+	var info ServerInfo
+	err := c.Call(ctx, "Info", struct{}{}, &info)
+	return info, err
+}
+
+// Quote joins argv into a command string that the server's shell runs as
+// argv. Quote, the function, does the same for a POSIX shell without asking
+// the server.
+func (c *Client) Quote(ctx context.Context, argv []string) (string, error) {
+	var command string
+	err := c.Call(ctx, "Quote", server.QuoteArgs{Argv: argv}, &command)
+	return command, err
+}
+
+// Validate checks the syntax of command with the server's shell, without
+// running it.
+func (c *Client) Validate(ctx context.Context, command string) (ValidateResult, error) {
+	var result ValidateResult
+	err := c.Call(ctx, "Validate", server.ValidateArgs{Command: command}, &result)
+	return result, err
+}
+
+// Quota returns the caller's quota on the server and what its jobs take up
+// of it.
+func (c *Client) Quota(ctx context.Context) (QuotaUsage, error) {
+	var usage QuotaUsage
+	err := c.Call(ctx, "Quota", struct{}{}, &usage)
+	return usage, err
+}
+
+// Identify names the client as agent for the jobs it submits from now on,
+// including on the connections it reopens, and returns the identity the
+// server records them with.
+func (c *Client) Identify(ctx context.Context, agent string) (Identity, error) {
+	c.mu.Lock()
+	c.dialer.Agent = agent
+	c.mu.Unlock()
+	var id Identity
+	err := c.Call(ctx, "Identify", IdentifyOptions{Agent: agent}, &id)
+	return id, err
+}
+
+// Ping calls the server's Ping method and returns its reply along with the
+// round trip of the call.
+func (c *Client) Ping(ctx context.Context) (Pong, time.Duration, error) {
+	var pong Pong
+	start := time.Now()
+	err := c.Call(ctx, "Ping", struct{}{}, &pong)
+	return pong, time.Since(start), err
+}
+
+// Resize changes the terminal size of a job running under a pty.
+func (c *Client) Resize(ctx context.Context, id string, rows, cols uint16) error {
+	var resized bool
+	return c.Call(ctx, "Resize", server.ResizeArgs{ID: id, Rows: rows, Cols: cols}, &resized)
+}
+
+// Exec starts an interactive session and returns its job ID. Attach
+// connects to its terminal.
+func (c *Client) Exec(ctx context.Context, opts ExecOptions) (string, error) {
+	var id string
+	err := c.Call(ctx, "Exec", opts, &id)
+	return id, err
+}
+
+// Attach opens a new connection to the terminal of the session with the
+// given job ID. Writes to it are the session's input and reads return its
+// output until the job exits. Closing it hangs up the terminal.
+func (c *Client) Attach(ctx context.Context, id string) (net.Conn, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(conn, "EXEC %s\n", id); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// AttachJob opens a new connection attached to a running background job.
+// Reads return the output the job has captured so far, and then its output
+// as it is captured, until the job exits. Writes are the job's input, if
+// it has a terminal or was started with StdinOpen. Closing the connection
+// detaches from the job, leaving it running.
+func (c *Client) AttachJob(ctx context.Context, id string) (net.Conn, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(conn, "ATTACH %s\n", id); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Wait waits for a job to finish and returns its final status.
+func (c *Client) Wait(ctx context.Context, id string) (JobStatus, error) {
+	for {
+		status, err := c.Status(ctx, id)
+		if err != nil || status.Finished() {
+			return status, err
+		}
+		select {
+		case <-time.After(PollInterval):
+		case <-ctx.Done():
+			return status, ctx.Err()
+		}
+	}
+}
+
+// Follow copies a job's output to stdout and stderr as it is produced until
+// the job finishes, and returns the job's final status and exit code. It
+// reads the output with Since, so output already returned by an earlier call
+// to Since is not copied again.
+func (c *Client) Follow(ctx context.Context, id string, stdout, stderr io.Writer) (JobOutput, error) {
+	for {
+		output, err := c.Since(ctx, id)
+		if err != nil {
+			return output, err
+		}
+		if _, err := io.WriteString(stdout, output.Stdout); err != nil {
+			return output, err
+		}
+		if _, err := io.WriteString(stderr, output.Stderr); err != nil {
+			return output, err
+		}
+		if output.Status != "" {
+			return output, nil
+		}
+		select {
+		case <-time.After(PollInterval):
+		case <-ctx.Done():
+			return output, ctx.Err()
+		}
+	}
+}
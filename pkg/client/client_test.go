@@ -0,0 +1,600 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"shellrunner/pkg/runner"
+	"shellrunner/pkg/server"
+)
+
+// serve starts a server with a fresh job manager on a new socket and returns
+// the socket's path.
+func serve(t *testing.T) string {
+	t.Helper()
+	return serveWith(t, runner.DefaultConfig())
+}
+
+// serveWith is like serve, but gives the job manager the given settings.
+func serveWith(t *testing.T, config runner.Config) string {
+	t.Helper()
+	socketPath, err := server.DefaultSocketPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(filepath.Dir(socketPath)) })
+	listener, err := server.Listen(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go server.New(runner.NewManager(config)).Serve(listener)
+	return socketPath
+}
+
+// connect dials the server on socketPath.
+func connect(t *testing.T, socketPath string) *Client {
+	t.Helper()
+	c, err := Dial(context.Background(), socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestRun(t *testing.T) {
+	c := connect(t, serve(t))
+	ctx := context.Background()
+
+	result, err := c.Run(ctx, RunOptions{Command: "echo hello; exit 3"})
+	if err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+	if result.Stdout != "hello\n" || result.ExitCode != 3 || result.JobID != "" {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	result, err = c.Run(ctx, RunOptions{Command: "true", Keep: true})
+	if err != nil {
+		t.Fatalf("Run returned an error: %v", err)
+	}
+	status, err := c.Status(ctx, result.JobID)
+	if err != nil {
+		t.Fatalf("Status returned an error: %v", err)
+	}
+	if status.Command != "true" || !status.Finished() || status.ExitCode == nil || *status.ExitCode != 0 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestWait(t *testing.T) {
+	c := connect(t, serve(t))
+	ctx := context.Background()
+
+	id, err := c.Background(ctx, BackgroundOptions{Command: "sleep 0.3; exit 2"})
+	if err != nil {
+		t.Fatalf("Background returned an error: %v", err)
+	}
+	status, err := c.Wait(ctx, id)
+	if err != nil {
+		t.Fatalf("Wait returned an error: %v", err)
+	}
+	if status.Status != "exited" || status.ExitCode == nil || *status.ExitCode != 2 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	if _, err := c.Status(ctx, "nonexistent"); server.Code(err) != server.CodeJobNotFound {
+		t.Errorf("expected a %s error for a nonexistent job, got %v", server.CodeJobNotFound, err)
+	}
+}
+
+func TestFollow(t *testing.T) {
+	c := connect(t, serve(t))
+	ctx := context.Background()
+
+	id, err := c.Background(ctx, BackgroundOptions{Command: "echo one; sleep 0.3; echo two >&2"})
+	if err != nil {
+		t.Fatalf("Background returned an error: %v", err)
+	}
+	var stdout, stderr bytes.Buffer
+	output, err := c.Follow(ctx, id, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("Follow returned an error: %v", err)
+	}
+	if stdout.String() != "one\n" || stderr.String() != "two\n" {
+		t.Errorf("unexpected output: %q, %q", stdout.String(), stderr.String())
+	}
+	if output.Status != "exited" || output.ExitCode == nil || *output.ExitCode != 0 {
+		t.Errorf("unexpected final output: %+v", output)
+	}
+}
+
+func TestContext(t *testing.T) {
+	c := connect(t, serve(t))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.Run(ctx, RunOptions{Command: "sleep 2"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Run returned after %v, not when its context expired", elapsed)
+	}
+}
+
+func TestPing(t *testing.T) {
+	c := connect(t, serve(t))
+	ctx := context.Background()
+
+	before := time.Now()
+	first, roundTrip, err := c.Ping(ctx)
+	if err != nil {
+		t.Fatalf("Ping returned an error: %v", err)
+	}
+	if roundTrip <= 0 || roundTrip > time.Since(before) {
+		t.Errorf("unexpected round trip %v", roundTrip)
+	}
+	if first.ServerTime.Before(before.Add(-time.Second)) || first.ServerTime.After(time.Now().Add(time.Second)) {
+		t.Errorf("unexpected server time %v", first.ServerTime)
+	}
+	second, _, err := c.Ping(ctx)
+	if err != nil {
+		t.Fatalf("Ping returned an error: %v", err)
+	}
+	if second.Counter != first.Counter+1 {
+		t.Errorf("expected the counter to go from %d to %d, got %d", first.Counter, first.Counter+1, second.Counter)
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	socketPath, err := server.DefaultSocketPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(filepath.Dir(socketPath)) })
+
+	if _, err := (Dialer{Attempts: 1}).Dial(context.Background(), socketPath); err == nil {
+		t.Fatal("expected an error dialing a socket nobody listens on")
+	}
+
+	// A server that starts while the client is retrying is reached.
+	listening := make(chan error, 1)
+	time.AfterFunc(150*time.Millisecond, func() {
+		listener, err := server.Listen(socketPath)
+		if err == nil {
+			t.Cleanup(func() { listener.Close() })
+			go server.New(runner.NewManager(runner.DefaultConfig())).Serve(listener)
+		}
+		listening <- err
+	})
+	c, err := Dialer{Backoff: 50 * time.Millisecond}.Dial(context.Background(), socketPath)
+	if err := <-listening; err != nil {
+		t.Fatal(err)
+	}
+	if err != nil {
+		t.Fatalf("Dial returned an error: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.List(context.Background()); err != nil {
+		t.Errorf("List returned an error: %v", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	socketPath, err := server.DefaultSocketPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(filepath.Dir(socketPath)) })
+	listener, err := server.Listen(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	// The server drops connections once they have been idle briefly.
+	srv := server.New(runner.NewManager(runner.DefaultConfig()))
+	srv.IdleTimeout = 100 * time.Millisecond
+	go srv.Serve(listener)
+	ctx := context.Background()
+
+	c, err := Dialer{RetryDelay: 10 * time.Millisecond}.Dial(ctx, socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	id, err := c.Background(ctx, BackgroundOptions{Command: "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if _, err := c.Status(ctx, id); err != nil {
+		t.Errorf("expected Status to reconnect, got %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if _, err := c.Background(ctx, BackgroundOptions{Command: "true"}); err != nil {
+		t.Errorf("expected a call made after the connection dropped to be sent on a new one, got %v", err)
+	}
+
+	noRetries, err := Dialer{Retries: -1}.Dial(ctx, socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer noRetries.Close()
+	time.Sleep(300 * time.Millisecond)
+	if _, err := noRetries.List(ctx); err == nil {
+		t.Error("expected an error from a dropped connection without retries")
+	}
+	if _, err := noRetries.List(ctx); err != nil {
+		t.Errorf("expected the next call to reconnect, got %v", err)
+	}
+
+	c.Close()
+	if _, err := c.List(ctx); err == nil {
+		t.Error("expected an error calling a closed client")
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	socketPath, err := server.DefaultSocketPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(filepath.Dir(socketPath)) })
+	listener, err := server.Listen(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	// The server refuses every other Background, as one that has handed
+	// over to an upgraded one would.
+	srv := server.New(runner.NewManager(runner.DefaultConfig()))
+	var calls atomic.Int64
+	srv.Interceptors = append(srv.Interceptors, func(call *server.Call, next server.Handler) error {
+		if call.Method == "Background" {
+			if calls.Add(1)%2 == 1 {
+				return &server.Error{Code: server.CodeUnavailable, Message: "upgraded"}
+			}
+		}
+		return next(call)
+	})
+	go srv.Serve(listener)
+	ctx := context.Background()
+
+	c, err := Dialer{RetryDelay: 10 * time.Millisecond}.Dial(ctx, socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Background(ctx, BackgroundOptions{Command: "true"}); err != nil {
+		t.Errorf("expected Background to be sent again on a new connection, got %v", err)
+	}
+
+	noRetries, err := Dialer{Retries: -1}.Dial(ctx, socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer noRetries.Close()
+	if _, err := noRetries.Background(ctx, BackgroundOptions{Command: "true"}); server.Code(err) != server.CodeUnavailable {
+		t.Errorf("expected UNAVAILABLE without retries, got %v", err)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "script.sh")
+	config := runner.DefaultConfig()
+	if err := config.SetFileDirs(dir); err != nil {
+		t.Fatal(err)
+	}
+	c := connect(t, serveWith(t, config))
+
+	// The file takes more than one chunk.
+	data := bytes.Repeat([]byte("echo hello\n"), server.MaxFileChunk/10)
+	n, err := c.PutFile(ctx, path, bytes.NewReader(data), 0o755)
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("expected %d bytes written, got %d, %v", len(data), n, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o755 {
+		t.Errorf("expected an executable file, got %v, %v", info, err)
+	}
+
+	var got bytes.Buffer
+	mode, err := c.GetFile(ctx, path, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), data) || mode != 0o755 {
+		t.Errorf("expected the uploaded file back, got %d bytes with mode %v", got.Len(), mode)
+	}
+
+	// An empty upload still creates the file.
+	empty := filepath.Join(dir, "empty")
+	if _, err := c.PutFile(ctx, empty, bytes.NewReader(nil), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetFile(ctx, empty, &got); err != nil {
+		t.Errorf("expected the empty file to exist, got %v", err)
+	}
+	if _, err := c.GetFile(ctx, "relative/path", &got); server.Code(err) != server.CodeInvalidArgument {
+		t.Errorf("expected INVALID_ARGUMENT for a relative path, got %v", err)
+	}
+}
+
+func TestAttachJob(t *testing.T) {
+	c := connect(t, serve(t))
+	ctx := context.Background()
+
+	id, err := c.Background(ctx, BackgroundOptions{Command: "cat", Stdin: "one\n", StdinOpen: true})
+	if err != nil {
+		t.Fatalf("Background returned an error: %v", err)
+	}
+	// readLine reads a line from stream, failing the test if it is not
+	// want.
+	readLine := func(stream net.Conn, want string) {
+		t.Helper()
+		stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := bufio.NewReader(stream).ReadString('\n')
+		if line != want {
+			t.Fatalf("expected %q, got %q, %v", want, line, err)
+		}
+	}
+
+	// The output so far is replayed, and input forwarded to the job.
+	stream, err := c.AttachJob(ctx, id)
+	if err != nil {
+		t.Fatalf("AttachJob returned an error: %v", err)
+	}
+	readLine(stream, "one\n")
+	fmt.Fprintf(stream, "two\n")
+	readLine(stream, "two\n")
+
+	// Detaching leaves the job running.
+	stream.Close()
+	time.Sleep(100 * time.Millisecond)
+	if status, err := c.Status(ctx, id); err != nil || status.Status != "running" {
+		t.Fatalf("expected the job to keep running once detached, got %+v, %v", status, err)
+	}
+
+	// The stream ends once the job exits.
+	stream, err = c.AttachJob(ctx, id)
+	if err != nil {
+		t.Fatalf("AttachJob returned an error: %v", err)
+	}
+	defer stream.Close()
+	if err := c.CloseStdin(ctx, id); err != nil {
+		t.Fatalf("CloseStdin returned an error: %v", err)
+	}
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if rest, err := io.ReadAll(stream); err != nil || string(rest) != "one\ntwo\n" {
+		t.Errorf("expected the replayed output and the end of the stream, got %q, %v", rest, err)
+	}
+}
+
+// selfSigned writes a certificate for 127.0.0.1 and its key to dir, and
+// returns their paths along with a pool trusting the certificate.
+func selfSigned(t *testing.T, dir string) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pool = x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+	return certFile, keyFile, pool
+}
+
+func TestDialTLS(t *testing.T) {
+	certFile, keyFile, pool := selfSigned(t, t.TempDir())
+	cfg := server.ListenerConfig{Network: "tls", Address: "127.0.0.1:0", CertFile: certFile, KeyFile: keyFile, Token: "s3cret"}
+	listener, err := cfg.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go server.New(runner.NewManager(runner.DefaultConfig())).ServeListener(listener, cfg)
+	ctx := context.Background()
+	addr := "tls:" + listener.Addr().String()
+
+	c, err := Dialer{Token: "s3cret", TLSConfig: &tls.Config{RootCAs: pool}}.Dial(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	result, err := c.Run(ctx, RunOptions{Command: "echo hello"})
+	if err != nil || result.Stdout != "hello\n" {
+		t.Errorf("Run over TLS returned %+v, %v", result, err)
+	}
+
+	wrong, err := Dialer{Token: "guess", TLSConfig: &tls.Config{RootCAs: pool}, Retries: -1}.Dial(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wrong.Close()
+	if _, err := wrong.Run(ctx, RunOptions{Command: "echo hello"}); err == nil {
+		t.Error("Run with the wrong token succeeded")
+	}
+
+	untrusted, err := Dialer{Token: "s3cret", Attempts: 1}.Dial(ctx, addr)
+	if err == nil {
+		untrusted.Close()
+		t.Error("Dial trusted a self-signed certificate")
+	}
+}
+
+// clientCert writes a CA to dir and returns its path, along with a client
+// certificate it signs for commonName.
+func clientCert(t *testing.T, dir, commonName string) (caFile string, cert tls.Certificate) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile = filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName + ".example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return caFile, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestDialMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, pool := selfSigned(t, dir)
+	caFile, cert := clientCert(t, dir, "deploy")
+	_, stranger := clientCert(t, t.TempDir(), "deploy")
+	ctx := context.Background()
+
+	listen := func(cfg server.ListenerConfig) string {
+		t.Helper()
+		listener, err := cfg.Listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go server.New(runner.NewManager(runner.DefaultConfig())).ServeListener(listener, cfg)
+		return "tls:" + listener.Addr().String()
+	}
+	submitter := func(addr string, cert tls.Certificate) (*runner.Identity, error) {
+		t.Helper()
+		c, err := Dialer{TLSConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}}, Retries: -1}.Dial(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		defer c.Close()
+		id, err := c.Background(ctx, BackgroundOptions{Command: "true"})
+		if err != nil {
+			return nil, err
+		}
+		status, err := c.Status(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		return status.Submitter, nil
+	}
+
+	addr := listen(server.ListenerConfig{Network: "tls", Address: "127.0.0.1:0", CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile})
+	if id, err := submitter(addr, cert); err != nil || id == nil || id.Cert != "deploy" {
+		t.Errorf("expected the job to be submitted by cert:deploy, got %+v, %v", id, err)
+	}
+	if _, err := submitter(addr, stranger); err == nil {
+		t.Error("a certificate signed by another CA was accepted")
+	}
+	if _, err := submitter(addr, tls.Certificate{}); err == nil {
+		t.Error("a client without a certificate was accepted")
+	}
+
+	addr = listen(server.ListenerConfig{Network: "tls", Address: "127.0.0.1:0", CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile,
+		CertNames: map[string]string{"deploy.example.com": "ci"}})
+	if id, err := submitter(addr, cert); err != nil || id == nil || id.Cert != "ci" {
+		t.Errorf("expected the job to be submitted by cert:ci, got %+v, %v", id, err)
+	}
+	addr = listen(server.ListenerConfig{Network: "tls", Address: "127.0.0.1:0", CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile,
+		CertNames: map[string]string{"backup": "backup"}})
+	if _, err := submitter(addr, cert); err == nil {
+		t.Error("a certificate without a mapped name was accepted")
+	}
+}
+
+func TestAgent(t *testing.T) {
+	ctx := context.Background()
+	c, err := Dialer{Agent: "nightly-backup"}.Dial(ctx, serve(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	id, err := c.Background(ctx, BackgroundOptions{Command: "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := c.Status(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Submitter == nil || status.Submitter.Agent != "nightly-backup" {
+		t.Errorf("unexpected submitter: %+v", status.Submitter)
+	}
+
+	if _, err := c.Identify(ctx, "rebuild"); err != nil {
+		t.Fatal(err)
+	}
+	id, err = c.Background(ctx, BackgroundOptions{Command: "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err = c.Status(ctx, id); err != nil || status.Submitter == nil || status.Submitter.Agent != "rebuild" {
+		t.Errorf("unexpected status after Identify: %+v, %v", status, err)
+	}
+}
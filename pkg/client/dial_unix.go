@@ -0,0 +1,14 @@
+//go:build !windows
+
+package client
+
+import (
+	"context"
+	"net"
+)
+
+// dial connects to the server's Unix socket.
+func dial(ctx context.Context, path string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", path)
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"shellrunner/pkg/runner"
+	"shellrunner/pkg/server"
+)
+
+// The argument and reply types are the server's own, so the two cannot drift
+// apart.
+type (
+	JobOptions           = server.JobOptions
+	RunOptions           = server.RunArgs
+	BackgroundOptions    = server.BackgroundArgs
+	ExecOptions          = server.ExecArgs
+	RunResult            = server.RunResult
+	JobStatus            = server.JobStatus
+	RecordedOptions      = server.RecordedOptions
+	JobOutput            = server.JobOutput
+	OutputOptions        = server.OutputArgs
+	DiffOptions          = server.DiffArgs
+	DiffResult           = server.DiffResult
+	SearchOptions        = server.SearchArgs
+	SearchResult         = server.SearchResult
+	SearchMatch          = server.SearchMatch
+	Archive              = server.Archive
+	ImportResult         = server.ImportResult
+	SecretInfo           = runner.SecretInfo
+	FileChunk            = server.FileChunk
+	Artifact             = runner.Artifact
+	OutputFilter         = runner.OutputFilter
+	Notification         = runner.Notification
+	SuccessOptions       = server.SuccessOptions
+	ExpectOptions        = server.ExpectOptions
+	GroupStatus          = server.GroupStatus
+	GroupJob             = server.GroupJob
+	Stats                = server.Stats
+	Alert                = server.Alert
+	Check                = server.Check
+	AlertsResult         = server.AlertsResult
+	Trend                = server.Trend
+	TrendsOptions        = server.TrendsArgs
+	TrendsResult         = server.TrendsResult
+	TopJob               = server.TopJob
+	TopJobsOptions       = server.TopJobsArgs
+	TopJobsResult        = server.TopJobsResult
+	Usage                = server.Usage
+	JobListEntry         = runner.JobListEntry
+	JobList              = server.JobList
+	ListOptions          = server.ListArgs
+	KillAllOptions       = server.KillAllArgs
+	KillAllResult        = server.KillAllResult
+	ConnectionInfo       = server.ConnectionInfo
+	ServerInfo           = server.ServerInfo
+	Pong                 = server.Pong
+	IdentifyOptions      = server.IdentifyArgs
+	Identity             = runner.Identity
+	IdentityStats        = server.IdentityStats
+	Quota                = server.Quota
+	Quotas               = server.Quotas
+	AdminJob             = server.AdminJob
+	AdminJobList         = server.AdminJobList
+	AdminJobsOptions     = server.AdminJobsArgs
+	AdminKillOptions     = server.AdminKillArgs
+	AdminReleaseOptions  = server.AdminReleaseArgs
+	AdminReleaseResult   = server.AdminReleaseResult
+	AdminSetQuotaOptions = server.AdminSetQuotaArgs
+	AdminBackupResult    = server.AdminBackupResult
+	AdminRestoreResult   = server.AdminRestoreResult
+	TenantStats          = server.TenantStats
+	TenantList           = server.TenantList
+	MaintainResult       = server.MaintainResult
+	StoreInfo            = server.StoreInfo
+	QuotaUsage           = server.QuotaUsage
+	ValidateResult       = server.ValidateResult
+	SyntaxError          = runner.SyntaxError
+	Error                = server.Error
+	ErrorCode            = server.ErrorCode
+)
+
+// The codes of the errors the server returns; see Error.
+const (
+	CodeJobNotFound      = server.CodeJobNotFound
+	CodeGroupNotFound    = server.CodeGroupNotFound
+	CodeSecretNotFound   = server.CodeSecretNotFound
+	CodeInvalidArgument  = server.CodeInvalidArgument
+	CodePolicyDenied     = server.CodePolicyDenied
+	CodePermissionDenied = server.CodePermissionDenied
+	CodeInvalidState     = server.CodeInvalidState
+	CodeTimeout          = server.CodeTimeout
+	CodeCancelled        = server.CodeCancelled
+	CodeRateLimited      = server.CodeRateLimited
+	CodeQuotaExceeded    = server.CodeQuotaExceeded
+	CodeOverloaded       = server.CodeOverloaded
+	CodeHostOverloaded   = server.CodeHostOverloaded
+	CodeUnavailable      = server.CodeUnavailable
+	CodeInternal         = server.CodeInternal
+)
+
+// DefaultDiffContext is the number of unchanged lines Diff shows around each
+// change when DiffOptions.Context is nil.
+const DefaultDiffContext = server.DefaultDiffContext
+
+// The encodings of job output in RunResult and JobOutput; see their Decode
+// methods.
+const (
+	EncodingText   = server.EncodingText
+	EncodingBase64 = server.EncodingBase64
+	EncodingAuto   = server.EncodingAuto
+)
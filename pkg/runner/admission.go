@@ -0,0 +1,61 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Admission control keeps jobs from starting while the host is overloaded,
+// so that those the Manager runs do not take it over from its other users.
+// A job submitted while the host is overloaded, by Config.MaxLoad or
+// Config.MinAvailableMemory, waits up to Config.HostWait for it to recover,
+// and is refused with ErrHostOverloaded after that.
+
+// hostPoll is how often a waiting job checks whether the host is still
+// overloaded.
+const hostPoll = time.Second
+
+// CheckHost reads the host's headroom and returns an error of kind
+// ErrHostOverloaded if it is overloaded, by the Manager's MaxLoad or
+// MinAvailableMemory. Hosts that do not report their headroom are never
+// overloaded.
+func (m *Manager) CheckHost() error {
+	maxLoad, minAvailable := m.config.MaxLoad, m.config.MinAvailableMemory
+	if maxLoad <= 0 && minAvailable == 0 {
+		return nil
+	}
+	host, err := ReadHostStats()
+	if err != nil {
+		return nil
+	}
+	if limit := maxLoad * float64(host.CPUs); maxLoad > 0 && host.Load1 > limit {
+		return withKind(ErrHostOverloaded, fmt.Errorf("the host's load of %.2f is above the limit of %.2f for its %d CPUs", host.Load1, limit, host.CPUs))
+	}
+	if host.MemoryAvailableBytes < minAvailable {
+		return withKind(ErrHostOverloaded, fmt.Errorf("the host has %d bytes of memory available, less than the %d required", host.MemoryAvailableBytes, minAvailable))
+	}
+	return nil
+}
+
+// admit waits for the host not to be overloaded, up to the Manager's
+// HostWait or until ctx is done, before a job is started.
+func (m *Manager) admit(ctx context.Context) error {
+	err := m.CheckHost()
+	if err == nil {
+		return nil
+	}
+	deadline := time.Now().Add(m.config.HostWait)
+	for time.Now().Before(deadline) {
+		select {
+		case <-time.After(min(hostPoll, time.Until(deadline))):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err = m.CheckHost(); err == nil {
+			return nil
+		}
+	}
+	Logger.Printf("Refused a job: %v", err)
+	return err
+}
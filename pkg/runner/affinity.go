@@ -0,0 +1,67 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxCPU is the highest CPU number a CPU set may name.
+const maxCPU = 4095
+
+// parseCPUSet checks a CPU set given as a list of CPU numbers and ranges,
+// such as "0-3" or "0,2,8-11", as taken by taskset and cpuset.cpus, and
+// returns the CPUs it names.
+func parseCPUSet(cpuset string) ([]int, error) {
+	var cpus []int
+	last := -1
+	for part := range strings.SplitSeq(cpuset, ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(from)
+		if err != nil || first < 0 || first > maxCPU {
+			return nil, fmt.Errorf("invalid CPU set %q: %q is not a CPU from 0 to %d", cpuset, part, maxCPU)
+		}
+		end := first
+		if isRange {
+			if end, err = strconv.Atoi(to); err != nil || end < first || end > maxCPU {
+				return nil, fmt.Errorf("invalid CPU set %q: %q is not a range of CPUs from 0 to %d", cpuset, part, maxCPU)
+			}
+		}
+		if first <= last {
+			return nil, fmt.Errorf("invalid CPU set %q: CPUs must be listed in increasing order", cpuset)
+		}
+		for cpu := first; cpu <= end; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+		last = end
+	}
+	return cpus, nil
+}
+
+// applyCPUSet arranges for cmd, and the processes it starts, to run only on
+// the CPUs of cpuset, set with taskset before the command executes.
+func applyCPUSet(cmd *exec.Cmd, cpuset string) error {
+	if cpuset == "" || cmd.Err != nil {
+		return nil
+	}
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("CPU sets are only supported on Linux")
+	}
+	cpus, err := parseCPUSet(cpuset)
+	if err != nil {
+		return err
+	}
+	if data, err := os.ReadFile("/sys/devices/system/cpu/online"); err == nil {
+		online, _ := parseCPUSet(strings.TrimSpace(string(data)))
+		for _, cpu := range cpus {
+			if !slices.Contains(online, cpu) {
+				return fmt.Errorf("invalid CPU set %q: CPU %d is not online", cpuset, cpu)
+			}
+		}
+	}
+	return wrapCommand(cmd, "taskset", "--cpu-list", cpuset)
+}
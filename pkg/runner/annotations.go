@@ -0,0 +1,49 @@
+package runner
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+)
+
+// The bounds of the annotations of a job.
+const (
+	maxAnnotations     = 64   // annotations per job
+	maxAnnotationKey   = 128  // bytes of a key
+	maxAnnotationValue = 4096 // bytes of a value
+)
+
+// Annotate sets the annotation key of the job with the given ID to value,
+// or removes it if value is empty, and returns the job's annotations.
+// Unlike labels, which are part of the job's spec, annotations are notes
+// added once the job has been submitted, such as the ticket of an incident
+// it caused, whether it is running or has finished.
+func (m *Manager) Annotate(id, key, value string) (map[string]string, error) {
+	switch {
+	case key == "" || strings.ContainsAny(key, "=\x00") || len(key) > maxAnnotationKey:
+		return nil, withKind(ErrInvalidSpec, fmt.Errorf("invalid annotation key %q: must be 1 to %d bytes, without '='", key, maxAnnotationKey))
+	case len(value) > maxAnnotationValue:
+		return nil, withKind(ErrInvalidSpec, fmt.Errorf("annotation %s is %d bytes, more than the %d allowed", key, len(value), maxAnnotationValue))
+	}
+	var annotations map[string]string
+	err := m.WithJob(id, func(job *Job) error {
+		if value == "" {
+			delete(job.Annotations, key)
+		} else {
+			if _, ok := job.Annotations[key]; !ok && len(job.Annotations) >= maxAnnotations {
+				return withKind(ErrInvalidSpec, fmt.Errorf("job with id %s already has %d annotations", id, maxAnnotations))
+			}
+			if job.Annotations == nil {
+				job.Annotations = make(map[string]string)
+			}
+			job.Annotations[key] = value
+		}
+		annotations = maps.Clone(job.Annotations)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	Logger.Printf("Annotated job %s with %s=%q", id, key, value)
+	return annotations, nil
+}
@@ -0,0 +1,238 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"time"
+)
+
+// JobRecord is the state of a job as exported by Manager.Export, for Import
+// to restore on another Manager.
+type JobRecord struct {
+	ID            string
+	Command       string
+	Argv          []string
+	Spec          *JobSpec // as submitted, before the BeforeStart hooks changed it
+	Shell         string
+	Status        string
+	ExitCode      int
+	StartError    string
+	SubmitTime    time.Time
+	StartTime     time.Time
+	EndTime       time.Time
+	Stdout        string
+	Stderr        string
+	StdoutDropped int64 // the bytes of stdout discarded before Stdout, if captured to a ring
+	StderrDropped int64
+	Group         string
+	LimitExceeded string
+	Signal        string
+	CoreDumped    bool
+	KilledBy      string
+	RerunOf       string
+	CgroupUsage   CgroupUsage
+	Annotations   map[string]string
+}
+
+// Export returns the records of all jobs, in order of ID. The output of jobs
+// that are still running is what they have written so far.
+func (m *Manager) Export() []JobRecord {
+	jobs := m.jobs.all()
+	records := make([]JobRecord, 0, len(jobs))
+	for _, job := range jobs {
+		job.mu.Lock()
+		records = append(records, job.Record())
+		job.mu.Unlock()
+	}
+	return records
+}
+
+// Record returns the record of the job, as Export does. The caller must
+// hold the job's lock, as EachJob does.
+func (job *Job) Record() JobRecord {
+	return JobRecord{
+		ID:            job.ID,
+		Command:       job.Command,
+		Argv:          job.Argv,
+		Spec:          job.Spec.original(),
+		Shell:         job.Shell,
+		Status:        job.Status,
+		ExitCode:      job.ExitCode,
+		StartError:    job.StartError,
+		SubmitTime:    job.SubmitTime,
+		StartTime:     job.StartTime,
+		EndTime:       job.EndTime,
+		Stdout:        job.Stdout.String(),
+		Stderr:        job.Stderr.String(),
+		StdoutDropped: job.Stdout.Dropped(),
+		StderrDropped: job.Stderr.Dropped(),
+		Annotations:   maps.Clone(job.Annotations),
+		Group:         job.Group,
+		LimitExceeded: job.LimitExceeded,
+		Signal:        job.Signal,
+		CoreDumped:    job.CoreDumped,
+		KilledBy:      job.KilledBy,
+		RerunOf:       job.RerunOf,
+		CgroupUsage:   job.Usage(),
+	}
+}
+
+// Import adds jobs from records exported by another Manager, and returns
+// the IDs they were given, keyed by the IDs they had. The jobs are finished:
+// those that were still running when they were exported are recorded as
+// errored, since nothing runs them any more. Jobs that were in a group are
+// put in a new group together.
+func (m *Manager) Import(records []JobRecord) (map[string]string, error) {
+	return m.restore(records, false)
+}
+
+// Adopt adds finished jobs from records exported by another Manager that
+// this one takes over from, keeping their IDs and groups. It fails if the
+// Manager already holds a job with one of the IDs.
+func (m *Manager) Adopt(records []JobRecord) error {
+	_, err := m.restore(records, true)
+	return err
+}
+
+// restore adds jobs from records, with new IDs or, if adopt is set, with
+// their own.
+func (m *Manager) restore(records []JobRecord, adopt bool) (map[string]string, error) {
+	seen := make(map[string]bool, len(records))
+	for _, record := range records {
+		if record.ID == "" || seen[record.ID] {
+			return nil, withKind(ErrInvalidSpec, fmt.Errorf("job records need unique IDs, got %q", record.ID))
+		}
+		if _, ok := m.jobs.get(record.ID); adopt && ok {
+			return nil, withKind(ErrInvalidSpec, fmt.Errorf("job %s already exists", record.ID))
+		}
+		seen[record.ID] = true
+	}
+
+	ids := make(map[string]string, len(records))
+	jobs := make([]*Job, 0, len(records))
+	groups := make(map[string]string)
+	now := time.Now()
+	for _, record := range records {
+		id, importedFrom := record.ID, ""
+		if !adopt {
+			id, importedFrom = m.nextID(), record.ID
+		}
+		ids[record.ID] = id
+
+		spec := record.Spec
+		if spec == nil {
+			spec = &JobSpec{Command: record.Command, Argv: record.Argv}
+		}
+		job := &Job{
+			ID:            id,
+			Command:       record.Command,
+			Argv:          record.Argv,
+			SubmitTime:    record.SubmitTime,
+			StartTime:     record.StartTime,
+			EndTime:       record.EndTime,
+			Status:        record.Status,
+			ExitCode:      record.ExitCode,
+			StartError:    record.StartError,
+			Spec:          spec,
+			Shell:         record.Shell,
+			LimitExceeded: record.LimitExceeded,
+			Signal:        record.Signal,
+			CoreDumped:    record.CoreDumped,
+			KilledBy:      record.KilledBy,
+			RerunOf:       record.RerunOf,
+			CgroupUsage:   record.CgroupUsage,
+			Annotations:   record.Annotations,
+			ImportedFrom:  importedFrom,
+		}
+		stdout, stderr := job.tracked(&job.Stdout, &job.Stderr)
+		io.WriteString(stdout, record.Stdout)
+		io.WriteString(stderr, record.Stderr)
+		job.Stdout.dropped, job.Stderr.dropped = record.StdoutDropped, record.StderrDropped
+		job.stdoutCounters.bytes.Add(record.StdoutDropped)
+		job.stderrCounters.bytes.Add(record.StderrDropped)
+		if !job.Finished() {
+			job.Status = "errored"
+			job.ExitCode = -1
+		}
+		if job.EndTime.IsZero() {
+			job.EndTime = now
+		}
+		if record.Stdout != "" || record.Stderr != "" {
+			// The output was written before the job ended, at the latest.
+			job.lastOutput.Store(job.EndTime.UnixNano())
+		}
+		if job.SubmitTime.IsZero() {
+			// Archives from before submit times were recorded.
+			job.SubmitTime = job.StartTime
+		}
+		judge(job)
+		job.compressOutput(m.config.CompressThreshold)
+		m.settle(job, true)
+		if record.Group != "" {
+			m.mutex.Lock()
+			group, ok := groups[record.Group]
+			if adopt {
+				group = record.Group
+			} else if !ok {
+				m.groupCounter++
+				group = fmt.Sprintf("group-%d", m.groupCounter)
+				groups[record.Group] = group
+			}
+			job.Group = group
+			m.groups[group] = append(m.groups[group], id)
+			m.mutex.Unlock()
+		}
+		jobs = append(jobs, job)
+	}
+	// Links between imported jobs follow them to their new IDs. The jobs
+	// are only published after that, complete.
+	for _, job := range jobs {
+		if rerunOf, ok := ids[job.RerunOf]; ok {
+			job.RerunOf = rerunOf
+		}
+		m.jobs.put(job)
+	}
+	if adopt {
+		Logger.Printf("Adopted %d jobs", len(records))
+	} else {
+		Logger.Printf("Imported %d jobs", len(records))
+	}
+	return ids, nil
+}
+
+// IDCounters returns the counters the Manager numbers jobs and groups with,
+// for a Manager that takes over from it to go on from with SkipIDs.
+func (m *Manager) IDCounters() (jobs, groups uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.ids.Load().counter.Load(), m.groupCounter
+}
+
+// SkipIDs makes the Manager number new jobs and groups after the given
+// counters, if they are ahead of its own, so that it does not reuse the IDs
+// of the Manager it takes over from.
+func (m *Manager) SkipIDs(jobs, groups uint64) {
+	m.mutex.Lock()
+	m.groupCounter = max(m.groupCounter, groups)
+	m.mutex.Unlock()
+	ids := m.ids.Load()
+	for {
+		n := ids.counter.Load()
+		if n >= jobs || ids.counter.CompareAndSwap(n, jobs) {
+			break
+		}
+	}
+	if ids.path != "" {
+		if err := ids.reserve(jobs); err != nil {
+			Logger.Printf("Error saving the job ID counter: %v", err)
+		}
+	}
+}
+
+// lessID orders job IDs: shorter ones first, then alphabetically, which
+// orders numbers, with or without a prefix, numerically, and UUIDv7s by the
+// time they were made.
+func lessID(a, b string) bool {
+	return len(a) < len(b) || len(a) == len(b) && a < b
+}
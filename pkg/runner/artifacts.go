@@ -0,0 +1,158 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Artifact is a file a job left behind: one in its workspace, or a copy of
+// one matching its artifact patterns.
+type Artifact struct {
+	Name     string    `json:"name"` // path relative to the job's directory
+	Path     string    `json:"path"` // absolute path on the server
+	Size     int64     `json:"size"`
+	Mode     uint32    `json:"mode"`
+	Modified time.Time `json:"modified"`
+}
+
+func newArtifact(name, path string, info fs.FileInfo) Artifact {
+	return Artifact{
+		Name:     filepath.ToSlash(name),
+		Path:     path,
+		Size:     info.Size(),
+		Mode:     uint32(info.Mode().Perm()),
+		Modified: info.ModTime(),
+	}
+}
+
+// checkArtifactPatterns checks that the artifact patterns of spec are valid
+// globs relative to the job's directory.
+func checkArtifactPatterns(spec *JobSpec) error {
+	for _, pattern := range spec.Artifacts {
+		if pattern == "" || filepath.IsAbs(pattern) {
+			return fmt.Errorf("artifact pattern %q is not a relative path", pattern)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid artifact pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// collectArtifacts copies the files matching the artifact patterns of a job
+// that has exited into a new directory, so that they outlive its workspace,
+// and returns the directory and the copies. Directories that match are
+// copied whole. Files that cannot be copied are logged and left out.
+func collectArtifacts(spec *JobSpec) (string, []Artifact) {
+	if len(spec.Artifacts) == 0 {
+		return "", nil
+	}
+	base := spec.workdir
+	if base == "" {
+		base = spec.Dir
+	}
+	if base == "" {
+		base = "."
+	}
+	dir, err := os.MkdirTemp("", "shellrunner-artifacts-")
+	if err != nil {
+		Logger.Printf("Failed to collect artifacts: %v", err)
+		return "", nil
+	}
+
+	artifacts := []Artifact{}
+	seen := make(map[string]bool)
+	for _, pattern := range spec.Artifacts {
+		matches, _ := filepath.Glob(filepath.Join(base, pattern))
+		for _, match := range matches {
+			files, err := listFiles(match)
+			if err != nil {
+				Logger.Printf("Failed to collect artifact %s: %v", match, err)
+				continue
+			}
+			for _, file := range files {
+				// Names are relative to the match, and the artifact's to base.
+				name, err := filepath.Rel(base, filepath.Join(match, file.Name))
+				if err != nil || seen[name] || strings.HasPrefix(name, "..") {
+					continue
+				}
+				seen[name] = true
+				artifact, err := copyArtifact(filepath.Join(match, file.Name), filepath.Join(dir, name))
+				if err != nil {
+					Logger.Printf("Failed to collect artifact %s: %v", name, err)
+					continue
+				}
+				artifact.Name = filepath.ToSlash(name)
+				artifacts = append(artifacts, artifact)
+			}
+		}
+	}
+	if len(artifacts) == 0 {
+		removeDir(dir)
+		dir = ""
+	}
+	sort.Slice(artifacts, func(i, j int) bool { return artifacts[i].Name < artifacts[j].Name })
+	return dir, artifacts
+}
+
+// copyArtifact copies the file at src to dst, with its permissions and
+// modification time.
+func copyArtifact(src, dst string) (Artifact, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return Artifact{}, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return Artifact{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return Artifact{}, err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return Artifact{}, err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return Artifact{}, err
+	}
+	if err := out.Close(); err != nil {
+		return Artifact{}, err
+	}
+	os.Chtimes(dst, time.Time{}, info.ModTime())
+	return newArtifact("", dst, info), nil
+}
+
+// Artifacts returns the artifacts of a job. For a job with artifact
+// patterns, they are the copies of the matching files, collected once it
+// has exited. Otherwise they are the files in its workspace.
+func (m *Manager) Artifacts(id string) ([]Artifact, error) {
+	var collected bool
+	var artifacts []Artifact
+	var workspace string
+	err := m.WithJob(id, func(job *Job) error {
+		collected = len(job.Spec.Artifacts) > 0
+		artifacts = append([]Artifact{}, job.Artifacts...)
+		workspace = job.Workspace
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if collected {
+		return artifacts, nil
+	}
+	if workspace == "" {
+		return nil, withKind(ErrInvalidSpec, fmt.Errorf("job %s has neither a workspace nor artifact patterns", id))
+	}
+	return listFiles(workspace)
+}
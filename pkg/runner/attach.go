@@ -0,0 +1,142 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// attachments fans the output of a background job out to the clients
+// attached to it with AttachJob, as it is captured.
+type attachments struct {
+	mu      sync.Mutex
+	clients map[io.WriteCloser]chan struct{} // closed when the client detaches
+	ended   bool                             // set once the job has exited
+}
+
+// stream returns a writer that captures output into w and forwards it to
+// the attached clients.
+func (a *attachments) stream(w io.Writer) io.Writer {
+	return &attachedStream{a: a, w: w}
+}
+
+// attachedStream is one of the output streams of a job with attachments.
+type attachedStream struct {
+	a *attachments
+	w io.Writer
+}
+
+func (s *attachedStream) Write(p []byte) (int, error) {
+	s.a.mu.Lock()
+	defer s.a.mu.Unlock()
+
+	n, err := s.w.Write(p)
+	for client, done := range s.a.clients {
+		if _, err := client.Write(p); err != nil {
+			// The client is gone, or too slow to keep up.
+			delete(s.a.clients, client)
+			close(done)
+		}
+	}
+	return n, err
+}
+
+// attach adds client after replaying the output captured so far, stdout
+// and then stderr, and returns a channel that is closed once it detaches.
+func (a *attachments) attach(client io.WriteCloser, stdout, stderr *OutputBuffer) (<-chan struct{}, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.ended {
+		return nil, fmt.Errorf("the job has exited")
+	}
+	for _, output := range []*OutputBuffer{stdout, stderr} {
+		if output.Len() > 0 {
+			if _, err := client.Write(output.Bytes()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if a.clients == nil {
+		a.clients = make(map[io.WriteCloser]chan struct{})
+	}
+	done := make(chan struct{})
+	a.clients[client] = done
+	return done, nil
+}
+
+// detach removes client, if it is still attached.
+func (a *attachments) detach(client io.WriteCloser) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if done, ok := a.clients[client]; ok {
+		delete(a.clients, client)
+		close(done)
+	}
+}
+
+// end detaches every client once the job has exited.
+func (a *attachments) end() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.ended = true
+	for client, done := range a.clients {
+		delete(a.clients, client)
+		close(done)
+	}
+}
+
+// AttachJob attaches client to a running background job, screen-style: the
+// output captured so far is replayed, stdout and then stderr, and what the
+// job writes after streams to client as it is captured, until client
+// detaches by closing input or the job exits. Input is typed into the
+// job's terminal, if it has one, or written to its stdin if it was started
+// with StdinOpen, and otherwise discarded. Detaching leaves the job
+// running, and any number of clients may be attached at once.
+func (m *Manager) AttachJob(id string, input io.Reader, client io.WriteCloser) error {
+	var attached *attachments
+	var stdout, stderr *OutputBuffer
+	var tty *os.File
+	var stdin *stdinPipe
+	err := m.WithJob(id, func(job *Job) error {
+		if job.attachments == nil || job.Finished() {
+			return withKind(ErrJobState, fmt.Errorf("job with id %s is not a running background job", id))
+		}
+		attached, stdout, stderr, tty, stdin = job.attachments, &job.Stdout, &job.Stderr, job.Tty, job.stdin
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	done, err := attached.attach(client, stdout, stderr)
+	if err != nil {
+		return withKind(ErrJobState, fmt.Errorf("cannot attach to job %s: %v", id, err))
+	}
+	Logger.Printf("Client attached to job %s", id)
+
+	go func() {
+		defer attached.detach(client)
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := input.Read(buf)
+			switch {
+			case n == 0:
+			case tty != nil:
+				tty.Write(buf[:n])
+			case stdin != nil:
+				// Input the job no longer takes is dropped.
+				stdin.write(id, buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	<-done
+	Logger.Printf("Client detached from job %s", id)
+	return nil
+}
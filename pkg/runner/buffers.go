@@ -0,0 +1,63 @@
+package runner
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// copyBuffers holds the buffers output is copied from commands with, which
+// io.Copy would otherwise allocate anew, 32 KiB for each stream of each job.
+var copyBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 32*1024)
+		return &buf
+	},
+}
+
+// pooledWriter is a writer that copies from readers with a buffer from
+// copyBuffers. os/exec copies a command's output to a writer that is not a
+// file through its ReadFrom.
+type pooledWriter struct {
+	io.Writer
+}
+
+// pooled returns w as a pooledWriter, or w itself if it is nil or a file,
+// which os/exec gives the command as it is.
+func pooled(w io.Writer) io.Writer {
+	if _, ok := w.(*os.File); ok || w == nil {
+		return w
+	}
+	return pooledWriter{w}
+}
+
+func (pw pooledWriter) ReadFrom(r io.Reader) (int64, error) {
+	return copyOutput(pw.Writer, r)
+}
+
+// copyOutput copies r to w until r is done, like io.Copy, with a buffer
+// from copyBuffers. Unlike io.CopyBuffer, it never lets a file copy itself,
+// which would allocate a buffer of its own.
+func copyOutput(w io.Writer, r io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	var written int64
+	for {
+		n, err := r.Read(*buf)
+		if n > 0 {
+			m, werr := w.Write((*buf)[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+			if m < n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		} else if err != nil {
+			return written, err
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package runner
+
+// CgroupLimits holds the limits applied to a job's cgroup. Zero leaves a
+// limit unset.
+type CgroupLimits struct {
+	Memory uint64  // memory.max in bytes
+	CPUs   float64 // cpu.max as a number of CPUs
+}
+
+// CgroupUsage holds resource usage read from a job's cgroup.
+type CgroupUsage struct {
+	MemoryBytes     uint64
+	MemoryPeakBytes uint64
+	CPUSeconds      float64
+	OOMKills        uint64 // processes the kernel killed for running out of memory
+}
+
+// cgroupRoot is the cgroup v2 directory under which each job gets its own
+// cgroup. Jobs are not placed in cgroups when it is empty.
+var cgroupRoot string
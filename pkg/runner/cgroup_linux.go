@@ -0,0 +1,180 @@
+package runner
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// cgroupPeriod is the cpu.max period, in microseconds, used for CPU limits.
+const cgroupPeriod = 100000
+
+// SetCgroupRoot places each job into its own cgroup under the cgroup v2
+// directory path, creating the directory and enabling the cpu, cpuset and
+// memory controllers for it where possible. An empty path stops placing jobs into
+// cgroups.
+func SetCgroupRoot(path string) error {
+	if path == "" {
+		cgroupRoot = ""
+		return nil
+	}
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	for _, controller := range []string{"+cpu", "+cpuset", "+memory"} {
+		err := os.WriteFile(filepath.Join(path, "cgroup.subtree_control"), []byte(controller), 0644)
+		if err != nil {
+			Logger.Printf("Could not enable %s controller under %s: %v", controller[1:], path, err)
+		}
+	}
+	cgroupRoot = path
+	return nil
+}
+
+// cgroup is the cgroup a single job runs in.
+type cgroup struct {
+	path string
+	dir  *os.File // open until the job's process has started
+}
+
+// newCgroup creates a cgroup with the given limits under cgroupRoot and
+// arranges for cmd to start inside it. It returns nil if cgroups are not in
+// use.
+func newCgroup(cmd *exec.Cmd, limits CgroupLimits) (*cgroup, error) {
+	if cgroupRoot == "" {
+		if limits != (CgroupLimits{}) {
+			return nil, withKind(ErrInvalidSpec, fmt.Errorf("cgroup limits require the server to be started with -cgroup-root"))
+		}
+		return nil, nil
+	}
+
+	path, err := os.MkdirTemp(cgroupRoot, "job-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %v", err)
+	}
+	cg := &cgroup{path: path}
+	if limits.Memory > 0 {
+		if err := cg.write("memory.max", strconv.FormatUint(limits.Memory, 10)); err != nil {
+			cg.remove()
+			return nil, err
+		}
+	}
+	if limits.CPUs > 0 {
+		quota := int64(limits.CPUs * cgroupPeriod)
+		if err := cg.write("cpu.max", fmt.Sprintf("%d %d", quota, cgroupPeriod)); err != nil {
+			cg.remove()
+			return nil, err
+		}
+	}
+
+	cg.dir, err = os.Open(path)
+	if err != nil {
+		cg.remove()
+		return nil, err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(cg.dir.Fd())
+	return cg, nil
+}
+
+// pin confines the cgroup to the CPUs of cpuset, so that its processes cannot
+// leave them by changing their own affinity, if the cpuset controller is
+// enabled for it.
+func (cg *cgroup) pin(cpuset string) error {
+	if cg == nil || cpuset == "" {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(cg.path, "cpuset.cpus")); os.IsNotExist(err) {
+		return nil
+	}
+	return cg.write("cpuset.cpus", cpuset)
+}
+
+// write sets one of the cgroup's interface files.
+func (cg *cgroup) write(file, value string) error {
+	err := os.WriteFile(filepath.Join(cg.path, file), []byte(value), 0644)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("cannot set %s: controller not enabled under %s", file, cgroupRoot)
+	}
+	return err
+}
+
+// started releases the directory handle once the job's process is running.
+func (cg *cgroup) started() {
+	if cg != nil && cg.dir != nil {
+		cg.dir.Close()
+		cg.dir = nil
+	}
+}
+
+// usage reads the cgroup's current memory and accumulated CPU usage. Values
+// whose controller is not enabled are left as zero.
+func (cg *cgroup) usage() CgroupUsage {
+	var usage CgroupUsage
+	if cg == nil {
+		return usage
+	}
+	usage.MemoryBytes = cg.readUint("memory.current")
+	usage.MemoryPeakBytes = cg.readUint("memory.peak")
+	usage.OOMKills = cg.readKey("memory.events", "oom_kill")
+
+	f, err := os.Open(filepath.Join(cg.path, "cpu.stat"))
+	if err != nil {
+		return usage
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "usage_usec "); ok {
+			usec, _ := strconv.ParseUint(value, 10, 64)
+			usage.CPUSeconds = float64(usec) / 1e6
+		}
+	}
+	return usage
+}
+
+// readKey reads the number for key from a cgroup interface file holding
+// lines of keys and numbers.
+func (cg *cgroup) readKey(file, key string) uint64 {
+	data, err := os.ReadFile(filepath.Join(cg.path, file))
+	if err != nil {
+		return 0
+	}
+	for line := range strings.Lines(string(data)) {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(line), key+" "); ok {
+			n, _ := strconv.ParseUint(value, 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// readUint reads a cgroup interface file holding a single number.
+func (cg *cgroup) readUint(file string) uint64 {
+	data, err := os.ReadFile(filepath.Join(cg.path, file))
+	if err != nil {
+		return 0
+	}
+	value, _ := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	return value
+}
+
+// remove deletes the cgroup. This fails, and the cgroup is left behind, if
+// processes the job spawned are still running in it.
+func (cg *cgroup) remove() {
+	if cg == nil {
+		return
+	}
+	cg.started()
+	if err := os.Remove(cg.path); err != nil {
+		Logger.Printf("Could not remove cgroup %s: %v", cg.path, err)
+	}
+}
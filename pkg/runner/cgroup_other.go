@@ -0,0 +1,41 @@
+//go:build !linux
+
+package runner
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// SetCgroupRoot fails unless path is empty, as cgroups only exist on Linux.
+func SetCgroupRoot(path string) error {
+	if path == "" {
+		return nil
+	}
+	return fmt.Errorf("cgroups are only supported on Linux")
+}
+
+// cgroup is never instantiated outside Linux.
+type cgroup struct {
+	path string
+}
+
+// newCgroup fails if any cgroup limit is set, as cgroups only exist on Linux.
+func newCgroup(cmd *exec.Cmd, limits CgroupLimits) (*cgroup, error) {
+	if limits != (CgroupLimits{}) {
+		return nil, withKind(ErrInvalidSpec, fmt.Errorf("cgroup limits are only supported on Linux"))
+	}
+	return nil, nil
+}
+
+func (cg *cgroup) pin(cpuset string) error {
+	return nil
+}
+
+func (cg *cgroup) started() {}
+
+func (cg *cgroup) usage() CgroupUsage {
+	return CgroupUsage{}
+}
+
+func (cg *cgroup) remove() {}
@@ -0,0 +1,117 @@
+package runner
+
+import "time"
+
+// Config holds the settings of a Manager, given to NewManager and fixed for
+// its lifetime, so that several Managers in one process can each have their
+// own. Start from DefaultConfig: in the zero Config, released jobs are not
+// remembered, output is never compressed and the failure rate of a series
+// is never judged.
+type Config struct {
+	// Workers is how many jobs the Manager runs at once, counting those
+	// run by Run and interactive sessions. A job submitted while all
+	// workers are busy waits up to WorkerWait for one to be free, and is
+	// refused as overloaded after that. Zero means no limit.
+	Workers int
+	// WorkerWait is how long a job waits for a free worker before it is
+	// refused.
+	WorkerWait time.Duration
+	// ShellWorkers is how many long-lived shells the Manager keeps to run
+	// plain command strings in, rather than starting a shell for each.
+	// Zero starts one for each.
+	//
+	// A command run by a shell worker runs in a subshell of it, so that it
+	// cannot change the worker's directory, variables or traps, but it
+	// does share the worker's process group and environment, and processes
+	// it leaves running in the background can write into the output of
+	// the commands run after it. Only jobs of the local executor whose
+	// command string runs with nothing but the server's environment and
+	// directory, without a terminal, stdin, cgroup, limits, sandbox or
+	// priority, are run by the workers, and only while bash or sh runs
+	// command strings. Other jobs, and jobs submitted while every worker
+	// is busy, start a shell of their own as usual.
+	ShellWorkers int
+
+	// MaxLoad is the load average over the last minute, per CPU, above
+	// which the host is overloaded. Zero means no limit.
+	MaxLoad float64
+	// MinAvailableMemory is the memory, in bytes, that must be available
+	// to new processes for the host not to be overloaded. Zero means no
+	// limit.
+	MinAvailableMemory uint64
+	// HostWait is how long a job waits for the host to no longer be
+	// overloaded. Zero refuses jobs at once.
+	HostWait time.Duration
+
+	// MaxBufferedBytes is the total size of job output the Manager may
+	// hold in memory, once compressed, beyond which it refuses to start
+	// new jobs. Zero means no limit.
+	MaxBufferedBytes int64
+	// CompressThreshold is the size from which the stdout or stderr of a
+	// finished job is kept compressed in memory. Zero keeps all output as
+	// it is.
+	CompressThreshold int
+
+	// HistorySize is how many released jobs the Manager remembers, so that
+	// they can still be rerun. The oldest are forgotten first. They are
+	// only remembered in memory, and are lost when the process exits.
+	HistorySize int
+	// HistoryRetention, if set, is how long the Manager remembers released
+	// jobs after their release, and the series of jobs it tracks the
+	// trends of after their last run, beyond which Maintain forgets them.
+	HistoryRetention time.Duration
+
+	// MaxFailureRate is the share of the last FailureWindow runs of a
+	// series, from 0 to 1, that may fail before an alert is raised, unless
+	// the last job of the series expects a rate of its own. Zero raises no
+	// such alert.
+	MaxFailureRate float64
+	// FailureWindow is how many of the last runs of a series its failure
+	// rate is worked out over, unless the last job of the series expects
+	// another number. It is at most the runs remembered per series, 50.
+	FailureWindow int
+
+	// FileDirs are the directories clients may read and write files in
+	// with FilePath, besides the workspaces and artifacts of the jobs
+	// held.
+	FileDirs []string
+	// LogDirs are the directories jobs may write log files in. Jobs cannot
+	// have log files unless it is set.
+	LogDirs []string
+	// EnvFileDirs are the directories jobs may read environment files
+	// from. Jobs cannot have environment files unless it is set.
+	EnvFileDirs []string
+	// LogSinkHosts are the addresses, as host:port, that jobs may send
+	// their output to over the network with a log sink. Jobs cannot send
+	// their output over the network unless it is set.
+	LogSinkHosts []string
+
+	// SSHHosts holds the hosts jobs may run on, keyed by alias. Jobs can
+	// only reach hosts configured here.
+	SSHHosts map[string]SSHHost
+	// ContainerRuntime is the Docker-compatible CLI, docker or podman,
+	// that runs container jobs.
+	ContainerRuntime string
+	// Sandbox holds the sandbox settings shared by all jobs.
+	Sandbox SandboxConfig
+}
+
+// DefaultConfig returns the settings of a Manager that runs any number of
+// jobs at once, remembers the last 1000 released jobs and compresses output
+// of 64 KiB or more, and that jobs can reach no files, hosts or log sinks
+// with.
+func DefaultConfig() Config {
+	return Config{
+		WorkerWait:        10 * time.Second,
+		CompressThreshold: 64 << 10,
+		HistorySize:       1000,
+		FailureWindow:     10,
+		ContainerRuntime:  "docker",
+	}
+}
+
+// Config returns the Manager's settings. Their slices and map must not be
+// changed.
+func (m *Manager) Config() Config {
+	return m.config
+}
@@ -0,0 +1,128 @@
+package runner
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ContainerOptions configures running a job in a container.
+type ContainerOptions struct {
+	Image  string
+	Name   string   // container name, generated if empty
+	Mounts []string // volumes, as "host-path:container-path[:ro]"
+	Memory uint64   // memory limit in bytes
+	CPUs   float64  // CPU limit in cores, such as 0.5
+}
+
+// containerExecutor runs jobs in containers through the container runtime's
+// CLI. The job's process is the CLI's "run" command, which streams the
+// container's output and exits with its exit code.
+type containerExecutor struct{}
+
+// Command builds the "run" command for the job's container. A command string
+// is run with sh, which unlike bash is present in nearly every image, while
+// an argv is used as the container's command as is.
+func (containerExecutor) Command(spec *JobSpec) (*exec.Cmd, error) {
+	opts := spec.Container
+	if opts == nil || opts.Image == "" {
+		return nil, fmt.Errorf("container jobs need an image")
+	}
+	if strings.HasPrefix(opts.Image, "-") {
+		return nil, fmt.Errorf("invalid container image %q", opts.Image)
+	}
+	// The container runtime applies its own isolation and limits.
+	if spec.Nice != 0 || spec.IONice != "" || spec.Sandbox != nil || spec.Cgroup != (CgroupLimits{}) || spec.Host != "" || spec.Kubernetes != nil {
+		return nil, fmt.Errorf("nice, ionice, sandbox, cgroup, host and kubernetes options are not supported for container jobs")
+	}
+	// Containers are not run in the sandbox, so they are refused when every
+	// job must be.
+	if spec.config.Sandbox.Always {
+		return nil, withKind(ErrPolicyDenied, fmt.Errorf("container jobs are not allowed while every job is sandboxed"))
+	}
+	mounts, err := resolveMounts(opts.Mounts, spec.config.Sandbox.BindAllow)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Name == "" {
+		opts.Name = generateName()
+	}
+
+	args := []string{"run", "--rm", "-i", "--name", opts.Name}
+	if spec.Pty {
+		args = append(args, "-t")
+	}
+	if opts.Memory > 0 {
+		args = append(args, "--memory", strconv.FormatUint(opts.Memory, 10))
+	}
+	if opts.CPUs > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(opts.CPUs, 'f', -1, 64))
+	}
+	if spec.CPUSet != "" {
+		if _, err := parseCPUSet(spec.CPUSet); err != nil {
+			return nil, err
+		}
+		args = append(args, "--cpuset-cpus", spec.CPUSet)
+	}
+	for _, mount := range mounts {
+		args = append(args, "--volume", mount)
+	}
+	for _, pair := range environ(spec.environment()) {
+		args = append(args, "--env", pair)
+	}
+	// Secrets are passed by name only, for the runtime to take their values
+	// from its own environment.
+	for _, name := range sortedKeys(spec.Secrets) {
+		args = append(args, "--env", name)
+	}
+	if spec.Dir != "" {
+		args = append(args, "--workdir", spec.Dir)
+	}
+	args = append(args, spec.Limits.ulimitArgs()...)
+	args = append(args, opts.Image)
+	if len(spec.Argv) > 0 {
+		args = append(args, spec.Argv...)
+	} else {
+		args = append(args, "sh", "-c", spec.Command)
+	}
+	return exec.Command(spec.config.ContainerRuntime, args...), nil
+}
+
+// resolveMounts checks that the host path of each of a container's volumes,
+// given as "host-path:container-path[:ro]", is in the sandbox's allowlist
+// of directories jobs may mount, like a sandbox's bind mounts, and returns
+// the volumes with their host paths resolved. allow is that allowlist.
+func resolveMounts(mounts, allow []string) ([]string, error) {
+	resolved := make([]string, 0, len(mounts))
+	for _, mount := range mounts {
+		host, rest, ok := strings.Cut(mount, ":")
+		if !ok || !filepath.IsAbs(host) {
+			return nil, fmt.Errorf("container mount %q is not an absolute host path and a container path", mount)
+		}
+		// Resolve symlinks so that a link inside an allowed directory can't
+		// expose a path outside of it.
+		path, err := filepath.EvalSymlinks(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid container mount: %v", err)
+		}
+		if !withinDirs(path, allow) {
+			return nil, withKind(ErrPolicyDenied, fmt.Errorf("container mount %s is not in the allowlist", host))
+		}
+		resolved = append(resolved, path+":"+rest)
+	}
+	return resolved, nil
+}
+
+// Signal delivers sig to the container. Signalling the CLI instead would not
+// reach the container for SIGKILL, and would leave it running.
+func (containerExecutor) Signal(spec *JobSpec, cmd *exec.Cmd, sig syscall.Signal) error {
+	runtime := spec.config.ContainerRuntime
+	out, err := exec.Command(runtime, "kill", "--signal", strconv.Itoa(int(sig)), spec.Container.Name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s kill failed: %v: %s", runtime, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package runner
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Expectation is what a job is expected to do, such that an alert is raised
+// if it does not: finish within MaxDuration, and, for jobs that check in to
+// a check, such as a nightly task run by cron, succeed at least every
+// Every. Unlike a timeout, it never stops the job.
+type Expectation struct {
+	MaxDuration time.Duration // how long the job is expected to run for at most
+	// Check names the dead-man switch the job checks in to by succeeding.
+	// If no job of the check succeeds within Every of the last one that did,
+	// or of when the first was submitted, the check is missed.
+	Check string
+	Every time.Duration
+	// MaxFailureRate and FailureWindow replace the server's MaxFailureRate
+	// and FailureWindow for the job's series, from when it finishes.
+	MaxFailureRate float64
+	FailureWindow  int
+}
+
+// Kinds of alerts.
+const (
+	AlertOverrun = "overrun" // a job ran for longer than its MaxDuration
+	AlertMissed  = "missed"  // no job of a check succeeded within its Every
+)
+
+// Alert is raised when a job does not do what it was expected to.
+type Alert struct {
+	Time    time.Time
+	Kind    string // AlertOverrun, AlertMissed, AlertSlower or AlertFailing
+	JobID   string // the job that overran, was slower or failed, or the last job of the missed check
+	Check   string
+	Message string
+}
+
+// CheckStatus is the state of a check.
+type CheckStatus struct {
+	Name        string
+	Every       time.Duration
+	LastJobID   string    // the last job to check in to it
+	LastSuccess time.Time // when a job of it last succeeded, or zero if none has
+	Due         time.Time // when a job of it must have succeeded by
+	Missed      bool      // whether Due has passed
+}
+
+// alertHistory is how many alerts a Manager remembers.
+const alertHistory = 100
+
+// checkName matches the names of checks.
+var checkName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:/-]*$`)
+
+// deadman tracks the checks and alerts of a Manager.
+type deadman struct {
+	mu     sync.Mutex
+	checks map[string]*check
+	alerts []Alert // the last alertHistory alerts, oldest first
+}
+
+// check is a dead-man switch that jobs check in to.
+type check struct {
+	CheckStatus
+	timer  *time.Timer
+	notify []Notification // the notifications of the last job of the check
+}
+
+// checkExpectation checks the expectation of spec, if it has one.
+func checkExpectation(spec *JobSpec) error {
+	e := spec.Expect
+	switch {
+	case e == nil:
+		return nil
+	case e.MaxDuration < 0 || e.Every < 0:
+		return withKind(ErrInvalidSpec, fmt.Errorf("expected durations must not be negative"))
+	case (e.Check == "") != (e.Every == 0):
+		return withKind(ErrInvalidSpec, fmt.Errorf("a check needs both a name and how often it is expected to succeed"))
+	case e.Check != "" && !checkName.MatchString(e.Check):
+		return withKind(ErrInvalidSpec, fmt.Errorf("invalid check name %q", e.Check))
+	case e.MaxFailureRate < 0 || e.MaxFailureRate > 1:
+		return withKind(ErrInvalidSpec, fmt.Errorf("invalid failure rate %v: must be from 0 to 1", e.MaxFailureRate))
+	case e.FailureWindow < 0 || e.FailureWindow > trendRuns:
+		return withKind(ErrInvalidSpec, fmt.Errorf("invalid failure window %d: must be at most %d runs", e.FailureWindow, trendRuns))
+	}
+	return nil
+}
+
+// expect starts watching a job that has just started for what it is
+// expected to do. The caller must hold the job's lock.
+func (m *Manager) expect(job *Job) {
+	e := job.Spec.Expect
+	if e == nil {
+		return
+	}
+	if e.MaxDuration > 0 {
+		job.overrunTimer = time.AfterFunc(e.MaxDuration, func() {
+			job.overran.Store(true)
+			m.alert(Alert{
+				Kind:    AlertOverrun,
+				JobID:   job.ID,
+				Check:   e.Check,
+				Message: fmt.Sprintf("%s has run for longer than the expected %v", jobName(job), e.MaxDuration),
+			}, job.Spec.Notify)
+		})
+	}
+	if e.Check != "" {
+		m.deadman.mu.Lock()
+		defer m.deadman.mu.Unlock()
+		c, ok := m.deadman.checks[e.Check]
+		if !ok {
+			c = &check{CheckStatus: CheckStatus{Name: e.Check}}
+			m.deadman.checks[e.Check] = c
+			c.arm(m, job.SubmitTime.Add(e.Every))
+		}
+		c.Every = e.Every
+		c.notify = job.Spec.Notify
+	}
+}
+
+// checkIn records the end of a job watched by expect: its check is met if
+// it succeeded. The caller must hold the job's lock.
+func (m *Manager) checkIn(job *Job) {
+	e := job.Spec.Expect
+	if e == nil {
+		return
+	}
+	if job.overrunTimer != nil {
+		job.overrunTimer.Stop()
+		job.overrunTimer = nil
+	}
+	if e.Check == "" || job.Result != ResultSuccess {
+		return
+	}
+	m.deadman.mu.Lock()
+	defer m.deadman.mu.Unlock()
+	c := m.deadman.checks[e.Check]
+	c.LastJobID = job.ID
+	c.LastSuccess = job.EndTime
+	c.Missed = false
+	c.arm(m, job.EndTime.Add(e.Every))
+}
+
+// arm sets when the check is missed unless a job of it succeeds. The caller
+// must hold the deadman's lock.
+func (c *check) arm(m *Manager, due time.Time) {
+	c.Due = due
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.timer = time.AfterFunc(time.Until(due), func() {
+		m.deadman.mu.Lock()
+		if !c.Due.Equal(due) {
+			// A job checked in meanwhile.
+			m.deadman.mu.Unlock()
+			return
+		}
+		c.Missed = true
+		last := "no job of it has succeeded yet"
+		if !c.LastSuccess.IsZero() {
+			last = fmt.Sprintf("the last job to succeed, %s, ended at %s", c.LastJobID, c.LastSuccess.Format(time.RFC3339))
+		}
+		alert := Alert{
+			Kind:    AlertMissed,
+			JobID:   c.LastJobID,
+			Check:   c.Name,
+			Message: fmt.Sprintf("Check %s was due by %s, but %s", c.Name, due.Format(time.RFC3339), last),
+		}
+		notify := c.notify
+		// Alert again if the next period passes without a success too.
+		c.arm(m, due.Add(c.Every))
+		m.deadman.mu.Unlock()
+		m.alert(alert, notify)
+	})
+}
+
+// alert records an alert, logs it, and sends it to the notifiers of
+// notifications, whatever their condition.
+func (m *Manager) alert(alert Alert, notifications []Notification) {
+	alert.Time = time.Now()
+	m.deadman.mu.Lock()
+	m.deadman.alerts = append(m.deadman.alerts, alert)
+	if len(m.deadman.alerts) > alertHistory {
+		m.deadman.alerts = m.deadman.alerts[len(m.deadman.alerts)-alertHistory:]
+	}
+	m.deadman.mu.Unlock()
+	Logger.Printf("Alert: %s", alert.Message)
+
+	subject := alert.Message
+	if len(subject) > 80 {
+		subject = subject[:77] + "..."
+	}
+	body := alert.Message + ".\n\n"
+	if alert.Check != "" {
+		body += fmt.Sprintf("Check: %s\n", alert.Check)
+	}
+	if alert.JobID != "" {
+		body += fmt.Sprintf("Job: %s\n", alert.JobID)
+	}
+	body += fmt.Sprintf("Server: %s\n", hostname())
+	var sent []string
+	for _, n := range notifications {
+		if !slices.Contains(sent, n.Notifier) {
+			sent = append(sent, n.Notifier)
+			sendNotification(n.Notifier, alert.JobID, subject, body, "")
+		}
+	}
+}
+
+// Alerts returns the last alerts raised, oldest first.
+func (m *Manager) Alerts() []Alert {
+	m.deadman.mu.Lock()
+	defer m.deadman.mu.Unlock()
+	return append([]Alert(nil), m.deadman.alerts...)
+}
+
+// Checks returns the state of the checks jobs have checked in to, in order
+// of name.
+func (m *Manager) Checks() []CheckStatus {
+	m.deadman.mu.Lock()
+	defer m.deadman.mu.Unlock()
+	checks := make([]CheckStatus, 0, len(m.deadman.checks))
+	for _, c := range m.deadman.checks {
+		checks = append(checks, c.CheckStatus)
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].Name < checks[j].Name })
+	return checks
+}
+
+// Overran reports whether the job has run for longer than its expected
+// MaxDuration. It may be called without the job's lock.
+func (job *Job) Overran() bool {
+	return job.overran.Load()
+}
+
+// jobName names a job in messages.
+func jobName(job *Job) string {
+	command := strings.Join(strings.Fields(job.Command), " ")
+	if command == "" {
+		command = strings.Join(job.Argv, " ")
+	}
+	if job.ID == "" {
+		return fmt.Sprintf("Job %q", command)
+	}
+	return fmt.Sprintf("Job %s (%q)", job.ID, command)
+}
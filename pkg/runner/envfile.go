@@ -0,0 +1,143 @@
+package runner
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SetEnvFileDirs sets EnvFileDirs from a comma-separated list of
+// directories.
+func (c *Config) SetEnvFileDirs(list string) error {
+	dirs, err := resolveDirs(list)
+	if err != nil {
+		return err
+	}
+	c.EnvFileDirs = dirs
+	return nil
+}
+
+// readEnvFile reads the variables of the environment file of spec, if it
+// has one.
+func readEnvFile(spec *JobSpec) (map[string]string, error) {
+	if spec.EnvFile == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(spec.EnvFile) {
+		return nil, withKind(ErrInvalidSpec, fmt.Errorf("env file %q is not an absolute path", spec.EnvFile))
+	}
+	// Resolve symlinks so that a link inside an allowed directory can't
+	// lead outside of it.
+	path, err := filepath.EvalSymlinks(spec.EnvFile)
+	if err != nil {
+		return nil, withKind(ErrInvalidSpec, fmt.Errorf("invalid env file: %v", err))
+	}
+	if !withinDirs(path, spec.config.EnvFileDirs) {
+		return nil, withKind(ErrPolicyDenied, fmt.Errorf("env file %s is not in an allowed directory", spec.EnvFile))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, withKind(ErrInvalidSpec, fmt.Errorf("cannot read env file: %v", err))
+	}
+	env, err := parseEnvFile(data)
+	if err != nil {
+		return nil, withKind(ErrInvalidSpec, fmt.Errorf("env file %s: %v", spec.EnvFile, err))
+	}
+	return env, nil
+}
+
+// parseEnvFile parses the dotenv format: a NAME=value pair per line,
+// optionally preceded by "export", with blank lines and lines starting with
+// # ignored. A value in single quotes is taken as it is, and one in double
+// quotes may span lines and have the escapes \n, \t, \", \\ and \$. An
+// unquoted value is trimmed and ends at " #". Variables are not expanded.
+func parseEnvFile(data []byte) (map[string]string, error) {
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t\"'\x00") {
+			return nil, fmt.Errorf("line %d: want NAME=value", lineNo)
+		}
+		value = strings.TrimSpace(value)
+		switch {
+		case strings.HasPrefix(value, "'"):
+			end := strings.Index(value[1:], "'")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated single quote", lineNo)
+			}
+			value = value[1 : end+1]
+		case strings.HasPrefix(value, `"`):
+			quoted := value[1:]
+			start := lineNo
+			for !closesQuote(quoted) {
+				if !scanner.Scan() {
+					return nil, fmt.Errorf("line %d: unterminated double quote", start)
+				}
+				lineNo++
+				quoted += "\n" + scanner.Text()
+			}
+			value = unescape(quoted)
+		default:
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+		}
+		if strings.ContainsRune(value, 0) {
+			return nil, fmt.Errorf("line %d: %s has a NUL byte", lineNo, name)
+		}
+		env[name] = value
+	}
+	return env, scanner.Err()
+}
+
+// closesQuote reports whether s, the text after an opening double quote,
+// has the closing one.
+func closesQuote(s string) bool {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return true
+		}
+	}
+	return false
+}
+
+// unescape returns the value of s, the text after an opening double quote,
+// up to the closing one.
+func unescape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '"' {
+			break
+		}
+		if c == '\\' && i+1 < len(s) {
+			i++
+			switch s[i] {
+			case 'n':
+				c = '\n'
+			case 't':
+				c = '\t'
+			case '"', '\\', '$':
+				c = s[i]
+			default:
+				b.WriteByte('\\')
+				c = s[i]
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
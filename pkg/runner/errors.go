@@ -0,0 +1,59 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Kinds of error returned by the Manager. Errors of each kind keep their own
+// message but match the kind with errors.Is.
+var (
+	ErrJobNotFound   = errors.New("job not found")
+	ErrGroupNotFound = errors.New("group not found")
+	// ErrInvalidSpec is returned for a JobSpec that cannot be run, such as
+	// one with options its executor does not support.
+	ErrInvalidSpec = errors.New("invalid job spec")
+	// ErrPolicyDenied is returned for a JobSpec the server's configuration
+	// does not allow, such as a sandbox bind mount outside the allowlist.
+	ErrPolicyDenied = errors.New("denied by policy")
+	// ErrJobState is returned for an operation the job's current state does
+	// not allow, such as killing a job that has already exited.
+	ErrJobState = errors.New("invalid job state")
+	// ErrSecretNotFound is returned for the name of a secret that is not
+	// stored.
+	ErrSecretNotFound = errors.New("secret not found")
+	// ErrOverloaded is returned for a job the Manager refuses to start
+	// because it holds too much output in memory already.
+	ErrOverloaded = errors.New("overloaded")
+	// ErrHostOverloaded is returned for a job the Manager refuses to start
+	// because the host has too little headroom left; see Config.MaxLoad.
+	ErrHostOverloaded = errors.New("host overloaded")
+)
+
+// kindError is an error of one of the kinds above.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string   { return e.err.Error() }
+func (e *kindError) Unwrap() []error { return []error{e.kind, e.err} }
+
+// withKind marks err as being of the given kind, unless it is nil or already
+// of a kind.
+func withKind(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, k := range []error{ErrJobNotFound, ErrGroupNotFound, ErrInvalidSpec, ErrPolicyDenied, ErrJobState, ErrSecretNotFound, ErrOverloaded, ErrHostOverloaded} {
+		if errors.Is(err, k) {
+			return err
+		}
+	}
+	return &kindError{kind, err}
+}
+
+// jobNotFound returns the error for a job ID the manager does not know.
+func jobNotFound(id string) error {
+	return withKind(ErrJobNotFound, fmt.Errorf("job with id %s not found", id))
+}
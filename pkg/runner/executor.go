@@ -0,0 +1,457 @@
+package runner
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// JobSpec describes a job independently of where it runs: the command and
+// the options it runs with.
+type JobSpec struct {
+	Command string
+	Argv    []string
+	Env     map[string]string // variables added to the command's environment
+	// EnvFile is a dotenv file, in one of EnvFileDirs, of variables added
+	// to the command's environment before Env, which takes precedence.
+	EnvFile string
+	Secrets map[string]string // variables set to the values of the named secrets
+	Dir     string            // working directory, by default the server's
+	Stdin   string            // input for the command, which otherwise gets none
+	Timeout time.Duration     // how long the job may run before it is killed
+	Labels  map[string]string // free-form metadata reported with the job
+	// StdinOpen keeps the command's standard input open once it has read
+	// Stdin, for WriteStdin to add to and CloseStdin to end. Only
+	// background jobs without a terminal can have it.
+	StdinOpen bool
+	// IdleTimeout is how long the job may go without writing anything to
+	// stdout or stderr. IdleAction says what happens then: IdleKill, the
+	// default, kills the job, while IdleFlag only reports it as stalled.
+	IdleTimeout time.Duration
+	IdleAction  string
+	// Umask is the command's octal file mode creation mask, such as "022",
+	// instead of the server's. Only the local executor supports it.
+	Umask string
+	// Locale sets LANG and LC_ALL, and TZ sets TZ, in the command's
+	// environment, whatever the server's environment has.
+	Locale string
+	TZ     string
+	// Workspace runs the job in a new temporary directory of its own, set
+	// as $SHELLRUNNER_WORKDIR, which is removed when the job is released
+	// unless KeepWorkspace is set. Only the local executor supports it.
+	Workspace     bool
+	KeepWorkspace bool
+	// Artifacts are globs, relative to the job's directory, of the files
+	// copied aside when the job exits, to be kept until it is released.
+	Artifacts []string
+	// Filter selects and rewrites the lines of the job's output as it is
+	// written, so that only what it keeps is stored.
+	Filter *OutputFilter
+	// Success decides whether the job succeeded, by its exit code being 0
+	// if nil.
+	Success *SuccessCriteria
+	// Expect is what the job is expected to do, such as finish within a
+	// time, with an alert raised if it does not.
+	Expect *Expectation
+	// Notify names the notifiers told when the job finishes, with the
+	// tail of its stderr.
+	Notify []Notification
+	// Progress takes the lines starting with "##progress" out of the job's
+	// output and records them as its progress; see ReportedProgress.
+	Progress bool
+	// LogFile is a file, in one of the Manager's LogDirs, that the job's output is
+	// appended to as it is written, so that it outlives the job. LogOnly
+	// writes the output only there, keeping none of it in memory.
+	LogFile string
+	LogOnly bool
+	// CaptureMode is how the job's output is kept in memory: CaptureFull,
+	// the default, keeps all of it, while CaptureRing keeps only the last
+	// RingBytes, or DefaultRingBytes, of each stream, for jobs that run
+	// and write for long enough that all of it would not fit.
+	CaptureMode string
+	RingBytes   int
+	// LogSink forwards each line of the job's output, as it is written, to
+	// a file, syslog, a TCP or UDP address, or a webhook, as well as
+	// capturing it; see openLogSink.
+	LogSink    string
+	Limits     ResourceLimits
+	Cgroup     CgroupLimits
+	Nice       int
+	IONice     string
+	CPUSet     string // CPUs the job runs on, such as "0-3" or "0,2"
+	Sandbox    *SandboxOptions
+	Executor   string // name of the executor running the job; see executors
+	Container  *ContainerOptions
+	Host       string // alias of the remote host the job runs on
+	Kubernetes *KubernetesOptions
+	// TraceParent is the W3C traceparent of the caller's span. The job gets
+	// a span of its own in the caller's trace, which its command is given
+	// as $TRACEPARENT.
+	TraceParent string
+	// Submitter is the client that submitted the job. The server sets it;
+	// it is reported with the job but changes nothing about how it runs.
+	Submitter Identity
+	TerminalOptions
+
+	workdir string            // the job's workspace, once created by newCommand
+	fileEnv map[string]string // the variables of EnvFile, once read by newCommand
+	logFile *os.File          // the open LogFile, once opened by prepare
+	logSink *logSink          // the LogSink, once opened by prepare
+	journal *logSink          // the journal, if Journal is set, once opened by prepare
+	config  *Config           // the settings of the Manager, once set by newCommand
+	// submitted is the spec as it was submitted, before the BeforeStart
+	// hooks changed it, once set by prepare.
+	submitted *JobSpec
+	// trace is the job's span, once set by prepare.
+	trace TraceContext
+}
+
+// Executor runs jobs somewhere: on this host, in a container, and so on.
+// Whatever the executor, a job is tracked through the local process of the
+// command it builds, so Status, Output and the rest work the same for all.
+type Executor interface {
+	// Command builds the command that runs the job. It may fill in details
+	// of spec that are reported later, such as a resolved sandbox or a
+	// generated container name.
+	Command(spec *JobSpec) (*exec.Cmd, error)
+	// Signal delivers sig to a job started from spec as cmd.
+	Signal(spec *JobSpec, cmd *exec.Cmd, sig syscall.Signal) error
+}
+
+// executors holds the available executors by name.
+var executors = map[string]Executor{
+	"local":      localExecutor{},
+	"container":  containerExecutor{},
+	"ssh":        sshExecutor{},
+	"kubernetes": kubernetesExecutor{},
+}
+
+// executorName returns the name of the executor of the job started from
+// spec: the one it names, or "container", "kubernetes" or "ssh" if it asks
+// for a container, a pod or a remote host, or "local".
+func executorName(spec *JobSpec) string {
+	switch {
+	case spec.Executor != "":
+		return spec.Executor
+	case spec.Container != nil:
+		return "container"
+	case spec.Kubernetes != nil:
+		return "kubernetes"
+	case spec.Host != "":
+		return "ssh"
+	}
+	return "local"
+}
+
+// newCommand picks the executor for spec and builds the job's command with
+// it. Jobs run locally unless they name another executor, ask for a
+// container or a Kubernetes pod, or name a remote host. Errors building the
+// command are of kind ErrInvalidSpec unless they are of another kind.
+// config holds the settings of the Manager that runs the job.
+func newCommand(spec *JobSpec, config *Config) (Executor, *exec.Cmd, error) {
+	spec.config = config
+	spec.Executor = executorName(spec)
+	executor, ok := executors[spec.Executor]
+	if !ok {
+		return nil, nil, withKind(ErrInvalidSpec, fmt.Errorf("unknown executor %q", spec.Executor))
+	}
+	if len(spec.Argv) > 0 && spec.Command != "" {
+		return nil, nil, withKind(ErrInvalidSpec, fmt.Errorf("only one of command and argv may be set"))
+	}
+	fileEnv, err := readEnvFile(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	spec.fileEnv = fileEnv
+	for name := range spec.Env {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return nil, nil, withKind(ErrInvalidSpec, fmt.Errorf("invalid environment variable name %q", name))
+		}
+	}
+	for name := range spec.Secrets {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return nil, nil, withKind(ErrInvalidSpec, fmt.Errorf("invalid environment variable name %q", name))
+		}
+		if _, ok := spec.Env[name]; ok {
+			return nil, nil, withKind(ErrInvalidSpec, fmt.Errorf("%s is set both by env and by secrets", name))
+		}
+	}
+	for name, value := range spec.presets() {
+		if _, ok := spec.Env[name]; ok {
+			return nil, nil, withKind(ErrInvalidSpec, fmt.Errorf("%s is set both by env and by the locale or tz option", name))
+		}
+		if strings.ContainsRune(value, 0) {
+			return nil, nil, withKind(ErrInvalidSpec, fmt.Errorf("invalid %s %q", name, value))
+		}
+	}
+	if spec.Umask != "" {
+		if mask, err := strconv.ParseUint(spec.Umask, 8, 32); err != nil || mask > 0o777 {
+			return nil, nil, withKind(ErrInvalidSpec, fmt.Errorf("invalid umask %q: must be octal, such as 022", spec.Umask))
+		}
+		if spec.Executor != "local" {
+			return nil, nil, withKind(ErrInvalidSpec, fmt.Errorf("umask requires the local executor"))
+		}
+	}
+	if spec.Timeout < 0 {
+		return nil, nil, withKind(ErrInvalidSpec, fmt.Errorf("invalid timeout %v", spec.Timeout))
+	}
+	if spec.IdleTimeout < 0 {
+		return nil, nil, withKind(ErrInvalidSpec, fmt.Errorf("invalid idle timeout %v", spec.IdleTimeout))
+	}
+	if spec.IdleAction != "" && spec.IdleAction != IdleKill && spec.IdleAction != IdleFlag {
+		return nil, nil, withKind(ErrInvalidSpec, fmt.Errorf("invalid idle action %q: must be %s or %s", spec.IdleAction, IdleKill, IdleFlag))
+	}
+	if err := checkCapture(spec); err != nil {
+		return nil, nil, withKind(ErrInvalidSpec, err)
+	}
+	if err := checkArtifactPatterns(spec); err != nil {
+		return nil, nil, withKind(ErrInvalidSpec, err)
+	}
+	if spec.Success != nil {
+		if err := spec.Success.check(); err != nil {
+			return nil, nil, withKind(ErrInvalidSpec, err)
+		}
+	}
+	if spec.StdinOpen && spec.Pty {
+		return nil, nil, withKind(ErrInvalidSpec, fmt.Errorf("jobs with a terminal cannot keep their stdin open; use a session"))
+	}
+	if spec.Filter != nil {
+		if spec.Pty {
+			return nil, nil, withKind(ErrInvalidSpec, fmt.Errorf("output filters cannot be used with a terminal"))
+		}
+		if _, err := spec.Filter.compile(); err != nil {
+			return nil, nil, withKind(ErrInvalidSpec, err)
+		}
+	}
+	spec.workdir = ""
+	if spec.Workspace {
+		if spec.Executor != "local" {
+			return nil, nil, withKind(ErrInvalidSpec, fmt.Errorf("workspaces require the local executor"))
+		}
+		if spec.Dir != "" {
+			return nil, nil, withKind(ErrInvalidSpec, fmt.Errorf("only one of dir and workspace may be set"))
+		}
+		dir, err := os.MkdirTemp("", "shellrunner-workspace-")
+		if err != nil {
+			return nil, nil, err
+		}
+		spec.workdir = dir
+	}
+	cmd, err := executor.Command(spec)
+	if err != nil {
+		removeDir(spec.workdir)
+		return nil, nil, withKind(ErrInvalidSpec, err)
+	}
+	if spec.Stdin != "" {
+		cmd.Stdin = strings.NewReader(spec.Stdin)
+	}
+	return executor, cmd, nil
+}
+
+// RegisterExecutor makes an executor available to jobs under name, replacing
+// any executor registered under the same name.
+func RegisterExecutor(name string, executor Executor) {
+	executors[name] = executor
+}
+
+// nameCounter is used to generate unique names for containers and pods.
+var nameCounter uint64
+
+// generateName returns a name for a container or pod that is unique to this
+// server and valid for both Docker and Kubernetes.
+func generateName() string {
+	return fmt.Sprintf("shellrunner-%d-%d", os.Getpid(), atomic.AddUint64(&nameCounter, 1))
+}
+
+// localExecutor runs jobs as processes on this host.
+type localExecutor struct{}
+
+// Command runs a command string through the configured shell, while an argv
+// is executed directly without a shell.
+func (localExecutor) Command(spec *JobSpec) (*exec.Cmd, error) {
+	if spec.Container != nil {
+		return nil, fmt.Errorf("container options require the container executor")
+	}
+	if spec.Host != "" {
+		return nil, fmt.Errorf("a remote host requires the ssh executor")
+	}
+	if spec.Kubernetes != nil {
+		return nil, fmt.Errorf("kubernetes options require the kubernetes executor")
+	}
+	sandbox, err := resolveSandbox(spec.Sandbox, spec.config.Sandbox)
+	if err != nil {
+		return nil, err
+	}
+	spec.Sandbox = sandbox
+
+	var cmd *exec.Cmd
+	if len(spec.Argv) > 0 {
+		cmd = exec.Command(spec.Argv[0], spec.Argv[1:]...)
+	} else {
+		cmd = shellCommand(spec.Command)
+	}
+	cmd.Dir = spec.Dir
+	if env := spec.environment(); len(env) > 0 {
+		cmd.Env = append(os.Environ(), environ(env)...)
+	}
+	if spec.workdir != "" {
+		cmd.Dir = spec.workdir
+		cmd.Env = append(cmd.Environ(), "SHELLRUNNER_WORKDIR="+spec.workdir)
+	}
+	if err := applyPriority(cmd, spec.Nice, spec.IONice); err != nil {
+		return nil, err
+	}
+	if err := applyCPUSet(cmd, spec.CPUSet); err != nil {
+		return nil, err
+	}
+	if err := applyLimits(cmd, spec.Limits); err != nil {
+		return nil, err
+	}
+	if err := applyUmask(cmd, spec.Umask); err != nil {
+		return nil, err
+	}
+	sandbox = spec.Sandbox
+	if sandbox != nil && spec.workdir != "" {
+		// The workspace is under the sandbox's private /tmp, so it is
+		// mounted over it. It is left out of the reported binds, which a
+		// rerun checks against the allowlist again.
+		withWorkspace := *sandbox
+		withWorkspace.Binds = append(slices.Clip(sandbox.Binds), spec.workdir)
+		sandbox = &withWorkspace
+	}
+	if err := applySandbox(cmd, sandbox); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// Signal delivers sig to the job's process and everything it spawned.
+func (localExecutor) Signal(spec *JobSpec, cmd *exec.Cmd, sig syscall.Signal) error {
+	return signalProcessGroup(cmd.Process, sig)
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// clone returns a copy of spec that shares none of its maps, slices or
+// options with it, so that changing one, as the BeforeStart hooks do,
+// leaves the other as it was.
+func (spec *JobSpec) clone() *JobSpec {
+	c := *spec
+	c.Argv = slices.Clone(spec.Argv)
+	c.Env = maps.Clone(spec.Env)
+	c.Secrets = maps.Clone(spec.Secrets)
+	c.Labels = maps.Clone(spec.Labels)
+	c.Artifacts = slices.Clone(spec.Artifacts)
+	c.Notify = slices.Clone(spec.Notify)
+	if spec.Filter != nil {
+		filter := *spec.Filter
+		filter.Include = slices.Clone(filter.Include)
+		filter.Exclude = slices.Clone(filter.Exclude)
+		c.Filter = &filter
+	}
+	if spec.Success != nil {
+		success := *spec.Success
+		success.ExitCodes = slices.Clone(success.ExitCodes)
+		success.Require = slices.Clone(success.Require)
+		success.Forbid = slices.Clone(success.Forbid)
+		c.Success = &success
+	}
+	if spec.Expect != nil {
+		expect := *spec.Expect
+		c.Expect = &expect
+	}
+	if spec.Sandbox != nil {
+		sandbox := *spec.Sandbox
+		sandbox.Binds = slices.Clone(sandbox.Binds)
+		c.Sandbox = &sandbox
+	}
+	if spec.Container != nil {
+		container := *spec.Container
+		container.Mounts = slices.Clone(container.Mounts)
+		c.Container = &container
+	}
+	if spec.Kubernetes != nil {
+		kubernetes := *spec.Kubernetes
+		c.Kubernetes = &kubernetes
+	}
+	c.submitted = nil
+	return &c
+}
+
+// original returns the spec as it was submitted, before the BeforeStart
+// hooks changed it, for the job to be rerun or exported as it was asked
+// for rather than as the hooks made it.
+func (spec *JobSpec) original() *JobSpec {
+	if spec.submitted != nil {
+		return spec.submitted
+	}
+	return spec
+}
+
+// presets returns the variables set by the Locale and TZ options.
+func (spec *JobSpec) presets() map[string]string {
+	presets := make(map[string]string)
+	if spec.Locale != "" {
+		presets["LANG"] = spec.Locale
+		presets["LC_ALL"] = spec.Locale
+	}
+	if spec.TZ != "" {
+		presets["TZ"] = spec.TZ
+	}
+	return presets
+}
+
+// environment returns the variables added to the command's environment: Env
+// along with those set by the Locale and TZ options and those of EnvFile.
+func (spec *JobSpec) environment() map[string]string {
+	presets := spec.presets()
+	if len(presets) == 0 && len(spec.fileEnv) == 0 {
+		return spec.Env
+	}
+	env := maps.Clone(spec.fileEnv)
+	if env == nil {
+		env = make(map[string]string)
+	}
+	maps.Copy(env, presets)
+	maps.Copy(env, spec.Env)
+	return env
+}
+
+// environ returns env as NAME=value pairs, sorted by name.
+func environ(env map[string]string) []string {
+	pairs := make([]string, 0, len(env))
+	for name, value := range env {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+// parseSignal returns the signal with the given name, such as "TERM" or
+// "SIGTERM". An empty name means SIGKILL.
+func parseSignal(name string) (syscall.Signal, error) {
+	if name == "" {
+		return syscall.SIGKILL, nil
+	}
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("unsupported signal %q", name)
+	}
+	return sig, nil
+}
@@ -0,0 +1,68 @@
+package runner
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// SetFileDirs sets FileDirs from a comma-separated list of directories.
+func (c *Config) SetFileDirs(list string) error {
+	dirs, err := resolveDirs(list)
+	if err != nil {
+		return err
+	}
+	c.FileDirs = dirs
+	return nil
+}
+
+// FilePath checks that clients may read or write the file name, which
+// must be in one of the Manager's FileDirs or in the workspace or artifacts of a job the
+// Manager holds that the filter selects, such as the client's own, and
+// returns its path with symlinks resolved. The file itself need not exist
+// yet.
+func (m *Manager) FilePath(name string, filter JobFilter) (string, error) {
+	selects, err := filter.compile()
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(name) {
+		return "", withKind(ErrInvalidSpec, fmt.Errorf("path %q is not absolute", name))
+	}
+	// Resolve symlinks so that a link inside an allowed directory can't
+	// lead outside of it.
+	dir, err := filepath.EvalSymlinks(filepath.Dir(name))
+	if err != nil {
+		return "", withKind(ErrInvalidSpec, fmt.Errorf("invalid path: %v", err))
+	}
+	path := filepath.Join(dir, filepath.Base(name))
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	if withinDirs(path, m.config.FileDirs) || withinDirs(path, m.jobDirs(selects)) {
+		return path, nil
+	}
+	return "", withKind(ErrPolicyDenied, fmt.Errorf("%s is not in an allowed directory", name))
+}
+
+// jobDirs returns the workspaces and artifact directories of the jobs held
+// that selects returns true for, with symlinks resolved.
+func (m *Manager) jobDirs(selects func(job *Job) bool) []string {
+	var dirs []string
+	for _, job := range m.jobs.all() {
+		job.mu.Lock()
+		if !selects(job) {
+			job.mu.Unlock()
+			continue
+		}
+		for _, dir := range []string{job.Workspace, job.artifactDir} {
+			if dir == "" {
+				continue
+			}
+			if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+				dirs = append(dirs, resolved)
+			}
+		}
+		job.mu.Unlock()
+	}
+	return dirs
+}
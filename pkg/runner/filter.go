@@ -0,0 +1,164 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// maxFilterLine is the longest line an output filter waits for the end of.
+// Longer lines are filtered in pieces of this size.
+const maxFilterLine = 1 << 20
+
+// ansiEscape matches ANSI escape sequences: CSI sequences such as colors and
+// cursor movement, OSC sequences such as window titles, and two-byte ones.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+
+// OutputFilter selects and rewrites the lines of a job's output, so that
+// only the relevant part of a noisy log is kept. The steps are applied to
+// each line in the order of the fields.
+type OutputFilter struct {
+	StripANSI bool     // remove ANSI escape sequences, such as colors
+	Include   []string // keep only the lines matching one of these regular expressions
+	Exclude   []string // drop the lines matching one of these regular expressions
+	// Extract replaces each line with what this regular expression captures
+	// in it: its groups, separated by tabs, or the whole match if it has
+	// none. Lines it does not match are dropped.
+	Extract string
+}
+
+// Compile checks the regular expressions of f and returns the function that
+// applies f to a whole output.
+func (f *OutputFilter) Compile() (func(output string) string, error) {
+	filter, err := f.compile()
+	if err != nil {
+		return nil, withKind(ErrInvalidSpec, err)
+	}
+	return filter.apply, nil
+}
+
+func (f *OutputFilter) compile() (*outputFilter, error) {
+	compileAll := func(patterns []string) ([]*regexp.Regexp, error) {
+		var res []*regexp.Regexp
+		for _, pattern := range patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid filter pattern %q: %v", pattern, err)
+			}
+			res = append(res, re)
+		}
+		return res, nil
+	}
+	var filter outputFilter
+	var err error
+	filter.stripANSI = f.StripANSI
+	if filter.include, err = compileAll(f.Include); err != nil {
+		return nil, err
+	}
+	if filter.exclude, err = compileAll(f.Exclude); err != nil {
+		return nil, err
+	}
+	if f.Extract != "" {
+		if filter.extract, err = regexp.Compile(f.Extract); err != nil {
+			return nil, fmt.Errorf("invalid filter pattern %q: %v", f.Extract, err)
+		}
+	}
+	return &filter, nil
+}
+
+// outputFilter is a compiled OutputFilter.
+type outputFilter struct {
+	stripANSI bool
+	include   []*regexp.Regexp
+	exclude   []*regexp.Regexp
+	extract   *regexp.Regexp
+}
+
+// apply filters each line of output.
+func (f *outputFilter) apply(output string) string {
+	var out strings.Builder
+	for output != "" {
+		line, rest, found := strings.Cut(output, "\n")
+		if found {
+			line += "\n"
+		}
+		out.WriteString(f.line(line))
+		output = rest
+	}
+	return out.String()
+}
+
+// line filters one line, with its newline if it has one, and returns what
+// is left of it.
+func (f *outputFilter) line(line string) string {
+	text, newline := strings.CutSuffix(line, "\n")
+	if f.stripANSI {
+		text = ansiEscape.ReplaceAllString(text, "")
+	}
+	if len(f.include) > 0 && !matchAny(f.include, text) {
+		return ""
+	}
+	if matchAny(f.exclude, text) {
+		return ""
+	}
+	if f.extract != nil {
+		match := f.extract.FindStringSubmatch(text)
+		if match == nil {
+			return ""
+		}
+		if len(match) > 1 {
+			match = match[1:]
+		}
+		text = strings.Join(match, "\t")
+	}
+	if newline {
+		text += "\n"
+	}
+	return text
+}
+
+func matchAny(res []*regexp.Regexp, text string) bool {
+	for _, re := range res {
+		if re.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterWriter is a writer that filters the lines of a job's output before
+// passing them on. The end of each write is held back until its line is
+// complete.
+type filterWriter struct {
+	w       io.Writer
+	filter  *outputFilter
+	pending string
+}
+
+func (fw *filterWriter) Write(p []byte) (int, error) {
+	fw.pending += string(p)
+	var out strings.Builder
+	for {
+		i := strings.IndexByte(fw.pending, '\n')
+		if i < 0 && len(fw.pending) < maxFilterLine {
+			break
+		}
+		if i < 0 || i >= maxFilterLine {
+			i = maxFilterLine - 1
+		}
+		out.WriteString(fw.filter.line(fw.pending[:i+1]))
+		fw.pending = fw.pending[i+1:]
+	}
+	if _, err := io.WriteString(fw.w, out.String()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush filters and passes on the last line, once the job has exited.
+func (fw *filterWriter) Flush() error {
+	_, err := io.WriteString(fw.w, fw.filter.line(fw.pending))
+	fw.pending = ""
+	return err
+}
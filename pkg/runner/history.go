@@ -0,0 +1,158 @@
+package runner
+
+import (
+	"fmt"
+	"time"
+)
+
+// archivedJob is what a Manager remembers of a released job.
+type archivedJob struct {
+	spec        *JobSpec
+	interactive bool
+	released    time.Time
+}
+
+// archive remembers a job that is being released.
+func (m *Manager) archive(id string, job *Job) {
+	if m.config.HistorySize <= 0 {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.history[id] = archivedJob{spec: job.Spec, interactive: job.session != nil, released: time.Now()}
+	m.historyOrder = append(m.historyOrder, id)
+	for len(m.historyOrder) > m.config.HistorySize {
+		delete(m.history, m.historyOrder[0])
+		m.historyOrder = m.historyOrder[1:]
+	}
+}
+
+// Submitter returns the client that submitted the job with the given ID,
+// which may have been released since, as long as Rerun could still find it.
+func (m *Manager) Submitter(id string) (Identity, error) {
+	var submitter Identity
+	err := m.WithJob(id, func(job *Job) error {
+		submitter = job.Spec.Submitter
+		return nil
+	})
+	if err == nil {
+		return submitter, nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	archived, ok := m.history[id]
+	if !ok {
+		return Identity{}, jobNotFound(id)
+	}
+	return archived.spec.Submitter, nil
+}
+
+// Rerun starts a new background job with the same command and options as the
+// job with the given ID, which may have been released since, and returns the
+// new job's ID. A kept job of Run is rerun in the background, and an
+// interactive session as a new session. The new job is submitted by
+// submitter, who need not have submitted the job rerun.
+func (m *Manager) Rerun(id string, submitter Identity) (string, error) {
+	var previous archivedJob
+	err := m.WithJob(id, func(job *Job) error {
+		previous = archivedJob{spec: job.Spec, interactive: job.session != nil}
+		return nil
+	})
+	if err != nil {
+		m.mutex.Lock()
+		archived, ok := m.history[id]
+		m.mutex.Unlock()
+		if !ok {
+			return "", jobNotFound(id)
+		}
+		previous = archived
+	}
+
+	// The hooks run again for the new job, so it starts from the spec as
+	// submitted rather than the one they already changed.
+	spec := previous.spec.original().clone()
+	spec.Submitter = submitter
+	newID, err := m.start(spec, previous.interactive)
+	if err != nil {
+		return "", fmt.Errorf("rerunning job %s: %w", id, err)
+	}
+
+	m.WithJob(newID, func(job *Job) error {
+		job.RerunOf = id
+		return nil
+	})
+	Logger.Printf("Rerunning job %s as job %s", id, newID)
+	return newID, nil
+}
+
+// StoreStats is the size of what a Manager remembers besides its jobs.
+type StoreStats struct {
+	HistoryJobs int // released jobs remembered for Rerun
+	TrendSeries int
+	TrendRuns   int // of all series, all told
+}
+
+// StoreStats returns the size of what the Manager remembers besides its
+// jobs.
+func (m *Manager) StoreStats() StoreStats {
+	var stats StoreStats
+	m.mutex.Lock()
+	stats.HistoryJobs = len(m.history)
+	m.mutex.Unlock()
+	m.trendsMutex.Lock()
+	stats.TrendSeries = len(m.trends)
+	for _, s := range m.trends {
+		stats.TrendRuns += len(s.runs)
+	}
+	m.trendsMutex.Unlock()
+	return stats
+}
+
+// Maintenance is what Maintain forgot.
+type Maintenance struct {
+	PrunedHistory int // released jobs
+	PrunedSeries  int // series of trends
+}
+
+// Maintain forgets the released jobs and the series of trends older than
+// Config.HistoryRetention, and compacts what it remembers of the rest, whose
+// memory is otherwise only given back as it is overwritten.
+func (m *Manager) Maintain() Maintenance {
+	var done Maintenance
+	cutoff := time.Now().Add(-m.config.HistoryRetention)
+
+	m.mutex.Lock()
+	pruned := 0
+	if m.config.HistoryRetention > 0 {
+		for pruned < len(m.historyOrder) && m.history[m.historyOrder[pruned]].released.Before(cutoff) {
+			delete(m.history, m.historyOrder[pruned])
+			pruned++
+		}
+	}
+	done.PrunedHistory = pruned
+	m.historyOrder = append([]string(nil), m.historyOrder[pruned:]...)
+	// Maps never shrink, so the remembered jobs are moved to a new one.
+	history := make(map[string]archivedJob, len(m.history))
+	for id, job := range m.history {
+		history[id] = job
+	}
+	m.history = history
+	m.mutex.Unlock()
+
+	m.trendsMutex.Lock()
+	trends := make(map[string]*series, len(m.trends))
+	for name, s := range m.trends {
+		if m.config.HistoryRetention > 0 && s.runs[len(s.runs)-1].end.Before(cutoff) {
+			done.PrunedSeries++
+			continue
+		}
+		trends[name] = s
+	}
+	m.trends = trends
+	m.trendsMutex.Unlock()
+
+	if done.PrunedHistory > 0 || done.PrunedSeries > 0 {
+		Logger.Printf("Maintenance forgot %d released jobs and %d series of trends older than %v", done.PrunedHistory, done.PrunedSeries, m.config.HistoryRetention)
+	}
+	return done
+}
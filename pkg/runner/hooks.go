@@ -0,0 +1,170 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// HookTimeout is how long a hook script may run before it is killed. A
+// pre-exec script killed for it denies the job.
+var HookTimeout = 30 * time.Second
+
+// hookTail is how much of the end of a job's stdout and stderr post-exec
+// scripts are given.
+const hookTail = 4 << 10
+
+// BeforeStart registers f to be called with the spec of each job before it
+// is prepared, in the order hooks were registered. f may change the spec,
+// or veto the job by returning an error, which fails it with
+// ErrPolicyDenied unless the error is already of a kind.
+func (m *Manager) BeforeStart(f func(spec *JobSpec) error) {
+	m.hooksMutex.Lock()
+	defer m.hooksMutex.Unlock()
+	m.startHooks = append(m.startHooks, f)
+}
+
+// OnFinish registers f to be called with each job once it has finished and
+// its outcome has been recorded, whether it was run or started in the
+// background. f is called with the job's lock held, so it may read the
+// job's fields but must not call the Manager.
+func (m *Manager) OnFinish(f func(job *Job)) {
+	m.hooksMutex.Lock()
+	defer m.hooksMutex.Unlock()
+	m.finishHooks = append(m.finishHooks, f)
+}
+
+// starting calls the BeforeStart hooks with spec.
+func (m *Manager) starting(spec *JobSpec) error {
+	m.hooksMutex.Lock()
+	hooks := m.startHooks
+	m.hooksMutex.Unlock()
+	for _, f := range hooks {
+		if err := f(spec); err != nil {
+			return withKind(ErrPolicyDenied, err)
+		}
+	}
+	return nil
+}
+
+// finished calls the OnFinish hooks with job.
+func (m *Manager) finished(job *Job) {
+	m.hooksMutex.Lock()
+	hooks := m.finishHooks
+	m.hooksMutex.Unlock()
+	for _, f := range hooks {
+		f(job)
+	}
+}
+
+// PreExecScript returns a BeforeStart hook that runs the executable at path
+// with the job's spec, as JSON with its Go field names, on stdin. The
+// script vetoes the job by exiting with a non-zero status, with its stderr
+// as the reason. It can change the spec by printing a JSON object of the
+// fields to change. The values of secrets are never passed to it.
+func PreExecScript(path string) func(spec *JobSpec) error {
+	return func(spec *JobSpec) error {
+		input, err := json.Marshal(spec)
+		if err != nil {
+			return err
+		}
+		var stdout, stderr bytes.Buffer
+		if err := runHook(path, "pre-exec", input, &stdout, &stderr); err != nil {
+			if reason := strings.TrimSpace(stderr.String()); reason != "" {
+				return fmt.Errorf("pre-exec hook denied the job: %s", reason)
+			}
+			return fmt.Errorf("pre-exec hook denied the job: %v", err)
+		}
+		if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+			return nil
+		}
+		if err := json.Unmarshal(stdout.Bytes(), spec); err != nil {
+			return fmt.Errorf("pre-exec hook printed an invalid spec: %v", err)
+		}
+		return nil
+	}
+}
+
+// HookSummary describes a finished job to a post-exec script.
+type HookSummary struct {
+	ID              string            `json:"id,omitempty"` // empty for jobs run without being kept
+	Command         string            `json:"command,omitempty"`
+	Argv            []string          `json:"argv,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Submitter       string            `json:"submitter,omitempty"` // as Identity.String returns it
+	Status          string            `json:"status"`
+	ExitCode        int               `json:"exit_code"`
+	Result          string            `json:"result"`
+	FailureReason   string            `json:"failure_reason,omitempty"`
+	Signal          string            `json:"signal,omitempty"`
+	KilledBy        string            `json:"killed_by,omitempty"`
+	StartTime       time.Time         `json:"start_time"`
+	EndTime         time.Time         `json:"end_time"`
+	DurationSeconds float64           `json:"duration_seconds"`
+	StdoutBytes     int               `json:"stdout_bytes"`
+	StderrBytes     int               `json:"stderr_bytes"`
+	// StdoutTail and StderrTail are the last few KiB of the output.
+	StdoutTail string `json:"stdout_tail,omitempty"`
+	StderrTail string `json:"stderr_tail,omitempty"`
+}
+
+// PostExecScript returns an OnFinish hook that runs the executable at path
+// with a HookSummary of each finished job, as JSON, on stdin. The script
+// runs in the background, so it cannot hold up the Manager, and its exit
+// status is only logged.
+func PostExecScript(path string) func(job *Job) {
+	return func(job *Job) {
+		stdout, stderr := job.Stdout.String(), job.Stderr.String()
+		summary := HookSummary{
+			ID:              job.ID,
+			Command:         job.Command,
+			Argv:            job.Argv,
+			Labels:          job.Spec.Labels,
+			Submitter:       job.Spec.Submitter.String(),
+			Status:          job.Status,
+			ExitCode:        job.ExitCode,
+			Result:          job.Result,
+			FailureReason:   job.FailureReason,
+			Signal:          job.Signal,
+			KilledBy:        job.KilledBy,
+			StartTime:       job.StartTime,
+			EndTime:         job.EndTime,
+			DurationSeconds: job.EndTime.Sub(job.StartTime).Seconds(),
+			StdoutBytes:     len(stdout),
+			StderrBytes:     len(stderr),
+			StdoutTail:      stdout[max(0, len(stdout)-hookTail):],
+			StderrTail:      stderr[max(0, len(stderr)-hookTail):],
+		}
+		input, err := json.Marshal(summary)
+		if err != nil {
+			Logger.Printf("Error encoding the summary of job %s for the post-exec hook: %v", job.ID, err)
+			return
+		}
+		go func() {
+			var stderr bytes.Buffer
+			if err := runHook(path, "post-exec", input, nil, &stderr); err != nil {
+				Logger.Printf("Post-exec hook failed for job %q: %v: %s", summary.ID, err, strings.TrimSpace(stderr.String()))
+			}
+		}()
+	}
+}
+
+// runHook runs the hook script at path with input on stdin and
+// $SHELLRUNNER_HOOK set to kind.
+func runHook(path, kind string, input []byte, stdout, stderr *bytes.Buffer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), HookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Env = append(os.Environ(), "SHELLRUNNER_HOOK="+kind)
+	cmd.Stdin = bytes.NewReader(input)
+	if stdout != nil {
+		cmd.Stdout = stdout
+	}
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
@@ -0,0 +1,32 @@
+package runner
+
+import (
+	"os"
+	"runtime"
+)
+
+// HostStats is how much headroom the host jobs run on has left.
+type HostStats struct {
+	// Load1, Load5 and Load15 are the load averages over the last 1, 5 and
+	// 15 minutes, to be compared with CPUs.
+	Load1, Load5, Load15 float64
+	CPUs                 int
+	MemoryTotalBytes     uint64
+	// MemoryAvailableBytes is the memory new processes can have without
+	// the host swapping, page cache that can be dropped included.
+	MemoryAvailableBytes uint64
+	// SpoolDir is the directory job workspaces and artifacts are kept in,
+	// and SpoolTotalBytes and SpoolFreeBytes the size of its file system
+	// and the space left on it for unprivileged users.
+	SpoolDir        string
+	SpoolTotalBytes uint64
+	SpoolFreeBytes  uint64
+}
+
+// ReadHostStats reads how much headroom the host has left. It fails where
+// the host does not report it, which is outside Linux.
+func ReadHostStats() (HostStats, error) {
+	stats := HostStats{CPUs: runtime.NumCPU(), SpoolDir: os.TempDir()}
+	err := readHostStats(&stats)
+	return stats, err
+}
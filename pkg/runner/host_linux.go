@@ -0,0 +1,60 @@
+package runner
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// readHostStats fills in stats from /proc and the spool directory's file
+// system.
+func readHostStats(stats *HostStats) error {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return fmt.Errorf("unexpected /proc/loadavg %q", data)
+	}
+	for i, load := range []*float64{&stats.Load1, &stats.Load5, &stats.Load15} {
+		if *load, err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return fmt.Errorf("unexpected /proc/loadavg %q", data)
+		}
+	}
+
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Lines such as "MemAvailable:   8123456 kB".
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, _ := strconv.ParseUint(fields[1], 10, 64)
+		switch fields[0] {
+		case "MemTotal:":
+			stats.MemoryTotalBytes = kb << 10
+		case "MemAvailable:":
+			stats.MemoryAvailableBytes = kb << 10
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(stats.SpoolDir, &fs); err != nil {
+		return fmt.Errorf("reading the file system of %s: %w", stats.SpoolDir, err)
+	}
+	stats.SpoolTotalBytes = fs.Blocks * uint64(fs.Bsize)
+	stats.SpoolFreeBytes = fs.Bavail * uint64(fs.Bsize)
+	return nil
+}
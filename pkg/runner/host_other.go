@@ -0,0 +1,11 @@
+//go:build !linux
+
+package runner
+
+import "fmt"
+
+// readHostStats fails, as only Linux has /proc to read the host's load and
+// memory from.
+func readHostStats(stats *HostStats) error {
+	return fmt.Errorf("host statistics are only supported on Linux")
+}
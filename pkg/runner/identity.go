@@ -0,0 +1,27 @@
+package runner
+
+// Identity identifies the client that submitted a job, as far as the server
+// knows it.
+type Identity struct {
+	User  string `json:"user,omitempty"`  // the peer's user ID, where known
+	Token string `json:"token,omitempty"` // the name of the token the client presented
+	Cert  string `json:"cert,omitempty"`  // the name of the client certificate the client presented
+	Agent string `json:"agent,omitempty"` // what the client calls itself
+}
+
+// String returns the most specific part of the identity, prefixed with its
+// kind: "agent:<agent>", else "token:<name>", else "cert:<name>", else
+// "uid:<user>", or "" if nothing is known.
+func (id Identity) String() string {
+	switch {
+	case id.Agent != "":
+		return "agent:" + id.Agent
+	case id.Token != "":
+		return "token:" + id.Token
+	case id.Cert != "":
+		return "cert:" + id.Cert
+	case id.User != "":
+		return "uid:" + id.User
+	}
+	return ""
+}
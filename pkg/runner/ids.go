@@ -0,0 +1,180 @@
+package runner
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// idBlock is how many counter values a Manager with a counter file saves
+// as used at a time, so that the file is written once for that many jobs
+// rather than for each. Up to that many IDs are skipped after a restart.
+const idBlock = 1000
+
+// idPrefix matches the prefixes of job IDs.
+var idPrefix = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// idScheme is how a Manager makes up the IDs of new jobs: a counter, by
+// default from 1 each time the Manager is created, with an optional
+// prefix, or UUIDv7s.
+type idScheme struct {
+	uuid   bool
+	prefix string
+
+	counter atomic.Uint64
+
+	// The counter values up to reserved have been saved as used in path, if
+	// it is set. mu is held while saving more of them.
+	mu       sync.Mutex
+	path     string
+	reserved atomic.Uint64
+
+	// The time in milliseconds and the sequence number of the last UUID,
+	// guarded by mu, so that UUIDs made in the same millisecond keep their
+	// order.
+	lastMillis int64
+	lastSeq    uint16
+}
+
+// UseIDs sets how the IDs of new jobs are made up:
+//
+//   - "sequential", the default, numbers jobs 1, 2, 3 and so on.
+//   - "prefix:<prefix>" numbers them likewise after prefix, such as job-1.
+//   - "uuid" gives them UUIDv7s, which are unique across restarts and
+//     servers, cannot be guessed from one another, and sort by the time
+//     they were made.
+//
+// If counterFile is set, the numbers are kept in it, so that they go on
+// from where they were after a restart rather than starting again from 1
+// and reusing the IDs of jobs from before it. The UUID scheme has no
+// counter to keep. UseIDs is meant to be called before the Manager runs
+// any jobs.
+func (m *Manager) UseIDs(scheme, counterFile string) error {
+	ids := &idScheme{}
+	switch {
+	case scheme == "" || scheme == "sequential":
+	case scheme == "uuid":
+		if counterFile != "" {
+			return errors.New("UUID job IDs have no counter to keep in a file")
+		}
+		ids.uuid = true
+	case strings.HasPrefix(scheme, "prefix:"):
+		ids.prefix = strings.TrimPrefix(scheme, "prefix:")
+		if !idPrefix.MatchString(ids.prefix) {
+			return fmt.Errorf("invalid job ID prefix %q: want letters, digits, '.', '_' and '-'", ids.prefix)
+		}
+	default:
+		return fmt.Errorf("unknown job ID scheme %q: want sequential, prefix:<prefix> or uuid", scheme)
+	}
+
+	if counterFile != "" {
+		data, err := os.ReadFile(counterFile)
+		if err == nil {
+			used, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+			if err != nil {
+				return fmt.Errorf("reading job ID counter file %s: %w", counterFile, err)
+			}
+			ids.counter.Store(used)
+			ids.reserved.Store(used)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		ids.path = counterFile
+		// Save the first block now, so that a file that cannot be written
+		// is found before any job is.
+		if err := ids.reserve(ids.counter.Load() + 1); err != nil {
+			return err
+		}
+	}
+	m.ids.Store(ids)
+	return nil
+}
+
+// next returns a new ID.
+func (ids *idScheme) next() string {
+	if ids.uuid {
+		return ids.newUUID()
+	}
+	n := ids.counter.Add(1)
+	if ids.path != "" && n > ids.reserved.Load() {
+		if err := ids.reserve(n); err != nil {
+			// The job still gets its ID, which may be used again after a
+			// restart.
+			Logger.Printf("Error saving the job ID counter: %v", err)
+		}
+	}
+	if ids.prefix != "" {
+		return ids.prefix + strconv.FormatUint(n, 10)
+	}
+	return strconv.FormatUint(n, 10)
+}
+
+// reserve saves the counter values up to the end of the block holding n as
+// used, unless they already are.
+func (ids *idScheme) reserve(n uint64) error {
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+	if n <= ids.reserved.Load() {
+		return nil
+	}
+	reserved := n + idBlock - 1
+	tmp := ids.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(reserved, 10)+"\n"), 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, ids.path); err != nil {
+		return err
+	}
+	ids.reserved.Store(reserved)
+	Logger.Printf("Reserved job IDs up to %d in %s", reserved, filepath.Base(ids.path))
+	return nil
+}
+
+// newUUID returns a UUIDv7: the time in milliseconds, then a 12-bit
+// sequence number that starts at a random value below 2048 each
+// millisecond and counts up within it, then 62 random bits.
+func (ids *idScheme) newUUID() string {
+	var b [16]byte
+	rand.Read(b[6:])
+
+	ids.mu.Lock()
+	millis := time.Now().UnixMilli()
+	seq := binary.BigEndian.Uint16(b[6:]) & 0x7ff
+	if millis <= ids.lastMillis {
+		// Within the same millisecond, or with the clock set back, count up
+		// from the last UUID, moving on to the next millisecond once the
+		// sequence runs out.
+		millis, seq = ids.lastMillis, ids.lastSeq+1
+		if seq > 0xfff {
+			millis, seq = millis+1, 0
+		}
+	}
+	ids.lastMillis, ids.lastSeq = millis, seq
+	ids.mu.Unlock()
+
+	binary.BigEndian.PutUint64(b[:8], uint64(millis)<<16|uint64(seq))
+	b[6] |= 0x70            // version 7
+	b[8] = b[8]&0x3f | 0x80 // variant 10
+
+	var s [36]byte
+	hex.Encode(s[:8], b[:4])
+	s[8] = '-'
+	hex.Encode(s[9:13], b[4:6])
+	s[13] = '-'
+	hex.Encode(s[14:18], b[6:8])
+	s[18] = '-'
+	hex.Encode(s[19:23], b[8:10])
+	s[23] = '-'
+	hex.Encode(s[24:], b[10:])
+	return string(s[:])
+}
@@ -0,0 +1,101 @@
+package runner
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// JobFilter selects jobs by their labels, command, age and submitter, such as
+// those of one deployment. The zero JobFilter selects every job.
+type JobFilter struct {
+	Labels    map[string]string // labels the jobs must have, with these values
+	Command   string            // a regular expression their command must match
+	OlderThan time.Duration     // how long ago they must have started, at least
+	// Submitter, if set, selects the jobs by the client that submitted them.
+	Submitter func(id Identity) bool
+}
+
+// compile returns the function that reports whether the filter selects a
+// job, which must be called with the job's lock held.
+func (f JobFilter) compile() (func(job *Job) bool, error) {
+	if f.OlderThan < 0 {
+		return nil, withKind(ErrInvalidSpec, fmt.Errorf("negative age %v", f.OlderThan))
+	}
+	var command *regexp.Regexp
+	if f.Command != "" {
+		var err error
+		if command, err = regexp.Compile(f.Command); err != nil {
+			return nil, withKind(ErrInvalidSpec, fmt.Errorf("invalid command pattern: %w", err))
+		}
+	}
+	now := time.Now()
+	return func(job *Job) bool {
+		if command != nil {
+			line := job.Spec.Command
+			if line == "" {
+				line = strings.Join(job.Spec.Argv, " ")
+			}
+			if !command.MatchString(line) {
+				return false
+			}
+		}
+		if f.Submitter != nil && !f.Submitter(job.Spec.Submitter) {
+			return false
+		}
+		for key, value := range f.Labels {
+			if job.Spec.Labels[key] != value {
+				return false
+			}
+		}
+		return now.Sub(job.StartTime) >= f.OlderThan
+	}, nil
+}
+
+// EachJob calls f with each job the filter selects, in order of ID, holding
+// the job's lock while it does.
+func (m *Manager) EachJob(filter JobFilter, f func(job *Job)) error {
+	selects, err := filter.compile()
+	if err != nil {
+		return err
+	}
+	for _, job := range m.jobs.all() {
+		job.mu.Lock()
+		if !job.released && selects(job) {
+			f(job)
+		}
+		job.mu.Unlock()
+	}
+	return nil
+}
+
+// KillAll sends the named signal, as Kill does, to every running or paused
+// job the filter selects. It returns the IDs of the jobs it was sent to, in order,
+// and the errors for those it could not be sent to.
+func (m *Manager) KillAll(filter JobFilter, signal string) ([]string, map[string]error, error) {
+	sig, err := parseSignal(signal)
+	if err != nil {
+		return nil, nil, withKind(ErrInvalidSpec, err)
+	}
+	selects, err := filter.compile()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var killed []string
+	failed := make(map[string]error)
+	for _, job := range m.jobs.all() {
+		job.mu.Lock()
+		if !job.Finished() && selects(job) {
+			if err := job.signal(sig); err != nil {
+				failed[job.ID] = err
+			} else {
+				killed = append(killed, job.ID)
+			}
+		}
+		job.mu.Unlock()
+	}
+	Logger.Printf("Sent signal %d to %d jobs, failed for %d", sig, len(killed), len(failed))
+	return killed, failed, nil
+}
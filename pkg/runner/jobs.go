@@ -0,0 +1,98 @@
+package runner
+
+import (
+	"io"
+	"sort"
+	"sync"
+)
+
+// jobShards is the number of shards of a jobTable.
+const jobShards = 32
+
+// jobTable holds the jobs of a Manager by ID, in shards with a lock each, so
+// that calls about different jobs do not wait for one another. The locks of
+// the shards are only held while the shards' maps are used, never while
+// taking another lock.
+type jobTable struct {
+	shards [jobShards]jobShard
+}
+
+// jobShard holds the jobs whose IDs hash to it.
+type jobShard struct {
+	mu   sync.RWMutex
+	jobs map[string]*Job
+}
+
+func newJobTable() *jobTable {
+	t := &jobTable{}
+	for i := range t.shards {
+		t.shards[i].jobs = make(map[string]*Job)
+	}
+	return t
+}
+
+// shard returns the shard holding the job with the given ID, by its 32-bit
+// FNV-1a hash, worked out here so that looking jobs up allocates nothing.
+func (t *jobTable) shard(id string) *jobShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(id); i++ {
+		h ^= uint32(id[i])
+		h *= 16777619
+	}
+	return &t.shards[h%jobShards]
+}
+
+// get returns the job with the given ID.
+func (t *jobTable) get(id string) (*Job, bool) {
+	s := t.shard(id)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	job, ok := s.jobs[id]
+	return job, ok
+}
+
+// put adds job under its ID.
+func (t *jobTable) put(job *Job) {
+	s := t.shard(job.ID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = job
+}
+
+// remove removes the job with the given ID and returns it.
+func (t *jobTable) remove(id string) (*Job, bool) {
+	s := t.shard(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	delete(s.jobs, id)
+	return job, ok
+}
+
+// all returns the jobs held now, in order of ID.
+func (t *jobTable) all() []*Job {
+	var jobs []*Job
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.RLock()
+		for _, job := range s.jobs {
+			jobs = append(jobs, job)
+		}
+		s.mu.RUnlock()
+	}
+	sort.Slice(jobs, func(i, j int) bool { return lessID(jobs[i].ID, jobs[j].ID) })
+	return jobs
+}
+
+// lockedWriter is a writer that holds a job's lock while writing its
+// output, so that it can be read from within WithJob while the job runs.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
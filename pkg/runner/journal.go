@@ -0,0 +1,121 @@
+package runner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Journal writes the output of every job to the systemd journal, a line per
+// entry, as well as capturing it, with the job's ID, command and stream as
+// fields, and ends each job with an entry of its exit code. It is set with
+// SetJournal.
+var Journal bool
+
+// journalSocket is where journald reads entries from.
+var journalSocket = "/run/systemd/journal/socket"
+
+// journalMaxMessage is the most bytes of a line written to the journal, so
+// that entries fit in a datagram. Longer lines are cut.
+const journalMaxMessage = 32 << 10
+
+// SetJournal sets Journal, checking that journald is running if on.
+func SetJournal(on bool) error {
+	if on {
+		if _, err := os.Stat(journalSocket); err != nil {
+			return fmt.Errorf("journald is not running: %v", err)
+		}
+	}
+	Journal = on
+	return nil
+}
+
+// openJournal starts writing the output of the job run from spec to the
+// journal, if Journal is set. It works like a log sink, so the journal
+// never holds up the job either.
+func openJournal(spec *JobSpec) *logSink {
+	if !Journal {
+		return nil
+	}
+	command := spec.Command
+	if command == "" {
+		command = strings.Join(spec.Argv, " ")
+	}
+	sink := newLogSink("journal")
+	sink.format = func(line sinkLine) []byte { return journalEntry(line, command) }
+	sink.dial = func() (io.WriteCloser, error) { return net.Dial("unixgram", journalSocket) }
+	sink.send = sink.stream
+	go sink.run()
+	return sink
+}
+
+// endJournal writes the entry that ends the output of a job that has
+// finished, with its exit code, and stops writing its output to the
+// journal. The caller must hold the job's lock.
+func endJournal(job *Job) {
+	sink := job.Spec.journal
+	if sink == nil {
+		return
+	}
+	job.Spec.journal = nil
+	code := job.ExitCode
+	message := fmt.Sprintf("Job finished with status %s and exit code %d", job.Status, code)
+	if job.ID != "" {
+		message = fmt.Sprintf("Job %s finished with status %s and exit code %d", job.ID, job.Status, code)
+	}
+	sink.queue(sinkLine{Time: job.EndTime, JobID: job.ID, Line: message, exitCode: &code})
+	sink.close()
+}
+
+// journalEntry encodes line as an entry of journald's native protocol.
+// Stdout lines are logged at priority info, stderr lines at err, and the
+// entry ending a job at notice.
+func journalEntry(line sinkLine, command string) []byte {
+	priority := "6"
+	switch {
+	case line.Stream == "stderr":
+		priority = "3"
+	case line.exitCode != nil:
+		priority = "5"
+	}
+	message := line.Line
+	if len(message) > journalMaxMessage {
+		message = message[:journalMaxMessage]
+	}
+	var b bytes.Buffer
+	journalField(&b, "MESSAGE", message)
+	journalField(&b, "PRIORITY", priority)
+	journalField(&b, "SYSLOG_IDENTIFIER", "shellrunner")
+	if line.JobID != "" {
+		journalField(&b, "JOB_ID", line.JobID)
+	}
+	journalField(&b, "COMMAND", command)
+	if line.Stream != "" {
+		journalField(&b, "STREAM", line.Stream)
+	}
+	if line.exitCode != nil {
+		journalField(&b, "EXIT_CODE", strconv.Itoa(*line.exitCode))
+	}
+	return b.Bytes()
+}
+
+// journalField appends a field to an entry, with its value's length before
+// it if it spans lines, as the protocol needs.
+func journalField(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
@@ -0,0 +1,166 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// KubernetesOptions configures running a job as a pod in a Kubernetes cluster.
+type KubernetesOptions struct {
+	Image     string
+	Namespace string  // defaults to the namespace of kubectl's current context
+	Name      string  // pod name, generated if empty
+	Memory    uint64  // memory limit in bytes
+	CPUs      float64 // CPU limit in cores, such as 0.5
+}
+
+// podPhaseTimeout bounds how long Status waits for kubectl to report the
+// phase of a running job's pod.
+const podPhaseTimeout = 2 * time.Second
+
+// kubernetesExecutor runs jobs as pods through kubectl, using the cluster of
+// its current context. The job's process is "kubectl run", which streams the
+// pod's logs while it runs, exits with its container's exit code, and
+// deletes the pod afterwards.
+type kubernetesExecutor struct{}
+
+// Command builds the "kubectl run" command for the job's pod. As with
+// containers, a command string is run with sh.
+func (kubernetesExecutor) Command(spec *JobSpec) (*exec.Cmd, error) {
+	opts := spec.Kubernetes
+	if opts == nil || opts.Image == "" {
+		return nil, fmt.Errorf("kubernetes jobs need an image")
+	}
+	if spec.Limits != (ResourceLimits{}) || spec.Cgroup != (CgroupLimits{}) || spec.Nice != 0 || spec.IONice != "" || spec.CPUSet != "" || spec.Sandbox != nil || spec.Container != nil || spec.Host != "" {
+		return nil, fmt.Errorf("limits, cgroup, nice, ionice, CPU set, sandbox, container and host options are not supported for kubernetes jobs")
+	}
+	if len(spec.Secrets) > 0 {
+		// The values would have to be put in the pod's spec on kubectl's
+		// command line.
+		return nil, fmt.Errorf("secrets are not supported for kubernetes jobs")
+	}
+	if opts.Name == "" {
+		opts.Name = generateName()
+	} else if strings.HasPrefix(opts.Name, "-") {
+		return nil, fmt.Errorf("invalid pod name %q", opts.Name)
+	}
+
+	command := spec.Argv
+	if len(command) == 0 {
+		command = []string{"sh", "-c", spec.Command}
+	}
+	container := map[string]interface{}{
+		"name":    opts.Name,
+		"image":   opts.Image,
+		"command": command,
+	}
+	limits := map[string]string{}
+	if opts.Memory > 0 {
+		limits["memory"] = strconv.FormatUint(opts.Memory, 10)
+	}
+	if opts.CPUs > 0 {
+		limits["cpu"] = strconv.FormatFloat(opts.CPUs, 'f', -1, 64)
+	}
+	if len(limits) > 0 {
+		container["resources"] = map[string]interface{}{"limits": limits}
+	}
+	if vars := spec.environment(); len(vars) > 0 {
+		var env []map[string]string
+		for _, pair := range environ(vars) {
+			name, value, _ := strings.Cut(pair, "=")
+			env = append(env, map[string]string{"name": name, "value": value})
+		}
+		container["env"] = env
+	}
+	if spec.Dir != "" {
+		container["workingDir"] = spec.Dir
+	}
+	if spec.Pty {
+		container["stdin"] = true
+		container["tty"] = true
+	} else if spec.Stdin != "" || spec.StdinOpen {
+		container["stdin"] = true
+		container["stdinOnce"] = true
+	}
+	// The overrides replace the container kubectl would generate, which
+	// gives full control over its command and resources.
+	overrides, err := json.Marshal(map[string]interface{}{
+		"apiVersion": "v1",
+		"spec": map[string]interface{}{
+			"containers": []interface{}{container},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"run", opts.Name, "--image", opts.Image, "--restart", "Never", "--rm", "--attach", "--quiet", "--overrides", string(overrides)}
+	if opts.Namespace != "" {
+		args = append(args, "--namespace", opts.Namespace)
+	}
+	if spec.Pty {
+		args = append(args, "--stdin", "--tty")
+	} else if spec.Stdin != "" || spec.StdinOpen {
+		args = append(args, "--stdin")
+	}
+	return exec.Command("kubectl", args...), nil
+}
+
+// Signal deletes the job's pod. Kubernetes can't deliver arbitrary signals:
+// SIGTERM deletes the pod with its usual grace period, and SIGKILL
+// immediately.
+func (kubernetesExecutor) Signal(spec *JobSpec, cmd *exec.Cmd, sig syscall.Signal) error {
+	args := []string{"delete", "pod", spec.Kubernetes.Name, "--wait=false"}
+	switch sig {
+	case syscall.SIGTERM:
+	case syscall.SIGKILL:
+		args = append(args, "--now")
+	default:
+		return fmt.Errorf("only TERM and KILL are supported for kubernetes jobs")
+	}
+	if spec.Kubernetes.Namespace != "" {
+		args = append(args, "--namespace", spec.Kubernetes.Namespace)
+	}
+	out, err := exec.Command("kubectl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("kubectl delete failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// PodPhase returns the phase of a Kubernetes job's pod. The phase of a
+// running job's pod is queried live, so that a pod still waiting to be
+// scheduled shows as "Pending"; once the job has finished, its exit code
+// tells whether the pod succeeded. It returns "" for other jobs, or if the
+// phase can't be queried.
+func (job *Job) PodPhase() string {
+	opts := job.Spec.Kubernetes
+	if opts == nil {
+		return ""
+	}
+
+	switch {
+	case job.Status == "running":
+		args := []string{"get", "pod", opts.Name, "--output", "jsonpath={.status.phase}"}
+		if opts.Namespace != "" {
+			args = append(args, "--namespace", opts.Namespace)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), podPhaseTimeout)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, "kubectl", args...).Output()
+		if err != nil {
+			return ""
+		}
+		return string(out)
+	case job.Status == "exited" && job.ExitCode == 0:
+		return "Succeeded"
+	default:
+		return "Failed"
+	}
+}
@@ -0,0 +1,41 @@
+package runner
+
+import "fmt"
+
+// ResourceLimits holds resource limits applied to a job's process before the
+// command executes, named after the corresponding RLIMIT_* resources. Zero
+// leaves a limit unset.
+type ResourceLimits struct {
+	CPU    uint64 // CPU time in seconds
+	AS     uint64 // address space in bytes
+	Data   uint64 // data segment size in bytes
+	NoFile uint64 // number of open file descriptors
+	FSize  uint64 // size of files the job may write, in bytes
+}
+
+// ulimitArgs returns the --ulimit options of docker and podman run that apply
+// the limits inside a container, matching applyLimits.
+func (l ResourceLimits) ulimitArgs() []string {
+	var args []string
+	add := func(name string, soft, hard uint64) {
+		args = append(args, "--ulimit", fmt.Sprintf("%s=%d:%d", name, soft, hard))
+	}
+	if l.CPU > 0 {
+		// As with applyLimits, the hard limit is a second higher so that
+		// the job gets SIGXCPU before it is killed.
+		add("cpu", l.CPU, l.CPU+1)
+	}
+	if l.AS > 0 {
+		add("as", l.AS, l.AS)
+	}
+	if l.Data > 0 {
+		add("data", l.Data, l.Data)
+	}
+	if l.NoFile > 0 {
+		add("nofile", l.NoFile, l.NoFile)
+	}
+	if l.FSize > 0 {
+		add("fsize", l.FSize, l.FSize)
+	}
+	return args
+}
@@ -0,0 +1,114 @@
+//go:build !windows
+
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// applyLimits arranges for limits to be set in cmd's process before it
+// executes. The command is wrapped in a bash prologue that applies the limits
+// with ulimit and then execs the original argv, so the limits are in place
+// before the command runs and are inherited by everything it spawns.
+func applyLimits(cmd *exec.Cmd, limits ResourceLimits) error {
+	if limits == (ResourceLimits{}) || cmd.Err != nil {
+		return nil
+	}
+
+	var script strings.Builder
+	if limits.CPU > 0 {
+		// The soft limit delivers SIGXCPU; the hard limit one second later
+		// kills commands that ignore it.
+		fmt.Fprintf(&script, "ulimit -S -t %d && ulimit -H -t %d && ", limits.CPU, limits.CPU+1)
+	}
+	if limits.AS > 0 {
+		fmt.Fprintf(&script, "ulimit -v %d && ", kibibytes(limits.AS))
+	}
+	if limits.Data > 0 {
+		fmt.Fprintf(&script, "ulimit -d %d && ", kibibytes(limits.Data))
+	}
+	if limits.NoFile > 0 {
+		fmt.Fprintf(&script, "ulimit -n %d && ", limits.NoFile)
+	}
+	if limits.FSize > 0 {
+		fmt.Fprintf(&script, "ulimit -f %d && ", kibibytes(limits.FSize))
+	}
+	script.WriteString(`exec "$@"`)
+
+	if err := wrapCommand(cmd, "bash", "-c", script.String(), "shellrunner"); err != nil {
+		return fmt.Errorf("resource limits require bash: %v", err)
+	}
+	return nil
+}
+
+// applyUmask makes cmd run with the given octal file mode creation mask, if
+// one is given.
+func applyUmask(cmd *exec.Cmd, umask string) error {
+	if umask == "" || cmd.Err != nil {
+		return nil
+	}
+	if err := wrapCommand(cmd, "sh", "-c", "umask "+umask+` && exec "$@"`, "shellrunner"); err != nil {
+		return fmt.Errorf("umask requires sh: %v", err)
+	}
+	return nil
+}
+
+// kibibytes converts bytes to the KiB units used by ulimit, rounding up.
+func kibibytes(bytes uint64) uint64 {
+	return (bytes + 1023) / 1024
+}
+
+// limitExceeded reports which limit, if any, killed the process: "cpu" or
+// "fsize". A shell reports a child killed by signal N as exit status 128+N,
+// so that is treated like the signal itself. Exceeding the memory or open
+// file limits makes allocations and opens fail rather than killing the
+// process, so those are not reported.
+func limitExceeded(state *os.ProcessState, limits ResourceLimits) string {
+	if state == nil {
+		return ""
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		return ""
+	}
+	var signal syscall.Signal
+	switch {
+	case status.Signaled():
+		signal = status.Signal()
+	case status.Exited() && status.ExitStatus() > 128:
+		signal = syscall.Signal(status.ExitStatus() - 128)
+	default:
+		return ""
+	}
+
+	switch {
+	case signal == syscall.SIGXCPU && limits.CPU > 0:
+		return "cpu"
+	case signal == syscall.SIGXFSZ && limits.FSize > 0:
+		return "fsize"
+	case signal == syscall.SIGKILL && limits.CPU > 0:
+		cpu := state.UserTime() + state.SystemTime()
+		if cpu >= time.Duration(limits.CPU)*time.Second {
+			return "cpu"
+		}
+	}
+	return ""
+}
+
+// terminationSignal returns the name of the signal that killed the process,
+// if one did, and whether it dumped core.
+func terminationSignal(state *os.ProcessState) (string, bool) {
+	if state == nil {
+		return "", false
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return "", false
+	}
+	return signalName(status.Signal()), status.CoreDump()
+}
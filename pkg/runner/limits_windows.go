@@ -0,0 +1,35 @@
+//go:build windows
+
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// applyLimits fails if any limit is set, as Windows has no rlimits.
+func applyLimits(cmd *exec.Cmd, limits ResourceLimits) error {
+	if limits != (ResourceLimits{}) {
+		return fmt.Errorf("resource limits are not supported on Windows")
+	}
+	return nil
+}
+
+// applyUmask fails if a umask is given, as Windows has none.
+func applyUmask(cmd *exec.Cmd, umask string) error {
+	if umask != "" {
+		return fmt.Errorf("umask is not supported on Windows")
+	}
+	return nil
+}
+
+// limitExceeded always reports no limit, as Windows has no rlimits.
+func limitExceeded(state *os.ProcessState, limits ResourceLimits) string {
+	return ""
+}
+
+// terminationSignal always reports no signal, as Windows has none.
+func terminationSignal(state *os.ProcessState) (string, bool) {
+	return "", false
+}
@@ -0,0 +1,82 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// SetLogDirs sets LogDirs from a comma-separated list of directories.
+func (c *Config) SetLogDirs(list string) error {
+	dirs, err := resolveDirs(list)
+	if err != nil {
+		return err
+	}
+	c.LogDirs = dirs
+	return nil
+}
+
+// openLog opens the log file of spec, if it has one, for appending, creating
+// it if needed.
+func openLog(spec *JobSpec) (*os.File, error) {
+	if spec.LogFile == "" {
+		if spec.LogOnly {
+			return nil, withKind(ErrInvalidSpec, fmt.Errorf("log only requires a log file"))
+		}
+		return nil, nil
+	}
+	return openInLogDirs(spec.LogFile, "log file", spec.config.LogDirs)
+}
+
+// openInLogDirs opens the file name, which must be in one of dirs, the
+// Manager's LogDirs, for appending, creating it if needed. Errors call it
+// what.
+func openInLogDirs(name, what string, dirs []string) (*os.File, error) {
+	if !filepath.IsAbs(name) {
+		return nil, withKind(ErrInvalidSpec, fmt.Errorf("%s %q is not an absolute path", what, name))
+	}
+	// Resolve symlinks so that a link inside an allowed directory can't
+	// lead outside of it. The file itself may not exist yet.
+	dir, err := filepath.EvalSymlinks(filepath.Dir(name))
+	if err != nil {
+		return nil, withKind(ErrInvalidSpec, fmt.Errorf("invalid %s: %v", what, err))
+	}
+	path := filepath.Join(dir, filepath.Base(name))
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	if !withinDirs(path, dirs) {
+		return nil, withKind(ErrPolicyDenied, fmt.Errorf("%s %s is not in an allowed directory", what, name))
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, withKind(ErrInvalidSpec, fmt.Errorf("cannot open %s: %v", what, err))
+	}
+	return f, nil
+}
+
+// logOutput makes the job's output go to its log file as well, or instead
+// for LogOnly, and returns the writers its stdout and stderr are captured
+// into.
+func logOutput(spec *JobSpec, stdout, stderr io.Writer) (io.Writer, io.Writer) {
+	if spec.logFile == nil {
+		return stdout, stderr
+	}
+	if spec.LogOnly {
+		return spec.logFile, spec.logFile
+	}
+	return io.MultiWriter(stdout, spec.logFile), io.MultiWriter(stderr, spec.logFile)
+}
+
+// closeLog closes the log file and the log sink of a job that has exited.
+func closeLog(spec *JobSpec) {
+	if spec.logFile != nil {
+		spec.logFile.Close()
+		spec.logFile = nil
+	}
+	if spec.logSink != nil {
+		spec.logSink.close()
+		spec.logSink = nil
+	}
+}
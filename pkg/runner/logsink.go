@@ -0,0 +1,421 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SetLogSinkHosts sets LogSinkHosts from a comma-separated list of
+// host:port addresses.
+func (c *Config) SetLogSinkHosts(list string) error {
+	var hosts []string
+	for _, host := range strings.Split(list, ",") {
+		if host = strings.TrimSpace(host); host == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			return fmt.Errorf("invalid log sink host %q: %v", host, err)
+		}
+		hosts = append(hosts, host)
+	}
+	c.LogSinkHosts = hosts
+	return nil
+}
+
+const (
+	// sinkQueue is how many lines of a job's output wait to be sent to its
+	// log sink before further lines are dropped, so that a slow sink never
+	// holds up the job.
+	sinkQueue = 1024
+	// sinkBatch is the most lines sent to a sink at once.
+	sinkBatch = 100
+	// sinkFlushInterval is how long the lines for a webhook are gathered
+	// before they are posted.
+	sinkFlushInterval = time.Second
+	// sinkRetryInterval is how long a sink that could not be reached is
+	// left before it is tried again. The lines meanwhile are dropped.
+	sinkRetryInterval = time.Second
+	// sinkTimeout bounds connecting to a sink and posting to a webhook.
+	sinkTimeout = 10 * time.Second
+)
+
+// sinkLine is a line of a job's output as sent to a log sink: as a line of
+// JSON to files, TCP and UDP addresses, and in arrays of them to webhooks.
+type sinkLine struct {
+	Time   time.Time `json:"time"`
+	JobID  string    `json:"job_id,omitempty"` // unset for jobs run by Run and not kept
+	Stream string    `json:"stream"`           // stdout or stderr
+	Line   string    `json:"line"`
+
+	exitCode *int // set on the entry ending a job in the journal
+}
+
+// logSink forwards the lines of a job's output to where its LogSink names,
+// from a goroutine of its own, as they are written.
+type logSink struct {
+	target  string // the LogSink
+	dropped atomic.Int64
+
+	// mu guards closing lines, so that a late write cannot send on it once
+	// closed.
+	mu     sync.Mutex
+	lines  chan sinkLine
+	closed bool
+
+	// Used by the goroutine only.
+	send    func([]sinkLine) error // delivers lines
+	closer  io.Closer              // the file or connection lines are sent on, if open
+	dial    func() (io.WriteCloser, error)
+	format  func(sinkLine) []byte
+	retryAt time.Time
+	gather  time.Duration // how long lines are gathered before they are sent
+}
+
+// openLogSink checks the log sink of spec, if it has one, and starts
+// forwarding lines to it. It is one of:
+//
+//   - file:<path>, a file in one of the Manager's LogDirs, appended to;
+//   - syslog for the local syslog daemon, or syslog://host:port, or
+//     syslog+tcp://host:port, for a remote one, sent stdout lines at
+//     severity info and stderr lines at severity err;
+//   - tcp://host:port or udp://host:port, sent a line of JSON per line;
+//   - an http:// or https:// URL, a webhook posted arrays of lines as JSON,
+//     a second's worth at a time.
+//
+// Hosts reached over the network must be in the Manager's LogSinkHosts. Connections are
+// made once there is a line to send, and made again if they fail.
+func openLogSink(spec *JobSpec) (*logSink, error) {
+	if spec.LogSink == "" {
+		return nil, nil
+	}
+	sink := newLogSink(spec.LogSink)
+	if path, ok := strings.CutPrefix(spec.LogSink, "file:"); ok {
+		f, err := openInLogDirs(path, "log sink file", spec.config.LogDirs)
+		if err != nil {
+			return nil, err
+		}
+		sink.closer = f
+		sink.send = func(lines []sinkLine) error { return sink.write(f, lines) }
+		go sink.run()
+		return sink, nil
+	}
+	if spec.LogSink == "syslog" {
+		sink.format = syslogLine("")
+		sink.dial = dialLocalSyslog
+		sink.send = sink.stream
+		go sink.run()
+		return sink, nil
+	}
+
+	u, err := url.Parse(spec.LogSink)
+	if err != nil || u.Host == "" {
+		return nil, withKind(ErrInvalidSpec, fmt.Errorf("invalid log sink %q: want file:<path>, syslog, syslog://host:port, tcp://host:port, udp://host:port or an http(s) URL", spec.LogSink))
+	}
+	host := u.Host
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "http":
+			host = net.JoinHostPort(u.Hostname(), "80")
+		case "https":
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	}
+	if !slices.Contains(spec.config.LogSinkHosts, host) {
+		return nil, withKind(ErrPolicyDenied, fmt.Errorf("log sink host %s is not allowed", host))
+	}
+	network := u.Scheme
+	switch u.Scheme {
+	case "http", "https":
+		client := &http.Client{Timeout: sinkTimeout, CheckRedirect: refuseRedirect}
+		sink.gather = sinkFlushInterval
+		sink.send = func(lines []sinkLine) error { return postLines(client, spec.LogSink, lines) }
+		go sink.run()
+		return sink, nil
+	case "syslog":
+		network = "udp"
+		sink.format = syslogLine(hostname())
+	case "syslog+tcp":
+		network = "tcp"
+		sink.format = syslogLine(hostname())
+	case "tcp", "udp":
+	default:
+		return nil, withKind(ErrInvalidSpec, fmt.Errorf("unknown log sink scheme %q", u.Scheme))
+	}
+	sink.dial = func() (io.WriteCloser, error) { return net.DialTimeout(network, host, sinkTimeout) }
+	sink.send = sink.stream
+	go sink.run()
+	return sink, nil
+}
+
+// newLogSink returns a sink for target that sends lines as JSON, to be
+// given the means to send them.
+func newLogSink(target string) *logSink {
+	return &logSink{target: target, lines: make(chan sinkLine, sinkQueue), format: jsonLine}
+}
+
+// errSinkDown is the error sending lines to a sink that could not be
+// reached the last time it was tried. It is not logged again.
+var errSinkDown = errors.New("not connected")
+
+// forward makes the writers of the output of the job with the given ID
+// forward its lines to the sink as well, and adds their Flush methods to
+// flushes.
+func (sink *logSink) forward(jobID string, stdout, stderr *io.Writer, flushes *[]func() error) {
+	sinkStdout := &sinkWriter{sink: sink, jobID: jobID, stream: "stdout"}
+	sinkStderr := &sinkWriter{sink: sink, jobID: jobID, stream: "stderr"}
+	*stdout, *stderr = io.MultiWriter(*stdout, sinkStdout), io.MultiWriter(*stderr, sinkStderr)
+	*flushes = append(*flushes, sinkStdout.Flush, sinkStderr.Flush)
+}
+
+// queue hands a line to the sink's goroutine, or drops it if the sink is
+// behind.
+func (sink *logSink) queue(line sinkLine) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.closed {
+		sink.dropped.Add(1)
+		return
+	}
+	select {
+	case sink.lines <- line:
+	default:
+		sink.dropped.Add(1)
+	}
+}
+
+// close ends the sink once its writers have been flushed. The lines still
+// queued are sent before its goroutine exits, without waiting for them.
+func (sink *logSink) close() {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.closed = true
+	close(sink.lines)
+}
+
+// run sends the queued lines in batches until the sink is closed.
+func (sink *logSink) run() {
+	defer func() {
+		if sink.closer != nil {
+			sink.closer.Close()
+		}
+		if dropped := sink.dropped.Load(); dropped > 0 {
+			Logger.Printf("Dropped %d lines for log sink %s", dropped, sink.target)
+		}
+	}()
+	for line := range sink.lines {
+		batch := sink.collect([]sinkLine{line})
+		if err := sink.send(batch); err != nil {
+			sink.dropped.Add(int64(len(batch)))
+			if err == errSinkDown {
+				continue
+			}
+			Logger.Printf("Error sending output to log sink %s: %v", sink.target, err)
+		}
+	}
+}
+
+// collect adds queued lines to batch, up to sinkBatch of them: those queued
+// already, or, for webhooks, those queued within sinkFlushInterval.
+func (sink *logSink) collect(batch []sinkLine) []sinkLine {
+	var timeout <-chan time.Time
+	if sink.gather > 0 {
+		timer := time.NewTimer(sink.gather)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for len(batch) < sinkBatch {
+		var line sinkLine
+		var ok bool
+		if timeout == nil {
+			select {
+			case line, ok = <-sink.lines:
+			default:
+				return batch
+			}
+		} else {
+			select {
+			case line, ok = <-sink.lines:
+			case <-timeout:
+				return batch
+			}
+		}
+		if !ok {
+			return batch
+		}
+		batch = append(batch, line)
+	}
+	return batch
+}
+
+// stream sends lines over the sink's connection, connecting first if it is
+// not connected, and dropping the connection if sending fails.
+func (sink *logSink) stream(lines []sinkLine) error {
+	if sink.closer == nil {
+		if time.Now().Before(sink.retryAt) {
+			return errSinkDown
+		}
+		conn, err := sink.dial()
+		if err != nil {
+			sink.retryAt = time.Now().Add(sinkRetryInterval)
+			return err
+		}
+		sink.closer = conn
+	}
+	if err := sink.write(sink.closer.(io.Writer), lines); err != nil {
+		sink.closer.Close()
+		sink.closer = nil
+		return err
+	}
+	return nil
+}
+
+// write writes lines to w, each in a write of its own so that datagram
+// sinks get a line per datagram.
+func (sink *logSink) write(w io.Writer, lines []sinkLine) error {
+	for _, line := range lines {
+		if _, err := w.Write(sink.format(line)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonLine formats line as a line of JSON.
+func jsonLine(line sinkLine) []byte {
+	b, _ := json.Marshal(line)
+	return append(b, '\n')
+}
+
+// syslogLine returns a function that formats lines as BSD syslog messages
+// from the host named host, or from this host without a name for the local
+// daemon.
+func syslogLine(host string) func(sinkLine) []byte {
+	if host != "" {
+		host += " "
+	}
+	pid := os.Getpid()
+	return func(line sinkLine) []byte {
+		priority := 1<<3 | 6 // user, info
+		if line.Stream == "stderr" {
+			priority = 1<<3 | 3 // user, err
+		}
+		job := ""
+		if line.JobID != "" {
+			job = "job " + line.JobID + ": "
+		}
+		return fmt.Appendf(nil, "<%d>%s %sshellrunner[%d]: %s%s\n", priority, line.Time.Format(time.Stamp), host, pid, job, line.Line)
+	}
+}
+
+// dialLocalSyslog connects to the local syslog daemon.
+func dialLocalSyslog() (io.WriteCloser, error) {
+	var err error
+	for _, path := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+		for _, network := range []string{"unixgram", "unix"} {
+			var conn net.Conn
+			if conn, err = net.DialTimeout(network, path, sinkTimeout); err == nil {
+				return conn, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("cannot connect to the local syslog daemon: %v", err)
+}
+
+// hostname returns the name of this host, as syslog messages report it.
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "-"
+	}
+	return name
+}
+
+// refuseRedirect is the CheckRedirect of the HTTP clients that post jobs'
+// output and notifications, which are not to follow an allowed host to
+// others.
+func refuseRedirect(req *http.Request, via []*http.Request) error {
+	return fmt.Errorf("refusing to follow a redirect to %s", req.URL.Host)
+}
+
+// postLines posts lines to the webhook at endpoint as a JSON array.
+func postLines(client *http.Client, endpoint string, lines []sinkLine) error {
+	body, err := json.Marshal(lines)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sinkTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// sinkWriter splits a stream of a job's output into lines for its log sink.
+type sinkWriter struct {
+	sink    *logSink
+	jobID   string
+	stream  string
+	partial []byte // the start of a line not yet ended
+}
+
+func (w *sinkWriter) Write(p []byte) (int, error) {
+	rest := p
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			break
+		}
+		line := rest[:i]
+		if len(w.partial) > 0 {
+			line = append(w.partial, line...)
+			w.partial = w.partial[:0]
+		}
+		w.send(line)
+		rest = rest[i+1:]
+	}
+	w.partial = append(w.partial, rest...)
+	return len(p), nil
+}
+
+// Flush sends the last line, if it did not end with a newline.
+func (w *sinkWriter) Flush() error {
+	if len(w.partial) > 0 {
+		w.send(w.partial)
+		w.partial = nil
+	}
+	return nil
+}
+
+func (w *sinkWriter) send(line []byte) {
+	w.sink.queue(sinkLine{
+		Time:   time.Now(),
+		JobID:  w.jobID,
+		Stream: w.stream,
+		Line:   strings.TrimSuffix(string(line), "\r"),
+	})
+}
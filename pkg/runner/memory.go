@@ -0,0 +1,60 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+)
+
+// countingWriter counts the output a job captures into memory. Once a
+// stream captured to a ring is full, what it discards makes up for what is
+// written, so nothing more is counted.
+type countingWriter struct {
+	w     io.Writer
+	job   *Job
+	m     *Manager
+	limit int64 // the size of the ring, if the stream is captured to one
+	held  int64 // what has been counted, if it is
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	added := int64(n)
+	if cw.limit > 0 {
+		added = min(added, cw.limit-cw.held)
+		cw.held += added
+	}
+	cw.job.buffered.Add(added)
+	cw.m.buffered.Add(added)
+	return n, err
+}
+
+// counted returns a writer that captures a job's output into w, counting
+// it towards the output the Manager holds.
+func (m *Manager) counted(job *Job, w io.Writer) io.Writer {
+	return &countingWriter{w: w, job: job, m: m, limit: int64(captureLimit(job.Spec))}
+}
+
+// settle counts what a finished job's output takes up now that it has been
+// compressed, or nothing if the job is not kept.
+func (m *Manager) settle(job *Job, kept bool) {
+	var retained int64
+	if kept {
+		retained = int64(job.Stdout.Retained() + job.Stderr.Retained())
+	}
+	m.buffered.Add(retained - job.buffered.Swap(retained))
+}
+
+// BufferedBytes returns the total size of the output the Manager holds in
+// memory.
+func (m *Manager) BufferedBytes() int64 {
+	return m.buffered.Load()
+}
+
+// checkMemory refuses new jobs once the output held in memory has reached
+// the Manager's MaxBufferedBytes.
+func (m *Manager) checkMemory() error {
+	if limit := m.config.MaxBufferedBytes; limit > 0 && m.buffered.Load() >= limit {
+		return withKind(ErrOverloaded, fmt.Errorf("job output held in memory (%d bytes) has reached the limit of %d bytes; release jobs to free it", m.buffered.Load(), limit))
+	}
+	return nil
+}
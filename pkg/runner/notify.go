@@ -0,0 +1,254 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Notifier sends notifications of finished jobs somewhere: to a Slack
+// channel, through an incoming webhook, or by email. Exactly one of Slack
+// and SMTP is set.
+type Notifier struct {
+	Slack string // URL of a Slack incoming webhook
+	// SMTP is the host:port of the mail server emails are sent through,
+	// from From to To. The server is logged in to as Username, if set, with
+	// the password in the environment variable PasswordEnv.
+	SMTP        string
+	From        string
+	To          []string
+	Username    string
+	PasswordEnv string
+}
+
+// Notifiers holds the notifiers jobs may notify, keyed by name.
+var Notifiers = map[string]Notifier{}
+
+// LoadNotifiers reads the notifiers from a JSON file holding an object that
+// maps each name to a Notifier.
+func LoadNotifiers(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	notifiers := map[string]Notifier{}
+	if err := json.Unmarshal(data, &notifiers); err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+	for name, n := range notifiers {
+		switch {
+		case (n.Slack == "") == (n.SMTP == ""):
+			return fmt.Errorf("notifier %q needs either a Slack webhook or an SMTP server", name)
+		case n.SMTP != "" && (n.From == "" || len(n.To) == 0):
+			return fmt.Errorf("notifier %q needs From and To addresses", name)
+		}
+	}
+	Notifiers = notifiers
+	return nil
+}
+
+// When to notify, by the result of the job.
+const (
+	NotifyFailure = "failure" // the default
+	NotifySuccess = "success"
+	NotifyAlways  = "always"
+)
+
+// Notification asks for a notifier to be told that a job has finished.
+type Notification struct {
+	Notifier string // the name of one of Notifiers
+	On       string // NotifyFailure, the default, NotifySuccess or NotifyAlways
+}
+
+// notifyTail is the most lines of a job's stderr a notification includes,
+// of at most hookTail bytes.
+const notifyTail = 20
+
+// notifyTimeout bounds sending a notification.
+const notifyTimeout = 30 * time.Second
+
+// checkNotifications checks that the notifications of spec name known
+// notifiers.
+func checkNotifications(spec *JobSpec) error {
+	for _, n := range spec.Notify {
+		if _, ok := Notifiers[n.Notifier]; !ok {
+			return withKind(ErrInvalidSpec, fmt.Errorf("unknown notifier %q", n.Notifier))
+		}
+		switch n.On {
+		case "", NotifyFailure, NotifySuccess, NotifyAlways:
+		default:
+			return withKind(ErrInvalidSpec, fmt.Errorf("invalid notification condition %q: want failure, success or always", n.On))
+		}
+	}
+	return nil
+}
+
+// notify sends the notifications of a job that has finished, in the
+// background. The caller must hold the job's lock.
+func notify(job *Job) {
+	var notifiers []string
+	for _, n := range job.Spec.Notify {
+		on := n.On
+		if on == "" {
+			on = NotifyFailure
+		}
+		if (on == NotifyAlways || on == job.Result) && !slices.Contains(notifiers, n.Notifier) {
+			notifiers = append(notifiers, n.Notifier)
+		}
+	}
+	if len(notifiers) == 0 {
+		return
+	}
+	subject, body, tail := notification(job)
+	for _, name := range notifiers {
+		sendNotification(name, job.ID, subject, body, tail)
+	}
+}
+
+// sendNotification sends a notification about the job with the given ID
+// to the notifier name, in the background.
+func sendNotification(name, id, subject, body, tail string) {
+	notifier, ok := Notifiers[name]
+	if !ok {
+		// Removed since the job started.
+		return
+	}
+	go func() {
+		var err error
+		if notifier.Slack != "" {
+			err = notifySlack(notifier.Slack, subject, body, tail)
+		} else {
+			err = notifyEmail(notifier, subject, body, tail)
+		}
+		if err != nil {
+			Logger.Printf("Error notifying %s of job %s: %v", name, id, err)
+		}
+	}()
+}
+
+// notification returns the subject and body of a notification that job has
+// finished, and the tail of its stderr.
+func notification(job *Job) (subject, body, tail string) {
+	command := job.Command
+	if command == "" {
+		command = strings.Join(job.Argv, " ")
+	}
+	name := "Job"
+	if job.ID != "" {
+		name = "Job " + job.ID
+	}
+	outcome := "succeeded"
+	if job.Result != ResultSuccess {
+		outcome = "failed"
+	}
+	short := strings.Join(strings.Fields(command), " ")
+	if runes := []rune(short); len(runes) > 60 {
+		short = string(runes[:57]) + "..."
+	}
+	subject = fmt.Sprintf("%s %s: %s", name, outcome, short)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s with status %s and exit code %d after %v.\n\n", name, outcome, job.Status, job.ExitCode, job.EndTime.Sub(job.StartTime).Round(time.Millisecond))
+	fmt.Fprintf(&b, "Command: %s\n", command)
+	if job.FailureReason != "" {
+		fmt.Fprintf(&b, "Failure reason: %s\n", job.FailureReason)
+	}
+	if job.Signal != "" {
+		fmt.Fprintf(&b, "Signal: %s\n", job.Signal)
+	}
+	if len(job.Spec.Labels) > 0 {
+		labels := make([]string, 0, len(job.Spec.Labels))
+		for key, value := range job.Spec.Labels {
+			labels = append(labels, key+"="+value)
+		}
+		sort.Strings(labels)
+		fmt.Fprintf(&b, "Labels: %s\n", strings.Join(labels, ", "))
+	}
+	if submitter := job.Spec.Submitter.String(); submitter != "" {
+		fmt.Fprintf(&b, "Submitted by: %s\n", submitter)
+	}
+	fmt.Fprintf(&b, "Server: %s\n", hostname())
+	return subject, b.String(), stderrTail(job.Stderr.String())
+}
+
+// stderrTail returns the last lines of stderr, up to notifyTail of them and
+// hookTail bytes.
+func stderrTail(stderr string) string {
+	stderr = strings.TrimRight(stderr, "\n")
+	if len(stderr) > hookTail {
+		stderr = stderr[len(stderr)-hookTail:]
+		if i := strings.IndexByte(stderr, '\n'); i >= 0 {
+			stderr = stderr[i+1:]
+		}
+	}
+	lines := strings.Split(stderr, "\n")
+	return strings.Join(lines[max(0, len(lines)-notifyTail):], "\n")
+}
+
+// notifySlack posts a notification to a Slack incoming webhook.
+func notifySlack(webhook, subject, body, tail string) error {
+	text := "*" + subject + "*\n" + body
+	if tail != "" {
+		text += "Last lines of stderr:\n```\n" + tail + "\n```"
+	}
+	payload, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{CheckRedirect: refuseRedirect}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Slack responded %s", resp.Status)
+	}
+	return nil
+}
+
+// notifyEmail emails a notification through the notifier's mail server.
+func notifyEmail(n Notifier, subject, body, tail string) error {
+	if tail != "" {
+		body += "\nLast lines of stderr:\n\n" + tail + "\n"
+	}
+	var auth smtp.Auth
+	if n.Username != "" {
+		host, _, err := net.SplitHostPort(n.SMTP)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", n.Username, os.Getenv(n.PasswordEnv), host)
+	}
+	return smtp.SendMail(n.SMTP, auth, n.From, n.To, emailMessage(n, subject, body))
+}
+
+// emailMessage returns the email of a notification, with CRLF line endings.
+func emailMessage(n Notifier, subject, body string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", n.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&b, "Subject: [shellrunner] %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(b.String())
+}
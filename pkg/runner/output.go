@@ -0,0 +1,182 @@
+package runner
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// How a job's output is captured, as set by JobSpec.CaptureMode.
+const (
+	CaptureFull = "full" // all of the output is kept
+	CaptureRing = "ring" // only the last JobSpec.RingBytes of each stream are kept
+)
+
+// DefaultRingBytes is how much of each output stream a job capturing its
+// output to a ring keeps if its JobSpec.RingBytes is not set.
+const DefaultRingBytes = 1 << 20
+
+// OutputBuffer holds one of a job's output streams. It is written like a
+// bytes.Buffer while the job runs. Once the job has finished, output of at
+// least the Manager's CompressThreshold bytes is compressed, and
+// decompressed again each time it is read, which saves most of the memory
+// of verbose but repetitive logs.
+//
+// A buffer with a limit is a ring: it keeps only the last limit bytes
+// written, discarding the oldest as more comes, and counts those it has
+// discarded.
+type OutputBuffer struct {
+	buf        bytes.Buffer
+	compressed []byte // the gzipped output, if compressed
+	size       int    // the length of the output, if compressed
+	limit      int    // the most the buffer keeps, if it is a ring
+	dropped    int64  // the bytes a ring has discarded
+}
+
+// Write appends p to the output, decompressing it first if needed.
+func (b *OutputBuffer) Write(p []byte) (int, error) {
+	b.decompress()
+	n, err := b.buf.Write(p)
+	b.trim()
+	return n, err
+}
+
+// WriteString appends s to the output, decompressing it first if needed.
+func (b *OutputBuffer) WriteString(s string) (int, error) {
+	b.decompress()
+	n, err := b.buf.WriteString(s)
+	b.trim()
+	return n, err
+}
+
+// trim discards the oldest output of a ring beyond its limit.
+func (b *OutputBuffer) trim() {
+	if over := b.buf.Len() - b.limit; b.limit > 0 && over > 0 {
+		b.buf.Next(over)
+		b.dropped += int64(over)
+	}
+}
+
+// Dropped returns the number of bytes of output a ring has discarded, which
+// precede what it holds.
+func (b *OutputBuffer) Dropped() int64 {
+	return b.dropped
+}
+
+// Limit returns how much of the output a ring keeps, or 0 if the buffer is
+// not a ring.
+func (b *OutputBuffer) Limit() int {
+	return b.limit
+}
+
+// Written returns the number of bytes written to the buffer, including
+// those a ring has discarded.
+func (b *OutputBuffer) Written() int64 {
+	return b.dropped + int64(b.Len())
+}
+
+// Bytes returns the output. The slice must not be modified.
+func (b *OutputBuffer) Bytes() []byte {
+	if b.compressed == nil {
+		return b.buf.Bytes()
+	}
+	r, err := gzip.NewReader(bytes.NewReader(b.compressed))
+	var data []byte
+	if err == nil {
+		data, err = io.ReadAll(r)
+	}
+	if err != nil {
+		// Only what compress wrote is ever read back.
+		panic("runner: corrupt compressed output: " + err.Error())
+	}
+	return data
+}
+
+// String returns the output as a string.
+func (b *OutputBuffer) String() string {
+	return string(b.Bytes())
+}
+
+// Len returns the length of the output.
+func (b *OutputBuffer) Len() int {
+	if b.compressed != nil {
+		return b.size
+	}
+	return b.buf.Len()
+}
+
+// Retained returns the number of bytes the output takes up in memory,
+// compressed if it is.
+func (b *OutputBuffer) Retained() int {
+	if b.compressed != nil {
+		return len(b.compressed)
+	}
+	return b.buf.Len()
+}
+
+// Compressed reports whether the output is held compressed.
+func (b *OutputBuffer) Compressed() bool {
+	return b.compressed != nil
+}
+
+// compress compresses the output of a finished job if it is large enough,
+// and if that saves memory.
+func (b *OutputBuffer) compress(threshold int) {
+	if b.compressed != nil || threshold <= 0 || b.buf.Len() < threshold {
+		return
+	}
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	w.Write(b.buf.Bytes())
+	w.Close()
+	if compressed.Len() >= b.buf.Len() {
+		return
+	}
+	b.compressed = bytes.Clone(compressed.Bytes())
+	b.size = b.buf.Len()
+	b.buf = bytes.Buffer{}
+}
+
+// decompress restores the output to a plain buffer.
+func (b *OutputBuffer) decompress() {
+	if b.compressed == nil {
+		return
+	}
+	data := b.Bytes()
+	b.compressed, b.size = nil, 0
+	b.buf = *bytes.NewBuffer(data)
+}
+
+// captureLimit returns how much of each output stream the job started from
+// spec keeps, or 0 if it keeps all of it.
+func captureLimit(spec *JobSpec) int {
+	switch {
+	case spec.CaptureMode != CaptureRing:
+		return 0
+	case spec.RingBytes > 0:
+		return spec.RingBytes
+	}
+	return DefaultRingBytes
+}
+
+// checkCapture checks the capture mode and ring size of spec.
+func checkCapture(spec *JobSpec) error {
+	if spec.CaptureMode != "" && spec.CaptureMode != CaptureFull && spec.CaptureMode != CaptureRing {
+		return fmt.Errorf("invalid capture mode %q: must be %s or %s", spec.CaptureMode, CaptureFull, CaptureRing)
+	}
+	if spec.RingBytes < 0 {
+		return fmt.Errorf("invalid ring size %d", spec.RingBytes)
+	}
+	if spec.RingBytes > 0 && spec.CaptureMode != CaptureRing {
+		return fmt.Errorf("a ring size requires the %s capture mode", CaptureRing)
+	}
+	return nil
+}
+
+// compressOutput compresses the output of a finished job, if it is of at
+// least threshold bytes.
+func (job *Job) compressOutput(threshold int) {
+	job.Stdout.compress(threshold)
+	job.Stderr.compress(threshold)
+}
@@ -0,0 +1,107 @@
+package runner
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A pauser is an Executor that can stop its jobs and continue them later.
+type pauser interface {
+	Pause(spec *JobSpec, cmd *exec.Cmd) error
+	Resume(spec *JobSpec, cmd *exec.Cmd) error
+}
+
+// Pause stops a job's process group with SIGSTOP.
+func (localExecutor) Pause(spec *JobSpec, cmd *exec.Cmd) error {
+	return pauseProcessGroup(cmd.Process, true)
+}
+
+// Resume continues a job's process group with SIGCONT.
+func (localExecutor) Resume(spec *JobSpec, cmd *exec.Cmd) error {
+	return pauseProcessGroup(cmd.Process, false)
+}
+
+// Pause freezes the container's processes.
+func (containerExecutor) Pause(spec *JobSpec, cmd *exec.Cmd) error {
+	return runContainerCommand(spec.config.ContainerRuntime, "pause", spec.Container.Name)
+}
+
+// Resume thaws the container's processes.
+func (containerExecutor) Resume(spec *JobSpec, cmd *exec.Cmd) error {
+	return runContainerCommand(spec.config.ContainerRuntime, "unpause", spec.Container.Name)
+}
+
+// runContainerCommand runs a subcommand of the container runtime, such as
+// "pause", for the named container.
+func runContainerCommand(runtime, subcommand, name string) error {
+	out, err := exec.Command(runtime, subcommand, name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %v: %s", runtime, subcommand, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Pause stops a running job, and everything it spawned, until Resume is
+// called, so that it yields the CPU and I/O it was using without losing
+// its progress. Its status is "paused" meanwhile. The time it spends
+// paused counts towards its timeout, but not its idle timeout. Only local
+// and container jobs can be paused.
+func (m *Manager) Pause(id string) error {
+	return m.WithJob(id, func(job *Job) error {
+		if job.Status != "running" {
+			return withKind(ErrJobState, fmt.Errorf("job with id %s is not running", id))
+		}
+		p, ok := job.Executor.(pauser)
+		if !ok {
+			return withKind(ErrInvalidSpec, fmt.Errorf("the %s executor cannot pause jobs", executorName(job.Spec)))
+		}
+		if err := p.Pause(job.Spec, job.Cmd); err != nil {
+			return err
+		}
+		job.Status = "paused"
+		job.paused.Store(true)
+		Logger.Printf("Paused job %s", id)
+		return nil
+	})
+}
+
+// Resume continues a job stopped by Pause.
+func (m *Manager) Resume(id string) error {
+	return m.WithJob(id, func(job *Job) error {
+		if job.Status != "paused" {
+			return withKind(ErrJobState, fmt.Errorf("job with id %s is not paused", id))
+		}
+		if err := job.resume(); err != nil {
+			return err
+		}
+		Logger.Printf("Resumed job %s", id)
+		return nil
+	})
+}
+
+// resume continues the paused job. The job's lock must be held.
+func (job *Job) resume() error {
+	if err := job.Executor.(pauser).Resume(job.Spec, job.Cmd); err != nil {
+		return err
+	}
+	job.Status = "running"
+	job.resumed.Store(time.Now().UnixNano())
+	job.paused.Store(false)
+	return nil
+}
+
+// signal sends sig to the job for Kill, resuming it if it is paused so that
+// it can act on the signal. The job's lock must be held.
+func (job *Job) signal(sig syscall.Signal) error {
+	if err := job.Executor.Signal(job.Spec, job.Cmd, sig); err != nil {
+		return err
+	}
+	job.killRequested = true
+	if job.Status == "paused" {
+		return job.resume()
+	}
+	return nil
+}
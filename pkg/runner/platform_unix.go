@@ -0,0 +1,84 @@
+//go:build !windows
+
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// DefaultShell is the interpreter used for command strings unless another
+// is selected with SetShell.
+const DefaultShell = "bash"
+
+// setCommandLine is a no-op on Unix, where arguments are passed to the
+// interpreter verbatim.
+func setCommandLine(cmd *exec.Cmd, command string) {}
+
+// signals maps the names accepted by Kill to signals.
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"STOP": syscall.SIGSTOP,
+	"CONT": syscall.SIGCONT,
+}
+
+// fatalSignals names the signals that kill a process by default, besides
+// those in signals, for reporting what killed a job.
+var fatalSignals = map[syscall.Signal]string{
+	syscall.SIGABRT: "ABRT",
+	syscall.SIGALRM: "ALRM",
+	syscall.SIGBUS:  "BUS",
+	syscall.SIGFPE:  "FPE",
+	syscall.SIGILL:  "ILL",
+	syscall.SIGPIPE: "PIPE",
+	syscall.SIGSEGV: "SEGV",
+	syscall.SIGSYS:  "SYS",
+	syscall.SIGTRAP: "TRAP",
+	syscall.SIGXCPU: "XCPU",
+	syscall.SIGXFSZ: "XFSZ",
+}
+
+// signalName returns the name of sig in the form Kill accepts, such as
+// "TERM".
+func signalName(sig syscall.Signal) string {
+	for name, s := range signals {
+		if s == sig {
+			return name
+		}
+	}
+	if name, ok := fatalSignals[sig]; ok {
+		return name
+	}
+	return fmt.Sprintf("SIG%d", int(sig))
+}
+
+// setProcessGroup makes cmd's process the leader of a new process group, so
+// that signalProcessGroup reaches everything it spawns.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// signalProcessGroup sends sig to the process group led by process.
+func signalProcessGroup(process *os.Process, sig syscall.Signal) error {
+	return syscall.Kill(-process.Pid, sig)
+}
+
+// pauseProcessGroup stops the process group led by process, or continues it
+// if pause is false.
+func pauseProcessGroup(process *os.Process, pause bool) error {
+	if pause {
+		return syscall.Kill(-process.Pid, syscall.SIGSTOP)
+	}
+	return syscall.Kill(-process.Pid, syscall.SIGCONT)
+}
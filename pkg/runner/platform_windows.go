@@ -0,0 +1,52 @@
+//go:build windows
+
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// DefaultShell is the interpreter used for command strings unless another
+// is selected with SetShell.
+const DefaultShell = "cmd"
+
+// setCommandLine passes the command to cmd.exe unescaped. Go quotes arguments
+// using the CommandLineToArgvW rules, which cmd.exe does not follow, so the
+// command line is built by hand instead.
+func setCommandLine(cmd *exec.Cmd, command string) {
+	if shell[0] != "cmd" {
+		return
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CmdLine: strings.Join(shell, " ") + ` "` + command + `"`,
+	}
+}
+
+// signals maps the names accepted by Kill to signals. Windows can only
+// terminate processes.
+var signals = map[string]syscall.Signal{
+	"KILL": syscall.SIGKILL,
+}
+
+// setProcessGroup is a no-op on Windows, where signalProcessGroup finds a
+// job's descendants through taskkill instead.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// signalProcessGroup forcibly terminates process and its descendants.
+func signalProcessGroup(process *os.Process, sig syscall.Signal) error {
+	if sig != syscall.SIGKILL {
+		return fmt.Errorf("only KILL is supported on Windows")
+	}
+	return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(process.Pid)).Run()
+}
+
+// pauseProcessGroup is not supported on Windows, which has no signals to
+// stop and continue processes with.
+func pauseProcessGroup(process *os.Process, pause bool) error {
+	return fmt.Errorf("pausing jobs is not supported on Windows")
+}
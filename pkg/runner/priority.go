@@ -0,0 +1,38 @@
+package runner
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ioClasses maps the I/O scheduling class names accepted by IONice to the
+// class numbers used by ionice.
+var ioClasses = map[string]string{
+	"realtime":    "1",
+	"best-effort": "2",
+	"idle":        "3",
+}
+
+// parseIONice parses an I/O priority of the form "class" or "class:level",
+// where class is realtime, best-effort or idle and level ranges from 0
+// (highest) to 7 (lowest), into ionice arguments.
+func parseIONice(ionice string) ([]string, error) {
+	name, level, hasLevel := strings.Cut(ionice, ":")
+	class, ok := ioClasses[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown I/O scheduling class %q", name)
+	}
+	args := []string{"ionice", "-c", class}
+	if hasLevel {
+		if name == "idle" {
+			return nil, fmt.Errorf("the idle I/O scheduling class has no levels")
+		}
+		n, err := strconv.Atoi(level)
+		if err != nil || n < 0 || n > 7 {
+			return nil, fmt.Errorf("invalid I/O priority level %q: must be 0 to 7", level)
+		}
+		args = append(args, "-n", level)
+	}
+	return args, nil
+}
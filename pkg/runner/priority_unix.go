@@ -0,0 +1,40 @@
+//go:build !windows
+
+package runner
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+)
+
+// applyPriority arranges for cmd to run with its niceness adjusted by nice
+// and with the I/O priority ionice, set with the nice and ionice programs
+// before the command executes.
+func applyPriority(cmd *exec.Cmd, nice int, ionice string) error {
+	if cmd.Err != nil {
+		return nil
+	}
+	if ionice != "" {
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("I/O priorities are only supported on Linux")
+		}
+		args, err := parseIONice(ionice)
+		if err != nil {
+			return err
+		}
+		if err := wrapCommand(cmd, args...); err != nil {
+			return err
+		}
+	}
+	if nice != 0 {
+		if nice < -20 || nice > 19 {
+			return fmt.Errorf("invalid nice value %d: must be -20 to 19", nice)
+		}
+		if err := wrapCommand(cmd, "nice", "-n", strconv.Itoa(nice)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
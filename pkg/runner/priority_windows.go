@@ -0,0 +1,17 @@
+//go:build windows
+
+package runner
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// applyPriority fails if a priority is set, as nice and ionice do not exist
+// on Windows.
+func applyPriority(cmd *exec.Cmd, nice int, ionice string) error {
+	if nice != 0 || ionice != "" {
+		return fmt.Errorf("nice and I/O priorities are not supported on Windows")
+	}
+	return nil
+}
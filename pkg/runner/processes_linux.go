@@ -0,0 +1,55 @@
+package runner
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// clockTicks is the rate, per second, of the CPU times in /proc/<pid>/stat,
+// which is 100 on every Linux that Go runs on.
+const clockTicks = 100
+
+// groupUsage adds up the CPU time and resident memory of the processes in
+// the process group pgid, which a job's command leads along with everything
+// it spawned that stayed in its group, as /proc reports them.
+func groupUsage(pgid int) processUsage {
+	var usage processUsage
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return usage
+	}
+	pageSize := uint64(os.Getpagesize())
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// The fields after the command name, which may contain anything,
+		// start with the state; the process group is the third of them,
+		// the user and system times the twelfth and thirteenth, and the
+		// resident pages the twenty-second.
+		i := strings.LastIndexByte(string(data), ')')
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(string(data[i+1:]))
+		if len(fields) < 22 {
+			continue
+		}
+		if pgrp, _ := strconv.Atoi(fields[2]); pgrp != pgid {
+			continue
+		}
+		utime, _ := strconv.ParseUint(fields[11], 10, 64)
+		stime, _ := strconv.ParseUint(fields[12], 10, 64)
+		rss, _ := strconv.ParseUint(fields[21], 10, 64)
+		usage.CPUSeconds += float64(utime+stime) / clockTicks
+		usage.RSSBytes += rss * pageSize
+		usage.Processes++
+	}
+	return usage
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package runner
+
+// groupUsage reports nothing, as only Linux has /proc to sample processes
+// from.
+func groupUsage(pgid int) processUsage {
+	return processUsage{}
+}
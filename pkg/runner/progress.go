@@ -0,0 +1,256 @@
+package runner
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// OutputProgress counts what a job's command has written so far, before
+// any filtering or redaction, so that a job that has stopped making
+// progress can be told apart without reading its output.
+type OutputProgress struct {
+	StdoutBytes int64
+	StdoutLines int64 // newlines written to stdout
+	StderrBytes int64
+	StderrLines int64
+	LastOutput  time.Time // when the command last wrote anything; zero if never
+}
+
+// streamCounters count the bytes and newlines written to one stream.
+type streamCounters struct {
+	bytes, lines atomic.Int64
+}
+
+// progressWriter counts what a job's command writes to one of its streams.
+type progressWriter struct {
+	w        io.Writer
+	counters *streamCounters
+	last     *atomic.Int64
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	pw.counters.bytes.Add(int64(len(p)))
+	pw.counters.lines.Add(int64(bytes.Count(p, []byte{'\n'})))
+	pw.last.Store(time.Now().UnixNano())
+	return pw.w.Write(p)
+}
+
+// tracked returns writers that pass the job's output on to stdout and
+// stderr, counting it for Progress.
+func (job *Job) tracked(stdout, stderr io.Writer) (io.Writer, io.Writer) {
+	return &progressWriter{stdout, &job.stdoutCounters, &job.lastOutput},
+		&progressWriter{stderr, &job.stderrCounters, &job.lastOutput}
+}
+
+// Progress returns the counts of the output the job's command has written
+// so far. Unlike the job's other fields, it may be called without the
+// job's lock.
+func (job *Job) Progress() OutputProgress {
+	progress := OutputProgress{
+		StdoutBytes: job.stdoutCounters.bytes.Load(),
+		StdoutLines: job.stdoutCounters.lines.Load(),
+		StderrBytes: job.stderrCounters.bytes.Load(),
+		StderrLines: job.stderrCounters.lines.Load(),
+	}
+	if last := job.lastOutput.Load(); last != 0 {
+		progress.LastOutput = time.Unix(0, last)
+	}
+	return progress
+}
+
+// What happens to a job that writes nothing for its JobSpec.IdleTimeout.
+const (
+	IdleKill = "kill" // the job is killed, with a LimitExceeded of "idle_timeout"
+	IdleFlag = "flag" // the job is left running, and reported as Stalled
+)
+
+// idleSince returns when the job's command last wrote anything, or when it
+// started if it has not, or when it was last resumed if that was later.
+func (job *Job) idleSince() time.Time {
+	since := job.StartTime
+	if last := job.lastOutput.Load(); last != 0 {
+		since = time.Unix(0, last)
+	}
+	if resumed := job.resumed.Load(); resumed != 0 && time.Unix(0, resumed).After(since) {
+		since = time.Unix(0, resumed)
+	}
+	return since
+}
+
+// Stalled reports whether the job has an idle timeout and has written
+// nothing for that long, until now or until it ended. Paused jobs are not
+// stalled.
+func (job *Job) Stalled() bool {
+	if job.Spec.IdleTimeout <= 0 || job.paused.Load() {
+		return false
+	}
+	end := time.Now()
+	if job.Finished() {
+		end = job.EndTime
+	}
+	return end.Sub(job.idleSince()) >= job.Spec.IdleTimeout
+}
+
+// enforceIdleTimeout kills the job's command once it has written nothing
+// for its idle timeout, if it has one and its IdleAction is IdleKill. The
+// returned function stops watching and reports whether the job was killed.
+func enforceIdleTimeout(job *Job, executor Executor, cmd *exec.Cmd) func() bool {
+	spec := job.Spec
+	if spec.IdleTimeout <= 0 || spec.IdleAction == IdleFlag {
+		return func() bool { return false }
+	}
+	done := make(chan struct{})
+	var killed atomic.Bool
+	go func() {
+		timer := time.NewTimer(spec.IdleTimeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+			}
+			idle := time.Since(job.idleSince())
+			if job.paused.Load() {
+				idle = 0
+			}
+			if idle >= spec.IdleTimeout {
+				Logger.Printf("Killing command %q: no output for %v", spec.Command, idle.Round(time.Millisecond))
+				killed.Store(true)
+				kill, _ := parseSignal("")
+				executor.Signal(spec, cmd, kill)
+				return
+			}
+			timer.Reset(spec.IdleTimeout - idle)
+		}
+	}()
+	return func() bool {
+		close(done)
+		return killed.Load()
+	}
+}
+
+// progressMarker starts the lines a job's command writes to report its
+// progress, when its JobSpec has Progress set:
+//
+//	##progress 42 "uploading"
+//
+// The percentage is a number from 0 to 100, and the message, which may be
+// left out, is either a Go-style quoted string or the rest of the line.
+const progressMarker = "##progress"
+
+// ReportedProgress is the progress a job's command last reported with a
+// progress line.
+type ReportedProgress struct {
+	Percent float64
+	Message string
+	Time    time.Time // when the line was written
+}
+
+// ReportedProgress returns the progress the job's command last reported,
+// if it has reported any. It may be called without the job's lock.
+func (job *Job) ReportedProgress() (ReportedProgress, bool) {
+	if reported := job.reported.Load(); reported != nil {
+		return *reported, true
+	}
+	return ReportedProgress{}, false
+}
+
+// parseProgress parses a progress line, without its newline.
+func parseProgress(line string) (ReportedProgress, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimSuffix(line, "\r"), progressMarker+" ")
+	if !ok {
+		return ReportedProgress{}, false
+	}
+	percentText, message, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(percentText, "%"), 64)
+	if err != nil || percent < 0 || percent > 100 {
+		return ReportedProgress{}, false
+	}
+	message = strings.TrimSpace(message)
+	if unquoted, err := strconv.Unquote(message); err == nil {
+		message = unquoted
+	}
+	return ReportedProgress{Percent: percent, Message: message, Time: time.Now()}, true
+}
+
+// progressParser is a writer that takes the progress lines out of a job's
+// output, recording them as the job's reported progress, and passes the
+// rest on. Only lines that may turn out to be progress lines are held
+// back until they are complete; progress lines that do not parse are
+// passed on as they are.
+type progressParser struct {
+	w       io.Writer
+	job     *Job
+	pending []byte // the start of a line that may be a progress line
+	midLine bool   // whether the output is in the middle of another line
+}
+
+func (pp *progressParser) Write(p []byte) (int, error) {
+	n := len(p)
+	var out []byte
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		chunk := p
+		if i >= 0 {
+			chunk = p[:i+1]
+		}
+		p = p[len(chunk):]
+		if pp.midLine {
+			out = append(out, chunk...)
+			pp.midLine = i < 0
+			continue
+		}
+		candidate := append(pp.pending, chunk...)
+		pp.pending = nil
+		switch {
+		case !maybeProgress(candidate) || len(candidate) >= maxFilterLine:
+			out = append(out, candidate...)
+			pp.midLine = i < 0
+		case i < 0:
+			pp.pending = candidate
+		case !pp.report(candidate[:len(candidate)-1]):
+			out = append(out, candidate...)
+		}
+	}
+	if len(out) > 0 {
+		if _, err := pp.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// maybeProgress reports whether line, which may be incomplete, may be a
+// progress line.
+func maybeProgress(line []byte) bool {
+	if len(line) <= len(progressMarker) {
+		return strings.HasPrefix(progressMarker, string(line))
+	}
+	return strings.HasPrefix(string(line), progressMarker+" ")
+}
+
+// report records line as the job's progress if it is a progress line.
+func (pp *progressParser) report(line []byte) bool {
+	progress, ok := parseProgress(string(line))
+	if ok {
+		pp.job.reported.Store(&progress)
+	}
+	return ok
+}
+
+// Flush handles the last line, once the job has exited.
+func (pp *progressParser) Flush() error {
+	line := pp.pending
+	pp.pending = nil
+	if len(line) == 0 || pp.report(line) {
+		return nil
+	}
+	_, err := pp.w.Write(line)
+	return err
+}
@@ -0,0 +1,88 @@
+package runner
+
+import (
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/creack/pty"
+)
+
+// Default terminal size used when a job asks for a pseudo-terminal without
+// specifying one.
+const (
+	defaultRows = 24
+	defaultCols = 80
+)
+
+// TerminalOptions controls whether a job runs under a pseudo-terminal.
+type TerminalOptions struct {
+	Pty  bool
+	Rows uint16
+	Cols uint16
+}
+
+// winsize returns the requested terminal size, filling in defaults.
+func (o TerminalOptions) winsize() *pty.Winsize {
+	size := &pty.Winsize{Rows: o.Rows, Cols: o.Cols}
+	if size.Rows == 0 {
+		size.Rows = defaultRows
+	}
+	if size.Cols == 0 {
+		size.Cols = defaultCols
+	}
+	return size
+}
+
+// startCommand starts cmd with its output captured into stdout and stderr.
+// When opts.Pty is set the command is attached to a pseudo-terminal instead,
+// all of its output is captured into stdout, and the terminal's master end is
+// returned so that it can be resized. The returned function waits for the
+// command to exit and for its output to be fully captured; the caller is
+// responsible for closing the terminal afterwards. Either way the command
+// leads its own process group, so that it can be signalled as a whole.
+func startCommand(cmd *exec.Cmd, opts TerminalOptions, stdout, stderr io.Writer) (*os.File, func() error, error) {
+	reaper.mutex.Lock()
+	defer reaper.mutex.Unlock()
+	tty, wait, err := spawn(cmd, opts, stdout, stderr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tty, trackJob(cmd.Process.Pid, wait), nil
+}
+
+// spawn starts cmd for startCommand.
+func spawn(cmd *exec.Cmd, opts TerminalOptions, stdout, stderr io.Writer) (*os.File, func() error, error) {
+	if !opts.Pty {
+		setProcessGroup(cmd)
+		cmd.Stdout = pooled(stdout)
+		cmd.Stderr = pooled(stderr)
+		return nil, cmd.Wait, cmd.Start()
+	}
+
+	// The command's input, if any, is typed into the terminal, which
+	// must be its standard input.
+	input := cmd.Stdin
+	cmd.Stdin = nil
+	// The terminal's session gives the command a process group of its own.
+	tty, err := pty.StartWithSize(cmd, opts.winsize())
+	if err != nil {
+		return nil, nil, err
+	}
+	if input != nil {
+		go io.Copy(tty, input)
+	}
+	drained := make(chan struct{})
+	go func() {
+		// Reading the master end fails with EIO once the command and
+		// everything it spawned have closed the terminal.
+		copyOutput(stdout, tty)
+		close(drained)
+	}()
+	wait := func() error {
+		err := cmd.Wait()
+		<-drained
+		return err
+	}
+	return tty, wait, nil
+}
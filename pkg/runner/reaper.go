@@ -0,0 +1,56 @@
+package runner
+
+import "sync"
+
+// reaper keeps track of the job processes the Manager waits for itself, so
+// that reaping the processes jobs leave behind never takes their exit
+// status from it.
+var reaper struct {
+	mutex   sync.Mutex
+	enabled bool         // set by EnableSubreaper
+	jobs    map[int]bool // the pids of job processes not yet waited for
+	reaped  int64        // strays reaped so far
+}
+
+// ReaperStats describes the stray processes adopted by this process since
+// EnableSubreaper: those that jobs spawned and left behind when they
+// exited.
+type ReaperStats struct {
+	Enabled bool
+	Reaped  int64 // strays reaped once they exited
+	Running int   // strays still running
+}
+
+// SubreaperStats returns the number of stray processes reaped so far and
+// the number still running.
+func SubreaperStats() ReaperStats {
+	reaper.mutex.Lock()
+	defer reaper.mutex.Unlock()
+	stats := ReaperStats{Enabled: reaper.enabled, Reaped: reaper.reaped}
+	if reaper.enabled {
+		for _, exited := range strays() {
+			if !exited {
+				stats.Running++
+			}
+		}
+	}
+	return stats
+}
+
+// trackJob records the pid of a job process that has just been started,
+// until its wait function returns. It must be called with reaper.mutex
+// held since before the process was started, so that it cannot be taken
+// for a stray in between.
+func trackJob(pid int, wait func() error) func() error {
+	if reaper.jobs == nil {
+		reaper.jobs = make(map[int]bool)
+	}
+	reaper.jobs[pid] = true
+	return func() error {
+		err := wait()
+		reaper.mutex.Lock()
+		delete(reaper.jobs, pid)
+		reaper.mutex.Unlock()
+		return err
+	}
+}
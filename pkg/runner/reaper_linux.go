@@ -0,0 +1,95 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// prSetChildSubreaper is the prctl option that makes a process the
+// subreaper of its descendants.
+const prSetChildSubreaper = 36
+
+// EnableSubreaper makes this process the subreaper of everything its jobs
+// spawn. Processes a job leaves behind, such as daemons that fork twice to
+// detach, are then re-parented to this process instead of to init, and are
+// reaped as soon as they exit rather than lingering as zombies.
+func EnableSubreaper() error {
+	reaper.mutex.Lock()
+	defer reaper.mutex.Unlock()
+	if reaper.enabled {
+		return nil
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetChildSubreaper, 1, 0); errno != 0 {
+		return fmt.Errorf("cannot become a subreaper: %v", errno)
+	}
+	reaper.enabled = true
+
+	exited := make(chan os.Signal, 1)
+	signal.Notify(exited, syscall.SIGCHLD)
+	go func() {
+		for range exited {
+			reapStrays()
+		}
+	}()
+	return nil
+}
+
+// reapStrays reaps the strays that have exited.
+func reapStrays() {
+	reaper.mutex.Lock()
+	defer reaper.mutex.Unlock()
+	for pid, exited := range strays() {
+		if !exited {
+			continue
+		}
+		var status syscall.WaitStatus
+		if wpid, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); err == nil && wpid == pid {
+			reaper.reaped++
+			Logger.Printf("Reaped stray process %d", pid)
+		}
+	}
+}
+
+// strays returns the children of this process that are neither job
+// processes the Manager waits for nor in this process's own process group,
+// where the commands the runner runs for itself stay, and whether each has
+// exited. It must be called with reaper.mutex held.
+func strays() map[int]bool {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	self, group := os.Getpid(), syscall.Getpgrp()
+	res := make(map[int]bool)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || reaper.jobs[pid] {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// The fields after the command name, which may contain anything,
+		// start with the state, the parent and the process group.
+		i := strings.LastIndexByte(string(data), ')')
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(string(data[i+1:]))
+		if len(fields) < 3 {
+			continue
+		}
+		ppid, _ := strconv.Atoi(fields[1])
+		pgrp, _ := strconv.Atoi(fields[2])
+		if ppid == self && pgrp != group {
+			res[pid] = fields[0] == "Z"
+		}
+	}
+	return res
+}
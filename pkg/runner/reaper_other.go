@@ -0,0 +1,15 @@
+//go:build !linux
+
+package runner
+
+import "fmt"
+
+// EnableSubreaper fails, as only Linux has subreapers.
+func EnableSubreaper() error {
+	return fmt.Errorf("subreapers are only supported on Linux")
+}
+
+// strays finds no strays, as they are never adopted outside Linux.
+func strays() map[int]bool {
+	return nil
+}
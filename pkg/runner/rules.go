@@ -0,0 +1,241 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"go.starlark.net/starlark"
+	"gopkg.in/yaml.v3"
+)
+
+// Rule is an operator's rule for the jobs it matches: it denies them, or
+// rewrites their command, tags them with labels, sets variables in their
+// environment, filters their output, or has notifiers told of them. Rules
+// are read from YAML files, each holding a list of them, and rules that
+// need more are Starlark scripts defining apply(job), in .star files:
+//
+//	# 10-jobs.yaml
+//	- name: no-rm-root
+//	  match:
+//	    command: 'rm\s+-rf\s+/(\s|$)'
+//	  deny: refusing to remove /
+//	- name: nice-builds
+//	  match:
+//	    command: '^make\b'
+//	  rewrite: 'nice $0'
+//	  labels:
+//	    kind: build
+type Rule struct {
+	Name  string    `yaml:"name"`
+	Match RuleMatch `yaml:"match"`
+	// Deny refuses the job, with this message as the reason.
+	Deny string `yaml:"deny"`
+	// Rewrite replaces what Match.Command matched in the job's command,
+	// with $1 and the like expanded to what its groups captured. It does
+	// not apply to argv jobs.
+	Rewrite string            `yaml:"rewrite"`
+	Labels  map[string]string `yaml:"labels"` // labels added to the job
+	Env     map[string]string `yaml:"env"`    // variables added to the job's environment
+	// Filter filters the output of jobs without a filter of their own. For
+	// jobs with one, only its StripANSI and Exclude are added to theirs.
+	// It does not apply to jobs with a terminal.
+	Filter *OutputFilter `yaml:"filter"`
+	// Notify adds notifications to the job's own.
+	Notify []Notification `yaml:"notify"`
+}
+
+// RuleMatch selects the jobs a Rule applies to: those meeting all of its
+// conditions. An empty RuleMatch matches every job.
+type RuleMatch struct {
+	// Command is a regular expression the job's command, or its argv
+	// joined by spaces, must match.
+	Command  string            `yaml:"command"`
+	Executor string            `yaml:"executor"` // the executor the job must run with
+	Labels   map[string]string `yaml:"labels"`   // labels the job must have
+}
+
+// compiledRule is a Rule with its regular expression compiled, or the
+// apply function of a script.
+type compiledRule struct {
+	Rule
+	command *regexp.Regexp
+	script  *starlark.Function
+}
+
+// Rules are the rules read from the YAML files and Starlark scripts of a
+// directory, applied in the order of the files' names and of the rules
+// within each file. They can be read again while in use with Reload.
+type Rules struct {
+	dir   string
+	rules atomic.Pointer[[]compiledRule]
+}
+
+// LoadRules reads the rules in the .yaml, .yml and .star files of dir.
+func LoadRules(dir string) (*Rules, error) {
+	r := &Rules{dir: dir}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the rules again. If they are invalid, the rules in use are
+// kept.
+func (r *Rules) Reload() error {
+	if _, err := os.Stat(r.dir); err != nil {
+		return err
+	}
+	var files []string
+	for _, pattern := range []string{"*.yaml", "*.yml", "*.star"} {
+		matches, err := filepath.Glob(filepath.Join(r.dir, pattern))
+		if err != nil {
+			return err
+		}
+		files = append(files, matches...)
+	}
+	slices.Sort(files)
+
+	var rules []compiledRule
+	for _, file := range files {
+		if filepath.Ext(file) == ".star" {
+			rule, err := readScript(file)
+			if err != nil {
+				return err
+			}
+			rules = append(rules, rule)
+			continue
+		}
+		fileRules, err := readRules(file)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, fileRules...)
+	}
+	r.rules.Store(&rules)
+	Logger.Printf("Loaded %d rules from %s", len(rules), r.dir)
+	return nil
+}
+
+// Len returns the number of rules in use.
+func (r *Rules) Len() int {
+	return len(*r.rules.Load())
+}
+
+// readRules reads and compiles the rules in file.
+func readRules(file string) ([]compiledRule, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules []Rule
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&rules); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid rules file %s: %w", file, err)
+	}
+
+	compiled := make([]compiledRule, len(rules))
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("%s#%d", filepath.Base(file), i+1)
+		}
+		compiled[i].Rule = rule
+		if rule.Match.Command != "" {
+			if compiled[i].command, err = regexp.Compile(rule.Match.Command); err != nil {
+				return nil, fmt.Errorf("invalid command pattern in rule %s: %v", rule.Name, err)
+			}
+		} else if rule.Rewrite != "" {
+			return nil, fmt.Errorf("rule %s rewrites commands without matching one", rule.Name)
+		}
+		if rule.Filter != nil {
+			if _, err := rule.Filter.compile(); err != nil {
+				return nil, fmt.Errorf("invalid filter in rule %s: %v", rule.Name, err)
+			}
+		}
+		if err := checkNotifications(&JobSpec{Notify: rule.Notify}); err != nil {
+			return nil, fmt.Errorf("invalid notification in rule %s: %v", rule.Name, err)
+		}
+	}
+	return compiled, nil
+}
+
+// Apply applies the rules to the spec of a job about to start, as a
+// Manager's BeforeStart hook. The first rule to deny the job stops it.
+func (r *Rules) Apply(spec *JobSpec) error {
+	for _, rule := range *r.rules.Load() {
+		if rule.script != nil {
+			if err := rule.applyScript(spec); err != nil {
+				return err
+			}
+			continue
+		}
+		if !rule.matches(spec) {
+			continue
+		}
+		if rule.Deny != "" {
+			return withKind(ErrPolicyDenied, fmt.Errorf("denied by rule %s: %s", rule.Name, rule.Deny))
+		}
+		if rule.Rewrite != "" && spec.Command != "" {
+			spec.Command = rule.command.ReplaceAllString(spec.Command, rule.Rewrite)
+		}
+		if len(rule.Labels) > 0 {
+			spec.Labels = maps.Clone(spec.Labels)
+			if spec.Labels == nil {
+				spec.Labels = make(map[string]string)
+			}
+			maps.Copy(spec.Labels, rule.Labels)
+		}
+		if len(rule.Env) > 0 {
+			spec.Env = maps.Clone(spec.Env)
+			if spec.Env == nil {
+				spec.Env = make(map[string]string)
+			}
+			maps.Copy(spec.Env, rule.Env)
+		}
+		if len(rule.Notify) > 0 {
+			spec.Notify = append(slices.Clip(spec.Notify), rule.Notify...)
+		}
+		if rule.Filter != nil && !spec.Pty {
+			if spec.Filter == nil {
+				filter := *rule.Filter
+				spec.Filter = &filter
+			} else {
+				filter := *spec.Filter
+				filter.StripANSI = filter.StripANSI || rule.Filter.StripANSI
+				filter.Exclude = append(slices.Clip(filter.Exclude), rule.Filter.Exclude...)
+				spec.Filter = &filter
+			}
+		}
+	}
+	return nil
+}
+
+// matches reports whether the rule applies to the job started from spec.
+func (rule *compiledRule) matches(spec *JobSpec) bool {
+	if rule.command != nil {
+		command := spec.Command
+		if command == "" {
+			command = strings.Join(spec.Argv, " ")
+		}
+		if !rule.command.MatchString(command) {
+			return false
+		}
+	}
+	if rule.Match.Executor != "" && rule.Match.Executor != executorName(spec) {
+		return false
+	}
+	for key, value := range rule.Match.Labels {
+		if spec.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,274 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// Rules that YAML cannot express are written as Starlark scripts, .star
+// files among the YAML ones, applied in the same order. Each script defines
+// a function apply(job), called with each job about to start as a dict:
+//
+//	command   the command string, or "" for an argv job
+//	argv      the argv, a list of strings
+//	executor  the executor the job runs with; changing it has no effect
+//	labels    the labels, a dict of strings
+//	env       the variables added to the environment, a dict of strings
+//	notify    the notifications, a list of "notifier" or "notifier:when"
+//	filter    the output filter, a dict of include, exclude, extract and
+//	          stripansi, or None
+//
+// apply changes the job by changing the dict, and refuses it by calling
+// deny(reason):
+//
+//	# 30-policy.star
+//	def apply(job):
+//	    if job["executor"] == "local" and "curl " in job["command"]:
+//	        deny("jobs may not fetch from the network")
+//	    if job["command"].startswith("make "):
+//	        job["command"] = "nice " + job["command"]
+//	        job["labels"]["kind"] = "build"
+//
+// Scripts cannot load other files, and what they print is logged. A script
+// that fails, or takes more than scriptSteps steps, denies the job.
+
+// scriptSteps is how many steps of Starlark a script may take to load, or to
+// apply to a job.
+const scriptSteps = 1_000_000
+
+// scriptBuiltins are the functions scripts have besides Starlark's own.
+var scriptBuiltins = starlark.StringDict{
+	"deny": starlark.NewBuiltin("deny", scriptDeny),
+}
+
+// scriptDenial is the error deny fails apply with.
+type scriptDenial struct {
+	reason string
+}
+
+func (d *scriptDenial) Error() string {
+	return "denied: " + d.reason
+}
+
+// scriptDeny is deny(reason), which refuses the job.
+func scriptDeny(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var reason string
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &reason); err != nil {
+		return nil, err
+	}
+	return nil, &scriptDenial{reason: reason}
+}
+
+// newScriptThread returns a thread to run the script of the rule name in.
+func newScriptThread(name string) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: name,
+		Print: func(thread *starlark.Thread, msg string) {
+			Logger.Printf("Rule %s: %s", thread.Name, msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(scriptSteps)
+	return thread
+}
+
+// readScript reads the Starlark script in file as a rule named after it.
+func readScript(file string) (compiledRule, error) {
+	name := filepath.Base(file)
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, newScriptThread(name), file, nil, scriptBuiltins)
+	if err != nil {
+		return compiledRule{}, fmt.Errorf("invalid rules script %s: %w", file, err)
+	}
+	apply, ok := globals["apply"].(*starlark.Function)
+	if !ok || apply.NumParams() != 1 {
+		return compiledRule{}, fmt.Errorf("rules script %s does not define apply(job)", file)
+	}
+	return compiledRule{Rule: Rule{Name: name}, script: apply}, nil
+}
+
+// applyScript calls the rule's script with the job started from spec, and
+// changes spec as the script changed the job.
+func (rule *compiledRule) applyScript(spec *JobSpec) error {
+	job := scriptJob(spec)
+	if _, err := starlark.Call(newScriptThread(rule.Name), rule.script, starlark.Tuple{job}, nil); err != nil {
+		var denial *scriptDenial
+		if errors.As(err, &denial) {
+			return withKind(ErrPolicyDenied, fmt.Errorf("denied by rule %s: %s", rule.Name, denial.reason))
+		}
+		return withKind(ErrPolicyDenied, fmt.Errorf("rule %s failed: %v", rule.Name, err))
+	}
+	if err := updateFromScript(spec, job); err != nil {
+		return withKind(ErrPolicyDenied, fmt.Errorf("rule %s failed: %v", rule.Name, err))
+	}
+	return nil
+}
+
+// scriptJob returns the dict a script is called with for the job started
+// from spec.
+func scriptJob(spec *JobSpec) *starlark.Dict {
+	notify := make([]string, len(spec.Notify))
+	for i, n := range spec.Notify {
+		notify[i] = n.Notifier
+		if n.On != "" {
+			notify[i] += ":" + n.On
+		}
+	}
+	var filter starlark.Value = starlark.None
+	if spec.Filter != nil {
+		filter = scriptDict(map[string]starlark.Value{
+			"include":   scriptList(spec.Filter.Include),
+			"exclude":   scriptList(spec.Filter.Exclude),
+			"extract":   starlark.String(spec.Filter.Extract),
+			"stripansi": starlark.Bool(spec.Filter.StripANSI),
+		})
+	}
+	return scriptDict(map[string]starlark.Value{
+		"command":  starlark.String(spec.Command),
+		"argv":     scriptList(spec.Argv),
+		"executor": starlark.String(executorName(spec)),
+		"labels":   scriptStrings(spec.Labels),
+		"env":      scriptStrings(spec.Env),
+		"notify":   scriptList(notify),
+		"filter":   filter,
+	})
+}
+
+// updateFromScript changes spec as a script changed job, the dict it was
+// called with.
+func updateFromScript(spec *JobSpec, job *starlark.Dict) error {
+	var err error
+	if spec.Command, err = fromScriptString(job, "command"); err != nil {
+		return err
+	}
+	if spec.Argv, err = fromScriptList(job, "argv"); err != nil {
+		return err
+	}
+	if spec.Labels, err = fromScriptStrings(job, "labels"); err != nil {
+		return err
+	}
+	if spec.Env, err = fromScriptStrings(job, "env"); err != nil {
+		return err
+	}
+	notify, err := fromScriptList(job, "notify")
+	if err != nil {
+		return err
+	}
+	spec.Notify = nil
+	for _, n := range notify {
+		name, on, _ := strings.Cut(n, ":")
+		spec.Notify = append(spec.Notify, Notification{Notifier: name, On: on})
+	}
+	spec.Filter = nil
+	if value, _, _ := job.Get(starlark.String("filter")); value != starlark.None {
+		filter, ok := value.(*starlark.Dict)
+		if !ok {
+			return fmt.Errorf("filter must be a dict or None, got %s", value.Type())
+		}
+		spec.Filter = &OutputFilter{}
+		if spec.Filter.Include, err = fromScriptList(filter, "include"); err != nil {
+			return err
+		}
+		if spec.Filter.Exclude, err = fromScriptList(filter, "exclude"); err != nil {
+			return err
+		}
+		if spec.Filter.Extract, err = fromScriptString(filter, "extract"); err != nil {
+			return err
+		}
+		value, _, _ := filter.Get(starlark.String("stripansi"))
+		spec.Filter.StripANSI = bool(value.Truth())
+	}
+	return nil
+}
+
+// scriptDict returns a dict holding values.
+func scriptDict(values map[string]starlark.Value) *starlark.Dict {
+	dict := starlark.NewDict(len(values))
+	for key, value := range values {
+		dict.SetKey(starlark.String(key), value)
+	}
+	return dict
+}
+
+// scriptList returns a list of strings.
+func scriptList(values []string) *starlark.List {
+	elems := make([]starlark.Value, len(values))
+	for i, value := range values {
+		elems[i] = starlark.String(value)
+	}
+	return starlark.NewList(elems)
+}
+
+// scriptStrings returns a dict of strings.
+func scriptStrings(values map[string]string) *starlark.Dict {
+	dict := starlark.NewDict(len(values))
+	for _, key := range sortedKeys(values) {
+		dict.SetKey(starlark.String(key), starlark.String(values[key]))
+	}
+	return dict
+}
+
+// fromScriptString returns the string under key in dict, or "" if there is
+// none.
+func fromScriptString(dict *starlark.Dict, key string) (string, error) {
+	value, found, _ := dict.Get(starlark.String(key))
+	if !found {
+		return "", nil
+	}
+	s, ok := starlark.AsString(value)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string, got %s", key, value.Type())
+	}
+	return s, nil
+}
+
+// fromScriptList returns the list of strings under key in dict, or nil if
+// it is empty or there is none.
+func fromScriptList(dict *starlark.Dict, key string) ([]string, error) {
+	value, found, _ := dict.Get(starlark.String(key))
+	if !found {
+		return nil, nil
+	}
+	list, ok := value.(*starlark.List)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a list, got %s", key, value.Type())
+	}
+	var values []string
+	for i := range list.Len() {
+		s, ok := starlark.AsString(list.Index(i))
+		if !ok {
+			return nil, fmt.Errorf("%s must hold strings, got %s", key, list.Index(i).Type())
+		}
+		values = append(values, s)
+	}
+	return values, nil
+}
+
+// fromScriptStrings returns the dict of strings under key in dict, or nil
+// if it is empty or there is none.
+func fromScriptStrings(dict *starlark.Dict, key string) (map[string]string, error) {
+	value, found, _ := dict.Get(starlark.String(key))
+	if !found {
+		return nil, nil
+	}
+	strs, ok := value.(*starlark.Dict)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a dict, got %s", key, value.Type())
+	}
+	var values map[string]string
+	for _, item := range strs.Items() {
+		k, ok := starlark.AsString(item[0])
+		v, ok2 := starlark.AsString(item[1])
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("%s must map strings to strings, got %s: %s", key, item[0].Type(), item[1].Type())
+		}
+		if values == nil {
+			values = make(map[string]string)
+		}
+		values[k] = v
+	}
+	return values, nil
+}
@@ -0,0 +1,974 @@
+// Package runner runs and tracks shell commands as jobs. It is the job
+// manager behind the shellrunner server, and can be embedded directly by Go
+// programs that want to run jobs without going through the server's socket.
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+// Logger receives the runner's log messages. It discards them by default.
+var Logger = log.New(io.Discard, "", 0)
+
+// Job is a command run by a Manager. Its fields are updated by the Manager
+// while the job runs, so they must only be accessed from within WithJob or
+// WithGroup, which hold the job's own lock.
+type Job struct {
+	ID            string // empty for jobs run by Run without keep
+	Command       string
+	Argv          []string
+	Cmd           *exec.Cmd
+	Tty           *os.File // master end of the job's terminal while it runs
+	Stdout        OutputBuffer
+	Stderr        OutputBuffer
+	SubmitTime    time.Time // when the job was submitted, before it was set up
+	StartTime     time.Time
+	EndTime       time.Time
+	Status        string // "running", "paused", "exited", "errored", "failed_to_start"
+	ExitCode      int
+	StartError    string // why the command could not be started, if it could not
+	StdoutOffset  int
+	StderrOffset  int
+	Spec          *JobSpec
+	Executor      Executor
+	Group         string      // the group of a job started for one of several hosts
+	LimitExceeded string      // the limit that killed the job, if any
+	RerunOf       string      // the job this one was started by Rerun from, if any
+	ImportedFrom  string      // the ID the job had where it was exported, if imported
+	Workspace     string      // the job's workspace directory, if it has one
+	Artifacts     []Artifact  // copies of the files matching Spec.Artifacts, once exited
+	Result        string      // ResultSuccess or ResultFailure, once finished
+	FailureReason string      // why the job failed, if it did
+	Signal        string      // the name of the signal that killed the job, such as "TERM"
+	CoreDumped    bool        // whether the signal that killed the job dumped core
+	KilledBy      string      // what killed the job, if known: one of the KilledBy constants
+	CgroupUsage   CgroupUsage // final usage, recorded when the job ends
+	// Annotations are the notes Annotate added to the job.
+	Annotations map[string]string
+	// Trace is the job's span in a distributed trace, if it has one; see
+	// JobSpec.TraceParent and TraceJobs.
+	Trace TraceContext
+	// Shell is the interpreter that ran the job's command string, such as
+	// "bash", and empty for jobs run from argv.
+	Shell string
+
+	mu            sync.Mutex   // the job's lock, guarding its fields
+	released      bool         // set once the job has been released
+	session       *session     // set for interactive jobs started by StartSession
+	shell         *shellWorker // set while a shell worker runs the job's command
+	cgroup        *cgroup
+	artifactDir   string       // holds the copies of the job's artifacts
+	stdin         *stdinPipe   // set for jobs started with StdinOpen
+	attachments   *attachments // the clients attached with AttachJob
+	synchronous   bool         // whether the job was started by Run
+	killRequested bool         // whether a signal has been sent to the job with Kill
+	buffered      atomic.Int64 // the job's output counted in Manager.buffered
+
+	// stdoutCounters, stderrCounters and lastOutput count the output the
+	// command writes, for Progress.
+	stdoutCounters, stderrCounters streamCounters
+	lastOutput                     atomic.Int64 // in Unix nanoseconds
+	// reported is the progress last reported by the command; see
+	// ReportedProgress.
+	reported atomic.Pointer[ReportedProgress]
+	// paused is set while the job is stopped by Pause, and resumed is when
+	// Resume last continued it, in Unix nanoseconds, so that the time it
+	// spends paused does not count as idle.
+	paused  atomic.Bool
+	resumed atomic.Int64
+	// deadline is when the job's timeout kills it, in Unix nanoseconds, or
+	// 0 if it has none, and timedOut is set once it has.
+	deadline atomic.Int64
+	timedOut atomic.Bool
+	// overrunTimer raises an alert once the job has run for longer than
+	// its expected MaxDuration, and overran is set once it has.
+	overrunTimer *time.Timer
+	overran      atomic.Bool
+}
+
+// Finished reports whether the job has exited, errored or failed to start.
+func (job *Job) Finished() bool {
+	return job.Status == "exited" || job.Status == "errored" || job.Status == "failed_to_start"
+}
+
+// CgroupPath returns the path of the cgroup the job runs in, or "" if it is
+// not run in a cgroup.
+func (job *Job) CgroupPath() string {
+	if job.cgroup == nil {
+		return ""
+	}
+	return job.cgroup.path
+}
+
+// Usage returns the resource usage of the job's cgroup: read live while the
+// job runs, and as recorded when it exited after.
+func (job *Job) Usage() CgroupUsage {
+	if job.cgroup != nil && !job.Finished() {
+		return job.cgroup.usage()
+	}
+	return job.CgroupUsage
+}
+
+// ExecutionStatistics holds statistics about command executions.
+type ExecutionStatistics struct {
+	TotalCount       int64
+	TotalDuration    time.Duration
+	MaxDuration      time.Duration
+	TotalStdoutBytes int64
+	TotalStderrBytes int64
+	SuccessCount     int64 // jobs whose result was ResultSuccess
+	FailureCount     int64 // jobs whose result was ResultFailure
+	BufferedBytes    int64 // output held in memory now; see Config.MaxBufferedBytes
+	BusyWorkers      int   // jobs running now; see Workers
+}
+
+// JobListEntry represents a single entry in the list of jobs.
+type JobListEntry struct {
+	ID          string
+	Status      string
+	Submitter   string            // the job's Submitter, as a string
+	Annotations map[string]string // the notes Annotate added to the job, if any
+}
+
+// Manager runs jobs and keeps track of them by ID until they are released.
+type Manager struct {
+	// jobs stores all background jobs, keyed by their unique ID.
+	jobs *jobTable
+	// ids makes up the IDs of new jobs.
+	ids atomic.Pointer[idScheme]
+	// mutex protects the groups, the history and the group counter. No
+	// other lock is taken while it is held.
+	mutex sync.Mutex
+	// groups maps group IDs to the IDs of the jobs in each group.
+	groups map[string][]string
+	// groupCounter is used to generate sequential group IDs.
+	groupCounter uint64
+	// secrets are the secrets jobs can have set in their environment.
+	secrets Secrets
+	// history remembers released jobs by ID, for Rerun, and historyOrder
+	// their IDs from the oldest release on.
+	history      map[string]archivedJob
+	historyOrder []string
+
+	// stats holds the execution statistics.
+	stats      ExecutionStatistics
+	statsMutex sync.Mutex
+	// buffered is the total size of the output jobs hold in memory.
+	buffered atomic.Int64
+	// workers run the jobs, and shells the commands that can run on a
+	// shell worker.
+	workers *workerPool
+	shells  *shellPool
+	// startHooks and finishHooks are called before each job is prepared
+	// and once it has finished; see BeforeStart and OnFinish.
+	startHooks  []func(spec *JobSpec) error
+	finishHooks []func(job *Job)
+	hooksMutex  sync.Mutex
+	// deadman tracks the checks jobs check in to and the alerts raised
+	// about jobs; see Expectation.
+	deadman deadman
+	// trends holds the recent runs of each series of jobs, by name; see
+	// Trend.
+	trendsMutex sync.Mutex
+	trends      map[string]*series
+	// config holds the Manager's settings, which never change.
+	config Config
+}
+
+// NewManager returns a Manager without any jobs, with the given settings.
+func NewManager(config Config) *Manager {
+	m := &Manager{
+		config:  config,
+		jobs:    newJobTable(),
+		workers: newWorkerPool(config.Workers, config.WorkerWait),
+		shells:  newShellPool(config.ShellWorkers),
+		groups:  make(map[string][]string),
+		history: make(map[string]archivedJob),
+		trends:  make(map[string]*series),
+	}
+	m.ids.Store(&idScheme{})
+	m.deadman.checks = make(map[string]*check)
+	return m
+}
+
+func (m *Manager) updateStats(duration time.Duration, stdoutBytes, stderrBytes int) {
+	m.statsMutex.Lock()
+	defer m.statsMutex.Unlock()
+
+	m.stats.TotalCount++
+	m.stats.TotalDuration += duration
+	if duration > m.stats.MaxDuration {
+		m.stats.MaxDuration = duration
+	}
+	m.stats.TotalStdoutBytes += int64(stdoutBytes)
+	m.stats.TotalStderrBytes += int64(stderrBytes)
+}
+
+// countResult counts the result of a job that has finished.
+func (m *Manager) countResult(result string) {
+	m.statsMutex.Lock()
+	defer m.statsMutex.Unlock()
+	if result == ResultSuccess {
+		m.stats.SuccessCount++
+	} else {
+		m.stats.FailureCount++
+	}
+}
+
+// Stats returns statistics about the commands executed so far.
+func (m *Manager) Stats() ExecutionStatistics {
+	m.statsMutex.Lock()
+	defer m.statsMutex.Unlock()
+	stats := m.stats
+	stats.BufferedBytes = m.buffered.Load()
+	stats.BusyWorkers = m.workers.count()
+	return stats
+}
+
+// finish records the outcome of a job's command.
+func finish(job *Job, err error) {
+	if job.StartError != "" {
+		job.Status = "failed_to_start"
+		job.ExitCode = -1
+		return
+	}
+	job.LimitExceeded = limitExceeded(job.Cmd.ProcessState, job.Spec.Limits)
+	if err != nil {
+		// Commands run by a shell worker exit with a shellExit.
+		if exitError, ok := err.(interface{ ExitCode() int }); ok {
+			job.ExitCode = exitError.ExitCode()
+			job.Status = "exited"
+		} else {
+			job.Status = "errored"
+			job.ExitCode = -1
+		}
+	} else {
+		job.Status = "exited"
+		job.ExitCode = 0
+	}
+}
+
+// Secrets returns the secrets jobs can have set in their environment.
+func (m *Manager) Secrets() *Secrets {
+	return &m.secrets
+}
+
+// injectSecrets sets the environment variables of cmd that spec takes from
+// secrets. Their values only ever appear in the command's environment.
+func (m *Manager) injectSecrets(spec *JobSpec, cmd *exec.Cmd) error {
+	if len(spec.Secrets) == 0 {
+		return nil
+	}
+	env, err := m.secrets.environ(spec.Secrets)
+	if err != nil {
+		return err
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, env...)
+	return nil
+}
+
+// wrapOutput wraps the writers of a job's output so that the values of the
+// secrets it uses are redacted, and then its filter applied, before it is
+// captured and written to its log file, log sink and the journal, and
+// returns the function that writes what is held back once the job has
+// exited.
+func (m *Manager) wrapOutput(job *Job, stdout, stderr *io.Writer) func() {
+	spec := job.Spec
+	var flushes []func() error
+	*stdout, *stderr = logOutput(spec, *stdout, *stderr)
+	if spec.logSink != nil {
+		spec.logSink.forward(job.ID, stdout, stderr, &flushes)
+	}
+	if spec.journal != nil {
+		spec.journal.forward(job.ID, stdout, stderr, &flushes)
+	}
+	if spec.Filter != nil {
+		// The filter was checked by newCommand.
+		filter, _ := spec.Filter.compile()
+		filterStdout := &filterWriter{w: *stdout, filter: filter}
+		filterStderr := &filterWriter{w: *stderr, filter: filter}
+		*stdout, *stderr = filterStdout, filterStderr
+		flushes = append(flushes, filterStdout.Flush, filterStderr.Flush)
+	}
+	if spec.Progress {
+		progressStdout := &progressParser{w: *stdout, job: job}
+		progressStderr := &progressParser{w: *stderr, job: job}
+		*stdout, *stderr = progressStdout, progressStderr
+		flushes = append(flushes, progressStdout.Flush, progressStderr.Flush)
+	}
+	if redactStdout := m.secrets.redactor(spec, *stdout); redactStdout != nil {
+		redactStderr := m.secrets.redactor(spec, *stderr)
+		*stdout, *stderr = redactStdout, redactStderr
+		flushes = append(flushes, redactStdout.Flush, redactStderr.Flush)
+	}
+	return func() {
+		// The outermost writers go first, so that what they hold back
+		// passes through the others.
+		for i := len(flushes) - 1; i >= 0; i-- {
+			flushes[i]()
+		}
+	}
+}
+
+// prepare builds the command of a job and the cgroup it runs in. If that
+// fails, the job's workspace, if already created, is removed.
+func (m *Manager) prepare(spec *JobSpec) (Executor, *exec.Cmd, *cgroup, error) {
+	if err := m.checkMemory(); err != nil {
+		return nil, nil, nil, err
+	}
+	spec.submitted = spec.clone()
+	if err := m.starting(spec); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := checkNotifications(spec); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := checkExpectation(spec); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := traceJob(spec); err != nil {
+		return nil, nil, nil, err
+	}
+	executor, command, err := newCommand(spec, &m.config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := m.injectSecrets(spec, command); err != nil {
+		removeDir(spec.workdir)
+		return nil, nil, nil, err
+	}
+	if spec.logFile, err = openLog(spec); err != nil {
+		removeDir(spec.workdir)
+		return nil, nil, nil, err
+	}
+	if spec.logSink, err = openLogSink(spec); err != nil {
+		closeLog(spec)
+		removeDir(spec.workdir)
+		return nil, nil, nil, err
+	}
+	cg, err := newCgroup(command, spec.Cgroup)
+	if err != nil {
+		closeLog(spec)
+		removeDir(spec.workdir)
+		return nil, nil, nil, err
+	}
+	if err := cg.pin(spec.CPUSet); err != nil {
+		cg.remove()
+		closeLog(spec)
+		removeDir(spec.workdir)
+		return nil, nil, nil, err
+	}
+	spec.journal = openJournal(spec)
+	return executor, command, cg, nil
+}
+
+// setDeadline sets the job's deadline from its timeout, if it has one, once
+// it has started.
+func (job *Job) setDeadline() {
+	if job.Spec.Timeout > 0 {
+		job.deadline.Store(job.StartTime.Add(job.Spec.Timeout).UnixNano())
+	}
+}
+
+// Deadline returns when the job's timeout kills it, as extended by
+// ExtendTimeout, or the zero time if it has no timeout. It may be called
+// without the job's lock.
+func (job *Job) Deadline() time.Time {
+	if deadline := job.deadline.Load(); deadline != 0 {
+		return time.Unix(0, deadline)
+	}
+	return time.Time{}
+}
+
+// enforceTimeout kills the job's command once its deadline has passed, if it
+// has one. The returned function stops watching and reports whether the job
+// was killed.
+func enforceTimeout(job *Job, executor Executor, cmd *exec.Cmd) func() bool {
+	if job.deadline.Load() == 0 {
+		return func() bool { return false }
+	}
+	done := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(time.Until(job.Deadline()))
+		defer timer.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+			}
+			// The deadline may have been extended meanwhile.
+			if remaining := time.Until(job.Deadline()); remaining > 0 {
+				timer.Reset(remaining)
+				continue
+			}
+			Logger.Printf("Killing command %q: timed out after %v", job.Spec.Command, time.Since(job.StartTime).Round(time.Millisecond))
+			job.timedOut.Store(true)
+			kill, _ := parseSignal("")
+			executor.Signal(job.Spec, cmd, kill)
+			return
+		}
+	}()
+	return func() bool {
+		close(done)
+		return job.timedOut.Load()
+	}
+}
+
+// enforceTimeouts kills the job's command once its timeout has passed, or
+// once it has written nothing for its idle timeout, if it has either. The
+// returned function stops them and returns the limit that was exceeded:
+// "timeout", "idle_timeout", or none.
+func enforceTimeouts(job *Job, executor Executor, cmd *exec.Cmd) func() string {
+	stopTimeout := enforceTimeout(job, executor, cmd)
+	stopIdleTimeout := enforceIdleTimeout(job, executor, cmd)
+	return func() string {
+		timedOut, idled := stopTimeout(), stopIdleTimeout()
+		switch {
+		case timedOut:
+			return "timeout"
+		case idled:
+			return "idle_timeout"
+		}
+		return ""
+	}
+}
+
+// Run executes a job synchronously and returns it once it has finished. If
+// keep is set, the job is also held like a background job, from when it
+// starts, and its ID set.
+func (m *Manager) Run(spec *JobSpec, keep bool) (*Job, error) {
+	return m.RunContext(context.Background(), spec, keep)
+}
+
+// RunContext is like Run, but kills the job's command if ctx is done before
+// it exits. The killed job is then recorded like any other and returned
+// along with the context's error.
+func (m *Manager) RunContext(ctx context.Context, spec *JobSpec, keep bool) (*Job, error) {
+	if len(spec.Artifacts) > 0 && !keep {
+		return nil, withKind(ErrInvalidSpec, fmt.Errorf("artifacts are only collected for kept jobs"))
+	}
+	if spec.StdinOpen {
+		return nil, withKind(ErrInvalidSpec, fmt.Errorf("only background jobs can keep their stdin open"))
+	}
+	submitted := time.Now()
+	if err := m.admit(ctx); err != nil {
+		return nil, err
+	}
+	if err := m.workers.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer m.workers.release()
+	executor, command, cg, err := m.prepare(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	job, stdout, stderr, flush := m.newJob(spec, submitted, executor, command, cg, keep, false)
+	job.synchronous = true
+	if keep {
+		Logger.Printf("Running kept job %s: %s", job.ID, job.Cmd)
+	}
+	tty, wait, err := m.startJob(job, command, stdout, stderr)
+	job.Tty = tty
+	cg.started()
+	if err != nil {
+		job.StartError = err.Error()
+	}
+	job.mu.Unlock()
+
+	var cancelErr error
+	expired := ""
+	if err == nil {
+		stop := context.AfterFunc(ctx, func() {
+			Logger.Printf("Killing command %q: %v", spec.Command, ctx.Err())
+			kill, _ := parseSignal("")
+			executor.Signal(spec, command, kill)
+		})
+		stopTimeouts := enforceTimeouts(job, executor, command)
+		err = wait()
+		expired = stopTimeouts()
+		if !stop() {
+			// The command was killed.
+			cancelErr = ctx.Err()
+		}
+		flush()
+	}
+	m.complete(job, err, expired, cancelErr != nil)
+	return job, cancelErr
+}
+
+// Start starts a background job and returns its ID.
+func (m *Manager) Start(spec *JobSpec) (string, error) {
+	return m.start(spec, false)
+}
+
+// StartSession starts an interactive session, a job running under a
+// pseudo-terminal that a client can attach to with Attach, and returns its
+// ID. Without a command or argv the session runs an interactive shell.
+func (m *Manager) StartSession(spec *JobSpec) (string, error) {
+	if spec.Command == "" && len(spec.Argv) == 0 {
+		spec.Argv = shell[:1]
+	}
+	spec.Pty = true
+	return m.start(spec, true)
+}
+
+// start starts a background job and returns its ID. An interactive job is
+// a session whose terminal a client can attach to.
+func (m *Manager) start(spec *JobSpec, interactive bool) (string, error) {
+	submitted := time.Now()
+	if err := m.admit(context.Background()); err != nil {
+		return "", err
+	}
+	if err := m.workers.acquire(context.Background()); err != nil {
+		return "", err
+	}
+	executor, command, cg, err := m.prepare(spec)
+	if err != nil {
+		m.workers.release()
+		return "", err
+	}
+
+	job, stdout, stderr, flush := m.newJob(spec, submitted, executor, command, cg, true, interactive)
+	defer job.mu.Unlock()
+	id := job.ID
+	Logger.Printf("Starting background job %s: %s", id, job.Cmd)
+	tty, wait, err := m.startJob(job, command, stdout, stderr)
+	job.Tty = tty
+	cg.started()
+	if err != nil {
+		Logger.Printf("Background job %s failed to start: %v", id, err)
+		job.StartError = err.Error()
+	}
+
+	// Wait for the command on a worker to make it non-blocking.
+	m.workers.run(func() {
+		defer m.workers.release()
+		expired := ""
+		if err == nil {
+			stopTimeouts := enforceTimeouts(job, executor, command)
+			err = wait()
+			expired = stopTimeouts()
+			flush()
+		}
+		m.complete(job, err, expired, false)
+	})
+
+	return id, nil
+}
+
+// startJob starts the prepared command of job on a shell worker, if it can
+// run on one and one is free, or like startWithStdin otherwise.
+func (m *Manager) startJob(job *Job, command *exec.Cmd, stdout, stderr io.Writer) (*os.File, func() error, error) {
+	if m.shells.runsOnWorker(job, command) {
+		if w := m.shells.get(); w != nil {
+			wait, err := w.run(command, job.Spec.Command, stdout, stderr)
+			if err == nil {
+				job.shell = w
+				return nil, wait, nil
+			}
+			m.shells.put(w, false)
+		}
+	}
+	return startWithStdin(job, command, stdout, stderr)
+}
+
+// newJob returns the record of a job about to run the command prepared for
+// spec, with the writers its output is to be captured with and the function
+// flushing them once the command has exited. A kept job is given an ID and
+// held from now on, so that it can be looked up, and attached to, while it
+// runs. The job is returned locked, for the caller to unlock once its
+// command has started.
+func (m *Manager) newJob(spec *JobSpec, submitted time.Time, executor Executor, command *exec.Cmd, cg *cgroup, keep, interactive bool) (job *Job, stdout, stderr io.Writer, flush func()) {
+	job = &Job{
+		Command:     spec.Command,
+		Argv:        spec.Argv,
+		Cmd:         command,
+		SubmitTime:  submitted,
+		StartTime:   time.Now(),
+		Status:      "running",
+		Spec:        spec,
+		Executor:    executor,
+		Workspace:   spec.workdir,
+		Trace:       spec.trace,
+		cgroup:      cg,
+		attachments: &attachments{},
+	}
+	if spec.Command != "" {
+		job.Shell = shell[0]
+	}
+	job.Stdout.limit = captureLimit(spec)
+	job.Stderr.limit = job.Stdout.limit
+	job.setDeadline()
+	job.mu.Lock()
+	if keep {
+		job.ID = m.nextID()
+		m.jobs.put(job)
+	}
+	m.expect(job)
+
+	stdout = m.counted(job, job.attachments.stream(&lockedWriter{&job.mu, &job.Stdout}))
+	if interactive {
+		job.session = &session{output: &job.Stdout}
+		stdout = m.counted(job, job.attachments.stream(&lockedWriter{&job.mu, job.session}))
+	}
+	stderr = m.counted(job, job.attachments.stream(&lockedWriter{&job.mu, &job.Stderr}))
+	flush = m.wrapOutput(job, &stdout, &stderr)
+	stdout, stderr = job.tracked(stdout, stderr)
+	return job, stdout, stderr, flush
+}
+
+// complete records the end of a job whose command exited with err, or
+// failed to start, after the limit expired named if it is set, or after it
+// was cancelled, and lets go of what the job held while it ran.
+func (m *Manager) complete(job *Job, err error, expired string, cancelled bool) {
+	if job.stdin != nil {
+		job.stdin.close()
+	}
+	job.attachments.end()
+	closeLog(job.Spec)
+	end := time.Now()
+	m.updateStats(end.Sub(job.StartTime), int(job.Stdout.Written()), int(job.Stderr.Written()))
+	usage := job.cgroup.usage()
+	job.cgroup.remove()
+	artifactDir, artifacts := collectArtifacts(job.Spec)
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	held := job.ID != "" && !job.released
+	job.EndTime = end
+	job.CgroupUsage = usage
+	if held {
+		job.artifactDir, job.Artifacts = artifactDir, artifacts
+	} else {
+		// The job was released while it ran, or never kept.
+		removeDir(artifactDir)
+	}
+
+	if job.Tty != nil {
+		job.Tty.Close()
+		job.Tty = nil
+	}
+
+	finish(job, err)
+	if expired != "" {
+		job.LimitExceeded = expired
+	}
+	terminated(job, cancelled)
+	judge(job)
+	m.countResult(job.Result)
+	if job.synchronous && job.Status == "errored" {
+		// Run reports commands that failed as they ran through their exit
+		// code.
+		job.Status = "exited"
+	}
+	endJournal(job)
+	m.checkIn(job)
+	m.recordTrend(job)
+	if held {
+		job.compressOutput(m.config.CompressThreshold)
+	} else if job.ID == "" {
+		// Nothing could release the job later.
+		releaseFiles(job)
+	}
+	m.settle(job, held)
+	if job.session != nil {
+		job.session.close()
+	}
+	if job.shell != nil {
+		// A worker whose job was signalled may have been hit as well.
+		m.shells.put(job.shell, expired == "" && !cancelled && !job.killRequested)
+		job.shell = nil
+	}
+	m.finished(job)
+	notify(job)
+	if job.ID != "" {
+		Logger.Printf("Job %s finished with status %s and exit code %d", job.ID, job.Status, job.ExitCode)
+	}
+}
+
+// StartGroup starts a background job on each of the given SSH hosts and
+// returns the ID of the group holding them. If the job fails to start on a
+// host, the jobs already started on the others are killed and released,
+// since nothing could reach them without the group.
+func (m *Manager) StartGroup(spec *JobSpec, hosts []string) (string, error) {
+	if spec.Host != "" {
+		return "", withKind(ErrInvalidSpec, fmt.Errorf("only one of host and hosts may be set"))
+	}
+	for _, host := range hosts {
+		if _, ok := m.config.SSHHosts[host]; !ok {
+			return "", withKind(ErrInvalidSpec, fmt.Errorf("unknown host %q", host))
+		}
+	}
+
+	ids := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		hostSpec := *spec
+		hostSpec.Host = host
+		id, err := m.start(&hostSpec, false)
+		if err != nil {
+			for _, started := range ids {
+				m.Kill(started, "")
+				m.Release(started)
+			}
+			return "", fmt.Errorf("starting job on %s: %w", host, err)
+		}
+		ids = append(ids, id)
+	}
+
+	m.mutex.Lock()
+	m.groupCounter++
+	groupID := fmt.Sprintf("group-%d", m.groupCounter)
+	m.groups[groupID] = ids
+	m.mutex.Unlock()
+
+	for _, id := range ids {
+		m.WithJob(id, func(job *Job) error {
+			job.Group = groupID
+			return nil
+		})
+	}
+	Logger.Printf("Started group %s with jobs %q", groupID, ids)
+	return groupID, nil
+}
+
+// WithJob calls f with the job with the given ID, holding the job's lock,
+// which guards its fields. Only the job is locked, so calls for other jobs
+// go ahead meanwhile.
+func (m *Manager) WithJob(id string, f func(job *Job) error) error {
+	job, ok := m.jobs.get(id)
+	if !ok {
+		return jobNotFound(id)
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	return f(job)
+}
+
+// WithGroup calls f with the jobs of the group with the given ID, holding
+// the locks of all of them. Released jobs are left out.
+func (m *Manager) WithGroup(id string, f func(jobs []*Job) error) error {
+	m.mutex.Lock()
+	ids, ok := m.groups[id]
+	m.mutex.Unlock()
+	if !ok {
+		return withKind(ErrGroupNotFound, fmt.Errorf("group with id %s not found", id))
+	}
+
+	// The jobs are locked in the order of the group, the same for every
+	// caller.
+	jobs := make([]*Job, 0, len(ids))
+	for _, jobID := range ids {
+		if job, ok := m.jobs.get(jobID); ok {
+			job.mu.Lock()
+			defer job.mu.Unlock()
+			jobs = append(jobs, job)
+		}
+	}
+	return f(jobs)
+}
+
+// Release removes a job's data from memory.
+func (m *Manager) Release(id string) error {
+	job, ok := m.jobs.remove(id)
+	if !ok {
+		return jobNotFound(id)
+	}
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	m.release(job)
+	return nil
+}
+
+// release lets go of a job removed from m.jobs, unless that has been done
+// already. The job's lock must be held.
+func (m *Manager) release(job *Job) {
+	if job.released {
+		return
+	}
+	job.released = true
+	m.archive(job.ID, job)
+	releaseFiles(job)
+	m.settle(job, false)
+	Logger.Printf("Released job %s", job.ID)
+}
+
+// ReleaseAll removes all finished jobs the filter selects from memory and
+// returns how many were removed.
+func (m *Manager) ReleaseAll(filter JobFilter) (int, error) {
+	selects, err := filter.compile()
+	if err != nil {
+		return 0, err
+	}
+	releasedCount := 0
+	for _, job := range m.jobs.all() {
+		job.mu.Lock()
+		if job.Finished() && !job.released && selects(job) {
+			m.jobs.remove(job.ID)
+			m.release(job)
+			releasedCount++
+		}
+		job.mu.Unlock()
+	}
+	Logger.Printf("Released %d finished jobs", releasedCount)
+	return releasedCount, nil
+}
+
+// nextID returns the ID of a new job.
+func (m *Manager) nextID() string {
+	return m.ids.Load().next()
+}
+
+// List returns all jobs and their statuses, in order of ID.
+func (m *Manager) List() []JobListEntry {
+	list, _ := m.ListPage("", 0)
+	return list
+}
+
+// ListPage returns the jobs whose IDs come after afterID, or all of them if
+// it is empty, and their statuses, in order of ID. If limit is positive, at
+// most that many jobs are returned. The total number of jobs is returned
+// too.
+func (m *Manager) ListPage(afterID string, limit int) ([]JobListEntry, int) {
+	jobs := m.jobs.all()
+	list := make([]JobListEntry, 0, len(jobs))
+	for _, job := range jobs {
+		if limit > 0 && len(list) == limit {
+			break
+		}
+		if afterID == "" || lessID(afterID, job.ID) {
+			job.mu.Lock()
+			list = append(list, JobListEntry{ID: job.ID, Status: job.Status, Submitter: job.Spec.Submitter.String(), Annotations: maps.Clone(job.Annotations)})
+			job.mu.Unlock()
+		}
+	}
+	return list, len(jobs)
+}
+
+// JobUsage is what some of the jobs a Manager holds take up.
+type JobUsage struct {
+	Running  int   // jobs that have not finished, including paused ones
+	Buffered int64 // bytes of their output held in memory
+}
+
+// Usage adds up what the jobs the Manager holds whose spec match returns
+// true for take up. Jobs started with Run are held only if kept, and are
+// left for the callers of Run to count as running.
+func (m *Manager) Usage(match func(spec *JobSpec) bool) JobUsage {
+	var usage JobUsage
+	for _, job := range m.jobs.all() {
+		job.mu.Lock()
+		if match(job.Spec) {
+			if !job.Finished() && !job.synchronous {
+				usage.Running++
+			}
+			usage.Buffered += job.buffered.Load()
+		}
+		job.mu.Unlock()
+	}
+	return usage
+}
+
+// Kill sends the named signal, such as "TERM", to a running job and
+// everything it spawned. An empty name sends SIGKILL.
+func (m *Manager) Kill(id, signal string) error {
+	sig, err := parseSignal(signal)
+	if err != nil {
+		return withKind(ErrInvalidSpec, err)
+	}
+	return m.WithJob(id, func(job *Job) error {
+		if job.Finished() {
+			return withKind(ErrJobState, fmt.Errorf("job with id %s is not running", id))
+		}
+		if err := job.signal(sig); err != nil {
+			return err
+		}
+		Logger.Printf("Sent signal %d to job %s", sig, id)
+		return nil
+	})
+}
+
+// ExtendTimeout pushes back the deadline of a running job's timeout by
+// extra, so that a job that is nearly done is not killed, and returns the
+// new deadline.
+func (m *Manager) ExtendTimeout(id string, extra time.Duration) (time.Time, error) {
+	if extra <= 0 {
+		return time.Time{}, withKind(ErrInvalidSpec, fmt.Errorf("invalid extension %v", extra))
+	}
+	var deadline time.Time
+	err := m.WithJob(id, func(job *Job) error {
+		switch {
+		case job.Finished():
+			return withKind(ErrJobState, fmt.Errorf("job with id %s is not running", id))
+		case job.deadline.Load() == 0:
+			return withKind(ErrJobState, fmt.Errorf("job with id %s has no timeout", id))
+		case job.timedOut.Load():
+			return withKind(ErrJobState, fmt.Errorf("job with id %s has already timed out", id))
+		}
+		deadline = time.Unix(0, job.deadline.Add(int64(extra)))
+		Logger.Printf("Extended the timeout of job %s by %v, to %v", id, extra, deadline)
+		return nil
+	})
+	return deadline, err
+}
+
+// Resize changes the terminal size of a running job started with a
+// pseudo-terminal.
+func (m *Manager) Resize(id string, rows, cols uint16) error {
+	return m.WithJob(id, func(job *Job) error {
+		if job.Tty == nil {
+			return withKind(ErrJobState, fmt.Errorf("job with id %s has no terminal", id))
+		}
+		return pty.Setsize(job.Tty, TerminalOptions{Rows: rows, Cols: cols}.winsize())
+	})
+}
+
+// Attach connects client to the terminal of the session with the given ID.
+// Output produced so far is replayed to the client, and input is typed into
+// the terminal until it ends, at which point the session is hung up. The
+// client is closed when the job exits.
+func (m *Manager) Attach(id string, input io.Reader, client io.WriteCloser) error {
+	var sess *session
+	var tty *os.File
+	var process *os.Process
+	err := m.WithJob(id, func(job *Job) error {
+		if job.session == nil || job.Tty == nil {
+			return withKind(ErrJobState, fmt.Errorf("job with id %s is not a running session", id))
+		}
+		sess, tty, process = job.session, job.Tty, job.Cmd.Process
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := sess.attach(client); err != nil {
+		return withKind(ErrJobState, fmt.Errorf("cannot attach to job %s: %v", id, err))
+	}
+	Logger.Printf("Client attached to session %s", id)
+
+	io.Copy(tty, input)
+
+	// The client has gone away, so hang up on the session.
+	Logger.Printf("Client detached from session %s", id)
+	sess.close()
+	process.Signal(syscall.SIGHUP)
+	return nil
+}
@@ -0,0 +1,1403 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSandbox contains unit tests for resolving sandbox options.
+func TestSandbox(t *testing.T) {
+	allowed := t.TempDir()
+	outside := t.TempDir()
+	var config Config
+	if err := config.SetSandboxBindAllow(allowed); err != nil {
+		t.Fatalf("setting allowlist failed: %v", err)
+	}
+	sandbox := config.Sandbox
+
+	t.Run("opt in", func(t *testing.T) {
+		if opts, err := resolveSandbox(nil, sandbox); err != nil || opts != nil {
+			t.Errorf("expected jobs not to be sandboxed by default, got %v, %v", opts, err)
+		}
+		opts, err := resolveSandbox(nil, SandboxConfig{Always: true, NoNetwork: true})
+		if err != nil || opts == nil || !opts.NoNetwork {
+			t.Errorf("expected server-wide settings to apply to every job, got %v, %v", opts, err)
+		}
+	})
+
+	t.Run("binds", func(t *testing.T) {
+		os.Mkdir(filepath.Join(allowed, "work"), 0755)
+		os.Symlink(outside, filepath.Join(allowed, "escape"))
+
+		opts, err := resolveSandbox(&SandboxOptions{Binds: []string{filepath.Join(allowed, "work")}}, sandbox)
+		if err != nil {
+			t.Fatalf("expected bind inside the allowlist to be accepted, got %v", err)
+		}
+		args := strings.Join(opts.bwrapArgs(), " ")
+		if !strings.Contains(args, "--bind "+filepath.Join(allowed, "work")) {
+			t.Errorf("expected bwrap arguments to bind the directory, got %q", args)
+		}
+		if strings.Contains(args, "--unshare-net") {
+			t.Errorf("did not expect network isolation, got %q", args)
+		}
+
+		for _, bind := range []string{outside, "relative", filepath.Join(allowed, "escape")} {
+			if _, err := resolveSandbox(&SandboxOptions{Binds: []string{bind}}, sandbox); err == nil {
+				t.Errorf("expected bind %q to be rejected", bind)
+			}
+		}
+		if _, err := resolveSandbox(&SandboxOptions{Binds: []string{outside}}, sandbox); !errors.Is(err, ErrPolicyDenied) {
+			t.Errorf("expected a bind outside the allowlist to be denied by policy, got %v", err)
+		}
+	})
+}
+
+// TestExecutor contains unit tests for choosing an executor and for the
+// commands the container executor builds.
+func TestExecutor(t *testing.T) {
+	config := DefaultConfig()
+	if _, _, err := newCommand(&JobSpec{Command: "true", Executor: "nowhere"}, &config); !errors.Is(err, ErrInvalidSpec) {
+		t.Errorf("expected an invalid spec error for an unknown executor, got %v", err)
+	}
+	if _, _, err := newCommand(&JobSpec{Command: "true", Executor: "local", Container: &ContainerOptions{Image: "alpine"}}, &config); err == nil {
+		t.Error("expected container options to be rejected by the local executor")
+	}
+	if _, _, err := newCommand(&JobSpec{Command: "true", Container: &ContainerOptions{}}, &config); err == nil {
+		t.Error("expected an error for a container without an image")
+	}
+	if _, _, err := newCommand(&JobSpec{Command: "true", Nice: 5, Container: &ContainerOptions{Image: "alpine"}}, &config); err == nil {
+		t.Error("expected nice to be rejected for container jobs")
+	}
+
+	dir := t.TempDir()
+	if _, _, err := newCommand(&JobSpec{Command: "true", Container: &ContainerOptions{Image: "alpine", Mounts: []string{dir + ":/data"}}}, &config); !errors.Is(err, ErrPolicyDenied) {
+		t.Errorf("expected a mount outside the allowlist to be denied, got %v", err)
+	}
+	config.Sandbox.BindAllow = []string{dir}
+	if _, _, err := newCommand(&JobSpec{Command: "true", Container: &ContainerOptions{Image: "alpine", Mounts: []string{"data:/data"}}}, &config); err == nil {
+		t.Error("expected a named volume to be rejected")
+	}
+	sandboxed := config
+	sandboxed.Sandbox.Always = true
+	if _, _, err := newCommand(&JobSpec{Command: "true", Container: &ContainerOptions{Image: "alpine"}}, &sandboxed); !errors.Is(err, ErrPolicyDenied) {
+		t.Errorf("expected container jobs to be denied while every job is sandboxed, got %v", err)
+	}
+
+	spec := &JobSpec{
+		Command: "echo hi",
+		Limits:  ResourceLimits{NoFile: 64},
+		Container: &ContainerOptions{
+			Image:  "alpine",
+			Mounts: []string{dir + ":/data:ro"},
+			Memory: 1 << 20,
+			CPUs:   0.5,
+		},
+	}
+	executor, cmd, err := newCommand(spec, &config)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, ok := executor.(containerExecutor); !ok || spec.Executor != "container" {
+		t.Errorf("expected the container executor, got %q", spec.Executor)
+	}
+	if spec.Container.Name == "" {
+		t.Error("expected a container name to be generated")
+	}
+	want := "docker run --rm -i --name " + spec.Container.Name +
+		" --memory 1048576 --cpus 0.5 --volume " + dir + ":/data:ro --ulimit nofile=64:64 alpine sh -c echo hi"
+	if got := strings.Join(cmd.Args, " "); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+// TestKubernetes contains unit tests for the commands the kubernetes
+// executor builds.
+func TestKubernetes(t *testing.T) {
+	config := DefaultConfig()
+	if _, _, err := newCommand(&JobSpec{Command: "true", Kubernetes: &KubernetesOptions{}}, &config); err == nil {
+		t.Error("expected an error for a pod without an image")
+	}
+	if _, _, err := newCommand(&JobSpec{Command: "true", Kubernetes: &KubernetesOptions{Image: "alpine", Name: "--help"}}, &config); err == nil {
+		t.Error("expected an error for an invalid pod name")
+	}
+
+	spec := &JobSpec{
+		Argv:       []string{"echo", "hi"},
+		Kubernetes: &KubernetesOptions{Image: "alpine", Namespace: "ci", Memory: 1 << 20, CPUs: 0.5},
+	}
+	_, cmd, err := newCommand(spec, &config)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if spec.Executor != "kubernetes" || spec.Kubernetes.Name == "" {
+		t.Errorf("expected the kubernetes executor and a generated pod name, got %q, %q", spec.Executor, spec.Kubernetes.Name)
+	}
+	want := []string{"kubectl", "run", spec.Kubernetes.Name, "--image", "alpine", "--restart", "Never", "--rm", "--attach", "--quiet", "--overrides"}
+	if len(cmd.Args) < len(want)+1 || strings.Join(cmd.Args[:len(want)], " ") != strings.Join(want, " ") {
+		t.Fatalf("expected arguments starting with %q, got %q", want, cmd.Args)
+	}
+	if got := cmd.Args[len(cmd.Args)-2:]; got[0] != "--namespace" || got[1] != "ci" {
+		t.Errorf("expected the namespace to be set, got %q", cmd.Args)
+	}
+
+	var overrides struct {
+		Spec struct {
+			Containers []struct {
+				Command   []string
+				Resources struct{ Limits map[string]string }
+			}
+		}
+	}
+	if err := json.Unmarshal([]byte(cmd.Args[len(want)]), &overrides); err != nil {
+		t.Fatalf("expected JSON overrides, got %v", err)
+	}
+	containers := overrides.Spec.Containers
+	if len(containers) != 1 || strings.Join(containers[0].Command, " ") != "echo hi" {
+		t.Fatalf("expected the argv as the container's command, got %+v", containers)
+	}
+	if limits := containers[0].Resources.Limits; limits["memory"] != "1048576" || limits["cpu"] != "0.5" {
+		t.Errorf("expected memory and CPU limits, got %v", limits)
+	}
+}
+
+// TestSSHCommand contains unit tests for the commands the ssh executor
+// builds.
+func TestSSHCommand(t *testing.T) {
+	config := DefaultConfig()
+	config.SSHHosts = map[string]SSHHost{"web1": {Address: "10.0.0.1", User: "deploy", Port: 2222, IdentityFile: "/keys/id"}}
+
+	_, cmd, err := newCommand(&JobSpec{Argv: []string{"echo", "it's"}, Host: "web1"}, &config)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	want := "ssh -o BatchMode=yes -T -l deploy -p 2222 -i /keys/id -o IdentitiesOnly=yes -- 10.0.0.1 'echo' 'it'\\''s'"
+	if got := strings.Join(cmd.Args, " "); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if _, _, err := newCommand(&JobSpec{Command: "true", Host: "db1"}, &config); err == nil {
+		t.Error("expected an error for an unknown host")
+	}
+}
+
+// TestSecrets contains unit tests for storing secrets and redacting their
+// values from job output.
+func TestSecrets(t *testing.T) {
+	t.Run("redactor", func(t *testing.T) {
+		var s Secrets
+		s.Set("token", "hunter2")
+		s.Set("short", "hunt")
+		var out strings.Builder
+		r := s.redactor(&JobSpec{Secrets: map[string]string{"A": "token", "B": "short"}}, &out)
+		// The values are split across writes.
+		for _, chunk := range []string{"x hun", "ter2 y hu", "nt z hu"} {
+			r.Write([]byte(chunk))
+		}
+		if got := out.String(); got != "x [REDACTED] y [REDACTED] z " {
+			t.Errorf("expected the held back output to end before a possible value, got %q", got)
+		}
+		r.Flush()
+		if got, want := out.String(), "x [REDACTED] y [REDACTED] z hu"; got != want {
+			t.Errorf("expected %q, got %q", want, got)
+		}
+		if s.redactor(&JobSpec{}, &out) != nil {
+			t.Error("expected no redactor for a job without secrets")
+		}
+	})
+
+	t.Run("file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "secrets")
+		key := []byte("0123456789abcdef0123456789abcdef")
+		var s Secrets
+		if err := s.UseFile(path, key); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if err := s.Set("token", "hunter2"); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil || strings.Contains(string(data), "hunter2") {
+			t.Fatalf("expected the value to be encrypted in the file, got %q, %v", data, err)
+		}
+
+		var loaded Secrets
+		if err := loaded.UseFile(path, key); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if list := loaded.List(); len(list) != 1 || list[0].Name != "token" {
+			t.Errorf("expected the secret to be loaded, got %v", list)
+		}
+		if err := new(Secrets).UseFile(path, []byte("fedcba9876543210fedcba9876543210")); err == nil {
+			t.Error("expected an error for the wrong key")
+		}
+		if err := loaded.Delete("other"); !errors.Is(err, ErrSecretNotFound) {
+			t.Errorf("expected ErrSecretNotFound, got %v", err)
+		}
+	})
+}
+
+// TestEnvFile contains unit tests for reading environment files.
+func TestEnvFile(t *testing.T) {
+	t.Run("parse", func(t *testing.T) {
+		env, err := parseEnvFile([]byte(`# shared settings
+export REGION=eu-west-1
+PLAIN = some value # a comment
+SINGLE='no \n escapes # here'
+DOUBLE="tab\there \"quoted\" \$HOME"
+MULTI="first
+second"
+EMPTY=
+`))
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		want := map[string]string{
+			"REGION": "eu-west-1",
+			"PLAIN":  "some value",
+			"SINGLE": `no \n escapes # here`,
+			"DOUBLE": "tab\there \"quoted\" $HOME",
+			"MULTI":  "first\nsecond",
+			"EMPTY":  "",
+		}
+		if !maps.Equal(env, want) {
+			t.Errorf("expected %q, got %q", want, env)
+		}
+		for _, data := range []string{"NOVALUE", "=value", "A='open", "A=\"open\nstill open"} {
+			if _, err := parseEnvFile([]byte(data)); err == nil {
+				t.Errorf("expected an error parsing %q", data)
+			}
+		}
+	})
+
+	t.Run("job", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "deploy.env")
+		os.WriteFile(path, []byte("STAGE=prod\nREGION=eu-west-1\n"), 0o600)
+
+		config := DefaultConfig()
+		m := NewManager(config)
+		spec := &JobSpec{Command: "echo $STAGE $REGION", EnvFile: path, Env: map[string]string{"STAGE": "staging"}}
+		if _, err := m.Run(spec, false); !errors.Is(err, ErrPolicyDenied) {
+			t.Errorf("expected an env file outside the allowed directories to be denied, got %v", err)
+		}
+		if err := config.SetEnvFileDirs(dir); err != nil {
+			t.Fatal(err)
+		}
+		m = NewManager(config)
+		job, err := m.Run(spec, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if output := job.Stdout.String(); output != "staging eu-west-1\n" {
+			t.Errorf("expected Env to take precedence over the env file, got %q", output)
+		}
+		if _, err := m.Run(&JobSpec{Command: "true", EnvFile: "deploy.env"}, false); !errors.Is(err, ErrInvalidSpec) {
+			t.Errorf("expected a relative env file to be invalid, got %v", err)
+		}
+	})
+}
+
+// TestParseSyntaxErrors contains unit tests for reading the syntax errors
+// shells report.
+func TestParseSyntaxErrors(t *testing.T) {
+	command := "echo ok\nif true; then\n  echo (\nfi"
+	errs := parseSyntaxErrors(command, "bash: line 3: syntax error near unexpected token `('\nbash: line 3: `  echo ('\n")
+	if want := []SyntaxError{{Line: 3, Column: 8, Message: "syntax error near unexpected token `('"}}; !slices.Equal(errs, want) {
+		t.Errorf("expected %+v, got %+v", want, errs)
+	}
+	errs = parseSyntaxErrors(command, "bash: line 3: syntax error near unexpected token `newline'\n")
+	if len(errs) != 1 || errs[0].Column != 9 {
+		t.Errorf("expected the error at the end of line 3, got %+v", errs)
+	}
+	errs = parseSyntaxErrors(command, "sh: 4: Syntax error: newline unexpected (expecting \")\")\n")
+	if want := []SyntaxError{{Line: 4, Message: "Syntax error: newline unexpected (expecting \")\")"}}; !slices.Equal(errs, want) {
+		t.Errorf("expected %+v, got %+v", want, errs)
+	}
+	if errs := parseSyntaxErrors(command, "something else\n"); len(errs) != 1 || errs[0].Message != "something else" {
+		t.Errorf("expected unrecognized diagnostics to be reported as they are, got %+v", errs)
+	}
+}
+
+// TestKeptRun checks that a job kept by Run is held from when it starts,
+// like a background job, and recorded like one once it finishes.
+func TestKeptRun(t *testing.T) {
+	m := NewManager(DefaultConfig())
+	spec := &JobSpec{Command: "echo out; echo err >&2; sleep 0.3; exit 2", Labels: map[string]string{"team": "infra"}}
+	done := make(chan *Job, 1)
+	go func() {
+		job, err := m.Run(spec, true)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- job
+	}()
+	var running bool
+	for start := time.Now(); !running && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		for _, entry := range m.List() {
+			running = entry.Status == "running"
+		}
+	}
+	if !running {
+		t.Fatalf("expected the kept job to be held while it runs, got %v", m.List())
+	}
+	if usage := m.Usage(func(*JobSpec) bool { return true }); usage.Running != 0 {
+		t.Errorf("expected the caller of Run to count its job, got %+v", usage)
+	}
+	kept := <-done
+
+	id, err := m.Start(&JobSpec{Command: "echo out; echo err >&2; exit 2", Labels: map[string]string{"team": "infra"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var background *Job
+	for start := time.Now(); (background == nil || !background.Finished()) && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		m.WithJob(id, func(job *Job) error {
+			if job.Finished() {
+				background = job
+			}
+			return nil
+		})
+	}
+	if background == nil {
+		t.Fatal("expected the background job to finish")
+	}
+
+	m.WithJob(kept.ID, func(job *Job) error {
+		if job != kept {
+			t.Errorf("expected Run to return the job it holds")
+		}
+		return nil
+	})
+	for _, job := range []*Job{kept, background} {
+		if job.ID == "" || job.Status != "exited" || job.ExitCode != 2 || job.Result != ResultFailure {
+			t.Errorf("unexpected record for job %q: status %q, exit code %d, result %q", job.ID, job.Status, job.ExitCode, job.Result)
+		}
+		if job.SubmitTime.IsZero() || job.StartTime.Before(job.SubmitTime) || job.EndTime.Before(job.StartTime) {
+			t.Errorf("unexpected times for job %s: %v, %v, %v", job.ID, job.SubmitTime, job.StartTime, job.EndTime)
+		}
+		if job.Stdout.String() != "out\n" || job.Stderr.String() != "err\n" || job.Spec.Labels["team"] != "infra" {
+			t.Errorf("unexpected output or spec for job %s: %q, %q, %v", job.ID, job.Stdout.String(), job.Stderr.String(), job.Spec.Labels)
+		}
+	}
+}
+
+// TestConcurrentAccess reads jobs while they write output and are released,
+// so that -race catches fields read or written outside their job's lock.
+func TestConcurrentAccess(t *testing.T) {
+	m := NewManager(DefaultConfig())
+	var ids []string
+	for i := 0; i < 8; i++ {
+		id, err := m.Start(&JobSpec{Command: "for i in 1 2 3 4 5 6 7 8 9 10; do echo $i; sleep 0.01; done"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := time.Now(); time.Since(start) < 300*time.Millisecond; {
+				for _, id := range ids {
+					m.WithJob(id, func(job *Job) error {
+						_ = job.Status + job.Stdout.String()
+						return nil
+					})
+				}
+				m.List()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, id := range ids {
+		var finished bool
+		for start := time.Now(); !finished && time.Since(start) < 5*time.Second; {
+			time.Sleep(10 * time.Millisecond)
+			m.WithJob(id, func(job *Job) error {
+				finished = job.Finished()
+				return nil
+			})
+		}
+		if err := m.WithJob(id, func(job *Job) error {
+			if want := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"; job.Stdout.String() != want {
+				t.Errorf("expected job %s to write %q, got %q", id, want, job.Stdout.String())
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A job released while it runs is let go of once, and not held again
+	// when it finishes.
+	id, err := m.Start(&JobSpec{Command: "sleep 0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Release(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Release(id); err == nil {
+		t.Errorf("expected a second release of job %s to fail", id)
+	}
+	if n, err := m.ReleaseAll(JobFilter{}); err != nil || n != len(ids) {
+		t.Errorf("expected %d finished jobs to be released, got %d", len(ids), n)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if list := m.List(); len(list) != 0 {
+		t.Errorf("expected no jobs left, got %v", list)
+	}
+}
+
+// BenchmarkWithJob polls the status and output of many held jobs from
+// parallel goroutines, as clients polling the server do.
+func BenchmarkWithJob(b *testing.B) {
+	m := NewManager(DefaultConfig())
+	var ids []string
+	for i := 0; i < 64; i++ {
+		id, err := m.Start(&JobSpec{Command: "echo $PPID"})
+		if err != nil {
+			b.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			m.WithJob(ids[i%len(ids)], func(job *Job) error {
+				_ = job.Status + job.Stdout.String()
+				return nil
+			})
+		}
+	})
+}
+
+// TestShellPath checks that the interpreter for command strings is looked
+// up in $PATH again once $PATH changes.
+func TestShellPath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the interpreter is not a script on Windows")
+	}
+	want, err := exec.LookPath(shell[0])
+	if err != nil {
+		t.Skip(err)
+	}
+	if cmd := shellCommand("true"); cmd.Path != want || cmd.Args[0] != shell[0] {
+		t.Errorf("expected %s run as %s, got %s as %s", want, shell[0], cmd.Path, cmd.Args[0])
+	}
+	dir := t.TempDir()
+	fake := filepath.Join(dir, shell[0])
+	if err := os.WriteFile(fake, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	if cmd := shellCommand("true"); cmd.Path != fake {
+		t.Errorf("expected %s after changing $PATH, got %s", fake, cmd.Path)
+	}
+}
+
+// TestConfig checks that Managers in one process each keep their own
+// settings.
+func TestConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.HistorySize = 0
+	forgetful, remembering := NewManager(config), NewManager(DefaultConfig())
+	for _, m := range []*Manager{forgetful, remembering} {
+		job, err := m.Run(&JobSpec{Command: "true"}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Release(job.ID); err != nil {
+			t.Fatal(err)
+		}
+		_, err = m.Rerun(job.ID, Identity{})
+		if remembers := err == nil; remembers != (m == remembering) {
+			t.Errorf("expected only the Manager with a history to rerun the job, got %v", err)
+		}
+	}
+	if forgetful.Config().HistorySize != 0 || remembering.Config().HistorySize != 1000 {
+		t.Errorf("expected each Manager's own history size, got %d and %d", forgetful.Config().HistorySize, remembering.Config().HistorySize)
+	}
+}
+
+// TestWorkers checks that jobs beyond the number of workers wait for one to
+// be free, and are refused once they have waited too long.
+func TestWorkers(t *testing.T) {
+	config := DefaultConfig()
+	config.Workers, config.WorkerWait = 2, 100*time.Millisecond
+
+	m := NewManager(config)
+	for i := 0; i < 2; i++ {
+		if _, err := m.Start(&JobSpec{Command: "sleep 0.5"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if busy := m.Stats().BusyWorkers; busy != 2 {
+		t.Errorf("expected 2 busy workers, got %d", busy)
+	}
+	if _, err := m.Start(&JobSpec{Command: "true"}); !errors.Is(err, ErrOverloaded) {
+		t.Errorf("expected a job beyond the workers to be refused, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := m.RunContext(ctx, &JobSpec{Command: "true"}, false); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected Run to stop waiting once its context is done, got %v", err)
+	}
+
+	// Nothing else is waiting for a worker.
+	m.workers.wait = 5 * time.Second
+	job, err := m.Run(&JobSpec{Command: "echo ok"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued := job.StartTime.Sub(job.SubmitTime); queued < 200*time.Millisecond {
+		t.Errorf("expected the job to wait for a worker, but it was queued for %v", queued)
+	}
+	if job.Stdout.String() != "ok\n" {
+		t.Errorf("unexpected output %q", job.Stdout.String())
+	}
+	if busy := m.Stats().BusyWorkers; busy > 1 {
+		t.Errorf("expected the worker of the finished job to be freed, got %d busy", busy)
+	}
+}
+
+// TestShellWorkers checks that plain commands are run by long-lived shells,
+// reused from one job to the next, with their output, exit status and
+// timeouts as when they run in shells of their own.
+func TestShellWorkers(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell workers need a POSIX shell")
+	}
+	config := DefaultConfig()
+	config.ShellWorkers = 1
+
+	m := NewManager(config)
+	run := func(spec *JobSpec) *Job {
+		t.Helper()
+		job, err := m.Run(spec, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return job
+	}
+	first := run(&JobSpec{Command: "echo $$; printf err >&2; cd /; x=1; exit 3"})
+	if first.ExitCode != 3 || first.Status != "exited" || first.Stderr.String() != "err" {
+		t.Errorf("unexpected record: status %q, exit code %d, stderr %q", first.Status, first.ExitCode, first.Stderr.String())
+	}
+	second := run(&JobSpec{Command: "echo $$; pwd; echo \"x=$x\"; printf 'no newline'"})
+	wd, _ := os.Getwd()
+	if want := first.Stdout.String() + wd + "\nx=\nno newline"; second.Stdout.String() != want || second.ExitCode != 0 {
+		t.Errorf("expected the same worker to run the second job unaffected by the first, got %q, exit code %d", second.Stdout.String(), second.ExitCode)
+	}
+
+	// Jobs that need more than a plain shell start one of their own.
+	for _, spec := range []*JobSpec{
+		{Command: "echo $$", Env: map[string]string{"A": "b"}},
+		{Command: "echo $$", Umask: "022"},
+		{Command: "echo $$", Nice: 5},
+	} {
+		if own := run(spec); own.Stdout.String() == first.Stdout.String() {
+			t.Errorf("expected the job %+v to run in a shell of its own", spec)
+		}
+	}
+
+	killed := run(&JobSpec{Command: "sleep 5", Timeout: 100 * time.Millisecond})
+	if killed.KilledBy != KilledByTimeout || killed.Signal != "KILL" {
+		t.Errorf("expected the job to be killed by its timeout, got killed by %q with %q", killed.KilledBy, killed.Signal)
+	}
+	after := run(&JobSpec{Command: "echo $$"})
+	if after.Stdout.String() == "" || after.Stdout.String() == first.Stdout.String() {
+		t.Errorf("expected a new worker after the last was killed, got %q", after.Stdout.String())
+	}
+}
+
+// TestIDs checks the schemes of job IDs, and that a counter kept in a file
+// goes on after a restart.
+func TestIDs(t *testing.T) {
+	start := func(m *Manager) string {
+		t.Helper()
+		id, err := m.Start(&JobSpec{Command: "true"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	counter := filepath.Join(t.TempDir(), "ids")
+	m := NewManager(DefaultConfig())
+	if err := m.UseIDs("prefix:job-", counter); err != nil {
+		t.Fatal(err)
+	}
+	if id := start(m); id != "job-1" {
+		t.Errorf("expected job-1, got %s", id)
+	}
+	m = NewManager(DefaultConfig())
+	if err := m.UseIDs("prefix:job-", counter); err != nil {
+		t.Fatal(err)
+	}
+	if id := start(m); id != "job-1001" {
+		t.Errorf("expected job-1001 after a restart, got %s", id)
+	}
+
+	m = NewManager(DefaultConfig())
+	if err := m.UseIDs("uuid", ""); err != nil {
+		t.Fatal(err)
+	}
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	var ids []string
+	for i := 0; i < 100; i++ {
+		id := m.nextID()
+		if !uuid.MatchString(id) {
+			t.Fatalf("expected a UUIDv7, got %s", id)
+		}
+		ids = append(ids, id)
+	}
+	if !slices.IsSorted(ids) {
+		t.Errorf("expected UUIDs in the order they were made, got %v", ids)
+	}
+	id := start(m)
+	if list := m.List(); len(list) != 1 || list[0].ID != id {
+		t.Errorf("expected job %s listed, got %v", id, list)
+	}
+
+	for _, scheme := range []string{"random", "prefix:", "prefix:a/b"} {
+		if err := NewManager(DefaultConfig()).UseIDs(scheme, ""); err == nil {
+			t.Errorf("expected scheme %q to be refused", scheme)
+		}
+	}
+	if err := NewManager(DefaultConfig()).UseIDs("uuid", counter); err == nil {
+		t.Errorf("expected a counter file to be refused with UUIDs")
+	}
+}
+
+// TestJournal checks the entries jobs write to the journal.
+func TestJournal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no journald on Windows")
+	}
+	socket := filepath.Join(t.TempDir(), "journal")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	defer func(path string) { journalSocket, Journal = path, false }(journalSocket)
+	journalSocket = socket
+	if err := SetJournal(true); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := NewManager(DefaultConfig()).Run(&JobSpec{Command: "echo out; echo err >&2; exit 3"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []string
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(entries) == 0 || !strings.Contains(entries[len(entries)-1], "EXIT_CODE=") {
+		buf := make([]byte, 64<<10)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("expected the job's entries, got %q: %v", entries, err)
+		}
+		entries = append(entries, string(buf[:n]))
+	}
+	common := "SYSLOG_IDENTIFIER=shellrunner\nJOB_ID=" + job.ID + "\nCOMMAND=" + job.Spec.Command + "\n"
+	want := []string{
+		"MESSAGE=out\nPRIORITY=6\n" + common + "STREAM=stdout\n",
+		"MESSAGE=err\nPRIORITY=3\n" + common + "STREAM=stderr\n",
+		"MESSAGE=Job " + job.ID + " finished with status exited and exit code 3\nPRIORITY=5\n" + common + "EXIT_CODE=3\n",
+	}
+	slices.Sort(entries[:2])
+	slices.Sort(want[:2])
+	if !slices.Equal(entries, want) {
+		t.Errorf("expected entries %q, got %q", want, entries)
+	}
+
+	var b bytes.Buffer
+	journalField(&b, "COMMAND", "a\nb")
+	if b.String() != "COMMAND\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n" {
+		t.Errorf("expected a value spanning lines to be sized, got %q", b.String())
+	}
+}
+
+// TestNotify checks that notifiers are told of the jobs that ask for them,
+// including through rules, with the tail of their stderr.
+func TestNotify(t *testing.T) {
+	posted := make(chan string, 10)
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		json.NewDecoder(r.Body).Decode(&payload)
+		posted <- payload["text"]
+	}))
+	defer slack.Close()
+	defer func(n map[string]Notifier) { Notifiers = n }(Notifiers)
+	Notifiers = map[string]Notifier{"ops": {Slack: slack.URL}}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "notify.yaml"), []byte(`
+- match:
+    labels:
+      critical: "true"
+  notify:
+    - notifier: ops
+`), 0o644)
+	rules, err := LoadRules(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(DefaultConfig())
+	m.BeforeStart(rules.Apply)
+
+	if _, err := m.Run(&JobSpec{Command: "true", Notify: []Notification{{Notifier: "ops"}}}, false); err != nil {
+		t.Fatal(err)
+	}
+	job, err := m.Run(&JobSpec{Command: "seq 30 >&2; exit 2", Labels: map[string]string{"critical": "true"}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case text := <-posted:
+		for _, want := range []string{"*Job " + job.ID + " failed: seq 30 >&2; exit 2*", "exit code 2", "Labels: critical=true", "```\n11\n12\n", "\n30\n```"} {
+			if !strings.Contains(text, want) {
+				t.Errorf("expected the notification to contain %q, got %q", want, text)
+			}
+		}
+		if strings.Contains(text, "\n10\n") {
+			t.Errorf("expected only the last 20 lines of stderr, got %q", text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a notification of the failed job")
+	}
+	if _, err := m.Run(&JobSpec{Command: "true", Notify: []Notification{{Notifier: "ops", On: NotifyAlways}}}, false); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case text := <-posted:
+		if !strings.Contains(text, "*Job succeeded: true*") {
+			t.Errorf("expected a notification of the job's success, got %q", text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a notification of the succeeded job")
+	}
+	select {
+	case text := <-posted:
+		t.Errorf("expected no notification of the job that succeeded without asking, got %q", text)
+	default:
+	}
+
+	for _, n := range []Notification{{Notifier: "nobody"}, {Notifier: "ops", On: "sometimes"}} {
+		if _, err := m.Run(&JobSpec{Command: "true", Notify: []Notification{n}}, false); !errors.Is(err, ErrInvalidSpec) {
+			t.Errorf("%+v: expected an invalid spec, got %v", n, err)
+		}
+	}
+
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("expected the Slack webhook's redirect not to be followed")
+	}))
+	defer elsewhere.Close()
+	redirect := httptest.NewServer(http.RedirectHandler(elsewhere.URL, http.StatusTemporaryRedirect))
+	defer redirect.Close()
+	if err := notifySlack(redirect.URL, "Job 1 failed: false", "", ""); err == nil {
+		t.Error("expected a redirect from the Slack webhook to fail the notification")
+	}
+
+	message := string(emailMessage(Notifier{From: "a@example.com", To: []string{"b@example.com", "c@example.com"}}, "Job 1 failed: false", "line\n"))
+	if !strings.HasPrefix(message, "From: a@example.com\r\nTo: b@example.com, c@example.com\r\nSubject: [shellrunner] Job 1 failed: false\r\n") || !strings.HasSuffix(message, "\r\n\r\nline\r\n") {
+		t.Errorf("unexpected email %q", message)
+	}
+}
+
+// TestDeadman checks that jobs that run for longer than expected and checks
+// that no job succeeds often enough raise alerts, sent to the jobs'
+// notifiers, and that a success checks in.
+func TestDeadman(t *testing.T) {
+	posted := make(chan string, 10)
+	slack := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		json.NewDecoder(r.Body).Decode(&payload)
+		posted <- payload["text"]
+	}))
+	defer slack.Close()
+	defer func(n map[string]Notifier) { Notifiers = n }(Notifiers)
+	Notifiers = map[string]Notifier{"ops": {Slack: slack.URL}}
+	m := NewManager(DefaultConfig())
+
+	job, err := m.Run(&JobSpec{Command: "sleep 0.3", Expect: &Expectation{MaxDuration: 50 * time.Millisecond}, Notify: []Notification{{Notifier: "ops"}}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !job.Overran() || job.Result != ResultSuccess {
+		t.Errorf("expected the job to have overrun and still succeeded, got overran %v and result %s", job.Overran(), job.Result)
+	}
+	alerts := m.Alerts()
+	if len(alerts) != 1 || alerts[0].Kind != AlertOverrun || alerts[0].JobID != job.ID || !strings.Contains(alerts[0].Message, "longer than the expected 50ms") {
+		t.Fatalf("expected an overrun alert of job %s, got %+v", job.ID, alerts)
+	}
+	select {
+	case text := <-posted:
+		if !strings.Contains(text, "Job: "+job.ID) {
+			t.Errorf("expected the alert to name job %s, got %q", job.ID, text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the overrun alert to be sent to the job's notifier")
+	}
+	quick, err := m.Run(&JobSpec{Command: "true", Expect: &Expectation{MaxDuration: time.Second}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quick.Overran() {
+		t.Error("expected a quick job not to overrun")
+	}
+
+	expect := &Expectation{Check: "nightly", Every: 300 * time.Millisecond}
+	first, err := m.Run(&JobSpec{Command: "true", Expect: expect}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := m.Checks()
+	if len(checks) != 1 || checks[0].Name != "nightly" || checks[0].LastJobID != first.ID || checks[0].Missed || !checks[0].Due.Equal(first.EndTime.Add(expect.Every)) {
+		t.Fatalf("expected the check to be due %v after job %s, got %+v", expect.Every, first.ID, checks)
+	}
+	if _, err := m.Run(&JobSpec{Command: "false", Expect: expect}, true); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !m.Checks()[0].Missed {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the check to be missed after a failure")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	alerts = m.Alerts()
+	if last := alerts[len(alerts)-1]; last.Kind != AlertMissed || last.Check != "nightly" || last.JobID != first.ID {
+		t.Errorf("expected a missed alert of the check naming job %s, got %+v", first.ID, last)
+	}
+	if _, err := m.Run(&JobSpec{Command: "true", Expect: &Expectation{Check: "nightly", Every: time.Hour}}, true); err != nil {
+		t.Fatal(err)
+	}
+	if c := m.Checks()[0]; c.Missed || time.Until(c.Due) < 59*time.Minute {
+		t.Errorf("expected a success to check in, got %+v", c)
+	}
+
+	for _, e := range []Expectation{{MaxDuration: -time.Second}, {Check: "nightly"}, {Every: time.Hour}, {Check: "no spaces", Every: time.Hour}} {
+		if _, err := m.Run(&JobSpec{Command: "true", Expect: &e}, false); !errors.Is(err, ErrInvalidSpec) {
+			t.Errorf("%+v: expected an invalid spec, got %v", e, err)
+		}
+	}
+}
+
+// TestTrends checks that the runs of each series of jobs are compared with
+// its baseline, raising an alert once when they become slower, and that
+// failure streaks are counted.
+func TestTrends(t *testing.T) {
+	m := NewManager(DefaultConfig())
+	expect := &Expectation{Check: "backup", Every: time.Hour}
+	run := func(command string) *Job {
+		t.Helper()
+		job, err := m.Run(&JobSpec{Command: command, Expect: expect}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return job
+	}
+	for range trendMinBaseline {
+		run("true")
+	}
+	var last *Job
+	for range trendRecent {
+		if trends := m.Trends(); trends[0].Slower {
+			t.Fatalf("expected the series not to be slower before its recent runs are, got %+v", trends[0])
+		}
+		last = run("sleep 0.2")
+	}
+	trends := m.Trends()
+	if len(trends) != 1 {
+		t.Fatalf("expected one series, got %+v", trends)
+	}
+	trend := trends[0]
+	if trend.Series != "backup" || trend.Runs != 10 || !trend.Slower || trend.Deviation < trendSlowdown || trend.Recent < 200*time.Millisecond || trend.LastJobID != last.ID || trend.SuccessRate != 1 {
+		t.Errorf("expected the backup series to be slower, got %+v", trend)
+	}
+	run("sleep 0.2")
+	var slower []Alert
+	for _, a := range m.Alerts() {
+		if a.Kind == AlertSlower {
+			slower = append(slower, a)
+		}
+	}
+	if len(slower) != 1 || slower[0].JobID != last.ID || slower[0].Check != "backup" {
+		t.Errorf("expected one alert of the series becoming slower, got %+v", slower)
+	}
+
+	for range 3 {
+		if _, err := m.Run(&JobSpec{Command: "exit  3"}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trends = m.Trends()
+	if len(trends) != 2 || trends[1].Series != "exit 3" || trends[1].FailureStreak != 3 || trends[1].SuccessRate != 0 || trends[1].LastExitCode != 3 || trends[1].Baseline != 0 {
+		t.Errorf("expected a failure streak of 3 for the command's series, got %+v", trends)
+	}
+}
+
+func TestFailureRate(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxFailureRate, config.FailureWindow = 0.2, 5
+	m := NewManager(config)
+	expect := &Expectation{MaxFailureRate: 0.5, FailureWindow: 4}
+	run := func(command string) {
+		t.Helper()
+		if _, err := m.Run(&JobSpec{Command: command, Expect: expect}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	failing := func() []Alert {
+		var alerts []Alert
+		for _, a := range m.Alerts() {
+			if a.Kind == AlertFailing {
+				alerts = append(alerts, a)
+			}
+		}
+		return alerts
+	}
+	for _, command := range []string{"exit 1", "exit 1", "exit 1"} {
+		run(command)
+	}
+	if trend := m.Trends()[0]; trend.Failing || trend.FailureRate != 1 || len(failing()) != 0 {
+		t.Errorf("expected no alert before the window is full, got %+v", trend)
+	}
+	run("exit 1")
+	if trend := m.Trends()[0]; !trend.Failing || trend.FailureWindow != 4 || trend.MaxFailureRate != 0.5 || len(failing()) != 1 {
+		t.Errorf("expected the series to be failing, got %+v, %+v", trend, failing())
+	}
+	run("exit 1")
+	if alerts := failing(); len(alerts) != 1 || !strings.Contains(alerts[0].Message, `100% of the last 4 runs of "exit 1" failed`) {
+		t.Errorf("expected a single alert while the series keeps failing, got %+v", alerts)
+	}
+
+	for range 2 {
+		run("true")
+	}
+	if trend := m.Trends()[1]; trend.Failing || trend.FailureRate != 0 {
+		t.Errorf("expected another series to be apart, got %+v", trend)
+	}
+
+	// Without a rate of its own, a series gets the server's.
+	expect = nil
+	for range 5 {
+		run("false")
+	}
+	if trend := m.Trends()[1]; trend.Series != "false" || !trend.Failing || trend.FailureWindow != 5 || trend.MaxFailureRate != 0.2 || len(failing()) != 2 {
+		t.Errorf("expected the series to be failing by the server's rate, got %+v", trend)
+	}
+
+	if _, err := m.Run(&JobSpec{Command: "true", Expect: &Expectation{MaxFailureRate: 1.5}}, false); !errors.Is(err, ErrInvalidSpec) {
+		t.Errorf("expected a rate above 1 to be rejected, got %v", err)
+	}
+}
+
+// TestOutputFilter contains unit tests for filtering job output.
+func TestOutputFilter(t *testing.T) {
+	output := "\x1b[32mok\x1b[0m test/a 0.1s\nFAIL test/b 2.5s\n--- debug noise\nok test/c 1.0s"
+	for _, tc := range []struct {
+		name   string
+		filter OutputFilter
+		want   string
+	}{
+		{"strip ansi", OutputFilter{StripANSI: true}, "ok test/a 0.1s\nFAIL test/b 2.5s\n--- debug noise\nok test/c 1.0s"},
+		{"include", OutputFilter{StripANSI: true, Include: []string{`^ok`, `^FAIL`}}, "ok test/a 0.1s\nFAIL test/b 2.5s\nok test/c 1.0s"},
+		{"exclude", OutputFilter{Exclude: []string{`^---`, `FAIL`}}, "\x1b[32mok\x1b[0m test/a 0.1s\nok test/c 1.0s"},
+		{"extract groups", OutputFilter{StripANSI: true, Extract: `^(\w+) (\S+)`}, "ok\ttest/a\nFAIL\ttest/b\nok\ttest/c"},
+		{"extract match", OutputFilter{Extract: `[\d.]+s$`}, "0.1s\n2.5s\n1.0s"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			apply, err := tc.filter.Compile()
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if got := apply(output); got != tc.want {
+				t.Errorf("expected %q, got %q", tc.want, got)
+			}
+
+			// Filtering output as it is written gives the same result,
+			// however it is split.
+			filter, _ := tc.filter.compile()
+			var out strings.Builder
+			w := &filterWriter{w: &out, filter: filter}
+			for i := 0; i < len(output); i += 7 {
+				w.Write([]byte(output[i:min(i+7, len(output))]))
+			}
+			w.Flush()
+			if got := out.String(); got != tc.want {
+				t.Errorf("expected %q when written in pieces, got %q", tc.want, got)
+			}
+		})
+	}
+
+	if _, err := (&OutputFilter{Include: []string{"("}}).Compile(); !errors.Is(err, ErrInvalidSpec) {
+		t.Errorf("expected ErrInvalidSpec for an invalid pattern, got %v", err)
+	}
+}
+
+// TestProgressParser contains unit tests for taking progress lines out of a
+// job's output.
+func TestProgressParser(t *testing.T) {
+	output := "start\n##progress 10\n##progresss\n#not progress\n##progress 42 \"uploading \\\"a\\\"\"\r\n##progress 150 too far\nend ##progress 99\n##progress 100.0% done"
+	want := "start\n##progresss\n#not progress\n##progress 150 too far\nend ##progress 99\n"
+	for _, size := range []int{1, 3, 7, len(output)} {
+		job := &Job{}
+		var out strings.Builder
+		w := &progressParser{w: &out, job: job}
+		for i := 0; i < len(output); i += size {
+			w.Write([]byte(output[i:min(i+size, len(output))]))
+		}
+		if reported, ok := job.ReportedProgress(); !ok || reported.Percent != 42 || reported.Message != `uploading "a"` {
+			t.Errorf("expected the last complete progress line, in pieces of %d, got %+v", size, reported)
+		}
+		w.Flush()
+		if got := out.String(); got != want {
+			t.Errorf("expected %q in pieces of %d, got %q", want, size, got)
+		}
+		if reported, _ := job.ReportedProgress(); reported.Percent != 100 || reported.Message != "done" {
+			t.Errorf("expected the progress line flushed at the end, got %+v", reported)
+		}
+	}
+}
+
+func TestOutputBuffer(t *testing.T) {
+	output := strings.Repeat("building target, all dependencies up to date\n", 4096)
+	var b OutputBuffer
+	b.WriteString(output)
+	b.compress(DefaultConfig().CompressThreshold)
+	if !b.Compressed() || b.Retained() >= len(output)/10 {
+		t.Fatalf("expected the output to be compressed, %d bytes retained", b.Retained())
+	}
+	if b.Len() != len(output) || b.String() != output {
+		t.Errorf("expected the output back after compression, got %d bytes", b.Len())
+	}
+
+	// Writing after compression decompresses first.
+	b.WriteString("done\n")
+	if b.Compressed() || b.String() != output+"done\n" {
+		t.Errorf("expected the output to be appended to, got %d bytes", b.Len())
+	}
+
+	var small OutputBuffer
+	small.WriteString("ok\n")
+	small.compress(DefaultConfig().CompressThreshold)
+	if small.Compressed() {
+		t.Error("expected output below the threshold to stay uncompressed")
+	}
+}
+
+func TestRingBuffer(t *testing.T) {
+	b := OutputBuffer{limit: 8}
+	b.WriteString("abcde")
+	b.WriteString("fghij")
+	if b.String() != "cdefghij" || b.Dropped() != 2 || b.Written() != 10 {
+		t.Errorf("expected the last 8 bytes, got %q with %d dropped", b.String(), b.Dropped())
+	}
+	b.Write([]byte("0123456789xy"))
+	if b.String() != "456789xy" || b.Dropped() != 14 || b.Len() != 8 {
+		t.Errorf("expected the last 8 bytes, got %q with %d dropped", b.String(), b.Dropped())
+	}
+
+	m := NewManager(DefaultConfig())
+	for _, spec := range []*JobSpec{
+		{Command: "true", CaptureMode: "circular"},
+		{Command: "true", RingBytes: 100},
+		{Command: "true", CaptureMode: CaptureRing, RingBytes: -1},
+	} {
+		if _, err := m.Run(spec, false); !errors.Is(err, ErrInvalidSpec) {
+			t.Errorf("expected %+v to be rejected, got %v", spec, err)
+		}
+	}
+}
+
+func TestParseTraceParent(t *testing.T) {
+	traceID, spanID, err := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil || traceID != "4bf92f3577b34da6a3ce929d0e0e4736" || spanID != "00f067aa0ba902b7" {
+		t.Errorf("expected the trace and span IDs, got %q, %q, %v", traceID, spanID, err)
+	}
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if _, _, err := ParseTraceParent(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestHooks(t *testing.T) {
+	m := NewManager(DefaultConfig())
+	m.BeforeStart(func(spec *JobSpec) error {
+		if spec.Labels["team"] == "" {
+			return errors.New("jobs must have a team label")
+		}
+		return nil
+	})
+	finished := make(chan string, 1)
+	m.OnFinish(func(job *Job) { finished <- job.Stdout.String() })
+
+	if _, err := m.Run(&JobSpec{Command: "true"}, false); !errors.Is(err, ErrPolicyDenied) {
+		t.Errorf("expected the hook to deny the job, got %v", err)
+	}
+	if _, err := m.Run(&JobSpec{Command: "echo ok", Labels: map[string]string{"team": "infra"}}, false); err != nil {
+		t.Fatal(err)
+	}
+	if output := <-finished; output != "ok\n" {
+		t.Errorf("expected the finished job's output, got %q", output)
+	}
+
+	dir := t.TempDir()
+	summary := filepath.Join(dir, "summary.json")
+	pre := filepath.Join(dir, "pre")
+	post := filepath.Join(dir, "post")
+	os.WriteFile(pre, []byte(`#!/bin/sh
+if grep -q forbidden; then echo "forbidden command" >&2; exit 1; fi
+echo '{"Env": {"HOOKED": "yes"}}'
+`), 0o755)
+	os.WriteFile(post, []byte("#!/bin/sh\ncat > "+summary+".tmp && mv "+summary+".tmp "+summary+"\n"), 0o755)
+	m = NewManager(DefaultConfig())
+	m.BeforeStart(PreExecScript(pre))
+	m.OnFinish(PostExecScript(post))
+
+	if _, err := m.Run(&JobSpec{Command: "echo forbidden"}, false); !errors.Is(err, ErrPolicyDenied) || !strings.Contains(err.Error(), "forbidden command") {
+		t.Errorf("expected the script to deny the job, got %v", err)
+	}
+	job, err := m.Run(&JobSpec{Command: "echo $HOOKED; exit 3"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Stdout.String() != "yes\n" {
+		t.Errorf("expected the script to set the job's environment, got %q", job.Stdout.String())
+	}
+	var data []byte
+	for start := time.Now(); data == nil && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		data, _ = os.ReadFile(summary)
+	}
+	var got HookSummary
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("expected a summary, got %q: %v", data, err)
+	}
+	if got.ExitCode != 3 || got.Result != ResultFailure || got.StdoutTail != "yes\n" {
+		t.Errorf("unexpected summary: %+v", got)
+	}
+}
+
+func TestRules(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "10-deny.yaml"), []byte(`
+- name: no-rm-root
+  match:
+    command: 'rm\s+-rf\s+/(\s|$)'
+  deny: refusing to remove /
+`), 0o644)
+	os.WriteFile(filepath.Join(dir, "20-builds.yml"), []byte(`
+- match:
+    command: '^make\b'
+  rewrite: 'nice $0'
+  labels:
+    kind: build
+- match:
+    labels:
+      kind: build
+  env:
+    CI: "true"
+  filter:
+    stripansi: true
+`), 0o644)
+	rules, err := LoadRules(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules.Len() != 3 {
+		t.Errorf("expected 3 rules, got %d", rules.Len())
+	}
+
+	if err := rules.Apply(&JobSpec{Command: "rm -rf /"}); !errors.Is(err, ErrPolicyDenied) || !strings.Contains(err.Error(), "no-rm-root") {
+		t.Errorf("expected the rule to deny the job, got %v", err)
+	}
+	spec := &JobSpec{Command: "make test", Filter: &OutputFilter{Exclude: []string{"^debug"}}}
+	if err := rules.Apply(spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.Command != "nice make test" || spec.Labels["kind"] != "build" || spec.Env["CI"] != "true" {
+		t.Errorf("expected the job to be rewritten and tagged, got %q, %v, %v", spec.Command, spec.Labels, spec.Env)
+	}
+	if !spec.Filter.StripANSI || !slices.Equal(spec.Filter.Exclude, []string{"^debug"}) {
+		t.Errorf("expected the rule's filter to be merged, got %+v", spec.Filter)
+	}
+	spec = &JobSpec{Argv: []string{"ls", "-l"}}
+	if err := rules.Apply(spec); err != nil || spec.Labels != nil || spec.Filter != nil {
+		t.Errorf("expected other jobs to be left alone, got %+v, %v", spec, err)
+	}
+
+	// Invalid rules are rejected, keeping the ones in use.
+	os.WriteFile(filepath.Join(dir, "30-bad.yaml"), []byte("- match:\n    command: '('\n"), 0o644)
+	if err := rules.Reload(); err == nil {
+		t.Error("expected an invalid pattern to be rejected")
+	}
+	if rules.Len() != 3 {
+		t.Errorf("expected the rules in use to be kept, got %d", rules.Len())
+	}
+	os.WriteFile(filepath.Join(dir, "30-bad.yaml"), []byte("- deny: no jobs today\n"), 0o644)
+	if err := rules.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rules.Apply(&JobSpec{Command: "true"}); !errors.Is(err, ErrPolicyDenied) {
+		t.Errorf("expected the reloaded rules to deny every job, got %v", err)
+	}
+}
+
+func TestRuleScripts(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "10-policy.star"), []byte(`
+def apply(job):
+    if job["executor"] == "local" and "curl " in job["command"]:
+        deny("no network for " + job["labels"].get("team", "anyone"))
+    if job["command"].startswith("make "):
+        job["command"] = "nice " + job["command"]
+        job["labels"]["kind"] = "build"
+        job["notify"].append("ops:failure")
+        job["filter"] = {"exclude": ["^debug"], "stripansi": True}
+`), 0o644)
+	os.WriteFile(filepath.Join(dir, "20-env.yaml"), []byte(`
+- match:
+    labels:
+      kind: build
+  env:
+    CI: "true"
+`), 0o644)
+	rules, err := LoadRules(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules.Len() != 2 {
+		t.Errorf("expected 2 rules, got %d", rules.Len())
+	}
+
+	err = rules.Apply(&JobSpec{Command: "curl example.com", Labels: map[string]string{"team": "web"}})
+	if !errors.Is(err, ErrPolicyDenied) || !strings.Contains(err.Error(), "10-policy.star: no network for web") {
+		t.Errorf("expected the script to deny the job, got %v", err)
+	}
+	spec := &JobSpec{Command: "make test"}
+	if err := rules.Apply(spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.Command != "nice make test" || spec.Labels["kind"] != "build" || spec.Env["CI"] != "true" {
+		t.Errorf("expected the job to be rewritten and tagged, got %q, %v, %v", spec.Command, spec.Labels, spec.Env)
+	}
+	if !slices.Equal(spec.Notify, []Notification{{Notifier: "ops", On: "failure"}}) || !spec.Filter.StripANSI || !slices.Equal(spec.Filter.Exclude, []string{"^debug"}) {
+		t.Errorf("expected the script's notification and filter, got %v, %+v", spec.Notify, spec.Filter)
+	}
+	spec = &JobSpec{Argv: []string{"ls", "-l"}}
+	if err := rules.Apply(spec); err != nil || !slices.Equal(spec.Argv, []string{"ls", "-l"}) || spec.Labels != nil || spec.Filter != nil {
+		t.Errorf("expected other jobs to be left alone, got %+v, %v", spec, err)
+	}
+
+	// Scripts that fail deny the job.
+	for _, script := range []string{
+		"def apply(job):\n    job[\"labels\"] = 1\n",
+		"def apply(job):\n    fail(\"broken\")\n",
+		"def apply(job):\n    for i in range(100000000):\n        pass\n",
+	} {
+		os.WriteFile(filepath.Join(dir, "10-policy.star"), []byte(script), 0o644)
+		if err := rules.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		if err := rules.Apply(&JobSpec{Command: "true"}); !errors.Is(err, ErrPolicyDenied) {
+			t.Errorf("%q: expected the job to be denied, got %v", script, err)
+		}
+	}
+
+	// Invalid scripts are rejected, keeping the rules in use.
+	for _, script := range []string{"def apply(job)\n", "def check(job):\n    pass\n", "load(\"other.star\", \"x\")\n"} {
+		os.WriteFile(filepath.Join(dir, "10-policy.star"), []byte(script), 0o644)
+		if err := rules.Reload(); err == nil {
+			t.Errorf("%q: expected the script to be rejected", script)
+		}
+		if rules.Len() != 2 {
+			t.Errorf("%q: expected the rules in use to be kept, got %d", script, rules.Len())
+		}
+	}
+}
+
+// TestRulesRerun checks that rerunning or exporting a job a rule changed
+// starts from the spec it was submitted with, so that the rule is applied
+// once rather than again on top of its own changes.
+func TestRulesRerun(t *testing.T) {
+	defer func(n map[string]Notifier) { Notifiers = n }(Notifiers)
+	Notifiers = map[string]Notifier{"ops": {Slack: "http://127.0.0.1:1"}}
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "rules.yaml"), []byte(`
+- match:
+    command: '^echo'
+  rewrite: 'echo ruled; $0'
+  notify:
+    - notifier: ops
+  filter:
+    exclude: ['^debug']
+`), 0o644)
+	rules, err := LoadRules(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(DefaultConfig())
+	m.BeforeStart(rules.Apply)
+
+	job, err := m.Run(&JobSpec{Command: "echo hi"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := m.Rerun(job.ID, Identity{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec *JobSpec
+	var stdout string
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		finished := false
+		m.WithJob(id, func(job *Job) error {
+			finished, spec, stdout = job.Finished(), job.Spec, job.Stdout.String()
+			return nil
+		})
+		if finished {
+			break
+		}
+	}
+	if spec.Command != "echo ruled; echo hi" || len(spec.Notify) != 1 || len(spec.Filter.Exclude) != 1 || stdout != "ruled\nhi\n" {
+		t.Errorf("expected the rule to be applied once to the rerun, got %q, %v, %+v, %q", spec.Command, spec.Notify, spec.Filter, stdout)
+	}
+	for _, record := range m.Export() {
+		if record.Spec.Command != "echo hi" || len(record.Spec.Notify) != 0 || record.Spec.Filter != nil {
+			t.Errorf("expected job %s to be exported as submitted, got %+v", record.ID, record.Spec)
+		}
+	}
+}
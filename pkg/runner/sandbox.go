@@ -0,0 +1,116 @@
+package runner
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// SandboxOptions configures running a job inside a bubblewrap sandbox, which
+// sees a read-only view of the host's filesystem, a private /tmp, and its own
+// PID and IPC namespaces.
+type SandboxOptions struct {
+	NoNetwork bool     // run without network access
+	Binds     []string // host directories mounted read-write, within the allowlist
+}
+
+// SandboxConfig holds the sandbox settings shared by all jobs of a Manager.
+type SandboxConfig struct {
+	Always    bool     // sandbox every job, even those not asking for it
+	NoNetwork bool     // deny network access to every sandboxed job
+	BindAllow []string // directories jobs may mount read-write
+}
+
+// SetSandboxBindAllow sets the directories jobs may mount read-write, given
+// as a comma-separated list.
+func (c *Config) SetSandboxBindAllow(list string) error {
+	dirs, err := resolveDirs(list)
+	if err != nil {
+		return err
+	}
+	c.Sandbox.BindAllow = dirs
+	return nil
+}
+
+// resolveDirs resolves a comma-separated list of directories to absolute
+// paths without symlinks, for withinDirs.
+func resolveDirs(list string) ([]string, error) {
+	var dirs []string
+	for _, dir := range strings.Split(list, ",") {
+		if dir == "" {
+			continue
+		}
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return nil, err
+		}
+		abs, err := filepath.Abs(resolved)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, abs)
+	}
+	return dirs, nil
+}
+
+// resolveSandbox combines a job's sandbox options with the server-wide
+// settings in config and validates its bind mounts against the allowlist.
+// It returns nil if the job is not sandboxed.
+func resolveSandbox(opts *SandboxOptions, config SandboxConfig) (*SandboxOptions, error) {
+	if opts == nil {
+		if !config.Always {
+			return nil, nil
+		}
+		opts = &SandboxOptions{}
+	}
+
+	resolved := &SandboxOptions{NoNetwork: opts.NoNetwork || config.NoNetwork}
+	for _, bind := range opts.Binds {
+		if !filepath.IsAbs(bind) {
+			return nil, fmt.Errorf("sandbox bind mount %q is not an absolute path", bind)
+		}
+		// Resolve symlinks so that a link inside an allowed directory can't
+		// expose a path outside of it.
+		path, err := filepath.EvalSymlinks(bind)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sandbox bind mount: %v", err)
+		}
+		if !withinDirs(path, config.BindAllow) {
+			return nil, withKind(ErrPolicyDenied, fmt.Errorf("sandbox bind mount %s is not in the allowlist", bind))
+		}
+		resolved.Binds = append(resolved.Binds, path)
+	}
+	return resolved, nil
+}
+
+// withinDirs reports whether path is inside one of dirs.
+func withinDirs(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// bwrapArgs returns the bubblewrap argv prefix that runs a command in the
+// sandbox.
+func (o *SandboxOptions) bwrapArgs() []string {
+	args := []string{
+		"bwrap",
+		"--ro-bind", "/", "/",
+		"--dev", "/dev",
+		"--proc", "/proc",
+		"--tmpfs", "/tmp",
+		"--unshare-pid",
+		"--unshare-ipc",
+		"--die-with-parent",
+	}
+	if o.NoNetwork {
+		args = append(args, "--unshare-net")
+	}
+	for _, bind := range o.Binds {
+		args = append(args, "--bind", bind, bind)
+	}
+	return append(args, "--")
+}
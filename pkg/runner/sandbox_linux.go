@@ -0,0 +1,18 @@
+package runner
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// applySandbox arranges for cmd to run inside the sandbox described by opts,
+// if any.
+func applySandbox(cmd *exec.Cmd, opts *SandboxOptions) error {
+	if opts == nil || cmd.Err != nil {
+		return nil
+	}
+	if err := wrapCommand(cmd, opts.bwrapArgs()...); err != nil {
+		return fmt.Errorf("sandboxing requires bubblewrap: %v", err)
+	}
+	return nil
+}
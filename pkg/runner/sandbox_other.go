@@ -0,0 +1,16 @@
+//go:build !linux
+
+package runner
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// applySandbox fails for sandboxed jobs, as bubblewrap only runs on Linux.
+func applySandbox(cmd *exec.Cmd, opts *SandboxOptions) error {
+	if opts != nil {
+		return fmt.Errorf("sandboxing is only supported on Linux")
+	}
+	return nil
+}
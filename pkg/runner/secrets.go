@@ -0,0 +1,223 @@
+package runner
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redacted replaces the values of secrets in job output.
+const redacted = "[REDACTED]"
+
+// Secrets holds named secrets that jobs can have set as environment
+// variables, so that their values never appear in commands, specs or logs.
+// The values are kept in memory and, once UseFile has been called, in a file
+// encrypted with AES-GCM.
+type Secrets struct {
+	mu     sync.Mutex
+	values map[string]secret
+	path   string
+	key    []byte
+}
+
+type secret struct {
+	Value   string    `json:"value"`
+	Updated time.Time `json:"updated"`
+}
+
+// SecretInfo describes a secret without its value.
+type SecretInfo struct {
+	Name    string    `json:"name"`
+	Updated time.Time `json:"updated_at"`
+}
+
+// UseFile loads the secrets stored in the file at path, if it exists, and
+// saves them there after every change from then on. key is the AES key the
+// file is encrypted with, of 16, 24 or 32 bytes.
+func (s *Secrets) UseFile(path string, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if len(data) < gcm.NonceSize() {
+			return fmt.Errorf("secrets file %s is truncated", path)
+		}
+		plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+		if err != nil {
+			return fmt.Errorf("decrypting secrets file %s: wrong key or corrupt file", path)
+		}
+		if err := json.Unmarshal(plain, &s.values); err != nil {
+			return fmt.Errorf("reading secrets file %s: %w", path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	s.path, s.key = path, key
+	return nil
+}
+
+// save writes the secrets to their file, if they have one. The caller must
+// hold s.mu.
+func (s *Secrets) save() error {
+	if s.path == "" {
+		return nil
+	}
+	plain, err := json.Marshal(s.values)
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that a crash cannot leave the
+	// secrets half written.
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, gcm.Seal(nonce, nonce, plain, nil), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Set stores a secret, replacing any secret of the same name.
+func (s *Secrets) Set(name, value string) error {
+	if name == "" {
+		return withKind(ErrInvalidSpec, fmt.Errorf("secrets need a name"))
+	}
+	if value == "" {
+		return withKind(ErrInvalidSpec, fmt.Errorf("secret %q has an empty value", name))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]secret)
+	}
+	s.values[name] = secret{Value: value, Updated: time.Now()}
+	Logger.Printf("Set secret %s", name)
+	return s.save()
+}
+
+// Delete removes a secret.
+func (s *Secrets) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.values[name]; !ok {
+		return withKind(ErrSecretNotFound, fmt.Errorf("secret %s not found", name))
+	}
+	delete(s.values, name)
+	Logger.Printf("Deleted secret %s", name)
+	return s.save()
+}
+
+// List returns the names of the secrets, in order, and when each was set.
+func (s *Secrets) List() []SecretInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]SecretInfo, 0, len(s.values))
+	for name, secret := range s.values {
+		list = append(list, SecretInfo{Name: name, Updated: secret.Updated})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// environ returns the environment variables refs sets, as NAME=value pairs,
+// from the references of a JobSpec's Secrets.
+func (s *Secrets) environ(refs map[string]string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	env := make(map[string]string, len(refs))
+	for variable, name := range refs {
+		secret, ok := s.values[name]
+		if !ok {
+			return nil, withKind(ErrInvalidSpec, fmt.Errorf("secret %s for %s not found", name, variable))
+		}
+		env[variable] = secret.Value
+	}
+	return environ(env), nil
+}
+
+// redactor returns a writer to w that replaces the values of the secrets
+// spec uses, as they are now, or nil if spec uses none.
+func (s *Secrets) redactor(spec *JobSpec, w io.Writer) *redactor {
+	if len(spec.Secrets) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var values []string
+	for _, name := range spec.Secrets {
+		if secret, ok := s.values[name]; ok {
+			values = append(values, secret.Value)
+		}
+	}
+	// Longer values go first, so that a value containing another is
+	// redacted whole.
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	pairs := make([]string, 0, 2*len(values))
+	for _, value := range values {
+		pairs = append(pairs, value, redacted)
+	}
+	return &redactor{w: w, values: values, replacer: strings.NewReplacer(pairs...)}
+}
+
+// redactor is a writer that replaces the values of secrets in the output of
+// a job before passing it on. As a value may be split across writes, the end
+// of each write is held back for as long as it could be the start of one.
+type redactor struct {
+	w        io.Writer
+	values   []string
+	replacer *strings.Replacer
+	pending  string
+}
+
+func (r *redactor) Write(p []byte) (int, error) {
+	text := r.replacer.Replace(r.pending + string(p))
+	keep := 0
+	for _, value := range r.values {
+		for n := min(len(value)-1, len(text)); n > keep; n-- {
+			if strings.HasSuffix(text, value[:n]) {
+				keep = n
+				break
+			}
+		}
+	}
+	r.pending = text[len(text)-keep:]
+	if _, err := io.WriteString(r.w, text[:len(text)-keep]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush passes on the output held back, once the job has exited.
+func (r *redactor) Flush() error {
+	_, err := io.WriteString(r.w, r.pending)
+	r.pending = ""
+	return err
+}
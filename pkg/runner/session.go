@@ -0,0 +1,58 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// session links the terminal of an interactive job to the client attached to it.
+type session struct {
+	mu     sync.Mutex
+	output *OutputBuffer
+	client io.WriteCloser
+}
+
+// Write captures terminal output into the job's buffer and forwards it to the
+// attached client, if any.
+func (s *session) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, err := s.output.Write(p)
+	if s.client != nil {
+		if _, err := s.client.Write(p); err != nil {
+			// The client is gone; Attach hangs up the terminal.
+			s.client = nil
+		}
+	}
+	return n, err
+}
+
+// attach makes conn the session's client after replaying the output so far.
+func (s *session) attach(conn io.WriteCloser) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return fmt.Errorf("a client is already attached")
+	}
+	if s.output.Len() > 0 {
+		if _, err := conn.Write(s.output.Bytes()); err != nil {
+			return err
+		}
+	}
+	s.client = conn
+	return nil
+}
+
+// close disconnects the attached client, if any.
+func (s *session) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		s.client.Close()
+		s.client = nil
+	}
+}
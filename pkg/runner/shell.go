@@ -0,0 +1,140 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// interpreters maps the names accepted by the -shell flag to the argv prefix
+// used to run a command string.
+var interpreters = map[string][]string{
+	"bash":       {"bash", "-c"},
+	"sh":         {"sh", "-c"},
+	"cmd":        {"cmd", "/S", "/C"},
+	"powershell": {"powershell", "-NoProfile", "-NonInteractive", "-Command"},
+	"pwsh":       {"pwsh", "-NoProfile", "-NonInteractive", "-Command"},
+}
+
+// shell is the argv prefix used to run command strings. It defaults to the
+// platform's native interpreter.
+var shell = interpreters[DefaultShell]
+
+// SetShell selects the interpreter used for command strings by name.
+func SetShell(name string) error {
+	prefix, ok := interpreters[name]
+	if !ok {
+		return fmt.Errorf("unknown shell %q", name)
+	}
+	shell = prefix
+	return nil
+}
+
+// shellCommand builds an exec.Cmd that runs command through the configured
+// interpreter.
+func shellCommand(command string) *exec.Cmd {
+	args := make([]string, 0, len(shell))
+	args = append(append(args, shell[1:]...), command)
+	var cmd *exec.Cmd
+	if path := shellPath(); path != "" {
+		cmd = exec.Command(path, args...)
+		cmd.Args[0] = shell[0]
+	} else {
+		cmd = exec.Command(shell[0], args...)
+	}
+	setCommandLine(cmd, command)
+	return cmd
+}
+
+// resolvedShell is where shellPath last found the interpreter, and for
+// which $PATH.
+var resolvedShell struct {
+	sync.Mutex
+	name, env, path string
+}
+
+// shellPath returns the path of the interpreter for command strings as
+// found in $PATH, or "" if it is not there. Looking it up stats every
+// directory in $PATH before it, so the path is looked up again only once
+// $PATH or the interpreter changes.
+func shellPath() string {
+	env := os.Getenv("PATH")
+	resolvedShell.Lock()
+	defer resolvedShell.Unlock()
+	if resolvedShell.name != shell[0] || resolvedShell.env != env {
+		path, err := exec.LookPath(shell[0])
+		if err != nil {
+			// exec.Command reports the error when the command is started.
+			return ""
+		}
+		resolvedShell.name, resolvedShell.env, resolvedShell.path = shell[0], env, path
+	}
+	return resolvedShell.path
+}
+
+// wrapCommand makes cmd execute its original argv through a wrapper program,
+// given as the wrapper's own argv. The wrapper is expected to exec the argv
+// appended to it.
+func wrapCommand(cmd *exec.Cmd, wrapper ...string) error {
+	path, err := exec.LookPath(wrapper[0])
+	if err != nil {
+		return err
+	}
+	args := append(append([]string{}, wrapper...), cmd.Path)
+	cmd.Args = append(args, cmd.Args[1:]...)
+	cmd.Path = path
+	return nil
+}
+
+// safeWord matches the arguments a POSIX shell passes through as they are.
+var safeWord = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// Quote joins argv into a command line for a POSIX shell, such as bash or
+// sh, that runs argv as it is. Arguments with characters the shell would
+// interpret, such as spaces, quotes or $, are single-quoted.
+func Quote(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		// A first word with an = would be taken for an assignment.
+		if safeWord.MatchString(arg) && (i > 0 || !strings.Contains(arg, "=")) {
+			quoted[i] = arg
+		} else {
+			quoted[i] = quoteArgs([]string{arg})
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// QuoteCommand joins argv into a command string for the interpreter of
+// command strings, as Quote does for a POSIX shell. PowerShell gets each
+// argument single-quoted and the program called with &. Command lines for
+// cmd cannot be quoted safely, since it expands %variables% even in quotes.
+func QuoteCommand(argv []string) (string, error) {
+	if len(argv) == 0 {
+		return "", withKind(ErrInvalidSpec, fmt.Errorf("nothing to quote"))
+	}
+	switch shell[0] {
+	case "bash", "sh":
+		return Quote(argv), nil
+	case "powershell", "pwsh":
+		quoted := make([]string, len(argv))
+		for i, arg := range argv {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", "''") + "'"
+		}
+		return "& " + strings.Join(quoted, " "), nil
+	}
+	return "", withKind(ErrInvalidSpec, fmt.Errorf("commands for the %s shell cannot be quoted safely; use argv instead", shell[0]))
+}
+
+// quoteArgs joins argv into a command line for a POSIX shell, single-quoting
+// each argument so that the shell passes it through verbatim.
+func quoteArgs(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
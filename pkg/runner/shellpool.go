@@ -0,0 +1,273 @@
+package runner
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// shellWorker is a long-lived shell that reads the commands it runs from a
+// pipe, and ends each command's output with a token that no command can
+// know, followed by its exit status on stdout.
+type shellWorker struct {
+	cmd            *exec.Cmd
+	input          *os.File // the write end of the shell's stdin
+	stdout, stderr *os.File // the read ends of its stdout and stderr
+	token          string
+	exited         chan struct{} // closed once the shell has exited
+	err            error         // how the shell exited, once it has
+}
+
+// shellPool holds the shell workers of a Manager, up to size of them; see
+// Config.ShellWorkers.
+type shellPool struct {
+	size    int // see Config.ShellWorkers
+	mu      sync.Mutex
+	idle    []*shellWorker
+	started int // workers started and not discarded
+}
+
+func newShellPool(size int) *shellPool {
+	return &shellPool{size: size}
+}
+
+// runsOnWorker reports whether the prepared command of job can be run by a
+// shell worker.
+func (p *shellPool) runsOnWorker(job *Job, command *exec.Cmd) bool {
+	spec := job.Spec
+	switch {
+	case p.size <= 0 || runtime.GOOS == "windows":
+		return false
+	case shell[0] != "bash" && shell[0] != "sh":
+		return false
+	case spec.Executor != "local" || spec.Command == "" || spec.Pty || spec.StdinOpen || job.cgroup != nil:
+		return false
+	}
+	// Anything that changes how the command is run shows in the command:
+	// its environment or directory, or a wrapper, such as nice or bwrap,
+	// running the shell.
+	args := append(slices.Clip(shell), spec.Command)
+	return slices.Equal(command.Args, args) &&
+		command.Env == nil && command.Dir == "" && command.Stdin == nil && command.SysProcAttr == nil
+}
+
+// get returns an idle worker, or a new one if fewer than size have
+// been started, or nil if every worker is busy.
+func (p *shellPool) get() *shellWorker {
+	p.mu.Lock()
+	for len(p.idle) > 0 {
+		w := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		select {
+		case <-w.exited:
+			p.started--
+			w.close()
+		default:
+			p.mu.Unlock()
+			return w
+		}
+	}
+	if p.started >= p.size {
+		p.mu.Unlock()
+		return nil
+	}
+	p.started++
+	p.mu.Unlock()
+
+	w, err := startShellWorker()
+	if err != nil {
+		Logger.Printf("Cannot start a shell worker: %v", err)
+		p.mu.Lock()
+		p.started--
+		p.mu.Unlock()
+		return nil
+	}
+	return w
+}
+
+// put gives back a worker taken with get once its job has finished, to be
+// reused if it is still fit to run commands, or discarded otherwise.
+func (p *shellPool) put(w *shellWorker, fit bool) {
+	if !fit {
+		w.discard()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-w.exited:
+		p.started--
+		w.close()
+	default:
+		p.idle = append(p.idle, w)
+	}
+}
+
+// startShellWorker starts a shell that reads commands from a pipe.
+func startShellWorker() (*shellWorker, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	w := &shellWorker{token: "shellrunner-" + hex.EncodeToString(token), exited: make(chan struct{})}
+
+	var files [6]*os.File // the ends of the shell's stdin, stdout and stderr
+	for i := 0; i < len(files); i += 2 {
+		r, pw, err := os.Pipe()
+		if err != nil {
+			for _, f := range files[:i] {
+				f.Close()
+			}
+			return nil, err
+		}
+		files[i], files[i+1] = r, pw
+	}
+	inR, stdoutW, stderrW := files[0], files[3], files[5]
+	w.input, w.stdout, w.stderr = files[1], files[2], files[4]
+
+	w.cmd = exec.Command(shell[0])
+	if path := shellPath(); path != "" {
+		w.cmd.Path = path
+	}
+	w.cmd.Stdin = inR
+	_, wait, err := startCommand(w.cmd, TerminalOptions{}, stdoutW, stderrW)
+	// The shell has its own copies of its ends now.
+	inR.Close()
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		w.close()
+		return nil, err
+	}
+	go func() {
+		w.err = wait()
+		close(w.exited)
+	}()
+	Logger.Printf("Started shell worker %d", w.cmd.Process.Pid)
+	return w, nil
+}
+
+// run has the worker run command, the prepared command of a job, writing
+// its output to stdout and stderr, and returns the function that waits for
+// it to finish. The command's Process is the worker's, so that signalling
+// the job signals the worker's process group, which the command runs in.
+func (w *shellWorker) run(command *exec.Cmd, script string, stdout, stderr io.Writer) (func() error, error) {
+	line := fmt.Sprintf("( eval %s ) </dev/null; printf '%s %%d\\n' $?; printf '%s\\n' >&2\n", quoteArgs([]string{script}), w.token, w.token)
+	if _, err := io.WriteString(w.input, line); err != nil {
+		return nil, err
+	}
+	command.Process = w.cmd.Process
+
+	wait := func() error {
+		stderrDone := make(chan error, 1)
+		go func() {
+			_, err := copyUntil(stderr, w.stderr, []byte(w.token+"\n"))
+			stderrDone <- err
+		}()
+		status, err := copyUntil(stdout, w.stdout, []byte(w.token+" "))
+		if err == nil {
+			status, err = readLine(w.stdout, status)
+		}
+		if stderrErr := <-stderrDone; err == nil {
+			err = stderrErr
+		}
+		if err != nil {
+			// The worker died, or was killed, before the command finished:
+			// the job ends as the worker did.
+			w.discard()
+			command.ProcessState = w.cmd.ProcessState
+			return w.err
+		}
+		code, err := strconv.Atoi(string(status))
+		if err != nil {
+			w.discard()
+			return fmt.Errorf("shell worker reported exit status %q", status)
+		}
+		if code != 0 {
+			return &shellExit{code: code}
+		}
+		return nil
+	}
+	return wait, nil
+}
+
+// discard kills the worker, if it has not exited yet, and waits for it to.
+func (w *shellWorker) discard() {
+	select {
+	case <-w.exited:
+	default:
+		signalProcessGroup(w.cmd.Process, syscall.SIGKILL)
+		<-w.exited
+	}
+}
+
+// close closes the worker's ends of its pipes.
+func (w *shellWorker) close() {
+	w.input.Close()
+	w.stdout.Close()
+	w.stderr.Close()
+}
+
+// shellExit is the non-zero exit status of a command run by a shell worker.
+type shellExit struct {
+	code int
+}
+
+func (e *shellExit) Error() string {
+	return "exit status " + strconv.Itoa(e.code)
+}
+
+// ExitCode returns the exit status, like exec.ExitError's.
+func (e *shellExit) ExitCode() int {
+	return e.code
+}
+
+// copyUntil copies from r to w until delim, which is not copied, and returns
+// what was read after it.
+func copyUntil(w io.Writer, r io.Reader, delim []byte) ([]byte, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	pending := 0
+	for {
+		n, err := r.Read((*buf)[pending:])
+		pending += n
+		if i := bytes.Index((*buf)[:pending], delim); i >= 0 {
+			w.Write((*buf)[:i])
+			return bytes.Clone((*buf)[i+len(delim) : pending]), nil
+		}
+		// What could be the start of delim is held back.
+		keep := min(pending, len(delim)-1)
+		w.Write((*buf)[:pending-keep])
+		copy(*buf, (*buf)[pending-keep:pending])
+		pending = keep
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+}
+
+// readLine returns the line read starts, reading the rest of it from r.
+func readLine(r io.Reader, read []byte) ([]byte, error) {
+	var b [32]byte
+	for {
+		if i := bytes.IndexByte(read, '\n'); i >= 0 {
+			return read[:i], nil
+		}
+		n, err := r.Read(b[:])
+		read = append(read, b[:n]...)
+		if err != nil && n == 0 {
+			return nil, err
+		}
+	}
+}
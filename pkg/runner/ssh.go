@@ -0,0 +1,114 @@
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SSHHost describes a remote host that jobs can run on.
+type SSHHost struct {
+	Address      string // host name or IP address
+	User         string // remote user, defaulting to ssh's choice
+	Port         int    // defaults to 22
+	IdentityFile string // private key to authenticate with
+}
+
+// LoadSSHHosts reads SSHHosts from a JSON file holding an object that maps
+// each alias to an SSHHost.
+func (c *Config) LoadSSHHosts(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	hosts := map[string]SSHHost{}
+	if err := json.Unmarshal(data, &hosts); err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+	for alias, host := range hosts {
+		if host.Address == "" {
+			return fmt.Errorf("host %q has no address", alias)
+		}
+	}
+	c.SSHHosts = hosts
+	return nil
+}
+
+// sshExecutor runs jobs on a configured remote host with the ssh client.
+// Authentication is by key only, as there is nobody to answer a password
+// prompt, and the host's key must already be known.
+type sshExecutor struct{}
+
+// Command builds the ssh invocation for the job. A command string is run by
+// the remote user's shell, while an argv is quoted so that the remote shell
+// passes it through unchanged.
+func (sshExecutor) Command(spec *JobSpec) (*exec.Cmd, error) {
+	host, ok := spec.config.SSHHosts[spec.Host]
+	if !ok {
+		return nil, fmt.Errorf("unknown host %q", spec.Host)
+	}
+	if spec.Limits != (ResourceLimits{}) || spec.Cgroup != (CgroupLimits{}) || spec.Nice != 0 || spec.IONice != "" || spec.CPUSet != "" || spec.Sandbox != nil || spec.Container != nil || spec.Kubernetes != nil {
+		return nil, fmt.Errorf("limits, cgroup, nice, ionice, CPU set, sandbox, container and kubernetes options are not supported for remote jobs")
+	}
+	if len(spec.Secrets) > 0 {
+		// The values would have to be put on the remote command line.
+		return nil, fmt.Errorf("secrets are not supported for remote jobs")
+	}
+
+	args := []string{"-o", "BatchMode=yes"}
+	if spec.Pty {
+		// A remote terminal also makes the remote command exit with
+		// SIGHUP when the job is killed.
+		args = append(args, "-tt")
+	} else {
+		args = append(args, "-T")
+	}
+	if host.User != "" {
+		args = append(args, "-l", host.User)
+	}
+	if host.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(host.Port))
+	}
+	if host.IdentityFile != "" {
+		args = append(args, "-i", host.IdentityFile, "-o", "IdentitiesOnly=yes")
+	}
+	command := spec.Command
+	if len(spec.Argv) > 0 {
+		command = quoteArgs(spec.Argv)
+	}
+	// The remote shell sets up the environment and working directory.
+	var setup strings.Builder
+	for _, pair := range environ(spec.environment()) {
+		if name, _, _ := strings.Cut(pair, "="); !isShellName(name) {
+			return nil, fmt.Errorf("invalid environment variable name %q for a remote job", name)
+		}
+		setup.WriteString("export " + quoteArgs([]string{pair}) + "; ")
+	}
+	if spec.Dir != "" {
+		setup.WriteString("cd " + quoteArgs([]string{spec.Dir}) + " || exit 1; ")
+	}
+	command = setup.String() + command
+	args = append(args, "--", host.Address, command)
+	return exec.Command("ssh", args...), nil
+}
+
+// Signal delivers sig to the local ssh client. Without a terminal, the remote
+// command only notices that it was killed once it writes to the closed
+// connection.
+func (sshExecutor) Signal(spec *JobSpec, cmd *exec.Cmd, sig syscall.Signal) error {
+	return signalProcessGroup(cmd.Process, sig)
+}
+
+// isShellName reports whether name is a valid shell variable name.
+func isShellName(name string) bool {
+	for i, c := range name {
+		if !(c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return name != ""
+}
@@ -0,0 +1,139 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// StdinWriteTimeout is how long WriteStdin waits for a job to read the
+// input it is given before giving up.
+var StdinWriteTimeout = 10 * time.Second
+
+// stdinPipe is the write end of the standard input of a job started with
+// StdinOpen.
+type stdinPipe struct {
+	mutex  sync.Mutex // serializes writes
+	w      *os.File
+	closed bool
+}
+
+// openStdin gives cmd a pipe as its standard input, after what it reads
+// already, if anything, which is written to the pipe first. It returns the
+// pipe and the function to call once cmd has started, which closes the
+// read end the job's process now holds.
+func openStdin(cmd *exec.Cmd) (*stdinPipe, func(), error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	pipe := &stdinPipe{w: w}
+	if input := cmd.Stdin; input != nil {
+		pipe.mutex.Lock()
+		go func() {
+			defer pipe.mutex.Unlock()
+			io.Copy(w, input)
+		}()
+	}
+	cmd.Stdin = r
+	return pipe, func() { r.Close() }, nil
+}
+
+// write writes data to the pipe, waiting at most StdinWriteTimeout for
+// the job to read it.
+func (p *stdinPipe) write(id string, data []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return 0, withKind(ErrJobState, fmt.Errorf("the input of job %s is closed", id))
+	}
+	// Deadlines are not supported for pipes on every platform, where the
+	// write blocks instead.
+	p.w.SetWriteDeadline(time.Now().Add(StdinWriteTimeout))
+	n, err := p.w.Write(data)
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return n, withKind(ErrJobState, fmt.Errorf("job %s did not read its input within %v", id, StdinWriteTimeout))
+	case errors.Is(err, syscall.EPIPE):
+		return n, withKind(ErrJobState, fmt.Errorf("job %s is no longer reading its input", id))
+	}
+	return n, err
+}
+
+// close closes the pipe, so that the job reads the end of its input.
+func (p *stdinPipe) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.closed {
+		p.closed = true
+		p.w.Close()
+	}
+}
+
+// stdinOf returns the pipe of the running job with the given ID, if it was
+// started with StdinOpen.
+func (m *Manager) stdinOf(id string) (*stdinPipe, error) {
+	var pipe *stdinPipe
+	err := m.WithJob(id, func(job *Job) error {
+		if job.stdin == nil {
+			return withKind(ErrJobState, fmt.Errorf("job with id %s was not started with an open stdin", id))
+		}
+		if job.Finished() {
+			return withKind(ErrJobState, fmt.Errorf("job with id %s is not running", id))
+		}
+		pipe = job.stdin
+		return nil
+	})
+	return pipe, err
+}
+
+// WriteStdin writes data to the standard input of a running job started
+// with StdinOpen, such as the answer to a prompt, and returns how much of
+// it was written. The job's lock is not held while writing, which waits
+// for the job to read what does not fit in the pipe.
+func (m *Manager) WriteStdin(id string, data []byte) (int, error) {
+	pipe, err := m.stdinOf(id)
+	if err != nil {
+		return 0, err
+	}
+	return pipe.write(id, data)
+}
+
+// CloseStdin closes the standard input of a running job started with
+// StdinOpen, so that it reads the end of its input.
+func (m *Manager) CloseStdin(id string) error {
+	pipe, err := m.stdinOf(id)
+	if err != nil {
+		return err
+	}
+	pipe.close()
+	Logger.Printf("Closed the input of job %s", id)
+	return nil
+}
+
+// startWithStdin starts the job's command like startCommand, with a pipe as
+// its standard input if the job has StdinOpen.
+func startWithStdin(job *Job, cmd *exec.Cmd, stdout, stderr io.Writer) (*os.File, func() error, error) {
+	if !job.Spec.StdinOpen {
+		return startCommand(cmd, job.Spec.TerminalOptions, stdout, stderr)
+	}
+	pipe, started, err := openStdin(cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+	tty, wait, err := startCommand(cmd, job.Spec.TerminalOptions, stdout, stderr)
+	started()
+	if err != nil {
+		pipe.close()
+		return nil, nil, err
+	}
+	job.stdin = pipe
+	return tty, wait, nil
+}
@@ -0,0 +1,94 @@
+package runner
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// The results of finished jobs.
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// SuccessCriteria decide whether a job that has finished succeeded, for
+// tools whose exit code alone does not say. A job fails if it meets none of
+// them, if it is killed for exceeding a limit, or if it cannot be started.
+type SuccessCriteria struct {
+	ExitCodes  []int         // exit codes that mean success; just 0 if empty
+	Require    []string      // regular expressions stdout or stderr must match
+	Forbid     []string      // regular expressions neither stdout nor stderr may match
+	MinRuntime time.Duration // how long the job must run for at least
+}
+
+// check checks that the regular expressions of c are valid.
+func (c *SuccessCriteria) check() error {
+	for _, pattern := range append(slices.Clip(c.Require), c.Forbid...) {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid success pattern %q: %v", pattern, err)
+		}
+	}
+	if c.MinRuntime < 0 {
+		return fmt.Errorf("invalid minimum runtime %v", c.MinRuntime)
+	}
+	return nil
+}
+
+// judge sets the result of a job that has finished, and why it failed if it
+// did.
+func judge(job *Job) {
+	job.Result, job.FailureReason = ResultFailure, failureReason(job)
+	if job.FailureReason == "" {
+		job.Result = ResultSuccess
+	}
+}
+
+// failureReason returns why a finished job failed, or "" if it succeeded.
+func failureReason(job *Job) string {
+	switch job.Status {
+	case "failed_to_start":
+		return "failed to start: " + job.StartError
+	case "errored":
+		return "errored"
+	}
+	if job.LimitExceeded != "" {
+		return fmt.Sprintf("exceeded its %s limit", job.LimitExceeded)
+	}
+	criteria := job.Spec.Success
+	if criteria == nil {
+		criteria = &SuccessCriteria{}
+	}
+	exitCodes := criteria.ExitCodes
+	if len(exitCodes) == 0 {
+		exitCodes = []int{0}
+	}
+	if !slices.Contains(exitCodes, job.ExitCode) {
+		return fmt.Sprintf("exit code %d", job.ExitCode)
+	}
+	stdout, stderr := job.Stdout.Bytes(), job.Stderr.Bytes()
+	for _, pattern := range criteria.Require {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			// Only the specs of imported jobs have not been checked.
+			return fmt.Sprintf("invalid success pattern %q", pattern)
+		}
+		if !re.Match(stdout) && !re.Match(stderr) {
+			return fmt.Sprintf("output does not match %q", pattern)
+		}
+	}
+	for _, pattern := range criteria.Forbid {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Sprintf("invalid success pattern %q", pattern)
+		}
+		if re.Match(stdout) || re.Match(stderr) {
+			return fmt.Sprintf("output matches %q", pattern)
+		}
+	}
+	if runtime := job.EndTime.Sub(job.StartTime); runtime < criteria.MinRuntime {
+		return fmt.Sprintf("ran for %v, less than the minimum of %v", runtime.Round(time.Millisecond), criteria.MinRuntime)
+	}
+	return ""
+}
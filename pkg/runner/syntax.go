@@ -0,0 +1,100 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SyntaxCheckTimeout is how long checking the syntax of a command may take
+// before the check is abandoned.
+var SyntaxCheckTimeout = 10 * time.Second
+
+// SyntaxError is a syntax error in a command string.
+type SyntaxError struct {
+	Line    int    `json:"line"`             // 1-based
+	Column  int    `json:"column,omitempty"` // 1-based, where the shell says
+	Message string `json:"message"`
+}
+
+// syntaxMessage matches the lines bash and dash write for syntax errors in
+// their input, such as "bash: line 3: syntax error near unexpected token
+// `('" and "sh: 4: Syntax error: newline unexpected".
+var syntaxMessage = regexp.MustCompile("^[^:]+: (?:line )?([0-9]+): (.*)$")
+
+// unexpectedToken finds the token bash names in a syntax error.
+var unexpectedToken = regexp.MustCompile("near unexpected token `(.*)'$")
+
+// CheckSyntax parses command with the interpreter for command strings,
+// without running it, and returns the syntax errors the interpreter finds.
+// Only bash and sh can check commands without running them.
+func CheckSyntax(command string) ([]SyntaxError, error) {
+	switch shell[0] {
+	case "bash", "sh":
+	default:
+		return nil, withKind(ErrInvalidSpec, fmt.Errorf("the %s shell cannot check syntax", shell[0]))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), SyntaxCheckTimeout)
+	defer cancel()
+	// The command is read from stdin, so that its length is not limited by
+	// the command line's.
+	cmd := exec.CommandContext(ctx, shell[0], "-n")
+	cmd.Stdin = strings.NewReader(command)
+	var stderr bytes.Buffer
+	_, wait, err := startCommand(cmd, TerminalOptions{}, nil, &stderr)
+	if err != nil {
+		return nil, err
+	}
+	err = wait()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("checking syntax: %w", ctx.Err())
+	}
+	if err == nil {
+		// Anything the shell wrote was only a warning.
+		return nil, nil
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return nil, err
+	}
+	return parseSyntaxErrors(command, stderr.String()), nil
+}
+
+// parseSyntaxErrors returns the syntax errors in the diagnostics the shell
+// wrote about command, which it found invalid.
+func parseSyntaxErrors(command, diagnostics string) []SyntaxError {
+	lines := strings.Split(command, "\n")
+	var errs []SyntaxError
+	for _, diagnostic := range strings.Split(strings.TrimSpace(diagnostics), "\n") {
+		match := syntaxMessage.FindStringSubmatch(diagnostic)
+		if match == nil {
+			continue
+		}
+		message := match[2]
+		if strings.HasPrefix(message, "`") {
+			// bash quotes the offending line after the error.
+			continue
+		}
+		line, _ := strconv.Atoi(match[1])
+		syntaxErr := SyntaxError{Line: line, Message: message}
+		if token := unexpectedToken.FindStringSubmatch(message); token != nil && line >= 1 && line <= len(lines) {
+			if token[1] == "newline" {
+				syntaxErr.Column = len(lines[line-1]) + 1
+			} else if i := strings.Index(lines[line-1], token[1]); i >= 0 {
+				syntaxErr.Column = i + 1
+			}
+		}
+		errs = append(errs, syntaxErr)
+	}
+	if len(errs) == 0 {
+		// Whatever the shell said, it is not in a form we recognize.
+		errs = append(errs, SyntaxError{Line: 1, Message: strings.TrimSpace(diagnostics)})
+	}
+	return errs
+}
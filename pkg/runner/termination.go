@@ -0,0 +1,35 @@
+package runner
+
+// What killed a job, as recorded in Job.KilledBy.
+const (
+	KilledByOperator = "operator" // a signal sent with Kill
+	KilledByTimeout  = "timeout"  // the job's timeout or idle timeout
+	KilledByCancel   = "cancel"   // the end of the context RunContext was given
+	KilledByLimit    = "limit"    // a resource limit
+	KilledByOOM      = "oom"      // the kernel, out of memory in the job's cgroup
+)
+
+// terminated records how a job that has finished was terminated: the signal
+// that killed it, if one did, and what sent it, if that is known. cancelled
+// reports whether RunContext killed the job because its context ended.
+func terminated(job *Job, cancelled bool) {
+	job.Signal, job.CoreDumped = terminationSignal(job.Cmd.ProcessState)
+	switch {
+	case job.CgroupUsage.OOMKills > 0 && job.ExitCode != 0:
+		// The OOM killer may only have killed one of the job's processes,
+		// leaving the shell to exit with its status.
+		job.KilledBy = KilledByOOM
+		if job.LimitExceeded == "" {
+			job.LimitExceeded = "memory"
+		}
+	case job.Signal == "":
+	case job.LimitExceeded == "timeout" || job.LimitExceeded == "idle_timeout":
+		job.KilledBy = KilledByTimeout
+	case cancelled:
+		job.KilledBy = KilledByCancel
+	case job.LimitExceeded != "":
+		job.KilledBy = KilledByLimit
+	case job.killRequested:
+		job.KilledBy = KilledByOperator
+	}
+}
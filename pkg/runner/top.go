@@ -0,0 +1,126 @@
+package runner
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// What TopJobs orders jobs by.
+const (
+	TopByCPU = "cpu" // the CPU the job used over the sampling interval
+	TopByRSS = "rss" // the memory the job's processes hold
+)
+
+// TopJob is what a running job was found to use by TopJobs.
+type TopJob struct {
+	ID        string
+	Command   string
+	Argv      []string
+	Status    string
+	Submitter string // the job's Submitter, as a string
+	StartTime time.Time
+	// CPUPercent is the CPU the job used over the sampling interval, as a
+	// percentage of one CPU, and CPUSeconds all it has used. RSSBytes is the
+	// memory its processes hold, or the memory its cgroup is charged for if
+	// it runs in one.
+	CPUPercent float64
+	CPUSeconds float64
+	RSSBytes   uint64
+	Processes  int // the processes sampled, or 0 for jobs sampled through their cgroup
+}
+
+// processUsage is what a job's processes were found to use at one time.
+type processUsage struct {
+	CPUSeconds float64
+	RSSBytes   uint64
+	Processes  int
+}
+
+// sampled is a running job TopJobs samples.
+type sampled struct {
+	job   *Job
+	pgid  int     // the job's process group, if it is not in a cgroup
+	cg    *cgroup // the job's cgroup, if it runs in one
+	first processUsage
+}
+
+// sample returns what the job uses now.
+func (s *sampled) sample() processUsage {
+	if s.cg != nil {
+		u := s.cg.usage()
+		return processUsage{CPUSeconds: u.CPUSeconds, RSSBytes: u.MemoryBytes}
+	}
+	if s.pgid > 0 {
+		return groupUsage(s.pgid)
+	}
+	return processUsage{}
+}
+
+// TopJobs samples what the jobs that are running or paused use twice,
+// interval apart, and returns them ordered by by, TopByCPU or TopByRSS, the
+// most demanding first, and at most limit of them if it is positive. A job
+// is sampled through its cgroup if it runs in one, and otherwise through
+// the processes of its process group, which for jobs of other executors are
+// the local commands that drive them.
+func (m *Manager) TopJobs(by string, limit int, interval time.Duration) ([]TopJob, error) {
+	if by == "" {
+		by = TopByCPU
+	}
+	switch {
+	case by != TopByCPU && by != TopByRSS:
+		return nil, withKind(ErrInvalidSpec, fmt.Errorf("invalid order %q: must be %s or %s", by, TopByCPU, TopByRSS))
+	case limit < 0:
+		return nil, withKind(ErrInvalidSpec, fmt.Errorf("invalid limit %d", limit))
+	case interval <= 0:
+		return nil, withKind(ErrInvalidSpec, fmt.Errorf("invalid sampling interval %v", interval))
+	}
+	var jobs []*sampled
+	for _, job := range m.jobs.all() {
+		job.mu.Lock()
+		if !job.Finished() {
+			s := &sampled{job: job, cg: job.cgroup}
+			if job.Cmd != nil && job.Cmd.Process != nil {
+				s.pgid = job.Cmd.Process.Pid
+			}
+			jobs = append(jobs, s)
+		}
+		job.mu.Unlock()
+	}
+	for _, s := range jobs {
+		s.first = s.sample()
+	}
+	time.Sleep(interval)
+
+	top := make([]TopJob, 0, len(jobs))
+	for _, s := range jobs {
+		usage := s.sample()
+		job := s.job
+		job.mu.Lock()
+		if !job.Finished() {
+			top = append(top, TopJob{
+				ID:         job.ID,
+				Command:    job.Command,
+				Argv:       job.Argv,
+				Status:     job.Status,
+				Submitter:  job.Spec.Submitter.String(),
+				StartTime:  job.StartTime,
+				CPUPercent: max(usage.CPUSeconds-s.first.CPUSeconds, 0) / interval.Seconds() * 100,
+				CPUSeconds: usage.CPUSeconds,
+				RSSBytes:   usage.RSSBytes,
+				Processes:  usage.Processes,
+			})
+		}
+		job.mu.Unlock()
+	}
+	sort.SliceStable(top, func(i, j int) bool {
+		if by == TopByRSS {
+			return top[i].RSSBytes > top[j].RSSBytes
+		}
+		return top[i].CPUPercent > top[j].CPUPercent
+	})
+	if limit > 0 && len(top) > limit {
+		top = top[:limit]
+	}
+	return top, nil
+}
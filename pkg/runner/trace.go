@@ -0,0 +1,88 @@
+package runner
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"strings"
+)
+
+// TraceJobs gives every job a trace span, as jobs with a TraceParent get,
+// for when the spans of jobs are exported.
+var TraceJobs = false
+
+// TraceContext identifies a job's span in a distributed trace, as in W3C
+// Trace Context: IDs are lowercase hex, 32 digits for TraceID and 16 for
+// the span IDs.
+type TraceContext struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string // empty for a span that starts its trace
+}
+
+// TraceParent returns the traceparent header value naming the span.
+func (t TraceContext) TraceParent() string {
+	return fmt.Sprintf("00-%s-%s-01", t.TraceID, t.SpanID)
+}
+
+// ParseTraceParent parses a W3C traceparent header value, such as
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", into the trace
+// and span IDs it names.
+func ParseTraceParent(traceParent string) (traceID, spanID string, err error) {
+	parts := strings.Split(traceParent, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return "", "", fmt.Errorf("invalid traceparent %q", traceParent)
+	}
+	traceID, spanID = parts[1], parts[2]
+	if !isTraceID(traceID, 32) || !isTraceID(spanID, 16) || !isTraceID(parts[0], 2) || !isTraceID(parts[3], 2) {
+		return "", "", fmt.Errorf("invalid traceparent %q", traceParent)
+	}
+	return traceID, spanID, nil
+}
+
+// isTraceID reports whether id is n lowercase hex digits, not all zero.
+func isTraceID(id string, n int) bool {
+	if len(id) != n || strings.Trim(id, "0") == "" && n > 2 {
+		return false
+	}
+	for _, c := range id {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// NewTraceID returns a random ID of n bytes as hex: 16 for a trace and 8
+// for a span.
+func NewTraceID(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// traceJob gives the job started from spec a span, if it has a TraceParent
+// or TraceJobs is set, and passes the span to its command as $TRACEPARENT
+// so that the command's own spans join the trace.
+func traceJob(spec *JobSpec) error {
+	spec.trace = TraceContext{}
+	if spec.TraceParent == "" && !TraceJobs {
+		return nil
+	}
+	trace := TraceContext{TraceID: NewTraceID(16), SpanID: NewTraceID(8)}
+	if spec.TraceParent != "" {
+		traceID, spanID, err := ParseTraceParent(spec.TraceParent)
+		if err != nil {
+			return withKind(ErrInvalidSpec, err)
+		}
+		trace.TraceID, trace.ParentSpanID = traceID, spanID
+	}
+	spec.trace = trace
+	spec.Env = maps.Clone(spec.Env)
+	if spec.Env == nil {
+		spec.Env = make(map[string]string)
+	}
+	spec.Env["TRACEPARENT"] = trace.TraceParent()
+	return nil
+}
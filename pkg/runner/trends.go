@@ -0,0 +1,231 @@
+package runner
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of alerts raised about the runs of a series.
+const (
+	AlertSlower  = "slower"  // the recent runs take much longer than the baseline
+	AlertFailing = "failing" // too many of the recent runs failed
+)
+
+// Trend is how the runs of a series of jobs have gone. A job's series is
+// the check it checks in to, if it has one, so that the runs of a job
+// scheduled under one name are compared with one another, and otherwise its
+// command.
+type Trend struct {
+	Series string
+	Runs   int // the runs recorded, up to trendRuns
+	// Baseline is the median duration of the successful runs before the
+	// last trendRecent, and Recent that of the last trendRecent. Deviation is
+	// Recent over Baseline, or 0 until there are enough runs for both.
+	Baseline  time.Duration
+	Recent    time.Duration
+	Deviation float64
+	// Slower is set while Deviation is at least trendSlowdown, an alert
+	// being raised when it is first set.
+	Slower        bool
+	FailureStreak int     // the runs that failed since the last that succeeded
+	SuccessRate   float64 // of the runs recorded, from 0 to 1
+	// FailureRate is the share of the last FailureWindow runs that failed,
+	// of all of them until there are as many. Failing is set while that is
+	// above a MaxFailureRate that is not 0, once there are FailureWindow
+	// runs, an alert being raised when it is first set.
+	FailureRate    float64
+	MaxFailureRate float64
+	FailureWindow  int
+	Failing        bool
+	LastJobID      string
+	LastExitCode   int
+	LastRun        time.Time // when the last run ended
+}
+
+// The bounds of the history trends are worked out from.
+const (
+	trendRuns        = 50   // runs remembered per series
+	trendRecent      = 5    // successful runs compared with the baseline
+	trendMinBaseline = 5    // successful runs needed for a baseline
+	trendSeriesMax   = 1000 // series remembered, the least recently run forgotten first
+	trendSlowdown    = 2.0  // Deviation from which a series is slower
+)
+
+// trendRun is a run of a series.
+type trendRun struct {
+	jobID    string
+	end      time.Time
+	duration time.Duration
+	exitCode int
+	success  bool
+}
+
+// series is the runs of a series, oldest first, whether it was last found
+// to be slower or failing, and the failure rate and window of its last job.
+type series struct {
+	runs           []trendRun
+	slower         bool
+	failing        bool
+	maxFailureRate float64
+	failureWindow  int
+}
+
+// trendSeries returns the series of a job.
+func trendSeries(job *Job) string {
+	if e := job.Spec.Expect; e != nil && e.Check != "" {
+		return e.Check
+	}
+	if job.Command != "" {
+		return strings.Join(strings.Fields(job.Command), " ")
+	}
+	return strings.Join(job.Argv, " ")
+}
+
+// recordTrend adds a job that has finished to the runs of its series,
+// raising an alert if that makes the series slower. Interactive sessions are
+// not recorded. The caller must hold the job's lock.
+func (m *Manager) recordTrend(job *Job) {
+	if job.session != nil {
+		return
+	}
+	name := trendSeries(job)
+	m.trendsMutex.Lock()
+	s, ok := m.trends[name]
+	if !ok {
+		if len(m.trends) >= trendSeriesMax {
+			m.forgetOldestSeries()
+		}
+		s = &series{}
+		m.trends[name] = s
+	}
+	s.runs = append(s.runs, trendRun{
+		jobID:    job.ID,
+		end:      job.EndTime,
+		duration: job.EndTime.Sub(job.StartTime),
+		exitCode: job.ExitCode,
+		success:  job.Result == ResultSuccess,
+	})
+	if len(s.runs) > trendRuns {
+		s.runs = slices.Delete(s.runs, 0, len(s.runs)-trendRuns)
+	}
+	s.maxFailureRate, s.failureWindow = m.config.MaxFailureRate, min(m.config.FailureWindow, trendRuns)
+	if e := job.Spec.Expect; e != nil && e.MaxFailureRate > 0 {
+		s.maxFailureRate = e.MaxFailureRate
+	}
+	if e := job.Spec.Expect; e != nil && e.FailureWindow > 0 {
+		s.failureWindow = e.FailureWindow
+	}
+	trend := s.trend(name)
+	wasSlower, wasFailing := s.slower, s.failing
+	s.slower, s.failing = trend.Slower, trend.Failing
+	m.trendsMutex.Unlock()
+
+	if trend.Slower && !wasSlower {
+		m.alert(Alert{
+			Kind:    AlertSlower,
+			JobID:   job.ID,
+			Check:   checkOf(job),
+			Message: fmt.Sprintf("The last %d runs of %q took %v at the median, %.1f times the baseline of %v", trendRecent, name, trend.Recent.Round(time.Millisecond), trend.Deviation, trend.Baseline.Round(time.Millisecond)),
+		}, job.Spec.Notify)
+	}
+	if trend.Failing && !wasFailing {
+		m.alert(Alert{
+			Kind:    AlertFailing,
+			JobID:   job.ID,
+			Check:   checkOf(job),
+			Message: fmt.Sprintf("%.0f%% of the last %d runs of %q failed, more than the %.0f%% allowed", trend.FailureRate*100, trend.FailureWindow, name, trend.MaxFailureRate*100),
+		}, job.Spec.Notify)
+	}
+}
+
+// forgetOldestSeries forgets the series that was run the longest ago. The
+// caller must hold trendsMutex.
+func (m *Manager) forgetOldestSeries() {
+	var oldest string
+	var oldestEnd time.Time
+	for name, s := range m.trends {
+		end := s.runs[len(s.runs)-1].end
+		if oldest == "" || end.Before(oldestEnd) {
+			oldest, oldestEnd = name, end
+		}
+	}
+	delete(m.trends, oldest)
+}
+
+// trend works out the trend of the series.
+func (s *series) trend(name string) Trend {
+	last := s.runs[len(s.runs)-1]
+	t := Trend{
+		Series:       name,
+		Runs:         len(s.runs),
+		LastJobID:    last.jobID,
+		LastExitCode: last.exitCode,
+		LastRun:      last.end,
+	}
+	var durations []time.Duration
+	succeeded := 0
+	for _, run := range s.runs {
+		if run.success {
+			durations = append(durations, run.duration)
+			succeeded++
+			t.FailureStreak = 0
+		} else {
+			t.FailureStreak++
+		}
+	}
+	t.SuccessRate = float64(succeeded) / float64(len(s.runs))
+	t.MaxFailureRate, t.FailureWindow = s.maxFailureRate, s.failureWindow
+	recent := s.runs[max(len(s.runs)-s.failureWindow, 0):]
+	failed := 0
+	for _, run := range recent {
+		if !run.success {
+			failed++
+		}
+	}
+	t.FailureRate = float64(failed) / float64(len(recent))
+	t.Failing = t.MaxFailureRate > 0 && len(recent) >= t.FailureWindow && t.FailureRate > t.MaxFailureRate
+	if len(durations) >= trendRecent+trendMinBaseline {
+		split := len(durations) - trendRecent
+		t.Baseline = median(durations[:split])
+		t.Recent = median(durations[split:])
+		if t.Baseline > 0 {
+			t.Deviation = float64(t.Recent) / float64(t.Baseline)
+			t.Slower = t.Deviation >= trendSlowdown
+		}
+	}
+	return t
+}
+
+// median returns the median of durations, which it sorts.
+func median(durations []time.Duration) time.Duration {
+	slices.Sort(durations)
+	n := len(durations)
+	if n%2 == 1 {
+		return durations[n/2]
+	}
+	return (durations[n/2-1] + durations[n/2]) / 2
+}
+
+// checkOf returns the check a job checks in to, if any.
+func checkOf(job *Job) string {
+	if job.Spec.Expect == nil {
+		return ""
+	}
+	return job.Spec.Expect.Check
+}
+
+// Trends returns the trends of the series of jobs run so far, in order of
+// series.
+func (m *Manager) Trends() []Trend {
+	m.trendsMutex.Lock()
+	defer m.trendsMutex.Unlock()
+	trends := make([]Trend, 0, len(m.trends))
+	for name, s := range m.trends {
+		trends = append(trends, s.trend(name))
+	}
+	sort.Slice(trends, func(i, j int) bool { return trends[i].Series < trends[j].Series })
+	return trends
+}
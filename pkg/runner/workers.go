@@ -0,0 +1,106 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// workerIdle is how long a goroutine that waited for a background job's
+// command waits for the next one before it exits.
+const workerIdle = 30 * time.Second
+
+// workerPool hands the jobs a Manager runs to workers, at most size of them
+// busy at once, unless size is 0. The goroutines waiting for background jobs' commands
+// are kept for the next jobs rather than started for each.
+type workerPool struct {
+	size    int           // see Config.Workers
+	wait    time.Duration // see Config.WorkerWait
+	mu      sync.Mutex
+	busy    int           // workers running a job
+	waiting int           // jobs waiting for a worker
+	freed   chan struct{} // closed once a busy worker is freed
+	tasks   chan func()   // hands tasks to idle goroutines
+}
+
+func newWorkerPool(size int, wait time.Duration) *workerPool {
+	return &workerPool{size: size, wait: wait, freed: make(chan struct{}), tasks: make(chan func())}
+}
+
+// acquire takes a worker for a job, waiting up to the pool's wait for one
+// to be free, or until ctx is done.
+func (p *workerPool) acquire(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var timeout <-chan time.Time
+	for p.size > 0 && p.busy >= p.size {
+		if timeout == nil {
+			timer := time.NewTimer(p.wait)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		freed := p.freed
+		p.waiting++
+		p.mu.Unlock()
+		var err error
+		select {
+		case <-freed:
+		case <-timeout:
+			err = withKind(ErrOverloaded, fmt.Errorf("all %d workers have been busy for %v", p.size, p.wait))
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		p.mu.Lock()
+		p.waiting--
+		if err != nil {
+			return err
+		}
+	}
+	p.busy++
+	return nil
+}
+
+// release frees a worker taken by acquire.
+func (p *workerPool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.busy--
+	if p.waiting > 0 {
+		close(p.freed)
+		p.freed = make(chan struct{})
+	}
+}
+
+// count returns how many workers are running jobs.
+func (p *workerPool) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.busy
+}
+
+// run calls f on an idle goroutine of the pool, or on a new one if none is
+// idle.
+func (p *workerPool) run(f func()) {
+	select {
+	case p.tasks <- f:
+	default:
+		go p.work(f)
+	}
+}
+
+// work calls f, then the tasks handed to it, until it has been idle for
+// workerIdle.
+func (p *workerPool) work(f func()) {
+	idle := time.NewTimer(workerIdle)
+	defer idle.Stop()
+	for {
+		f()
+		idle.Reset(workerIdle)
+		select {
+		case f = <-p.tasks:
+		case <-idle.C:
+			return
+		}
+	}
+}
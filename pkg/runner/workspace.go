@@ -0,0 +1,57 @@
+package runner
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// removeDir removes a directory of a job, such as its workspace, and
+// everything in it. An empty dir is the job not having one.
+func removeDir(dir string) {
+	if dir == "" {
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		Logger.Printf("Failed to remove %s: %v", dir, err)
+	}
+}
+
+// releaseFiles removes the files of a job being released: its workspace,
+// unless the job asked to keep it, and the copies of its artifacts.
+func releaseFiles(job *Job) {
+	if job.artifactDir != "" {
+		removeDir(job.artifactDir)
+		job.artifactDir = ""
+	}
+	if job.Workspace == "" || job.Spec.KeepWorkspace {
+		return
+	}
+	removeDir(job.Workspace)
+	job.Workspace = ""
+}
+
+// listFiles returns the regular files under dir, in order of name, named
+// relative to dir.
+func listFiles(dir string) ([]Artifact, error) {
+	files := []Artifact{}
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, newArtifact(name, path, info))
+		return nil
+	})
+	return files, err
+}
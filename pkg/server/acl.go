@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+
+	"shellrunner/pkg/runner"
+)
+
+// attachMethod is what the ACL calls attaching to a running job, which
+// clients do with the ATTACH preamble rather than a method.
+const attachMethod = "Attach"
+
+// ACL limits the methods each client may call. Roles names sets of methods,
+// with "*" for every method, and Members gives each identity its roles. The
+// identities are those of Quotas: "token:<name>", "cert:<name>",
+// "uid:<user>" or "unknown", with "*" for every identity without an entry
+// of its own. A client may call the methods of any of its roles, and root,
+// as the peer of a Unix socket, may call every method.
+type ACL struct {
+	Roles   map[string][]string `json:"roles"`
+	Members map[string][]string `json:"members"`
+}
+
+// LoadACL reads an ACL from a JSON file holding an object with its roles
+// and members.
+func LoadACL(path string) (*ACL, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var acl ACL
+	if err := json.Unmarshal(data, &acl); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if err := acl.check(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &acl, nil
+}
+
+// check checks that the roles of the ACL only name methods the server has,
+// and that its members only hold roles it defines.
+func (a *ACL) check() error {
+	for role, methods := range a.Roles {
+		for _, method := range methods {
+			if _, ok := rpcMethods()[method]; !ok && method != "*" && method != attachMethod {
+				return fmt.Errorf("role %q: unknown method %q", role, method)
+			}
+		}
+	}
+	for key, roles := range a.Members {
+		if err := checkQuota(key, Quota{}); err != nil {
+			return fmt.Errorf("member %q: identity must be token:<name>, cert:<name>, uid:<user>, unknown or *", key)
+		}
+		for _, role := range roles {
+			if _, ok := a.Roles[role]; !ok {
+				return fmt.Errorf("member %q: unknown role %q", key, role)
+			}
+		}
+	}
+	return nil
+}
+
+// allows reports whether the identity key may call method.
+func (a *ACL) allows(key, method string) bool {
+	roles, ok := a.Members[key]
+	if !ok {
+		roles = a.Members["*"]
+	}
+	for _, role := range roles {
+		if methods := a.Roles[role]; slices.Contains(methods, method) || slices.Contains(methods, "*") {
+			return true
+		}
+	}
+	return false
+}
+
+// enforceACL is the interceptor that fails the calls the server's ACL does
+// not allow.
+func (s *Server) enforceACL(call *Call, next Handler) error {
+	if err := s.checkACL(call.Identity, call.Method); err != nil {
+		return err
+	}
+	return next(call)
+}
+
+// checkACL returns a PERMISSION_DENIED error if the server's ACL does not
+// allow the client id to call method.
+func (s *Server) checkACL(id runner.Identity, method string) error {
+	if s.ACL == nil {
+		return nil
+	}
+	key := quotaKey(id)
+	if id.User == "0" || s.ACL.allows(key, method) {
+		return nil
+	}
+	s.permissionDenied.Add(1)
+	runner.Logger.Printf("%s denied to %s by the ACL", method, key)
+	return &Error{
+		Code:    CodePermissionDenied,
+		Message: fmt.Sprintf("%s may not call %s", key, method),
+		Details: map[string]interface{}{"identity": key, "method": method},
+	}
+}
@@ -0,0 +1,349 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"shellrunner/pkg/runner"
+)
+
+// The Admin methods manage the jobs of every tenant on a shared server. A
+// tenant is the identity a client is held to quotas as: "token:<name>",
+// "cert:<name>", "uid:<user>" or "unknown". They, and adminMethods, are only
+// for the clients Server.Admins names and for root, as the peer of a Unix
+// socket. Other clients only see and act on the jobs of their own tenant.
+
+// adminMethods are the methods besides the Admin methods that only admins
+// may call.
+var adminMethods = []string{"Maintain"}
+
+// ParseAdmins parses a comma-separated list of admins, such as
+// "token:ops,cert:deploy,uid:1000", for Server.Admins.
+func ParseAdmins(list string) ([]string, error) {
+	var admins []string
+	for _, admin := range strings.Split(list, ",") {
+		admin = strings.TrimSpace(admin)
+		if admin == "" {
+			continue
+		}
+		kind, name, _ := strings.Cut(admin, ":")
+		if (kind != "token" && kind != "cert" && kind != "uid") || name == "" {
+			return nil, fmt.Errorf("invalid admin %q: want token:<name>, cert:<name> or uid:<user>", admin)
+		}
+		admins = append(admins, admin)
+	}
+	return admins, nil
+}
+
+// isAdmin reports whether the client id is an admin. What a client calls
+// itself with Identify is its own claim, so it does not count.
+func (s *Server) isAdmin(id runner.Identity) bool {
+	switch {
+	case id.User == "0":
+		return true
+	case id.Token != "" && slices.Contains(s.Admins, "token:"+id.Token):
+		return true
+	case id.Cert != "" && slices.Contains(s.Admins, "cert:"+id.Cert):
+		return true
+	case id.User != "" && slices.Contains(s.Admins, "uid:"+id.User):
+		return true
+	}
+	return false
+}
+
+// adminOnly is the interceptor that fails the calls to the Admin methods and
+// adminMethods of clients that are not admins with a PERMISSION_DENIED
+// error.
+func (s *Server) adminOnly(call *Call, next Handler) error {
+	admin := strings.HasPrefix(call.Method, "Admin") || slices.Contains(adminMethods, call.Method)
+	if !admin || s.isAdmin(call.Identity) {
+		return next(call)
+	}
+	key := quotaKey(call.Identity)
+	s.permissionDenied.Add(1)
+	runner.Logger.Printf("%s denied to %s, which is not an admin", call.Method, key)
+	return &Error{
+		Code:    CodePermissionDenied,
+		Message: fmt.Sprintf("%s is only for admins, which %s is not", call.Method, key),
+		Details: map[string]interface{}{"identity": key},
+	}
+}
+
+// jobMethods are the methods that act on the jobs their arguments name by
+// ID, which clients that are not admins may only call for their own jobs.
+var jobMethods = []string{
+	"Status", "Output", "Since", "Diff", "Artifacts", "Kill", "Pause", "Resume", "Release",
+	"WriteStdin", "CloseStdin", "ExtendTimeout", "Annotate", "Resize", "Rerun",
+}
+
+// ownJobs is the interceptor that holds the clients that are not admins to
+// their own jobs: a call to one of jobMethods naming a job another tenant
+// submitted fails with the JOB_NOT_FOUND error of a job that does not
+// exist, so that a client cannot tell other tenants' jobs apart from
+// missing ones.
+func (s *Server) ownJobs(call *Call, next Handler) error {
+	if !slices.Contains(jobMethods, call.Method) {
+		return next(call)
+	}
+	for _, id := range jobIDs(call) {
+		if err := s.checkOwner(call.Identity, id); err != nil {
+			return err
+		}
+	}
+	return next(call)
+}
+
+// jobIDs returns the IDs of the jobs a call to one of jobMethods names.
+func jobIDs(call *Call) []string {
+	var ids []string
+	switch args := call.Args.(type) {
+	case *string:
+		ids = []string{*args}
+	case *OutputArgs:
+		ids = []string{args.ID}
+	case *DiffArgs:
+		ids = []string{args.A, args.B}
+	case *KillArgs:
+		ids = []string{args.ID}
+	case *WriteStdinArgs:
+		ids = []string{args.ID}
+	case *ExtendTimeoutArgs:
+		ids = []string{args.ID}
+	case *AnnotateArgs:
+		ids = []string{args.ID}
+	case *ResizeArgs:
+		ids = []string{args.ID}
+	}
+	return ids
+}
+
+// checkOwner returns the JOB_NOT_FOUND error of a missing job if the client
+// id may not act on job jobID: if it is not an admin and another tenant
+// submitted the job. Jobs that are missing are left for the method to fail
+// on.
+func (s *Server) checkOwner(id runner.Identity, jobID string) error {
+	submitter, err := s.manager.Submitter(jobID)
+	if err != nil && s.predecessor != nil {
+		// The job may still be running on the server this one replaces.
+		var ok bool
+		if submitter, ok = s.predecessor.submitter(jobID); ok {
+			err = nil
+		}
+	}
+	if err != nil || s.owns(id, submitter) {
+		return nil
+	}
+	return &Error{Code: CodeJobNotFound, Message: fmt.Sprintf("job with id %s not found", jobID)}
+}
+
+// owns reports whether the client id may act on the jobs submitted by
+// submitter: whether it is the same tenant, or an admin.
+func (s *Server) owns(id, submitter runner.Identity) bool {
+	return quotaKey(id) == quotaKey(submitter) || s.isAdmin(id)
+}
+
+// ownFilter returns the filter that selects the jobs the client the
+// receiver serves may act on: its own, or every job for an admin.
+func (s *ShellRunner) ownFilter() runner.JobFilter {
+	id := s.identity()
+	if s.server.isAdmin(id) {
+		return runner.JobFilter{}
+	}
+	return tenantFilter(quotaKey(id))
+}
+
+// tenantFilter returns the filter that selects the jobs of tenant, or every
+// job if it is empty.
+func tenantFilter(tenant string) runner.JobFilter {
+	if tenant == "" {
+		return runner.JobFilter{}
+	}
+	return runner.JobFilter{Submitter: func(id runner.Identity) bool { return quotaKey(id) == tenant }}
+}
+
+// AdminJobsArgs defines the arguments for the AdminJobs method.
+type AdminJobsArgs struct {
+	Tenant string // only the jobs of this tenant, if set
+}
+
+// AdminJobs lists the jobs of every tenant, or of one, in order of ID.
+func (s *ShellRunner) AdminJobs(args AdminJobsArgs, reply *AdminJobList) error {
+	runner.Logger.Printf("AdminJobs called for tenant %q", args.Tenant)
+	reply.Jobs = []AdminJob{}
+	return rpcError(s.manager.EachJob(tenantFilter(args.Tenant), func(job *runner.Job) {
+		entry := AdminJob{
+			ID:            job.ID,
+			Tenant:        quotaKey(job.Spec.Submitter),
+			Submitter:     submitter(job),
+			Command:       job.Command,
+			Argv:          job.Argv,
+			Status:        job.Status,
+			StartTime:     job.StartTime,
+			BufferedBytes: int64(job.Stdout.Retained() + job.Stderr.Retained()),
+		}
+		if job.Finished() {
+			entry.DurationSeconds = job.EndTime.Sub(job.StartTime).Seconds()
+		} else {
+			entry.DurationSeconds = time.Since(job.StartTime).Seconds()
+		}
+		reply.Jobs = append(reply.Jobs, entry)
+	}))
+}
+
+// AdminKillArgs defines the arguments for the AdminKill method: either the
+// IDs of the jobs to kill, or a tenant to kill the running jobs of.
+type AdminKillArgs struct {
+	IDs    []string
+	Tenant string
+	Signal string // signal name such as "TERM"; defaults to "KILL"
+}
+
+// AdminKill sends a signal to jobs of any tenant.
+func (s *ShellRunner) AdminKill(args AdminKillArgs, reply *KillAllResult) error {
+	runner.Logger.Printf("AdminKill called for jobs %q of tenant %q, Signal: %q", args.IDs, args.Tenant, args.Signal)
+	if (len(args.IDs) == 0) == (args.Tenant == "") {
+		return &Error{Code: CodeInvalidArgument, Message: "give either the IDs of the jobs to kill or a tenant"}
+	}
+	reply.Killed = []string{}
+	if args.Tenant != "" {
+		killed, failed, err := s.manager.KillAll(tenantFilter(args.Tenant), args.Signal)
+		if err != nil {
+			return rpcError(err)
+		}
+		reply.Killed = append(reply.Killed, killed...)
+		for id, err := range failed {
+			reply.fail(id, err)
+		}
+		return nil
+	}
+	for _, id := range args.IDs {
+		if err := s.manager.Kill(id, args.Signal); err != nil {
+			if errors.Is(err, runner.ErrInvalidSpec) {
+				return rpcError(err)
+			}
+			reply.fail(id, err)
+			continue
+		}
+		reply.Killed = append(reply.Killed, id)
+	}
+	return nil
+}
+
+// fail records that the signal could not be sent to job id.
+func (r *KillAllResult) fail(id string, err error) {
+	if r.Failed == nil {
+		r.Failed = make(map[string]string)
+	}
+	r.Failed[id] = err.Error()
+}
+
+// AdminReleaseArgs defines the arguments for the AdminRelease method:
+// either the IDs of the jobs to release, or a tenant to release the jobs
+// of.
+type AdminReleaseArgs struct {
+	IDs    []string
+	Tenant string
+	// Force kills the jobs that are still running with SIGKILL and
+	// releases them too. Otherwise they are left alone.
+	Force bool
+}
+
+// AdminRelease releases jobs of any tenant.
+func (s *ShellRunner) AdminRelease(args AdminReleaseArgs, reply *AdminReleaseResult) error {
+	runner.Logger.Printf("AdminRelease called for jobs %q of tenant %q, force: %v", args.IDs, args.Tenant, args.Force)
+	if (len(args.IDs) == 0) == (args.Tenant == "") {
+		return &Error{Code: CodeInvalidArgument, Message: "give either the IDs of the jobs to release or a tenant"}
+	}
+	ids := args.IDs
+	if args.Tenant != "" {
+		s.manager.EachJob(tenantFilter(args.Tenant), func(job *runner.Job) {
+			ids = append(ids, job.ID)
+		})
+	}
+	reply.Released = []string{}
+	for _, id := range ids {
+		var running bool
+		err := s.manager.WithJob(id, func(job *runner.Job) error {
+			running = !job.Finished()
+			return nil
+		})
+		if err == nil && running {
+			if !args.Force {
+				reply.fail(id, errors.New("job is still running; force kills it"))
+				continue
+			}
+			// It may have finished since.
+			s.manager.Kill(id, "KILL")
+		}
+		if err == nil {
+			err = s.manager.Release(id)
+		}
+		if err != nil {
+			reply.fail(id, err)
+			continue
+		}
+		reply.Released = append(reply.Released, id)
+	}
+	return nil
+}
+
+// fail records that job id could not be released.
+func (r *AdminReleaseResult) fail(id string, err error) {
+	if r.Failed == nil {
+		r.Failed = make(map[string]string)
+	}
+	r.Failed[id] = err.Error()
+}
+
+// AdminSetQuotaArgs defines the arguments for the AdminSetQuota method.
+type AdminSetQuotaArgs struct {
+	Tenant string // a tenant, or "*" for every tenant without its own quota
+	Quota  *Quota // the tenant's new quota, or nil to remove it
+}
+
+// AdminSetQuota changes the quota of a tenant while the server runs, and
+// returns the quotas now in force. The change lasts until the server
+// restarts; edit the quotas file to keep it.
+func (s *ShellRunner) AdminSetQuota(args AdminSetQuotaArgs, reply *Quotas) error {
+	runner.Logger.Printf("AdminSetQuota called for tenant %q", args.Tenant)
+	quotas, err := s.server.setQuota(args.Tenant, args.Quota)
+	if err != nil {
+		return &Error{Code: CodeInvalidArgument, Message: err.Error()}
+	}
+	runner.Logger.Printf("Quota of %s set to %+v", args.Tenant, args.Quota)
+	*reply = quotas
+	return nil
+}
+
+// AdminTenants returns the statistics, quota and usage of each tenant that
+// has submitted jobs, holds jobs or has a quota of its own, in order of
+// tenant.
+func (s *ShellRunner) AdminTenants(args struct{}, reply *TenantList) error {
+	runner.Logger.Println("AdminTenants called")
+	stats := s.server.identities.tenantStats()
+	tenants := make(map[string]bool)
+	for tenant := range stats {
+		tenants[tenant] = true
+	}
+	s.server.quotas.mu.Lock()
+	for tenant := range s.server.Quotas {
+		if tenant != "*" {
+			tenants[tenant] = true
+		}
+	}
+	s.server.quotas.mu.Unlock()
+	s.manager.EachJob(runner.JobFilter{}, func(job *runner.Job) {
+		tenants[quotaKey(job.Spec.Submitter)] = true
+	})
+
+	reply.Tenants = []TenantStats{}
+	for tenant := range tenants {
+		reply.Tenants = append(reply.Tenants, TenantStats{QuotaUsage: s.server.usage(tenant), Stats: stats[tenant]})
+	}
+	sort.Slice(reply.Tenants, func(i, j int) bool { return reply.Tenants[i].Identity < reply.Tenants[j].Identity })
+	return nil
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"shellrunner/pkg/runner"
+)
+
+// ArchiveVersion is the version of the Archive format written by Export.
+const ArchiveVersion = 1
+
+// Archive is the state of a server's jobs, including their output, as
+// exported by Export and imported by Import.
+type Archive struct {
+	Version    int                `json:"version"`
+	ExportedAt time.Time          `json:"exported_at"`
+	Jobs       []runner.JobRecord `json:"jobs"`
+}
+
+// Export returns the records of all the caller's jobs with their output, or
+// of every tenant's for an admin, to migrate them to another server with
+// Import, attach them to a ticket, or back them up.
+func (s *ShellRunner) Export(args struct{}, reply *Archive) error {
+	runner.Logger.Printf("Export called")
+	records := []runner.JobRecord{}
+	err := s.manager.EachJob(s.ownFilter(), func(job *runner.Job) {
+		records = append(records, job.Record())
+	})
+	if err != nil {
+		return rpcError(err)
+	}
+	*reply = Archive{Version: ArchiveVersion, ExportedAt: time.Now(), Jobs: records}
+	return nil
+}
+
+// ImportResult reports the IDs given to imported jobs.
+type ImportResult struct {
+	IDs map[string]string `json:"ids"` // new job IDs, keyed by the IDs in the archive
+}
+
+// Import adds the jobs of an archive written by Export. The jobs get new
+// IDs, and are all finished: jobs that were running when they were exported
+// are recorded as errored. They are recorded as submitted by the caller,
+// whoever submitted them in the archive, so that a client cannot pass off
+// jobs as another's, to be counted against their quotas or rerun as theirs.
+func (s *ShellRunner) Import(args Archive, reply *ImportResult) error {
+	runner.Logger.Printf("Import called with %d jobs", len(args.Jobs))
+	if args.Version != ArchiveVersion {
+		return &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf("unsupported archive version %d, expected %d", args.Version, ArchiveVersion)}
+	}
+	caller := s.identity()
+	records := make([]runner.JobRecord, len(args.Jobs))
+	for i, record := range args.Jobs {
+		spec := runner.JobSpec{Command: record.Command, Argv: record.Argv}
+		if record.Spec != nil {
+			spec = *record.Spec
+		}
+		spec.Submitter = caller
+		record.Spec = &spec
+		records[i] = record
+	}
+	ids, err := s.manager.Import(records)
+	if err != nil {
+		return rpcError(err)
+	}
+	reply.IDs = ids
+	return nil
+}
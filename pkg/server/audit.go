@@ -0,0 +1,41 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+
+	"shellrunner/pkg/runner"
+)
+
+// auditEntry is the line of the audit log recording a call. The arguments
+// are left out, as they may hold secrets.
+type auditEntry struct {
+	Time            time.Time       `json:"time"`
+	Identity        runner.Identity `json:"identity"`
+	Method          string          `json:"method"`
+	Code            ErrorCode       `json:"code,omitempty"` // why the call failed, if it did
+	DurationSeconds float64         `json:"duration_seconds"`
+}
+
+// auditCalls is the interceptor that records each call, who made it and
+// whether it failed in the server's AuditLog, if it has one, including the
+// calls refused for being denied or rate limited.
+func (s *Server) auditCalls(call *Call, next Handler) error {
+	if s.AuditLog == nil {
+		return next(call)
+	}
+	err := next(call)
+	line, _ := json.Marshal(auditEntry{
+		Time:            call.Start,
+		Identity:        call.Identity,
+		Method:          call.Method,
+		Code:            Code(err),
+		DurationSeconds: time.Since(call.Start).Seconds(),
+	})
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	if _, werr := s.AuditLog.Write(append(line, '\n')); werr != nil {
+		runner.Logger.Printf("Error writing the audit log: %v", werr)
+	}
+	return err
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"shellrunner/pkg/runner"
+)
+
+// BackupVersion is the version of the Backup format written by AdminBackup.
+const BackupVersion = 1
+
+// Backup is the state of a server that AdminBackup saves and AdminRestore
+// restores: its jobs, as Export archives them, and the quotas in force,
+// which AdminSetQuota may have changed since the server started. The rest of
+// its configuration is in its flags and files, and secrets stay in their
+// encrypted file.
+type Backup struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Archive   Archive   `json:"archive"`
+	Quotas    Quotas    `json:"quotas"`
+}
+
+// AdminBackupArgs defines the arguments for the AdminBackup method.
+type AdminBackupArgs struct {
+	Path string // an absolute path on the server's host
+}
+
+// AdminBackupResult is the result of the AdminBackup method.
+type AdminBackupResult struct {
+	Path  string `json:"path"`
+	Jobs  int    `json:"jobs"`
+	Bytes int64  `json:"bytes"`
+}
+
+// AdminBackup saves the state of the server to a gzipped JSON file on its
+// host while it runs, replacing any file at the path. The file is written
+// whole or not at all, and only its owner may read it, as it holds the
+// output of every job.
+func (s *ShellRunner) AdminBackup(args AdminBackupArgs, reply *AdminBackupResult) error {
+	runner.Logger.Printf("AdminBackup called for %s", args.Path)
+	if !filepath.IsAbs(args.Path) {
+		return &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf("backup path %q is not absolute", args.Path)}
+	}
+	now := time.Now()
+	backup := Backup{
+		Version:   BackupVersion,
+		CreatedAt: now,
+		Archive:   Archive{Version: ArchiveVersion, ExportedAt: now, Jobs: s.manager.Export()},
+	}
+	s.server.quotas.mu.Lock()
+	backup.Quotas = s.server.Quotas
+	s.server.quotas.mu.Unlock()
+
+	size, err := writeBackup(args.Path, backup)
+	if err != nil {
+		return rpcError(fmt.Errorf("writing backup %s: %v", args.Path, err))
+	}
+	runner.Logger.Printf("Backed up %d jobs to %s", len(backup.Archive.Jobs), args.Path)
+	*reply = AdminBackupResult{Path: args.Path, Jobs: len(backup.Archive.Jobs), Bytes: size}
+	return nil
+}
+
+// writeBackup writes backup to path through a temporary file, so that a
+// failure cannot leave a previous backup half overwritten, and returns the
+// size of the file.
+func writeBackup(path string, backup Backup) (int64, error) {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+	zw := gzip.NewWriter(f)
+	err = json.NewEncoder(zw).Encode(backup)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), os.Rename(tmp, path)
+}
+
+// AdminRestoreArgs defines the arguments for the AdminRestore method.
+type AdminRestoreArgs struct {
+	Path string // an absolute path on the server's host
+}
+
+// AdminRestoreResult is the result of the AdminRestore method.
+type AdminRestoreResult struct {
+	IDs    map[string]string `json:"ids"` // new job IDs, keyed by the IDs in the backup
+	Quotas Quotas            `json:"quotas"`
+}
+
+// AdminRestore restores a backup written by AdminBackup, on this server or
+// another: it imports the backup's jobs as Import does, with new IDs, and
+// replaces the quotas in force with the backup's. The restored quotas last
+// until the server restarts, like those AdminSetQuota sets.
+func (s *ShellRunner) AdminRestore(args AdminRestoreArgs, reply *AdminRestoreResult) error {
+	runner.Logger.Printf("AdminRestore called for %s", args.Path)
+	if !filepath.IsAbs(args.Path) {
+		return &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf("backup path %q is not absolute", args.Path)}
+	}
+	backup, err := readBackup(args.Path)
+	if err != nil {
+		return &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf("reading backup %s: %v", args.Path, err)}
+	}
+	if backup.Version != BackupVersion {
+		return &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf("unsupported backup version %d, expected %d", backup.Version, BackupVersion)}
+	}
+	if backup.Archive.Version != ArchiveVersion {
+		return &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf("unsupported archive version %d, expected %d", backup.Archive.Version, ArchiveVersion)}
+	}
+	for key, quota := range backup.Quotas {
+		if err := checkQuota(key, quota); err != nil {
+			return &Error{Code: CodeInvalidArgument, Message: err.Error()}
+		}
+	}
+	ids, err := s.manager.Import(backup.Archive.Jobs)
+	if err != nil {
+		return rpcError(err)
+	}
+	s.server.quotas.mu.Lock()
+	s.server.Quotas = backup.Quotas
+	s.server.quotas.mu.Unlock()
+	runner.Logger.Printf("Restored %d jobs and %d quotas from %s", len(ids), len(backup.Quotas), args.Path)
+	*reply = AdminRestoreResult{IDs: ids, Quotas: backup.Quotas}
+	return nil
+}
+
+// readBackup reads a backup written by writeBackup.
+func readBackup(path string) (Backup, error) {
+	var backup Backup
+	f, err := os.Open(path)
+	if err != nil {
+		return backup, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return backup, err
+	}
+	err = json.NewDecoder(zr).Decode(&backup)
+	return backup, err
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"shellrunner/pkg/runner"
+)
+
+// The bounds of the results Run keeps for CacheTTL, the oldest being
+// dropped first.
+const (
+	resultCacheEntries = 1000
+	resultCacheBytes   = 64 << 20 // of stdout and stderr, all told
+)
+
+// cachedResult is the result of a successful Run kept for later ones.
+type cachedResult struct {
+	key     string
+	result  RunResult // as the job left it, before ParseJSON and Encoding
+	end     time.Time
+	expires time.Time
+}
+
+// resultCache holds the results of successful Runs with a CacheTTL, oldest
+// first. It is guarded by the server's mutex.
+type resultCache struct {
+	entries []*cachedResult
+	bytes   int
+	hits    int64
+}
+
+// cacheKey returns the key of the results of the jobs opts describes: a hash
+// of everything about them that can change what a job does, which leaves
+// out how a result is returned.
+func cacheKey(opts JobOptions) string {
+	opts.CacheTTL = 0
+	opts.Keep = false
+	opts.CancelOnDisconnect = false
+	opts.ParseJSON = false
+	opts.Encoding = ""
+	opts.TraceParent = ""
+	data, _ := json.Marshal(opts)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// cachedRun returns the result of a successful Run of the job opts describes
+// that finished no more than opts.CacheTTL seconds ago, if there is one.
+func (s *Server) cachedRun(opts JobOptions) (RunResult, bool) {
+	key := cacheKey(opts)
+	ttl := time.Duration(opts.CacheTTL * float64(time.Second))
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.results.entries) - 1; i >= 0; i-- {
+		entry := s.results.entries[i]
+		if entry.key == key && now.Sub(entry.end) <= ttl && now.Before(entry.expires) {
+			s.results.hits++
+			result := entry.result
+			result.Cached = true
+			return result, true
+		}
+	}
+	return RunResult{}, false
+}
+
+// cacheRun keeps the result of a Run of the job opts describes, which
+// finished at end, for opts.CacheTTL seconds, if it succeeded.
+func (s *Server) cacheRun(opts JobOptions, result RunResult, end time.Time) {
+	size := len(result.Stdout) + len(result.Stderr)
+	if result.Result != runner.ResultSuccess || size > resultCacheBytes {
+		return
+	}
+	entry := &cachedResult{
+		key:     cacheKey(opts),
+		result:  result,
+		end:     end,
+		expires: end.Add(time.Duration(opts.CacheTTL * float64(time.Second))),
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := &s.results
+	kept := c.entries[:0]
+	c.bytes = 0
+	for _, old := range c.entries {
+		if old.key != entry.key && now.Before(old.expires) {
+			kept = append(kept, old)
+			c.bytes += len(old.result.Stdout) + len(old.result.Stderr)
+		}
+	}
+	clear(c.entries[len(kept):])
+	c.entries = append(kept, entry)
+	c.bytes += size
+	for len(c.entries) > resultCacheEntries || c.bytes > resultCacheBytes {
+		c.bytes -= len(c.entries[0].result.Stdout) + len(c.entries[0].result.Stderr)
+		c.entries[0] = nil
+		c.entries = c.entries[1:]
+	}
+}
+
+// cachedRuns returns the number of Runs answered from the cache.
+func (s *Server) cachedRuns() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.results.hits
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/rpc"
+	"strings"
+	"time"
+
+	"shellrunner/pkg/runner"
+)
+
+// DefaultSlowCalls are the slow-call thresholds of a new Server.
+var DefaultSlowCalls = map[string]time.Duration{"Run": time.Minute, "TopJobs": 15 * time.Second, "*": time.Second}
+
+// ParseDurations parses a comma-separated list of method=duration pairs, such
+// as "Run=10m,*=5s", into a map for Server.Timeouts or Server.SlowCalls.
+func ParseDurations(list string) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration)
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		method, value, ok := strings.Cut(pair, "=")
+		if !ok || method == "" {
+			return nil, fmt.Errorf("invalid method duration %q: must be method=duration", pair)
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid duration for %s: %q", method, value)
+		}
+		durations[method] = d
+	}
+	return durations, nil
+}
+
+// lookupDuration returns the duration for method in durations, falling back
+// to the "*" entry.
+func lookupDuration(durations map[string]time.Duration, method string) time.Duration {
+	if d, ok := durations[method]; ok {
+		return d
+	}
+	return durations["*"]
+}
+
+// context returns the context for a call to method, which is cancelled at
+// the method's deadline, when the server shuts down, and, if
+// cancelOnDisconnect is set, when the client disconnects.
+func (s *ShellRunner) context(method string, cancelOnDisconnect bool) (context.Context, context.CancelFunc) {
+	ctx := s.server.ctx
+	if cancelOnDisconnect {
+		ctx = s.connCtx
+	}
+	if timeout := lookupDuration(s.server.Timeouts, method); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// connCodec wraps the codec of a connection to cancel the connection's
+// context once the client goes away, and to track its calls in progress.
+type connCodec struct {
+	rpc.ServerCodec
+	server *Server
+	conn   *connection
+	cancel context.CancelFunc
+	// limit bounds the size of each request.
+	limit *requestLimit
+}
+
+func (c *connCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.ServerCodec.ReadRequestHeader(r); err != nil {
+		// The client has disconnected, or sent something that isn't
+		// JSON-RPC, and no more is read from the connection.
+		c.cancel()
+		return err
+	}
+	// The request has been read whole, arguments and all.
+	c.limit.reset()
+	c.server.calls.Add(1)
+	c.server.startCall(c.conn)
+	return nil
+}
+
+// WriteResponse is called exactly once for each request whose header was
+// read.
+func (c *connCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	defer c.server.calls.Done()
+	defer c.server.finishCall(c.conn)
+	return c.ServerCodec.WriteResponse(r, body)
+}
+
+// recordCalls is the interceptor that records the latency and outcome of
+// each call for Statistics and the metrics, and logs the calls that are slow
+// or time out.
+func (s *Server) recordCalls(call *Call, next Handler) error {
+	err := next(call)
+	elapsed := time.Since(call.Start)
+	s.methods.record(call.Method, elapsed, err != nil)
+	if threshold := lookupDuration(s.SlowCalls, call.Method); threshold > 0 && elapsed > threshold {
+		s.slowCalls.Add(1)
+		runner.Logger.Printf("Slow call: %s took %v", call.Method, elapsed.Round(time.Millisecond))
+	}
+	if Code(err) == CodeTimeout {
+		s.timeouts.Add(1)
+		runner.Logger.Printf("Call timed out: %s after %v", call.Method, elapsed.Round(time.Millisecond))
+	}
+	return err
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"shellrunner/pkg/runner"
+)
+
+// connection is an open client connection.
+type connection struct {
+	id        uint64
+	conn      net.Conn
+	user      string
+	connected time.Time
+	// kind is "rpc", or "exec" for a connection attached to a session.
+	// token is the name of the token the client presented, cert that of
+	// its client certificate, and agent what it calls itself through
+	// Identify. They are guarded by the server's mutex.
+	kind  string
+	token string
+	cert  string
+	agent string
+
+	// mu guards the calls in progress, so that the read deadline of an idle
+	// connection is never left set while a call is in progress.
+	mu         sync.Mutex
+	calls      int64
+	inFlight   int64
+	lastActive time.Time // when the last call started or finished
+}
+
+// openConnection starts tracking conn. It returns false if the server already
+// has MaxConnections open, in which case conn should be closed.
+func (s *Server) openConnection(conn net.Conn) (*connection, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.MaxConnections > 0 && len(s.conns) >= s.MaxConnections {
+		return nil, false
+	}
+	if s.conns == nil {
+		s.conns = make(map[uint64]*connection)
+	}
+	s.connCounter++
+	c := &connection{
+		id:        s.connCounter,
+		conn:      conn,
+		user:      peerUser(conn),
+		connected: time.Now(),
+		kind:      "rpc",
+	}
+	c.lastActive = c.connected
+	s.conns[c.id] = c
+	return c, true
+}
+
+// closeConnection stops tracking c.
+func (s *Server) closeConnection(c *connection) {
+	s.mu.Lock()
+	delete(s.conns, c.id)
+	s.mu.Unlock()
+}
+
+// startCall records the start of a call on c, which is no longer idle.
+func (s *Server) startCall(c *connection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	c.inFlight++
+	c.lastActive = time.Now()
+	c.conn.SetReadDeadline(time.Time{})
+}
+
+// finishCall records the end of a call on c, which becomes idle if it was
+// its last call in progress.
+func (s *Server) finishCall(c *connection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight--
+	c.lastActive = time.Now()
+	if c.inFlight == 0 {
+		s.idle(c)
+	}
+}
+
+// idle starts the idle timeout of c: reading its next call fails, closing
+// it, unless the call arrives in time. The caller must hold c.mu unless c is
+// not serving calls yet.
+func (s *Server) idle(c *connection) {
+	if s.IdleTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+	}
+}
+
+// ConnectionInfo describes an open client connection.
+type ConnectionInfo struct {
+	ID          string    `json:"id"`
+	Kind        string    `json:"kind"`            // "rpc", or "exec" when attached to a session
+	User        string    `json:"user,omitempty"`  // the peer's user ID, where known
+	Token       string    `json:"token,omitempty"` // the name of the token the client presented
+	Cert        string    `json:"cert,omitempty"`  // the name of the client certificate the client presented
+	Agent       string    `json:"agent,omitempty"` // what the client calls itself
+	RemoteAddr  string    `json:"remote_addr,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	AgeSeconds  float64   `json:"age_seconds"`
+	IdleSeconds float64   `json:"idle_seconds"` // time since the last call started or finished
+	Calls       int64     `json:"calls"`
+	InFlight    int64     `json:"in_flight"`
+}
+
+// Connections lists the server's open connections, oldest first, including
+// the one making the call.
+func (s *ShellRunner) Connections(args struct{}, reply *[]ConnectionInfo) error {
+	runner.Logger.Println("Connections called")
+	now := time.Now()
+	s.server.mu.Lock()
+	defer s.server.mu.Unlock()
+
+	conns := make([]*connection, 0, len(s.server.conns))
+	for _, c := range s.server.conns {
+		conns = append(conns, c)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+
+	*reply = make([]ConnectionInfo, 0, len(conns))
+	for _, c := range conns {
+		c.mu.Lock()
+		info := ConnectionInfo{
+			ID:          fmt.Sprint(c.id),
+			Kind:        c.kind,
+			User:        c.user,
+			Token:       c.token,
+			Cert:        c.cert,
+			Agent:       c.agent,
+			ConnectedAt: c.connected,
+			AgeSeconds:  now.Sub(c.connected).Seconds(),
+			IdleSeconds: now.Sub(c.lastActive).Seconds(),
+			Calls:       c.calls,
+			InFlight:    c.inFlight,
+		}
+		c.mu.Unlock()
+		if addr := c.conn.RemoteAddr(); addr != nil {
+			info.RemoteAddr = addr.String()
+		}
+		*reply = append(*reply, info)
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"shellrunner/pkg/runner"
+)
+
+// DefaultDiffContext is the number of unchanged lines shown around each
+// change by Diff, unless DiffArgs.Context says otherwise.
+const DefaultDiffContext = 3
+
+// DiffArgs defines the arguments for the Diff method.
+type DiffArgs struct {
+	A, B    string // IDs of the jobs to compare, from A to B
+	Stderr  bool   // also compare the jobs' stderr
+	Context *int   // unchanged lines around each change; DefaultDiffContext if nil
+}
+
+// Diff compares the output of two jobs, such as a failed run and the last
+// good run of the same command, and returns unified diffs of their stdout
+// and, if asked, their stderr.
+func (s *ShellRunner) Diff(args DiffArgs, reply *DiffResult) error {
+	runner.Logger.Printf("Diff called for job IDs: %s, %s", args.A, args.B)
+	context := DefaultDiffContext
+	if args.Context != nil {
+		if *args.Context < 0 {
+			return &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf("invalid context %d: must not be negative", *args.Context)}
+		}
+		context = *args.Context
+	}
+
+	var a, b JobOutput
+	for _, job := range []struct {
+		id     string
+		output *JobOutput
+	}{{args.A, &a}, {args.B, &b}} {
+		err := s.manager.WithJob(job.id, func(j *runner.Job) error {
+			job.output.Stdout = j.Stdout.String()
+			job.output.Stderr = j.Stderr.String()
+			return nil
+		})
+		if err != nil {
+			return rpcError(err)
+		}
+	}
+
+	reply.Stdout = unifiedDiff(a.Stdout, b.Stdout, "job "+args.A+" stdout", "job "+args.B+" stdout", context)
+	reply.Identical = a.Stdout == b.Stdout
+	if args.Stderr {
+		reply.Stderr = unifiedDiff(a.Stderr, b.Stderr, "job "+args.A+" stderr", "job "+args.B+" stderr", context)
+		reply.Identical = reply.Identical && a.Stderr == b.Stderr
+	}
+	return nil
+}
+
+// unifiedDiff returns the differences between the lines of a and b in the
+// unified format of diff -u, with context unchanged lines around each
+// change, or an empty string if a and b are the same.
+func unifiedDiff(a, b, nameA, nameB string, context int) string {
+	if a == b {
+		return ""
+	}
+	linesA, linesB := splitLines(a), splitLines(b)
+	edits := diffLines(linesA, linesB)
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", nameA, nameB)
+	// posA and posB are the line of a and b, counting from 0, at which each
+	// edit applies.
+	posA := make([]int, len(edits)+1)
+	posB := make([]int, len(edits)+1)
+	for i, e := range edits {
+		posA[i+1], posB[i+1] = posA[i], posB[i]
+		if e.op != '+' {
+			posA[i+1]++
+		}
+		if e.op != '-' {
+			posB[i+1]++
+		}
+	}
+
+	for i := 0; i < len(edits); {
+		if edits[i].op == ' ' {
+			i++
+			continue
+		}
+		// A hunk runs from context lines before a change to context lines
+		// after the last change that is less than 2*context lines from the
+		// one before it.
+		start := max(0, i-context)
+		end := i
+		for j := i; j < len(edits); j++ {
+			if edits[j].op != ' ' {
+				end = j + 1
+			} else if j-end >= 2*context {
+				break
+			}
+		}
+		end = min(len(edits), end+context)
+
+		countA, countB := posA[end]-posA[start], posB[end]-posB[start]
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(posA[start], countA), hunkRange(posB[start], countB))
+		for _, e := range edits[start:end] {
+			out.WriteByte(e.op)
+			out.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+	return out.String()
+}
+
+// hunkRange formats the range of count lines from line start, counting from
+// 0, in a hunk header.
+func hunkRange(start, count int) string {
+	switch count {
+	case 0:
+		// An empty range names the line before it.
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// splitLines splits s into lines, each with its newline, if any.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// edit is a line kept (' '), deleted ('-') or inserted ('+') on the way from
+// one text to another.
+type edit struct {
+	op   byte
+	line string
+}
+
+// diffLines returns the shortest edit script from a to b, found with Myers'
+// O(ND) algorithm.
+func diffLines(a, b []string) []edit {
+	n, m := len(a), len(b)
+	limit := n + m
+	// v holds, for each diagonal k = x-y, the furthest x reached on it, at
+	// index k+offset.
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	// trace holds v at the start of each round d, for diagonals -d to d,
+	// for finding the path back.
+	var trace [][]int
+	for d := 0; d <= limit; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[offset+k-1] < v[offset+k+1] {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace)
+			}
+		}
+	}
+	return nil
+}
+
+// backtrack follows the rounds in trace back from the ends of a and b, and
+// returns the edits on the way in order.
+func backtrack(a, b []string, trace [][]int) []edit {
+	x, y := len(a), len(b)
+	var edits []edit
+	for d := len(trace) - 1; d >= 0; d-- {
+		if d == 0 {
+			// The rest is the common start of a and b.
+			for x > 0 {
+				x--
+				edits = append(edits, edit{' ', a[x]})
+			}
+			break
+		}
+		v := trace[d]
+		at := func(k int) int { return v[k+d] }
+		k := x - y
+		var prevK int
+		if k == -d || k != d && at(k-1) < at(k+1) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			edits = append(edits, edit{' ', a[x]})
+		}
+		if x == prevX {
+			edits = append(edits, edit{'+', b[prevY]})
+		} else {
+			edits = append(edits, edit{'-', a[prevX]})
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
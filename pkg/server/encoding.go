@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// The encodings of job output in replies. JSON strings only carry text, so
+// output that is not valid UTF-8 is mangled unless it is base64-encoded.
+const (
+	EncodingText   = "text"   // output as it is; the default
+	EncodingBase64 = "base64" // output always base64-encoded
+	EncodingAuto   = "auto"   // output base64-encoded if it is binary
+)
+
+// checkEncoding checks that encoding is one of the output encodings.
+func checkEncoding(encoding string) error {
+	switch encoding {
+	case "", EncodingText, EncodingBase64, EncodingAuto:
+		return nil
+	}
+	return &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf("invalid encoding %q: must be text, base64 or auto", encoding)}
+}
+
+// isBinary reports whether output is binary: not valid UTF-8, or holding
+// NUL bytes, which text does not.
+func isBinary(output string) bool {
+	return !utf8.ValidString(output) || strings.IndexByte(output, 0) >= 0
+}
+
+// encodeOutput encodes stdout and stderr in place as encoding asks, and
+// returns the encoding used, if not text, and whether either is binary.
+func encodeOutput(encoding string, stdout, stderr *string) (string, bool) {
+	binary := isBinary(*stdout) || isBinary(*stderr)
+	if encoding == EncodingBase64 || encoding == EncodingAuto && binary {
+		*stdout = base64.StdEncoding.EncodeToString([]byte(*stdout))
+		*stderr = base64.StdEncoding.EncodeToString([]byte(*stderr))
+		return EncodingBase64, binary
+	}
+	return "", binary
+}
+
+// decodeOutput returns output as it was before encodeOutput.
+func decodeOutput(encoding, output string) ([]byte, error) {
+	if encoding == EncodingBase64 {
+		return base64.StdEncoding.DecodeString(output)
+	}
+	return []byte(output), nil
+}
+
+// Decode returns the command's stdout and stderr, decoding them if they
+// were base64-encoded.
+func (r RunResult) Decode() (stdout, stderr []byte, err error) {
+	if stdout, err = decodeOutput(r.Encoding, r.Stdout); err != nil {
+		return nil, nil, err
+	}
+	stderr, err = decodeOutput(r.Encoding, r.Stderr)
+	return stdout, stderr, err
+}
+
+// Decode returns the job's stdout and stderr, decoding them if they were
+// base64-encoded.
+func (o JobOutput) Decode() (stdout, stderr []byte, err error) {
+	if stdout, err = decodeOutput(o.Encoding, o.Stdout); err != nil {
+		return nil, nil, err
+	}
+	stderr, err = decodeOutput(o.Encoding, o.Stderr)
+	return stdout, stderr, err
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"shellrunner/pkg/runner"
+)
+
+// ErrorCode classifies an Error so clients can act on failures without
+// matching on messages.
+type ErrorCode string
+
+const (
+	CodeJobNotFound      ErrorCode = "JOB_NOT_FOUND"
+	CodeGroupNotFound    ErrorCode = "GROUP_NOT_FOUND"
+	CodeSecretNotFound   ErrorCode = "SECRET_NOT_FOUND"
+	CodeInvalidArgument  ErrorCode = "INVALID_ARGUMENT"
+	CodePolicyDenied     ErrorCode = "POLICY_DENIED"
+	CodePermissionDenied ErrorCode = "PERMISSION_DENIED"
+	CodeInvalidState     ErrorCode = "INVALID_STATE"
+	CodeTimeout          ErrorCode = "TIMEOUT"
+	CodeCancelled        ErrorCode = "CANCELLED"
+	CodeRateLimited      ErrorCode = "RATE_LIMITED"
+	CodeQuotaExceeded    ErrorCode = "QUOTA_EXCEEDED"
+	CodeOverloaded       ErrorCode = "OVERLOADED"
+	CodeHostOverloaded   ErrorCode = "HOST_OVERLOADED"
+	CodeUnavailable      ErrorCode = "UNAVAILABLE"
+	CodeInternal         ErrorCode = "INTERNAL"
+)
+
+// Error is the error returned by the ShellRunner methods. The JSON-RPC error
+// field carries its JSON encoding, which is also what its Error method
+// returns, so clients in any language can decode it.
+type Error struct {
+	Code    ErrorCode              `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return e.Message
+	}
+	return string(data)
+}
+
+// rpcError converts an error from the job manager into an *Error.
+func rpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	code := CodeInternal
+	switch {
+	case errors.Is(err, runner.ErrJobNotFound):
+		code = CodeJobNotFound
+	case errors.Is(err, runner.ErrGroupNotFound):
+		code = CodeGroupNotFound
+	case errors.Is(err, runner.ErrSecretNotFound):
+		code = CodeSecretNotFound
+	case errors.Is(err, runner.ErrPolicyDenied):
+		code = CodePolicyDenied
+	case errors.Is(err, runner.ErrInvalidSpec):
+		code = CodeInvalidArgument
+	case errors.Is(err, runner.ErrJobState):
+		code = CodeInvalidState
+	case errors.Is(err, runner.ErrOverloaded):
+		code = CodeOverloaded
+	case errors.Is(err, runner.ErrHostOverloaded):
+		code = CodeHostOverloaded
+	case errors.Is(err, context.Canceled):
+		code = CodeCancelled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = CodeTimeout
+	}
+	return &Error{Code: code, Message: err.Error()}
+}
+
+// ParseError decodes the message of an error returned over JSON-RPC into an
+// *Error. Messages that are not an encoded Error, such as those of older
+// servers, become errors with CodeInternal.
+func ParseError(message string) *Error {
+	var e Error
+	if err := json.Unmarshal([]byte(message), &e); err != nil || e.Code == "" {
+		return &Error{Code: CodeInternal, Message: message}
+	}
+	return &e
+}
+
+// Code returns the code of err if it is or wraps an *Error, CodeInternal if
+// it is any other error, and the empty code if it is nil.
+func Code(err error) ErrorCode {
+	if err == nil {
+		return ""
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return CodeInternal
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"shellrunner/pkg/runner"
+)
+
+// MaxFileChunk is the most data PutFile, GetFile and WriteStdin move in one
+// call. Larger files are moved in chunks, as pkg/client does.
+const MaxFileChunk = 4 << 20
+
+// PutFileArgs defines the arguments for the PutFile method.
+type PutFileArgs struct {
+	Path string // absolute path of the file on the server, within -file-dirs or the workspace of one of the caller's jobs
+	// Data is the chunk to write at Offset, base64-encoded in JSON.
+	Data   []byte
+	Offset int64  // 0 creates or truncates the file; otherwise at most its size
+	Mode   uint32 // permissions of a file created at offset 0; 0644 by default
+}
+
+// PutFile writes a chunk of a file on the server, such as a script or an
+// input file for a job to use. A file is uploaded by writing its chunks in
+// order, starting at offset 0. The reply is the file's size after the write.
+func (s *ShellRunner) PutFile(args PutFileArgs, reply *int64) error {
+	runner.Logger.Printf("PutFile called for path: %s, offset: %d, length: %d", args.Path, args.Offset, len(args.Data))
+	path, err := s.manager.FilePath(args.Path, s.ownFilter())
+	if err != nil {
+		return rpcError(err)
+	}
+	if len(args.Data) > MaxFileChunk {
+		return &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf("chunk of %d bytes is larger than the maximum of %d", len(args.Data), MaxFileChunk)}
+	}
+
+	flags := os.O_WRONLY
+	mode := fs.FileMode(0o644)
+	if args.Offset == 0 {
+		flags |= os.O_CREATE | os.O_TRUNC
+		if args.Mode != 0 {
+			mode = fs.FileMode(args.Mode).Perm()
+		}
+	}
+	f, err := os.OpenFile(path, flags, mode)
+	if err != nil {
+		return fileError(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fileError(err)
+	}
+	if args.Offset < 0 || args.Offset > info.Size() {
+		return &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf("offset %d is outside the file, of %d bytes", args.Offset, info.Size())}
+	}
+	if _, err := f.WriteAt(args.Data, args.Offset); err != nil {
+		return fileError(err)
+	}
+	if err := f.Close(); err != nil {
+		return fileError(err)
+	}
+	*reply = max(info.Size(), args.Offset+int64(len(args.Data)))
+	return nil
+}
+
+// GetFileArgs defines the arguments for the GetFile method.
+type GetFileArgs struct {
+	Path   string // absolute path of the file on the server, within -file-dirs or the workspace or artifacts of one of the caller's jobs
+	Offset int64
+	Length int // bytes to read at most; MaxFileChunk if 0 or more than that
+}
+
+// GetFile reads a chunk of a file on the server, such as an artifact a job
+// wrote. A file is downloaded by reading chunks until EOF is set.
+func (s *ShellRunner) GetFile(args GetFileArgs, reply *FileChunk) error {
+	runner.Logger.Printf("GetFile called for path: %s, offset: %d", args.Path, args.Offset)
+	path, err := s.manager.FilePath(args.Path, s.ownFilter())
+	if err != nil {
+		return rpcError(err)
+	}
+	if args.Offset < 0 || args.Length < 0 {
+		return &Error{Code: CodeInvalidArgument, Message: "offset and length must not be negative"}
+	}
+	length := args.Length
+	if length == 0 || length > MaxFileChunk {
+		length = MaxFileChunk
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fileError(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fileError(err)
+	}
+	if info.IsDir() {
+		return &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf("%s is a directory", args.Path)}
+	}
+	data := make([]byte, min(int64(length), max(0, info.Size()-args.Offset)))
+	n, err := f.ReadAt(data, args.Offset)
+	if err != nil && err != io.EOF {
+		return fileError(err)
+	}
+	*reply = FileChunk{
+		Data: data[:n],
+		Size: info.Size(),
+		EOF:  args.Offset+int64(n) >= info.Size(),
+		Mode: uint32(info.Mode().Perm()),
+	}
+	return nil
+}
+
+// fileError converts an error from the file system into an *Error.
+func fileError(err error) error {
+	code := CodeInternal
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) || errors.Is(err, fs.ErrExist) {
+		code = CodeInvalidArgument
+	}
+	return &Error{Code: code, Message: err.Error()}
+}
+
+// Artifacts lists the artifacts of a job, for GetFile to fetch: the copies
+// of the files matching its artifact patterns, collected when it exits, or
+// else the files in its workspace, in order of name.
+func (s *ShellRunner) Artifacts(id string, reply *[]runner.Artifact) error {
+	runner.Logger.Printf("Artifacts called for job ID: %s", id)
+	artifacts, err := s.manager.Artifacts(id)
+	if err != nil {
+		if errors.Is(err, runner.ErrJobNotFound) || errors.Is(err, runner.ErrInvalidSpec) {
+			return rpcError(err)
+		}
+		return fileError(err)
+	}
+	*reply = artifacts
+	return nil
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"unicode"
+
+	"shellrunner/pkg/runner"
+)
+
+// MaxAgentLength is the longest name a client may give itself with Identify.
+const MaxAgentLength = 128
+
+// IdentifyArgs defines the arguments for the Identify method.
+type IdentifyArgs struct {
+	// Agent is what the client calls itself, such as "nightly-backup". It
+	// is the client's own claim, unlike its user, token and certificate.
+	Agent string
+}
+
+// Identify names the client for the jobs it submits on this connection from
+// now on, and returns the identity they are recorded with.
+func (s *ShellRunner) Identify(args IdentifyArgs, reply *runner.Identity) error {
+	runner.Logger.Printf("Identify called with agent %q", args.Agent)
+	if len(args.Agent) > MaxAgentLength {
+		return &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf("agent is longer than %d bytes", MaxAgentLength)}
+	}
+	for _, r := range args.Agent {
+		if !unicode.IsPrint(r) {
+			return &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf("agent %q has unprintable characters", args.Agent)}
+		}
+	}
+	if s.conn != nil {
+		s.server.mu.Lock()
+		s.conn.agent = args.Agent
+		s.server.mu.Unlock()
+	}
+	*reply = s.identity()
+	return nil
+}
+
+// identity returns the identity of the client the receiver serves.
+func (s *ShellRunner) identity() runner.Identity {
+	if s.conn == nil {
+		return runner.Identity{User: s.user}
+	}
+	return s.server.connIdentity(s.conn)
+}
+
+// connIdentity returns the identity of the client on c.
+func (s *Server) connIdentity(c *connection) runner.Identity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return runner.Identity{User: c.user, Token: c.token, Cert: c.cert, Agent: c.agent}
+}
+
+// jobSpec returns the JobSpec described by opts, submitted by the client
+// the receiver serves.
+func (s *ShellRunner) jobSpec(opts JobOptions) *runner.JobSpec {
+	spec := opts.spec()
+	spec.Submitter = s.identity()
+	return spec
+}
+
+// submitter returns the identity of the client that submitted job, or nil if
+// it is unknown.
+func submitter(job *runner.Job) *runner.Identity {
+	if job.Spec.Submitter == (runner.Identity{}) {
+		return nil
+	}
+	id := job.Spec.Submitter
+	return &id
+}
+
+// IdentityStats are the statistics of the jobs of one client.
+type IdentityStats struct {
+	Submitted   int64   `json:"submitted"` // including jobs denied before they started
+	Finished    int64   `json:"finished"`
+	Succeeded   int64   `json:"succeeded"`
+	Failed      int64   `json:"failed"`
+	RunSeconds  float64 `json:"run_seconds"`  // total time its jobs ran
+	OutputBytes int64   `json:"output_bytes"` // total stdout and stderr its jobs wrote
+}
+
+// identityMetrics counts the jobs of each client, by its identity as
+// runner.Identity.String returns it, and of each tenant, by the identity it
+// is held to quotas as.
+type identityMetrics struct {
+	mu         sync.Mutex
+	identities map[string]*IdentityStats
+	tenants    map[string]*IdentityStats
+}
+
+// statsOf returns the statistics of key in m, which it makes if need be. The
+// caller must hold im.mu.
+func statsOf(m *map[string]*IdentityStats, key string) *IdentityStats {
+	if *m == nil {
+		*m = make(map[string]*IdentityStats)
+	}
+	stats, ok := (*m)[key]
+	if !ok {
+		stats = &IdentityStats{}
+		(*m)[key] = stats
+	}
+	return stats
+}
+
+// each returns the statistics of the client id and of its tenant. The
+// caller must hold im.mu.
+func (im *identityMetrics) each(id runner.Identity) [2]*IdentityStats {
+	key := id.String()
+	if key == "" {
+		key = "unknown"
+	}
+	return [2]*IdentityStats{statsOf(&im.identities, key), statsOf(&im.tenants, quotaKey(id))}
+}
+
+// submitted counts a job submitted by id.
+func (im *identityMetrics) submitted(id runner.Identity) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	for _, stats := range im.each(id) {
+		stats.Submitted++
+	}
+}
+
+// finished counts job, which has finished.
+func (im *identityMetrics) finished(job *runner.Job) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	for _, stats := range im.each(job.Spec.Submitter) {
+		stats.Finished++
+		if job.Result == runner.ResultSuccess {
+			stats.Succeeded++
+		} else {
+			stats.Failed++
+		}
+		stats.RunSeconds += job.EndTime.Sub(job.StartTime).Seconds()
+		stats.OutputBytes += job.Stdout.Written() + job.Stderr.Written()
+	}
+}
+
+// stats returns a copy of the statistics of each client.
+func (im *identityMetrics) stats() map[string]IdentityStats {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	return copyStats(im.identities)
+}
+
+// tenantStats returns a copy of the statistics of each tenant.
+func (im *identityMetrics) tenantStats() map[string]IdentityStats {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	return copyStats(im.tenants)
+}
+
+// copyStats returns a copy of the statistics in m.
+func copyStats(m map[string]*IdentityStats) map[string]IdentityStats {
+	stats := make(map[string]IdentityStats, len(m))
+	for key, s := range m {
+		stats[key] = *s
+	}
+	return stats
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"os"
+	"time"
+
+	"shellrunner/pkg/runner"
+)
+
+// ServerInfo describes the server process.
+type ServerInfo struct {
+	PID       int  `json:"pid"`
+	Subreaper bool `json:"subreaper"` // whether processes jobs leave behind are adopted
+	// Instance is the server's instance name, if it has one.
+	Instance string `json:"instance,omitempty"`
+	// ReapedStrays counts the adopted processes reaped once they exited,
+	// and RunningStrays those still running.
+	ReapedStrays  int64 `json:"reaped_strays"`
+	RunningStrays int   `json:"running_strays"`
+	// Store is the size of what the server remembers besides its jobs.
+	Store StoreInfo `json:"store"`
+}
+
+// Info describes the server process.
+func (s *ShellRunner) Info(args struct{}, reply *ServerInfo) error {
+	runner.Logger.Println("Info called")
+	stats := runner.SubreaperStats()
+	*reply = ServerInfo{
+		PID:           os.Getpid(),
+		Subreaper:     stats.Enabled,
+		ReapedStrays:  stats.Reaped,
+		RunningStrays: stats.Running,
+		Instance:      s.server.Instance,
+		Store:         s.server.store(),
+	}
+	return nil
+}
+
+// Pong is the reply of Ping.
+type Pong struct {
+	ServerTime time.Time `json:"server_time"`
+	// Counter counts the pings the server has answered, this one included,
+	// so that a client can tell a restarted server, or pings answered out
+	// of order.
+	Counter uint64 `json:"counter"`
+}
+
+// Ping replies at once with the server's time, so that clients can measure
+// the round trip of a call without running anything.
+func (s *ShellRunner) Ping(args struct{}, reply *Pong) error {
+	runner.Logger.Println("Ping called")
+	*reply = Pong{ServerTime: time.Now(), Counter: s.server.pings.Add(1)}
+	return nil
+}
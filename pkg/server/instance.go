@@ -0,0 +1,45 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+)
+
+// instanceName matches the names of instances, which are used in paths.
+var instanceName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// CheckInstance returns an error unless name can name an instance: letters,
+// digits, '.', '_' and '-', starting with a letter or a digit.
+func CheckInstance(name string) error {
+	if !instanceName.MatchString(name) {
+		return fmt.Errorf("invalid instance name %q: want letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+// InstanceDir returns the directory the files of instance name are kept in:
+// shellrunner/<name> in $XDG_STATE_HOME, or else ~/.local/state, or the
+// local application data directory on Windows.
+func InstanceDir(name string) (string, error) {
+	if err := CheckInstance(name); err != nil {
+		return "", err
+	}
+	base := os.Getenv("XDG_STATE_HOME")
+	if base == "" && runtime.GOOS == "windows" {
+		var err error
+		if base, err = os.UserCacheDir(); err != nil {
+			return "", err
+		}
+	}
+	if base == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		base = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(base, "shellrunner", name), nil
+}
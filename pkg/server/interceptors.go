@@ -0,0 +1,181 @@
+package server
+
+import (
+	"fmt"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"shellrunner/pkg/runner"
+)
+
+// Call is a call to one of the ShellRunner methods, as the interceptors
+// around it see it.
+type Call struct {
+	Method string // the method's name, such as "Run"
+	// Args points to the call's arguments, such as a *RunArgs, which an
+	// interceptor may change but not replace. Reply points to its reply,
+	// which the method fills in.
+	Args     any
+	Reply    any
+	Identity runner.Identity // the client making the call
+	Start    time.Time
+
+	receiver *ShellRunner
+	method   rpcMethod
+}
+
+// Handler handles a call, returning the error it fails with, if any.
+type Handler func(call *Call) error
+
+// Interceptor runs around the handling of each call. It calls next to go on
+// with the call, possibly after changing its arguments, or returns an error
+// to fail the call without it.
+type Interceptor func(call *Call, next Handler) error
+
+// interceptors returns the interceptors each call goes through, outermost
+// first: the server's own, which record, trace and audit calls and then
+// enforce the Admin methods, the ACL and tenants' ownership of their jobs,
+// forward the calls for jobs still running on the server this one upgraded
+// from, refuse new jobs once the server has handed over to an upgraded one
+// and enforce the rate limits, followed by s.Interceptors.
+func (s *Server) interceptors() []Interceptor {
+	own := []Interceptor{s.recordCalls, s.traceCalls, s.auditCalls, s.adminOnly, s.enforceACL, s.ownJobs, s.forwardRunning, s.refuseHandedOver, s.rateLimit}
+	return append(own, s.Interceptors...)
+}
+
+// rpcMethod is a method of ShellRunner that clients can call.
+type rpcMethod struct {
+	fn    reflect.Value // func(*ShellRunner, args, reply) error
+	args  reflect.Type
+	reply reflect.Type // a pointer
+}
+
+// rpcMethods returns the methods of ShellRunner clients can call, by name:
+// those that, as net/rpc would have them, take arguments and a pointer to a
+// reply and return an error.
+var rpcMethods = sync.OnceValue(func() map[string]rpcMethod {
+	errorType := reflect.TypeFor[error]()
+	receiver := reflect.TypeFor[*ShellRunner]()
+	methods := make(map[string]rpcMethod)
+	for i := range receiver.NumMethod() {
+		m := receiver.Method(i)
+		t := m.Type
+		if t.NumIn() != 3 || t.NumOut() != 1 || t.Out(0) != errorType || t.In(2).Kind() != reflect.Pointer {
+			continue
+		}
+		methods[m.Name] = rpcMethod{fn: m.Func, args: t.In(1), reply: t.In(2)}
+	}
+	return methods
+})
+
+// newCall returns a call of method by the client the receiver serves, with
+// args pointing to its arguments.
+func (s *ShellRunner) newCall(name string, method rpcMethod, args any) *Call {
+	reply := reflect.New(method.reply.Elem())
+	// Like net/rpc, replies that are maps or slices start out empty, not
+	// nil.
+	switch method.reply.Elem().Kind() {
+	case reflect.Map:
+		reply.Elem().Set(reflect.MakeMap(method.reply.Elem()))
+	case reflect.Slice:
+		reply.Elem().Set(reflect.MakeSlice(method.reply.Elem(), 0, 0))
+	}
+	return &Call{
+		Method:   name,
+		Args:     args,
+		Reply:    reply.Interface(),
+		Identity: s.identity(),
+		Start:    time.Now(),
+		receiver: s,
+		method:   method,
+	}
+}
+
+// handle passes call through the interceptors to its method.
+func (s *ShellRunner) handle(call *Call) error {
+	next := Handler(func(call *Call) error {
+		args := reflect.ValueOf(call.Args).Elem()
+		out := call.method.fn.Call([]reflect.Value{reflect.ValueOf(call.receiver), args, reflect.ValueOf(call.Reply)})
+		err, _ := out[0].Interface().(error)
+		return err
+	})
+	interceptors := s.server.interceptors()
+	if s.forwarded {
+		// The server that forwarded the call has put it through its
+		// interceptors already.
+		interceptors = nil
+	}
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := interceptors[i], next
+		next = func(call *Call) error { return interceptor(call, inner) }
+	}
+	return next(call)
+}
+
+// Invoke calls method, such as "Run", as a client would, through the
+// interceptors, so that an embedder can call the methods in-process. args
+// is the method's arguments and reply a pointer to its reply, of the types
+// the method takes.
+func (s *ShellRunner) Invoke(method string, args, reply any) error {
+	m, ok := rpcMethods()[method]
+	if !ok {
+		return &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf("unknown method %q", method)}
+	}
+	if reflect.TypeOf(args) != m.args || reflect.TypeOf(reply) != m.reply {
+		return &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf("%s takes %v and %v", method, m.args, m.reply)}
+	}
+	argv := reflect.New(m.args)
+	argv.Elem().Set(reflect.ValueOf(args))
+	call := s.newCall(method, m, argv.Interface())
+	call.Reply = reply
+	return s.handle(call)
+}
+
+// serveCodec reads calls from codec and handles each in a goroutine of its
+// own, as net/rpc does, until the client disconnects. It closes codec once
+// the calls in progress have been answered.
+func (s *ShellRunner) serveCodec(codec rpc.ServerCodec) {
+	var sending sync.Mutex
+	var wg sync.WaitGroup
+	respond := func(req *rpc.Request, reply any, err error) {
+		resp := &rpc.Response{ServiceMethod: req.ServiceMethod, Seq: req.Seq}
+		if err != nil {
+			resp.Error, reply = err.Error(), struct{}{}
+		}
+		sending.Lock()
+		defer sending.Unlock()
+		if err := codec.WriteResponse(resp, reply); err != nil {
+			runner.Logger.Printf("Error writing the response to %s: %v", req.ServiceMethod, err)
+		}
+	}
+	for {
+		var req rpc.Request
+		if err := codec.ReadRequestHeader(&req); err != nil {
+			break
+		}
+		name, _ := strings.CutPrefix(req.ServiceMethod, "ShellRunner.")
+		method, ok := rpcMethods()[name]
+		if !ok || name == req.ServiceMethod {
+			codec.ReadRequestBody(nil)
+			respond(&req, nil, fmt.Errorf("rpc: can't find method %s", req.ServiceMethod))
+			continue
+		}
+		args := reflect.New(method.args)
+		if err := codec.ReadRequestBody(args.Interface()); err != nil {
+			respond(&req, nil, fmt.Errorf("rpc: reading the arguments of %s: %v", req.ServiceMethod, err))
+			continue
+		}
+		call := s.newCall(name, method, args.Interface())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.handle(call)
+			respond(&req, call.Reply, err)
+		}()
+	}
+	wg.Wait()
+	codec.Close()
+}
@@ -0,0 +1,408 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// authPreamble starts the first line a client sends on a listener with a
+// token, followed by the token.
+const authPreamble = "AUTH "
+
+// authTimeout is how long a client on a listener with a token has to send
+// it, including the TLS handshake.
+const authTimeout = 10 * time.Second
+
+// ListenerConfig describes one of the endpoints a server serves, each with
+// its own authentication.
+type ListenerConfig struct {
+	// Network is "unix" to serve JSON-RPC on the Unix socket, or named pipe
+	// on Windows, at Address; "tls" to serve it over TLS on the TCP
+	// Address; or "http" to serve the HTTP endpoints, /metrics, on it.
+	Network string
+	Address string
+	// CertFile and KeyFile are the PEM certificate and key to serve TLS
+	// with. A tls listener needs them, and an http listener with them
+	// serves HTTPS.
+	CertFile string
+	KeyFile  string
+	// Token, if set, is the secret clients must present: as the first line
+	// "AUTH <token>" on a unix or tls listener, and as a bearer token on an
+	// http listener. Tokens maps the names of other secrets clients may
+	// present instead to the secrets, so that the jobs of a client are
+	// recorded with the name of its token. A tls listener needs one or the
+	// other.
+	Token  string
+	Tokens map[string]string
+	// ClientCAFile, if set, is the PEM bundle of the CAs a client
+	// certificate must be signed by, which every client of a tls listener
+	// must then present. The jobs of a client are recorded with the name of
+	// its certificate: the name CertNames maps its common name or one of
+	// its subject alternative names to, tried in that order, or else its
+	// common name, first DNS name, email address or URI. With CertNames, a
+	// certificate none of whose names it maps is refused. A tls listener
+	// with a ClientCAFile needs no token, but clients must present both if
+	// it has one.
+	ClientCAFile string
+	CertNames    map[string]string
+	// Users, if set, are the IDs of the only users served on a unix
+	// listener, as identified by their peer credentials. Those are only
+	// read on Linux, so elsewhere no one is served. An abstract socket,
+	// such as "@shellrunner", serves only the server's user by default.
+	Users []string
+}
+
+// ParseListener parses a listener such as "unix:/run/shellrunner.sock",
+// "tls:0.0.0.0:7443,cert=server.pem,key=server.key,token-file=token" or
+// "http:localhost:9090": a network and an address, followed by
+// comma-separated options. The options are cert and key, token-file, a file
+// holding the token, client-ca, the CAs of client certificates, cert-names,
+// a file mapping their names, and users, a colon-separated list of user
+// IDs. Each line of the token file is either the token or, for Tokens, a
+// name and a token separated by a colon, and each line of the cert-names
+// file a name and the certificate name it is for, such as
+// "deploy:spiffe://example.com/deploy".
+func ParseListener(spec string) (ListenerConfig, error) {
+	network, rest, ok := strings.Cut(spec, ":")
+	if !ok {
+		return ListenerConfig{}, fmt.Errorf("listener %q: want network:address", spec)
+	}
+	fields := strings.Split(rest, ",")
+	cfg := ListenerConfig{Network: network, Address: fields[0]}
+	for _, option := range fields[1:] {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "cert":
+			cfg.CertFile = value
+		case "key":
+			cfg.KeyFile = value
+		case "token-file":
+			if err := cfg.readTokens(value); err != nil {
+				return ListenerConfig{}, fmt.Errorf("listener %q: %w", spec, err)
+			}
+		case "client-ca":
+			cfg.ClientCAFile = value
+		case "cert-names":
+			if err := cfg.readCertNames(value); err != nil {
+				return ListenerConfig{}, fmt.Errorf("listener %q: %w", spec, err)
+			}
+		case "users":
+			cfg.Users = strings.Split(value, ":")
+		default:
+			return ListenerConfig{}, fmt.Errorf("listener %q: unknown option %q", spec, key)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return ListenerConfig{}, fmt.Errorf("listener %q: %w", spec, err)
+	}
+	return cfg, nil
+}
+
+// readTokens reads the tokens of cfg from the file at path.
+func (cfg *ListenerConfig) readTokens(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		name, token, named := strings.Cut(line, ":")
+		switch {
+		case line == "":
+		case !named:
+			cfg.Token = line
+		case name == "" || token == "":
+			return fmt.Errorf("%s: a named token needs both a name and a token", path)
+		default:
+			if cfg.Tokens == nil {
+				cfg.Tokens = make(map[string]string)
+			}
+			cfg.Tokens[name] = token
+		}
+	}
+	return nil
+}
+
+// readCertNames reads the CertNames of cfg from the file at path.
+func (cfg *ListenerConfig) readCertNames(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	cfg.CertNames = make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		name, certName, ok := strings.Cut(line, ":")
+		if !ok || name == "" || certName == "" {
+			return fmt.Errorf("%s: each line needs a name and a certificate name", path)
+		}
+		cfg.CertNames[certName] = name
+	}
+	return nil
+}
+
+// validate checks that cfg describes a listener that can be served.
+func (cfg ListenerConfig) validate() error {
+	switch cfg.Network {
+	case "unix", "tls", "http":
+	default:
+		return fmt.Errorf("unknown network %q: want unix, tls or http", cfg.Network)
+	}
+	if cfg.Address == "" {
+		return errors.New("no address")
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return errors.New("cert and key must be set together")
+	}
+	if cfg.CertFile != "" && cfg.Network == "unix" {
+		return errors.New("unix listeners do not serve TLS")
+	}
+	if cfg.Network == "tls" && (cfg.CertFile == "" || !cfg.hasTokens() && cfg.ClientCAFile == "") {
+		return errors.New("tls listeners need a cert, a key and a token or client CA")
+	}
+	if cfg.ClientCAFile != "" && cfg.Network != "tls" {
+		return errors.New("only tls listeners can verify client certificates")
+	}
+	if len(cfg.CertNames) > 0 && cfg.ClientCAFile == "" {
+		return errors.New("cert names need a client CA")
+	}
+	if len(cfg.Users) > 0 && cfg.Network != "unix" {
+		return errors.New("only unix listeners can allow users")
+	}
+	return nil
+}
+
+// hasTokens reports whether clients must present a token.
+func (cfg ListenerConfig) hasTokens() bool {
+	return cfg.Token != "" || len(cfg.Tokens) > 0
+}
+
+// checkToken returns the name of the token of cfg that token is, which is
+// empty for Token, and whether it is one at all.
+func (cfg ListenerConfig) checkToken(token string) (string, bool) {
+	ok := subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Token)) == 1 && cfg.Token != ""
+	var name string
+	for tokenName, secret := range cfg.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1 {
+			name, ok = tokenName, true
+		}
+	}
+	return name, ok
+}
+
+// Listen opens the listener cfg describes, for ServeListener to serve.
+func (cfg ListenerConfig) Listen() (net.Listener, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Network == "unix" {
+		return Listen(cfg.Address)
+	}
+	listener, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.wrap(listener)
+}
+
+// ListenFile makes the listener cfg describes of a socket that is already
+// listening, such as one inherited from the server an upgraded one
+// replaces.
+func (cfg ListenerConfig) ListenFile(f *os.File) (net.Listener, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	if l, ok := listener.(*net.UnixListener); ok && !strings.HasPrefix(cfg.Address, "@") {
+		// The socket file is this server's to remove now.
+		l.SetUnlinkOnClose(true)
+	}
+	if cfg.Network == "unix" {
+		return listener, nil
+	}
+	return cfg.wrap(listener)
+}
+
+// filer is a listener whose socket can be handed to another process.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// tlsListener is a TLS listener that keeps the listener it wraps, so that
+// its socket can be handed over.
+type tlsListener struct {
+	net.Listener
+	inner net.Listener
+}
+
+func (l tlsListener) File() (*os.File, error) {
+	f, ok := l.inner.(filer)
+	if !ok {
+		return nil, fmt.Errorf("%T cannot be handed over", l.inner)
+	}
+	return f.File()
+}
+
+// wrap makes listener, a TCP listener, serve TLS if cfg has a certificate.
+// It closes listener if it fails.
+func (cfg ListenerConfig) wrap(listener net.Listener) (net.Listener, error) {
+	if cfg.CertFile == "" {
+		return listener, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.ClientCAFile != "" {
+		bundle, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(bundle) {
+			listener.Close()
+			return nil, fmt.Errorf("%s: no certificates found", cfg.ClientCAFile)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsListener{tls.NewListener(listener, config), listener}, nil
+}
+
+// certName returns the name the jobs of a client presenting cert are
+// recorded with, or an error if cfg refuses it.
+func (cfg ListenerConfig) certName(cert *x509.Certificate) (string, error) {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if len(cfg.CertNames) == 0 {
+			return name, nil
+		}
+		if mapped, ok := cfg.CertNames[name]; ok {
+			return mapped, nil
+		}
+	}
+	return "", fmt.Errorf("certificate %q has no known name", cert.Subject)
+}
+
+// ServeListener serves listener, opened by cfg.Listen, as cfg describes,
+// until it is closed or the server shuts down. A server can serve any
+// number of listeners at once, each in its own goroutine.
+func (s *Server) ServeListener(listener net.Listener, cfg ListenerConfig) error {
+	if cfg.Network == "unix" && strings.HasPrefix(cfg.Address, "@") && len(cfg.Users) == 0 {
+		// Abstract sockets have no file permissions, so any user could
+		// connect to one: only the server's own user may by default.
+		cfg.Users = []string{strconv.Itoa(os.Getuid())}
+	}
+	if cfg.Network == "http" {
+		return s.serveHTTP(listener, &cfg)
+	}
+	return s.serve(listener, &cfg)
+}
+
+// serveHTTP serves the HTTP endpoints on listener until it is closed or the
+// server shuts down.
+func (s *Server) serveHTTP(listener net.Listener, cfg *ListenerConfig) error {
+	if !s.track(listener) {
+		listener.Close()
+		return net.ErrClosed
+	}
+	defer s.untrack(listener)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.MetricsHandler())
+	var handler http.Handler = mux
+	if cfg.hasTokens() {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if _, ok := cfg.checkToken(token); !ok {
+				s.authFailures.Add(1)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			mux.ServeHTTP(w, r)
+		})
+	}
+	httpServer := &http.Server{Handler: handler, ReadHeaderTimeout: authTimeout}
+	err := httpServer.Serve(listener)
+	if errors.Is(err, http.ErrServerClosed) {
+		return net.ErrClosed
+	}
+	return err
+}
+
+// authenticate checks that the client on c may be served on the listener
+// cfg describes, verifying its certificate and reading its token from input
+// if it needs them, and records their names on c.
+func (s *Server) authenticate(c *connection, input *bufio.Reader, cfg *ListenerConfig) error {
+	if len(cfg.Users) > 0 && !slices.Contains(cfg.Users, c.user) {
+		return fmt.Errorf("user %q is not allowed", c.user)
+	}
+	if !cfg.hasTokens() && cfg.ClientCAFile == "" {
+		return nil
+	}
+	c.conn.SetDeadline(time.Now().Add(authTimeout))
+	var certName string
+	if cfg.ClientCAFile != "" {
+		tlsConn, ok := c.conn.(*tls.Conn)
+		if !ok {
+			return errors.New("client certificates need TLS")
+		}
+		// The handshake verifies the certificate against the client CAs.
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("TLS handshake: %w", err)
+		}
+		name, err := cfg.certName(tlsConn.ConnectionState().PeerCertificates[0])
+		if err != nil {
+			return err
+		}
+		certName = name
+	}
+	var tokenName string
+	if cfg.hasTokens() {
+		line, err := input.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("reading token: %w", err)
+		}
+		token, ok := strings.CutPrefix(strings.TrimRight(line, "\r\n"), authPreamble)
+		name, valid := cfg.checkToken(token)
+		if !ok || !valid {
+			return errors.New("invalid token")
+		}
+		tokenName = name
+	}
+	c.conn.SetDeadline(time.Time{})
+	s.mu.Lock()
+	c.token, c.cert = tokenName, certName
+	s.mu.Unlock()
+	return nil
+}
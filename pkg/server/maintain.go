@@ -0,0 +1,93 @@
+package server
+
+import (
+	"time"
+
+	"shellrunner/pkg/runner"
+)
+
+// DefaultMaintenanceInterval is how often MaintainEvery is usually run.
+const DefaultMaintenanceInterval = time.Hour
+
+// StoreInfo is the size of what the server remembers besides its jobs, all
+// of it in memory, and when it was last maintained.
+type StoreInfo struct {
+	HistoryJobs     int        `json:"history_jobs"` // released jobs remembered for Rerun
+	TrendSeries     int        `json:"trend_series"`
+	TrendRuns       int        `json:"trend_runs"`
+	CachedResults   int        `json:"cached_results"` // results of Runs with a CacheTTL
+	CachedBytes     int        `json:"cached_bytes"`
+	LastMaintenance *time.Time `json:"last_maintenance,omitempty"`
+}
+
+// MaintainResult is the result of the Maintain method: what it forgot, and
+// what the server remembers now.
+type MaintainResult struct {
+	PrunedHistory   int       `json:"pruned_history"`
+	PrunedSeries    int       `json:"pruned_series"`
+	PrunedResults   int       `json:"pruned_results"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Store           StoreInfo `json:"store"`
+}
+
+// store returns the size of what the server remembers besides its jobs.
+func (s *Server) store() StoreInfo {
+	stats := s.manager.StoreStats()
+	info := StoreInfo{HistoryJobs: stats.HistoryJobs, TrendSeries: stats.TrendSeries, TrendRuns: stats.TrendRuns}
+	s.mu.Lock()
+	info.CachedResults, info.CachedBytes = len(s.results.entries), s.results.bytes
+	if !s.lastMaintenance.IsZero() {
+		last := s.lastMaintenance
+		info.LastMaintenance = &last
+	}
+	s.mu.Unlock()
+	return info
+}
+
+// maintain forgets the released jobs and series of trends older than the
+// manager's HistoryRetention and the cached results that expired, and
+// compacts the rest.
+func (s *Server) maintain() MaintainResult {
+	start := time.Now()
+	done := s.manager.Maintain()
+	result := MaintainResult{PrunedHistory: done.PrunedHistory, PrunedSeries: done.PrunedSeries}
+	s.mu.Lock()
+	c := &s.results
+	entries := make([]*cachedResult, 0, len(c.entries))
+	c.bytes = 0
+	for _, entry := range c.entries {
+		if start.Before(entry.expires) {
+			entries = append(entries, entry)
+			c.bytes += len(entry.result.Stdout) + len(entry.result.Stderr)
+		}
+	}
+	result.PrunedResults = len(c.entries) - len(entries)
+	c.entries = entries
+	s.lastMaintenance = start
+	s.mu.Unlock()
+	result.DurationSeconds = time.Since(start).Seconds()
+	result.Store = s.store()
+	return result
+}
+
+// MaintainEvery maintains the server every interval until it shuts down.
+func (s *Server) MaintainEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.maintain()
+		}
+	}
+}
+
+// Maintain maintains the server at once, as it is every maintenance
+// interval. Only admins may call it.
+func (s *ShellRunner) Maintain(args struct{}, reply *MaintainResult) error {
+	runner.Logger.Println("Maintain called")
+	*reply = s.server.maintain()
+	return nil
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets the
+// latencies of calls are counted in for Prometheus.
+var latencyBuckets = []float64{0.001, 0.01, 0.1, 1, 10, 60}
+
+// MethodStats are the statistics of the calls to one method.
+type MethodStats struct {
+	Calls                 int64   `json:"calls"`
+	Errors                int64   `json:"errors"`
+	AverageLatencySeconds float64 `json:"average_latency_seconds"`
+	MaxLatencySeconds     float64 `json:"max_latency_seconds"`
+}
+
+// methodMetrics counts the calls to each method, the calls that failed, and
+// their latencies.
+type methodMetrics struct {
+	mu      sync.Mutex
+	methods map[string]*methodMetric
+}
+
+type methodMetric struct {
+	calls, errors int64
+	total, max    time.Duration
+	buckets       []int64 // calls per latency bucket, the last for the rest
+}
+
+// record counts a call to method that took elapsed and failed if failed.
+func (mm *methodMetrics) record(method string, elapsed time.Duration, failed bool) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.methods == nil {
+		mm.methods = make(map[string]*methodMetric)
+	}
+	m := mm.methods[method]
+	if m == nil {
+		m = &methodMetric{buckets: make([]int64, len(latencyBuckets)+1)}
+		mm.methods[method] = m
+	}
+	m.calls++
+	if failed {
+		m.errors++
+	}
+	m.total += elapsed
+	m.max = max(m.max, elapsed)
+	i := sort.SearchFloat64s(latencyBuckets, elapsed.Seconds())
+	m.buckets[i]++
+}
+
+// stats returns the statistics of each method called so far.
+func (mm *methodMetrics) stats() map[string]MethodStats {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	stats := make(map[string]MethodStats, len(mm.methods))
+	for method, m := range mm.methods {
+		stats[method] = MethodStats{
+			Calls:                 m.calls,
+			Errors:                m.errors,
+			AverageLatencySeconds: m.total.Seconds() / float64(m.calls),
+			MaxLatencySeconds:     m.max.Seconds(),
+		}
+	}
+	return stats
+}
+
+// writePrometheus writes the metrics of each method in the Prometheus text
+// format, with labels, such as `instance="ci",`, before their own.
+func (mm *methodMetrics) writePrometheus(w io.Writer, labels string) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	methods := make([]string, 0, len(mm.methods))
+	for method := range mm.methods {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	fmt.Fprintln(w, "# HELP shellrunner_rpc_calls_total RPC calls by method.")
+	fmt.Fprintln(w, "# TYPE shellrunner_rpc_calls_total counter")
+	for _, method := range methods {
+		fmt.Fprintf(w, "shellrunner_rpc_calls_total{%smethod=%q} %d\n", labels, method, mm.methods[method].calls)
+	}
+	fmt.Fprintln(w, "# HELP shellrunner_rpc_errors_total RPC calls that returned an error, by method.")
+	fmt.Fprintln(w, "# TYPE shellrunner_rpc_errors_total counter")
+	for _, method := range methods {
+		fmt.Fprintf(w, "shellrunner_rpc_errors_total{%smethod=%q} %d\n", labels, method, mm.methods[method].errors)
+	}
+	fmt.Fprintln(w, "# HELP shellrunner_rpc_duration_seconds Latency of RPC calls by method.")
+	fmt.Fprintln(w, "# TYPE shellrunner_rpc_duration_seconds histogram")
+	for _, method := range methods {
+		m := mm.methods[method]
+		var cumulative int64
+		for i, bound := range latencyBuckets {
+			cumulative += m.buckets[i]
+			fmt.Fprintf(w, "shellrunner_rpc_duration_seconds_bucket{%smethod=%q,le=\"%g\"} %d\n", labels, method, bound, cumulative)
+		}
+		fmt.Fprintf(w, "shellrunner_rpc_duration_seconds_bucket{%smethod=%q,le=\"+Inf\"} %d\n", labels, method, m.calls)
+		fmt.Fprintf(w, "shellrunner_rpc_duration_seconds_sum{%smethod=%q} %g\n", labels, method, m.total.Seconds())
+		fmt.Fprintf(w, "shellrunner_rpc_duration_seconds_count{%smethod=%q} %d\n", labels, method, m.calls)
+	}
+}
+
+// MetricsHandler returns an HTTP handler serving the server's statistics,
+// and those of each RPC method, in the Prometheus text format. The metrics
+// of a named instance are labelled with its name.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		stats := s.stats()
+		var labels, instance string
+		if s.Instance != "" {
+			labels = fmt.Sprintf("instance=%q,", s.Instance)
+			instance = fmt.Sprintf("{instance=%q}", s.Instance)
+		}
+		type metric struct {
+			name, kind, help string
+			value            float64
+		}
+		metrics := []metric{
+			{"shellrunner_jobs_total", "counter", "Jobs that have finished.", float64(stats.TotalCount)},
+			{"shellrunner_jobs_succeeded_total", "counter", "Jobs whose result was success.", float64(stats.SuccessCount)},
+			{"shellrunner_jobs_failed_total", "counter", "Jobs whose result was failure.", float64(stats.FailureCount)},
+			{"shellrunner_job_stdout_bytes_total", "counter", "Bytes jobs wrote to stdout.", float64(stats.TotalStdoutBytes)},
+			{"shellrunner_job_stderr_bytes_total", "counter", "Bytes jobs wrote to stderr.", float64(stats.TotalStderrBytes)},
+			{"shellrunner_buffered_bytes", "gauge", "Job output held in memory.", float64(stats.BufferedBytes)},
+			{"shellrunner_busy_workers", "gauge", "Workers running jobs.", float64(stats.BusyWorkers)},
+			{"shellrunner_slow_calls_total", "counter", "RPC calls that took longer than their slow-call threshold.", float64(stats.SlowCalls)},
+			{"shellrunner_timed_out_calls_total", "counter", "RPC calls that failed at their deadline.", float64(stats.TimedOutCalls)},
+			{"shellrunner_rate_limited_calls_total", "counter", "Job submissions refused by a rate limit.", float64(stats.RateLimitedCalls)},
+			{"shellrunner_quota_exceeded_calls_total", "counter", "Job submissions refused for exceeding a quota.", float64(stats.QuotaExceededCalls)},
+			{"shellrunner_permission_denied_calls_total", "counter", "RPC calls refused by the ACL or for not being an admin.", float64(stats.PermissionDeniedCalls)},
+			{"shellrunner_cached_runs_total", "counter", "Run calls answered from the cache.", float64(stats.CachedRuns)},
+			{"shellrunner_rejected_connections_total", "counter", "Connections closed for exceeding the connection cap.", float64(stats.RejectedConnections)},
+			{"shellrunner_auth_failures_total", "counter", "Clients refused by a listener's authentication.", float64(stats.AuthFailures)},
+		}
+		if host := stats.Host; host != nil {
+			metrics = append(metrics,
+				metric{"shellrunner_host_load1", "gauge", "Load average of the host over the last minute.", host.Load1},
+				metric{"shellrunner_host_load5", "gauge", "Load average of the host over the last 5 minutes.", host.Load5},
+				metric{"shellrunner_host_load15", "gauge", "Load average of the host over the last 15 minutes.", host.Load15},
+				metric{"shellrunner_host_cpus", "gauge", "CPUs of the host.", float64(host.CPUs)},
+				metric{"shellrunner_host_memory_total_bytes", "gauge", "Memory of the host.", float64(host.MemoryTotalBytes)},
+				metric{"shellrunner_host_memory_available_bytes", "gauge", "Memory of the host available to new processes.", float64(host.MemoryAvailableBytes)},
+				metric{"shellrunner_host_spool_total_bytes", "gauge", "Size of the file system job workspaces and artifacts are kept on.", float64(host.SpoolTotalBytes)},
+				metric{"shellrunner_host_spool_free_bytes", "gauge", "Space left for jobs on the file system their workspaces and artifacts are kept on.", float64(host.SpoolFreeBytes)},
+			)
+		}
+		for _, metric := range metrics {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s%s %g\n", metric.name, metric.help, metric.name, metric.kind, metric.name, instance, metric.value)
+		}
+		s.methods.writePrometheus(w, labels)
+	})
+}
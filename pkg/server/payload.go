@@ -0,0 +1,150 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"shellrunner/pkg/runner"
+)
+
+// PayloadLimits caps the size of what clients submit, so that a buggy or
+// malicious client cannot have the server buffer, log and run a command of
+// hundreds of megabytes. Zero fields are unlimited.
+type PayloadLimits struct {
+	MaxRequestBytes int64 // a whole JSON-RPC request, as sent
+	MaxCommandBytes int   // a command string, or an argv all told
+	MaxEnvVars      int   // the entries of a job's Env and Secrets
+	MaxEnvBytes     int   // the names and values of a job's Env, all told
+	MaxStdinBytes   int   // a job's Stdin, and the data of each WriteStdin
+}
+
+// DefaultPayloadLimits are the limits of a new Server.
+var DefaultPayloadLimits = PayloadLimits{
+	MaxRequestBytes: 64 << 20,
+	MaxCommandBytes: 1 << 20,
+	MaxEnvVars:      1024,
+	MaxEnvBytes:     1 << 20,
+	MaxStdinBytes:   32 << 20,
+}
+
+// ParsePayloadLimits parses a comma-separated list of name=bytes pairs, such
+// as "command=65536,stdin=1048576", into the limits it changes from
+// DefaultPayloadLimits. The names are request, command, env-vars, which is
+// a count, env and stdin, and 0 lifts a limit.
+func ParsePayloadLimits(list string) (PayloadLimits, error) {
+	limits := DefaultPayloadLimits
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return PayloadLimits{}, fmt.Errorf("invalid payload limit %q: must be name=value", pair)
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 || int64(int(n)) != n {
+			return PayloadLimits{}, fmt.Errorf("invalid payload limit for %s: %q", name, value)
+		}
+		switch name {
+		case "request":
+			limits.MaxRequestBytes = n
+		case "command":
+			limits.MaxCommandBytes = int(n)
+		case "env-vars":
+			limits.MaxEnvVars = int(n)
+		case "env":
+			limits.MaxEnvBytes = int(n)
+		case "stdin":
+			limits.MaxStdinBytes = int(n)
+		default:
+			return PayloadLimits{}, fmt.Errorf("unknown payload limit %q: want request, command, env-vars, env or stdin", name)
+		}
+	}
+	return limits, nil
+}
+
+// tooLarge returns the INVALID_ARGUMENT error of a payload whose size, in
+// units, exceeds the limit max.
+func tooLarge(method, what, units, limit string, size, max int) error {
+	message := fmt.Sprintf("%s: %d %s, over the server's limit of %d", what, size, units, max)
+	runner.Logger.Printf("%s rejected: %s", method, message)
+	return &Error{
+		Code:    CodeInvalidArgument,
+		Message: message,
+		Details: map[string]interface{}{"limit": limit, "max": max, "size": size},
+	}
+}
+
+// checkCommand checks the size of a command string or argv against the
+// server's limit.
+func (s *Server) checkCommand(method, command string, argv []string) error {
+	max := s.PayloadLimits.MaxCommandBytes
+	size := len(command)
+	for _, arg := range argv {
+		size += len(arg)
+	}
+	if max > 0 && size > max {
+		return tooLarge(method, "command", "bytes", "max_command_bytes", size, max)
+	}
+	return nil
+}
+
+// checkPayload checks the size of the parts of a job's options clients are
+// most likely to make too large against the server's limits, before the
+// options are logged or a job is started from them.
+func (s *Server) checkPayload(method string, opts *JobOptions) error {
+	if err := s.checkCommand(method, opts.Command, opts.Argv); err != nil {
+		return err
+	}
+	limits := s.PayloadLimits
+	if vars := len(opts.Env) + len(opts.Secrets); limits.MaxEnvVars > 0 && vars > limits.MaxEnvVars {
+		return tooLarge(method, "environment", "variables", "max_env_vars", vars, limits.MaxEnvVars)
+	}
+	size := 0
+	for name, value := range opts.Env {
+		size += len(name) + len(value)
+	}
+	if limits.MaxEnvBytes > 0 && size > limits.MaxEnvBytes {
+		return tooLarge(method, "environment", "bytes", "max_env_bytes", size, limits.MaxEnvBytes)
+	}
+	if limits.MaxStdinBytes > 0 && len(opts.Stdin) > limits.MaxStdinBytes {
+		return tooLarge(method, "stdin", "bytes", "max_stdin_bytes", len(opts.Stdin), limits.MaxStdinBytes)
+	}
+	return nil
+}
+
+// requestLimit fails reads from a connection once a request has taken more
+// than max bytes, which makes the codec give up on the connection rather
+// than buffer the rest of the request. reset starts counting the next
+// request. As the codec reads ahead, the start of the next request may be
+// counted with the last, so the limit is only as exact as its buffer.
+type requestLimit struct {
+	r        io.Reader
+	max      int64
+	read     int64
+	exceeded bool
+}
+
+func (l *requestLimit) Read(p []byte) (int, error) {
+	if l.max > 0 && l.read >= l.max {
+		if !l.exceeded {
+			l.exceeded = true
+			runner.Logger.Printf("Closing a connection whose request is larger than %d bytes", l.max)
+		}
+		return 0, fmt.Errorf("request larger than %d bytes", l.max)
+	}
+	if l.max > 0 && int64(len(p)) > l.max-l.read {
+		p = p[:l.max-l.read]
+	}
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	return n, err
+}
+
+// reset starts counting a new request.
+func (l *requestLimit) reset() {
+	l.read = 0
+}
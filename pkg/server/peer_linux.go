@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// peerUser returns the user ID of the process at the other end of a Unix
+// socket connection, or "" if it cannot be determined.
+func peerUser(conn net.Conn) string {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ""
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return ""
+	}
+	var cred *syscall.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		return ""
+	}
+	return strconv.FormatUint(uint64(cred.Uid), 10)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package server
+
+import "net"
+
+// peerUser returns "": peer credentials are only read on Linux.
+func peerUser(conn net.Conn) string {
+	return ""
+}
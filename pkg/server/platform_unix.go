@@ -0,0 +1,108 @@
+//go:build !windows
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// UpgradeSignals are the signals that ask the server to Upgrade.
+var UpgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// Listen opens the Unix socket the server accepts connections on. A path
+// starting with "@" names a socket in Linux's abstract namespace, which
+// leaves no file behind. A socket file left by a server that is no longer
+// running is replaced.
+func Listen(path string) (net.Listener, error) {
+	if strings.HasPrefix(path, "@") && runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("abstract socket %s: only supported on Linux", path)
+	}
+	listener, err := net.Listen("unix", path)
+	if errors.Is(err, syscall.EADDRINUSE) && !strings.HasPrefix(path, "@") {
+		if conn, dialErr := net.Dial("unix", path); dialErr == nil {
+			conn.Close()
+		} else if errors.Is(dialErr, syscall.ECONNREFUSED) && os.Remove(path) == nil {
+			listener, err = net.Listen("unix", path)
+		}
+	}
+	return listener, err
+}
+
+// DefaultSocketPath returns a socket path inside a fresh directory of the
+// user's runtime directory: $XDG_RUNTIME_DIR, or else /run/user/<uid>, or
+// /run for root, falling back to the temporary directory.
+func DefaultSocketPath() (string, error) {
+	tempDir, err := os.MkdirTemp(runtimeDir(), "shellrunner-")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(tempDir, "shellrunner.sock"), nil
+}
+
+// InstanceSocketPath returns the socket instance name listens on by default:
+// shellrunner/<name>.sock in the user's runtime directory, as for
+// DefaultSocketPath, or shellrunner-<uid>/<name>.sock in the temporary one.
+func InstanceSocketPath(name string) string {
+	dir := runtimeDir()
+	if dir == os.TempDir() {
+		return filepath.Join(dir, fmt.Sprintf("shellrunner-%d", os.Getuid()), name+".sock")
+	}
+	return filepath.Join(dir, "shellrunner", name+".sock")
+}
+
+// MakeSocketDir creates the directory of the socket at path, such as one
+// InstanceSocketPath returns, readable only by the user, if it is missing.
+// As the directory may be in the shared temporary directory, one that is
+// already there is refused unless it is a directory, not a symlink, that
+// the user owns and no one else can access.
+func MakeSocketDir(path string) error {
+	if strings.HasPrefix(path, "@") {
+		return nil
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	switch {
+	case !info.IsDir():
+		return fmt.Errorf("socket directory %s: not a directory", dir)
+	case !ok || int(stat.Uid) != os.Getuid():
+		return fmt.Errorf("socket directory %s: not owned by user %d", dir, os.Getuid())
+	case info.Mode().Perm() != 0o700:
+		return fmt.Errorf("socket directory %s: mode %v, not 0700", dir, info.Mode().Perm())
+	}
+	return nil
+}
+
+// RemoveDefaultSocket removes the directory DefaultSocketPath made for path,
+// once its socket has been closed.
+func RemoveDefaultSocket(path string) error {
+	return os.Remove(filepath.Dir(path))
+}
+
+// runtimeDir returns the directory DefaultSocketPath creates sockets in.
+func runtimeDir() string {
+	candidates := []string{os.Getenv("XDG_RUNTIME_DIR"), fmt.Sprintf("/run/user/%d", os.Getuid())}
+	if os.Getuid() == 0 {
+		candidates = append(candidates, "/run")
+	}
+	for _, dir := range candidates {
+		// 0o3 checks that the directory is writable and searchable.
+		if dir != "" && syscall.Access(dir, 0o3) == nil {
+			return dir
+		}
+	}
+	return os.TempDir()
+}
@@ -0,0 +1,40 @@
+//go:build windows
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// UpgradeSignals is empty: named pipes cannot be handed over.
+var UpgradeSignals []os.Signal
+
+// Listen opens the named pipe the server accepts connections on.
+func Listen(path string) (net.Listener, error) {
+	return winio.ListenPipe(path, nil)
+}
+
+// DefaultSocketPath returns a named pipe path unique to this process.
+func DefaultSocketPath() (string, error) {
+	return fmt.Sprintf(`\\.\pipe\shellrunner-%d`, os.Getpid()), nil
+}
+
+// InstanceSocketPath returns the named pipe instance name listens on by
+// default.
+func InstanceSocketPath(name string) string {
+	return fmt.Sprintf(`\\.\pipe\shellrunner-%s`, name)
+}
+
+// MakeSocketDir does nothing: named pipes have no directories.
+func MakeSocketDir(path string) error {
+	return nil
+}
+
+// RemoveDefaultSocket does nothing: named pipes leave nothing behind.
+func RemoveDefaultSocket(path string) error {
+	return nil
+}
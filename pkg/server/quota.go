@@ -0,0 +1,239 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"shellrunner/pkg/runner"
+)
+
+// quotaWindow is the period MaxJobsPerHour counts submissions over.
+const quotaWindow = time.Hour
+
+// Quota limits what the jobs of one client may take up. Zero fields are
+// unlimited.
+type Quota struct {
+	MaxRunning       int   `json:"max_running,omitempty"`        // jobs not yet finished
+	MaxJobsPerHour   int   `json:"max_jobs_per_hour,omitempty"`  // jobs submitted over the last hour
+	MaxBufferedBytes int64 `json:"max_buffered_bytes,omitempty"` // output held in memory
+}
+
+// Quotas maps authenticated identities to their quotas. Clients are told
+// apart by the name of the token they presented, as "token:<name>", or else
+// by the name of their client certificate, as "cert:<name>", or else by the
+// user ID of their peer, as "uid:<user>"; clients with none of them are
+// "unknown". What a client calls itself with Identify is its own claim, so
+// it does not count. The "*" entry applies to every identity without its
+// own, each on its own, and identities without either are unlimited.
+type Quotas map[string]Quota
+
+// LoadQuotas reads Quotas from a JSON file holding an object that maps each
+// identity to a Quota.
+func LoadQuotas(path string) (Quotas, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var quotas Quotas
+	if err := json.Unmarshal(data, &quotas); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	for key, quota := range quotas {
+		if err := checkQuota(key, quota); err != nil {
+			return nil, err
+		}
+	}
+	return quotas, nil
+}
+
+// checkQuota checks the quota of the identity key.
+func checkQuota(key string, quota Quota) error {
+	if key != "*" && key != "unknown" && !strings.HasPrefix(key, "token:") && !strings.HasPrefix(key, "cert:") && !strings.HasPrefix(key, "uid:") {
+		return fmt.Errorf("quota for %q: identity must be token:<name>, cert:<name>, uid:<user>, unknown or *", key)
+	}
+	if quota.MaxRunning < 0 || quota.MaxJobsPerHour < 0 || quota.MaxBufferedBytes < 0 {
+		return fmt.Errorf("quota for %q: limits must not be negative", key)
+	}
+	return nil
+}
+
+// quotaKey returns the identity id is held to quotas as.
+func quotaKey(id runner.Identity) string {
+	switch {
+	case id.Token != "":
+		return "token:" + id.Token
+	case id.Cert != "":
+		return "cert:" + id.Cert
+	case id.User != "":
+		return "uid:" + id.User
+	}
+	return "unknown"
+}
+
+// lookup returns the quota of the identity key and whether it has one.
+func (q Quotas) lookup(key string) (Quota, bool) {
+	if quota, ok := q[key]; ok {
+		return quota, true
+	}
+	quota, ok := q["*"]
+	return quota, ok
+}
+
+// QuotaUsage is the result of the Quota method.
+type QuotaUsage struct {
+	Identity      string `json:"identity"`        // what the caller is held to quotas as
+	Quota         *Quota `json:"quota,omitempty"` // nil if the caller is unlimited
+	Running       int    `json:"running"`
+	JobsLastHour  int    `json:"jobs_last_hour"`
+	BufferedBytes int64  `json:"buffered_bytes"`
+	QuotaExceeded int64  `json:"quota_exceeded"` // submissions refused for exceeding the quota
+}
+
+// quotaState tracks what each identity takes up beyond the jobs the
+// Manager holds. Its lock also guards Server.Quotas once the server runs,
+// which setQuota replaces rather than changes, so that a map the caller set
+// it to is left alone.
+type quotaState struct {
+	mu sync.Mutex
+	// reserved counts the jobs being submitted, which the Manager does not
+	// hold yet, and those being run by Run, which it does not count.
+	reserved map[string]int
+	// submissions holds the times of the jobs submitted over the last
+	// quotaWindow.
+	submissions map[string][]time.Time
+	exceeded    map[string]int64
+}
+
+// recent returns the submissions of key over the last quotaWindow, dropping
+// older ones. The caller must hold qs.mu.
+func (qs *quotaState) recent(key string, now time.Time) []time.Time {
+	times := qs.submissions[key]
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= quotaWindow {
+		i++
+	}
+	times = times[i:]
+	if len(times) == 0 {
+		delete(qs.submissions, key)
+	} else {
+		qs.submissions[key] = times
+	}
+	return times
+}
+
+// usage returns what the jobs of the identity key take up.
+func (s *Server) usage(key string) QuotaUsage {
+	s.quotas.mu.Lock()
+	defer s.quotas.mu.Unlock()
+	jobs := s.manager.Usage(func(spec *runner.JobSpec) bool {
+		return quotaKey(spec.Submitter) == key
+	})
+	usage := QuotaUsage{
+		Identity:      key,
+		Running:       jobs.Running + s.quotas.reserved[key],
+		JobsLastHour:  len(s.quotas.recent(key, time.Now())),
+		BufferedBytes: jobs.Buffered,
+		QuotaExceeded: s.quotas.exceeded[key],
+	}
+	if quota, ok := s.Quotas.lookup(key); ok {
+		usage.Quota = &quota
+	}
+	return usage
+}
+
+// reserve checks the submission of n jobs by the client the receiver serves
+// against its quota, returning a QUOTA_EXCEEDED error if they would exceed
+// it. Otherwise the jobs count as running until release is called, by when
+// the Manager should hold those that are still running.
+func (s *ShellRunner) reserve(method string, n int) (release func(), err error) {
+	key := quotaKey(s.identity())
+	// The jobs are counted with qs.mu held, so that those released since
+	// are already held by the Manager.
+	qs := &s.server.quotas
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	quota, limited := s.server.Quotas.lookup(key)
+	if !limited {
+		return func() {}, nil
+	}
+	jobs := s.manager.Usage(func(spec *runner.JobSpec) bool {
+		return quotaKey(spec.Submitter) == key
+	})
+	now := time.Now()
+	recent := qs.recent(key, now)
+	for _, limit := range []struct {
+		name  string
+		usage int64
+		max   int64
+		add   int64
+	}{
+		{"max_running", int64(jobs.Running + qs.reserved[key]), int64(quota.MaxRunning), int64(n)},
+		{"max_jobs_per_hour", int64(len(recent)), int64(quota.MaxJobsPerHour), int64(n)},
+		{"max_buffered_bytes", jobs.Buffered, quota.MaxBufferedBytes, 1},
+	} {
+		if limit.max > 0 && limit.usage+limit.add > limit.max {
+			if qs.exceeded == nil {
+				qs.exceeded = make(map[string]int64)
+			}
+			qs.exceeded[key]++
+			s.server.quotaExceeded.Add(1)
+			return nil, &Error{
+				Code:    CodeQuotaExceeded,
+				Message: fmt.Sprintf("%s rejected: %s would exceed its %s quota of %d", method, key, limit.name, limit.max),
+				Details: map[string]interface{}{"identity": key, "quota": limit.name, "limit": limit.max, "usage": limit.usage},
+			}
+		}
+	}
+
+	if qs.reserved == nil {
+		qs.reserved = make(map[string]int)
+	}
+	if qs.submissions == nil {
+		qs.submissions = make(map[string][]time.Time)
+	}
+	qs.reserved[key] += n
+	for range n {
+		qs.submissions[key] = append(qs.submissions[key], now)
+	}
+	return func() {
+		qs.mu.Lock()
+		defer qs.mu.Unlock()
+		if qs.reserved[key] -= n; qs.reserved[key] == 0 {
+			delete(qs.reserved, key)
+		}
+	}, nil
+}
+
+// setQuota sets the quota of the identity key, or removes it if quota is
+// nil, and returns the quotas now in force.
+func (s *Server) setQuota(key string, quota *Quota) (Quotas, error) {
+	if quota != nil {
+		if err := checkQuota(key, *quota); err != nil {
+			return nil, err
+		}
+	}
+	s.quotas.mu.Lock()
+	defer s.quotas.mu.Unlock()
+	quotas := make(Quotas, len(s.Quotas)+1)
+	for k, q := range s.Quotas {
+		quotas[k] = q
+	}
+	if quota != nil {
+		quotas[key] = *quota
+	} else {
+		delete(quotas, key)
+	}
+	s.Quotas = quotas
+	return quotas, nil
+}
+
+// Quota returns the caller's quota and what its jobs take up of it.
+func (s *ShellRunner) Quota(args struct{}, reply *QuotaUsage) error {
+	runner.Logger.Printf("Quota called")
+	*reply = s.server.usage(quotaKey(s.identity()))
+	return nil
+}
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"shellrunner/pkg/runner"
+)
+
+// QuoteArgs defines the arguments for the Quote method.
+type QuoteArgs struct {
+	Argv []string
+}
+
+// Quote joins argv into a command string that the server's shell runs as
+// argv, quoting the arguments it would otherwise split or interpret, so that
+// callers need not build command strings by concatenation.
+func (s *ShellRunner) Quote(args QuoteArgs, reply *string) error {
+	runner.Logger.Printf("Quote called with argv: %q", args.Argv)
+	command, err := runner.QuoteCommand(args.Argv)
+	if err != nil {
+		return rpcError(err)
+	}
+	*reply = command
+	return nil
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"shellrunner/pkg/runner"
+)
+
+// Rate is a token-bucket rate limit: Burst calls may be made at once, and
+// the allowance refills at PerSecond calls per second. The zero Rate is
+// unlimited.
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+// RateLimits limits how fast jobs may be submitted with Run, Background and
+// Exec, across the whole server, on each connection, and by each user.
+// Users are told apart as quotas tell them apart: by the token or client
+// certificate they authenticated with, or else by the credentials of their
+// connection's peer, which are only available on Linux.
+type RateLimits struct {
+	Global     Rate
+	Connection Rate
+	User       Rate
+}
+
+// ParseRateLimits parses a comma-separated list of scope=rate pairs, such as
+// "global=100,connection=5:10", into RateLimits. A rate is in calls per
+// second, optionally followed by a colon and the burst, which defaults to
+// the rate rounded up.
+func ParseRateLimits(list string) (RateLimits, error) {
+	var limits RateLimits
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		scope, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return RateLimits{}, fmt.Errorf("invalid rate limit %q: must be scope=rate", pair)
+		}
+		perSecond, burst, hasBurst := strings.Cut(value, ":")
+		var rate Rate
+		var err error
+		if rate.PerSecond, err = strconv.ParseFloat(perSecond, 64); err != nil || rate.PerSecond <= 0 {
+			return RateLimits{}, fmt.Errorf("invalid rate for %s: %q", scope, perSecond)
+		}
+		rate.Burst = int(math.Ceil(rate.PerSecond))
+		if hasBurst {
+			if rate.Burst, err = strconv.Atoi(burst); err != nil || rate.Burst <= 0 {
+				return RateLimits{}, fmt.Errorf("invalid burst for %s: %q", scope, burst)
+			}
+		}
+		switch scope {
+		case "global":
+			limits.Global = rate
+		case "connection":
+			limits.Connection = rate
+		case "user":
+			limits.User = rate
+		default:
+			return RateLimits{}, fmt.Errorf("unknown rate limit scope %q", scope)
+		}
+	}
+	return limits, nil
+}
+
+// tokenBucket enforces a Rate. A nil *tokenBucket allows everything.
+type tokenBucket struct {
+	rate Rate
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket for rate, or nil if rate is unlimited.
+func newTokenBucket(rate Rate) *tokenBucket {
+	if rate.PerSecond <= 0 {
+		return nil
+	}
+	if rate.Burst < 1 {
+		rate.Burst = 1
+	}
+	return &tokenBucket{rate: rate, tokens: float64(rate.Burst), last: time.Now()}
+}
+
+// take takes a token from the bucket. If it is empty, take returns false
+// along with how long until the next token.
+func (b *tokenBucket) take() (bool, time.Duration) {
+	if b == nil {
+		return true, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(float64(b.rate.Burst), b.tokens+now.Sub(b.last).Seconds()*b.rate.PerSecond)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / b.rate.PerSecond * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// giveBack returns a token taken from the bucket for a call that another
+// limit rejected.
+func (b *tokenBucket) giveBack() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(float64(b.rate.Burst), b.tokens+1)
+}
+
+// userBucket returns the bucket limiting the user with identity id,
+// creating it on first use.
+func (s *Server) userBucket(id runner.Identity) *tokenBucket {
+	user := quotaKey(id)
+	if user == "unknown" || s.RateLimits.User.PerSecond <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.userBuckets == nil {
+		s.userBuckets = make(map[string]*tokenBucket)
+	}
+	bucket, ok := s.userBuckets[user]
+	if !ok {
+		bucket = newTokenBucket(s.RateLimits.User)
+		s.userBuckets[user] = bucket
+	}
+	return bucket
+}
+
+// submitMethods are the methods that submit jobs, which the rate limits
+// apply to.
+var submitMethods = []string{"Run", "Background", "Rerun", "Exec"}
+
+// rateLimit is the interceptor that checks the calls that submit jobs
+// against the rate limits.
+func (s *Server) rateLimit(call *Call, next Handler) error {
+	if slices.Contains(submitMethods, call.Method) {
+		if err := call.receiver.admit(call.Method); err != nil {
+			return err
+		}
+	}
+	return next(call)
+}
+
+// admit checks a job submission against the rate limits, returning a
+// RATE_LIMITED error if any of them is exceeded. A rejected call uses up
+// none of the allowances, so the tokens taken from the limits checked
+// before the one that rejected it are given back.
+func (s *ShellRunner) admit(method string) error {
+	s.server.mu.Lock()
+	if s.server.globalBucket == nil {
+		s.server.globalBucket = newTokenBucket(s.server.RateLimits.Global)
+	}
+	global := s.server.globalBucket
+	s.server.mu.Unlock()
+
+	limits := []struct {
+		scope  string
+		bucket *tokenBucket
+	}{
+		{"connection", s.bucket},
+		{"user", s.server.userBucket(s.identity())},
+		{"global", global},
+	}
+	for i, limit := range limits {
+		if ok, retry := limit.bucket.take(); !ok {
+			for _, taken := range limits[:i] {
+				taken.bucket.giveBack()
+			}
+			s.server.rateLimited.Add(1)
+			return &Error{
+				Code:    CodeRateLimited,
+				Message: fmt.Sprintf("%s rejected: %s rate limit exceeded", method, limit.scope),
+				Details: map[string]interface{}{"scope": limit.scope, "retry_after_seconds": retry.Seconds()},
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"shellrunner/pkg/runner"
+)
+
+// DefaultSearchLimit is the number of matches Search returns at most, unless
+// SearchArgs.Limit says otherwise.
+const DefaultSearchLimit = 1000
+
+// SearchArgs defines the arguments for the Search method.
+type SearchArgs struct {
+	Pattern string   // regular expression, in the syntax of Go's regexp package
+	IDs     []string // jobs to search; all of them if empty
+	Stream  string   // "stdout" or "stderr" to search only one; both if empty
+	Context int      // lines to include before and after each match
+	Limit   int      // matches to return at most; DefaultSearchLimit if 0
+}
+
+// Search scans the output of the caller's jobs, or of every tenant's for an
+// admin, for lines matching a regular expression, and returns them, in order
+// of job ID, with the lines around them.
+func (s *ShellRunner) Search(args SearchArgs, reply *SearchResult) error {
+	runner.Logger.Printf("Search called with pattern: %q", args.Pattern)
+	re, err := regexp.Compile(args.Pattern)
+	if err != nil {
+		return &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf("invalid pattern: %v", err)}
+	}
+	streams := []string{"stdout", "stderr"}
+	switch args.Stream {
+	case "":
+	case "stdout", "stderr":
+		streams = []string{args.Stream}
+	default:
+		return &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf("invalid stream %q: must be stdout or stderr", args.Stream)}
+	}
+	if args.Context < 0 || args.Limit < 0 {
+		return &Error{Code: CodeInvalidArgument, Message: "context and limit must not be negative"}
+	}
+	limit := args.Limit
+	if limit == 0 {
+		limit = DefaultSearchLimit
+	}
+
+	ids := args.IDs
+	if len(ids) == 0 {
+		for _, job := range s.manager.List() {
+			ids = append(ids, job.ID)
+		}
+		// Job IDs are sequential numbers.
+		sort.Slice(ids, func(i, j int) bool {
+			return len(ids[i]) < len(ids[j]) || len(ids[i]) == len(ids[j]) && ids[i] < ids[j]
+		})
+	}
+
+	reply.Matches = []SearchMatch{}
+	caller := s.identity()
+	for _, id := range ids {
+		var outputs []string
+		err := s.manager.WithJob(id, func(job *runner.Job) error {
+			if !s.server.owns(caller, job.Spec.Submitter) {
+				return &Error{Code: CodeJobNotFound, Message: fmt.Sprintf("job with id %s not found", id)}
+			}
+			for _, stream := range streams {
+				if stream == "stdout" {
+					outputs = append(outputs, job.Stdout.String())
+				} else {
+					outputs = append(outputs, job.Stderr.String())
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			if len(args.IDs) == 0 {
+				continue // released since it was listed
+			}
+			return rpcError(err)
+		}
+		for i, output := range outputs {
+			for _, match := range searchLines(re, output, args.Context) {
+				if len(reply.Matches) == limit {
+					reply.Truncated = true
+					return nil
+				}
+				match.JobID = id
+				match.Stream = streams[i]
+				reply.Matches = append(reply.Matches, match)
+			}
+		}
+	}
+	return nil
+}
+
+// searchLines returns the lines of output that match re, with context lines
+// before and after each.
+func searchLines(re *regexp.Regexp, output string, context int) []SearchMatch {
+	if output == "" {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	var matches []SearchMatch
+	for i, line := range lines {
+		if !re.MatchString(line) {
+			continue
+		}
+		matches = append(matches, SearchMatch{
+			Line:   i + 1,
+			Text:   line,
+			Before: lines[max(0, i-context):i],
+			After:  lines[i+1 : min(len(lines), i+1+context)],
+		})
+	}
+	return matches
+}
@@ -0,0 +1,39 @@
+package server
+
+import "shellrunner/pkg/runner"
+
+// SecretArgs defines the arguments for the SetSecret method.
+type SecretArgs struct {
+	Name  string
+	Value string
+}
+
+// SetSecret stores a named secret, replacing any secret of the same name.
+// Jobs refer to secrets by name in JobOptions.Secrets, and only ever see
+// their values in their environment; the values are redacted from the jobs'
+// output.
+func (s *ShellRunner) SetSecret(args SecretArgs, reply *bool) error {
+	runner.Logger.Printf("SetSecret called for secret: %s", args.Name)
+	if err := s.manager.Secrets().Set(args.Name, args.Value); err != nil {
+		return rpcError(err)
+	}
+	*reply = true
+	return nil
+}
+
+// DeleteSecret removes a secret.
+func (s *ShellRunner) DeleteSecret(name string, reply *bool) error {
+	runner.Logger.Printf("DeleteSecret called for secret: %s", name)
+	if err := s.manager.Secrets().Delete(name); err != nil {
+		return rpcError(err)
+	}
+	*reply = true
+	return nil
+}
+
+// ListSecrets returns the names of the stored secrets, but not their values.
+func (s *ShellRunner) ListSecrets(args struct{}, reply *[]runner.SecretInfo) error {
+	runner.Logger.Printf("ListSecrets called")
+	*reply = s.manager.Secrets().List()
+	return nil
+}
@@ -0,0 +1,1434 @@
+// Package server exposes a runner.Manager as a JSON-RPC service, served over
+// a Unix socket or, on Windows, a named pipe, and optionally over TLS.
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/rpc/jsonrpc"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"shellrunner/pkg/runner"
+)
+
+// execPreamble starts the first line of a connection that attaches to an Exec
+// session, followed by the session's job ID. Such a connection carries raw
+// terminal input and output instead of JSON-RPC.
+const execPreamble = "EXEC "
+
+// attachPreamble starts the first line of a connection that attaches to a
+// running background job, followed by its ID. Like an Exec connection, it
+// carries raw input and output instead of JSON-RPC.
+const attachPreamble = "ATTACH "
+
+// attachWriteTimeout is how long writing a job's output to an attached
+// client may take before the client is detached for being too slow, so
+// that it does not hold up the job.
+const attachWriteTimeout = 5 * time.Second
+
+// Server serves the ShellRunner RPC methods, along with Exec sessions, on
+// connections to a listener.
+type Server struct {
+	manager *runner.Manager
+	// ctx is cancelled when the server shuts down.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// calls counts the calls in progress on all connections.
+	calls sync.WaitGroup
+
+	// Timeouts maps method names, such as "Run", to the longest a call may
+	// take. The "*" entry applies to methods without their own, and methods
+	// without either have no deadline. A synchronous run still going at its
+	// deadline is killed, and the call fails with TIMEOUT; the other methods
+	// don't wait on commands, so only SlowCalls applies to them in practice.
+	Timeouts map[string]time.Duration
+	// SlowCalls maps method names, with "*" as above, to the duration after
+	// which a call is logged and counted as slow.
+	SlowCalls map[string]time.Duration
+	slowCalls atomic.Int64
+	timeouts  atomic.Int64
+	methods   methodMetrics
+	pings     atomic.Uint64
+	// RateLimits limits how fast jobs may be submitted.
+	RateLimits  RateLimits
+	rateLimited atomic.Int64
+	// Quotas limits what the jobs of each client may take up.
+	Quotas        Quotas
+	quotas        quotaState
+	quotaExceeded atomic.Int64
+	// PayloadLimits caps the size of what clients submit. It defaults to
+	// DefaultPayloadLimits.
+	PayloadLimits PayloadLimits
+	// Admins are the clients allowed to call the Admin methods, besides
+	// root: "token:<name>" for those that presented the named token,
+	// "cert:<name>" for those that presented the named client certificate
+	// and "uid:<user>" for the peers of a Unix socket.
+	Admins []string
+	// ACL, if set, limits the methods each client may call. Otherwise
+	// every client may call every method.
+	ACL              *ACL
+	permissionDenied atomic.Int64
+	// AuditLog, if set, gets a line of JSON for each call, with who made
+	// it and whether it failed.
+	AuditLog io.Writer
+	auditMu  sync.Mutex
+	// Interceptors run around each call, in order, inside the server's
+	// own, which record, trace and audit calls and enforce the Admin
+	// methods, the ACL and the rate limits.
+	Interceptors []Interceptor
+	// MaxConnections caps the number of open connections. Connections
+	// beyond it are closed as soon as they are accepted. Zero means no cap.
+	MaxConnections int
+	// IdleTimeout closes connections that have had no call in progress for
+	// this long. Zero means they are never closed for being idle.
+	IdleTimeout   time.Duration
+	rejectedConns atomic.Int64
+	authFailures  atomic.Int64
+	// Tracer, if set, exports a span for each call and for each job with a
+	// span of its own; see runner.TraceJobs.
+	Tracer *Tracer
+	// Instance names the server among the others on its host. Info reports
+	// it, and its metrics are labelled with it.
+	Instance string
+	// handedOver is set once the server has handed over to an upgraded
+	// one. adding guards setting it against the calls adding jobs, which
+	// addingCalls counts while they are in progress.
+	handedOver  atomic.Bool
+	adding      sync.Mutex
+	addingCalls sync.WaitGroup
+	// predecessor is the server this one replaces, if Upgrade started it,
+	// which it forwards the calls for the jobs still running there to.
+	predecessor *predecessor
+	// results holds the results of Runs with a CacheTTL.
+	results         resultCache
+	lastMaintenance time.Time
+	// identities counts the jobs of each client.
+	identities identityMetrics
+
+	mu           sync.Mutex
+	listeners    map[net.Listener]struct{}
+	globalBucket *tokenBucket
+	userBuckets  map[string]*tokenBucket
+	conns        map[uint64]*connection
+	connCounter  uint64
+}
+
+// New returns a Server for the jobs of manager.
+func New(manager *runner.Manager) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		manager:       manager,
+		ctx:           ctx,
+		cancel:        cancel,
+		SlowCalls:     DefaultSlowCalls,
+		PayloadLimits: DefaultPayloadLimits,
+		listeners:     make(map[net.Listener]struct{}),
+	}
+	manager.BeforeStart(func(spec *runner.JobSpec) error {
+		s.identities.submitted(spec.Submitter)
+		return nil
+	})
+	manager.OnFinish(func(job *runner.Job) {
+		if s.Tracer != nil {
+			s.Tracer.jobSpan(job)
+		}
+		s.identities.finished(job)
+	})
+	return s
+}
+
+// Serve accepts connections on listener and serves each of them in a new
+// goroutine, until the listener is closed or the server shuts down.
+func (s *Server) Serve(listener net.Listener) error {
+	return s.serve(listener, nil)
+}
+
+// serve is Serve for a listener that cfg, if not nil, describes, whose
+// clients must authenticate as it requires.
+func (s *Server) serve(listener net.Listener, cfg *ListenerConfig) error {
+	if !s.track(listener) {
+		return net.ErrClosed
+	}
+	defer s.untrack(listener)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			runner.Logger.Printf("Error accepting connection: %v", err)
+			continue
+		}
+		runner.Logger.Printf("Accepted new connection from %s", conn.RemoteAddr().String())
+		// Handle each connection in a new goroutine.
+		go s.serveConn(conn, cfg)
+	}
+}
+
+// track records listener for Shutdown to close. It returns false if the
+// server has already shut down.
+func (s *Server) track(listener net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx.Err() != nil {
+		return false
+	}
+	s.listeners[listener] = struct{}{}
+	return true
+}
+
+// untrack forgets listener once it is no longer served.
+func (s *Server) untrack(listener net.Listener) {
+	s.mu.Lock()
+	delete(s.listeners, listener)
+	s.mu.Unlock()
+}
+
+// Shutdown stops the server. It closes the listeners it serves and
+// cancels the calls in progress, killing the commands of synchronous runs,
+// then waits for those calls to reply or for ctx to be done. Spans not yet
+// exported by the Tracer are exported last.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.cancel()
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.calls.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if s.Tracer != nil {
+		return s.Tracer.Flush(ctx)
+	}
+	return nil
+}
+
+// bufferedConn is a connection whose first bytes have already been read into
+// a buffer.
+type bufferedConn struct {
+	io.Reader
+	net.Conn
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) {
+	return c.Reader.Read(p)
+}
+
+// ServeConn serves a single client connection, which either speaks JSON-RPC
+// or attaches to an Exec session.
+func (s *Server) ServeConn(conn net.Conn) {
+	s.serveConn(conn, nil)
+}
+
+// serveConn is ServeConn for a connection accepted on the listener cfg, if
+// not nil, describes.
+func (s *Server) serveConn(conn net.Conn, cfg *ListenerConfig) {
+	c, ok := s.openConnection(conn)
+	if !ok {
+		s.rejectedConns.Add(1)
+		runner.Logger.Printf("Rejected connection: %d connections are already open", s.MaxConnections)
+		conn.Close()
+		return
+	}
+	defer s.closeConnection(c)
+
+	reader := bufio.NewReader(conn)
+	if cfg != nil {
+		if err := s.authenticate(c, reader, cfg); err != nil {
+			s.authFailures.Add(1)
+			runner.Logger.Printf("Rejected connection from %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+	}
+	s.idle(c)
+	for _, raw := range []struct {
+		preamble, kind, method string
+		attach                 func(id string, input *bufio.Reader, conn net.Conn)
+	}{
+		{execPreamble, "exec", "Exec", s.attachSession},
+		{attachPreamble, "attach", attachMethod, s.attachJob},
+	} {
+		if prefix, err := reader.Peek(len(raw.preamble)); err != nil || string(prefix) != raw.preamble {
+			continue
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return
+		}
+		id := strings.TrimSpace(strings.TrimPrefix(line, raw.preamble))
+		err = s.checkACL(s.connIdentity(c), raw.method)
+		if err == nil {
+			err = s.checkOwner(s.connIdentity(c), id)
+		}
+		if err != nil {
+			fmt.Fprintf(conn, "%v\r\n", err)
+			conn.Close()
+			return
+		}
+		// Sessions are interactive, and attached clients may watch a job
+		// for as long as it runs, so they are never idle.
+		conn.SetReadDeadline(time.Time{})
+		s.mu.Lock()
+		c.kind = raw.kind
+		s.mu.Unlock()
+		raw.attach(id, reader, conn)
+		return
+	}
+
+	// Each connection gets its own receiver, which carries a context that is
+	// cancelled when the client disconnects or the server shuts down.
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	receiver := s.receiver(ctx, c.user)
+	receiver.conn = c
+	limit := &requestLimit{r: reader, max: s.PayloadLimits.MaxRequestBytes}
+	receiver.serveCodec(&connCodec{
+		ServerCodec: jsonrpc.NewServerCodec(bufferedConn{limit, conn}),
+		limit:       limit,
+		server:      s,
+		conn:        c,
+		cancel:      cancel,
+	})
+}
+
+// receiver returns the receiver of the RPC methods for a connection whose
+// context is connCtx, made by user, or by an unknown user if it is empty.
+func (s *Server) receiver(connCtx context.Context, user string) *ShellRunner {
+	return &ShellRunner{
+		manager: s.manager,
+		server:  s,
+		connCtx: connCtx,
+		user:    user,
+		bucket:  newTokenBucket(s.RateLimits.Connection),
+	}
+}
+
+// attachSession connects conn to the terminal of session id, forwarding
+// input from the client until it disconnects or the job exits.
+func (s *Server) attachSession(id string, input *bufio.Reader, conn net.Conn) {
+	defer conn.Close()
+	if err := s.manager.Attach(id, input, conn); err != nil {
+		fmt.Fprintf(conn, "%v\r\n", err)
+	}
+}
+
+// attachJob attaches conn to the running background job id, until the
+// client detaches by disconnecting or the job exits.
+func (s *Server) attachJob(id string, input *bufio.Reader, conn net.Conn) {
+	defer conn.Close()
+	if err := s.manager.AttachJob(id, input, slowConn{conn}); err != nil {
+		fmt.Fprintf(conn, "%v\r\n", err)
+	}
+}
+
+// slowConn is a connection whose writes fail once they take longer than
+// attachWriteTimeout.
+type slowConn struct {
+	net.Conn
+}
+
+func (c slowConn) Write(p []byte) (int, error) {
+	c.SetWriteDeadline(time.Now().Add(attachWriteTimeout))
+	return c.Conn.Write(p)
+}
+
+// ShellRunner is the receiver for the RPC methods. Each connection has its
+// own.
+type ShellRunner struct {
+	manager *runner.Manager
+	server  *Server
+	// connCtx is cancelled when the client disconnects or the server shuts
+	// down.
+	connCtx context.Context
+	user    string
+	// conn is the connection, which is nil for receivers not serving one.
+	conn *connection
+	// bucket limits the rate of job submissions on the connection.
+	bucket *tokenBucket
+	// forwarded is set for the receiver serving the calls the server that
+	// replaces this one forwards.
+	forwarded bool
+}
+
+// JobOptions describe a job to run, for both the Run and Background methods.
+type JobOptions struct {
+	Command string
+	Argv    []string
+	Env     map[string]string // variables added to the server's environment
+	// EnvFile is a dotenv file on the server, in one of the directories it
+	// allows env files in, of variables added to the environment before
+	// Env, which takes precedence.
+	EnvFile string
+	// Secrets sets environment variables to the values of the named
+	// secrets, which are redacted from the job's output.
+	Secrets map[string]string
+	Dir     string            // working directory, by default the server's
+	Stdin   string            // input for the command, which otherwise gets none
+	Timeout float64           // seconds the job may run before it is killed
+	Labels  map[string]string // free-form metadata reported in the job's status
+	// StdinOpen keeps the command's stdin open once it has read Stdin, for
+	// WriteStdin to add to and CloseStdin to end. Only Background jobs
+	// without a terminal can have it.
+	StdinOpen bool
+	// IdleTimeoutSeconds is how long the job may go without writing to
+	// stdout or stderr. IdleAction is then "kill", the default, to kill
+	// it, or "flag" to leave it running and report it as stalled.
+	IdleTimeoutSeconds float64
+	IdleAction         string
+	// Umask is the command's octal file mode creation mask, such as "022",
+	// instead of the server's. Only the local executor supports it.
+	Umask string
+	// Locale sets LANG and LC_ALL, and TZ sets TZ, in the command's
+	// environment, so that its output does not depend on how the server
+	// was started.
+	Locale string
+	TZ     string
+	// Workspace runs the job in a new temporary directory of its own, set
+	// as $SHELLRUNNER_WORKDIR, which is removed when the job is released
+	// unless KeepWorkspace is set.
+	Workspace     bool
+	KeepWorkspace bool
+	// Artifacts are globs, relative to the job's directory, of the files
+	// copied aside when the job exits, for Artifacts to list until it is
+	// released. Run only collects them for kept jobs.
+	Artifacts []string
+	// Progress takes lines such as `##progress 42 "uploading"` out of the
+	// job's output, reporting the last one in its status instead.
+	Progress bool
+	// Filter selects and rewrites the lines of the job's output as it is
+	// written: only what it keeps is stored and returned.
+	Filter *runner.OutputFilter
+	// Success decides whether the job succeeded, which the result in its
+	// status reports. By default it succeeds if it exits with code 0.
+	Success *SuccessOptions
+	// Notify names the notifiers the server was configured with that are
+	// told when the job fails, succeeds or either, with the tail of its
+	// stderr.
+	Notify []runner.Notification
+	// Expect raises an alert, which Alerts reports and the job's notifiers
+	// are sent, if the job runs for longer than expected or, with a check,
+	// if no job of the check succeeds often enough.
+	Expect *ExpectOptions
+	// LogFile is a file on the server, in one of the directories it allows
+	// logs in, that the job's output is appended to, so that it outlives
+	// the job. LogOnly writes the output only there, so that Output and
+	// the rest return none of it.
+	LogFile string
+	LogOnly bool
+	// CaptureMode is how the job's output is kept: "full", the default,
+	// keeps all of it, while "ring" keeps only the last RingBytes, or 1 MiB,
+	// of each stream, so that a job writing for weeks takes up no more
+	// memory over time while its recent output can still be read.
+	CaptureMode string
+	RingBytes   int
+	// LogSink forwards each line of the job's output, as it is written, to
+	// a file in the directories the server allows logs in, syslog, a TCP or
+	// UDP address, or a webhook, as a line of JSON with the job's ID and
+	// the stream it came from; see the README for its forms.
+	LogSink string
+	// Keep stores a job run by Run so that it can be looked up later, like
+	// a background job. Background jobs are always kept until released.
+	Keep    bool
+	Limits  runner.ResourceLimits
+	Cgroup  runner.CgroupLimits
+	Nice    int    // niceness adjustment, from -20 to 19
+	IONice  string // I/O priority as "class" or "class:level"
+	CPUSet  string // CPUs to run on, such as "0-3" or "0,2,8-11"
+	Sandbox *runner.SandboxOptions
+	// Executor names the executor to run the command with. It defaults to
+	// "container", "kubernetes" or "ssh" if Container, Kubernetes or Host
+	// is set, and to "local" otherwise.
+	Executor   string
+	Container  *runner.ContainerOptions
+	Host       string // alias of the remote host to run on, for the ssh executor
+	Kubernetes *runner.KubernetesOptions
+	// TraceParent is the W3C traceparent of the caller's span. The job's
+	// span joins the caller's trace, and the command is given its own
+	// span as $TRACEPARENT.
+	TraceParent string
+	// Hosts starts one job for each of the given host aliases, grouped
+	// together. The reply is then the group's ID instead of a job ID. It is
+	// only accepted by Background.
+	Hosts []string
+	// CancelOnDisconnect kills the command if the client disconnects before
+	// it exits, instead of letting it run to completion unobserved. It is
+	// only accepted by Run.
+	CancelOnDisconnect bool
+	// ParseJSON returns the command's stdout parsed as JSON, if it is valid
+	// JSON of at most MaxParsedJSON bytes. It is only accepted by Run.
+	ParseJSON bool
+	// Encoding is how the output is encoded in the reply: EncodingText,
+	// the default, EncodingBase64 or EncodingAuto. It is only accepted by
+	// Run.
+	Encoding string
+	// CacheTTL lets Run answer with the result of a successful Run of the
+	// same job that finished no more than this many seconds ago, instead
+	// of running it again, and keeps the result for as long if it runs
+	// it. The same job is one with the same command, environment,
+	// directory, stdin and other options, from any client. It is only
+	// accepted by Run.
+	CacheTTL float64
+	runner.TerminalOptions
+}
+
+// SuccessOptions are the criteria for a job's success: it succeeds only if
+// it meets them all.
+type SuccessOptions struct {
+	ExitCodes  []int    // exit codes that mean success; just 0 if empty
+	Require    []string // regular expressions stdout or stderr must match
+	Forbid     []string // regular expressions neither stdout nor stderr may match
+	MinRuntime float64  // seconds the job must run for at least
+}
+
+// criteria returns the runner's criteria for opts, which may be nil.
+func (opts *SuccessOptions) criteria() *runner.SuccessCriteria {
+	if opts == nil {
+		return nil
+	}
+	return &runner.SuccessCriteria{
+		ExitCodes:  opts.ExitCodes,
+		Require:    opts.Require,
+		Forbid:     opts.Forbid,
+		MinRuntime: time.Duration(opts.MinRuntime * float64(time.Second)),
+	}
+}
+
+// ExpectOptions are what a job is expected to do.
+type ExpectOptions struct {
+	MaxDuration float64 // seconds the job is expected to run for at most
+	// Check names the dead-man switch the job checks in to by succeeding,
+	// which is missed if no job of it succeeds for Every seconds.
+	Check string
+	Every float64
+	// MaxFailureRate is the share, from 0 to 1, of the last FailureWindow
+	// runs of the job's series that may fail before an alert is raised,
+	// replacing the server's for the series once the job finishes.
+	MaxFailureRate float64
+	FailureWindow  int
+}
+
+// expectation returns the runner's expectation for opts, which may be nil.
+func (opts *ExpectOptions) expectation() *runner.Expectation {
+	if opts == nil {
+		return nil
+	}
+	return &runner.Expectation{
+		MaxDuration:    time.Duration(opts.MaxDuration * float64(time.Second)),
+		Check:          opts.Check,
+		Every:          time.Duration(opts.Every * float64(time.Second)),
+		MaxFailureRate: opts.MaxFailureRate,
+		FailureWindow:  opts.FailureWindow,
+	}
+}
+
+// MaxParsedJSON is the largest stdout Run parses as JSON for ParseJSON.
+const MaxParsedJSON = 16 << 20
+
+// RunArgs defines the arguments for the Run method.
+type RunArgs = JobOptions
+
+// BackgroundArgs defines the arguments for the Background method.
+type BackgroundArgs = JobOptions
+
+// spec returns the JobSpec described by opts.
+func (opts JobOptions) spec() *runner.JobSpec {
+	return &runner.JobSpec{
+		Command:         opts.Command,
+		Argv:            opts.Argv,
+		Env:             opts.Env,
+		EnvFile:         opts.EnvFile,
+		Secrets:         opts.Secrets,
+		Dir:             opts.Dir,
+		Stdin:           opts.Stdin,
+		StdinOpen:       opts.StdinOpen,
+		Timeout:         time.Duration(opts.Timeout * float64(time.Second)),
+		IdleTimeout:     time.Duration(opts.IdleTimeoutSeconds * float64(time.Second)),
+		IdleAction:      opts.IdleAction,
+		Labels:          opts.Labels,
+		Umask:           opts.Umask,
+		Locale:          opts.Locale,
+		TZ:              opts.TZ,
+		Workspace:       opts.Workspace,
+		KeepWorkspace:   opts.KeepWorkspace,
+		Artifacts:       opts.Artifacts,
+		Filter:          opts.Filter,
+		Progress:        opts.Progress,
+		Success:         opts.Success.criteria(),
+		Notify:          opts.Notify,
+		Expect:          opts.Expect.expectation(),
+		LogFile:         opts.LogFile,
+		LogOnly:         opts.LogOnly,
+		CaptureMode:     opts.CaptureMode,
+		RingBytes:       opts.RingBytes,
+		LogSink:         opts.LogSink,
+		Limits:          opts.Limits,
+		Cgroup:          opts.Cgroup,
+		Nice:            opts.Nice,
+		IONice:          opts.IONice,
+		CPUSet:          opts.CPUSet,
+		Sandbox:         opts.Sandbox,
+		Executor:        opts.Executor,
+		Container:       opts.Container,
+		Host:            opts.Host,
+		Kubernetes:      opts.Kubernetes,
+		TraceParent:     opts.TraceParent,
+		TerminalOptions: opts.TerminalOptions,
+	}
+}
+
+// jobOptions returns the options a job was run with, as its spec records
+// them once normalized by the server and its hooks, for its status.
+func jobOptions(spec *runner.JobSpec) *RecordedOptions {
+	opts := &RecordedOptions{
+		Command:            spec.Command,
+		Argv:               spec.Argv,
+		Env:                slices.Sorted(maps.Keys(spec.Env)),
+		EnvFile:            spec.EnvFile,
+		Secrets:            spec.Secrets,
+		Dir:                spec.Dir,
+		StdinBytes:         len(spec.Stdin),
+		StdinOpen:          spec.StdinOpen,
+		Timeout:            spec.Timeout.Seconds(),
+		IdleTimeoutSeconds: spec.IdleTimeout.Seconds(),
+		IdleAction:         spec.IdleAction,
+		Labels:             spec.Labels,
+		Umask:              spec.Umask,
+		Locale:             spec.Locale,
+		TZ:                 spec.TZ,
+		Workspace:          spec.Workspace,
+		KeepWorkspace:      spec.KeepWorkspace,
+		Artifacts:          spec.Artifacts,
+		Filter:             spec.Filter,
+		Progress:           spec.Progress,
+		Notify:             spec.Notify,
+		LogFile:            spec.LogFile,
+		LogOnly:            spec.LogOnly,
+		CaptureMode:        spec.CaptureMode,
+		RingBytes:          spec.RingBytes,
+		LogSink:            spec.LogSink,
+		Nice:               spec.Nice,
+		IONice:             spec.IONice,
+		CPUSet:             spec.CPUSet,
+		Sandbox:            spec.Sandbox,
+		Executor:           spec.Executor,
+		Container:          spec.Container,
+		Host:               spec.Host,
+		Kubernetes:         spec.Kubernetes,
+		TraceParent:        spec.TraceParent,
+		Pty:                spec.Pty,
+		Rows:               spec.Rows,
+		Cols:               spec.Cols,
+	}
+	if limits := spec.Limits; limits != (runner.ResourceLimits{}) {
+		opts.Limits = &limits
+	}
+	if cgroup := spec.Cgroup; cgroup != (runner.CgroupLimits{}) {
+		opts.Cgroup = &cgroup
+	}
+	if spec.Stdin != "" {
+		opts.StdinSHA256 = fmt.Sprintf("%x", sha256.Sum256([]byte(spec.Stdin)))
+	}
+	if c := spec.Success; c != nil {
+		opts.Success = &SuccessOptions{
+			ExitCodes:  c.ExitCodes,
+			Require:    c.Require,
+			Forbid:     c.Forbid,
+			MinRuntime: c.MinRuntime.Seconds(),
+		}
+	}
+	if e := spec.Expect; e != nil {
+		opts.Expect = &ExpectOptions{
+			MaxDuration:    e.MaxDuration.Seconds(),
+			Check:          e.Check,
+			Every:          e.Every.Seconds(),
+			MaxFailureRate: e.MaxFailureRate,
+			FailureWindow:  e.FailureWindow,
+		}
+	}
+	return opts
+}
+
+// UnmarshalJSON accepts either a JobOptions object or, for compatibility
+// with older clients of Background, a bare command string.
+func (opts *JobOptions) UnmarshalJSON(data []byte) error {
+	var command string
+	if err := json.Unmarshal(data, &command); err == nil {
+		*opts = JobOptions{Command: command}
+		return nil
+	}
+	type plain JobOptions
+	return json.Unmarshal(data, (*plain)(opts))
+}
+
+// Run executes a command synchronously and returns its output and exit code.
+func (s *ShellRunner) Run(args RunArgs, reply *RunResult) error {
+	if err := s.server.checkPayload("Run", &args); err != nil {
+		return err
+	}
+	runner.Logger.Printf("Run called with command: %q, argv: %q, Keep: %t", args.Command, args.Argv, args.Keep)
+	if len(args.Hosts) > 0 {
+		return &Error{Code: CodeInvalidArgument, Message: "Hosts is only supported by Background"}
+	}
+	if err := checkEncoding(args.Encoding); err != nil {
+		return err
+	}
+	if args.CacheTTL < 0 {
+		return &Error{Code: CodeInvalidArgument, Message: "CacheTTL must not be negative"}
+	}
+	var cached bool
+	if args.CacheTTL > 0 {
+		*reply, cached = s.server.cachedRun(args)
+	}
+	if cached {
+		runner.Logger.Printf("Run answered from the cache for command: %q", args.Command)
+	} else {
+		release, err := s.reserve("Run", 1)
+		if err != nil {
+			return err
+		}
+		defer release()
+		ctx, cancel := s.context("Run", args.CancelOnDisconnect)
+		defer cancel()
+		job, err := s.manager.RunContext(ctx, s.jobSpec(args), args.Keep)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return &Error{Code: CodeTimeout, Message: fmt.Sprintf("command killed after the %v deadline for Run", lookupDuration(s.server.Timeouts, "Run"))}
+		}
+		if err != nil {
+			return rpcError(err)
+		}
+
+		*reply = RunResult{
+			Stdout:        job.Stdout.String(),
+			Stderr:        job.Stderr.String(),
+			ExitCode:      job.ExitCode,
+			Status:        job.Status,
+			StartError:    job.StartError,
+			LimitExceeded: job.LimitExceeded,
+			Signal:        job.Signal,
+			CoreDumped:    job.CoreDumped,
+			KilledBy:      job.KilledBy,
+			Result:        job.Result,
+			FailureReason: job.FailureReason,
+			JobID:         job.ID,
+			Workspace:     job.Workspace,
+			Artifacts:     job.Artifacts,
+			Usage:         usage(job),
+		}
+		if args.CacheTTL > 0 {
+			s.server.cacheRun(args, *reply, job.EndTime)
+		}
+	}
+	if args.ParseJSON {
+		reply.Parsed, reply.ParseError = parseJSON([]byte(reply.Stdout))
+	}
+	reply.Encoding, reply.IsBinary = encodeOutput(args.Encoding, &reply.Stdout, &reply.Stderr)
+
+	runner.Logger.Printf("Run finished for command: %q", args.Command)
+	return nil
+}
+
+// parseJSON returns stdout as compact JSON, or why it cannot.
+func parseJSON(stdout []byte) (json.RawMessage, string) {
+	if len(stdout) > MaxParsedJSON {
+		return nil, fmt.Sprintf("stdout of %d bytes is larger than the maximum of %d", len(stdout), MaxParsedJSON)
+	}
+	if len(bytes.TrimSpace(stdout)) == 0 {
+		return nil, "stdout is empty"
+	}
+	var parsed bytes.Buffer
+	if err := json.Compact(&parsed, stdout); err != nil {
+		return nil, fmt.Sprintf("stdout is not valid JSON: %v", err)
+	}
+	return parsed.Bytes(), ""
+}
+
+// Background executes a command asynchronously, returning a unique job ID, or
+// a group ID when the command is started on several hosts.
+func (s *ShellRunner) Background(args BackgroundArgs, reply *string) error {
+	if err := s.server.checkPayload("Background", &args); err != nil {
+		return err
+	}
+	runner.Logger.Printf("Background called with command: %q, argv: %q, hosts: %q", args.Command, args.Argv, args.Hosts)
+	if args.CancelOnDisconnect || args.ParseJSON || args.Encoding != "" || args.CacheTTL != 0 {
+		return &Error{Code: CodeInvalidArgument, Message: "CancelOnDisconnect, ParseJSON, Encoding and CacheTTL are only supported by Run"}
+	}
+	release, err := s.reserve("Background", max(len(args.Hosts), 1))
+	if err != nil {
+		return err
+	}
+	defer release()
+	var id string
+	if len(args.Hosts) > 0 {
+		id, err = s.manager.StartGroup(s.jobSpec(args), args.Hosts)
+	} else {
+		id, err = s.manager.Start(s.jobSpec(args))
+	}
+	if err != nil {
+		return rpcError(err)
+	}
+	*reply = id
+	return nil
+}
+
+// Rerun starts a new background job with the same command and options as
+// the job with the given ID, and returns the new job's ID. The new job's
+// status names the job it reruns. The job may have been released, as long
+// as the server still remembers it: released jobs are kept in memory only,
+// up to the manager's HistorySize of them, so none can be rerun after a restart.
+// Only the job's tenant, or an admin, can rerun it; the new job is the
+// caller's, counted against their quotas.
+func (s *ShellRunner) Rerun(id string, reply *string) error {
+	runner.Logger.Printf("Rerun called for job ID: %s", id)
+	release, err := s.reserve("Rerun", 1)
+	if err != nil {
+		return err
+	}
+	defer release()
+	newID, err := s.manager.Rerun(id, s.identity())
+	if err != nil {
+		return rpcError(err)
+	}
+	*reply = newID
+	return nil
+}
+
+// Group returns the jobs of a group started on several hosts, along with
+// the group's overall status: "running" until all of its jobs have finished,
+// and "exited" after. Released jobs are left out. The groups of other
+// tenants are not found, unless the caller is an admin.
+func (s *ShellRunner) Group(id string, reply *GroupStatus) error {
+	runner.Logger.Printf("Group called for group ID: %s", id)
+	caller := s.identity()
+	return rpcError(s.manager.WithGroup(id, func(jobs []*runner.Job) error {
+		for _, job := range jobs {
+			if !s.server.owns(caller, job.Spec.Submitter) {
+				return &Error{Code: CodeGroupNotFound, Message: fmt.Sprintf("group with id %s not found", id)}
+			}
+		}
+		reply.Status = "exited"
+		reply.Jobs = make([]GroupJob, 0, len(jobs))
+		for _, job := range jobs {
+			entry := GroupJob{ID: job.ID, Host: job.Spec.Host, Status: job.Status}
+			if !job.Finished() {
+				reply.Status = "running"
+			} else {
+				entry.ExitCode = exitCode(job)
+			}
+			reply.Jobs = append(reply.Jobs, entry)
+		}
+		return nil
+	}))
+}
+
+// Status returns the current status and execution time of a background job.
+func (s *ShellRunner) Status(id string, reply *JobStatus) error {
+	runner.Logger.Printf("Status called for job ID: %s", id)
+	return rpcError(s.manager.WithJob(id, func(job *runner.Job) error {
+		*reply = JobStatus{
+			Command:       job.Command,
+			Argv:          job.Argv,
+			Pty:           job.Spec.Pty,
+			Host:          job.Spec.Host,
+			Group:         job.Group,
+			Labels:        job.Spec.Labels,
+			Annotations:   maps.Clone(job.Annotations),
+			Submitter:     submitter(job),
+			RerunOf:       job.RerunOf,
+			ImportedFrom:  job.ImportedFrom,
+			Workspace:     job.Workspace,
+			LogFile:       job.Spec.LogFile,
+			LogSink:       job.Spec.LogSink,
+			CaptureMode:   runner.CaptureFull,
+			Status:        job.Status,
+			StartTime:     job.StartTime,
+			ExitCode:      exitCode(job),
+			StartError:    job.StartError,
+			LimitExceeded: job.LimitExceeded,
+			Signal:        job.Signal,
+			CoreDumped:    job.CoreDumped,
+			KilledBy:      job.KilledBy,
+			Result:        job.Result,
+			FailureReason: job.FailureReason,
+			Overrun:       job.Overran(),
+			Umask:         job.Spec.Umask,
+			Locale:        job.Spec.Locale,
+			TZ:            job.Spec.TZ,
+			Nice:          job.Spec.Nice,
+			IONice:        job.Spec.IONice,
+			CPUSet:        job.Spec.CPUSet,
+			Shell:         job.Shell,
+			Options:       jobOptions(job.Spec),
+			Usage:         usage(job),
+		}
+		if job.Spec.CaptureMode == runner.CaptureRing {
+			reply.CaptureMode = runner.CaptureRing
+			reply.RingBytes = job.Stdout.Limit()
+			reply.StdoutDropped = job.Stdout.Dropped()
+			reply.StderrDropped = job.Stderr.Dropped()
+		}
+		if job.Spec.Executor != "local" {
+			reply.Executor = job.Spec.Executor
+		}
+		if opts := job.Spec.Kubernetes; opts != nil {
+			reply.Image = opts.Image
+			reply.Pod = opts.Name
+			reply.Namespace = opts.Namespace
+			reply.PodPhase = job.PodPhase()
+		}
+		if job.Spec.Container != nil {
+			reply.Image = job.Spec.Container.Image
+			reply.Container = job.Spec.Container.Name
+		}
+		if !job.Finished() {
+			reply.DurationSeconds = time.Since(job.StartTime).Seconds()
+		} else {
+			reply.DurationSeconds = job.EndTime.Sub(job.StartTime).Seconds()
+			ended := job.EndTime
+			reply.EndedAt = &ended
+		}
+		reply.SubmittedAt = job.SubmitTime
+		reply.StartedAt = job.StartTime
+		reply.QueuedDurationSeconds = job.StartTime.Sub(job.SubmitTime).Seconds()
+		reply.RunDurationSeconds = reply.DurationSeconds
+		progress := job.Progress()
+		reply.StdoutBytes, reply.StdoutLines = progress.StdoutBytes, progress.StdoutLines
+		reply.StderrBytes, reply.StderrLines = progress.StderrBytes, progress.StderrLines
+		idleSince := job.StartTime
+		if !progress.LastOutput.IsZero() {
+			reply.LastOutputAt = &progress.LastOutput
+			idleSince = progress.LastOutput
+		}
+		if !job.Finished() {
+			reply.OutputIdleSeconds = time.Since(idleSince).Seconds()
+		} else {
+			reply.OutputIdleSeconds = max(0, job.EndTime.Sub(idleSince).Seconds())
+		}
+		reply.Stalled = job.Stalled()
+		if deadline := job.Deadline(); !deadline.IsZero() {
+			reply.Deadline = &deadline
+		}
+		if reported, ok := job.ReportedProgress(); ok {
+			reply.ProgressPercent = &reported.Percent
+			reply.ProgressMessage = reported.Message
+			reply.ProgressUpdatedAt = &reported.Time
+		}
+		if job.Spec.Sandbox != nil {
+			reply.Sandboxed = true
+			reply.NetworkIsolated = job.Spec.Sandbox.NoNetwork
+		}
+		reply.TraceID = job.Trace.TraceID
+		reply.SpanID = job.Trace.SpanID
+		return nil
+	}))
+}
+
+// exitCode returns a pointer to a job's exit code, or nil while it is still
+// running.
+func exitCode(job *runner.Job) *int {
+	if !job.Finished() {
+		return nil
+	}
+	code := job.ExitCode
+	return &code
+}
+
+// usage returns a job's cgroup and its resource usage, if the job runs in a
+// cgroup.
+func usage(job *runner.Job) Usage {
+	path := job.CgroupPath()
+	if path == "" {
+		return Usage{}
+	}
+	u := job.Usage()
+	return Usage{
+		Cgroup:          path,
+		MemoryBytes:     u.MemoryBytes,
+		MemoryPeakBytes: u.MemoryPeakBytes,
+		CPUSeconds:      u.CPUSeconds,
+		OOMKills:        u.OOMKills,
+	}
+}
+
+// OutputArgs defines the arguments for the Output method.
+type OutputArgs struct {
+	ID      string
+	Release bool
+	// Filter selects and rewrites the lines of the output returned, leaving
+	// the job's output as it is.
+	Filter *runner.OutputFilter
+	// Encoding is how the output is encoded in the reply, as for Run.
+	Encoding string
+}
+
+// Output returns the stdout and stderr of a background job.
+func (s *ShellRunner) Output(args OutputArgs, reply *JobOutput) error {
+	runner.Logger.Printf("Output called for job ID: %s, Release: %t", args.ID, args.Release)
+	if err := checkEncoding(args.Encoding); err != nil {
+		return err
+	}
+	var filter func(string) string
+	if args.Filter != nil {
+		var err error
+		if filter, err = args.Filter.Compile(); err != nil {
+			return rpcError(err)
+		}
+	}
+	err := s.manager.WithJob(args.ID, func(job *runner.Job) error {
+		*reply = JobOutput{
+			Stdout: job.Stdout.String(),
+			Stderr: job.Stderr.String(),
+			Argv:   job.Argv,
+		}
+		return nil
+	})
+	if err != nil {
+		return rpcError(err)
+	}
+	if filter != nil {
+		reply.Stdout, reply.Stderr = filter(reply.Stdout), filter(reply.Stderr)
+	}
+	reply.Encoding, reply.IsBinary = encodeOutput(args.Encoding, &reply.Stdout, &reply.Stderr)
+
+	if args.Release {
+		runner.Logger.Printf("Releasing job %s", args.ID)
+		s.manager.Release(args.ID)
+	}
+	return nil
+}
+
+// Release removes a job's data from memory.
+func (s *ShellRunner) Release(id string, reply *bool) error {
+	runner.Logger.Printf("Release called for job ID: %s", id)
+	if err := s.manager.Release(id); err != nil {
+		return rpcError(err)
+	}
+	*reply = true
+	return nil
+}
+
+// KillArgs defines the arguments for the Kill method.
+type KillArgs struct {
+	ID     string
+	Signal string // signal name such as "TERM"; defaults to "KILL"
+}
+
+// Kill sends a signal to a running job and everything it spawned.
+func (s *ShellRunner) Kill(args KillArgs, reply *bool) error {
+	runner.Logger.Printf("Kill called for job ID: %s, Signal: %q", args.ID, args.Signal)
+	if err := s.manager.Kill(args.ID, args.Signal); err != nil {
+		return rpcError(err)
+	}
+	*reply = true
+	return nil
+}
+
+// Pause stops a running job and everything it spawned, without losing its
+// progress, until Resume is called. Its status is "paused" meanwhile.
+func (s *ShellRunner) Pause(id string, reply *bool) error {
+	runner.Logger.Printf("Pause called for job ID: %s", id)
+	if err := s.manager.Pause(id); err != nil {
+		return rpcError(err)
+	}
+	*reply = true
+	return nil
+}
+
+// Resume continues a job stopped by Pause.
+func (s *ShellRunner) Resume(id string, reply *bool) error {
+	runner.Logger.Printf("Resume called for job ID: %s", id)
+	if err := s.manager.Resume(id); err != nil {
+		return rpcError(err)
+	}
+	*reply = true
+	return nil
+}
+
+// WriteStdinArgs defines the arguments for the WriteStdin method.
+type WriteStdinArgs struct {
+	ID string
+	// Data is the input to write, base64-encoded in JSON, of at most
+	// MaxFileChunk bytes.
+	Data []byte
+}
+
+// WriteStdin writes to the stdin of a running job started with StdinOpen,
+// such as the answer to a prompt or another batch of input. It fails if the
+// job does not read its input in time. The reply is the number of bytes
+// written.
+func (s *ShellRunner) WriteStdin(args WriteStdinArgs, reply *int) error {
+	runner.Logger.Printf("WriteStdin called for job ID: %s with %d bytes", args.ID, len(args.Data))
+	if len(args.Data) > MaxFileChunk {
+		return &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf("input of %d bytes is larger than the maximum of %d", len(args.Data), MaxFileChunk)}
+	}
+	if max := s.server.PayloadLimits.MaxStdinBytes; max > 0 && len(args.Data) > max {
+		return tooLarge("WriteStdin", "stdin", "bytes", "max_stdin_bytes", len(args.Data), max)
+	}
+	n, err := s.manager.WriteStdin(args.ID, args.Data)
+	if err != nil {
+		return rpcError(err)
+	}
+	*reply = n
+	return nil
+}
+
+// CloseStdin closes the stdin of a running job started with StdinOpen, so
+// that it reads the end of its input.
+func (s *ShellRunner) CloseStdin(id string, reply *bool) error {
+	runner.Logger.Printf("CloseStdin called for job ID: %s", id)
+	if err := s.manager.CloseStdin(id); err != nil {
+		return rpcError(err)
+	}
+	*reply = true
+	return nil
+}
+
+// ExtendTimeoutArgs defines the arguments for the ExtendTimeout method.
+type ExtendTimeoutArgs struct {
+	ID           string
+	ExtraSeconds float64 // how much longer the job may run
+}
+
+// ExtendTimeout gives a running job with a timeout more time before it is
+// killed, and replies with its new deadline.
+func (s *ShellRunner) ExtendTimeout(args ExtendTimeoutArgs, reply *time.Time) error {
+	runner.Logger.Printf("ExtendTimeout called for job ID: %s, by %vs", args.ID, args.ExtraSeconds)
+	deadline, err := s.manager.ExtendTimeout(args.ID, time.Duration(args.ExtraSeconds*float64(time.Second)))
+	if err != nil {
+		return rpcError(err)
+	}
+	*reply = deadline
+	return nil
+}
+
+// AnnotateArgs defines the arguments for the Annotate method.
+type AnnotateArgs struct {
+	ID    string
+	Key   string
+	Value string // removes the annotation if empty
+}
+
+// Annotate adds a note to an existing job, such as the ticket of the
+// incident it caused or whether it has been looked into, and replies with
+// all of the job's annotations.
+func (s *ShellRunner) Annotate(args AnnotateArgs, reply *map[string]string) error {
+	runner.Logger.Printf("Annotate called for job ID: %s, key: %q", args.ID, args.Key)
+	annotations, err := s.manager.Annotate(args.ID, args.Key, args.Value)
+	if err != nil {
+		return rpcError(err)
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	*reply = annotations
+	return nil
+}
+
+// KillAllArgs defines the arguments for the KillAll method. Only running
+// jobs with all the given labels, a command matching Command, a regular
+// expression, and that started at least OlderThanSeconds ago are signalled;
+// without any of them, every running job is.
+type KillAllArgs struct {
+	Labels           map[string]string
+	Command          string
+	OlderThanSeconds float64
+	Signal           string // signal name such as "TERM"; defaults to "KILL"
+}
+
+// KillAll sends a signal to every running job that args selects, such as
+// those of a broken deployment, and everything they spawned. Only the
+// caller's own jobs are selected, unless it is an admin.
+func (s *ShellRunner) KillAll(args KillAllArgs, reply *KillAllResult) error {
+	runner.Logger.Printf("KillAll called with labels %v, command %q, older than %vs, Signal: %q", args.Labels, args.Command, args.OlderThanSeconds, args.Signal)
+	filter := runner.JobFilter{
+		Labels:    args.Labels,
+		Command:   args.Command,
+		OlderThan: time.Duration(args.OlderThanSeconds * float64(time.Second)),
+		Submitter: s.ownFilter().Submitter,
+	}
+	killed, failed, err := s.manager.KillAll(filter, args.Signal)
+	if err != nil {
+		return rpcError(err)
+	}
+	reply.Killed = killed
+	if reply.Killed == nil {
+		reply.Killed = []string{}
+	}
+	for id, err := range failed {
+		if reply.Failed == nil {
+			reply.Failed = make(map[string]string)
+		}
+		reply.Failed[id] = err.Error()
+	}
+	return nil
+}
+
+// ReleaseAll removes all the caller's finished jobs from memory, or every
+// tenant's for an admin.
+func (s *ShellRunner) ReleaseAll(args struct{}, reply *int) error {
+	runner.Logger.Println("ReleaseAll called")
+	released, err := s.manager.ReleaseAll(s.ownFilter())
+	if err != nil {
+		return rpcError(err)
+	}
+	*reply = released
+	return nil
+}
+
+// ListArgs defines the arguments for the List method.
+type ListArgs struct {
+	Limit   int    // the most jobs to return, or 0 for all of them
+	AfterID string // return only the jobs after this one, the NextAfterID of the previous page
+}
+
+// List returns the jobs and their statuses in order of ID, a page at a time
+// if args.Limit is set.
+func (s *ShellRunner) List(args ListArgs, reply *JobList) error {
+	runner.Logger.Printf("List called with limit %d after %q", args.Limit, args.AfterID)
+	if args.Limit < 0 {
+		return &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf("invalid limit %d", args.Limit)}
+	}
+	limit := args.Limit
+	if limit > 0 {
+		// One more job tells whether another page follows.
+		limit++
+	}
+	jobs, total := s.manager.ListPage(args.AfterID, limit)
+	*reply = JobList{Jobs: jobs, Total: total}
+	if args.Limit > 0 && len(jobs) > args.Limit {
+		reply.Jobs = jobs[:args.Limit]
+		reply.NextAfterID = reply.Jobs[args.Limit-1].ID
+	}
+	return nil
+}
+
+// Statistics returns statistics about command executions.
+func (s *ShellRunner) Statistics(args struct{}, reply *Stats) error {
+	runner.Logger.Println("Statistics called")
+	*reply = s.server.stats()
+	return nil
+}
+
+// Alerts returns the alerts raised about jobs that ran for longer than
+// expected, checks that were missed and series of jobs that became slower
+// or failed too often, and the state of the checks.
+func (s *ShellRunner) Alerts(args struct{}, reply *AlertsResult) error {
+	runner.Logger.Println("Alerts called")
+	reply.Alerts = []Alert{}
+	for _, a := range s.manager.Alerts() {
+		reply.Alerts = append(reply.Alerts, Alert{
+			Time:    a.Time,
+			Kind:    a.Kind,
+			JobID:   a.JobID,
+			Check:   a.Check,
+			Message: a.Message,
+		})
+	}
+	reply.Checks = []Check{}
+	for _, c := range s.manager.Checks() {
+		check := Check{
+			Name:         c.Name,
+			EverySeconds: c.Every.Seconds(),
+			LastJobID:    c.LastJobID,
+			Due:          c.Due,
+			Missed:       c.Missed,
+		}
+		if !c.LastSuccess.IsZero() {
+			check.LastSuccess = &c.LastSuccess
+		}
+		reply.Checks = append(reply.Checks, check)
+	}
+	return nil
+}
+
+// TrendsArgs defines the arguments for the Trends method.
+type TrendsArgs struct {
+	Series string // return only this series, or all of them if empty
+}
+
+// Trends returns how the runs of each series of jobs have gone: the
+// baseline duration of its successful runs, how far the recent ones
+// deviate from it, and its failures and failure rate, so that jobs that
+// have become slower or keep failing stand out.
+func (s *ShellRunner) Trends(args TrendsArgs, reply *TrendsResult) error {
+	runner.Logger.Printf("Trends called for series %q", args.Series)
+	reply.Trends = []Trend{}
+	for _, t := range s.manager.Trends() {
+		if args.Series != "" && t.Series != args.Series {
+			continue
+		}
+		reply.Trends = append(reply.Trends, Trend{
+			Series:                  t.Series,
+			Runs:                    t.Runs,
+			BaselineDurationSeconds: t.Baseline.Seconds(),
+			RecentDurationSeconds:   t.Recent.Seconds(),
+			Deviation:               t.Deviation,
+			Slower:                  t.Slower,
+			FailureStreak:           t.FailureStreak,
+			SuccessRate:             t.SuccessRate,
+			FailureRate:             t.FailureRate,
+			MaxFailureRate:          t.MaxFailureRate,
+			FailureWindow:           t.FailureWindow,
+			Failing:                 t.Failing,
+			LastJobID:               t.LastJobID,
+			LastExitCode:            t.LastExitCode,
+			LastRun:                 t.LastRun,
+		})
+	}
+	return nil
+}
+
+// stats returns the statistics reported by Statistics.
+func (s *Server) stats() Stats {
+	stats := s.manager.Stats()
+	config := s.manager.Config()
+
+	var avgDuration float64
+	if stats.TotalCount > 0 {
+		avgDuration = stats.TotalDuration.Seconds() / float64(stats.TotalCount)
+	}
+
+	reply := Stats{
+		TotalCount:             stats.TotalCount,
+		AverageDurationSeconds: avgDuration,
+		MaxDurationSeconds:     stats.MaxDuration.Seconds(),
+		TotalStdoutBytes:       stats.TotalStdoutBytes,
+		TotalStderrBytes:       stats.TotalStderrBytes,
+		SuccessCount:           stats.SuccessCount,
+		FailureCount:           stats.FailureCount,
+		BufferedBytes:          stats.BufferedBytes,
+		MaxBufferedBytes:       config.MaxBufferedBytes,
+		BusyWorkers:            stats.BusyWorkers,
+		Workers:                config.Workers,
+		SlowCalls:              s.slowCalls.Load(),
+		TimedOutCalls:          s.timeouts.Load(),
+		RateLimitedCalls:       s.rateLimited.Load(),
+		QuotaExceededCalls:     s.quotaExceeded.Load(),
+		PermissionDeniedCalls:  s.permissionDenied.Load(),
+		CachedRuns:             s.cachedRuns(),
+		RejectedConnections:    s.rejectedConns.Load(),
+		AuthFailures:           s.authFailures.Load(),
+		Methods:                s.methods.stats(),
+		Identities:             s.identities.stats(),
+	}
+	if host, err := runner.ReadHostStats(); err == nil {
+		reply.Host = &HostStats{
+			Load1:                host.Load1,
+			Load5:                host.Load5,
+			Load15:               host.Load15,
+			CPUs:                 host.CPUs,
+			MemoryTotalBytes:     host.MemoryTotalBytes,
+			MemoryAvailableBytes: host.MemoryAvailableBytes,
+			SpoolDir:             host.SpoolDir,
+			SpoolTotalBytes:      host.SpoolTotalBytes,
+			SpoolFreeBytes:       host.SpoolFreeBytes,
+		}
+	}
+	return reply
+}
+
+// Since returns the output of a job since the last time it was called.
+func (s *ShellRunner) Since(id string, reply *JobOutput) error {
+	runner.Logger.Printf("Since called for job ID: %s", id)
+	return rpcError(s.manager.WithJob(id, func(job *runner.Job) error {
+		// Read new output from the buffers. The offsets count what rings
+		// have discarded, so output discarded since the last call is
+		// skipped.
+		newStdout := unread(&job.Stdout, &job.StdoutOffset)
+		newStderr := unread(&job.Stderr, &job.StderrOffset)
+
+		*reply = JobOutput{Stdout: newStdout, Stderr: newStderr}
+
+		// If the job is finished, include its status and exit code.
+		if job.Finished() {
+			reply.Status = job.Status
+			reply.ExitCode = exitCode(job)
+		}
+		return nil
+	}))
+}
+
+// unread returns the output of buf past *offset, the number of bytes
+// written to it that have been read, and moves the offset past it.
+func unread(buf *runner.OutputBuffer, offset *int) string {
+	output := buf.Bytes()
+	start := max(int64(*offset)-buf.Dropped(), 0)
+	*offset = int(buf.Written())
+	return string(output[start:])
+}
+
+// ResizeArgs defines the arguments for the Resize method.
+type ResizeArgs struct {
+	ID   string
+	Rows uint16
+	Cols uint16
+}
+
+// Resize changes the terminal size of a running job started with a pseudo-terminal.
+func (s *ShellRunner) Resize(args ResizeArgs, reply *bool) error {
+	runner.Logger.Printf("Resize called for job ID: %s, Rows: %d, Cols: %d", args.ID, args.Rows, args.Cols)
+	if err := s.manager.Resize(args.ID, args.Rows, args.Cols); err != nil {
+		return rpcError(err)
+	}
+	*reply = true
+	return nil
+}
+
+// ExecArgs defines the arguments for the Exec method.
+type ExecArgs struct {
+	Command string
+	Argv    []string
+	Rows    uint16
+	Cols    uint16
+}
+
+// Exec starts an interactive session, a job running under a pseudo-terminal,
+// and returns its job ID. Without a command the session runs an interactive
+// shell. A client attaches by opening a new connection and sending
+// "EXEC <job_id>\n"; keystrokes and output then flow over that connection
+// until the job exits, and disconnecting hangs up the terminal.
+func (s *ShellRunner) Exec(args ExecArgs, reply *string) error {
+	if err := s.server.checkCommand("Exec", args.Command, args.Argv); err != nil {
+		return err
+	}
+	runner.Logger.Printf("Exec called with command: %q, argv: %q", args.Command, args.Argv)
+	release, err := s.reserve("Exec", 1)
+	if err != nil {
+		return err
+	}
+	defer release()
+	id, err := s.manager.StartSession(&runner.JobSpec{
+		Command:         args.Command,
+		Argv:            args.Argv,
+		TerminalOptions: runner.TerminalOptions{Rows: args.Rows, Cols: args.Cols},
+		Submitter:       s.identity(),
+	})
+	if err != nil {
+		return rpcError(err)
+	}
+	*reply = id
+	return nil
+}
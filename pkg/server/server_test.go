@@ -0,0 +1,4391 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"shellrunner/pkg/runner"
+)
+
+// setup is a helper function that returns a ShellRunner with a fresh job
+// manager for each test.
+func setup(t *testing.T) *ShellRunner {
+	t.Helper()
+	return setupWith(t, runner.DefaultConfig())
+}
+
+// setupWith is like setup, but gives the job manager the given settings.
+func setupWith(t *testing.T, config runner.Config) *ShellRunner {
+	t.Helper()
+	srv := New(runner.NewManager(config))
+	return srv.receiver(srv.ctx, "")
+}
+
+// lookup returns the job with the given ID, or nil if there is none.
+func lookup(s *ShellRunner, id string) *runner.Job {
+	var job *runner.Job
+	s.manager.WithJob(id, func(j *runner.Job) error {
+		job = j
+		return nil
+	})
+	return job
+}
+
+// TestRun contains unit tests for the Run method.
+func TestRun(t *testing.T) {
+	shellRunner := setup(t)
+
+	t.Run("without keep", func(t *testing.T) {
+		var reply RunResult
+		err := shellRunner.Run(RunArgs{Command: `echo "hello"`}, &reply)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if reply.Stdout != "hello\n" {
+			t.Errorf("expected stdout 'hello\\n', got %q", reply.Stdout)
+		}
+		if reply.JobID != "" {
+			t.Error("expected no job_id when not keeping the job")
+		}
+	})
+
+	t.Run("with keep", func(t *testing.T) {
+		var reply RunResult
+		err := shellRunner.Run(RunArgs{Command: `echo "kept"`, Keep: true}, &reply)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		jobID := reply.JobID
+		if jobID == "" {
+			t.Fatal("expected a job_id when keeping the job")
+		}
+
+		// Verify the job is in the map
+		job := lookup(shellRunner, jobID)
+		if job == nil {
+			t.Fatal("job was not kept in the jobs map")
+		}
+		if job.Command != `echo "kept"` {
+			t.Errorf("kept job has wrong command: %q", job.Command)
+		}
+		if job.Status != "exited" {
+			t.Errorf("kept job has wrong status: %q", job.Status)
+		}
+	})
+
+	t.Run("with parse json", func(t *testing.T) {
+		var reply RunResult
+		err := shellRunner.Run(RunArgs{Command: `echo '{"items": [1, 2],  "name": "x"}'`, ParseJSON: true}, &reply)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if string(reply.Parsed) != `{"items":[1,2],"name":"x"}` || reply.ParseError != "" {
+			t.Errorf("expected stdout parsed as JSON, got %s, %q", reply.Parsed, reply.ParseError)
+		}
+
+		for _, command := range []string{"echo not json", "true"} {
+			err = shellRunner.Run(RunArgs{Command: command, ParseJSON: true}, &reply)
+			if err != nil || reply.Parsed != nil || reply.ParseError == "" {
+				t.Errorf("%s: expected a parse error, got %s, %q, %v", command, reply.Parsed, reply.ParseError, err)
+			}
+		}
+
+		var id string
+		if err := shellRunner.Background(BackgroundArgs{Command: "true", ParseJSON: true}, &id); err == nil || ParseError(err.Error()).Code != CodeInvalidArgument {
+			t.Errorf("expected INVALID_ARGUMENT from Background, got %v", err)
+		}
+	})
+}
+
+// TestBackground contains unit tests for the Background method.
+func TestBackground(t *testing.T) {
+	shellRunner := setup(t)
+	var id string
+	err := shellRunner.Background(BackgroundArgs{Command: `sleep 0.1; echo "done"`}, &id)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if id != "1" {
+		t.Fatalf("expected a job id '1', got %s", id)
+	}
+
+	// Allow time for the command to start
+	time.Sleep(10 * time.Millisecond)
+
+	err = shellRunner.manager.WithJob(id, func(job *runner.Job) error {
+		if job.Status != "running" {
+			t.Errorf("expected job status to be 'running', got %s", job.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("job with id %s not found in jobs map", id)
+	}
+
+	// Wait for the job to finish
+	time.Sleep(200 * time.Millisecond)
+
+	shellRunner.manager.WithJob(id, func(job *runner.Job) error {
+		if job.Status != "exited" {
+			t.Errorf("expected job status to be 'exited', got %s", job.Status)
+		}
+		if job.ExitCode != 0 {
+			t.Errorf("expected exit code to be 0, got %d", job.ExitCode)
+		}
+		if job.Stdout.String() != "done\n" {
+			t.Errorf("expected stdout to be 'done\\n', got %q", job.Stdout.String())
+		}
+		return nil
+	})
+}
+
+// TestStatus contains unit tests for the Status method.
+func TestStatus(t *testing.T) {
+	shellRunner := setup(t)
+	command := "sleep 0.2"
+	var id string
+	err := shellRunner.Background(BackgroundArgs{Command: command}, &id)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	var reply JobStatus
+	err = shellRunner.Status(id, &reply)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if reply.Status != "running" {
+		t.Errorf("expected status to be 'running', got %s", reply.Status)
+	}
+	if reply.Command != command {
+		t.Errorf("expected command to be %q, got %q", command, reply.Command)
+	}
+	if reply.StartTime.IsZero() {
+		t.Error("expected status reply to have 'start_time'")
+	}
+	if reply.ExitCode != nil {
+		t.Error("expected no exit code while the job is running")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	err = shellRunner.Status(id, &reply)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if reply.Status != "exited" {
+		t.Errorf("expected status to be 'exited', got %s", reply.Status)
+	}
+	if reply.DurationSeconds < 0.2 {
+		t.Errorf("expected duration to be at least 0.2, got %v", reply.DurationSeconds)
+	}
+}
+
+// TestOutput contains unit tests for the Output method.
+func TestOutput(t *testing.T) {
+	shellRunner := setup(t)
+
+	t.Run("without release", func(t *testing.T) {
+		var id string
+		err := shellRunner.Background(BackgroundArgs{Command: `echo "test"`}, &id)
+		if err != nil {
+			t.Fatalf("background failed: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond) // allow command to finish
+
+		var reply JobOutput
+		err = shellRunner.Output(OutputArgs{ID: id, Release: false}, &reply)
+		if err != nil {
+			t.Fatalf("output failed: %v", err)
+		}
+
+		if reply.Stdout != "test\n" {
+			t.Errorf("expected stdout 'test\\n', got %q", reply.Stdout)
+		}
+
+		// Verify the job still exists
+		if lookup(shellRunner, id) == nil {
+			t.Error("job was released when it should not have been")
+		}
+	})
+
+	t.Run("with release", func(t *testing.T) {
+		var id string
+		err := shellRunner.Background(BackgroundArgs{Command: `echo "test"`}, &id)
+		if err != nil {
+			t.Fatalf("background failed: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond) // allow command to finish
+
+		var reply JobOutput
+		err = shellRunner.Output(OutputArgs{ID: id, Release: true}, &reply)
+		if err != nil {
+			t.Fatalf("output failed: %v", err)
+		}
+
+		if reply.Stdout != "test\n" {
+			t.Errorf("expected stdout 'test\\n', got %q", reply.Stdout)
+		}
+
+		// Verify the job was released
+		if lookup(shellRunner, id) != nil {
+			t.Error("job was not released when it should have been")
+		}
+	})
+}
+
+// TestRelease contains unit tests for the Release method.
+func TestRelease(t *testing.T) {
+	shellRunner := setup(t)
+	var id string
+	err := shellRunner.Background(BackgroundArgs{Command: `sleep 1`}, &id)
+	if err != nil {
+		t.Fatalf("background failed: %v", err)
+	}
+
+	// Verify the job exists before releasing
+	if lookup(shellRunner, id) == nil {
+		t.Fatal("job was not created successfully")
+	}
+
+	var released bool
+	err = shellRunner.Release(id, &released)
+	if err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+	if !released {
+		t.Error("expected release to return true")
+	}
+
+	// Verify the job was released
+	if lookup(shellRunner, id) != nil {
+		t.Error("job was not released")
+	}
+
+	// Verify that releasing a non-existent job returns an error
+	err = shellRunner.Release(id, &released)
+	if err == nil {
+		t.Error("expected an error when releasing a non-existent job, but got nil")
+	}
+}
+
+// TestReleaseAll contains unit tests for the ReleaseAll method.
+func TestReleaseAll(t *testing.T) {
+	shellRunner := setup(t)
+
+	// Create a mix of finished and running jobs
+	var finishedID1, finishedID2, runningID string
+	shellRunner.Background(BackgroundArgs{Command: "echo 'finished 1'"}, &finishedID1)
+	shellRunner.Background(BackgroundArgs{Command: "echo 'finished 2'"}, &finishedID2)
+	shellRunner.Background(BackgroundArgs{Command: "sleep 1"}, &runningID)
+
+	time.Sleep(100 * time.Millisecond) // Allow finished jobs to complete
+
+	var releasedCount int
+	err := shellRunner.ReleaseAll(struct{}{}, &releasedCount)
+	if err != nil {
+		t.Fatalf("ReleaseAll failed: %v", err)
+	}
+
+	if releasedCount != 2 {
+		t.Errorf("expected to release 2 jobs, but released %d", releasedCount)
+	}
+
+	// Verify that only the running job remains
+	if remaining := shellRunner.manager.List(); len(remaining) != 1 {
+		t.Errorf("expected 1 job to remain, but found %d", len(remaining))
+	}
+	if lookup(shellRunner, runningID) == nil {
+		t.Errorf("running job with id %s was released", runningID)
+	}
+}
+
+// TestList contains unit tests for the List method.
+func TestList(t *testing.T) {
+	shellRunner := setup(t)
+
+	// 1. Test with no jobs
+	var reply JobList
+	err := shellRunner.List(ListArgs{}, &reply)
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	if len(reply.Jobs) != 0 || reply.Total != 0 {
+		t.Errorf("expected 0 jobs, got %d", len(reply.Jobs))
+	}
+
+	// 2. Test with a few jobs
+	var id1, id2 string
+	shellRunner.Background(BackgroundArgs{Command: "sleep 1"}, &id1)
+	shellRunner.Background(BackgroundArgs{Command: "echo 'done'"}, &id2)
+	time.Sleep(100 * time.Millisecond) // Allow second job to finish
+
+	err = shellRunner.List(ListArgs{}, &reply)
+	if err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	if len(reply.Jobs) != 2 || reply.Total != 2 || reply.NextAfterID != "" {
+		t.Errorf("expected 2 jobs, got %d", len(reply.Jobs))
+	}
+
+	// Check if the returned IDs and statuses are correct
+	found1, found2 := false, false
+	for _, entry := range reply.Jobs {
+		if entry.ID == id1 {
+			found1 = true
+			if entry.Status != "running" {
+				t.Errorf("expected job %s to be running, got %s", id1, entry.Status)
+			}
+		}
+		if entry.ID == id2 {
+			found2 = true
+			if entry.Status != "exited" {
+				t.Errorf("expected job %s to be exited, got %s", id2, entry.Status)
+			}
+		}
+	}
+	if !found1 || !found2 {
+		t.Errorf("did not find all job IDs in list reply")
+	}
+
+	// 3. Test paging through the jobs in order of ID
+	for i := 0; i < 9; i++ {
+		var id string
+		shellRunner.Background(BackgroundArgs{Command: "true"}, &id)
+	}
+	var ids []string
+	args := ListArgs{Limit: 4}
+	for pages := 0; ; pages++ {
+		if err := shellRunner.List(args, &reply); err != nil {
+			t.Fatalf("list failed: %v", err)
+		}
+		if reply.Total != 11 || len(reply.Jobs) > 4 || pages > 3 {
+			t.Fatalf("expected pages of at most 4 of 11 jobs, got %+v", reply)
+		}
+		for _, entry := range reply.Jobs {
+			ids = append(ids, entry.ID)
+		}
+		if reply.NextAfterID == "" {
+			break
+		}
+		args.AfterID = reply.NextAfterID
+	}
+	if want := []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11"}; !slices.Equal(ids, want) {
+		t.Errorf("expected jobs %v, got %v", want, ids)
+	}
+	if err := shellRunner.List(ListArgs{Limit: -1}, &reply); err == nil || ParseError(err.Error()).Code != CodeInvalidArgument {
+		t.Errorf("expected INVALID_ARGUMENT for a negative limit, got %v", err)
+	}
+}
+
+// TestSince contains unit tests for the Since method.
+func TestSince(t *testing.T) {
+	shellRunner := setup(t)
+
+	var id string
+	// This command outputs "1", waits, then outputs "2".
+	shellRunner.Background(BackgroundArgs{Command: "echo 1; sleep 0.2; echo 2"}, &id)
+
+	time.Sleep(100 * time.Millisecond) // Wait for the first output
+
+	// First call should get "1"
+	var reply1 JobOutput
+	err := shellRunner.Since(id, &reply1)
+	if err != nil {
+		t.Fatalf("first since call failed: %v", err)
+	}
+	if reply1.Stdout != "1\n" {
+		t.Errorf("expected first stdout to be '1\\n', got %q", reply1.Stdout)
+	}
+	if reply1.Status != "" {
+		t.Error("did not expect status on first call for running job")
+	}
+
+	time.Sleep(200 * time.Millisecond) // Wait for the second output
+
+	// Second call should get "2" and the final status
+	var reply2 JobOutput
+	err = shellRunner.Since(id, &reply2)
+	if err != nil {
+		t.Fatalf("second since call failed: %v", err)
+	}
+	if reply2.Stdout != "2\n" {
+		t.Errorf("expected second stdout to be '2\\n', got %q", reply2.Stdout)
+	}
+	if reply2.Status != "exited" {
+		t.Errorf("expected status to be 'exited', got %v", reply2.Status)
+	}
+	if reply2.ExitCode == nil || *reply2.ExitCode != 0 {
+		t.Errorf("expected exit_code to be 0, got %v", reply2.ExitCode)
+	}
+
+	// Third call should get nothing but still report the status
+	var reply3 JobOutput
+	err = shellRunner.Since(id, &reply3)
+	if err != nil {
+		t.Fatalf("third since call failed: %v", err)
+	}
+	if reply3.Stdout != "" {
+		t.Errorf("expected third stdout to be empty, got %q", reply3.Stdout)
+	}
+	if reply3.Status != "exited" {
+		t.Errorf("expected status to be 'exited' on third call, got %v", reply3.Status)
+	}
+}
+
+// TestStatistics contains unit tests for the Statistics method.
+func TestStatistics(t *testing.T) {
+	shellRunner := setup(t)
+
+	// Run a few commands to generate some stats
+	shellRunner.Run(RunArgs{Command: "echo '12345'"}, &RunResult{})
+	shellRunner.Run(RunArgs{Command: "echo 'abc' >&2"}, &RunResult{})
+
+	var reply Stats
+	err := shellRunner.Statistics(struct{}{}, &reply)
+	if err != nil {
+		t.Fatalf("statistics failed: %v", err)
+	}
+
+	if reply.TotalCount != 2 {
+		t.Errorf("expected total_count to be 2, got %v", reply.TotalCount)
+	}
+	if reply.TotalStdoutBytes != 6 { // '12345\n'
+		t.Errorf("expected total_stdout_bytes to be 6, got %v", reply.TotalStdoutBytes)
+	}
+	if reply.TotalStderrBytes != 4 { // 'abc\n'
+		t.Errorf("expected total_stderr_bytes to be 4, got %v", reply.TotalStderrBytes)
+	}
+	if host := reply.Host; host == nil || host.CPUs < 1 || host.MemoryAvailableBytes == 0 || host.MemoryAvailableBytes > host.MemoryTotalBytes || host.SpoolDir != os.TempDir() || host.SpoolFreeBytes > host.SpoolTotalBytes || host.Load1 < 0 {
+		t.Errorf("expected the host's headroom to be reported, got %+v", host)
+	}
+}
+
+// TestArgv contains unit tests for executing an argv without a shell.
+func TestArgv(t *testing.T) {
+	shellRunner := setup(t)
+
+	t.Run("run", func(t *testing.T) {
+		var reply RunResult
+		err := shellRunner.Run(RunArgs{Argv: []string{"echo", "$HOME; ls"}}, &reply)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if reply.Stdout != "$HOME; ls\n" {
+			t.Errorf("expected arguments to be passed verbatim, got %q", reply.Stdout)
+		}
+	})
+
+	t.Run("background", func(t *testing.T) {
+		var id string
+		err := shellRunner.Background(BackgroundArgs{Argv: []string{"printf", "%s-%s", "a b", "c"}}, &id)
+		if err != nil {
+			t.Fatalf("background failed: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond) // allow command to finish
+
+		var status JobStatus
+		if err := shellRunner.Status(id, &status); err != nil {
+			t.Fatalf("status failed: %v", err)
+		}
+		if argv := status.Argv; len(argv) != 4 || argv[2] != "a b" {
+			t.Errorf("expected status to report the argv, got %v", status.Argv)
+		}
+
+		var output JobOutput
+		if err := shellRunner.Output(OutputArgs{ID: id}, &output); err != nil {
+			t.Fatalf("output failed: %v", err)
+		}
+		if output.Stdout != "a b-c" {
+			t.Errorf("expected stdout 'a b-c', got %q", output.Stdout)
+		}
+		if len(output.Argv) == 0 {
+			t.Error("expected output reply to have 'argv'")
+		}
+	})
+
+	t.Run("command and argv", func(t *testing.T) {
+		var reply RunResult
+		err := shellRunner.Run(RunArgs{Command: "true", Argv: []string{"true"}}, &reply)
+		if err == nil {
+			t.Error("expected an error when both command and argv are set")
+		}
+	})
+
+	t.Run("bare string params", func(t *testing.T) {
+		var args BackgroundArgs
+		if err := json.Unmarshal([]byte(`"echo legacy"`), &args); err != nil {
+			t.Fatalf("unmarshal failed: %v", err)
+		}
+		if args.Command != "echo legacy" {
+			t.Errorf("expected command 'echo legacy', got %q", args.Command)
+		}
+	})
+}
+
+// TestJobOptions contains unit tests for the job options Run and Background
+// share.
+func TestJobOptions(t *testing.T) {
+	shellRunner := setup(t)
+
+	t.Run("run", func(t *testing.T) {
+		dir := t.TempDir()
+		args := RunArgs{
+			Command: `printf '%s %s ' "$GREETING" "$PWD"; cat`,
+			Env:     map[string]string{"GREETING": "hello world"},
+			Dir:     dir,
+			Stdin:   "from stdin",
+		}
+		var reply RunResult
+		if err := shellRunner.Run(args, &reply); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if want := "hello world " + dir + " from stdin"; reply.Stdout != want {
+			t.Errorf("expected stdout %q, got %q", want, reply.Stdout)
+		}
+	})
+
+	t.Run("background", func(t *testing.T) {
+		args := BackgroundArgs{
+			Command: `echo "$GREETING"`,
+			Env:     map[string]string{"GREETING": "hi"},
+			Labels:  map[string]string{"team": "infra"},
+		}
+		var id string
+		if err := shellRunner.Background(args, &id); err != nil {
+			t.Fatalf("background failed: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		var status JobStatus
+		if err := shellRunner.Status(id, &status); err != nil {
+			t.Fatalf("status failed: %v", err)
+		}
+		if status.Labels["team"] != "infra" {
+			t.Errorf("expected status to report the labels, got %v", status.Labels)
+		}
+		var output JobOutput
+		if err := shellRunner.Output(OutputArgs{ID: id}, &output); err != nil {
+			t.Fatalf("output failed: %v", err)
+		}
+		if output.Stdout != "hi\n" {
+			t.Errorf("expected stdout 'hi', got %q", output.Stdout)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		var reply RunResult
+		start := time.Now()
+		if err := shellRunner.Run(RunArgs{Command: "sleep 5", Timeout: 0.1}, &reply); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("expected the command to be killed, took %v", elapsed)
+		}
+		if reply.LimitExceeded != "timeout" {
+			t.Errorf("expected limit_exceeded 'timeout', got %q", reply.LimitExceeded)
+		}
+
+		var id string
+		if err := shellRunner.Background(BackgroundArgs{Command: "sleep 5", Timeout: 0.1}, &id); err != nil {
+			t.Fatalf("background failed: %v", err)
+		}
+		time.Sleep(300 * time.Millisecond)
+		var status JobStatus
+		if err := shellRunner.Status(id, &status); err != nil {
+			t.Fatalf("status failed: %v", err)
+		}
+		if status.Status == "running" || status.LimitExceeded != "timeout" {
+			t.Errorf("expected the job to have timed out, got status %q, limit_exceeded %q", status.Status, status.LimitExceeded)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		var reply RunResult
+		if err := shellRunner.Run(RunArgs{Command: "true", Env: map[string]string{"A=B": "c"}}, &reply); err == nil {
+			t.Error("expected an error for an invalid environment variable name")
+		}
+		if err := shellRunner.Run(RunArgs{Command: "true", Hosts: []string{"web"}}, &reply); err == nil {
+			t.Error("expected an error for hosts with Run")
+		}
+		var id string
+		if err := shellRunner.Background(BackgroundArgs{Command: "true", CancelOnDisconnect: true}, &id); err == nil {
+			t.Error("expected an error for cancel on disconnect with Background")
+		}
+	})
+}
+
+func TestRerun(t *testing.T) {
+	shellRunner := setup(t)
+
+	var id string
+	args := BackgroundArgs{Command: `echo "$GREETING"`, Env: map[string]string{"GREETING": "again"}}
+	if err := shellRunner.Background(args, &id); err != nil {
+		t.Fatalf("background failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	var released bool
+	if err := shellRunner.Release(id, &released); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+
+	var rerunID string
+	if err := shellRunner.Rerun(id, &rerunID); err != nil {
+		t.Fatalf("expected a released job to be rerun, got %v", err)
+	}
+	if rerunID == id {
+		t.Fatalf("expected a new job ID, got %s again", id)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	var status JobStatus
+	if err := shellRunner.Status(rerunID, &status); err != nil {
+		t.Fatalf("status failed: %v", err)
+	}
+	if status.RerunOf != id {
+		t.Errorf("expected the new job to be a rerun of %s, got %q", id, status.RerunOf)
+	}
+	var output JobOutput
+	if err := shellRunner.Output(OutputArgs{ID: rerunID}, &output); err != nil {
+		t.Fatalf("output failed: %v", err)
+	}
+	if output.Stdout != "again\n" {
+		t.Errorf("expected the same command and environment, got stdout %q", output.Stdout)
+	}
+
+	if err := shellRunner.Rerun("999", &rerunID); err == nil || ParseError(err.Error()).Code != CodeJobNotFound {
+		t.Errorf("expected JOB_NOT_FOUND for an unknown job, got %v", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	shellRunner := setup(t)
+
+	var a, b, c string
+	commands := []struct {
+		command string
+		id      *string
+	}{
+		{`printf 'a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\n'; echo warning >&2`, &a},
+		{`printf 'a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\nn'`, &b},
+		{`printf 'a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\n'`, &c},
+	}
+	for _, command := range commands {
+		if err := shellRunner.Background(BackgroundArgs{Command: command.command}, command.id); err != nil {
+			t.Fatalf("background failed: %v", err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	t.Run("different", func(t *testing.T) {
+		var reply DiffResult
+		if err := shellRunner.Diff(DiffArgs{A: a, B: b}, &reply); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		want := "--- job " + a + " stdout\n+++ job " + b + " stdout\n" +
+			"@@ -1,5 +1,5 @@\n a\n-b\n+B\n c\n d\n e\n" +
+			"@@ -11,3 +11,4 @@\n k\n l\n m\n+n\n\\ No newline at end of file\n"
+		if reply.Stdout != want {
+			t.Errorf("expected diff\n%s\ngot\n%s", want, reply.Stdout)
+		}
+		if reply.Identical || reply.Stderr != "" {
+			t.Errorf("expected only a stdout diff, got %+v", reply)
+		}
+	})
+
+	t.Run("stderr", func(t *testing.T) {
+		var reply DiffResult
+		if err := shellRunner.Diff(DiffArgs{A: a, B: c}, &reply); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !reply.Identical || reply.Stdout != "" {
+			t.Errorf("expected the same stdout, got %+v", reply)
+		}
+		context := 0
+		if err := shellRunner.Diff(DiffArgs{A: a, B: c, Stderr: true, Context: &context}, &reply); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		want := "--- job " + a + " stderr\n+++ job " + c + " stderr\n@@ -1 +0,0 @@\n-warning\n"
+		if reply.Identical || reply.Stderr != want {
+			t.Errorf("expected stderr diff\n%s\ngot\n%s", want, reply.Stderr)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		var reply DiffResult
+		if err := shellRunner.Diff(DiffArgs{A: a, B: "999"}, &reply); err == nil || ParseError(err.Error()).Code != CodeJobNotFound {
+			t.Errorf("expected JOB_NOT_FOUND for an unknown job, got %v", err)
+		}
+		context := -1
+		if err := shellRunner.Diff(DiffArgs{A: a, B: b, Context: &context}, &reply); err == nil {
+			t.Error("expected an error for a negative context")
+		}
+	})
+}
+
+func TestSearch(t *testing.T) {
+	shellRunner := setup(t)
+
+	var deploy, build string
+	if err := shellRunner.Background(BackgroundArgs{Command: "echo start; echo 'error: disk full'; echo done"}, &deploy); err != nil {
+		t.Fatalf("background failed: %v", err)
+	}
+	if err := shellRunner.Background(BackgroundArgs{Command: "echo ok; echo 'error: timeout' >&2"}, &build); err != nil {
+		t.Fatalf("background failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	t.Run("all jobs", func(t *testing.T) {
+		var reply SearchResult
+		if err := shellRunner.Search(SearchArgs{Pattern: "^error", Context: 1}, &reply); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(reply.Matches) != 2 {
+			t.Fatalf("expected 2 matches, got %+v", reply.Matches)
+		}
+		first, second := reply.Matches[0], reply.Matches[1]
+		if first.JobID != deploy || first.Stream != "stdout" || first.Line != 2 || first.Text != "error: disk full" {
+			t.Errorf("unexpected first match %+v", first)
+		}
+		if len(first.Before) != 1 || first.Before[0] != "start" || len(first.After) != 1 || first.After[0] != "done" {
+			t.Errorf("expected a line of context around the first match, got %+v", first)
+		}
+		if second.JobID != build || second.Stream != "stderr" || second.Line != 1 {
+			t.Errorf("unexpected second match %+v", second)
+		}
+	})
+
+	t.Run("filters", func(t *testing.T) {
+		var reply SearchResult
+		if err := shellRunner.Search(SearchArgs{Pattern: "error", Stream: "stderr"}, &reply); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(reply.Matches) != 1 || reply.Matches[0].JobID != build {
+			t.Errorf("expected only the stderr match, got %+v", reply.Matches)
+		}
+		if err := shellRunner.Search(SearchArgs{Pattern: "error", IDs: []string{deploy}, Limit: 1}, &reply); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(reply.Matches) != 1 || reply.Matches[0].JobID != deploy || reply.Truncated {
+			t.Errorf("expected only the match of job %s, got %+v", deploy, reply)
+		}
+		if err := shellRunner.Search(SearchArgs{Pattern: "o", Limit: 2}, &reply); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(reply.Matches) != 2 || !reply.Truncated {
+			t.Errorf("expected 2 matches and truncated, got %+v", reply)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		var reply SearchResult
+		if err := shellRunner.Search(SearchArgs{Pattern: "("}, &reply); err == nil || ParseError(err.Error()).Code != CodeInvalidArgument {
+			t.Errorf("expected INVALID_ARGUMENT for a bad pattern, got %v", err)
+		}
+		if err := shellRunner.Search(SearchArgs{Pattern: "x", IDs: []string{"999"}}, &reply); err == nil || ParseError(err.Error()).Code != CodeJobNotFound {
+			t.Errorf("expected JOB_NOT_FOUND for an unknown job, got %v", err)
+		}
+	})
+}
+
+func TestExportImport(t *testing.T) {
+	source, target := setup(t), setup(t)
+
+	var finished, running, rerun string
+	if err := source.Background(BackgroundArgs{Command: "echo out; echo err >&2; exit 3", Labels: map[string]string{"env": "prod"}}, &finished); err != nil {
+		t.Fatalf("background failed: %v", err)
+	}
+	if err := source.Background(BackgroundArgs{Command: "echo partial; sleep 5"}, &running); err != nil {
+		t.Fatalf("background failed: %v", err)
+	}
+	defer source.Kill(KillArgs{ID: running}, new(bool))
+	time.Sleep(100 * time.Millisecond)
+	if err := source.Rerun(finished, &rerun); err != nil {
+		t.Fatalf("rerun failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	var archive Archive
+	if err := source.Export(struct{}{}, &archive); err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+	if len(archive.Jobs) != 3 || archive.Jobs[0].ID != finished || archive.Version != ArchiveVersion {
+		t.Fatalf("expected an archive of 3 jobs in order of ID, got %+v", archive)
+	}
+	// The archive must survive being written out and read back.
+	data, err := json.Marshal(archive)
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	archive = Archive{}
+	if err := json.Unmarshal(data, &archive); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+
+	// The target already has a job, so the imported jobs get new IDs.
+	var existing string
+	if err := target.Background(BackgroundArgs{Command: "true"}, &existing); err != nil {
+		t.Fatalf("background failed: %v", err)
+	}
+	var result ImportResult
+	if err := target.Import(archive, &result); err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	if len(result.IDs) != 3 || result.IDs[finished] == existing {
+		t.Fatalf("expected new IDs for 3 jobs, got %v", result.IDs)
+	}
+
+	var status JobStatus
+	if err := target.Status(result.IDs[finished], &status); err != nil {
+		t.Fatalf("status failed: %v", err)
+	}
+	if status.Status != "exited" || *status.ExitCode != 3 || status.Labels["env"] != "prod" || status.ImportedFrom != finished {
+		t.Errorf("expected the finished job to be imported as it was, got %+v", status)
+	}
+	var output JobOutput
+	if err := target.Output(OutputArgs{ID: result.IDs[finished]}, &output); err != nil {
+		t.Fatalf("output failed: %v", err)
+	}
+	if output.Stdout != "out\n" || output.Stderr != "err\n" {
+		t.Errorf("expected the imported output, got %+v", output)
+	}
+	if err := target.Status(result.IDs[running], &status); err != nil {
+		t.Fatalf("status failed: %v", err)
+	}
+	if status.Status != "errored" {
+		t.Errorf("expected a job running at export to be imported as errored, got %q", status.Status)
+	}
+	if err := target.Status(result.IDs[rerun], &status); err != nil {
+		t.Fatalf("status failed: %v", err)
+	}
+	if status.RerunOf != result.IDs[finished] {
+		t.Errorf("expected the rerun to link to the imported job %s, got %q", result.IDs[finished], status.RerunOf)
+	}
+
+	if err := target.Import(Archive{Version: 99}, &result); err == nil {
+		t.Error("expected an error for an unsupported archive version")
+	}
+}
+
+func TestSecrets(t *testing.T) {
+	shellRunner := setup(t)
+
+	var ok bool
+	if err := shellRunner.SetSecret(SecretArgs{Name: "token", Value: "hunter2"}, &ok); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var list []runner.SecretInfo
+	if err := shellRunner.ListSecrets(struct{}{}, &list); err != nil || len(list) != 1 || list[0].Name != "token" {
+		t.Fatalf("expected the secret to be listed, got %v, %v", list, err)
+	}
+
+	args := RunArgs{Command: `test "$TOKEN" = hunter2 && echo "token $TOKEN"`, Secrets: map[string]string{"TOKEN": "token"}}
+	var reply RunResult
+	if err := shellRunner.Run(args, &reply); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if reply.ExitCode != 0 || reply.Stdout != "token [REDACTED]\n" {
+		t.Errorf("expected the secret in the environment and redacted from the output, got %+v", reply)
+	}
+
+	args.Secrets = map[string]string{"TOKEN": "missing"}
+	if err := shellRunner.Run(args, &reply); err == nil || ParseError(err.Error()).Code != CodeInvalidArgument {
+		t.Errorf("expected INVALID_ARGUMENT for an unknown secret, got %v", err)
+	}
+	if err := shellRunner.DeleteSecret("token", &ok); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := shellRunner.DeleteSecret("token", &ok); err == nil || ParseError(err.Error()).Code != CodeSecretNotFound {
+		t.Errorf("expected SECRET_NOT_FOUND, got %v", err)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	shellRunner := setup(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "input.txt")
+	if err := shellRunner.PutFile(PutFileArgs{Path: path, Data: []byte("x")}, new(int64)); Code(err) != CodePolicyDenied {
+		t.Errorf("expected POLICY_DENIED outside the file directories, got %v", err)
+	}
+	config := runner.DefaultConfig()
+	if err := config.SetFileDirs(dir); err != nil {
+		t.Fatal(err)
+	}
+	shellRunner = setupWith(t, config)
+
+	var size int64
+	for i, chunk := range []string{"hello ", "world\n"} {
+		args := PutFileArgs{Path: path, Data: []byte(chunk), Offset: size, Mode: 0o600}
+		if err := shellRunner.PutFile(args, &size); err != nil {
+			t.Fatalf("chunk %d: expected no error, got %v", i, err)
+		}
+	}
+	if size != 12 {
+		t.Errorf("expected a file of 12 bytes, got %d", size)
+	}
+
+	var chunk FileChunk
+	if err := shellRunner.GetFile(GetFileArgs{Path: path, Offset: 6, Length: 3}, &chunk); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if string(chunk.Data) != "wor" || chunk.Size != 12 || chunk.EOF || chunk.Mode != 0o600 {
+		t.Errorf("expected the middle of the file, got %+v", chunk)
+	}
+	if err := shellRunner.GetFile(GetFileArgs{Path: path, Offset: 9}, &chunk); err != nil || string(chunk.Data) != "ld\n" || !chunk.EOF {
+		t.Errorf("expected the end of the file, got %+v, %v", chunk, err)
+	}
+
+	// A job can use the uploaded file.
+	var reply RunResult
+	if err := shellRunner.Run(RunArgs{Command: "cat " + path}, &reply); err != nil || reply.Stdout != "hello world\n" {
+		t.Errorf("expected the job to read the file, got %+v, %v", reply, err)
+	}
+
+	for name, err := range map[string]error{
+		"relative path":   shellRunner.PutFile(PutFileArgs{Path: "input.txt"}, &size),
+		"offset past end": shellRunner.PutFile(PutFileArgs{Path: path, Data: []byte("x"), Offset: 20}, &size),
+		"missing file":    shellRunner.GetFile(GetFileArgs{Path: path + ".missing"}, &chunk),
+		"missing dir":     shellRunner.PutFile(PutFileArgs{Path: filepath.Join(dir, "missing", "input.txt")}, &size),
+		"directory":       shellRunner.GetFile(GetFileArgs{Path: filepath.Dir(path)}, &chunk),
+		"negative offset": shellRunner.GetFile(GetFileArgs{Path: path, Offset: -1}, &chunk),
+		"oversized chunk": shellRunner.PutFile(PutFileArgs{Path: path, Data: make([]byte, MaxFileChunk+1)}, &size),
+	} {
+		if err == nil || ParseError(err.Error()).Code != CodeInvalidArgument {
+			t.Errorf("%s: expected INVALID_ARGUMENT, got %v", name, err)
+		}
+	}
+
+	// Links out of the file directories are followed before checking.
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("/etc/passwd", link); err != nil {
+		t.Fatal(err)
+	}
+	if err := shellRunner.GetFile(GetFileArgs{Path: link}, &chunk); Code(err) != CodePolicyDenied {
+		t.Errorf("expected POLICY_DENIED for a link out of the file directories, got %v", err)
+	}
+}
+
+func TestWorkspace(t *testing.T) {
+	shellRunner := setup(t)
+
+	args := RunArgs{Command: `test "$PWD" = "$SHELLRUNNER_WORKDIR" && mkdir out && echo result > out/result.txt`, Workspace: true, Keep: true}
+	var reply RunResult
+	if err := shellRunner.Run(args, &reply); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	id := reply.JobID
+	var status JobStatus
+	if err := shellRunner.Status(id, &status); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if reply.ExitCode != 0 || status.Workspace == "" || reply.Workspace != status.Workspace {
+		t.Fatalf("expected the job to run in its workspace, got %+v, %+v", reply, status)
+	}
+
+	var artifacts []runner.Artifact
+	if err := shellRunner.Artifacts(id, &artifacts); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(artifacts) != 1 || artifacts[0].Name != "out/result.txt" || artifacts[0].Size != 7 {
+		t.Fatalf("expected the job's file to be listed, got %+v", artifacts)
+	}
+	var chunk FileChunk
+	if err := shellRunner.GetFile(GetFileArgs{Path: artifacts[0].Path}, &chunk); err != nil || string(chunk.Data) != "result\n" {
+		t.Errorf("expected to fetch the artifact, got %q, %v", chunk.Data, err)
+	}
+
+	var ok bool
+	if err := shellRunner.Release(id, &ok); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := os.Stat(status.Workspace); !os.IsNotExist(err) {
+		t.Errorf("expected the workspace to be removed on release, got %v", err)
+	}
+
+	// A kept workspace outlives the job, even one that is not kept.
+	if err := shellRunner.Run(RunArgs{Command: "touch kept", Workspace: true, KeepWorkspace: true}, &reply); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if reply.Workspace == "" {
+		t.Fatalf("expected the kept workspace in the result, got %+v", reply)
+	}
+	defer os.RemoveAll(reply.Workspace)
+	if _, err := os.Stat(filepath.Join(reply.Workspace, "kept")); err != nil {
+		t.Errorf("expected the workspace to be kept, got %v", err)
+	}
+	if err := shellRunner.Run(RunArgs{Command: "true", Workspace: true}, &reply); err != nil || reply.Workspace != "" {
+		t.Errorf("expected the workspace of a job that is not kept to be removed, got %+v, %v", reply, err)
+	}
+
+	if err := shellRunner.Run(RunArgs{Command: "true", Workspace: true, Dir: "/"}, &reply); err == nil || ParseError(err.Error()).Code != CodeInvalidArgument {
+		t.Errorf("expected INVALID_ARGUMENT for both dir and workspace, got %v", err)
+	}
+	if err := shellRunner.Run(RunArgs{Command: "true", Keep: true}, &reply); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := shellRunner.Artifacts(reply.JobID, &artifacts); err == nil || ParseError(err.Error()).Code != CodeInvalidArgument {
+		t.Errorf("expected INVALID_ARGUMENT for a job without a workspace, got %v", err)
+	}
+}
+
+func TestArtifacts(t *testing.T) {
+	shellRunner := setup(t)
+
+	args := BackgroundArgs{
+		Command:   "mkdir -p dist/sub && echo tar > dist/app.tar.gz && echo sub > dist/sub/notes && echo '<testsuite/>' > junit.xml && echo log > build.log",
+		Workspace: true,
+		Artifacts: []string{"dist", "junit.xml", "*.xml", "missing/*"},
+	}
+	var id string
+	if err := shellRunner.Background(args, &id); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var artifacts []runner.Artifact
+	for start := time.Now(); len(artifacts) == 0 && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		if err := shellRunner.Artifacts(id, &artifacts); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+
+	var names []string
+	for _, artifact := range artifacts {
+		names = append(names, artifact.Name)
+	}
+	if strings.Join(names, " ") != "dist/app.tar.gz dist/sub/notes junit.xml" {
+		t.Fatalf("expected the matching files, each once, got %q", names)
+	}
+	workspace := lookup(shellRunner, id).Workspace
+	if strings.HasPrefix(artifacts[0].Path, workspace) {
+		t.Errorf("expected the artifacts to be copied out of the workspace, got %s", artifacts[0].Path)
+	}
+	var chunk FileChunk
+	if err := shellRunner.GetFile(GetFileArgs{Path: artifacts[2].Path}, &chunk); err != nil || string(chunk.Data) != "<testsuite/>\n" {
+		t.Errorf("expected to fetch the artifact, got %q, %v", chunk.Data, err)
+	}
+
+	// Another tenant can reach neither the artifacts nor the workspace.
+	other := shellRunner.server.receiver(shellRunner.server.ctx, "2000")
+	if err := other.GetFile(GetFileArgs{Path: artifacts[2].Path}, &chunk); Code(err) != CodePolicyDenied {
+		t.Errorf("expected another tenant's GetFile of the artifact to be denied, got %v", err)
+	}
+	var size int64
+	if err := other.PutFile(PutFileArgs{Path: filepath.Join(workspace, "build.log"), Data: []byte("x")}, &size); Code(err) != CodePolicyDenied {
+		t.Errorf("expected another tenant's PutFile in the workspace to be denied, got %v", err)
+	}
+
+	var ok bool
+	if err := shellRunner.Release(id, &ok); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := os.Stat(artifacts[0].Path); !os.IsNotExist(err) {
+		t.Errorf("expected the artifacts to be removed on release, got %v", err)
+	}
+
+	var reply RunResult
+	for name, args := range map[string]RunArgs{
+		"not kept":         {Command: "true", Artifacts: []string{"*.xml"}},
+		"absolute pattern": {Command: "true", Artifacts: []string{"/etc/*"}, Keep: true},
+		"bad pattern":      {Command: "true", Artifacts: []string{"["}, Keep: true},
+	} {
+		if err := shellRunner.Run(args, &reply); err == nil || ParseError(err.Error()).Code != CodeInvalidArgument {
+			t.Errorf("%s: expected INVALID_ARGUMENT, got %v", name, err)
+		}
+	}
+
+	// Without a workspace, patterns are relative to the job's directory.
+	dir := t.TempDir()
+	if err := shellRunner.Run(RunArgs{Command: "echo out > out.txt", Dir: dir, Artifacts: []string{"*.txt"}, Keep: true}, &reply); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(reply.Artifacts) != 1 || reply.Artifacts[0].Name != "out.txt" || reply.Artifacts[0].Size != 4 {
+		t.Errorf("expected the artifact in the result, got %+v", reply.Artifacts)
+	}
+	if err := shellRunner.Release(reply.JobID, &ok); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	shellRunner := setup(t)
+
+	command := `printf 'step 1\nwarning: slow\nstep 2\n'; echo 'error: code 7' >&2`
+	args := RunArgs{Command: command, Keep: true, Filter: &runner.OutputFilter{Exclude: []string{"^warning"}, Extract: `(\d+)$`}}
+	var reply RunResult
+	if err := shellRunner.Run(args, &reply); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if reply.Stdout != "1\n2\n" || reply.Stderr != "7\n" {
+		t.Errorf("expected the job's output filtered, got %q, %q", reply.Stdout, reply.Stderr)
+	}
+
+	args.Filter = nil
+	if err := shellRunner.Run(args, &reply); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var output JobOutput
+	outputArgs := OutputArgs{ID: reply.JobID, Filter: &runner.OutputFilter{Include: []string{"step", "error"}}}
+	if err := shellRunner.Output(outputArgs, &output); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if output.Stdout != "step 1\nstep 2\n" || output.Stderr != "error: code 7\n" {
+		t.Errorf("expected the returned output filtered, got %q, %q", output.Stdout, output.Stderr)
+	}
+	if err := shellRunner.Output(OutputArgs{ID: reply.JobID}, &output); err != nil || output.Stdout != "step 1\nwarning: slow\nstep 2\n" {
+		t.Errorf("expected the job's output left as it is, got %q, %v", output.Stdout, err)
+	}
+
+	outputArgs.Filter = &runner.OutputFilter{Extract: "("}
+	if err := shellRunner.Output(outputArgs, &output); err == nil || ParseError(err.Error()).Code != CodeInvalidArgument {
+		t.Errorf("expected INVALID_ARGUMENT for an invalid pattern, got %v", err)
+	}
+	args.Filter = &runner.OutputFilter{StripANSI: true}
+	args.Pty = true
+	if err := shellRunner.Run(args, &reply); err == nil || ParseError(err.Error()).Code != CodeInvalidArgument {
+		t.Errorf("expected INVALID_ARGUMENT for a filter on a terminal, got %v", err)
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	shellRunner := setup(t)
+
+	command := `printf 'bin\000\377\n'; printf 'warn\n' >&2`
+	var reply RunResult
+	if err := shellRunner.Run(RunArgs{Command: command, Encoding: EncodingAuto, Keep: true}, &reply); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	stdout, stderr, err := reply.Decode()
+	if err != nil || reply.Encoding != EncodingBase64 || !reply.IsBinary || string(stdout) != "bin\x00\xff\n" || string(stderr) != "warn\n" {
+		t.Errorf("expected binary output base64-encoded, got %+v: %q, %q, %v", reply, stdout, stderr, err)
+	}
+
+	var output JobOutput
+	if err := shellRunner.Output(OutputArgs{ID: reply.JobID}, &output); err != nil || output.Encoding != "" || !output.IsBinary {
+		t.Errorf("expected text output flagged as binary, got %+v, %v", output, err)
+	}
+	if err := shellRunner.Output(OutputArgs{ID: reply.JobID, Encoding: EncodingBase64}, &output); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if stdout, _, err := output.Decode(); err != nil || string(stdout) != "bin\x00\xff\n" {
+		t.Errorf("expected the output to decode, got %q, %v", stdout, err)
+	}
+
+	// Text is left as it is, unless base64 is asked for.
+	if err := shellRunner.Run(RunArgs{Command: "echo text", Encoding: EncodingAuto}, &reply); err != nil || reply.Stdout != "text\n" || reply.Encoding != "" || reply.IsBinary {
+		t.Errorf("expected text output as it is, got %+v, %v", reply, err)
+	}
+	if err := shellRunner.Run(RunArgs{Command: "echo text", Encoding: EncodingBase64}, &reply); err != nil || reply.Stdout != "dGV4dAo=" || reply.Encoding != EncodingBase64 {
+		t.Errorf("expected text output base64-encoded, got %+v, %v", reply, err)
+	}
+	if err := shellRunner.Run(RunArgs{Command: "true", Encoding: "hex"}, &reply); err == nil || ParseError(err.Error()).Code != CodeInvalidArgument {
+		t.Errorf("expected INVALID_ARGUMENT for an unknown encoding, got %v", err)
+	}
+}
+
+func TestSuccess(t *testing.T) {
+	shellRunner := setup(t)
+
+	for _, tc := range []struct {
+		command string
+		success *SuccessOptions
+		result  string
+		reason  string
+	}{
+		{"true", nil, runner.ResultSuccess, ""},
+		{"exit 1", nil, runner.ResultFailure, "exit code 1"},
+		{"echo done; exit 1", &SuccessOptions{ExitCodes: []int{0, 1}}, runner.ResultSuccess, ""},
+		{"echo partial", &SuccessOptions{Require: []string{"^done"}}, runner.ResultFailure, `output does not match "^done"`},
+		{"echo 'ERROR: disk full' >&2", &SuccessOptions{Forbid: []string{"ERROR"}}, runner.ResultFailure, `output matches "ERROR"`},
+		{"true", &SuccessOptions{MinRuntime: 10}, runner.ResultFailure, "less than the minimum of 10s"},
+		{"sleep 0.1", &SuccessOptions{MinRuntime: 0.05}, runner.ResultSuccess, ""},
+	} {
+		var reply RunResult
+		if err := shellRunner.Run(RunArgs{Command: tc.command, Success: tc.success}, &reply); err != nil {
+			t.Fatalf("%s: expected no error, got %v", tc.command, err)
+		}
+		if reply.Result != tc.result || !strings.Contains(reply.FailureReason, tc.reason) || tc.reason == "" && reply.FailureReason != "" {
+			t.Errorf("%s: expected %s (%s), got %s (%s)", tc.command, tc.result, tc.reason, reply.Result, reply.FailureReason)
+		}
+	}
+
+	var id string
+	if err := shellRunner.Background(BackgroundArgs{Command: "exit 3", Success: &SuccessOptions{ExitCodes: []int{3}}}, &id); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var status JobStatus
+	for start := time.Now(); (status.Status == "" || !status.Finished()) && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		if err := shellRunner.Status(id, &status); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if status.Result != runner.ResultSuccess {
+		t.Errorf("expected the background job to succeed, got %+v", status)
+	}
+
+	var stats Stats
+	if err := shellRunner.Statistics(struct{}{}, &stats); err != nil || stats.SuccessCount != 4 || stats.FailureCount != 4 {
+		t.Errorf("expected 4 successes and 4 failures, got %+v, %v", stats, err)
+	}
+
+	var reply RunResult
+	if err := shellRunner.Run(RunArgs{Command: "true", Success: &SuccessOptions{Require: []string{"("}}}, &reply); err == nil || ParseError(err.Error()).Code != CodeInvalidArgument {
+		t.Errorf("expected INVALID_ARGUMENT for an invalid pattern, got %v", err)
+	}
+}
+
+func TestTermination(t *testing.T) {
+	shellRunner := setup(t)
+
+	for _, tc := range []struct {
+		args     RunArgs
+		signal   string
+		killedBy string
+	}{
+		{RunArgs{Command: "exit 1"}, "", ""},
+		{RunArgs{Command: "kill -SEGV $$"}, "SEGV", ""},
+		{RunArgs{Command: "sleep 10", Timeout: 0.1}, "KILL", runner.KilledByTimeout},
+	} {
+		var reply RunResult
+		if err := shellRunner.Run(tc.args, &reply); err != nil {
+			t.Fatalf("%s: expected no error, got %v", tc.args.Command, err)
+		}
+		if reply.Signal != tc.signal || reply.KilledBy != tc.killedBy {
+			t.Errorf("%s: expected signal %q killed by %q, got %q killed by %q", tc.args.Command, tc.signal, tc.killedBy, reply.Signal, reply.KilledBy)
+		}
+	}
+
+	var id string
+	if err := shellRunner.Background(BackgroundArgs{Command: "sleep 10"}, &id); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var killed bool
+	if err := shellRunner.Kill(KillArgs{ID: id, Signal: "TERM"}, &killed); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var status JobStatus
+	for start := time.Now(); (status.Status == "" || !status.Finished()) && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		if err := shellRunner.Status(id, &status); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if status.Signal != "TERM" || status.KilledBy != runner.KilledByOperator || status.CoreDumped {
+		t.Errorf("expected the job to be killed by the operator with TERM, got %+v", status)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	shellRunner := setup(t)
+	if err := runner.EnableSubreaper(); err != nil {
+		t.Skipf("cannot become a subreaper: %v", err)
+	}
+
+	var info ServerInfo
+	if err := shellRunner.Info(struct{}{}, &info); err != nil || info.PID != os.Getpid() || !info.Subreaper {
+		t.Fatalf("expected the test process as a subreaper, got %+v, %v", info, err)
+	}
+	reaped := info.ReapedStrays
+
+	// The subshell exits at once, leaving sleep behind to be adopted.
+	var reply RunResult
+	if err := shellRunner.Run(RunArgs{Command: "(sleep 0.3 >/dev/null 2>&1 &)"}, &reply); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := shellRunner.Info(struct{}{}, &info); err != nil || info.RunningStrays < 1 {
+		t.Errorf("expected a running stray, got %+v, %v", info, err)
+	}
+	for start := time.Now(); info.ReapedStrays == reaped && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		if err := shellRunner.Info(struct{}{}, &info); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if info.ReapedStrays != reaped+1 || info.RunningStrays != 0 {
+		t.Errorf("expected the stray to be reaped, got %+v", info)
+	}
+}
+
+func TestLogFile(t *testing.T) {
+	dir := t.TempDir()
+	config := runner.DefaultConfig()
+	if err := config.SetLogDirs(dir); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	shellRunner := setupWith(t, config)
+	logFile := filepath.Join(dir, "job.log")
+
+	var reply RunResult
+	if err := shellRunner.Run(RunArgs{Command: "echo out; sleep 0.1; echo err >&2", LogFile: logFile}, &reply); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if reply.Stdout != "out\n" || reply.Stderr != "err\n" {
+		t.Errorf("expected the output to be captured too, got %+v", reply)
+	}
+	if err := shellRunner.Run(RunArgs{Command: "echo only", LogFile: logFile, LogOnly: true}, &reply); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if reply.Stdout != "" {
+		t.Errorf("expected no output to be captured, got %q", reply.Stdout)
+	}
+	if data, err := os.ReadFile(logFile); err != nil || string(data) != "out\nerr\nonly\n" {
+		t.Errorf("expected the log file to hold both jobs' output, got %q, %v", data, err)
+	}
+
+	var id string
+	if err := shellRunner.Background(BackgroundArgs{Command: "echo background", LogFile: logFile}, &id); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var status JobStatus
+	for start := time.Now(); (status.Status == "" || !status.Finished()) && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		if err := shellRunner.Status(id, &status); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if status.LogFile != logFile {
+		t.Errorf("expected the status to report the log file, got %q", status.LogFile)
+	}
+	var released bool
+	if err := shellRunner.Release(id, &released); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if data, err := os.ReadFile(logFile); err != nil || !strings.HasSuffix(string(data), "background\n") {
+		t.Errorf("expected the log file to outlive the job, got %q, %v", data, err)
+	}
+
+	for _, tc := range []struct {
+		args RunArgs
+		code ErrorCode
+	}{
+		{RunArgs{Command: "true", LogFile: filepath.Join(t.TempDir(), "job.log")}, CodePolicyDenied},
+		{RunArgs{Command: "true", LogFile: "job.log"}, CodeInvalidArgument},
+		{RunArgs{Command: "true", LogOnly: true}, CodeInvalidArgument},
+	} {
+		if err := shellRunner.Run(tc.args, &reply); err == nil || ParseError(err.Error()).Code != tc.code {
+			t.Errorf("%+v: expected %s, got %v", tc.args, tc.code, err)
+		}
+	}
+}
+
+// TestLogSink checks that jobs' output lines reach file, TCP and webhook
+// sinks, and that sinks on hosts that are not allowed are refused.
+func TestLogSink(t *testing.T) {
+	dir := t.TempDir()
+	config := runner.DefaultConfig()
+	if err := config.SetLogDirs(dir); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+	}()
+	posted := make(chan []map[string]string, 1)
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("expected the webhook's redirect out of the allowed hosts not to be followed")
+	}))
+	defer elsewhere.Close()
+	redirected := make(chan bool, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			redirected <- true
+			http.Redirect(w, r, elsewhere.URL, http.StatusTemporaryRedirect)
+			return
+		}
+		var lines []map[string]string
+		json.NewDecoder(r.Body).Decode(&lines)
+		posted <- lines
+	}))
+	defer webhook.Close()
+	if err := config.SetLogSinkHosts(listener.Addr().String() + "," + strings.TrimPrefix(webhook.URL, "http://")); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	shellRunner := setupWith(t, config)
+
+	sinkFile := filepath.Join(dir, "sink.jsonl")
+	var id string
+	if err := shellRunner.Background(BackgroundArgs{Command: "echo one; echo two >&2; printf three", LogSink: "file:" + sinkFile}, &id); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var status JobStatus
+	for start := time.Now(); (status.Status == "" || !status.Finished()) && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		if err := shellRunner.Status(id, &status); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if status.LogSink != "file:"+sinkFile {
+		t.Errorf("expected the status to report the log sink, got %q", status.LogSink)
+	}
+	want := []string{"stdout one", "stderr two", "stdout three"}
+	var got []string
+	for start := time.Now(); len(got) < len(want) && time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		data, _ := os.ReadFile(sinkFile)
+		got = nil
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var record map[string]string
+			if json.Unmarshal([]byte(line), &record) == nil {
+				if record["job_id"] != id {
+					t.Errorf("expected lines of job %s, got %q", id, line)
+				}
+				got = append(got, record["stream"]+" "+record["line"])
+			}
+		}
+	}
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("expected the file sink to get %q, got %q", want, got)
+	}
+
+	var reply RunResult
+	if err := shellRunner.Run(RunArgs{Command: "echo tcp", LogSink: "tcp://" + listener.Addr().String()}, &reply); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if reply.Stdout != "tcp\n" {
+		t.Errorf("expected the output to be captured too, got %q", reply.Stdout)
+	}
+	select {
+	case data := <-received:
+		if !strings.Contains(data, `"stream":"stdout","line":"tcp"`) {
+			t.Errorf("expected the TCP sink to get the line, got %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected the TCP sink to get the line")
+	}
+
+	if err := shellRunner.Run(RunArgs{Command: "echo hook", LogSink: webhook.URL + "/logs"}, &reply); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	select {
+	case lines := <-posted:
+		if len(lines) != 1 || lines[0]["line"] != "hook" {
+			t.Errorf("expected the webhook to get the line, got %v", lines)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected the webhook to get the line")
+	}
+	if err := shellRunner.Run(RunArgs{Command: "echo secret", LogSink: webhook.URL + "/redirect"}, &reply); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	select {
+	case <-redirected:
+		time.Sleep(100 * time.Millisecond)
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected the webhook to be posted to")
+	}
+
+	for _, tc := range []struct {
+		args RunArgs
+		code ErrorCode
+	}{
+		{RunArgs{Command: "true", LogSink: "tcp://192.0.2.1:514"}, CodePolicyDenied},
+		{RunArgs{Command: "true", LogSink: "file:" + filepath.Join(t.TempDir(), "sink")}, CodePolicyDenied},
+		{RunArgs{Command: "true", LogSink: "ftp://" + listener.Addr().String()}, CodeInvalidArgument},
+		{RunArgs{Command: "true", LogSink: "elsewhere"}, CodeInvalidArgument},
+	} {
+		if err := shellRunner.Run(tc.args, &reply); err == nil || ParseError(err.Error()).Code != tc.code {
+			t.Errorf("%+v: expected %s, got %v", tc.args, tc.code, err)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	shellRunner := setup(t)
+
+	var id string
+	if err := shellRunner.Background(BackgroundArgs{Command: "yes 'all tests passed' | head -n 50000"}, &id); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var status JobStatus
+	for start := time.Now(); (status.Status == "" || !status.Finished()) && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		if err := shellRunner.Status(id, &status); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if job := lookup(shellRunner, id); !job.Stdout.Compressed() {
+		t.Errorf("expected the finished job's stdout to be compressed")
+	}
+	var output JobOutput
+	if err := shellRunner.Output(OutputArgs{ID: id}, &output); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if output.Stdout != strings.Repeat("all tests passed\n", 50000) {
+		t.Errorf("expected the whole output back, got %d bytes", len(output.Stdout))
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	config := runner.DefaultConfig()
+	config.MaxBufferedBytes = 1000
+	shellRunner := setupWith(t, config)
+
+	var reply RunResult
+	if err := shellRunner.Run(RunArgs{Command: "printf '%2000s' x"}, &reply); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var stats Stats
+	if err := shellRunner.Statistics(struct{}{}, &stats); err != nil || stats.BufferedBytes != 0 || stats.MaxBufferedBytes != 1000 {
+		t.Errorf("expected no output held once Run returns, got %+v, %v", stats, err)
+	}
+
+	if err := shellRunner.Run(RunArgs{Command: "printf '%2000s' x", Keep: true}, &reply); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := shellRunner.Statistics(struct{}{}, &stats); err != nil || stats.BufferedBytes != 2000 {
+		t.Errorf("expected the kept job's output to be held, got %+v, %v", stats, err)
+	}
+	var id string
+	if err := shellRunner.Background(BackgroundArgs{Command: "true"}, &id); err == nil || ParseError(err.Error()).Code != CodeOverloaded {
+		t.Errorf("expected OVERLOADED over the limit, got %v", err)
+	}
+
+	var released bool
+	if err := shellRunner.Release(reply.JobID, &released); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := shellRunner.Background(BackgroundArgs{Command: "true"}, &id); err != nil {
+		t.Errorf("expected jobs to be accepted once the output was released, got %v", err)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	shellRunner := setup(t)
+
+	var id string
+	if err := shellRunner.Background(BackgroundArgs{Command: "sleep 0.1"}, &id); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var status JobStatus
+	if err := shellRunner.Status(id, &status); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if status.EndedAt != nil || status.SubmittedAt.IsZero() || status.StartedAt.Before(status.SubmittedAt) || status.QueuedDurationSeconds < 0 {
+		t.Errorf("expected a running job to be submitted and started but not ended, got %+v", status)
+	}
+	for start := time.Now(); !status.Finished() && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		if err := shellRunner.Status(id, &status); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	if status.EndedAt == nil || status.EndedAt.Sub(status.StartedAt).Seconds() != status.RunDurationSeconds || status.RunDurationSeconds < 0.1 {
+		t.Errorf("expected the job to have ended after running for its duration, got %+v", status)
+	}
+}
+
+// TestMethodMetrics contains unit tests for the per-method call statistics and
+// the Prometheus endpoint.
+func TestMethodMetrics(t *testing.T) {
+	srv := New(runner.NewManager(runner.DefaultConfig()))
+	server, client := net.Pipe()
+	go srv.ServeConn(server)
+	c := jsonrpc.NewClient(client)
+	defer c.Close()
+
+	var result RunResult
+	if err := c.Call("ShellRunner.Run", RunArgs{Command: "true"}, &result); err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		var status JobStatus
+		if err := c.Call("ShellRunner.Status", "missing", &status); err == nil {
+			t.Fatal("expected the status of a missing job to fail")
+		}
+	}
+	var stats Stats
+	if err := c.Call("ShellRunner.Statistics", struct{}{}, &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if run := stats.Methods["Run"]; run.Calls != 1 || run.Errors != 0 || run.MaxLatencySeconds <= 0 {
+		t.Errorf("expected one successful Run call, got %+v", run)
+	}
+	if status := stats.Methods["Status"]; status.Calls != 3 || status.Errors != 3 {
+		t.Errorf("expected three failed Status calls, got %+v", status)
+	}
+
+	recorder := httptest.NewRecorder()
+	srv.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, want := range []string{
+		`shellrunner_rpc_calls_total{method="Run"} 1`,
+		`shellrunner_rpc_errors_total{method="Status"} 3`,
+		`shellrunner_rpc_duration_seconds_bucket{method="Status",le="+Inf"} 3`,
+		`shellrunner_rpc_duration_seconds_count{method="Run"} 1`,
+		"shellrunner_jobs_total 1",
+		"# TYPE shellrunner_host_memory_available_bytes gauge",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected the metrics to contain %q, got:\n%s", want, body)
+		}
+	}
+}
+
+// TestTracing contains unit tests for exporting the spans of calls and jobs,
+// and for propagating a caller's traceparent to them.
+func TestTracing(t *testing.T) {
+	var mu sync.Mutex
+	var bodies [][]byte
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			http.NotFound(w, r)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, body)
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	srv := New(runner.NewManager(runner.DefaultConfig()))
+	srv.Tracer = NewTracer(collector.URL)
+	server, client := net.Pipe()
+	go srv.ServeConn(server)
+	c := jsonrpc.NewClient(client)
+	defer c.Close()
+
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	var id string
+	if err := c.Call("ShellRunner.Background", BackgroundArgs{Command: "echo $TRACEPARENT", TraceParent: "00-" + traceID + "-" + parentID + "-01"}, &id); err != nil {
+		t.Fatal(err)
+	}
+	var status JobStatus
+	for start := time.Now(); (status.Status == "" || !status.Finished()) && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		if err := c.Call("ShellRunner.Status", id, &status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if status.TraceID != traceID || status.SpanID == "" {
+		t.Fatalf("expected the job to join the caller's trace, got trace %q and span %q", status.TraceID, status.SpanID)
+	}
+	var output JobOutput
+	if err := c.Call("ShellRunner.Output", OutputArgs{ID: id}, &output); err != nil {
+		t.Fatal(err)
+	}
+	if want := "00-" + traceID + "-" + status.SpanID + "-01\n"; output.Stdout != want {
+		t.Errorf("expected the command to get TRACEPARENT %q, got %q", want, output.Stdout)
+	}
+
+	if err := srv.Tracer.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans := make(map[string]span)
+	mu.Lock()
+	for _, body := range bodies {
+		var request struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []span
+				}
+			}
+		}
+		if err := json.Unmarshal(body, &request); err != nil {
+			t.Fatal(err)
+		}
+		for _, resource := range request.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				for _, s := range scope.Spans {
+					spans[s.Name] = s
+				}
+			}
+		}
+	}
+	mu.Unlock()
+	call, job := spans["ShellRunner.Background"], spans["job"]
+	if call.TraceID != traceID || call.ParentSpanID != parentID {
+		t.Errorf("expected the Background call's span to be a child of the caller's, got %+v", call)
+	}
+	if job.SpanID != status.SpanID || job.ParentSpanID != call.SpanID || job.TraceID != traceID {
+		t.Errorf("expected the job's span to be a child of the Background call's, got %+v", job)
+	}
+	if _, ok := spans["ShellRunner.Status"]; !ok {
+		t.Errorf("expected a span for the Status calls, got %v", spans)
+	}
+
+	shellRunner := setup(t)
+	if err := shellRunner.Background(BackgroundArgs{Command: "true", TraceParent: "00-nope-01"}, &id); Code(err) != CodeInvalidArgument {
+		t.Errorf("expected an invalid traceparent to be rejected, got %v", err)
+	}
+}
+
+// TestPresets contains unit tests for the umask, locale and timezone options.
+func TestPresets(t *testing.T) {
+	shellRunner := setup(t)
+
+	var reply RunResult
+	if err := shellRunner.Run(RunArgs{Command: "umask; echo $LANG $LC_ALL $TZ; date +%Z", Umask: "027", Locale: "C", TZ: "UTC"}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Stdout != "0027\nC C UTC\nUTC\n" {
+		t.Errorf("expected the job's umask, locale and timezone to be set, got %q", reply.Stdout)
+	}
+
+	for _, args := range []RunArgs{
+		{Command: "true", Umask: "999"},
+		{Command: "true", Umask: "022", Container: &runner.ContainerOptions{Image: "alpine"}},
+		{Command: "true", Locale: "C", Env: map[string]string{"LC_ALL": "POSIX"}},
+	} {
+		if err := shellRunner.Run(args, &reply); Code(err) != CodeInvalidArgument {
+			t.Errorf("expected %+v to be rejected, got %v", args, err)
+		}
+	}
+}
+
+// TestProgress contains unit tests for the output counters in a job's status.
+func TestProgress(t *testing.T) {
+	shellRunner := setup(t)
+
+	var id string
+	filter := &runner.OutputFilter{Exclude: []string{"."}}
+	if err := shellRunner.Background(BackgroundArgs{Command: "printf 'a\\nb\\n'; printf err >&2; sleep 5", Filter: filter}, &id); err != nil {
+		t.Fatal(err)
+	}
+	defer shellRunner.Kill(KillArgs{ID: id}, new(bool))
+	var status JobStatus
+	for start := time.Now(); status.StderrBytes < 3 && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		if err := shellRunner.Status(id, &status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if status.StdoutBytes != 4 || status.StdoutLines != 2 || status.StderrBytes != 3 || status.StderrLines != 0 {
+		t.Errorf("expected what the command wrote to be counted despite the filter, got %+v", status)
+	}
+	if status.LastOutputAt == nil || status.LastOutputAt.Before(status.StartTime) {
+		t.Errorf("expected the time of the last output, got %v", status.LastOutputAt)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := shellRunner.Status(id, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.OutputIdleSeconds < 0.1 {
+		t.Errorf("expected the job to have been idle since its last output, got %v seconds", status.OutputIdleSeconds)
+	}
+}
+
+// TestIdleTimeout contains unit tests for killing or flagging jobs that stop
+// writing output.
+func TestIdleTimeout(t *testing.T) {
+	shellRunner := setup(t)
+
+	var reply RunResult
+	start := time.Now()
+	if err := shellRunner.Run(RunArgs{Command: "echo start; sleep 5", IdleTimeoutSeconds: 0.3}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.LimitExceeded != "idle_timeout" || reply.KilledBy != runner.KilledByTimeout || time.Since(start) > 3*time.Second {
+		t.Errorf("expected the silent job to be killed, got %+v after %v", reply, time.Since(start))
+	}
+
+	if err := shellRunner.Run(RunArgs{Command: "for i in 1 2 3 4 5 6; do echo $i; sleep 0.1; done", IdleTimeoutSeconds: 0.3}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.ExitCode != 0 || reply.LimitExceeded != "" {
+		t.Errorf("expected a job writing steadily to finish, got %+v", reply)
+	}
+
+	var id string
+	if err := shellRunner.Background(BackgroundArgs{Command: "sleep 5", IdleTimeoutSeconds: 0.2, IdleAction: runner.IdleFlag}, &id); err != nil {
+		t.Fatal(err)
+	}
+	defer shellRunner.Kill(KillArgs{ID: id}, new(bool))
+	var status JobStatus
+	if err := shellRunner.Status(id, &status); err != nil || status.Stalled {
+		t.Fatalf("expected a new job not to be stalled, got %+v, %v", status, err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if err := shellRunner.Status(id, &status); err != nil || !status.Stalled || status.Status != "running" {
+		t.Errorf("expected the job to be flagged as stalled and left running, got %+v, %v", status, err)
+	}
+
+	if err := shellRunner.Run(RunArgs{Command: "true", IdleTimeoutSeconds: 1, IdleAction: "pause"}, &reply); Code(err) != CodeInvalidArgument {
+		t.Errorf("expected an unknown idle action to be rejected, got %v", err)
+	}
+}
+
+// TestReportedProgress contains unit tests for reporting the progress lines
+// a job writes in its status.
+func TestReportedProgress(t *testing.T) {
+	shellRunner := setup(t)
+
+	var id string
+	command := `echo start; echo '##progress 42 "uploading"'; sleep 5`
+	if err := shellRunner.Background(BackgroundArgs{Command: command, Progress: true}, &id); err != nil {
+		t.Fatal(err)
+	}
+	defer shellRunner.Kill(KillArgs{ID: id}, new(bool))
+	var status JobStatus
+	for start := time.Now(); status.ProgressPercent == nil && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		if err := shellRunner.Status(id, &status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if status.ProgressPercent == nil || *status.ProgressPercent != 42 || status.ProgressMessage != "uploading" || status.ProgressUpdatedAt == nil {
+		t.Fatalf("expected the reported progress, got %+v", status)
+	}
+	var output JobOutput
+	if err := shellRunner.Output(OutputArgs{ID: id}, &output); err != nil {
+		t.Fatal(err)
+	}
+	if output.Stdout != "start\n" {
+		t.Errorf("expected the progress line to be taken out of the output, got %q", output.Stdout)
+	}
+
+	var reply RunResult
+	if err := shellRunner.Run(RunArgs{Command: "echo '##progress 50'"}, &reply); err != nil || reply.Stdout != "##progress 50\n" {
+		t.Errorf("expected progress lines to be left alone without the option, got %q, %v", reply.Stdout, err)
+	}
+}
+
+// TestKillAll contains unit tests for signalling the jobs a filter selects.
+func TestKillAll(t *testing.T) {
+	shellRunner := setup(t)
+
+	start := func(command string, labels map[string]string) string {
+		var id string
+		if err := shellRunner.Background(BackgroundArgs{Command: command, Labels: labels}, &id); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { shellRunner.Kill(KillArgs{ID: id}, new(bool)) })
+		return id
+	}
+	broken := map[string]string{"deploy": "broken"}
+	old := start("sleep 5", broken)
+	time.Sleep(200 * time.Millisecond)
+	young := start("sleep 5", broken)
+	other := start("sleep 5", map[string]string{"deploy": "ok"})
+	server := start("sleep 5 # server", broken)
+
+	var reply KillAllResult
+	if err := shellRunner.KillAll(KillAllArgs{Labels: broken, Command: `^sleep 5$`, OlderThanSeconds: 0.1, Signal: "TERM"}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(reply.Killed, []string{old}) || reply.Failed != nil {
+		t.Errorf("expected only job %s to be signalled, got %+v", old, reply)
+	}
+	var status JobStatus
+	for start := time.Now(); (status.Status == "" || !status.Finished()) && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		if err := shellRunner.Status(old, &status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if status.Signal != "TERM" || status.KilledBy != runner.KilledByOperator {
+		t.Errorf("expected the job to be killed by the operator with TERM, got %+v", status)
+	}
+	if err := shellRunner.KillAll(KillAllArgs{Labels: broken}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Killed) != 2 || !slices.Contains(reply.Killed, young) || !slices.Contains(reply.Killed, server) {
+		t.Errorf("expected the other running jobs of the deployment to be signalled, got %v", reply.Killed)
+	}
+	if err := shellRunner.Status(other, &status); err != nil || status.Status != "running" {
+		t.Errorf("expected the job of another deployment to be left running, got %+v, %v", status, err)
+	}
+
+	if err := shellRunner.KillAll(KillAllArgs{Command: "("}, &reply); Code(err) != CodeInvalidArgument {
+		t.Errorf("expected INVALID_ARGUMENT for an invalid pattern, got %v", err)
+	}
+	if err := shellRunner.KillAll(KillAllArgs{Signal: "NOPE"}, &reply); Code(err) != CodeInvalidArgument {
+		t.Errorf("expected INVALID_ARGUMENT for an unknown signal, got %v", err)
+	}
+}
+
+// TestPauseResume contains unit tests for pausing and resuming jobs.
+func TestPauseResume(t *testing.T) {
+	shellRunner := setup(t)
+
+	var id string
+	if err := shellRunner.Background(BackgroundArgs{Command: "while :; do echo tick; sleep 0.02; done", IdleTimeoutSeconds: 0.2}, &id); err != nil {
+		t.Fatal(err)
+	}
+	defer shellRunner.Kill(KillArgs{ID: id}, new(bool))
+	time.Sleep(100 * time.Millisecond)
+
+	var ok bool
+	if err := shellRunner.Pause(id, &ok); err != nil || !ok {
+		t.Fatalf("expected the job to be paused, got %v", err)
+	}
+	if err := shellRunner.Pause(id, &ok); Code(err) != CodeInvalidState {
+		t.Errorf("expected INVALID_STATE pausing a paused job, got %v", err)
+	}
+	var before, after JobStatus
+	time.Sleep(50 * time.Millisecond)
+	shellRunner.Status(id, &before)
+	time.Sleep(300 * time.Millisecond)
+	shellRunner.Status(id, &after)
+	if after.Status != "paused" || after.Finished() || after.StdoutBytes != before.StdoutBytes {
+		t.Errorf("expected the job to be paused without writing, got %+v after %+v", after, before)
+	}
+	if after.Stalled {
+		t.Error("expected a paused job not to be stalled")
+	}
+
+	if err := shellRunner.Resume(id, &ok); err != nil || !ok {
+		t.Fatalf("expected the job to be resumed, got %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	shellRunner.Status(id, &after)
+	if after.Status != "running" || after.StdoutBytes <= before.StdoutBytes {
+		t.Errorf("expected the job to run again, and not be killed as idle, got %+v", after)
+	}
+	if err := shellRunner.Resume(id, &ok); Code(err) != CodeInvalidState {
+		t.Errorf("expected INVALID_STATE resuming a running job, got %v", err)
+	}
+
+	// A paused job is resumed to act on the signal it is killed with.
+	if err := shellRunner.Pause(id, &ok); err != nil {
+		t.Fatal(err)
+	}
+	if err := shellRunner.Kill(KillArgs{ID: id, Signal: "TERM"}, &ok); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); !after.Finished() && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		shellRunner.Status(id, &after)
+	}
+	if after.Signal != "TERM" {
+		t.Errorf("expected the paused job to be killed with TERM, got %+v", after)
+	}
+}
+
+// TestExtendTimeout contains unit tests for extending the timeouts of jobs.
+func TestExtendTimeout(t *testing.T) {
+	shellRunner := setup(t)
+
+	var id string
+	if err := shellRunner.Background(BackgroundArgs{Command: "sleep 0.6", Timeout: 0.3}, &id); err != nil {
+		t.Fatal(err)
+	}
+	defer shellRunner.Kill(KillArgs{ID: id}, new(bool))
+	var status JobStatus
+	if err := shellRunner.Status(id, &status); err != nil || status.Deadline == nil {
+		t.Fatalf("expected the job's deadline, got %+v, %v", status, err)
+	}
+	var deadline time.Time
+	if err := shellRunner.ExtendTimeout(ExtendTimeoutArgs{ID: id, ExtraSeconds: 2}, &deadline); err != nil {
+		t.Fatal(err)
+	}
+	if got := deadline.Sub(*status.Deadline); got != 2*time.Second {
+		t.Errorf("expected the deadline to move by 2s, got %v", got)
+	}
+	for start := time.Now(); !status.Finished() && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		shellRunner.Status(id, &status)
+	}
+	if status.ExitCode == nil || *status.ExitCode != 0 || status.LimitExceeded != "" {
+		t.Errorf("expected the job to finish in its extended time, got %+v", status)
+	}
+
+	if err := shellRunner.ExtendTimeout(ExtendTimeoutArgs{ID: id, ExtraSeconds: 1}, &deadline); Code(err) != CodeInvalidState {
+		t.Errorf("expected INVALID_STATE for a finished job, got %v", err)
+	}
+	if err := shellRunner.Background(BackgroundArgs{Command: "sleep 5"}, &id); err != nil {
+		t.Fatal(err)
+	}
+	defer shellRunner.Kill(KillArgs{ID: id}, new(bool))
+	if err := shellRunner.ExtendTimeout(ExtendTimeoutArgs{ID: id, ExtraSeconds: 1}, &deadline); Code(err) != CodeInvalidState {
+		t.Errorf("expected INVALID_STATE for a job without a timeout, got %v", err)
+	}
+	if err := shellRunner.ExtendTimeout(ExtendTimeoutArgs{ID: id, ExtraSeconds: -1}, &deadline); Code(err) != CodeInvalidArgument {
+		t.Errorf("expected INVALID_ARGUMENT for a negative extension, got %v", err)
+	}
+}
+
+// TestWriteStdin contains unit tests for writing to the stdin of running
+// jobs.
+func TestWriteStdin(t *testing.T) {
+	shellRunner := setup(t)
+
+	var id string
+	if err := shellRunner.Background(BackgroundArgs{Command: "cat", Stdin: "first\n", StdinOpen: true}, &id); err != nil {
+		t.Fatal(err)
+	}
+	defer shellRunner.Kill(KillArgs{ID: id}, new(bool))
+	var n int
+	if err := shellRunner.WriteStdin(WriteStdinArgs{ID: id, Data: []byte("second\n")}, &n); err != nil || n != 7 {
+		t.Fatalf("expected 7 bytes to be written, got %d, %v", n, err)
+	}
+	var closed bool
+	if err := shellRunner.CloseStdin(id, &closed); err != nil || !closed {
+		t.Fatalf("expected stdin to be closed, got %v", err)
+	}
+	if err := shellRunner.WriteStdin(WriteStdinArgs{ID: id, Data: []byte("third\n")}, &n); Code(err) != CodeInvalidState {
+		t.Errorf("expected INVALID_STATE writing to closed stdin, got %v", err)
+	}
+	var status JobStatus
+	for start := time.Now(); (status.Status == "" || !status.Finished()) && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		shellRunner.Status(id, &status)
+	}
+	var output JobOutput
+	if err := shellRunner.Output(OutputArgs{ID: id}, &output); err != nil || output.Stdout != "first\nsecond\n" {
+		t.Errorf("expected the job to read its input until it was closed, got %q, %v", output.Stdout, err)
+	}
+
+	// A job that does not read its input fails the write once the pipe
+	// is full.
+	defer func(timeout time.Duration) { runner.StdinWriteTimeout = timeout }(runner.StdinWriteTimeout)
+	runner.StdinWriteTimeout = 100 * time.Millisecond
+	if err := shellRunner.Background(BackgroundArgs{Command: "sleep 5", StdinOpen: true}, &id); err != nil {
+		t.Fatal(err)
+	}
+	defer shellRunner.Kill(KillArgs{ID: id}, new(bool))
+	if err := shellRunner.WriteStdin(WriteStdinArgs{ID: id, Data: make([]byte, 1<<20)}, &n); Code(err) != CodeInvalidState {
+		t.Errorf("expected INVALID_STATE for a job not reading its input, got %v", err)
+	}
+
+	if err := shellRunner.Background(BackgroundArgs{Command: "sleep 5"}, &id); err != nil {
+		t.Fatal(err)
+	}
+	defer shellRunner.Kill(KillArgs{ID: id}, new(bool))
+	if err := shellRunner.CloseStdin(id, &closed); Code(err) != CodeInvalidState {
+		t.Errorf("expected INVALID_STATE for a job without an open stdin, got %v", err)
+	}
+	var reply RunResult
+	if err := shellRunner.Run(RunArgs{Command: "cat", StdinOpen: true}, &reply); Code(err) != CodeInvalidArgument {
+		t.Errorf("expected INVALID_ARGUMENT for Run with an open stdin, got %v", err)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ParseListener("tls:0.0.0.0:7443,cert=server.pem,key=server.key,token-file=" + tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ListenerConfig{Network: "tls", Address: "0.0.0.0:7443", CertFile: "server.pem", KeyFile: "server.key", Token: "s3cret"}); !reflect.DeepEqual(cfg, want) {
+		t.Errorf("ParseListener returned %+v, want %+v", cfg, want)
+	}
+	if cfg, err := ParseListener("tls:0.0.0.0:7443,cert=server.pem,key=server.key,client-ca=ca.pem"); err != nil || cfg.ClientCAFile != "ca.pem" {
+		t.Errorf("ParseListener returned %+v, %v", cfg, err)
+	}
+	for _, spec := range []string{
+		"/run/shellrunner.sock",
+		"tcp:localhost:7443",
+		"tls:localhost:7443,cert=server.pem,key=server.key",
+		"http:localhost:9090,client-ca=ca.pem",
+		"tls:localhost:7443,cert=server.pem,key=server.key,token-file=" + tokenFile + ",cert-names=" + tokenFile,
+		"http:localhost:9090,users=1000",
+		"unix:/run/shellrunner.sock,mode=600",
+	} {
+		if _, err := ParseListener(spec); err == nil {
+			t.Errorf("ParseListener(%q) succeeded", spec)
+		}
+	}
+
+	srv := New(runner.NewManager(runner.DefaultConfig()))
+	serve := func(cfg ListenerConfig) net.Listener {
+		t.Helper()
+		listener, err := cfg.Listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go srv.ServeListener(listener, cfg)
+		return listener
+	}
+
+	t.Run("token", func(t *testing.T) {
+		socketPath, err := DefaultSocketPath()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(filepath.Dir(socketPath))
+		serve(ListenerConfig{Network: "unix", Address: socketPath, Token: "s3cret"})
+
+		for _, tc := range []struct {
+			preamble string
+			ok       bool
+		}{
+			{"AUTH s3cret\n", true},
+			{"AUTH guess\n", false},
+			{"", false},
+		} {
+			conn, err := net.Dial("unix", socketPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(conn, tc.preamble)
+			c := jsonrpc.NewClient(conn)
+			err = c.Call("ShellRunner.Ping", struct{}{}, &Pong{})
+			c.Close()
+			if (err == nil) != tc.ok {
+				t.Errorf("Ping after %q returned %v", tc.preamble, err)
+			}
+		}
+	})
+
+	t.Run("users", func(t *testing.T) {
+		socketPath, err := DefaultSocketPath()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(filepath.Dir(socketPath))
+		serve(ListenerConfig{Network: "unix", Address: socketPath, Users: []string{"nobody"}})
+
+		conn, err := net.Dial("unix", socketPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := jsonrpc.NewClient(conn)
+		defer c.Close()
+		if err := c.Call("ShellRunner.Ping", struct{}{}, &Pong{}); err == nil {
+			t.Error("a user not on the list was served")
+		}
+	})
+
+	t.Run("http", func(t *testing.T) {
+		listener := serve(ListenerConfig{Network: "http", Address: "127.0.0.1:0", Token: "s3cret"})
+		url := "http://" + listener.Addr().String() + "/metrics"
+
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected a request without a token to be unauthorized, got %s", resp.Status)
+		}
+
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "shellrunner_auth_failures_total") {
+			t.Errorf("unexpected metrics response: %s\n%s", resp.Status, body)
+		}
+	})
+
+	if failures := srv.stats().AuthFailures; failures < 4 {
+		t.Errorf("expected at least 4 auth failures, got %d", failures)
+	}
+}
+
+func TestSocketPaths(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("named pipes have no socket paths")
+	}
+
+	t.Run("runtime dir", func(t *testing.T) {
+		dir := t.TempDir()
+		t.Setenv("XDG_RUNTIME_DIR", dir)
+		socketPath, err := DefaultSocketPath()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Dir(filepath.Dir(socketPath)) != dir {
+			t.Errorf("expected a socket in a directory of %s, got %s", dir, socketPath)
+		}
+		if err := RemoveDefaultSocket(socketPath); err != nil {
+			t.Errorf("RemoveDefaultSocket: %v", err)
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		socketPath := filepath.Join(t.TempDir(), "shellrunner.sock")
+		stale, err := net.Listen("unix", socketPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		stale.Close()
+
+		listener, err := Listen(socketPath)
+		if err != nil {
+			t.Fatalf("expected the stale socket to be replaced, got %v", err)
+		}
+		defer listener.Close()
+		if _, err := Listen(socketPath); err == nil {
+			t.Error("Listen replaced the socket of a running server")
+		}
+	})
+
+	t.Run("abstract", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("abstract sockets are only supported on Linux")
+		}
+		cfg := ListenerConfig{Network: "unix", Address: fmt.Sprintf("@shellrunner-test-%d", os.Getpid())}
+		listener, err := cfg.Listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		go New(runner.NewManager(runner.DefaultConfig())).ServeListener(listener, cfg)
+
+		conn, err := net.Dial("unix", cfg.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := jsonrpc.NewClient(conn)
+		defer c.Close()
+		if err := c.Call("ShellRunner.Ping", struct{}{}, &Pong{}); err != nil {
+			t.Errorf("Ping over an abstract socket failed: %v", err)
+		}
+	})
+}
+
+func TestInstance(t *testing.T) {
+	for _, name := range []string{"", "../etc", "-x", "a/b", "with space"} {
+		if err := CheckInstance(name); err == nil {
+			t.Errorf("CheckInstance(%q) succeeded", name)
+		}
+	}
+	state := t.TempDir()
+	t.Setenv("XDG_STATE_HOME", state)
+	if dir, err := InstanceDir("ci"); err != nil || dir != filepath.Join(state, "shellrunner", "ci") {
+		t.Errorf("InstanceDir returned %q, %v", dir, err)
+	}
+	if runtime.GOOS != "windows" {
+		run := t.TempDir()
+		t.Setenv("XDG_RUNTIME_DIR", run)
+		if path := InstanceSocketPath("ci"); path != filepath.Join(run, "shellrunner", "ci.sock") {
+			t.Errorf("InstanceSocketPath returned %q", path)
+		}
+		path := InstanceSocketPath("ci")
+		if err := MakeSocketDir(path); err != nil {
+			t.Fatal(err)
+		}
+		if err := MakeSocketDir(path); err != nil {
+			t.Errorf("expected the socket directory made before to be accepted, got %v", err)
+		}
+		os.Chmod(filepath.Dir(path), 0o755)
+		if err := MakeSocketDir(path); err == nil {
+			t.Error("expected a socket directory others can read to be refused")
+		}
+		target := t.TempDir()
+		os.Chmod(target, 0o700)
+		os.Symlink(target, filepath.Join(run, "linked"))
+		if err := MakeSocketDir(filepath.Join(run, "linked", "ci.sock")); err == nil {
+			t.Error("expected a symlinked socket directory to be refused")
+		}
+	}
+
+	srv := New(runner.NewManager(runner.DefaultConfig()))
+	srv.Instance = "ci"
+	server, client := net.Pipe()
+	go srv.ServeConn(server)
+	c := jsonrpc.NewClient(client)
+	defer c.Close()
+	if err := c.Call("ShellRunner.Run", RunArgs{Command: "true"}, &RunResult{}); err != nil {
+		t.Fatal(err)
+	}
+	var info ServerInfo
+	if err := c.Call("ShellRunner.Info", struct{}{}, &info); err != nil || info.Instance != "ci" {
+		t.Errorf("Info returned %+v, %v", info, err)
+	}
+	recorder := httptest.NewRecorder()
+	srv.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, want := range []string{
+		`shellrunner_jobs_total{instance="ci"} 1`,
+		`shellrunner_rpc_calls_total{instance="ci",method="Run"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in the metrics:\n%s", want, body)
+		}
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(tokenFile, []byte("deploy:s3cret\nci:0ther\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	socketPath, err := DefaultSocketPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(socketPath))
+	cfg, err := ParseListener("unix:" + socketPath + ",token-file=" + tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := cfg.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	srv := New(runner.NewManager(runner.DefaultConfig()))
+	go srv.ServeListener(listener, cfg)
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "AUTH s3cret\n")
+	c := jsonrpc.NewClient(conn)
+	defer c.Close()
+
+	var id runner.Identity
+	if err := c.Call("ShellRunner.Identify", IdentifyArgs{Agent: "nightly-backup"}, &id); err != nil {
+		t.Fatal(err)
+	}
+	if id.Token != "deploy" || id.Agent != "nightly-backup" {
+		t.Errorf("unexpected identity: %+v", id)
+	}
+	if err := c.Call("ShellRunner.Identify", IdentifyArgs{Agent: "bell\a"}, &id); err == nil {
+		t.Error("expected an agent with a control character to be refused")
+	}
+
+	var jobID string
+	if err := c.Call("ShellRunner.Background", BackgroundArgs{Command: "true"}, &jobID); err != nil {
+		t.Fatal(err)
+	}
+	var status JobStatus
+	for start := time.Now(); (status.Status == "" || !status.Finished()) && time.Since(start) < 5*time.Second; {
+		if err := c.Call("ShellRunner.Status", jobID, &status); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.Submitter == nil || status.Submitter.Agent != "nightly-backup" || status.Submitter.Token != "deploy" {
+		t.Errorf("unexpected submitter: %+v", status.Submitter)
+	}
+	var list JobList
+	if err := c.Call("ShellRunner.List", ListArgs{}, &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Jobs) != 1 || list.Jobs[0].Submitter != "agent:nightly-backup" {
+		t.Errorf("unexpected list: %+v", list.Jobs)
+	}
+	var stats Stats
+	if err := c.Call("ShellRunner.Statistics", struct{}{}, &stats); err != nil {
+		t.Fatal(err)
+	}
+	if got := stats.Identities["agent:nightly-backup"]; got.Submitted != 1 || got.Finished != 1 || got.Succeeded != 1 {
+		t.Errorf("unexpected statistics for the agent: %+v", stats.Identities)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quotas.json")
+	if err := os.WriteFile(path, []byte(`{"uid:1000": {"max_running": 1, "max_jobs_per_hour": 3}, "*": {"max_buffered_bytes": 10}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	quotas, err := LoadQuotas(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(`{"agent:nightly": {"max_running": 1}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadQuotas(path); err == nil {
+		t.Error("expected a quota for an agent to be refused")
+	}
+
+	srv := New(runner.NewManager(runner.DefaultConfig()))
+	srv.Quotas = quotas
+	limited := srv.receiver(srv.ctx, "1000")
+	other := srv.receiver(srv.ctx, "2000")
+	wait := func(s *ShellRunner, id string) {
+		var status JobStatus
+		for start := time.Now(); (status.Status == "" || !status.Finished()) && time.Since(start) < 5*time.Second; {
+			if err := s.Status(id, &status); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	exceeded := func(err error, quota string) {
+		t.Helper()
+		var e *Error
+		if !errors.As(err, &e) || e.Code != CodeQuotaExceeded || e.Details["quota"] != quota {
+			t.Errorf("expected the %s quota to be exceeded, got %v", quota, err)
+		}
+	}
+
+	var sleeper string
+	if err := limited.Background(BackgroundArgs{Command: "sleep 5"}, &sleeper); err != nil {
+		t.Fatal(err)
+	}
+	var id string
+	exceeded(limited.Background(BackgroundArgs{Command: "true"}, &id), "max_running")
+	// Other identities have quotas of their own.
+	if err := other.Run(RunArgs{Command: "printf 0123456789ab", Keep: true}, &RunResult{}); err != nil {
+		t.Fatal(err)
+	}
+	limited.Kill(KillArgs{ID: sleeper}, new(bool))
+	wait(limited, sleeper)
+
+	if err := limited.Background(BackgroundArgs{Command: "true"}, &id); err != nil {
+		t.Fatalf("expected the job to be admitted once the first finished, got %v", err)
+	}
+	wait(limited, id)
+	if err := limited.Run(RunArgs{Command: "true"}, &RunResult{}); err != nil {
+		t.Fatal(err)
+	}
+	exceeded(limited.Run(RunArgs{Command: "true"}, &RunResult{}), "max_jobs_per_hour")
+
+	var usage QuotaUsage
+	if err := limited.Quota(struct{}{}, &usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage.Identity != "uid:1000" || usage.Quota == nil || usage.Quota.MaxRunning != 1 || usage.Running != 0 || usage.JobsLastHour != 3 || usage.QuotaExceeded != 2 {
+		t.Errorf("unexpected usage: %+v", usage)
+	}
+
+	exceeded(other.Background(BackgroundArgs{Command: "true"}, &id), "max_buffered_bytes")
+	if err := other.Quota(struct{}{}, &usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage.Identity != "uid:2000" || usage.BufferedBytes != 12 || usage.Quota.MaxBufferedBytes != 10 {
+		t.Errorf("unexpected usage: %+v", usage)
+	}
+	var stats Stats
+	limited.Statistics(struct{}{}, &stats)
+	if stats.QuotaExceededCalls != 3 {
+		t.Errorf("expected 3 calls over quota, got %d", stats.QuotaExceededCalls)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	srv := New(runner.NewManager(runner.DefaultConfig()))
+	srv.Admins = []string{"uid:1000"}
+	admin := srv.receiver(srv.ctx, "1000")
+	root := srv.receiver(srv.ctx, "0")
+	alice := srv.receiver(srv.ctx, "2000")
+	bob := srv.receiver(srv.ctx, "3000")
+	code := func(err error, want ErrorCode) {
+		t.Helper()
+		if got := Code(err); got != want {
+			t.Errorf("expected %s, got %v", want, err)
+		}
+	}
+
+	code(alice.Invoke("AdminJobs", AdminJobsArgs{}, &AdminJobList{}), CodePermissionDenied)
+	code(alice.Invoke("AdminSetQuota", AdminSetQuotaArgs{Tenant: "uid:2000"}, new(Quotas)), CodePermissionDenied)
+
+	var sleeper, other string
+	if err := alice.Background(BackgroundArgs{Command: "sleep 5"}, &sleeper); err != nil {
+		t.Fatal(err)
+	}
+	var result RunResult
+	if err := alice.Run(RunArgs{Command: "true", Keep: true}, &result); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Background(BackgroundArgs{Command: "sleep 5"}, &other); err != nil {
+		t.Fatal(err)
+	}
+
+	var jobs AdminJobList
+	if err := admin.AdminJobs(AdminJobsArgs{Tenant: "uid:2000"}, &jobs); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs.Jobs) != 2 || jobs.Jobs[0].ID != sleeper || jobs.Jobs[0].Tenant != "uid:2000" || jobs.Jobs[1].ID != result.JobID {
+		t.Fatalf("expected alice's two jobs, got %+v", jobs.Jobs)
+	}
+
+	var released AdminReleaseResult
+	if err := admin.AdminRelease(AdminReleaseArgs{Tenant: "uid:2000"}, &released); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(released.Released, []string{result.JobID}) || released.Failed[sleeper] == "" {
+		t.Errorf("expected only alice's finished job to be released, got %+v", released)
+	}
+	var killed KillAllResult
+	if err := admin.AdminKill(AdminKillArgs{Tenant: "uid:3000"}, &killed); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(killed.Killed, []string{other}) {
+		t.Errorf("expected bob's job to be killed, got %+v", killed)
+	}
+	code(admin.AdminKill(AdminKillArgs{}, &killed), CodeInvalidArgument)
+	released = AdminReleaseResult{}
+	if err := root.AdminRelease(AdminReleaseArgs{IDs: []string{sleeper}, Force: true}, &released); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(released.Released, []string{sleeper}) {
+		t.Errorf("expected the running job to be released by force, got %+v", released)
+	}
+	code(alice.Status(sleeper, &JobStatus{}), CodeJobNotFound)
+
+	var quotas Quotas
+	if err := admin.AdminSetQuota(AdminSetQuotaArgs{Tenant: "uid:2000", Quota: &Quota{MaxRunning: 1}}, &quotas); err != nil {
+		t.Fatal(err)
+	}
+	if len(quotas) != 1 || quotas["uid:2000"].MaxRunning != 1 {
+		t.Errorf("unexpected quotas: %+v", quotas)
+	}
+	code(admin.AdminSetQuota(AdminSetQuotaArgs{Tenant: "agent:nightly", Quota: &Quota{}}, &quotas), CodeInvalidArgument)
+	if err := alice.Background(BackgroundArgs{Command: "sleep 5"}, &sleeper); err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Kill(KillArgs{ID: sleeper}, new(bool))
+	code(alice.Background(BackgroundArgs{Command: "true"}, new(string)), CodeQuotaExceeded)
+
+	var tenants TenantList
+	if err := admin.AdminTenants(struct{}{}, &tenants); err != nil {
+		t.Fatal(err)
+	}
+	if len(tenants.Tenants) != 2 || tenants.Tenants[0].Identity != "uid:2000" || tenants.Tenants[1].Identity != "uid:3000" {
+		t.Fatalf("expected alice and bob, got %+v", tenants.Tenants)
+	}
+	if alice := tenants.Tenants[0]; alice.Quota == nil || alice.Running != 1 || alice.Stats.Submitted != 3 || alice.Stats.Succeeded != 1 || alice.QuotaExceeded != 1 {
+		t.Errorf("unexpected statistics of alice: %+v", alice)
+	}
+
+	if admins, err := ParseAdmins("token:ops, uid:1000"); err != nil || !slices.Equal(admins, []string{"token:ops", "uid:1000"}) {
+		t.Errorf("unexpected admins %q: %v", admins, err)
+	}
+	if _, err := ParseAdmins("agent:nightly"); err == nil {
+		t.Error("expected an agent to be refused as an admin")
+	}
+}
+
+// TestOwnJobs checks that clients that are not admins only see and act on
+// the jobs of their own tenant, and that other tenants' jobs look missing.
+func TestOwnJobs(t *testing.T) {
+	srv := New(runner.NewManager(runner.DefaultConfig()))
+	srv.Admins = []string{"uid:1000"}
+	admin := srv.receiver(srv.ctx, "1000")
+	alice := srv.receiver(srv.ctx, "2000")
+	bob := srv.receiver(srv.ctx, "3000")
+	notFound := func(method string, err error) {
+		t.Helper()
+		if Code(err) != CodeJobNotFound {
+			t.Errorf("expected %s of another tenant's job to fail with JOB_NOT_FOUND, got %v", method, err)
+		}
+	}
+
+	var sleeper, finished string
+	if err := alice.Invoke("Background", BackgroundArgs{Command: "sleep 5"}, &sleeper); err != nil {
+		t.Fatal(err)
+	}
+	defer alice.manager.Kill(sleeper, "KILL")
+	if err := alice.Invoke("Background", BackgroundArgs{Command: "echo secret"}, &finished); err != nil {
+		t.Fatal(err)
+	}
+	var status JobStatus
+	for start := time.Now(); (status.Status == "" || !status.Finished()) && time.Since(start) < 5*time.Second; {
+		if err := alice.Invoke("Status", finished, &status); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	notFound("Status", bob.Invoke("Status", finished, &JobStatus{}))
+	notFound("Output", bob.Invoke("Output", OutputArgs{ID: finished}, &JobOutput{}))
+	notFound("Diff", bob.Invoke("Diff", DiffArgs{A: finished, B: finished}, &DiffResult{}))
+	notFound("Annotate", bob.Invoke("Annotate", AnnotateArgs{ID: finished, Key: "k", Value: "v"}, new(map[string]string)))
+	notFound("Kill", bob.Invoke("Kill", KillArgs{ID: sleeper}, new(bool)))
+	notFound("Release", bob.Invoke("Release", finished, new(bool)))
+	notFound("Rerun", bob.Invoke("Rerun", finished, new(string)))
+	missing := bob.Invoke("Status", "999", &JobStatus{})
+	if err := bob.Invoke("Status", finished, &JobStatus{}); err.Error() != strings.ReplaceAll(missing.Error(), "999", finished) {
+		t.Errorf("expected another tenant's job to look missing, got %q and %q", err, missing)
+	}
+
+	var killed KillAllResult
+	if err := bob.Invoke("KillAll", KillAllArgs{}, &killed); err != nil || len(killed.Killed) != 0 {
+		t.Errorf("expected KillAll to leave another tenant's jobs alone, got %+v, %v", killed, err)
+	}
+	var archive Archive
+	if err := bob.Invoke("Export", struct{}{}, &archive); err != nil || len(archive.Jobs) != 0 {
+		t.Errorf("expected Export to leave out another tenant's jobs, got %d, %v", len(archive.Jobs), err)
+	}
+	var search SearchResult
+	if err := bob.Invoke("Search", SearchArgs{Pattern: "secret"}, &search); err != nil || len(search.Matches) != 0 {
+		t.Errorf("expected Search to leave out another tenant's jobs, got %+v, %v", search.Matches, err)
+	}
+	var released int
+	if err := bob.Invoke("ReleaseAll", struct{}{}, &released); err != nil || released != 0 {
+		t.Errorf("expected ReleaseAll to leave another tenant's jobs, got %d, %v", released, err)
+	}
+
+	// The owner and admins still reach the jobs, and a released job stays
+	// its owner's to rerun.
+	if err := admin.Invoke("Output", OutputArgs{ID: finished}, &JobOutput{}); err != nil {
+		t.Errorf("expected an admin to read another tenant's job, got %v", err)
+	}
+	if err := alice.Invoke("Release", finished, new(bool)); err != nil {
+		t.Fatal(err)
+	}
+	notFound("Rerun", bob.Invoke("Rerun", finished, new(string)))
+	var rerun string
+	if err := alice.Invoke("Rerun", finished, &rerun); err != nil {
+		t.Errorf("expected the owner to rerun its released job, got %v", err)
+	}
+}
+
+func TestACL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.json")
+	for _, data := range []string{
+		`{"roles": {"monitoring": ["Statsu"]}}`,
+		`{"roles": {"monitoring": ["Status"]}, "members": {"unknown": ["deployer"]}}`,
+		`{"roles": {"monitoring": ["Status"]}, "members": {"agent:nightly": ["monitoring"]}}`,
+	} {
+		os.WriteFile(path, []byte(data), 0o600)
+		if _, err := LoadACL(path); err == nil {
+			t.Errorf("expected an error loading %s", data)
+		}
+	}
+	os.WriteFile(path, []byte(`{
+		"roles": {"monitoring": ["Ping", "Status", "List", "Statistics"], "deployer": ["Run", "Background"], "admin": ["*"]},
+		"members": {"token:ops": ["admin"], "*": ["monitoring"]}
+	}`), 0o600)
+	acl, err := LoadACL(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acl.allows("token:ops", "Kill") || !acl.allows("uid:1000", "List") || acl.allows("uid:1000", "Kill") {
+		t.Errorf("unexpected ACL: %+v", acl)
+	}
+
+	srv := New(runner.NewManager(runner.DefaultConfig()))
+	srv.ACL = acl
+	server, client := net.Pipe()
+	go srv.ServeConn(server)
+	c := jsonrpc.NewClient(client)
+	defer c.Close()
+	err = c.Call("ShellRunner.Run", RunArgs{Command: "true"}, &RunResult{})
+	if e := ParseError(fmt.Sprint(err)); e.Code != CodePermissionDenied || e.Details["method"] != "Run" {
+		t.Errorf("expected Run to be denied, got %v", err)
+	}
+	// A denied call leaves the connection usable.
+	if err := c.Call("ShellRunner.Ping", struct{}{}, &Pong{}); err != nil {
+		t.Errorf("expected Ping to be allowed, got %v", err)
+	}
+	var stats Stats
+	if err := c.Call("ShellRunner.Statistics", struct{}{}, &stats); err != nil || stats.PermissionDeniedCalls != 1 || stats.Methods["Run"].Errors != 1 {
+		t.Errorf("unexpected statistics: %+v, %v", stats, err)
+	}
+
+	acl.Members["unknown"] = []string{"deployer"}
+	if err := c.Call("ShellRunner.Run", RunArgs{Command: "true"}, &RunResult{}); err != nil {
+		t.Errorf("expected Run to be allowed to a deployer, got %v", err)
+	}
+	if err := c.Call("ShellRunner.Ping", struct{}{}, &Pong{}); err == nil {
+		t.Error("expected Ping to be denied to a client that is only a deployer")
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	srv := New(runner.NewManager(runner.DefaultConfig()))
+	var audit bytes.Buffer
+	srv.AuditLog = &audit
+	var seen []string
+	srv.Interceptors = []Interceptor{
+		func(call *Call, next Handler) error {
+			seen = append(seen, call.Method)
+			if call.Method == "Kill" {
+				return &Error{Code: CodePolicyDenied, Message: "no killing today"}
+			}
+			if args, ok := call.Args.(*RunArgs); ok {
+				args.Command = "echo intercepted"
+			}
+			return next(call)
+		},
+	}
+	server, client := net.Pipe()
+	go srv.ServeConn(server)
+	c := jsonrpc.NewClient(client)
+	defer c.Close()
+
+	var result RunResult
+	if err := c.Call("ShellRunner.Run", RunArgs{Command: "echo hello"}, &result); err != nil || result.Stdout != "intercepted\n" {
+		t.Errorf("expected the interceptor to change the command, got %+v, %v", result, err)
+	}
+	if err := c.Call("ShellRunner.Kill", KillArgs{ID: result.JobID}, new(bool)); err == nil || ParseError(err.Error()).Code != CodePolicyDenied {
+		t.Errorf("expected the interceptor to deny Kill, got %v", err)
+	}
+	if err := c.Call("ShellRunner.Missing", struct{}{}, new(struct{})); err == nil {
+		t.Error("expected a call to an unknown method to fail")
+	}
+	if err := c.Call("ShellRunner.Ping", struct{}{}, &Pong{}); err != nil {
+		t.Errorf("expected the connection to stay usable, got %v", err)
+	}
+	if want := []string{"Run", "Kill", "Ping"}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("expected the interceptor to see %v, got %v", want, seen)
+	}
+
+	var entries []auditEntry
+	for _, line := range strings.Split(strings.TrimSpace(audit.String()), "\n") {
+		var entry auditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 3 || entries[0].Method != "Run" || entries[0].Code != "" || entries[1].Code != CodePolicyDenied {
+		t.Errorf("unexpected audit log: %s", audit.String())
+	}
+
+	s := srv.receiver(srv.ctx, "1000")
+	if err := s.Invoke("Run", "echo", &result); Code(err) != CodeInvalidArgument {
+		t.Errorf("expected Invoke to refuse arguments of the wrong type, got %v", err)
+	}
+	if err := s.Invoke("Run", RunArgs{Command: "echo hello"}, &result); err != nil || result.Stdout != "intercepted\n" {
+		t.Errorf("expected Invoke to go through the interceptors, got %+v, %v", result, err)
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	srv := New(runner.NewManager(runner.DefaultConfig()))
+	s := srv.receiver(srv.ctx, "1000")
+	other := srv.receiver(srv.ctx, "2000")
+	counter := filepath.Join(t.TempDir(), "runs")
+	command := fmt.Sprintf(`echo run >> %s; echo "{\"runs\": $(wc -l < %s)}"`, counter, counter)
+	run := func(s *ShellRunner, args RunArgs) RunResult {
+		t.Helper()
+		var result RunResult
+		if err := s.Run(args, &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	first := run(s, RunArgs{Command: command, CacheTTL: 60})
+	if first.Cached {
+		t.Error("expected the first run not to be cached")
+	}
+	second := run(other, RunArgs{Command: command, CacheTTL: 60, ParseJSON: true})
+	if !second.Cached || second.Stdout != first.Stdout || second.JobID != first.JobID || string(second.Parsed) != `{"runs":1}` {
+		t.Errorf("expected the result of the first run, got %+v", second)
+	}
+	if result := run(s, RunArgs{Command: command}); result.Cached || result.Stdout != "{\"runs\": 2}\n" {
+		t.Errorf("expected a run without CacheTTL to run, got %+v", result)
+	}
+	if result := run(s, RunArgs{Command: command, CacheTTL: 60, Env: map[string]string{"A": "1"}}); result.Cached {
+		t.Errorf("expected a run with another environment to run, got %+v", result)
+	}
+
+	failing := RunArgs{Command: "echo run >> " + counter + "; false", CacheTTL: 60}
+	run(s, failing)
+	if result := run(s, failing); result.Cached {
+		t.Errorf("expected a failed run not to be cached, got %+v", result)
+	}
+
+	short := RunArgs{Command: "echo short", CacheTTL: 0.05}
+	run(s, short)
+	time.Sleep(100 * time.Millisecond)
+	if result := run(s, short); result.Cached {
+		t.Errorf("expected the result to have expired, got %+v", result)
+	}
+
+	if err := s.Run(RunArgs{Command: "true", CacheTTL: -1}, &RunResult{}); Code(err) != CodeInvalidArgument {
+		t.Errorf("expected a negative CacheTTL to be refused, got %v", err)
+	}
+	if err := s.Background(BackgroundArgs{Command: "true", CacheTTL: 60}, new(string)); Code(err) != CodeInvalidArgument {
+		t.Errorf("expected Background to refuse CacheTTL, got %v", err)
+	}
+	var stats Stats
+	s.Statistics(struct{}{}, &stats)
+	if stats.CachedRuns != 1 {
+		t.Errorf("expected 1 cached run, got %d", stats.CachedRuns)
+	}
+}
+
+func TestMaintain(t *testing.T) {
+	config := runner.DefaultConfig()
+	config.HistoryRetention = 50 * time.Millisecond
+	srv := New(runner.NewManager(config))
+	root := srv.receiver(srv.ctx, "0")
+	alice := srv.receiver(srv.ctx, "2000")
+
+	var result RunResult
+	if err := alice.Run(RunArgs{Command: "true", Keep: true}, &result); err != nil {
+		t.Fatal(err)
+	}
+	kept := result.JobID
+	var released bool
+	if err := alice.Release(kept, &released); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Run(RunArgs{Command: "echo cached", CacheTTL: 0.05}, &result); err != nil {
+		t.Fatal(err)
+	}
+
+	var info ServerInfo
+	if err := alice.Info(struct{}{}, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Store.HistoryJobs != 1 || info.Store.CachedResults != 1 || info.Store.LastMaintenance != nil {
+		t.Fatalf("expected a released job and a cached result, got %+v", info.Store)
+	}
+
+	var maintained MaintainResult
+	if err := alice.Invoke("Maintain", struct{}{}, &maintained); Code(err) != CodePermissionDenied {
+		t.Fatalf("expected PERMISSION_DENIED for a non-admin, got %v", err)
+	}
+	if err := root.Invoke("Maintain", struct{}{}, &maintained); err != nil {
+		t.Fatal(err)
+	}
+	if maintained.PrunedHistory != 0 || maintained.PrunedResults != 0 || maintained.Store.HistoryJobs != 1 {
+		t.Fatalf("expected nothing pruned yet, got %+v", maintained)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if err := root.Invoke("Maintain", struct{}{}, &maintained); err != nil {
+		t.Fatal(err)
+	}
+	if maintained.PrunedHistory != 1 || maintained.PrunedResults != 1 {
+		t.Fatalf("expected the released job and cached result pruned, got %+v", maintained)
+	}
+	if s := maintained.Store; s.HistoryJobs != 0 || s.CachedResults != 0 || s.CachedBytes != 0 || s.LastMaintenance == nil {
+		t.Fatalf("expected an empty store, got %+v", s)
+	}
+	var rerun string
+	if err := alice.Rerun(kept, &rerun); err == nil {
+		t.Fatal("expected the pruned job not to be rerun")
+	}
+}
+
+func TestBackup(t *testing.T) {
+	srv := New(runner.NewManager(runner.DefaultConfig()))
+	srv.Quotas = Quotas{"uid:2000": {MaxRunning: 3}}
+	root := srv.receiver(srv.ctx, "0")
+	alice := srv.receiver(srv.ctx, "2000")
+	path := filepath.Join(t.TempDir(), "backup.json.gz")
+
+	var result RunResult
+	if err := alice.Run(RunArgs{Command: "echo saved", Keep: true}, &result); err != nil {
+		t.Fatal(err)
+	}
+	var backedUp AdminBackupResult
+	if err := alice.Invoke("AdminBackup", AdminBackupArgs{Path: path}, &backedUp); Code(err) != CodePermissionDenied {
+		t.Fatalf("expected PERMISSION_DENIED for a non-admin, got %v", err)
+	}
+	if err := root.Invoke("AdminBackup", AdminBackupArgs{Path: "backup.json.gz"}, &backedUp); Code(err) != CodeInvalidArgument {
+		t.Fatalf("expected INVALID_ARGUMENT for a relative path, got %v", err)
+	}
+	if err := root.Invoke("AdminBackup", AdminBackupArgs{Path: path}, &backedUp); err != nil {
+		t.Fatal(err)
+	}
+	if backedUp.Jobs != 1 || backedUp.Bytes == 0 {
+		t.Fatalf("expected a job backed up, got %+v", backedUp)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected a backup only its owner can read, got %v, %v", info, err)
+	}
+
+	other := New(runner.NewManager(runner.DefaultConfig()))
+	admin := other.receiver(other.ctx, "0")
+	var restored AdminRestoreResult
+	if err := admin.Invoke("AdminRestore", AdminRestoreArgs{Path: path}, &restored); err != nil {
+		t.Fatal(err)
+	}
+	id, ok := restored.IDs[result.JobID]
+	if !ok || restored.Quotas["uid:2000"].MaxRunning != 3 || other.Quotas["uid:2000"].MaxRunning != 3 {
+		t.Fatalf("expected the job and quota restored, got %+v", restored)
+	}
+	var output JobOutput
+	if err := admin.Output(OutputArgs{ID: id}, &output); err != nil {
+		t.Fatal(err)
+	}
+	if output.Stdout != "saved\n" {
+		t.Errorf("expected the restored job's output, got %q", output.Stdout)
+	}
+
+	if err := os.WriteFile(path, []byte("not a backup"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.Invoke("AdminRestore", AdminRestoreArgs{Path: path}, &restored); Code(err) != CodeInvalidArgument {
+		t.Fatalf("expected INVALID_ARGUMENT for a corrupt backup, got %v", err)
+	}
+}
+
+func TestCaptureRing(t *testing.T) {
+	shellRunner := setup(t)
+
+	var id string
+	if err := shellRunner.Background(BackgroundArgs{Command: "seq 1 1000; seq 1 1000 >&2", CaptureMode: "ring", RingBytes: 100}, &id); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var status JobStatus
+	for start := time.Now(); (status.Status == "" || !status.Finished()) && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		if err := shellRunner.Status(id, &status); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+	}
+	// seq 1 1000 writes 3893 bytes.
+	if status.CaptureMode != "ring" || status.RingBytes != 100 || status.StdoutDropped != 3793 || status.StderrDropped != 3793 || status.StdoutBytes != 3893 {
+		t.Errorf("expected a full ring reported, got %+v", status)
+	}
+	var output JobOutput
+	if err := shellRunner.Since(id, &output); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !strings.HasSuffix(output.Stdout, "\n999\n1000\n") || len(output.Stdout) != 100 || len(output.Stderr) != 100 {
+		t.Errorf("expected the last 100 bytes of each stream, got %q and %q", output.Stdout, output.Stderr)
+	}
+	if err := shellRunner.Since(id, &output); err != nil || output.Stdout != "" || output.Stderr != "" {
+		t.Errorf("expected nothing new, got %+v, %v", output, err)
+	}
+	var stats Stats
+	if err := shellRunner.Statistics(struct{}{}, &stats); err != nil || stats.BufferedBytes > 200 {
+		t.Errorf("expected at most the rings held, got %+v, %v", stats, err)
+	}
+
+	var reply RunResult
+	if err := shellRunner.Run(RunArgs{Command: "seq 1 1000", Keep: true}, &reply); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := shellRunner.Status(reply.JobID, &status); err != nil || status.CaptureMode != "full" || status.StdoutDropped != 0 {
+		t.Errorf("expected full capture by default, got %+v, %v", status, err)
+	}
+	if err := shellRunner.Background(BackgroundArgs{Command: "true", CaptureMode: "tail"}, &id); err == nil || ParseError(err.Error()).Code != CodeInvalidArgument {
+		t.Errorf("expected an unknown capture mode to be rejected, got %v", err)
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	shellRunner := setup(t)
+
+	var reply RunResult
+	if err := shellRunner.Run(RunArgs{Command: "exit 1", Keep: true}, &reply); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	id := reply.JobID
+	var annotations map[string]string
+	if err := shellRunner.Annotate(AnnotateArgs{ID: id, Key: "ticket", Value: "OPS-123"}, &annotations); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := shellRunner.Annotate(AnnotateArgs{ID: id, Key: "investigated", Value: "true"}, &annotations); err != nil || len(annotations) != 2 {
+		t.Fatalf("expected both annotations, got %v, %v", annotations, err)
+	}
+	var status JobStatus
+	if err := shellRunner.Status(id, &status); err != nil || status.Annotations["ticket"] != "OPS-123" || status.Annotations["investigated"] != "true" {
+		t.Errorf("expected the status to report the annotations, got %v, %v", status.Annotations, err)
+	}
+	var list JobList
+	if err := shellRunner.List(ListArgs{}, &list); err != nil || len(list.Jobs) != 1 || list.Jobs[0].Annotations["ticket"] != "OPS-123" {
+		t.Errorf("expected the list to report the annotations, got %+v, %v", list, err)
+	}
+
+	var archive Archive
+	if err := shellRunner.Export(struct{}{}, &archive); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var imported ImportResult
+	if err := shellRunner.Import(archive, &imported); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := shellRunner.Status(imported.IDs[id], &status); err != nil || status.Annotations["ticket"] != "OPS-123" {
+		t.Errorf("expected the annotations to be exported and imported, got %v, %v", status.Annotations, err)
+	}
+
+	if err := shellRunner.Annotate(AnnotateArgs{ID: id, Key: "ticket"}, &annotations); err != nil || len(annotations) != 1 || annotations["ticket"] != "" {
+		t.Errorf("expected an empty value to remove the annotation, got %v, %v", annotations, err)
+	}
+	if err := shellRunner.Annotate(AnnotateArgs{ID: id, Key: "a=b", Value: "c"}, &annotations); Code(err) != CodeInvalidArgument {
+		t.Errorf("expected an invalid key to be rejected, got %v", err)
+	}
+	if err := shellRunner.Annotate(AnnotateArgs{ID: "nonexistent", Key: "ticket", Value: "OPS-1"}, &annotations); Code(err) != CodeJobNotFound {
+		t.Errorf("expected an unknown job to be reported, got %v", err)
+	}
+}
+
+func TestTopJobs(t *testing.T) {
+	shellRunner := setup(t)
+
+	var idle, busy string
+	if err := shellRunner.Background(BackgroundArgs{Command: "sleep 5"}, &idle); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := shellRunner.Background(BackgroundArgs{Command: "while :; do :; done"}, &busy); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer func() {
+		var killed bool
+		shellRunner.Kill(KillArgs{ID: idle}, &killed)
+		shellRunner.Kill(KillArgs{ID: busy}, &killed)
+	}()
+
+	var top TopJobsResult
+	if err := shellRunner.TopJobs(TopJobsArgs{IntervalSeconds: 0.3}, &top); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if top.By != "cpu" || len(top.Jobs) != 2 || top.Jobs[0].ID != busy || top.Jobs[0].CPUPercent < 20 || top.Jobs[1].CPUPercent > top.Jobs[0].CPUPercent {
+		t.Fatalf("expected the busy job first, got %+v", top)
+	}
+	if job := top.Jobs[0]; job.Processes < 1 || job.RSSBytes == 0 || job.CPUSeconds <= 0 || job.Status != "running" {
+		t.Errorf("expected the busy job's processes to be sampled, got %+v", job)
+	}
+	if err := shellRunner.TopJobs(TopJobsArgs{By: "rss", Limit: 1, IntervalSeconds: 0.1}, &top); err != nil || top.By != "rss" || len(top.Jobs) != 1 {
+		t.Errorf("expected a single job by memory, got %+v, %v", top, err)
+	}
+
+	for _, args := range []TopJobsArgs{{By: "io"}, {Limit: -1}, {IntervalSeconds: -1}, {IntervalSeconds: 60}} {
+		if err := shellRunner.TopJobs(args, &top); Code(err) != CodeInvalidArgument {
+			t.Errorf("expected %+v to be rejected, got %v", args, err)
+		}
+	}
+}
+
+func TestHostOverloaded(t *testing.T) {
+	config := runner.DefaultConfig()
+	config.MinAvailableMemory = math.MaxUint64
+	shellRunner := setupWith(t, config)
+
+	var id string
+	if err := shellRunner.Background(BackgroundArgs{Command: "true"}, &id); Code(err) != CodeHostOverloaded {
+		t.Errorf("expected HOST_OVERLOADED without enough memory available, got %v", err)
+	}
+	var reply RunResult
+	if err := shellRunner.Run(RunArgs{Command: "true"}, &reply); Code(err) != CodeHostOverloaded {
+		t.Errorf("expected HOST_OVERLOADED from Run, got %v", err)
+	}
+
+	config.MinAvailableMemory = 0
+	config.MaxLoad = 1000
+	shellRunner = setupWith(t, config)
+	if err := shellRunner.Background(BackgroundArgs{Command: "true"}, &id); err != nil {
+		t.Errorf("expected jobs to be accepted below the limits, got %v", err)
+	}
+}
+
+func TestImportSubmitter(t *testing.T) {
+	srv := New(runner.NewManager(runner.DefaultConfig()))
+	alice := srv.receiver(srv.ctx, "1000")
+	mallory := srv.receiver(srv.ctx, "2000")
+
+	var reply RunResult
+	if err := alice.Run(RunArgs{Command: "true", Keep: true}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	var archive Archive
+	if err := alice.Export(struct{}{}, &archive); err != nil {
+		t.Fatal(err)
+	}
+	archive.Jobs = append(archive.Jobs, runner.JobRecord{ID: "forged", Command: "true", Status: "exited"})
+	var imported ImportResult
+	if err := mallory.Import(archive, &imported); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range imported.IDs {
+		var status JobStatus
+		if err := mallory.Status(id, &status); err != nil || status.Submitter == nil || status.Submitter.User != "2000" {
+			t.Errorf("expected job %s to be imported as the caller's, got %+v, %v", id, status.Submitter, err)
+		}
+	}
+	if archive.Jobs[0].Spec.Submitter.User != "1000" {
+		t.Error("expected the archive to be left as it was")
+	}
+}
+
+func TestRerunSubmitter(t *testing.T) {
+	srv := New(runner.NewManager(runner.DefaultConfig()))
+	srv.Quotas = Quotas{"uid:1000": {MaxRunning: 1}}
+	limited := srv.receiver(srv.ctx, "1000")
+	other := srv.receiver(srv.ctx, "2000")
+
+	var theirs, mine, rerun string
+	if err := other.Background(BackgroundArgs{Command: "sleep 5"}, &theirs); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Kill(KillArgs{ID: theirs}, new(bool))
+	if err := limited.Background(BackgroundArgs{Command: "sleep 5"}, &mine); err != nil {
+		t.Fatal(err)
+	}
+	if err := limited.Rerun(theirs, &rerun); Code(err) != CodeQuotaExceeded {
+		t.Fatalf("expected rerunning another's job to count against the caller's quota, got %v", err)
+	}
+
+	limited.Kill(KillArgs{ID: mine}, new(bool))
+	var status JobStatus
+	for start := time.Now(); (status.Status == "" || !status.Finished()) && time.Since(start) < 5*time.Second; {
+		if err := limited.Status(mine, &status); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := limited.Rerun(theirs, &rerun); err != nil {
+		t.Fatalf("expected the rerun to be admitted, got %v", err)
+	}
+	defer limited.Kill(KillArgs{ID: rerun}, new(bool))
+	if err := limited.Status(rerun, &status); err != nil || status.Submitter == nil || status.Submitter.User != "1000" || status.RerunOf != theirs {
+		t.Errorf("expected the rerun to be the caller's, got %+v, %v", status.Submitter, err)
+	}
+	var usage QuotaUsage
+	if err := other.Quota(struct{}{}, &usage); err != nil || usage.Running != 1 {
+		t.Errorf("expected the rerun not to count against the original submitter, got %+v, %v", usage, err)
+	}
+}
+
+// TestStopAdding checks that once a server stops adding jobs for an upgrade,
+// the calls adding them are refused at once while it waits for those in
+// progress.
+func TestStopAdding(t *testing.T) {
+	srv := New(runner.NewManager(runner.DefaultConfig()))
+	s := srv.receiver(srv.ctx, "1000")
+	running := make(chan error, 1)
+	go func() { running <- s.Invoke("Run", RunArgs{Command: "sleep 0.5", Keep: true}, &RunResult{}) }()
+	for start := time.Now(); len(srv.manager.List()) == 0 && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.stopAdding()
+		close(stopped)
+	}()
+	for !srv.HandedOver() {
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	var id string
+	if err := s.Invoke("Background", BackgroundArgs{Command: "true"}, &id); Code(err) != CodeUnavailable {
+		t.Errorf("expected UNAVAILABLE once the server stops adding jobs, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("expected the refusal not to wait for the Run in progress, took %v", elapsed)
+	}
+	select {
+	case <-stopped:
+		t.Error("expected stopAdding to wait for the Run in progress")
+	default:
+	}
+	if err := <-running; err != nil {
+		t.Errorf("expected the Run in progress to finish, got %v", err)
+	}
+	<-stopped
+}
+
+// TestForwardRunning checks that a server that took over from an upgraded
+// one forwards the calls for the jobs still running there.
+func TestForwardRunning(t *testing.T) {
+	old := New(runner.NewManager(runner.DefaultConfig()))
+	owner := old.receiver(old.ctx, "1000")
+	var id string
+	if err := owner.Invoke("Background", BackgroundArgs{Command: "sleep 5"}, &id); err != nil {
+		t.Fatal(err)
+	}
+	oldEnd, newEnd := net.Pipe()
+	go old.serveForwarded(oldEnd)
+	srv := New(runner.NewManager(runner.DefaultConfig()))
+	srv.predecessor = &predecessor{
+		client:  jsonrpc.NewClient(newEnd),
+		running: map[string]runner.Identity{id: {User: "1000"}},
+	}
+	defer srv.predecessor.close()
+
+	s := srv.receiver(srv.ctx, "1000")
+	var status JobStatus
+	if err := s.Invoke("Status", id, &status); err != nil || status.Status != "running" {
+		t.Errorf("expected the status of the job running on the old server, got %+v, %v", status, err)
+	}
+	other := srv.receiver(srv.ctx, "2000")
+	if err := other.Invoke("Status", id, &JobStatus{}); Code(err) != CodeJobNotFound {
+		t.Errorf("expected another tenant's call to be refused before it is forwarded, got %v", err)
+	}
+	if err := s.Invoke("Rerun", id, new(string)); Code(err) != CodeUnavailable {
+		t.Errorf("expected UNAVAILABLE for a Rerun of a job still running on the old server, got %v", err)
+	}
+	if err := s.Invoke("Kill", KillArgs{ID: id}, new(bool)); err != nil {
+		t.Errorf("expected the Kill to be forwarded, got %v", err)
+	}
+	if err := s.Invoke("Kill", KillArgs{ID: id, Signal: "BOGUS"}, new(bool)); Code(err) != CodeInvalidArgument {
+		t.Errorf("expected the old server's error code, got %v", err)
+	}
+
+	// Once the job is handed over, it is the new server's.
+	srv.predecessor.handedOver(id)
+	if err := s.Invoke("Status", id, &JobStatus{}); Code(err) != CodeJobNotFound {
+		t.Errorf("expected a job handed over to be looked up locally, got %v", err)
+	}
+}
+
+func TestStartFailure(t *testing.T) {
+	shellRunner := setup(t)
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	var result RunResult
+	if err := shellRunner.Run(RunArgs{Argv: []string{missing}}, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != "failed_to_start" || result.StartError == "" || result.Result != runner.ResultFailure {
+		t.Errorf("expected the run to fail to start, got %+v", result)
+	}
+	if err := shellRunner.Run(RunArgs{Command: "exit 3"}, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != "exited" || result.StartError != "" || result.ExitCode != 3 {
+		t.Errorf("expected the run to exit with code 3, got %+v", result)
+	}
+
+	var id string
+	if err := shellRunner.Background(BackgroundArgs{Argv: []string{missing}}, &id); err != nil {
+		t.Fatal(err)
+	}
+	var status JobStatus
+	for start := time.Now(); (status.Status == "" || !status.Finished()) && time.Since(start) < 5*time.Second; {
+		if err := shellRunner.Status(id, &status); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.Status != "failed_to_start" || !strings.Contains(status.StartError, missing) || !strings.HasPrefix(status.FailureReason, "failed to start") {
+		t.Errorf("expected the job to fail to start, got %+v", status)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	shellRunner := setup(t)
+
+	var result ValidateResult
+	if err := shellRunner.Validate(ValidateArgs{Command: "for f in *.log; do\n  gzip \"$f\"\ndone"}, &result); err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid || len(result.Errors) != 0 {
+		t.Errorf("expected the command to be valid, got %+v", result)
+	}
+	if err := shellRunner.Validate(ValidateArgs{Command: "echo ok\nif true; then\n  echo (\nfi"}, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Valid || len(result.Errors) != 1 || result.Errors[0].Line != 3 || result.Errors[0].Message == "" {
+		t.Errorf("expected a syntax error on line 3, got %+v", result)
+	}
+	// Validating a command never runs it.
+	marker := filepath.Join(t.TempDir(), "ran")
+	if err := shellRunner.Validate(ValidateArgs{Command: "touch " + marker}, &result); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("expected the command not to run")
+	}
+}
+
+func TestQuote(t *testing.T) {
+	shellRunner := setup(t)
+	argv := []string{"printf", "%s|", "two words", "it's", "$HOME", "", "*", "a;b", "--opt=x"}
+
+	var command string
+	if err := shellRunner.Quote(QuoteArgs{Argv: argv}, &command); err != nil {
+		t.Fatal(err)
+	}
+	if want := `printf '%s|' 'two words' 'it'\''s' '$HOME' '' '*' 'a;b' --opt=x`; command != want {
+		t.Errorf("expected %q, got %q", want, command)
+	}
+	var result RunResult
+	if err := shellRunner.Run(RunArgs{Command: command}, &result); err != nil {
+		t.Fatal(err)
+	}
+	if want := "two words|it's|$HOME||*|a;b|--opt=x|"; result.Stdout != want {
+		t.Errorf("expected the shell to get the arguments as they are, %q, got %q", want, result.Stdout)
+	}
+
+	if err := shellRunner.Quote(QuoteArgs{Argv: []string{"FOO=bar", "env"}}, &command); err != nil {
+		t.Fatal(err)
+	}
+	if command != "'FOO=bar' env" {
+		t.Errorf("expected a first word with = to be quoted, got %q", command)
+	}
+	if err := shellRunner.Quote(QuoteArgs{}, &command); Code(err) != CodeInvalidArgument {
+		t.Errorf("expected INVALID_ARGUMENT for an empty argv, got %v", err)
+	}
+}
+
+// TestRecordedOptions checks that a job's status records all the options it
+// was run with, leaving out the values of its environment, its stdin and its
+// secrets.
+func TestRecordedOptions(t *testing.T) {
+	shellRunner := setup(t)
+	var ok bool
+	if err := shellRunner.SetSecret(SecretArgs{Name: "token", Value: "hunter2"}, &ok); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	args := BackgroundArgs{
+		Command: `cat && test -n "$TOKEN"`,
+		Env:     map[string]string{"GREETING": "hello", "PASSWORD": "sw0rdfish"},
+		Secrets: map[string]string{"TOKEN": "token"},
+		Dir:     dir,
+		Stdin:   "correct horse",
+		Timeout: 30,
+		Labels:  map[string]string{"team": "infra"},
+		Success: &SuccessOptions{ExitCodes: []int{0, 1}},
+	}
+	var id string
+	if err := shellRunner.Background(args, &id); err != nil {
+		t.Fatal(err)
+	}
+	var status JobStatus
+	for start := time.Now(); (status.Status == "" || !status.Finished()) && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		if err := shellRunner.Status(id, &status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts := status.Options
+	if opts == nil || opts.Command != args.Command || !slices.Equal(opts.Env, []string{"GREETING", "PASSWORD"}) || opts.Dir != dir || opts.Timeout != 30 || opts.Labels["team"] != "infra" {
+		t.Fatalf("expected the status to record the job's options, got %+v", opts)
+	}
+	if opts.StdinBytes != len(args.Stdin) || opts.StdinSHA256 != fmt.Sprintf("%x", sha256.Sum256([]byte(args.Stdin))) {
+		t.Errorf("expected stdin to be recorded by length and digest, got %d bytes, %q", opts.StdinBytes, opts.StdinSHA256)
+	}
+	if opts.Success == nil || !slices.Equal(opts.Success.ExitCodes, []int{0, 1}) {
+		t.Errorf("expected the success criteria to be recorded, got %+v", opts.Success)
+	}
+	if status.Shell == "" {
+		t.Error("expected the shell that ran the command to be recorded")
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"hunter2", "hello", "sw0rdfish", "correct horse"} {
+		if strings.Contains(string(data), value) {
+			t.Errorf("expected %q to be left out of the status, got %s", value, data)
+		}
+	}
+	for _, want := range []string{`"secrets":{"TOKEN":"token"}`, `"env":["GREETING","PASSWORD"]`, `"stdin_bytes":13`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("expected %s in the status, got %s", want, data)
+		}
+	}
+}
+
+// TestShell contains unit tests for selecting the command interpreter.
+func TestShell(t *testing.T) {
+	shellRunner := setup(t)
+	defer runner.SetShell(runner.DefaultShell)
+
+	if err := runner.SetShell("fish-and-chips"); err == nil {
+		t.Error("expected an error when selecting an unknown shell")
+	}
+
+	if err := runner.SetShell("sh"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var reply RunResult
+	err := shellRunner.Run(RunArgs{Command: `echo "$0"`}, &reply)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if reply.Stdout != "sh\n" {
+		t.Errorf("expected command to run under sh, got %q", reply.Stdout)
+	}
+}
+
+// TestPty contains unit tests for running jobs under a pseudo-terminal.
+func TestPty(t *testing.T) {
+	shellRunner := setup(t)
+
+	t.Run("run", func(t *testing.T) {
+		var reply RunResult
+		args := RunArgs{Command: "test -t 1 && stty size", TerminalOptions: runner.TerminalOptions{Pty: true, Rows: 30, Cols: 100}}
+		err := shellRunner.Run(args, &reply)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if reply.Stdout != "30 100\r\n" {
+			t.Errorf("expected stdout '30 100\\r\\n', got %q", reply.Stdout)
+		}
+		if reply.ExitCode != 0 {
+			t.Errorf("expected exit code 0, got %v", reply.ExitCode)
+		}
+	})
+
+	t.Run("resize", func(t *testing.T) {
+		var id string
+		args := BackgroundArgs{Command: "sleep 0.2; stty size", TerminalOptions: runner.TerminalOptions{Pty: true}}
+		if err := shellRunner.Background(args, &id); err != nil {
+			t.Fatalf("background failed: %v", err)
+		}
+
+		var resized bool
+		if err := shellRunner.Resize(ResizeArgs{ID: id, Rows: 40, Cols: 120}, &resized); err != nil {
+			t.Fatalf("resize failed: %v", err)
+		}
+		if !resized {
+			t.Error("expected resize to return true")
+		}
+		time.Sleep(300 * time.Millisecond) // allow command to finish
+
+		var reply JobOutput
+		if err := shellRunner.Output(OutputArgs{ID: id}, &reply); err != nil {
+			t.Fatalf("output failed: %v", err)
+		}
+		if reply.Stdout != "40 120\r\n" {
+			t.Errorf("expected stdout '40 120\\r\\n', got %q", reply.Stdout)
+		}
+
+		// The terminal is gone once the job has exited.
+		if err := shellRunner.Resize(ResizeArgs{ID: id, Rows: 10, Cols: 10}, &resized); err == nil {
+			t.Error("expected an error when resizing a finished job")
+		}
+	})
+
+	t.Run("without pty", func(t *testing.T) {
+		var id string
+		if err := shellRunner.Background(BackgroundArgs{Command: "sleep 0.1"}, &id); err != nil {
+			t.Fatalf("background failed: %v", err)
+		}
+		var resized bool
+		if err := shellRunner.Resize(ResizeArgs{ID: id, Rows: 10, Cols: 10}, &resized); err == nil {
+			t.Error("expected an error when resizing a job without a terminal")
+		}
+	})
+}
+
+// TestExec contains unit tests for interactive Exec sessions.
+func TestExec(t *testing.T) {
+	shellRunner := setup(t)
+
+	t.Run("attach", func(t *testing.T) {
+		var id string
+		err := shellRunner.Exec(ExecArgs{Command: `read line; echo "got $line"`}, &id)
+		if err != nil {
+			t.Fatalf("exec failed: %v", err)
+		}
+
+		server, client := net.Pipe()
+		go New(shellRunner.manager).ServeConn(server)
+		go fmt.Fprintf(client, "EXEC %s\nhello\n", id)
+
+		// The server closes the connection once the job exits.
+		out, _ := io.ReadAll(client)
+		if !strings.Contains(string(out), "got hello") {
+			t.Errorf("expected session output to contain 'got hello', got %q", out)
+		}
+
+		var reply JobStatus
+		if err := shellRunner.Status(id, &reply); err != nil {
+			t.Fatalf("status failed: %v", err)
+		}
+		if reply.Status != "exited" || reply.ExitCode == nil || *reply.ExitCode != 0 {
+			t.Errorf("expected session to exit with code 0, got %v", reply)
+		}
+	})
+
+	t.Run("hang up", func(t *testing.T) {
+		var id string
+		if err := shellRunner.Exec(ExecArgs{Command: "sleep 5"}, &id); err != nil {
+			t.Fatalf("exec failed: %v", err)
+		}
+
+		server, client := net.Pipe()
+		go New(shellRunner.manager).ServeConn(server)
+		fmt.Fprintf(client, "EXEC %s\n", id)
+		client.Close()
+		time.Sleep(200 * time.Millisecond) // allow the terminal to hang up
+
+		var reply JobStatus
+		if err := shellRunner.Status(id, &reply); err != nil {
+			t.Fatalf("status failed: %v", err)
+		}
+		if reply.Status == "running" {
+			t.Error("expected session to end when the client disconnects")
+		}
+	})
+
+	t.Run("not a session", func(t *testing.T) {
+		var id string
+		if err := shellRunner.Background(BackgroundArgs{Command: "sleep 0.1"}, &id); err != nil {
+			t.Fatalf("background failed: %v", err)
+		}
+
+		server, client := net.Pipe()
+		go New(shellRunner.manager).ServeConn(server)
+		go fmt.Fprintf(client, "EXEC %s\n", id)
+		out, _ := io.ReadAll(client)
+		if !strings.Contains(string(out), "not a running session") {
+			t.Errorf("expected an error attaching to a non-session job, got %q", out)
+		}
+	})
+}
+
+// TestLimits contains unit tests for per-job resource limits.
+func TestLimits(t *testing.T) {
+	shellRunner := setup(t)
+
+	t.Run("applied", func(t *testing.T) {
+		var reply RunResult
+		limits := runner.ResourceLimits{AS: 1 << 30, NoFile: 64}
+		err := shellRunner.Run(RunArgs{Command: "ulimit -v; ulimit -n", Limits: limits}, &reply)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if reply.Stdout != "1048576\n64\n" {
+			t.Errorf("expected limits to be applied, got %q", reply.Stdout)
+		}
+		if reply.LimitExceeded != "" {
+			t.Error("did not expect limit_exceeded for a job within its limits")
+		}
+	})
+
+	t.Run("argv", func(t *testing.T) {
+		var reply RunResult
+		limits := runner.ResourceLimits{NoFile: 32}
+		err := shellRunner.Run(RunArgs{Argv: []string{"sh", "-c", "ulimit -n"}, Limits: limits}, &reply)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if reply.Stdout != "32\n" {
+			t.Errorf("expected limits to be applied to argv jobs, got %q", reply.Stdout)
+		}
+	})
+
+	t.Run("file size", func(t *testing.T) {
+		var id string
+		command := "head -c 100000 /dev/zero > " + t.TempDir() + "/out"
+		err := shellRunner.Background(BackgroundArgs{Command: command, Limits: runner.ResourceLimits{FSize: 4096}}, &id)
+		if err != nil {
+			t.Fatalf("background failed: %v", err)
+		}
+		time.Sleep(200 * time.Millisecond) // allow command to finish
+
+		var reply JobStatus
+		if err := shellRunner.Status(id, &reply); err != nil {
+			t.Fatalf("status failed: %v", err)
+		}
+		if reply.LimitExceeded != "fsize" {
+			t.Errorf("expected limit_exceeded to be 'fsize', got %v", reply.LimitExceeded)
+		}
+	})
+
+	t.Run("cpu", func(t *testing.T) {
+		var reply RunResult
+		err := shellRunner.Run(RunArgs{Command: "while :; do :; done", Limits: runner.ResourceLimits{CPU: 1}}, &reply)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if reply.LimitExceeded != "cpu" {
+			t.Errorf("expected limit_exceeded to be 'cpu', got %v", reply.LimitExceeded)
+		}
+	})
+}
+
+// TestCgroup contains unit tests for placing jobs into cgroups.
+func TestCgroup(t *testing.T) {
+	shellRunner := setup(t)
+
+	var reply RunResult
+	err := shellRunner.Run(RunArgs{Command: "true", Cgroup: runner.CgroupLimits{Memory: 1 << 30}}, &reply)
+	if err == nil {
+		t.Error("expected an error when setting cgroup limits without a cgroup root")
+	}
+
+	// Find a writable cgroup v2 hierarchy to create the test's root under.
+	mounts, _ := os.ReadFile("/proc/self/mounts")
+	var mountPoint string
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 2 && fields[2] == "cgroup2" {
+			mountPoint = fields[1]
+		}
+	}
+	if mountPoint == "" {
+		t.Skip("no cgroup v2 hierarchy is mounted")
+	}
+	root := filepath.Join(mountPoint, fmt.Sprintf("shellrunner-test-%d", os.Getpid()))
+	if err := runner.SetCgroupRoot(root); err != nil {
+		t.Skipf("cannot create a cgroup root: %v", err)
+	}
+	defer func() {
+		runner.SetCgroupRoot("")
+		os.Remove(root)
+	}()
+
+	var id string
+	err = shellRunner.Background(BackgroundArgs{Command: "cat /proc/self/cgroup; i=0; while [ $i -lt 100000 ]; do i=$((i+1)); done"}, &id)
+	if err != nil {
+		t.Fatalf("background failed: %v", err)
+	}
+
+	var status JobStatus
+	if err := shellRunner.Status(id, &status); err != nil {
+		t.Fatalf("status failed: %v", err)
+	}
+	path := status.Cgroup
+	if filepath.Dir(path) != root {
+		t.Fatalf("expected the job's cgroup to be under %s, got %v", root, status.Cgroup)
+	}
+
+	// The cgroup is removed after the job is recorded as finished, so both
+	// are waited for.
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := shellRunner.Status(id, &status); err != nil {
+			t.Fatalf("status failed: %v", err)
+		}
+		if _, err := os.Stat(path); status.Finished() && os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	var output JobOutput
+	if err := shellRunner.Output(OutputArgs{ID: id}, &output); err != nil {
+		t.Fatalf("output failed: %v", err)
+	}
+	if !strings.Contains(output.Stdout, filepath.Base(path)) {
+		t.Errorf("expected the job to run in cgroup %s, got %q", path, output.Stdout)
+	}
+	if !status.Finished() || status.CPUSeconds <= 0 {
+		t.Errorf("expected cpu_seconds to be recorded, got %v", status.CPUSeconds)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the job's cgroup to be removed once it exited, got %v", err)
+	}
+}
+
+// TestPriority contains unit tests for the Nice and IONice options.
+func TestPriority(t *testing.T) {
+	shellRunner := setup(t)
+
+	t.Run("applied", func(t *testing.T) {
+		var id string
+		err := shellRunner.Background(BackgroundArgs{Command: "nice; ionice", Nice: 5, IONice: "best-effort:7"}, &id)
+		if err != nil {
+			t.Fatalf("background failed: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond) // allow command to finish
+
+		var output JobOutput
+		if err := shellRunner.Output(OutputArgs{ID: id}, &output); err != nil {
+			t.Fatalf("output failed: %v", err)
+		}
+		if output.Stdout != "5\nbest-effort: prio 7\n" {
+			t.Errorf("expected priorities to be applied, got %q", output.Stdout)
+		}
+
+		var status JobStatus
+		if err := shellRunner.Status(id, &status); err != nil {
+			t.Fatalf("status failed: %v", err)
+		}
+		if status.Nice != 5 || status.IONice != "best-effort:7" {
+			t.Errorf("expected status to report the priorities, got %v", status)
+		}
+	})
+
+	t.Run("idle with limits", func(t *testing.T) {
+		var reply RunResult
+		args := RunArgs{Argv: []string{"ionice"}, IONice: "idle", Limits: runner.ResourceLimits{NoFile: 64}}
+		if err := shellRunner.Run(args, &reply); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if reply.Stdout != "idle\n" {
+			t.Errorf("expected stdout 'idle\\n', got %q", reply.Stdout)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, args := range []RunArgs{
+			{Command: "true", Nice: 20},
+			{Command: "true", IONice: "urgent"},
+			{Command: "true", IONice: "best-effort:8"},
+			{Command: "true", IONice: "idle:1"},
+		} {
+			var reply RunResult
+			if err := shellRunner.Run(args, &reply); err == nil {
+				t.Errorf("expected an error for nice %d and ionice %q", args.Nice, args.IONice)
+			}
+		}
+	})
+}
+
+// TestCPUSet contains unit tests for the CPUSet option.
+func TestCPUSet(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("CPU sets are only supported on Linux")
+	}
+	shellRunner := setup(t)
+
+	t.Run("applied", func(t *testing.T) {
+		var reply RunResult
+		if err := shellRunner.Run(RunArgs{Command: "grep Cpus_allowed_list /proc/self/status", CPUSet: "0", Keep: true}, &reply); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !strings.HasSuffix(reply.Stdout, "\t0\n") {
+			t.Errorf("expected the job to run on CPU 0 only, got %q", reply.Stdout)
+		}
+		var status JobStatus
+		if err := shellRunner.Status(reply.JobID, &status); err != nil {
+			t.Fatalf("status failed: %v", err)
+		}
+		if status.CPUSet != "0" {
+			t.Errorf("expected status to report the CPU set, got %q", status.CPUSet)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, cpuset := range []string{"x", "3-1", "2,1", "0,", "-1", "4096", "4095"} {
+			var reply RunResult
+			if err := shellRunner.Run(RunArgs{Command: "true", CPUSet: cpuset}, &reply); Code(err) != CodeInvalidArgument {
+				t.Errorf("expected INVALID_ARGUMENT for CPU set %q, got %v", cpuset, err)
+			}
+		}
+	})
+}
+
+// TestSandbox contains unit tests for running jobs in a bubblewrap sandbox.
+func TestSandbox(t *testing.T) {
+	shellRunner := setup(t)
+
+	t.Run("run", func(t *testing.T) {
+		var reply RunResult
+		args := RunArgs{Command: "ls -A /tmp; touch /sandbox-test", Sandbox: &runner.SandboxOptions{NoNetwork: true}}
+		err := shellRunner.Run(args, &reply)
+		if _, lookErr := exec.LookPath("bwrap"); lookErr != nil {
+			if err == nil {
+				t.Error("expected an error when bubblewrap is not installed")
+			}
+			t.Skip("bubblewrap is not installed")
+		}
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if reply.Stdout != "" {
+			t.Errorf("expected a private, empty /tmp, got %q", reply.Stdout)
+		}
+		if reply.ExitCode == 0 {
+			t.Error("expected the root filesystem to be read-only")
+		}
+	})
+}
+
+// TestKill contains unit tests for the Kill method.
+func TestKill(t *testing.T) {
+	shellRunner := setup(t)
+	var id string
+	// The subshell keeps stdout open, so the job only ends once the whole
+	// process group is gone.
+	err := shellRunner.Background(BackgroundArgs{Command: "(sleep 30); echo done"}, &id)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	var killed bool
+	if err := shellRunner.Kill(KillArgs{ID: id, Signal: "BOGUS"}, &killed); err == nil {
+		t.Error("expected an error for an unknown signal")
+	}
+	if err := shellRunner.Kill(KillArgs{ID: id, Signal: "term"}, &killed); err != nil || !killed {
+		t.Fatalf("expected the job to be killed, got %v", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	var reply JobStatus
+	if err := shellRunner.Status(id, &reply); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if reply.Status == "running" {
+		t.Fatal("expected the job to have finished")
+	}
+	if err := shellRunner.Kill(KillArgs{ID: id}, &killed); err == nil {
+		t.Error("expected an error when killing a finished job")
+	}
+	if err := shellRunner.Kill(KillArgs{ID: "999"}, &killed); err == nil {
+		t.Error("expected an error for a non-existent job")
+	}
+}
+
+// TestSSH contains unit tests for the ssh executor and for starting a group
+// of jobs on several hosts. A stand-in for the ssh client runs the remote
+// command locally.
+func TestSSH(t *testing.T) {
+	bin := t.TempDir()
+	fake := "#!/bin/sh\nfor arg; do command=$arg; done\nexec sh -c \"$command\"\n"
+	if err := os.WriteFile(filepath.Join(bin, "ssh"), []byte(fake), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	path := filepath.Join(t.TempDir(), "hosts.json")
+	hosts := `{"web1": {"address": "10.0.0.1", "user": "deploy", "port": 2222, "identityfile": "/keys/id"}, "web2": {"address": "10.0.0.2"}}`
+	if err := os.WriteFile(path, []byte(hosts), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := runner.DefaultConfig()
+	if err := config.LoadSSHHosts(path); err != nil {
+		t.Fatalf("loading hosts failed: %v", err)
+	}
+	shellRunner := setupWith(t, config)
+
+	t.Run("run", func(t *testing.T) {
+		var reply RunResult
+		if err := shellRunner.Run(RunArgs{Argv: []string{"echo", "it's"}, Host: "web2"}, &reply); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if reply.Stdout != "it's\n" {
+			t.Errorf("expected the argv to survive remote quoting, got %q", reply.Stdout)
+		}
+	})
+
+	t.Run("group", func(t *testing.T) {
+		var id string
+		if err := shellRunner.Background(BackgroundArgs{Command: "echo hi", Hosts: []string{"web1", "db1"}}, &id); err == nil {
+			t.Error("expected an error for a group with an unknown host")
+		}
+		if err := shellRunner.Background(BackgroundArgs{Command: "echo hi", Hosts: []string{"web1", "web2"}}, &id); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !strings.HasPrefix(id, "group-") {
+			t.Fatalf("expected a group id, got %q", id)
+		}
+
+		time.Sleep(200 * time.Millisecond)
+		var reply GroupStatus
+		if err := shellRunner.Group(id, &reply); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if reply.Status != "exited" {
+			t.Errorf("expected the group to have finished, got %v", reply.Status)
+		}
+		entries := reply.Jobs
+		if len(entries) != 2 || entries[0].Host != "web1" || entries[1].Host != "web2" {
+			t.Fatalf("expected a job per host, got %v", entries)
+		}
+
+		var status JobStatus
+		if err := shellRunner.Status(entries[1].ID, &status); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if status.Group != id || status.Host != "web2" || status.Executor != "ssh" {
+			t.Errorf("expected the job to report its host and group, got %v", status)
+		}
+		if err := shellRunner.Group("group-999", &reply); err == nil {
+			t.Error("expected an error for a non-existent group")
+		}
+	})
+
+	t.Run("partial failure", func(t *testing.T) {
+		shellRunner.manager.BeforeStart(func(spec *runner.JobSpec) error {
+			if spec.Host == "web2" {
+				return errors.New("web2 is down")
+			}
+			return nil
+		})
+		var id string
+		if err := shellRunner.Background(BackgroundArgs{Command: "sleep 5", Hosts: []string{"web1", "web2"}}, &id); Code(err) != CodePolicyDenied {
+			t.Fatalf("expected the group to fail on web2, got %v", err)
+		}
+		for _, record := range shellRunner.manager.Export() {
+			if record.Command == "sleep 5" {
+				t.Errorf("expected the job started on web1 to be killed and released, got job %s %s", record.ID, record.Status)
+			}
+		}
+	})
+}
+
+// TestErrors checks that errors carry a code matching their cause.
+func TestErrors(t *testing.T) {
+	shellRunner := setup(t)
+
+	var done RunResult
+	if err := shellRunner.Run(RunArgs{Command: "true", Keep: true}, &done); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	tests := []struct {
+		name string
+		call func() error
+		code ErrorCode
+	}{
+		{"unknown job", func() error { var r JobStatus; return shellRunner.Status("999", &r) }, CodeJobNotFound},
+		{"unknown group", func() error { var r GroupStatus; return shellRunner.Group("group-999", &r) }, CodeGroupNotFound},
+		{"invalid spec", func() error {
+			var r RunResult
+			return shellRunner.Run(RunArgs{Command: "true", Argv: []string{"true"}}, &r)
+		}, CodeInvalidArgument},
+		{"unknown signal", func() error { var r bool; return shellRunner.Kill(KillArgs{ID: done.JobID, Signal: "BOGUS"}, &r) }, CodeInvalidArgument},
+		{"finished job", func() error { var r bool; return shellRunner.Kill(KillArgs{ID: done.JobID}, &r) }, CodeInvalidState},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			if code := Code(err); code != tt.code {
+				t.Fatalf("expected code %s, got %s (%v)", tt.code, code, err)
+			}
+			// The error survives the trip through the JSON-RPC error field.
+			if parsed := ParseError(err.Error()); parsed.Code != tt.code || parsed.Message != err.(*Error).Message {
+				t.Errorf("expected %v to decode with code %s, got %+v", err, tt.code, parsed)
+			}
+		})
+	}
+
+	if parsed := ParseError("plain message"); parsed.Code != CodeInternal || parsed.Message != "plain message" {
+		t.Errorf("expected a plain message to decode as an internal error, got %+v", parsed)
+	}
+}
+
+// TestCancel contains unit tests for cancelling synchronous runs when their
+// client disconnects or the server shuts down.
+func TestCancel(t *testing.T) {
+	t.Run("disconnect", func(t *testing.T) {
+		manager := runner.NewManager(runner.DefaultConfig())
+		server, client := net.Pipe()
+		go New(manager).ServeConn(server)
+
+		c := jsonrpc.NewClient(client)
+		c.Go("ShellRunner.Run", RunArgs{Command: "sleep 5", Keep: true, CancelOnDisconnect: true}, &RunResult{}, nil)
+		time.Sleep(200 * time.Millisecond)
+		start := time.Now()
+		c.Close()
+
+		// The kept job is held from when it starts, so wait for it to end.
+		finished := func() bool {
+			list := manager.List()
+			return len(list) == 1 && list[0].Status != "running"
+		}
+		for time.Since(start) < 2*time.Second && !finished() {
+			time.Sleep(20 * time.Millisecond)
+		}
+		list := manager.List()
+		if len(list) != 1 || list[0].Status == "running" {
+			t.Fatalf("expected the run to be killed when its client disconnected, got %v", list)
+		}
+		manager.WithJob(list[0].ID, func(job *runner.Job) error {
+			if job.ExitCode == 0 {
+				t.Errorf("expected the killed command to fail, got exit code %d", job.ExitCode)
+			}
+			return nil
+		})
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		socketPath, err := DefaultSocketPath()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(filepath.Dir(socketPath))
+		listener, err := Listen(socketPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := New(runner.NewManager(runner.DefaultConfig()))
+		served := make(chan error, 1)
+		go func() { served <- srv.Serve(listener) }()
+
+		conn, err := net.Dial("unix", socketPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := jsonrpc.NewClient(conn)
+		defer c.Close()
+		call := c.Go("ShellRunner.Run", RunArgs{Command: "sleep 5"}, &RunResult{}, nil)
+		time.Sleep(200 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			t.Fatalf("expected the run to be cancelled at shutdown, got %v", err)
+		}
+		<-call.Done
+		if code := ParseError(call.Error.Error()).Code; code != CodeCancelled {
+			t.Errorf("expected a %s error, got %v", CodeCancelled, call.Error)
+		}
+		if err := <-served; !errors.Is(err, net.ErrClosed) {
+			t.Errorf("expected Serve to return once its listener closed, got %v", err)
+		}
+	})
+}
+
+// TestTimeouts contains unit tests for call deadlines and slow-call
+// thresholds.
+func TestTimeouts(t *testing.T) {
+	t.Run("parse", func(t *testing.T) {
+		durations, err := ParseDurations("Run=10m, *=5s")
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if durations["Run"] != 10*time.Minute || lookupDuration(durations, "Status") != 5*time.Second {
+			t.Errorf("unexpected durations: %v", durations)
+		}
+		for _, list := range []string{"Run", "Run=forever", "=5s", "Run=-1s"} {
+			if _, err := ParseDurations(list); err == nil {
+				t.Errorf("expected an error parsing %q", list)
+			}
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		srv := New(runner.NewManager(runner.DefaultConfig()))
+		srv.Timeouts = map[string]time.Duration{"Run": 300 * time.Millisecond}
+		srv.SlowCalls = map[string]time.Duration{"*": 50 * time.Millisecond}
+		server, client := net.Pipe()
+		go srv.ServeConn(server)
+		c := jsonrpc.NewClient(client)
+		defer c.Close()
+
+		start := time.Now()
+		err := c.Call("ShellRunner.Run", RunArgs{Command: "sleep 5"}, &RunResult{})
+		if err == nil || ParseError(err.Error()).Code != CodeTimeout {
+			t.Fatalf("expected a %s error, got %v", CodeTimeout, err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("expected the run to be killed at its deadline, took %v", elapsed)
+		}
+
+		if err := c.Call("ShellRunner.Run", RunArgs{Command: "sleep 0.1"}, &RunResult{}); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		var stats Stats
+		if err := c.Call("ShellRunner.Statistics", struct{}{}, &stats); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if stats.TimedOutCalls != 1 || stats.SlowCalls != 2 {
+			t.Errorf("expected 1 timed out and 2 slow calls, got %d and %d", stats.TimedOutCalls, stats.SlowCalls)
+		}
+	})
+}
+
+// TestRateLimit contains unit tests for limiting the rate of job
+// submissions.
+func TestRateLimit(t *testing.T) {
+	t.Run("parse", func(t *testing.T) {
+		limits, err := ParseRateLimits("global=100, connection=0.5:3, user=2")
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if limits.Global != (Rate{100, 100}) || limits.Connection != (Rate{0.5, 3}) || limits.User != (Rate{2, 2}) {
+			t.Errorf("unexpected limits: %+v", limits)
+		}
+		for _, list := range []string{"global", "global=0", "global=1:0", "host=1"} {
+			if _, err := ParseRateLimits(list); err == nil {
+				t.Errorf("expected an error parsing %q", list)
+			}
+		}
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		srv := New(runner.NewManager(runner.DefaultConfig()))
+		srv.RateLimits = RateLimits{Connection: Rate{0.1, 2}, User: Rate{0.1, 3}}
+		first := srv.receiver(srv.ctx, "1000")
+		second := srv.receiver(srv.ctx, "1000")
+
+		var id string
+		for i := 0; i < 2; i++ {
+			if err := first.Invoke("Background", BackgroundArgs{Command: "true"}, &id); err != nil {
+				t.Fatalf("expected submission %d to be admitted, got %v", i, err)
+			}
+		}
+		err := first.Invoke("Background", BackgroundArgs{Command: "true"}, &id)
+		var e *Error
+		if !errors.As(err, &e) || e.Code != CodeRateLimited || e.Details["scope"] != "connection" {
+			t.Fatalf("expected the connection limit to be hit, got %v", err)
+		}
+		if retry, _ := e.Details["retry_after_seconds"].(float64); retry <= 0 {
+			t.Errorf("expected a retry delay, got %v", e.Details)
+		}
+
+		// Connections of the same user share the user's allowance.
+		if err := second.Invoke("Run", RunArgs{Command: "true"}, &RunResult{}); err != nil {
+			t.Fatalf("expected the submission to be admitted, got %v", err)
+		}
+		err = second.Invoke("Exec", ExecArgs{Command: "true"}, &id)
+		if !errors.As(err, &e) || e.Details["scope"] != "user" {
+			t.Fatalf("expected the user limit to be hit, got %v", err)
+		}
+
+		var stats Stats
+		first.Statistics(struct{}{}, &stats)
+		if stats.RateLimitedCalls != 2 {
+			t.Errorf("expected 2 rate limited calls, got %d", stats.RateLimitedCalls)
+		}
+	})
+
+	t.Run("token identities", func(t *testing.T) {
+		srv := New(runner.NewManager(runner.DefaultConfig()))
+		srv.RateLimits = RateLimits{User: Rate{0.1, 1}}
+		withToken := func(token string) *ShellRunner {
+			s := srv.receiver(srv.ctx, "1000")
+			s.conn = &connection{user: "1000", token: token}
+			return s
+		}
+
+		// Clients authenticating with different tokens are different
+		// users, even when the server sees the same peer behind them.
+		var id string
+		for _, token := range []string{"deploy", "ci"} {
+			if err := withToken(token).Invoke("Background", BackgroundArgs{Command: "true"}, &id); err != nil {
+				t.Fatalf("expected the submission with token %s to be admitted, got %v", token, err)
+			}
+		}
+		err := withToken("deploy").Invoke("Background", BackgroundArgs{Command: "true"}, &id)
+		var e *Error
+		if !errors.As(err, &e) || e.Details["scope"] != "user" {
+			t.Fatalf("expected the user limit of token deploy to be hit, got %v", err)
+		}
+	})
+
+	t.Run("rejected calls", func(t *testing.T) {
+		srv := New(runner.NewManager(runner.DefaultConfig()))
+		srv.RateLimits = RateLimits{Global: Rate{0.1, 1}, Connection: Rate{0.1, 2}}
+		s := srv.receiver(srv.ctx, "1000")
+
+		var id string
+		if err := s.Invoke("Background", BackgroundArgs{Command: "true"}, &id); err != nil {
+			t.Fatalf("expected the submission to be admitted, got %v", err)
+		}
+		var e *Error
+		if err := s.Invoke("Background", BackgroundArgs{Command: "true"}, &id); !errors.As(err, &e) || e.Details["scope"] != "global" {
+			t.Fatalf("expected the global limit to be hit, got %v", err)
+		}
+		// The call the global limit rejected used none of the connection's
+		// allowance.
+		srv.mu.Lock()
+		srv.globalBucket = newTokenBucket(srv.RateLimits.Global)
+		srv.mu.Unlock()
+		if err := s.Invoke("Background", BackgroundArgs{Command: "true"}, &id); err != nil {
+			t.Errorf("expected the connection to have allowance left, got %v", err)
+		}
+	})
+
+	t.Run("peer user", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("peer credentials are only read on Linux")
+		}
+		socketPath, err := DefaultSocketPath()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(filepath.Dir(socketPath))
+		listener, err := Listen(socketPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		client, err := net.Dial("unix", socketPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if user := peerUser(conn); user != fmt.Sprint(os.Getuid()) {
+			t.Errorf("expected the peer to be user %d, got %q", os.Getuid(), user)
+		}
+	})
+}
+
+func TestPayloadLimits(t *testing.T) {
+	limits, err := ParsePayloadLimits("command=10, env-vars=2,env=20,stdin=5,request=4096")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits != (PayloadLimits{MaxRequestBytes: 4096, MaxCommandBytes: 10, MaxEnvVars: 2, MaxEnvBytes: 20, MaxStdinBytes: 5}) {
+		t.Errorf("unexpected limits: %+v", limits)
+	}
+	if limits, err := ParsePayloadLimits("stdin=0"); err != nil || limits.MaxStdinBytes != 0 || limits.MaxCommandBytes != DefaultPayloadLimits.MaxCommandBytes {
+		t.Errorf("expected only the stdin limit to be lifted, got %+v, %v", limits, err)
+	}
+	for _, list := range []string{"command", "command=-1", "output=10"} {
+		if _, err := ParsePayloadLimits(list); err == nil {
+			t.Errorf("expected an error parsing %q", list)
+		}
+	}
+
+	srv := New(runner.NewManager(runner.DefaultConfig()))
+	srv.PayloadLimits = limits
+	s := srv.receiver(srv.ctx, "")
+	for _, tc := range []struct {
+		limit string
+		opts  JobOptions
+	}{
+		{"max_command_bytes", JobOptions{Command: "echo 0123456789"}},
+		{"max_command_bytes", JobOptions{Argv: []string{"echo", "0123456789"}}},
+		{"max_env_vars", JobOptions{Command: "true", Env: map[string]string{"A": "1", "B": "2"}, Secrets: map[string]string{"C": "c"}}},
+		{"max_env_bytes", JobOptions{Command: "true", Env: map[string]string{"A": "01234567890123456789"}}},
+		{"max_stdin_bytes", JobOptions{Command: "cat", Stdin: "012345"}},
+	} {
+		var e *Error
+		err := s.Run(tc.opts, &RunResult{})
+		if !errors.As(err, &e) || e.Code != CodeInvalidArgument || e.Details["limit"] != tc.limit {
+			t.Errorf("%+v: expected the %s limit to be exceeded, got %v", tc.opts, tc.limit, err)
+		}
+		if err := s.Background(tc.opts, new(string)); Code(err) != CodeInvalidArgument {
+			t.Errorf("%+v: expected Background to refuse the job too, got %v", tc.opts, err)
+		}
+	}
+	if err := s.Run(RunArgs{Command: "cat", Stdin: "01234", Env: map[string]string{"A": "1"}}, &RunResult{}); err != nil {
+		t.Errorf("expected a job within the limits to run, got %v", err)
+	}
+	if err := s.Validate(ValidateArgs{Command: "echo 0123456789"}, &ValidateResult{}); Code(err) != CodeInvalidArgument {
+		t.Errorf("expected Validate to refuse a long command, got %v", err)
+	}
+
+	server, client := net.Pipe()
+	go srv.ServeConn(server)
+	c := jsonrpc.NewClient(client)
+	defer c.Close()
+	// The limit applies to each request, not to the connection.
+	for range 10 {
+		if err := c.Call("ShellRunner.Validate", ValidateArgs{Command: strings.Repeat("x", 1000)}, &ValidateResult{}); err == nil || ParseError(err.Error()).Code != CodeInvalidArgument {
+			t.Fatalf("expected the command to be refused, got %v", err)
+		}
+	}
+	if err := c.Call("ShellRunner.Validate", ValidateArgs{Command: strings.Repeat("x", 10000)}, &ValidateResult{}); err == nil {
+		t.Fatal("expected a request over the limit to fail")
+	}
+	if err := c.Call("ShellRunner.Ping", struct{}{}, &Pong{}); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+}
+
+func TestConnections(t *testing.T) {
+	// connect serves a new in-memory connection, closing done when the server
+	// is finished with it.
+	connect := func(srv *Server) (*rpc.Client, chan struct{}) {
+		server, client := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			srv.ServeConn(server)
+			close(done)
+		}()
+		return jsonrpc.NewClient(client), done
+	}
+
+	t.Run("limit", func(t *testing.T) {
+		srv := New(runner.NewManager(runner.DefaultConfig()))
+		srv.MaxConnections = 1
+		first, _ := connect(srv)
+		defer first.Close()
+		var conns []ConnectionInfo
+		if err := first.Call("ShellRunner.Connections", struct{}{}, &conns); err != nil {
+			t.Fatal(err)
+		}
+
+		second, done := connect(srv)
+		defer second.Close()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("expected the connection over the limit to be closed")
+		}
+		var stats Stats
+		if err := first.Call("ShellRunner.Statistics", struct{}{}, &stats); err != nil {
+			t.Fatal(err)
+		}
+		if stats.RejectedConnections != 1 {
+			t.Errorf("expected 1 rejected connection, got %d", stats.RejectedConnections)
+		}
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		srv := New(runner.NewManager(runner.DefaultConfig()))
+		srv.IdleTimeout = 200 * time.Millisecond
+		c, done := connect(srv)
+		defer c.Close()
+
+		// A call longer than the idle timeout does not count as idle.
+		if err := c.Call("ShellRunner.Run", RunArgs{Command: "sleep 0.4"}, &RunResult{}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected the idle connection to be closed")
+		}
+		if err := c.Call("ShellRunner.Statistics", struct{}{}, &Stats{}); err == nil {
+			t.Error("expected a call on the closed connection to fail")
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		srv := New(runner.NewManager(runner.DefaultConfig()))
+		first, _ := connect(srv)
+		defer first.Close()
+		second, _ := connect(srv)
+		defer second.Close()
+
+		for i := 0; i < 2; i++ {
+			if err := first.Call("ShellRunner.Statistics", struct{}{}, &Stats{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var conns []ConnectionInfo
+		if err := first.Call("ShellRunner.Connections", struct{}{}, &conns); err != nil {
+			t.Fatal(err)
+		}
+		if len(conns) != 2 {
+			t.Fatalf("expected 2 connections, got %+v", conns)
+		}
+		if conns[0].ConnectedAt.After(conns[1].ConnectedAt) {
+			t.Errorf("expected the connections oldest first, got %+v", conns)
+		}
+		// The connections may have been accepted in either order.
+		busy, quiet := conns[0], conns[1]
+		if busy.Calls < quiet.Calls {
+			busy, quiet = quiet, busy
+		}
+		if busy.Calls != 3 || busy.InFlight != 1 {
+			t.Errorf("expected the calling connection to have made 3 calls, 1 in flight, got %+v", busy)
+		}
+		if quiet.Calls != 0 || quiet.Kind != "rpc" {
+			t.Errorf("expected the other connection to have made no calls, got %+v", quiet)
+		}
+	})
+}
+
+// BenchmarkBackground submits background jobs from parallel clients, as
+// BenchmarkCommandIssuing does, against a server of its own.
+func BenchmarkBackground(b *testing.B) {
+	socketPath := filepath.Join(b.TempDir(), "shellrunner.sock")
+	listener, err := Listen(socketPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	srv := New(runner.NewManager(runner.DefaultConfig()))
+	go srv.Serve(listener)
+	defer srv.Shutdown(context.Background())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		conn, err := net.Dial("unix", socketPath)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		c := jsonrpc.NewClient(conn)
+		defer c.Close()
+		var reply string
+		for pb.Next() {
+			if err := c.Call("ShellRunner.Background", "true", &reply); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
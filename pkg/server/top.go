@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"shellrunner/pkg/runner"
+)
+
+// maxTopInterval is the longest TopJobs samples jobs for.
+const maxTopInterval = 10 * time.Second
+
+// TopJobsArgs defines the arguments for the TopJobs method.
+type TopJobsArgs struct {
+	By              string  // "cpu", the default, or "rss"
+	Limit           int     // the most jobs returned, or all of them if 0
+	IntervalSeconds float64 // how long CPU use is sampled over; defaults to 1
+}
+
+// TopJob is a running job TopJobs reports.
+type TopJob struct {
+	ID         string    `json:"id"`
+	Command    string    `json:"command,omitempty"`
+	Argv       []string  `json:"argv,omitempty"`
+	Status     string    `json:"status"`
+	Submitter  string    `json:"submitter,omitempty"`
+	StartTime  time.Time `json:"start_time"`
+	CPUPercent float64   `json:"cpu_percent"` // of one CPU, over the interval
+	CPUSeconds float64   `json:"cpu_seconds"`
+	RSSBytes   uint64    `json:"rss_bytes"`
+	Processes  int       `json:"processes,omitempty"` // 0 for jobs sampled through their cgroup
+}
+
+// TopJobsResult is the reply of TopJobs.
+type TopJobsResult struct {
+	By              string   `json:"by"`
+	IntervalSeconds float64  `json:"interval_seconds"`
+	Jobs            []TopJob `json:"jobs"` // the most demanding first
+}
+
+// TopJobs samples what the running and paused jobs use and replies with
+// them ordered by CPU or by resident memory, so that the job overloading
+// the host can be found without leaving the API. The call takes as long as
+// the sampling interval.
+func (s *ShellRunner) TopJobs(args TopJobsArgs, reply *TopJobsResult) error {
+	runner.Logger.Printf("TopJobs called by %q with limit %d over %vs", args.By, args.Limit, args.IntervalSeconds)
+	interval := time.Duration(args.IntervalSeconds * float64(time.Second))
+	if args.IntervalSeconds == 0 {
+		interval = time.Second
+	}
+	if interval <= 0 || interval > maxTopInterval {
+		return &Error{Code: CodeInvalidArgument, Message: fmt.Sprintf("invalid interval %vs: must be more than 0 and at most %v", args.IntervalSeconds, maxTopInterval)}
+	}
+	jobs, err := s.manager.TopJobs(args.By, args.Limit, interval)
+	if err != nil {
+		return rpcError(err)
+	}
+	*reply = TopJobsResult{By: args.By, IntervalSeconds: interval.Seconds(), Jobs: []TopJob{}}
+	if reply.By == "" {
+		reply.By = runner.TopByCPU
+	}
+	for _, job := range jobs {
+		reply.Jobs = append(reply.Jobs, TopJob{
+			ID:         job.ID,
+			Command:    job.Command,
+			Argv:       job.Argv,
+			Status:     job.Status,
+			Submitter:  job.Submitter,
+			StartTime:  job.StartTime,
+			CPUPercent: job.CPUPercent,
+			CPUSeconds: job.CPUSeconds,
+			RSSBytes:   job.RSSBytes,
+			Processes:  job.Processes,
+		})
+	}
+	return nil
+}
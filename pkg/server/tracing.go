@@ -0,0 +1,273 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"shellrunner/pkg/runner"
+)
+
+// Tracer exports trace spans, for each RPC call and each job, to an
+// OpenTelemetry collector with OTLP over HTTP, in its JSON encoding.
+// Spans are sent in batches, at most every FlushInterval.
+type Tracer struct {
+	// Endpoint is the collector's base URL, such as
+	// http://localhost:4318; spans are posted to its /v1/traces.
+	Endpoint string
+	// Service is reported as the service.name of the spans.
+	Service string
+
+	mu      sync.Mutex
+	spans   []span
+	timer   *time.Timer
+	client  *http.Client
+	flushed chan struct{} // closed and replaced after each export
+}
+
+// FlushInterval is how long a Tracer holds spans before exporting them.
+var FlushInterval = 5 * time.Second
+
+// maxBatch is the number of spans after which a Tracer exports them without
+// waiting for FlushInterval.
+const maxBatch = 512
+
+// NewTracer returns a Tracer exporting to the collector at endpoint.
+func NewTracer(endpoint string) *Tracer {
+	return &Tracer{
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		Service:  "shellrunner",
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// span is a finished span, as encoded in OTLP JSON.
+type span struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []attribute `json:"attributes,omitempty"`
+	Status            spanStatus  `json:"status"`
+}
+
+// Span kinds and status codes of OTLP.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+
+	statusOK    = 1
+	statusError = 2
+)
+
+type spanStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type attribute struct {
+	Key   string         `json:"key"`
+	Value attributeValue `json:"value"`
+}
+
+type attributeValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+func stringAttribute(key, value string) attribute {
+	return attribute{key, attributeValue{StringValue: &value}}
+}
+
+func intAttribute(key string, value int) attribute {
+	s := strconv.Itoa(value)
+	return attribute{key, attributeValue{IntValue: &s}}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// record adds a finished span to the next batch.
+func (t *Tracer) record(s span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.spans = append(t.spans, s)
+	if len(t.spans) >= maxBatch {
+		go t.Flush(context.Background())
+	} else if t.timer == nil {
+		t.timer = time.AfterFunc(FlushInterval, func() { t.Flush(context.Background()) })
+	}
+}
+
+// rpcSpan records the span of a call to method, from start until now, and
+// traceCalls is the interceptor that exports a span for each call when
+// calls are traced. A call with a job's options joins the trace of their
+// TraceParent, and the job's span becomes a child of the call's.
+func (s *Server) traceCalls(call *Call, next Handler) error {
+	if s.Tracer == nil {
+		return next(call)
+	}
+	trace := runner.TraceContext{TraceID: runner.NewTraceID(16), SpanID: runner.NewTraceID(8)}
+	if opts, ok := call.Args.(*JobOptions); ok {
+		traceID, spanID, err := runner.ParseTraceParent(opts.TraceParent)
+		switch {
+		case opts.TraceParent == "":
+			opts.TraceParent = trace.TraceParent()
+		case err == nil:
+			trace.TraceID, trace.ParentSpanID = traceID, spanID
+			opts.TraceParent = trace.TraceParent()
+		}
+		// An invalid TraceParent is left for the call to reject.
+	}
+	err := next(call)
+	var message string
+	if err != nil {
+		message = err.Error()
+	}
+	s.Tracer.rpcSpan(trace, call.Method, call.Start, message)
+	return err
+}
+
+// fails it if errMessage is not empty.
+func (t *Tracer) rpcSpan(trace runner.TraceContext, method string, start time.Time, errMessage string) {
+	s := span{
+		TraceID:           trace.TraceID,
+		SpanID:            trace.SpanID,
+		ParentSpanID:      trace.ParentSpanID,
+		Name:              "ShellRunner." + method,
+		Kind:              spanKindServer,
+		StartTimeUnixNano: unixNano(start),
+		EndTimeUnixNano:   unixNano(time.Now()),
+		Attributes: []attribute{
+			stringAttribute("rpc.system", "jsonrpc"),
+			stringAttribute("rpc.service", "ShellRunner"),
+			stringAttribute("rpc.method", method),
+		},
+	}
+	if errMessage != "" {
+		rpcErr := ParseError(errMessage)
+		s.Status = spanStatus{Code: statusError, Message: rpcErr.Message}
+		s.Attributes = append(s.Attributes, stringAttribute("shellrunner.error_code", string(rpcErr.Code)))
+	}
+	t.record(s)
+}
+
+// jobSpan records the span of a job that has finished, from its start to
+// its end, if it has one.
+func (t *Tracer) jobSpan(job *runner.Job) {
+	if job.Trace.SpanID == "" {
+		return
+	}
+	command := job.Command
+	if command == "" {
+		command = strings.Join(job.Argv, " ")
+	}
+	s := span{
+		TraceID:           job.Trace.TraceID,
+		SpanID:            job.Trace.SpanID,
+		ParentSpanID:      job.Trace.ParentSpanID,
+		Name:              "job",
+		Kind:              spanKindInternal,
+		StartTimeUnixNano: unixNano(job.StartTime),
+		EndTimeUnixNano:   unixNano(job.EndTime),
+		Attributes: []attribute{
+			stringAttribute("shellrunner.job.command", command),
+			stringAttribute("shellrunner.job.status", job.Status),
+			stringAttribute("shellrunner.job.result", job.Result),
+			intAttribute("process.exit.code", job.ExitCode),
+		},
+		Status: spanStatus{Code: statusOK},
+	}
+	if job.ID != "" {
+		s.Attributes = append(s.Attributes, stringAttribute("shellrunner.job.id", job.ID))
+	}
+	if job.Signal != "" {
+		s.Attributes = append(s.Attributes, stringAttribute("shellrunner.job.signal", job.Signal))
+	}
+	if job.Result == runner.ResultFailure {
+		s.Status = spanStatus{Code: statusError, Message: job.FailureReason}
+	}
+	t.record(s)
+}
+
+// Flush exports the spans recorded so far, waiting for any export already
+// in progress first.
+func (t *Tracer) Flush(ctx context.Context) error {
+	t.mu.Lock()
+	for t.flushed != nil {
+		flushed := t.flushed
+		t.mu.Unlock()
+		select {
+		case <-flushed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		t.mu.Lock()
+	}
+	spans := t.spans
+	t.spans = nil
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	if len(spans) == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	t.flushed = make(chan struct{})
+	t.mu.Unlock()
+
+	err := t.export(ctx, spans)
+	if err != nil {
+		runner.Logger.Printf("Error exporting %d spans: %v", len(spans), err)
+	}
+
+	t.mu.Lock()
+	close(t.flushed)
+	t.flushed = nil
+	t.mu.Unlock()
+	return err
+}
+
+// export posts spans to the collector.
+func (t *Tracer) export(ctx context.Context, spans []span) error {
+	request := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []attribute{stringAttribute("service.name", t.Service)},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "shellrunner"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.Endpoint+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector replied %s", resp.Status)
+	}
+	return nil
+}
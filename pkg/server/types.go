@@ -0,0 +1,402 @@
+package server
+
+import (
+	"encoding/json"
+	"time"
+
+	"shellrunner/pkg/runner"
+)
+
+// The reply types of the ShellRunner methods. Fields the server leaves out
+// for a job are omitted from the JSON encoding.
+
+// Usage is the resource usage of a job placed in a cgroup. It is left empty
+// for jobs outside of cgroups.
+type Usage struct {
+	Cgroup          string  `json:"cgroup,omitempty"`
+	MemoryBytes     uint64  `json:"memory_bytes,omitempty"`
+	MemoryPeakBytes uint64  `json:"memory_peak_bytes,omitempty"`
+	CPUSeconds      float64 `json:"cpu_seconds,omitempty"`
+	OOMKills        uint64  `json:"oom_kills,omitempty"`
+}
+
+// RunResult is the reply of Run.
+type RunResult struct {
+	Stdout        string `json:"stdout"`
+	Stderr        string `json:"stderr"`
+	ExitCode      int    `json:"exit_code"`             // -1 if the command failed to start
+	Status        string `json:"status"`                // "exited" or "failed_to_start"
+	StartError    string `json:"start_error,omitempty"` // why the command could not be started
+	LimitExceeded string `json:"limit_exceeded,omitempty"`
+	Signal        string `json:"signal,omitempty"` // the signal that killed the command, if one did
+	CoreDumped    bool   `json:"core_dumped,omitempty"`
+	KilledBy      string `json:"killed_by,omitempty"` // what sent the signal, if known
+	Result        string `json:"result"`              // "success" or "failure"
+	FailureReason string `json:"failure_reason,omitempty"`
+	JobID         string `json:"job_id,omitempty"`    // set when the job was kept
+	Workspace     string `json:"workspace,omitempty"` // set when the workspace was kept
+	// Cached is set when the result is that of an earlier Run, for
+	// CacheTTL, whose job JobID is.
+	Cached bool `json:"cached,omitempty"`
+	// Artifacts are the copies of the files matching the job's artifact
+	// patterns, for kept jobs.
+	Artifacts []runner.Artifact `json:"artifacts,omitempty"`
+	// Parsed is stdout parsed as JSON, for ParseJSON, and ParseError why
+	// it could not be.
+	Parsed     json.RawMessage `json:"parsed,omitempty"`
+	ParseError string          `json:"parse_error,omitempty"`
+	// Encoding is "base64" if Stdout and Stderr are base64-encoded, and
+	// IsBinary set if either is binary; see Decode.
+	Encoding string `json:"encoding,omitempty"`
+	IsBinary bool   `json:"is_binary,omitempty"`
+	Usage
+}
+
+// JobStatus is the reply of Status.
+type JobStatus struct {
+	Command         string            `json:"command"`
+	Argv            []string          `json:"argv,omitempty"`
+	Pty             bool              `json:"pty,omitempty"`
+	Executor        string            `json:"executor,omitempty"`
+	Host            string            `json:"host,omitempty"`
+	Group           string            `json:"group,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	Submitter       *runner.Identity  `json:"submitter,omitempty"` // the client that submitted the job, where known
+	RerunOf         string            `json:"rerun_of,omitempty"`
+	ImportedFrom    string            `json:"imported_from,omitempty"`
+	Workspace       string            `json:"workspace,omitempty"`
+	LogFile         string            `json:"log_file,omitempty"`
+	LogSink         string            `json:"log_sink,omitempty"`
+	CaptureMode     string            `json:"capture_mode"`             // "full" or "ring"
+	RingBytes       int               `json:"ring_bytes,omitempty"`     // how much of each stream a ring keeps
+	StdoutDropped   int64             `json:"stdout_dropped,omitempty"` // bytes of stdout a ring has discarded
+	StderrDropped   int64             `json:"stderr_dropped,omitempty"`
+	Image           string            `json:"image,omitempty"`
+	Container       string            `json:"container,omitempty"`
+	Pod             string            `json:"pod,omitempty"`
+	Namespace       string            `json:"namespace,omitempty"`
+	PodPhase        string            `json:"pod_phase,omitempty"`
+	Status          string            `json:"status"`
+	StartTime       time.Time         `json:"start_time"`
+	DurationSeconds float64           `json:"duration_seconds"`
+	ExitCode        *int              `json:"exit_code,omitempty"`   // nil while running
+	StartError      string            `json:"start_error,omitempty"` // why the command could not be started, for failed_to_start
+	LimitExceeded   string            `json:"limit_exceeded,omitempty"`
+	Signal          string            `json:"signal,omitempty"` // the signal that killed the job, if one did
+	CoreDumped      bool              `json:"core_dumped,omitempty"`
+	KilledBy        string            `json:"killed_by,omitempty"` // what sent the signal, if known
+	Result          string            `json:"result,omitempty"`    // "success" or "failure", once finished
+	FailureReason   string            `json:"failure_reason,omitempty"`
+	Overrun         bool              `json:"overrun,omitempty"` // whether it ran for longer than expected
+	Umask           string            `json:"umask,omitempty"`
+	Locale          string            `json:"locale,omitempty"`
+	TZ              string            `json:"tz,omitempty"`
+	Nice            int               `json:"nice,omitempty"`
+	IONice          string            `json:"ionice,omitempty"`
+	CPUSet          string            `json:"cpu_set,omitempty"`
+	Sandboxed       bool              `json:"sandboxed,omitempty"`
+	NetworkIsolated bool              `json:"network_isolated,omitempty"`
+	TraceID         string            `json:"trace_id,omitempty"` // the job's span, if it has one
+	SpanID          string            `json:"span_id,omitempty"`
+	// Shell is the interpreter that ran the command string, for jobs with
+	// one, and Options all the options the job was run with, as normalized
+	// by the server, for audits.
+	Shell   string           `json:"shell,omitempty"`
+	Options *RecordedOptions `json:"options,omitempty"`
+
+	// The stages of the job's life: SubmittedAt is when the server accepted
+	// it, StartedAt, the same as StartTime, when its command started, and
+	// EndedAt, nil while it runs, when it ended. QueuedDurationSeconds is
+	// the time between submission and start, and RunDurationSeconds, the
+	// same as DurationSeconds, the time it has run for.
+	SubmittedAt           time.Time  `json:"submitted_at"`
+	StartedAt             time.Time  `json:"started_at"`
+	EndedAt               *time.Time `json:"ended_at,omitempty"`
+	QueuedDurationSeconds float64    `json:"queued_duration_seconds"`
+	RunDurationSeconds    float64    `json:"run_duration_seconds"`
+
+	// What the command has written so far, before any filtering, so that
+	// pollers can tell a job that has stopped making progress without
+	// fetching its output: bytes and newlines on each stream, when it last
+	// wrote anything, if it has, and the seconds since then, or since the
+	// job started if it has not. Stalled is set once that reaches the
+	// job's idle timeout.
+	StdoutBytes       int64      `json:"stdout_bytes"`
+	StdoutLines       int64      `json:"stdout_lines"`
+	StderrBytes       int64      `json:"stderr_bytes"`
+	StderrLines       int64      `json:"stderr_lines"`
+	LastOutputAt      *time.Time `json:"last_output_at,omitempty"`
+	OutputIdleSeconds float64    `json:"output_idle_seconds"`
+	Stalled           bool       `json:"stalled,omitempty"`
+	// Deadline is when the job's timeout kills it, as extended by
+	// ExtendTimeout, for jobs with a timeout.
+	Deadline *time.Time `json:"deadline,omitempty"`
+
+	// The progress the command last reported with a progress line, for
+	// jobs run with the progress option, once it has reported any.
+	ProgressPercent   *float64   `json:"progress_percent,omitempty"`
+	ProgressMessage   string     `json:"progress_message,omitempty"`
+	ProgressUpdatedAt *time.Time `json:"progress_updated_at,omitempty"`
+	Usage
+}
+
+// RecordedOptions are the options a job was run with, as its status reports
+// them. They are its JobOptions, except that whatever may hold a secret is
+// left out: the environment is given by variable names only, stdin by its
+// length and SHA-256 digest, and secrets by name, as always. Rerun runs the
+// job again with the options in full. The options that are objects keep the
+// field names JobOptions takes them with.
+type RecordedOptions struct {
+	Command            string                    `json:"command,omitempty"`
+	Argv               []string                  `json:"argv,omitempty"`
+	Env                []string                  `json:"env,omitempty"` // the names of the variables added
+	EnvFile            string                    `json:"env_file,omitempty"`
+	Secrets            map[string]string         `json:"secrets,omitempty"`
+	Dir                string                    `json:"dir,omitempty"`
+	StdinBytes         int                       `json:"stdin_bytes,omitempty"`
+	StdinSHA256        string                    `json:"stdin_sha256,omitempty"`
+	StdinOpen          bool                      `json:"stdin_open,omitempty"`
+	Timeout            float64                   `json:"timeout,omitempty"`
+	IdleTimeoutSeconds float64                   `json:"idle_timeout_seconds,omitempty"`
+	IdleAction         string                    `json:"idle_action,omitempty"`
+	Labels             map[string]string         `json:"labels,omitempty"`
+	Umask              string                    `json:"umask,omitempty"`
+	Locale             string                    `json:"locale,omitempty"`
+	TZ                 string                    `json:"tz,omitempty"`
+	Workspace          bool                      `json:"workspace,omitempty"`
+	KeepWorkspace      bool                      `json:"keep_workspace,omitempty"`
+	Artifacts          []string                  `json:"artifacts,omitempty"`
+	Progress           bool                      `json:"progress,omitempty"`
+	Filter             *runner.OutputFilter      `json:"filter,omitempty"`
+	Success            *SuccessOptions           `json:"success,omitempty"`
+	Notify             []runner.Notification     `json:"notify,omitempty"`
+	Expect             *ExpectOptions            `json:"expect,omitempty"`
+	LogFile            string                    `json:"log_file,omitempty"`
+	LogOnly            bool                      `json:"log_only,omitempty"`
+	CaptureMode        string                    `json:"capture_mode,omitempty"`
+	RingBytes          int                       `json:"ring_bytes,omitempty"`
+	LogSink            string                    `json:"log_sink,omitempty"`
+	Limits             *runner.ResourceLimits    `json:"limits,omitempty"`
+	Cgroup             *runner.CgroupLimits      `json:"cgroup,omitempty"`
+	Nice               int                       `json:"nice,omitempty"`
+	IONice             string                    `json:"ionice,omitempty"`
+	CPUSet             string                    `json:"cpu_set,omitempty"`
+	Sandbox            *runner.SandboxOptions    `json:"sandbox,omitempty"`
+	Executor           string                    `json:"executor,omitempty"`
+	Container          *runner.ContainerOptions  `json:"container,omitempty"`
+	Host               string                    `json:"host,omitempty"`
+	Kubernetes         *runner.KubernetesOptions `json:"kubernetes,omitempty"`
+	TraceParent        string                    `json:"trace_parent,omitempty"`
+	Pty                bool                      `json:"pty,omitempty"`
+	Rows               uint16                    `json:"rows,omitempty"`
+	Cols               uint16                    `json:"cols,omitempty"`
+}
+
+// Finished reports whether the job has stopped running.
+func (s JobStatus) Finished() bool {
+	return s.Status != "running" && s.Status != "paused"
+}
+
+// JobList is the reply of List.
+type JobList struct {
+	Jobs        []runner.JobListEntry `json:"jobs"`
+	Total       int                   `json:"total"`                   // the number of jobs on the server
+	NextAfterID string                `json:"next_after_id,omitempty"` // the AfterID of the next page, if there is one
+}
+
+// KillAllResult is the reply of KillAll.
+type KillAllResult struct {
+	Killed []string          `json:"killed"`           // the IDs of the jobs signalled, in order
+	Failed map[string]string `json:"failed,omitempty"` // why signalling a job failed, keyed by its ID
+}
+
+// JobOutput is the reply of Output and Since. Since only sets Status and
+// ExitCode once the job has finished.
+type JobOutput struct {
+	Stdout   string   `json:"stdout"`
+	Stderr   string   `json:"stderr"`
+	Argv     []string `json:"argv,omitempty"`
+	Status   string   `json:"status,omitempty"`
+	ExitCode *int     `json:"exit_code,omitempty"`
+	// Encoding and IsBinary are set by Output as for RunResult.
+	Encoding string `json:"encoding,omitempty"`
+	IsBinary bool   `json:"is_binary,omitempty"`
+}
+
+// DiffResult holds the differences between the output of two jobs, as
+// unified diffs that are empty where the output is the same.
+type DiffResult struct {
+	Stdout    string `json:"stdout"`
+	Stderr    string `json:"stderr,omitempty"`
+	Identical bool   `json:"identical"` // whether the compared output is the same
+}
+
+// SearchResult holds the lines of job output found by Search.
+type SearchResult struct {
+	Matches   []SearchMatch `json:"matches"`
+	Truncated bool          `json:"truncated,omitempty"` // more lines matched than the limit
+}
+
+// SearchMatch is a line of a job's output that matched a search, with the
+// lines around it.
+type SearchMatch struct {
+	JobID  string   `json:"job_id"`
+	Stream string   `json:"stream"` // "stdout" or "stderr"
+	Line   int      `json:"line"`   // counting from 1
+	Text   string   `json:"text"`
+	Before []string `json:"before,omitempty"`
+	After  []string `json:"after,omitempty"`
+}
+
+// FileChunk is a chunk of a file read by GetFile.
+type FileChunk struct {
+	Data []byte `json:"data"` // base64-encoded in JSON
+	Size int64  `json:"size"` // of the whole file
+	EOF  bool   `json:"eof"`  // whether the chunk ends the file
+	Mode uint32 `json:"mode"` // the file's permissions
+}
+
+// GroupJob is a single job of a group.
+type GroupJob struct {
+	ID       string `json:"id"`
+	Host     string `json:"host"`
+	Status   string `json:"status"`
+	ExitCode *int   `json:"exit_code,omitempty"` // nil while running
+}
+
+// GroupStatus is the reply of Group.
+type GroupStatus struct {
+	Status string     `json:"status"`
+	Jobs   []GroupJob `json:"jobs"`
+}
+
+// Alert is an alert Alerts reports.
+type Alert struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"` // "overrun", "missed", "slower" or "failing"
+	JobID   string    `json:"job_id,omitempty"`
+	Check   string    `json:"check,omitempty"`
+	Message string    `json:"message"`
+}
+
+// Check is the state of a check Alerts reports.
+type Check struct {
+	Name         string     `json:"name"`
+	EverySeconds float64    `json:"every_seconds"`
+	LastJobID    string     `json:"last_job_id,omitempty"`
+	LastSuccess  *time.Time `json:"last_success,omitempty"` // nil until a job of it succeeds
+	Due          time.Time  `json:"due"`
+	Missed       bool       `json:"missed"`
+}
+
+// AlertsResult is the reply of Alerts.
+type AlertsResult struct {
+	Alerts []Alert `json:"alerts"` // the last 100, oldest first
+	Checks []Check `json:"checks"` // in order of name
+}
+
+// Trend is the trend of a series of jobs Trends reports.
+type Trend struct {
+	Series                  string    `json:"series"`
+	Runs                    int       `json:"runs"`
+	BaselineDurationSeconds float64   `json:"baseline_duration_seconds"` // 0 until there are enough runs
+	RecentDurationSeconds   float64   `json:"recent_duration_seconds"`
+	Deviation               float64   `json:"deviation"` // recent over baseline
+	Slower                  bool      `json:"slower"`
+	FailureStreak           int       `json:"failure_streak"`
+	SuccessRate             float64   `json:"success_rate"`
+	FailureRate             float64   `json:"failure_rate"` // of the last failure_window runs
+	MaxFailureRate          float64   `json:"max_failure_rate,omitempty"`
+	FailureWindow           int       `json:"failure_window"`
+	Failing                 bool      `json:"failing"`
+	LastJobID               string    `json:"last_job_id,omitempty"`
+	LastExitCode            int       `json:"last_exit_code"`
+	LastRun                 time.Time `json:"last_run"`
+}
+
+// TrendsResult is the reply of Trends.
+type TrendsResult struct {
+	Trends []Trend `json:"trends"` // in order of series
+}
+
+// AdminJob is a job AdminJobs lists.
+type AdminJob struct {
+	ID              string           `json:"id"`
+	Tenant          string           `json:"tenant"`
+	Submitter       *runner.Identity `json:"submitter,omitempty"`
+	Command         string           `json:"command"`
+	Argv            []string         `json:"argv,omitempty"`
+	Status          string           `json:"status"`
+	StartTime       time.Time        `json:"start_time"`
+	DurationSeconds float64          `json:"duration_seconds"`
+	BufferedBytes   int64            `json:"buffered_bytes"` // output held in memory
+}
+
+// AdminJobList is the reply of AdminJobs.
+type AdminJobList struct {
+	Jobs []AdminJob `json:"jobs"`
+}
+
+// AdminReleaseResult is the reply of AdminRelease.
+type AdminReleaseResult struct {
+	Released []string          `json:"released"`
+	Failed   map[string]string `json:"failed,omitempty"` // why each job that was not released was not
+}
+
+// TenantStats are the statistics, quota and usage of a tenant.
+type TenantStats struct {
+	QuotaUsage
+	Stats IdentityStats `json:"stats"`
+}
+
+// TenantList is the reply of AdminTenants.
+type TenantList struct {
+	Tenants []TenantStats `json:"tenants"`
+}
+
+// Stats is the reply of Statistics.
+type Stats struct {
+	TotalCount             int64   `json:"total_count"`
+	AverageDurationSeconds float64 `json:"average_duration_seconds"`
+	MaxDurationSeconds     float64 `json:"max_duration_seconds"`
+	TotalStdoutBytes       int64   `json:"total_stdout_bytes"`
+	TotalStderrBytes       int64   `json:"total_stderr_bytes"`
+	SuccessCount           int64   `json:"success_count"`
+	FailureCount           int64   `json:"failure_count"`
+	BufferedBytes          int64   `json:"buffered_bytes"`     // job output held in memory
+	MaxBufferedBytes       int64   `json:"max_buffered_bytes"` // 0 if unlimited
+	BusyWorkers            int     `json:"busy_workers"`       // jobs running now
+	Workers                int     `json:"workers"`            // 0 if unlimited
+	SlowCalls              int64   `json:"slow_calls"`
+	TimedOutCalls          int64   `json:"timed_out_calls"`
+	RateLimitedCalls       int64   `json:"rate_limited_calls"`
+	QuotaExceededCalls     int64   `json:"quota_exceeded_calls"`
+	PermissionDeniedCalls  int64   `json:"permission_denied_calls"` // calls refused by the ACL or for not being an admin
+	CachedRuns             int64   `json:"cached_runs"`             // Runs answered from the cache, for CacheTTL
+	RejectedConnections    int64   `json:"rejected_connections"`
+	AuthFailures           int64   `json:"auth_failures"` // clients refused by a listener's authentication
+	// Identities are the statistics of the jobs each client submitted,
+	// keyed by its identity as runner.Identity.String returns it, or
+	// "unknown".
+	Identities map[string]IdentityStats `json:"identities,omitempty"`
+	// Methods are the statistics of the calls to each method, by name.
+	Methods map[string]MethodStats `json:"methods"`
+	// Host is how much headroom the server's host has left, where the host
+	// reports it.
+	Host *HostStats `json:"host,omitempty"`
+}
+
+// HostStats is how much headroom the server's host has left, as Statistics
+// reports it.
+type HostStats struct {
+	Load1                float64 `json:"load1"`
+	Load5                float64 `json:"load5"`
+	Load15               float64 `json:"load15"`
+	CPUs                 int     `json:"cpus"`
+	MemoryTotalBytes     uint64  `json:"memory_total_bytes"`
+	MemoryAvailableBytes uint64  `json:"memory_available_bytes"`
+	SpoolDir             string  `json:"spool_dir"` // where workspaces and artifacts are kept
+	SpoolTotalBytes      uint64  `json:"spool_total_bytes"`
+	SpoolFreeBytes       uint64  `json:"spool_free_bytes"`
+}
@@ -0,0 +1,489 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"shellrunner/pkg/runner"
+)
+
+// upgradeEnv tells a server that Upgrade started how many listeners it
+// inherits.
+const upgradeEnv = "SHELLRUNNER_UPGRADE"
+
+// The files a server that Upgrade started inherits, after stdin, stdout and
+// stderr: the pipe it receives the jobs of the server it replaces on, the
+// pipe it tells that server it is ready on, the pipes it forwards calls to
+// that server on and reads their replies from, then its listeners, in the
+// order of its listener configs.
+const (
+	handoffFD       = 3
+	readyFD         = 4
+	callsFD         = 5
+	repliesFD       = 6
+	firstListenerFD = 7
+)
+
+// upgradeTimeout is how long Upgrade waits for the new server to be ready
+// before giving up on it.
+const upgradeTimeout = 30 * time.Second
+
+// drainInterval is how often a server that has handed over checks for jobs
+// that have finished since.
+const drainInterval = 200 * time.Millisecond
+
+// handoff is what a server hands over to the one that replaces it first:
+// the counters its job and group IDs were at, the jobs that had finished,
+// and the submitters of those still running, by ID, whose calls the new
+// server forwards to it. The records of the jobs that were still running
+// follow, one at a time, as each finishes.
+type handoff struct {
+	JobCounter   uint64                     `json:"job_counter"`
+	GroupCounter uint64                     `json:"group_counter"`
+	Jobs         []runner.JobRecord         `json:"jobs"`
+	Running      map[string]runner.Identity `json:"running,omitempty"`
+}
+
+// handOverMethods are the methods that add jobs, which a server that has
+// handed over refuses: their jobs would be numbered past the IDs the new
+// server took over.
+var handOverMethods = []string{"Run", "Background", "Rerun", "Exec", "Import", "AdminRestore"}
+
+// addsJobs reports whether call adds jobs with IDs: those of
+// handOverMethods, except Runs that do not keep their jobs.
+func addsJobs(call *Call) bool {
+	if call.Method == "Run" {
+		return call.Args.(*RunArgs).Keep
+	}
+	return slices.Contains(handOverMethods, call.Method)
+}
+
+// refuseHandedOver is the interceptor that fails the calls that add jobs
+// once the server has handed over to an upgraded one, so that clients
+// reconnect to it to add them. Upgrade waits for those in progress.
+func (s *Server) refuseHandedOver(call *Call, next Handler) error {
+	if !addsJobs(call) {
+		return next(call)
+	}
+	s.adding.Lock()
+	if s.handedOver.Load() {
+		s.adding.Unlock()
+		return &Error{
+			Code:    CodeUnavailable,
+			Message: "the server has been upgraded: reconnect to add jobs",
+			Details: map[string]interface{}{"method": call.Method},
+		}
+	}
+	s.addingCalls.Add(1)
+	s.adding.Unlock()
+	defer s.addingCalls.Done()
+	return next(call)
+}
+
+// stopAdding refuses the calls that add jobs from then on, and waits for
+// those in progress to return. The calls that come meanwhile are refused
+// at once, rather than held up behind them.
+func (s *Server) stopAdding() {
+	s.adding.Lock()
+	s.handedOver.Store(true)
+	s.adding.Unlock()
+	s.addingCalls.Wait()
+}
+
+// HandedOver reports whether the server has handed over to an upgraded one.
+func (s *Server) HandedOver() bool {
+	return s.handedOver.Load()
+}
+
+// Upgrade hands the server over to a new process running the server's
+// executable, as it was started, with env added to its environment. The new
+// server inherits the sockets of listeners, which it makes its own listeners
+// of in the same order, so that no connection is refused in between, and
+// the server's jobs with their IDs.
+//
+// From then on, the server refuses calls that add jobs, once those in
+// progress, such as kept Runs, have returned. Once the new server is ready,
+// it stops accepting connections, but serves those it has until its jobs
+// have finished, handing each over as it does, and its calls are answered;
+// meanwhile, the new server forwards the calls for the jobs still running
+// to it. Then it shuts down and Upgrade returns. If the new server fails to start,
+// Upgrade returns an error and the server carries on as before.
+func (s *Server) Upgrade(listeners []net.Listener, env []string) error {
+	if s.handedOver.Load() {
+		return errors.New("the server has already handed over")
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, listener := range listeners {
+		l, ok := listener.(filer)
+		if !ok {
+			return fmt.Errorf("listener on %s cannot be handed over", listener.Addr())
+		}
+		f, err := l.File()
+		if err != nil {
+			return fmt.Errorf("handing over listener on %s: %w", listener.Addr(), err)
+		}
+		files = append(files, f)
+	}
+	handoffR, handoffW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer handoffW.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		handoffR.Close()
+		return err
+	}
+	defer readyR.Close()
+	callsR, callsW, err := os.Pipe()
+	if err != nil {
+		handoffR.Close()
+		readyW.Close()
+		return err
+	}
+	repliesR, repliesW, err := os.Pipe()
+	if err != nil {
+		handoffR.Close()
+		readyW.Close()
+		callsR.Close()
+		callsW.Close()
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(append(os.Environ(), env...), upgradeEnv+"="+strconv.Itoa(len(files)))
+	cmd.ExtraFiles = append([]*os.File{handoffR, readyW, callsW, repliesR}, files...)
+	err = cmd.Start()
+	handoffR.Close()
+	readyW.Close()
+	callsW.Close()
+	repliesR.Close()
+	if err != nil {
+		callsR.Close()
+		repliesW.Close()
+		return fmt.Errorf("starting the new server: %w", err)
+	}
+	// The forwarded calls are served until the new server closes its end,
+	// or exits.
+	go s.serveForwarded(pipeConn{r: callsR, w: repliesW})
+	runner.Logger.Printf("Handing over to the new server, process %d", cmd.Process.Pid)
+
+	// No job may be added once the counters are taken, as the new server
+	// only steers clear of the IDs up to them, so the calls adding jobs
+	// are refused from now on, and those in progress are waited for. The
+	// records of the finished jobs are sent while the new server starts,
+	// so that it holds them once it is ready, and jobs finishing in the
+	// meantime are sent along with the others later.
+	s.stopAdding()
+	jobs, groups := s.manager.IDCounters()
+	state := handoff{JobCounter: jobs, GroupCounter: groups, Running: make(map[string]runner.Identity)}
+	sent := make(map[string]bool)
+	s.manager.EachJob(runner.JobFilter{}, func(job *runner.Job) {
+		if job.Finished() {
+			state.Jobs = append(state.Jobs, job.Record())
+			sent[job.ID] = true
+		} else {
+			state.Running[job.ID] = job.Spec.Submitter
+		}
+	})
+	enc := json.NewEncoder(handoffW)
+	sending := make(chan error, 1)
+	go func() { sending <- enc.Encode(state) }()
+
+	ready := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		if _, err := readyR.Read(b[:]); err != nil {
+			ready <- errors.New("the new server exited before it was ready")
+			return
+		}
+		ready <- nil
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeTimeout):
+		err = fmt.Errorf("the new server was not ready after %v", upgradeTimeout)
+	}
+	if err == nil {
+		err = <-sending
+	}
+	if err != nil {
+		s.handedOver.Store(false)
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return err
+	}
+	go cmd.Wait()
+
+	// The sockets now belong to the new server, which removes the socket
+	// files when it no longer needs them.
+	for _, listener := range listeners {
+		if l, ok := listener.(*net.UnixListener); ok {
+			l.SetUnlinkOnClose(false)
+		}
+		listener.Close()
+	}
+	runner.Logger.Printf("Handed over to process %d; finishing the jobs in progress", cmd.Process.Pid)
+	s.drain(enc, sent)
+	return nil
+}
+
+// drain hands over the jobs of a server that has handed over as they
+// finish, until none is left running and no call is in progress, and then
+// shuts the server down.
+func (s *Server) drain(enc *json.Encoder, sent map[string]bool) {
+	for {
+		running := 0
+		var records []runner.JobRecord
+		s.manager.EachJob(runner.JobFilter{}, func(job *runner.Job) {
+			switch {
+			case !job.Finished():
+				running++
+			case !sent[job.ID]:
+				records = append(records, job.Record())
+				sent[job.ID] = true
+			}
+		})
+		for _, record := range records {
+			if err := enc.Encode(record); err != nil {
+				runner.Logger.Printf("Error handing over job %s: %v", record.ID, err)
+			}
+		}
+		if running == 0 && !s.callsInProgress() {
+			break
+		}
+		time.Sleep(drainInterval)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		runner.Logger.Printf("Calls still in progress at shutdown: %v", err)
+	}
+}
+
+// callsInProgress reports whether a call is in progress on any connection.
+func (s *Server) callsInProgress() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.mu.Lock()
+		inFlight := c.inFlight
+		c.mu.Unlock()
+		if inFlight > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// serveForwarded serves the calls the server that replaces this one
+// forwards on conn, for the jobs this server still runs.
+func (s *Server) serveForwarded(conn io.ReadWriteCloser) {
+	receiver := s.receiver(s.ctx, "")
+	receiver.forwarded = true
+	receiver.serveCodec(jsonrpc.NewServerCodec(conn))
+}
+
+// pipeConn is a connection made of a pipe to read from and one to write to.
+type pipeConn struct {
+	r, w *os.File
+}
+
+func (c pipeConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c pipeConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+func (c pipeConn) Close() error {
+	c.w.Close()
+	return c.r.Close()
+}
+
+// predecessor is the server a server that Upgrade started replaces, as long
+// as it runs jobs that it has not handed over yet.
+type predecessor struct {
+	client *rpc.Client
+	mu     sync.Mutex
+	// running holds the submitters of its jobs still running, by ID.
+	running map[string]runner.Identity
+}
+
+// submitter returns the submitter of job id and whether the predecessor
+// still runs it.
+func (p *predecessor) submitter(id string) (runner.Identity, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	submitter, ok := p.running[id]
+	return submitter, ok
+}
+
+// handedOver records that job id has been handed over.
+func (p *predecessor) handedOver(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.running, id)
+}
+
+// close forgets the jobs the predecessor ran, once it has handed them all
+// over and gone.
+func (p *predecessor) close() {
+	p.mu.Lock()
+	p.running = nil
+	p.mu.Unlock()
+	p.client.Close()
+}
+
+// forwardMethods are the jobMethods a server that Upgrade started forwards
+// to the server it replaces, for the jobs that server still runs. The other
+// jobMethods fail with UNAVAILABLE for those jobs until they are handed
+// over.
+var forwardMethods = []string{
+	"Status", "Output", "Since", "Artifacts", "Kill", "Pause", "Resume", "Release",
+	"WriteStdin", "CloseStdin", "ExtendTimeout", "Annotate", "Resize",
+}
+
+// forwardRunning is the interceptor that forwards the calls naming a job
+// that the server this one replaces still runs to that server, so that the
+// job can be followed and controlled through the upgrade. A call finds the
+// job here once it has been handed over.
+func (s *Server) forwardRunning(call *Call, next Handler) error {
+	p := s.predecessor
+	if p == nil || !slices.Contains(jobMethods, call.Method) {
+		return next(call)
+	}
+	ids := jobIDs(call)
+	forward := false
+	for _, id := range ids {
+		if _, ok := p.submitter(id); ok {
+			forward = true
+		}
+	}
+	if !forward {
+		return next(call)
+	}
+	if !slices.Contains(forwardMethods, call.Method) || len(ids) != 1 {
+		return &Error{
+			Code:    CodeUnavailable,
+			Message: fmt.Sprintf("%s is unavailable for jobs still running on the server being upgraded: retry once they have finished", call.Method),
+			Details: map[string]interface{}{"method": call.Method},
+		}
+	}
+	err := p.client.Call("ShellRunner."+call.Method, call.Args, call.Reply)
+	var serverErr rpc.ServerError
+	switch {
+	case errors.As(err, &serverErr):
+		return ParseError(string(serverErr))
+	case err != nil:
+		// The old server is gone, having handed over its jobs.
+		return next(call)
+	}
+	return nil
+}
+
+// Inheritance is what a server that Upgrade started inherits from the one
+// it replaces.
+type Inheritance struct {
+	// Listeners are the sockets of the listeners of the server it
+	// replaces, in the order of their configs, for ListenFile.
+	Listeners []*os.File
+	handoff   *os.File
+	ready     *os.File
+	calls     *os.File
+	replies   *os.File
+}
+
+// Inherited returns what the server inherits from the one it replaces, or
+// nil if Upgrade did not start it.
+func Inherited() (*Inheritance, error) {
+	value, ok := os.LookupEnv(upgradeEnv)
+	if !ok {
+		return nil, nil
+	}
+	// Jobs are not to think they are upgraded servers.
+	os.Unsetenv(upgradeEnv)
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid %s %q", upgradeEnv, value)
+	}
+	in := &Inheritance{
+		handoff: os.NewFile(handoffFD, "handoff"),
+		ready:   os.NewFile(readyFD, "ready"),
+		calls:   os.NewFile(callsFD, "calls"),
+		replies: os.NewFile(repliesFD, "replies"),
+	}
+	for i := range n {
+		in.Listeners = append(in.Listeners, os.NewFile(uintptr(firstListenerFD+i), "listener-"+strconv.Itoa(i)))
+	}
+	return in, nil
+}
+
+// TakeOver takes the jobs over from the server in hands over from, keeping
+// their IDs, and tells it the server is ready. The jobs that were still
+// running are taken over as they finish, in the background, and the calls
+// for them are forwarded to the old server until then. It must be called
+// before the server serves any connection.
+func (s *Server) TakeOver(in *Inheritance) error {
+	defer in.ready.Close()
+	conn := pipeConn{r: in.replies, w: in.calls}
+	dec := json.NewDecoder(in.handoff)
+	var state handoff
+	if err := dec.Decode(&state); err != nil {
+		in.handoff.Close()
+		conn.Close()
+		return fmt.Errorf("reading the jobs handed over: %w", err)
+	}
+	s.manager.SkipIDs(state.JobCounter, state.GroupCounter)
+	if err := s.manager.Adopt(state.Jobs); err != nil {
+		in.handoff.Close()
+		conn.Close()
+		return err
+	}
+	p := &predecessor{client: jsonrpc.NewClient(conn), running: state.Running}
+	if _, err := in.ready.Write([]byte{1}); err != nil {
+		in.handoff.Close()
+		p.close()
+		return fmt.Errorf("telling the old server it is ready: %w", err)
+	}
+	s.predecessor = p
+	go func() {
+		defer in.handoff.Close()
+		defer p.close()
+		for {
+			var record runner.JobRecord
+			err := dec.Decode(&record)
+			if errors.Is(err, io.EOF) {
+				runner.Logger.Printf("The old server has handed over all its jobs")
+				return
+			}
+			if err != nil {
+				runner.Logger.Printf("Error reading the jobs handed over: %v", err)
+				return
+			}
+			if err := s.manager.Adopt([]runner.JobRecord{record}); err != nil {
+				runner.Logger.Printf("Error taking over job %s: %v", record.ID, err)
+			}
+			p.handedOver(record.ID)
+		}
+	}()
+	return nil
+}
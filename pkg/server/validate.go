@@ -0,0 +1,32 @@
+package server
+
+import (
+	"shellrunner/pkg/runner"
+)
+
+// ValidateArgs defines the arguments for the Validate method.
+type ValidateArgs struct {
+	Command string
+}
+
+// ValidateResult is the reply of Validate.
+type ValidateResult struct {
+	Valid  bool                 `json:"valid"`
+	Errors []runner.SyntaxError `json:"errors,omitempty"`
+}
+
+// Validate checks the syntax of a command string with the server's shell,
+// without running it, so that tools can point out mistakes in a command
+// before submitting it.
+func (s *ShellRunner) Validate(args ValidateArgs, reply *ValidateResult) error {
+	if err := s.server.checkCommand("Validate", args.Command, nil); err != nil {
+		return err
+	}
+	runner.Logger.Printf("Validate called with command: %q", args.Command)
+	errs, err := runner.CheckSyntax(args.Command)
+	if err != nil {
+		return rpcError(err)
+	}
+	*reply = ValidateResult{Valid: len(errs) == 0, Errors: errs}
+	return nil
+}